@@ -4,27 +4,38 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	httpSwagger "github.com/swaggo/http-swagger"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/square/etre"
 	"github.com/square/etre/app"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
+	"github.com/square/etre/config"
 	"github.com/square/etre/docs"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/metrics"
@@ -37,6 +48,37 @@ func init() {
 
 const reqKey = "rc"
 
+const (
+	// BATCH_QUERY_MAX is the maximum number of queries in a batch query.
+	BATCH_QUERY_MAX = 100
+
+	// BATCH_QUERY_WORKERS is the maximum number of queries in a batch query
+	// that run concurrently.
+	BATCH_QUERY_WORKERS = 4
+
+	// QUERY_MAX_LENGTH is the maximum length (bytes) of a query (label selector)
+	// in any endpoint: the "query" URL param, the POST /query/:type body, and each
+	// query in a batch query. It is the same for all endpoints so that a query
+	// valid in one is valid in the others.
+	QUERY_MAX_LENGTH = 64 << 10 // 64 KiB
+
+	// EXPORT_FLUSH_ENTITIES is the number of entities between flushes of an export
+	// response, so the client receives the stream in chunks instead of the server
+	// buffering it.
+	EXPORT_FLUSH_ENTITIES = 100
+
+	// IMPORT_BATCH_SIZE_MAX is the maximum batchSize of an import. The default is
+	// config.server.import_batch_size.
+	IMPORT_BATCH_SIZE_MAX = 10000
+
+	// IMPORT_MAX_ERRORS is the maximum number of entity errors in an import result.
+	// All entities not inserted are counted in ImportResult.Failed.
+	IMPORT_MAX_ERRORS = 1000
+
+	// CDC_REPLAY_MAX_EVENTS is the maximum range of sequence numbers in a CDC replay.
+	CDC_REPLAY_MAX_EVENTS = 10000
+)
+
 type req struct {
 	ctx        context.Context
 	caller     auth.Caller
@@ -45,7 +87,10 @@ type req struct {
 	inst       app.Instrument
 	entityType string
 	entityId   string
+	requestId  string // etre.REQUEST_ID_HEADER from client or server-generated
+	span       trace.Span
 	write      bool
+	autoSet    bool // true if wo set is server-generated
 }
 
 // API provides controllers for endpoints it registers with a router.
@@ -55,16 +100,24 @@ type API struct {
 	key                      string
 	es                       entity.Store
 	validate                 entity.Validator
-	auth                     auth.Plugin
+	auth                     auth.Manager
 	metricsStore             metrics.Store
 	cdcDisabled              bool
+	cdcStore                 cdc.Store
+	cdcMaxHistory            int
 	streamFactory            changestream.StreamerFactory
+	changesServer            changestream.Server
 	metricsFactory           metrics.Factory
 	systemMetrics            metrics.Metrics
 	queryTimeout             time.Duration
 	queryLatencySLA          time.Duration
 	queryProfSampleRate      int
 	queryProfReportThreshold time.Duration
+	entityConfig             config.EntityConfig
+	rateLimiter              *rateLimiter
+	maxBodyBytes             int64
+	importBatchSize          int
+	health                   *app.Health
 	srv                      *http.Server
 }
 
@@ -87,7 +140,10 @@ func NewAPI(appCtx app.Context) *API {
 		validate:                 appCtx.EntityValidator,
 		auth:                     appCtx.Auth,
 		cdcDisabled:              appCtx.Config.CDC.Disabled,
+		cdcStore:                 appCtx.CDCStore,
+		cdcMaxHistory:            appCtx.Config.CDC.MaxHistory,
 		streamFactory:            appCtx.StreamerFactory,
+		changesServer:            appCtx.ChangesServer,
 		metricsFactory:           appCtx.MetricsFactory,
 		metricsStore:             appCtx.MetricsStore,
 		systemMetrics:            appCtx.SystemMetrics,
@@ -95,6 +151,17 @@ func NewAPI(appCtx app.Context) *API {
 		queryLatencySLA:          queryLatencySLA,
 		queryProfSampleRate:      int(appCtx.Config.Metrics.QueryProfileSampleRate * 100),
 		queryProfReportThreshold: queryProfReportThreshold,
+		entityConfig:             appCtx.Config.Entity,
+		rateLimiter:              newRateLimiter(appCtx.Config.Server.RateLimit),
+		maxBodyBytes:             appCtx.Config.Server.MaxBodyBytes,
+		importBatchSize:          appCtx.Config.Server.ImportBatchSize,
+		health:                   appCtx.Health,
+	}
+	if api.maxBodyBytes <= 0 {
+		api.maxBodyBytes = config.DEFAULT_MAX_BODY_BYTES
+	}
+	if api.importBatchSize <= 0 {
+		api.importBatchSize = config.DEFAULT_IMPORT_BATCH_SIZE
 	}
 
 	mux := http.NewServeMux()
@@ -103,21 +170,37 @@ func NewAPI(appCtx app.Context) *API {
 	// Query
 	// /////////////////////////////////////////////////////////////////////
 	mux.Handle("GET "+etre.API_ROOT+"/entities/{type}", api.requestWrapper(http.HandlerFunc(api.getEntitiesHandler)))
+	mux.Handle("HEAD "+etre.API_ROOT+"/entities/{type}", api.requestWrapper(http.HandlerFunc(api.headEntitiesHandler)))
+	mux.Handle("POST "+etre.API_ROOT+"/query/{type}", api.readRequestWrapper(http.HandlerFunc(api.queryHandler)))
+	mux.Handle("POST "+etre.API_ROOT+"/entities/{type}/batch-query", api.readRequestWrapper(http.HandlerFunc(api.batchQueryHandler)))
+	mux.Handle("GET "+etre.API_ROOT+"/entities/{type}/export", api.requestWrapper(http.HandlerFunc(api.exportHandler)))
+	mux.Handle("GET "+etre.API_ROOT+"/entities/{type}/aggregate", api.requestWrapper(http.HandlerFunc(api.aggregateHandler)))
+	mux.Handle("GET "+etre.API_ROOT+"/entities/{type}/by-ids", api.requestWrapper(http.HandlerFunc(api.readByIdsHandler)))
+	mux.Handle("POST "+etre.API_ROOT+"/entities/{type}/by-ids", api.readRequestWrapper(http.HandlerFunc(api.readByIdsHandler)))
 
 	// /////////////////////////////////////////////////////////////////////
 	// Bulk Write
 	// /////////////////////////////////////////////////////////////////////
 	mux.Handle("POST "+etre.API_ROOT+"/entities/{type}", api.requestWrapper(http.HandlerFunc(api.postEntitiesHandler)))
+	mux.Handle("POST "+etre.API_ROOT+"/entities/{type}/import", api.requestWrapper(http.HandlerFunc(api.importHandler)))
 	mux.Handle("PUT "+etre.API_ROOT+"/entities/{type}", api.requestWrapper(http.HandlerFunc(api.putEntitiesHandler)))
 	mux.Handle("DELETE "+etre.API_ROOT+"/entities/{type}", api.requestWrapper(http.HandlerFunc(api.deleteEntitiesHandler)))
+	mux.Handle("DELETE "+etre.API_ROOT+"/entities/{type}/all", api.requestWrapper(http.HandlerFunc(api.deleteAllHandler)))
+	mux.Handle("DELETE "+etre.API_ROOT+"/entities/{type}/labels/{label}", api.requestWrapper(http.HandlerFunc(api.deleteLabelByQueryHandler)))
+	mux.Handle("PUT "+etre.API_ROOT+"/entities/{type}/labels/{label}", api.requestWrapper(http.HandlerFunc(api.renameLabelHandler)))
+	mux.Handle("PUT "+etre.API_ROOT+"/entities/{type}/restore", api.requestWrapper(http.HandlerFunc(api.restoreEntitiesHandler)))
 
 	// /////////////////////////////////////////////////////////////////////
 	// Single Entity
 	// /////////////////////////////////////////////////////////////////////
 	mux.Handle("POST "+etre.API_ROOT+"/entity/{type}", api.requestWrapper(http.HandlerFunc(api.postEntityHandler)))
 	mux.Handle("GET "+etre.API_ROOT+"/entity/{type}/{id}", api.requestWrapper(api.id(http.HandlerFunc(api.getEntityHandler))))
+	mux.Handle("HEAD "+etre.API_ROOT+"/entity/{type}/{id}", api.requestWrapper(api.id(http.HandlerFunc(api.headEntityHandler))))
 	mux.Handle("PUT "+etre.API_ROOT+"/entity/{type}/{id}", api.requestWrapper(api.id(http.HandlerFunc(api.putEntityHandler))))
 	mux.Handle("DELETE "+etre.API_ROOT+"/entity/{type}/{id}", api.requestWrapper(api.id(http.HandlerFunc(api.deleteEntityHandler))))
+	mux.Handle("PUT "+etre.API_ROOT+"/entity/{type}/{id}/restore", api.requestWrapper(api.id(http.HandlerFunc(api.restoreEntityHandler))))
+	mux.Handle("GET "+etre.API_ROOT+"/entity/{type}/{id}/history", api.requestWrapper(api.id(http.HandlerFunc(api.historyHandler))))
+	mux.Handle("GET "+etre.API_ROOT+"/entity/{type}/{id}/at", api.requestWrapper(api.id(http.HandlerFunc(api.entityAtHandler))))
 	mux.Handle("GET "+etre.API_ROOT+"/entity/{type}/{id}/labels", api.requestWrapper(api.id(http.HandlerFunc(api.getLabelsHandler))))
 	mux.Handle("DELETE "+etre.API_ROOT+"/entity/{type}/{id}/labels/{label}", api.requestWrapper(api.id(http.HandlerFunc(api.deleteLabelHandler))))
 
@@ -126,11 +209,13 @@ func NewAPI(appCtx app.Context) *API {
 	// /////////////////////////////////////////////////////////////////////
 	mux.HandleFunc("GET "+etre.API_ROOT+"/metrics", api.metricsHandler)
 	mux.HandleFunc("GET "+etre.API_ROOT+"/status", api.statusHandler)
+	mux.HandleFunc("GET "+etre.API_ROOT+"/health", api.healthHandler)
 
 	// /////////////////////////////////////////////////////////////////////
 	// Changes
 	// /////////////////////////////////////////////////////////////////////
 	mux.Handle("GET "+etre.API_ROOT+"/changes", api.cdcWrapper(http.HandlerFunc(api.changesHandler)))
+	mux.Handle("POST "+etre.API_ROOT+"/changes/replay", api.cdcWrapper(http.HandlerFunc(api.replayHandler)))
 
 	// /////////////////////////////////////////////////////////////////////
 	// OpenAPI docs
@@ -180,13 +265,32 @@ func (api *API) Stop() error {
 // requestWrapper adds auth and metrics middleware to the endpoint handler for
 // entity read/write endpoints. CDC should use cdcWrapper instead.
 func (api *API) requestWrapper(next http.Handler) http.Handler {
+	return api.wrapRequest(next, false)
+}
+
+// readRequestWrapper is like requestWrapper for read endpoints that use POST
+// to send a request body, like batch query. The request is authorized and
+// counted as a read, not a write.
+func (api *API) readRequestWrapper(next http.Handler) http.Handler {
+	return api.wrapRequest(next, true)
+}
+
+func (api *API) wrapRequest(next http.Handler, read bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		write := isWriteRequest(r.Method)
+		write := !read && isWriteRequest(r.Method)
+
+		// Limit request body size. If exceeded, the handler returns ErrPayloadTooLarge
+		// when it decodes the body (see contentError). An import is a stream of any
+		// size, so it limits the size of each entity instead (see importHandler).
+		if r.Body != nil && !strings.HasSuffix(r.Pattern, "/import") {
+			r.Body = http.MaxBytesReader(w, r.Body, api.maxBodyBytes)
+		}
 
 		// Etre request context passed to endpoint handler
 		rc := &req{
 			entityType: r.PathValue("type"),
+			requestId:  requestId(w, r),
 			write:      write,
 		}
 
@@ -205,6 +309,17 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 			return
 		}
 
+		// Trace the request (no-op unless a tracer provider is set, see tracer)
+		spanCtx, span := tracer.Start(r.Context(), r.Pattern,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("etre.entity_type", rc.entityType),
+				attribute.String("etre.request_id", rc.requestId),
+			),
+		)
+		defer span.End()
+		rc.span = span
+
 		defer func() {
 			if r := recover(); r != nil {
 				err, ok := r.(error)
@@ -218,7 +333,7 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 					Type:       "panic",
 					HTTPStatus: http.StatusInternalServerError,
 				}
-				log.Printf("PANIC: %s\n%s\n\n", err, string(b[0:n]))
+				log.Printf("PANIC: %s (request %s)\n%s\n\n", err, rc.requestId, string(b[0:n]))
 				if write {
 					api.WriteResult(rc, w, nil, etreErr)
 				} else {
@@ -263,7 +378,7 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 			}
 			queryTimeout = d
 		}
-		ctx, cancel = context.WithTimeout(r.Context(), queryTimeout)
+		ctx, cancel = context.WithTimeout(etre.WithRequestId(spanCtx, rc.requestId), queryTimeout)
 
 		defer cancel() // don't leak
 		t0 := time.Now()
@@ -272,7 +387,7 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 		// Authenticate
 		// --------------------------------------------------------------
 		rc.inst.Start("authenticate")
-		caller, err := api.auth.Authenticate(r)
+		caller, err := api.authenticate(spanCtx, r)
 		rc.inst.Stop("authenticate")
 		if err != nil {
 			log.Printf("AUTH: failed to authenticate: %s (caller: %+v request: %+v)", err, caller, r)
@@ -301,6 +416,23 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 		gm := api.metricsFactory.Make(caller.MetricGroups)
 		rc.gm = gm
 
+		// --------------------------------------------------------------
+		// Rate limit
+		// --------------------------------------------------------------
+		if api.rateLimiter != nil {
+			if ok, group := api.rateLimiter.allow(caller.MetricGroups); !ok {
+				log.Printf("Rate limited: metric group %s: caller=%+v request=%+v", group, caller, r)
+				w.Header().Set("Retry-After", "1")
+				err := ErrRateLimited.New("metric group %s exceeded its request rate limit", group)
+				if write {
+					api.WriteResult(rc, w, nil, err)
+				} else {
+					api.readError(rc, w, err)
+				}
+				return
+			}
+		}
+
 		if err := api.validate.EntityType(rc.entityType); err != nil {
 			log.Printf("Invalid entity type: '%s': caller=%+v request=%+v", rc.entityType, caller, r)
 			gm.Inc(metrics.InvalidEntityType, 1)
@@ -329,8 +461,10 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 		if write {
 			gm.Inc(metrics.Write, 1) // all writes (write QPS)
 
-			// Don't allow empty PUT or POST, client must provide entities for these
-			if r.Method != "DELETE" && r.ContentLength == 0 {
+			// Don't allow empty PUT or POST, client must provide entities for these.
+			// Renaming a label (PUT /entities/:type/labels/:label) and restoring
+			// entities (PUT /entities/:type/restore) have no payload.
+			if r.Method != "DELETE" && r.ContentLength == 0 && r.PathValue("label") == "" && !strings.HasSuffix(r.Pattern, "/restore") {
 				api.WriteResult(rc, w, nil, ErrNoContent)
 				return
 			}
@@ -345,7 +479,7 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 				gm.Inc(metrics.SetOp, 1)
 			}
 
-			if err := api.auth.Authorize(caller, auth.Action{EntityType: rc.entityType, Op: auth.OP_WRITE}); err != nil {
+			if err := api.authorize(spanCtx, caller, auth.Action{EntityType: rc.entityType, Op: writeAuthOp(r)}); err != nil {
 				log.Printf("AUTH: not authorized: %s (caller: %+v request: %+v)", err, caller, r)
 				gm.Inc(metrics.AuthorizationFailed, 1)
 				authErr := auth.Error{
@@ -359,7 +493,7 @@ func (api *API) requestWrapper(next http.Handler) http.Handler {
 		} else {
 			gm.Inc(metrics.Read, 1) // all reads (read QPS)
 
-			if err := api.auth.Authorize(caller, auth.Action{EntityType: rc.entityType, Op: auth.OP_READ}); err != nil {
+			if err := api.authorize(spanCtx, caller, auth.Action{EntityType: rc.entityType, Op: auth.OP_READ}); err != nil {
 				log.Printf("AUTH: not authorized: %s (caller: %+v request: %+v)", err, caller, r)
 				gm.Inc(metrics.AuthorizationFailed, 1)
 				authErr := auth.Error{
@@ -410,7 +544,9 @@ func (api *API) cdcWrapper(next http.Handler) http.Handler {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Etre request context passed to endpoint handler
-		rc := &req{}
+		rc := &req{
+			requestId: requestId(w, r),
+		}
 
 		defer func() {
 			if r := recover(); r != nil {
@@ -425,7 +561,7 @@ func (api *API) cdcWrapper(next http.Handler) http.Handler {
 					Type:       "panic",
 					HTTPStatus: http.StatusInternalServerError,
 				}
-				log.Printf("PANIC: %s\n%s\n\n", err, string(b[0:n]))
+				log.Printf("PANIC: %s (request %s)\n%s\n\n", err, rc.requestId, string(b[0:n]))
 				api.readError(rc, w, etreErr)
 			}
 		}()
@@ -485,26 +621,49 @@ func (api *API) cdcWrapper(next http.Handler) http.Handler {
 		// Endpoint
 		// //////////////////////////////////////////////////////////////////////
 
-		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), reqKey, rc)))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(etre.WithRequestId(r.Context(), rc.requestId), reqKey, rc)))
 	})
 }
 
+// requestId returns the request ID from the etre.REQUEST_ID_HEADER, or a new ID
+// if the client did not send one or it's invalid, and echoes it in the response
+// header. The request ID is returned in errors and logged to correlate client
+// errors with server logs.
+func requestId(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(etre.REQUEST_ID_HEADER)
+	if !validRequestId(id) {
+		id = bson.NewObjectID().Hex()
+	}
+	w.Header().Set(etre.REQUEST_ID_HEADER, id)
+	return id
+}
+
+// validRequestId returns true if the request ID is 1 to 128 printable ASCII
+// characters, which is safe to log and echo.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 func (api *API) id(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		rc := ctx.Value(reqKey).(*req)
 
 		var err error
-		var entityId bson.ObjectID
 
 		id := r.PathValue("id") // 1. from URL
 		if id == "" {
 			err = ErrMissingParam.New("missing id param")
-		} else {
-			entityId, err = bson.ObjectIDFromHex(id) // 2. convert to/validate as ObjectID
-			if err != nil {
-				err = ErrInvalidParam.New("id '%s' is not a valid ObjectID: %v", id, err)
-			}
+		} else if id, err = entity.ParseId(api.entityConfig.IdFormat(rc.entityType), id); err != nil {
+			err = ErrInvalidParam.New("%s", err) // 2. validate as id format, like ObjectID
 		}
 		if err != nil {
 			if rc.write {
@@ -515,7 +674,10 @@ func (api *API) id(next http.Handler) http.Handler {
 			return
 		}
 
-		rc.entityId = entityId.Hex() // 3. ObjectID to hex value (string)
+		rc.entityId = id
+		if rc.write {
+			rc.wo.EntityId = id // canonical id, like lowercase hex
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -530,15 +692,27 @@ func (api *API) id(next http.Handler) http.Handler {
 // @Description Returns a set of entities matching the labels in the `query` query parameter.
 // @Description All labels of each entity are returned, unless specific labels are specified in the `labels` query parameter.
 // @Description The result set is reduced to distinct values if the request includes the `distinct` query parameter (requires `lables` name a single label).
-// @Description If the query is longer than 2000 characters, use the POST /query endpoint (to be implemented).
+// @Description If the query is longer than 2000 characters, use the POST /query/:type endpoint.
+// @Description The response has an ETag header unless it's larger than 4 MiB. Send it in the If-None-Match header
+// @Description to get 304 Not Modified (no body) if the result has not changed.
 // @ID getEntitiesHandler
 // @Produce json
 // @Param type path string true "Entity type"
+// @Param If-None-Match header string false "ETag of a previous response"
 // @Param query query string true "Selector"
 // @Param labels query string false "Comma-separated list of labels to return"
+// @Param aliases query string false "Comma-separated list of label:alias to return labels renamed, like dc:datacenter"
 // @Param distinct query boolean false "Reduce results to one per distinct value"
+// @Param deleted query boolean false "Include soft-deleted entities"
 // @Param limit query integer false "Maximum number of results to return" (0 for no limit)
+// @Param hint query string false "Index name or key spec (like x:1,y:-1) for the query to use"
+// @Param sort query string false "Comma-separated list of label:1 (ascending) or label:-1 (descending) to order the results by"
+// @Param maxTimeMS query integer false "Max time (milliseconds) for the query to run on the database; lower than entity.max_query_time"
+// @Param collation query string false "Collation locale[:strength] for string comparison, like en:2 for case-insensitive (needs a matching collated index)"
+// @Param groupBy query string false "Return an object of label value to array of entities with that value"
 // @Success 200 {array} etre.Entity "OK"
+// @Header 200 {string} ETag "Hash of the response"
+// @Success 304 "Not modified"
 // @Failure 400,404 {object} etre.Error
 // @Router /entities/:type [get]
 func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
@@ -557,10 +731,18 @@ func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Label metrics
-	rc.gm.Val(metrics.Labels, int64(len(q.Predicates)))
-	for _, p := range q.Predicates {
+	rc.gm.Val(metrics.Labels, int64(len(q.AllPredicates())))
+	for _, p := range q.AllPredicates() {
 		rc.gm.IncLabel(metrics.LabelRead, p.Label)
 	}
+	api.incQueryLabels(rc, q)
+
+	// Querying a denied label would reveal its values, so reject it
+	if err := api.authorizeLabels(rc, auth.OP_READ, q.Labels()); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	readable := api.readableLabels(rc)
 
 	// Query Filter
 	f := etre.QueryFilter{}
@@ -571,6 +753,9 @@ func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	if _, ok := qv["distinct"]; ok {
 		f.Distinct = true
 	}
+	if _, ok := qv["deleted"]; ok {
+		f.IncludeDeleted = true
+	}
 	if f.Distinct && len(f.ReturnLabels) > 1 {
 		api.readError(rc, w, ErrInvalidQuery.New("distinct requires only 1 return label but %d specified: %v", len(f.ReturnLabels), f.ReturnLabels))
 		return
@@ -583,6 +768,68 @@ func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		f.Limit = limit
 	}
+	if hint := qv.Get("hint"); hint != "" {
+		f.Hint = hint
+	}
+	if sort := qv.Get("sort"); sort != "" {
+		// Sorting by a denied label would reveal the order of its values
+		if err := api.authorizeLabels(rc, auth.OP_READ, sortLabels(sort)); err != nil {
+			api.readError(rc, w, err)
+			return
+		}
+		f.Sort = sort
+	}
+	if v, ok := qv["maxTimeMS"]; ok {
+		maxTime, err := strconv.ParseInt(v[0], 10, 64)
+		if err != nil || maxTime < 0 {
+			api.readError(rc, w, ErrInvalidQuery.New("invalid maxTimeMS: %s", v[0]))
+			return
+		}
+		f.MaxTimeMS = maxTime
+	}
+	if v := qv.Get("collation"); v != "" {
+		c, err := parseCollation(v)
+		if err != nil {
+			api.readError(rc, w, err)
+			return
+		}
+		f.Collation = c
+	}
+	if f.Aliases, err = api.aliases(rc, qv); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	f = api.queryFilter(rc.entityType, f)
+
+	// Grouped results: {"value1": [entities], "value2": [entities], ...}
+	if groupBy := qv.Get("groupBy"); groupBy != "" {
+		if err := validGroupBy(groupBy); err != nil {
+			api.readError(rc, w, err)
+			return
+		}
+		if err := api.authorizeLabels(rc, auth.OP_READ, []string{groupBy}); err != nil {
+			api.readError(rc, w, err)
+			return
+		}
+		rc.inst.Start("db")
+		groups, err := api.es.GroupEntities(ctx, rc.entityType, q, groupBy, f)
+		rc.inst.Stop("db")
+		if err != nil {
+			api.readError(rc, w, err)
+			return
+		}
+		count := 0
+		for _, entities := range groups {
+			for _, e := range entities {
+				stripLabels(e, readable)
+			}
+			count += len(entities)
+		}
+		rc.gm.Val(metrics.ReadMatch, int64(count))
+		body, _ := json.Marshal(groups)
+		writeWithETag(w, r, append(body, '\n'))
+		return
+	}
 
 	// Query data store (instrumented)
 	rc.inst.Start("db")
@@ -591,15 +838,28 @@ func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 
 	rc.inst.Start("encode-response")
 
-	// FinalWriter is where we will write the data. If we're using gzip compression, this will be the gzip writer. If not, it will just be the original response writer.
-	var finalWriter io.Writer
-	finalWriter = w
-
-	// gzip writer, only initialized if client accepts gzip encoding.
+	// gzip writer, only initialized if client accepts gzip encoding and there is data to return to the client.
 	var gzw *gzip.Writer
+	acceptGzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	start := func() io.Writer {
+		if !acceptGzip {
+			return w
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gzw = gzip.NewWriter(w)
+		return gzw
+	}
+	defer func() {
+		if gzw != nil {
+			gzw.Close()
+		}
+	}()
 
-	// encoder is the JSON encoder writing to finalWriter. We initialize it after we know whether we're using gzip or not.
-	var encoder *json.Encoder
+	// The response is buffered in etagWriter to compute its ETag, unless it's
+	// larger than ETAG_MAX_BYTES, then etagWriter calls start and streams.
+	// Until then, nothing has been sent, so errors are returned normally.
+	ew := newETagWriter(ETAG_MAX_BYTES, start)
+	encoder := json.NewEncoder(ew)
 
 	// Number of non-error records sent to the client
 	count := 0
@@ -616,30 +876,21 @@ func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Initialize gzip writer and JSON encoder on the first record, after we know there is data to return to the client.
-		// We also check the client's Accept-Encoding header to see if gzip is supported.
-		if count == 0 && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			w.Header().Set("Content-Encoding", "gzip")
-			gzw = gzip.NewWriter(w)
-			defer gzw.Close()
-			finalWriter = gzw
-		}
-
 		// Start the JSON array if this is the first record, or put a comma separator if not the first record
 		// We don't do this before the for loop because we don't want to write the opening bracket if there is a database
 		// error in the first record returned.
 		if count == 0 {
-			finalWriter.Write([]byte("["))
-			encoder = json.NewEncoder(finalWriter)
+			ew.Write([]byte("["))
 		} else {
-			finalWriter.Write([]byte(","))
+			ew.Write([]byte(","))
 		}
 
 		// Write the record and handle the error.
 		// encoder.Encode will add a newline, which is fine (nice for human readable output)
+		stripLabels(e.Entity, readable)
 		err = encoder.Encode(e.Entity)
 		if err != nil {
-			// api.readError will mangle the response, but if the encoder failed then the response is already mangled and there's not much else we can do.
+			// api.readError will mangle the response if streaming, but if the encoder failed then the response is already mangled and there's not much else we can do.
 			api.readError(rc, w, err)
 			log.Println("ERROR: Read error while encoding response: ", err)
 			return
@@ -665,210 +916,1162 @@ func (api *API) getEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	// Clean up the JSON array
 	if count == 0 {
 		// Never saw any data. Write an empty array.
-		finalWriter.Write([]byte("[]"))
+		ew.Write([]byte("[]"))
 	} else {
 		// We wrote some data, now we need to close the array
-		finalWriter.Write([]byte("]")) // end of JSON array
+		ew.Write([]byte("]")) // end of JSON array
+	}
+	rc.gm.Val(metrics.ReadMatch, int64(count))
+
+	// Response not streamed: send it with its ETag, or 304 if the client has it
+	if !ew.Streaming() {
+		body := ew.Bytes()
+		tag := etag(body)
+		w.Header().Set("ETag", tag)
+		if notModified(r, tag) {
+			w.WriteHeader(http.StatusNotModified)
+			rc.inst.Stop("encode-response")
+			return
+		}
+		if count == 0 {
+			w.Write(body) // don't compress empty result
+		} else {
+			start().Write(body)
+		}
 	}
 
 	if gzw != nil {
 		gzw.Flush() // flush any remaining compressed data to the client
 	}
 
-	rc.gm.Val(metrics.ReadMatch, int64(count))
 	rc.inst.Stop("encode-response")
 }
 
-// //////////////////////////////////////////////////////////////////////////
-// Bulk Write
-// //////////////////////////////////////////////////////////////////////////
-
-// postEntitiesHandler godoc
-// @Summary Create entities in bulk
-// @Description Given JSON payload, create new entities of the given :type.
-// @Description Some meta-labels are filled in by Etre, e.g. `_id`.
-// @Description Optionally specify `setOp`, `setId`, and `setSize` together to define a SetOp.
-// @ID postEntitiesHandler
-// @Accept json
+// queryHandler godoc
+// @Summary Query a set of entities (long query)
+// @Description Same as GET /entities/:type but the query (label selector) is the request body,
+// @Description which is not limited by URL length. Other parameters are the same query parameters.
+// @Description The query is validated the same way, and the max query length is the same.
+// @ID queryHandler
+// @Accept plain
 // @Produce json
 // @Param type path string true "Entity type"
-// @Param setOp query string false "SetOp"
-// @Param setId query string false "SetId"
-// @Param setSize query int false "SetSize"
-// @Success 201 {array} string "List of new entity id's"
-// @Failure 400 {object} etre.Error
-// @Router /entities/:type [post]
-func (api *API) postEntitiesHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()             // query timeout
-	rc := ctx.Value(reqKey).(*req) // Etre request context
-	rc.inst.Start("handler")
-	defer rc.inst.Stop("handler")
-
-	rc.gm.Inc(metrics.CreateMany, 1) // specific write type
-
-	// Return values at reply (not mutually exclusive)
-	var ids []string
-	var err error
-
-	// Read new entities from client. Should be an array of entities like:
-	//   [{a:1,b:"foo"},{a:2,b:"bar"}]
-	// Must have >= 1 entity; we're strict to guard against client bugs.
-	var entities []etre.Entity
-	if err = json.NewDecoder(r.Body).Decode(&entities); err != nil {
-		err = ErrInvalidContent
-		goto reply
-	}
-	if len(entities) == 0 {
-		err = ErrNoContent
-		goto reply
-	}
-
-	// Validate new entities before attempting to write
-	rc.gm.Val(metrics.CreateBulk, int64(len(entities))) // inc before validating
-	if err = api.validate.Entities(entities, entity.VALIDATE_ON_CREATE); err != nil {
-		goto reply
+// @Param labels query string false "Comma-separated list of labels to return"
+// @Param aliases query string false "Comma-separated list of label:alias to return labels renamed, like dc:datacenter"
+// @Param distinct query boolean false "Reduce results to one per distinct value"
+// @Param deleted query boolean false "Include soft-deleted entities"
+// @Param limit query integer false "Maximum number of results to return" (0 for no limit)
+// @Param hint query string false "Index name or key spec (like x:1,y:-1) for the query to use"
+// @Param sort query string false "Comma-separated list of label:1 (ascending) or label:-1 (descending) to order the results by"
+// @Param maxTimeMS query integer false "Max time (milliseconds) for the query to run on the database; lower than entity.max_query_time"
+// @Param collation query string false "Collation locale[:strength] for string comparison, like en:2 for case-insensitive (needs a matching collated index)"
+// @Param groupBy query string false "Return an object of label value to array of entities with that value"
+// @Success 200 {array} etre.Entity "OK"
+// @Header 200 {string} ETag "Hash of the response"
+// @Success 304 "Not modified"
+// @Failure 400,404,413 {object} etre.Error
+// @Router /query/:type [post]
+func (api *API) queryHandler(w http.ResponseWriter, r *http.Request) {
+	rc := r.Context().Value(reqKey).(*req) // Etre request context
+
+	// Read one byte more than the max to detect a query that's too long
+	body, err := io.ReadAll(io.LimitReader(r.Body, QUERY_MAX_LENGTH+1))
+	if err != nil {
+		api.readError(rc, w, api.contentError(err))
+		return
 	}
 
-	// Write new entities to data store
-	ids, err = api.es.CreateEntities(ctx, rc.wo, entities)
-	rc.gm.Inc(metrics.Created, int64(len(ids)))
-
-reply:
-	api.WriteResult(rc, w, ids, err)
+	// Set the query URL param so that the query is parsed and validated exactly
+	// like GET /entities/:type, then handle the request the same
+	qv := r.URL.Query()
+	qv.Set("query", strings.TrimSpace(string(body)))
+	r.URL.RawQuery = qv.Encode()
+	api.getEntitiesHandler(w, r)
 }
 
-// putEntitiesHandler godoc
-// @Summary Update matching entities in bulk
-// @Description Given JSON payload, update labels in matching entities of the given :type.
-// @Description Applies update to the set of entities matching the labels in the `query` query parameter.
-// @Description Optionally specify `setOp`, `setId`, and `setSize` together to define a SetOp.
-// @ID putEntitiesHandler
-// @Accept json
-// @Produce json
+// headEntitiesHandler godoc
+// @Summary Check if any entity matches a query
+// @Description Returns 200 if at least one entity of the :type matches the `query` query parameter, else 404.
+// @Description There is no response body. It's cheaper than a query because it reads only the first matching entity id.
+// @ID headEntitiesHandler
 // @Param type path string true "Entity type"
 // @Param query query string true "Selector"
-// @Param setOp query string false "SetOp"
-// @Param setId query string false "SetId"
-// @Param setSize query int false "SetSize"
-// @Success 200 {array} etre.Entity "Set of matching entities after update applied."
-// @Failure 400 {object} etre.Error
-// @Router /entities/:type [put]
-func (api *API) putEntitiesHandler(w http.ResponseWriter, r *http.Request) {
+// @Param deleted query boolean false "Include soft-deleted entities"
+// @Success 200 "An entity matches the query"
+// @Failure 400,403,404 "No body"
+// @Router /entities/:type [head]
+func (api *API) headEntitiesHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()             // query timeout
 	rc := ctx.Value(reqKey).(*req) // Etre request context
 	rc.inst.Start("handler")
 	defer rc.inst.Stop("handler")
 
-	rc.gm.Inc(metrics.UpdateQuery, 1) // specific write type
-
-	// Return values at reply (not mutually exclusive)
-	var entities []etre.Entity
-	var err error
-
-	var patch etre.Entity
+	rc.gm.Inc(metrics.ReadQuery, 1) // specific read type
 
-	// Parse query (label selector) from URL
-	var q query.Query
-	q, err = parseQuery(r)
+	q, err := parseQuery(r)
 	if err != nil {
-		goto reply
+		api.readError(rc, w, err)
+		return
+	}
+	rc.gm.Val(metrics.Labels, int64(len(q.AllPredicates())))
+	for _, p := range q.AllPredicates() {
+		rc.gm.IncLabel(metrics.LabelRead, p.Label)
 	}
+	api.incQueryLabels(rc, q)
 
-	// Read and validate patch entity
-	if err = json.NewDecoder(r.Body).Decode(&patch); err != nil {
-		err = ErrInvalidContent
-		goto reply
+	// Querying a denied label would reveal its values, so reject it
+	if err := api.authorizeLabels(rc, auth.OP_READ, q.Labels()); err != nil {
+		api.readError(rc, w, err)
+		return
 	}
-	if len(patch) == 0 {
-		err = ErrNoContent
-		goto reply
+
+	// Read only the id of the first matching entity
+	f := etre.QueryFilter{ReturnLabels: []string{"_id"}, Limit: 1}
+	if _, ok := r.URL.Query()["deleted"]; ok {
+		f.IncludeDeleted = true
 	}
-	if err = api.validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
-		goto reply
+	rc.inst.Start("db")
+	exists := false
+	for e := range api.es.StreamEntities(ctx, rc.entityType, q, f) {
+		if e.Err != nil {
+			rc.inst.Stop("db")
+			api.readError(rc, w, e.Err)
+			return
+		}
+		exists = true
 	}
+	rc.inst.Stop("db")
 
-	// Label metrics (read and update)
-	rc.gm.Val(metrics.Labels, int64(len(q.Predicates)))
-	for _, p := range q.Predicates {
-		rc.gm.IncLabel(metrics.LabelRead, p.Label)
+	// The store closes the channel without an error on timeout
+	if err := ctx.Err(); err != nil {
+		api.readError(rc, w, entity.DbError{Err: err, Type: "db-query"})
+		return
 	}
-	for label := range patch {
-		rc.gm.IncLabel(metrics.LabelUpdate, label)
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
-
-	// Patch all entities matching query
-	entities, err = api.es.UpdateEntities(ctx, rc.wo, q, patch)
-	rc.gm.Val(metrics.UpdateBulk, int64(len(entities)))
-	rc.gm.Inc(metrics.Updated, int64(len(entities)))
-
-reply:
-	api.WriteResult(rc, w, entities, err)
+	w.WriteHeader(http.StatusOK)
 }
 
-// deleteEntitiesHandler godoc
-// @Summary Remove matching entities in bulk
-// @Description Deletes the set of entities of the given :type, matching the labels in the `query` query parameter.
-// @ID deleteEntitiesHandler
-// @Produce json
+// exportHandler godoc
+// @Summary Export entities as newline-delimited JSON
+// @Description Streams all entities of a type specified by the :type endpoint, or only those that match the optional
+// @Description `query` query parameter, one JSON entity per line. Unlike GET /entities/:type, the default limit
+// @Description (entity.filter) does not apply, and the response is streamed and flushed periodically, not buffered.
+// @Description Exporting many entities can take longer than the default query timeout; set X-Etre-Query-Timeout.
+// @Description If an error occurs after the response started, the X-Etre-Error trailer has the error message.
+// @ID exportHandler
+// @Produce x-ndjson
 // @Param type path string true "Entity type"
-// @Param query query string true "Selector"
-// @Param setOp query string false "SetOp"
-// @Param setId query string false "SetId"
-// @Param setSize query int false "SetSize"
-// @Success 200 {array} etre.Entity "OK"
-// @Failure 400 {object} etre.Error
-// @Router /entities/:type [delete]
-func (api *API) deleteEntitiesHandler(w http.ResponseWriter, r *http.Request) {
+// @Param query query string false "Selector (default: all entities)"
+// @Param labels query string false "Comma-separated list of labels to return"
+// @Param aliases query string false "Comma-separated list of label:alias to return labels renamed, like dc:datacenter"
+// @Param deleted query boolean false "Include soft-deleted entities"
+// @Success 200 {object} etre.Entity "One entity per line"
+// @Header 200 {string} X-Etre-Error "Trailer: error after the response started"
+// @Failure 400,403 {object} etre.Error
+// @Router /entities/:type/export [get]
+func (api *API) exportHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()             // query timeout
 	rc := ctx.Value(reqKey).(*req) // Etre request context
 	rc.inst.Start("handler")
 	defer rc.inst.Stop("handler")
 
-	rc.gm.Inc(metrics.DeleteQuery, 1) // specific write type
-
-	// Return values at reply (not mutually exclusive)
-	var entities []etre.Entity
-	var err error
+	rc.gm.Inc(metrics.ReadQuery, 1) // specific read type
 
-	// Parse query (label selector) from URL
+	// Optional query, else all entities (empty query)
+	qv := r.URL.Query()
 	var q query.Query
-	q, err = parseQuery(r)
-	if err != nil {
-		goto reply
+	if qv.Get("query") != "" {
+		var err error
+		if q, err = parseQuery(r); err != nil {
+			api.readError(rc, w, err)
+			return
+		}
 	}
-
-	// Label metrics
-	rc.gm.Val(metrics.Labels, int64(len(q.Predicates)))
-	for _, p := range q.Predicates {
+	rc.gm.Val(metrics.Labels, int64(len(q.AllPredicates())))
+	for _, p := range q.AllPredicates() {
 		rc.gm.IncLabel(metrics.LabelRead, p.Label)
 	}
+	api.incQueryLabels(rc, q)
 
-	// Delete entities, returns the deleted entities
-	entities, err = api.es.DeleteEntities(ctx, rc.wo, q)
-	rc.gm.Val(metrics.DeleteBulk, int64(len(entities)))
-	rc.gm.Inc(metrics.Deleted, int64(len(entities)))
+	// Querying a denied label would reveal its values, so reject it
+	if err := api.authorizeLabels(rc, auth.OP_READ, q.Labels()); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	readable := api.readableLabels(rc)
 
-reply:
-	api.WriteResult(rc, w, entities, err)
+	// No default limit: export all matching entities
+	f := etre.QueryFilter{}
+	if csv, ok := qv["labels"]; ok {
+		f.ReturnLabels = strings.Split(csv[0], ",")
+	}
+	if _, ok := qv["deleted"]; ok {
+		f.IncludeDeleted = true
+	}
+	var err error
+	if f.Aliases, err = api.aliases(rc, qv); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	rc.inst.Start("db")
+	entities := api.es.StreamEntities(ctx, rc.entityType, q, f)
+	rc.inst.Stop("db")
+
+	rc.inst.Start("encode-response")
+	defer rc.inst.Stop("encode-response")
+
+	// The response starts with the first entity, so errors until then are
+	// returned normally. The error trailer must be declared before it starts.
+	started := false
+	start := func() {
+		w.Header().Set("Content-Type", etre.NDJSON_CONTENT_TYPE)
+		w.Header().Set("Trailer", etre.ERROR_TRAILER)
+		w.WriteHeader(http.StatusOK)
+		started = true
+	}
+	flusher := http.NewResponseController(w)
+	encoder := json.NewEncoder(w) // one entity per line
+	count := 0
+	for e := range entities {
+		if e.Err != nil {
+			err = e.Err
+			break
+		}
+		if !started {
+			start()
+		}
+		stripLabels(e.Entity, readable)
+		if err = encoder.Encode(e.Entity); err != nil {
+			break
+		}
+		count++
+		if count%EXPORT_FLUSH_ENTITIES == 0 {
+			flusher.Flush()
+		}
+	}
+	// The store closes the channel without an error on timeout
+	if err == nil && ctx.Err() != nil {
+		err = entity.DbError{Err: ctx.Err(), Type: "db-query"}
+	}
+	rc.gm.Val(metrics.ReadMatch, int64(count))
+
+	if err != nil {
+		if !started {
+			api.readError(rc, w, err)
+			return
+		}
+		// Too late to change the HTTP status, so report the error in the trailer.
+		// The client must check it because the export is incomplete.
+		api.systemMetrics.Inc(metrics.Error, 1)
+		if _, ok := err.(entity.DbError); ok {
+			maybeInc(metrics.DbError, 1, rc.gm)
+		} else {
+			maybeInc(metrics.APIError, 1, rc.gm)
+		}
+		log.Printf("API READ ERROR: export: %v (request %s)", err, rc.requestId)
+		spanError(rc, err)
+		e := queryError(err)
+		e.RequestId = rc.requestId
+		trailer, _ := json.Marshal(e)
+		w.Header().Set(etre.ERROR_TRAILER, string(trailer))
+		return
+	}
+	if !started {
+		start() // no entities, empty response
+	}
+	flusher.Flush()
+}
+
+// aggregateHandler godoc
+// @Summary Count entities by label value
+// @Description Count entities of a type specified by the :type endpoint that match the `query` query parameter,
+// @Description grouped by the value of the `groupBy` label. Entities without the label are counted with a null value.
+// @ID aggregateHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param query query string true "Selector"
+// @Param groupBy query string true "Label to group by"
+// @Success 200 {array} etre.GroupCount "OK"
+// @Failure 400,403 {object} etre.Error
+// @Router /entities/:type/aggregate [get]
+func (api *API) aggregateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadQuery, 1) // specific read type
+
+	q, err := parseQuery(r)
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	groupBy := r.URL.Query().Get("groupBy")
+	if groupBy == "" {
+		api.readError(rc, w, ErrMissingParam.New("missing groupBy param"))
+		return
+	}
+	if err := validGroupBy(groupBy); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	// Label metrics
+	rc.gm.Val(metrics.Labels, int64(len(q.AllPredicates())))
+	for _, p := range q.AllPredicates() {
+		rc.gm.IncLabel(metrics.LabelRead, p.Label)
+	}
+	api.incQueryLabels(rc, q)
+
+	// Counts reveal label values, so the query and groupBy labels must be readable
+	if err := api.authorizeLabels(rc, auth.OP_READ, append(q.Labels(), groupBy)); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	rc.inst.Start("db")
+	counts, err := api.es.CountGroups(ctx, rc.entityType, q, groupBy)
+	rc.inst.Stop("db")
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	var total int64
+	for _, c := range counts {
+		total += c.Count
+	}
+	rc.gm.Val(metrics.ReadMatch, total)
+	json.NewEncoder(w).Encode(counts)
+}
+
+// readByIdsHandler godoc
+// @Summary Get entities by id
+// @Description Return entities of the given :type by id in one request. The ids are the comma-separated `ids`
+// @Description query parameter (GET) or a JSON array of strings (POST) for many ids. The response has one item
+// @Description per id in the same order: the entity, or null if not found. Duplicate ids return the same entity.
+// @ID readByIdsHandler
+// @Accept json
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param ids query string false "Comma-separated list of entity ids (GET)"
+// @Param labels query string false "Comma-separated list of labels to return"
+// @Param aliases query string false "Comma-separated list of label:alias to return labels renamed, like dc:datacenter"
+// @Param deleted query boolean false "Include soft-deleted entities"
+// @Success 200 {array} etre.Entity "OK"
+// @Failure 400,413 {object} etre.Error
+// @Router /entities/:type/by-ids [get]
+// @Router /entities/:type/by-ids [post]
+func (api *API) readByIdsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadId, 1) // specific read type
+
+	var ids []string
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+			api.readError(rc, w, api.contentError(err))
+			return
+		}
+	} else if v := r.URL.Query().Get("ids"); v != "" {
+		ids = strings.Split(v, ",")
+	}
+	if len(ids) == 0 {
+		api.readError(rc, w, ErrMissingParam.New("no ids provided"))
+		return
+	}
+	for i, id := range ids {
+		if id == "" {
+			api.readError(rc, w, ErrInvalidParam.New("id %d is empty", i))
+			return
+		}
+	}
+
+	// Query Filter
+	f := etre.QueryFilter{}
+	if csv, ok := r.URL.Query()["labels"]; ok {
+		f.ReturnLabels = strings.Split(csv[0], ",")
+	}
+	if _, ok := r.URL.Query()["deleted"]; ok {
+		f.IncludeDeleted = true
+	}
+	var err error
+	if f.Aliases, err = api.aliases(rc, r.URL.Query()); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	rc.inst.Start("db")
+	entities, err := api.es.ReadEntitiesByIds(ctx, rc.entityType, ids, f)
+	rc.inst.Stop("db")
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	readable := api.readableLabels(rc)
+	count := 0
+	for _, e := range entities {
+		if e != nil {
+			stripLabels(e, readable)
+			count++
+		}
+	}
+	rc.gm.Val(metrics.ReadMatch, int64(count))
+	json.NewEncoder(w).Encode(entities)
+}
+
+// batchQueryHandler godoc
+// @Summary Run a batch of queries
+// @Description Run several queries on entities of a type specified by the :type endpoint in one request.
+// @Description The request is a JSON array of etre.QueryRequest. The response is a JSON array of etre.QueryResult
+// @Description in the same order. If one query fails, its result has an error, but other queries are not affected.
+// @ID batchQueryHandler
+// @Accept json
+// @Produce json
+// @Param type path string true "Entity type"
+// @Success 200 {array} etre.QueryResult "OK"
+// @Failure 400,413 {object} etre.Error
+// @Router /entities/:type/batch-query [post]
+func (api *API) batchQueryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadQuery, 1) // specific read type
+
+	var reqs []etre.QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		api.readError(rc, w, api.contentError(err))
+		return
+	}
+	if len(reqs) == 0 {
+		api.readError(rc, w, ErrNoContent.New("no queries provided"))
+		return
+	}
+	if len(reqs) > BATCH_QUERY_MAX {
+		api.readError(rc, w, ErrInvalidQuery.New("%d queries in batch; max is %d", len(reqs), BATCH_QUERY_MAX))
+		return
+	}
+
+	version, err := queryVersion(r)
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	readable := api.readableLabels(rc)
+
+	// Parse and authorize every query before running any of them. A query that
+	// fails here has an error result and is not run.
+	results := make([]etre.QueryResult, len(reqs))
+	queries := make([]query.Query, len(reqs))
+	for i, qr := range reqs {
+		var err error
+		if qr.Query == "" {
+			err = ErrInvalidQuery.New("query %d: query string is empty", i)
+		} else if qr.Filter.Distinct && len(qr.Filter.ReturnLabels) != 1 {
+			err = ErrInvalidQuery.New("query %d: distinct requires only 1 return label but %d specified: %v", i, len(qr.Filter.ReturnLabels), qr.Filter.ReturnLabels)
+		} else if qr.Filter.Limit < 0 {
+			err = ErrInvalidQuery.New("query %d: invalid limit: %d", i, qr.Filter.Limit)
+		} else if qr.Filter.MaxTimeMS < 0 {
+			err = ErrInvalidQuery.New("query %d: invalid maxTimeMS: %d", i, qr.Filter.MaxTimeMS)
+		} else if err = validateCollation(qr.Filter.Collation); err != nil {
+			err = ErrInvalidQuery.New("query %d: invalid collation %s: %s", i, qr.Filter.Collation, err)
+		} else if err = api.validate.Aliases(qr.Filter.Aliases); err != nil {
+			err = ErrInvalidQuery.New("query %d: %s", i, err)
+		} else if queries[i], err = translateQuery(qr.Query, version); err != nil {
+			e := err.(etre.Error)
+			err = ErrInvalidQuery.New("query %d: %s", i, e.Message)
+		} else {
+			predicates := queries[i].AllPredicates()
+			rc.gm.Val(metrics.Labels, int64(len(predicates)))
+			for _, p := range predicates {
+				rc.gm.IncLabel(metrics.LabelRead, p.Label)
+			}
+			api.incQueryLabels(rc, queries[i])
+			labels := append(queries[i].Labels(), aliasedLabels(qr.Filter.Aliases)...)
+			err = api.authorizeLabels(rc, auth.OP_READ, append(labels, sortLabels(qr.Filter.Sort)...))
+		}
+		if err != nil {
+			results[i].Error = queryError(err)
+		}
+		reqs[i].Filter = api.queryFilter(rc.entityType, reqs[i].Filter)
+	}
+
+	// Run valid queries concurrently, at most BATCH_QUERY_WORKERS at a time
+	rc.inst.Start("db")
+	sem := make(chan struct{}, BATCH_QUERY_WORKERS)
+	var wg sync.WaitGroup
+	for i := range reqs {
+		if results[i].Error != nil {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			entities := []etre.Entity{}
+			for e := range api.es.StreamEntities(ctx, rc.entityType, queries[i], reqs[i].Filter) {
+				if e.Err != nil {
+					results[i].Error = queryError(e.Err)
+					return
+				}
+				stripLabels(e.Entity, readable)
+				entities = append(entities, e.Entity)
+			}
+			// The store closes the channel without an error on timeout
+			if err := ctx.Err(); err != nil {
+				results[i].Error = queryError(entity.DbError{Err: err, Type: "db-query"})
+				return
+			}
+			results[i].Entities = entities
+		}(i)
+	}
+	wg.Wait()
+	rc.inst.Stop("db")
+
+	// Metrics are not safe for concurrent use, so count results and errors here
+	count := 0
+	for _, res := range results {
+		switch {
+		case res.Error == nil:
+			count += len(res.Entities)
+		case res.Error.HTTPStatus == http.StatusForbidden:
+			// Metric incremented by authorizeLabels
+		case res.Error.HTTPStatus == http.StatusServiceUnavailable:
+			maybeInc(metrics.DbError, 1, rc.gm)
+		case res.Error.HTTPStatus >= 500:
+			maybeInc(metrics.APIError, 1, rc.gm)
+		default:
+			maybeInc(metrics.ClientError, 1, rc.gm)
+		}
+	}
+	rc.gm.Val(metrics.ReadMatch, int64(count))
+	json.NewEncoder(w).Encode(results)
+}
+
+// //////////////////////////////////////////////////////////////////////////
+// Bulk Write
+// //////////////////////////////////////////////////////////////////////////
+
+// postEntitiesHandler godoc
+// @Summary Create entities in bulk
+// @Description Given JSON payload, create new entities of the given :type.
+// @Description Some meta-labels are filled in by Etre, e.g. `_id`.
+// @Description Optionally specify `setOp`, `setId`, and `setSize` together to define a SetOp.
+// @ID postEntitiesHandler
+// @Accept json
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param setOp query string false "SetOp"
+// @Param setId query string false "SetId"
+// @Param setSize query int false "SetSize"
+// @Param ordered query bool false "If false, insert all entities that can be inserted instead of stopping at the first error"
+// @Success 201 {array} string "List of new entity id's"
+// @Failure 400 {object} etre.Error
+// @Router /entities/:type [post]
+func (api *API) postEntitiesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.CreateMany, 1) // specific write type
+
+	// Return values at reply (not mutually exclusive)
+	var ids []string
+	var err error
+
+	// Read new entities from client. Should be an array of entities like:
+	//   [{a:1,b:"foo"},{a:2,b:"bar"}]
+	// Must have >= 1 entity; we're strict to guard against client bugs.
+	var entities []etre.Entity
+	if err = json.NewDecoder(r.Body).Decode(&entities); err != nil {
+		err = api.contentError(err)
+		goto reply
+	}
+	if len(entities) == 0 {
+		err = ErrNoContent
+		goto reply
+	}
+
+	// Validate new entities before attempting to write
+	rc.gm.Val(metrics.CreateBulk, int64(len(entities))) // inc before validating
+	if err = api.validate.Entities(entities, entity.VALIDATE_ON_CREATE); err != nil {
+		goto reply
+	}
+	if err = api.validate.Schema(rc.entityType, entities, entity.VALIDATE_ON_CREATE); err != nil {
+		goto reply
+	}
+	if err = api.authorizeLabels(rc, auth.OP_INSERT, entityLabels(entities...)); err != nil {
+		goto reply
+	}
+
+	// Write new entities to data store
+	if len(entities) > 1 {
+		autoSet(rc, "insert")
+	}
+	ids, err = api.es.CreateEntities(ctx, rc.wo, entities)
+	rc.gm.Inc(metrics.Created, int64(len(ids)))
+
+reply:
+	api.WriteResult(rc, w, ids, err)
+}
+
+// importHandler godoc
+// @Summary Import entities from newline-delimited JSON
+// @Description Given a stream of entities, one JSON entity per line, create new entities of the given :type.
+// @Description Entities are inserted in batches of `batchSize` like POST /entities/:type?ordered=false: an entity
+// @Description that is invalid or not inserted (e.g. a duplicate) is counted as failed and does not stop the import.
+// @Description The response is a summary: the number of entities inserted and failed, and the error of each failed
+// @Description entity (up to 1000). The stream has no max size, but each entity is limited to config.server.max_body_bytes.
+// @Description Importing many entities can take longer than the default query timeout; set X-Etre-Query-Timeout.
+// @ID importHandler
+// @Accept x-ndjson
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param batchSize query int false "Entities per insert (default: config.server.import_batch_size, max: 10000)"
+// @Param setOp query string false "SetOp"
+// @Param setId query string false "SetId"
+// @Param setSize query int false "SetSize"
+// @Success 200 {object} etre.ImportResult "Summary of the import, including failed entities"
+// @Failure 400,413,503 {object} etre.ImportResult "Import stopped, see error"
+// @Router /entities/:type/import [post]
+func (api *API) importHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.CreateMany, 1) // specific write type
+
+	var res etre.ImportResult
+	var err error
+
+	batchSize := api.importBatchSize
+	if v := r.URL.Query().Get("batchSize"); v != "" {
+		batchSize, err = strconv.Atoi(v)
+		if err != nil || batchSize < 1 || batchSize > IMPORT_BATCH_SIZE_MAX {
+			err = ErrInvalidParam.New("invalid batchSize: %s: must be 1 to %d", v, IMPORT_BATCH_SIZE_MAX)
+			goto reply
+		}
+	}
+
+	res, err = api.importEntities(ctx, rc, r.Body, batchSize)
+	rc.gm.Val(metrics.CreateBulk, int64(res.Inserted+res.Failed))
+	rc.gm.Inc(metrics.Created, int64(res.Inserted))
+
+reply:
+	httpStatus := http.StatusOK
+	if err != nil {
+		log.Printf("API WRITE ERROR: import: %v (request %s)", err, rc.requestId)
+		spanError(rc, err)
+		api.systemMetrics.Inc(metrics.Error, 1)
+		res.Error = api.writeError(rc, err)
+		res.Error.RequestId = rc.requestId
+		httpStatus = res.Error.HTTPStatus
+	} else if res.Failed > 0 {
+		// Like an unordered insert (see WriteResult), but the import succeeded
+		log.Printf("API WRITE ERROR: import: %d entities not inserted (request %s)", res.Failed, rc.requestId)
+		api.systemMetrics.Inc(metrics.Error, 1)
+	}
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(res)
+}
+
+// importEntities reads entities from the NDJSON body and inserts them in batches
+// with an unordered insert. An entity that is not valid JSON, not valid, not
+// authorized, or not inserted is counted as failed. The returned error stops the
+// import, like a database error; the result counts the entities before it.
+func (api *API) importEntities(ctx context.Context, rc *req, body io.Reader, batchSize int) (etre.ImportResult, error) {
+	var res etre.ImportResult
+	failed := func(i int, err error) {
+		res.Failed++
+		if len(res.Errors) == IMPORT_MAX_ERRORS {
+			return
+		}
+		e := *api.writeError(rc, err)
+		if e.EntityIndex != nil && *e.EntityIndex != i {
+			// Each entity is validated alone, so the message has its index in
+			// a slice of one (0), not its index in the stream
+			old := fmt.Sprintf("index %d", *e.EntityIndex)
+			if n := strings.LastIndex(e.Message, old); n >= 0 {
+				e.Message = e.Message[:n] + fmt.Sprintf("index %d", i) + e.Message[n+len(old):]
+			}
+		}
+		e.EntityIndex = &i // every import error is for one entity
+		res.Errors = append(res.Errors, etre.WriteError{Index: i, Error: e})
+	}
+
+	wo := rc.wo
+	wo.Unordered = true
+
+	var batch []etre.Entity
+	var index []int // stream index of each entity in batch
+	insert := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ids, err := api.es.CreateEntities(ctx, wo, batch)
+		res.Inserted += len(ids)
+		if err != nil {
+			insertErrs, ok := err.(entity.InsertErrors)
+			if !ok {
+				res.Failed += len(batch) - len(ids)
+				return err
+			}
+			failedIndexes := make([]int, 0, len(insertErrs))
+			for i := range insertErrs {
+				failedIndexes = append(failedIndexes, i)
+			}
+			sort.Ints(failedIndexes)
+			for _, i := range failedIndexes {
+				failed(index[i], insertErrs[i])
+			}
+		}
+		batch, index = nil, nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), int(api.maxBodyBytes))
+	n := 0 // entities read
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		i := n
+		n++
+
+		var e etre.Entity
+		if err := json.Unmarshal(line, &e); err != nil || e == nil {
+			failed(i, ErrInvalidContent.New("entity %d is not a valid JSON object", i))
+			continue
+		}
+		if err := api.validate.Entities([]etre.Entity{e}, entity.VALIDATE_ON_CREATE); err != nil {
+			failed(i, err)
+			continue
+		}
+		if err := api.validate.Schema(rc.entityType, []etre.Entity{e}, entity.VALIDATE_ON_CREATE); err != nil {
+			failed(i, err)
+			continue
+		}
+		if err := api.authorizeLabels(rc, auth.OP_INSERT, entityLabels(e)); err != nil {
+			failed(i, err)
+			continue
+		}
+
+		batch = append(batch, e)
+		index = append(index, i)
+		if len(batch) == batchSize {
+			if err := insert(); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	// Insert the last batch, which was read ok, before returning a read error
+	if err := insert(); err != nil {
+		return res, err
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return res, ErrPayloadTooLarge.New("entity %d larger than %d bytes (config.server.max_body_bytes)", n, api.maxBodyBytes)
+		}
+		return res, ErrInvalidContent.New("error reading entity %d: %s", n, err)
+	}
+	if n == 0 {
+		return res, ErrNoContent
+	}
+	return res, nil
+}
+
+// putEntitiesHandler godoc
+// @Summary Update matching entities in bulk
+// @Description Given JSON payload, update labels in matching entities of the given :type.
+// @Description Applies update to the set of entities matching the labels in the `query` query parameter.
+// @Description Optionally specify `setOp`, `setId`, and `setSize` together to define a SetOp.
+// @Description Or, with Content-Type application/json-patch+json, JSON Patch (RFC 6902) operations add, replace, and remove. Paths like /label/field change nested fields.
+// @ID putEntitiesHandler
+// @Accept json
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param query query string true "Selector"
+// @Param setOp query string false "SetOp"
+// @Param setId query string false "SetId"
+// @Param setSize query int false "SetSize"
+// @Param upsert query bool false "If true and no entity matches, insert an entity made from the query (label=value only) and the patch"
+// @Param ordered query bool false "If false, continue updating after an entity is not updated; see errors in the write result"
+// @Success 200 {array} etre.Entity "Set of matching entities after update applied."
+// @Failure 400 {object} etre.Error
+// @Router /entities/:type [put]
+func (api *API) putEntitiesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.UpdateQuery, 1) // specific write type
+
+	// Return values at reply (not mutually exclusive)
+	var entities []etre.Entity
+	var err error
+
+	var patch etre.Entity
+
+	// Parse query (label selector) from URL
+	var q query.Query
+	q, err = parseQuery(r)
+	if err != nil {
+		goto reply
+	}
+
+	// Read and validate patch entity
+	if patch, err = api.readPatch(r); err != nil {
+		goto reply
+	}
+	if len(patch) == 0 {
+		err = ErrNoContent
+		goto reply
+	}
+	if err = api.validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
+		goto reply
+	}
+	if err = api.validate.Schema(rc.entityType, []etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
+		goto reply
+	}
+	if err = api.authorizeLabels(rc, auth.OP_UPDATE, entity.PatchLabels(patch)); err != nil {
+		goto reply
+	}
+	if rc.wo.Upsert {
+		// Upsert can insert, so caller must be allowed to insert, too
+		if err = api.authorizeUpsert(rc, append(q.Labels(), entity.PatchLabels(patch)...)); err != nil {
+			goto reply
+		}
+	}
+
+	// Label metrics (read and update)
+	rc.gm.Val(metrics.Labels, int64(len(q.AllPredicates())))
+	for _, p := range q.AllPredicates() {
+		rc.gm.IncLabel(metrics.LabelRead, p.Label)
+	}
+	for _, label := range entity.PatchLabels(patch) {
+		rc.gm.IncLabel(metrics.LabelUpdate, label)
+	}
+
+	// Patch all entities matching query
+	autoSet(rc, "update")
+	entities, err = api.es.UpdateEntities(ctx, rc.wo, q, patch)
+	rc.gm.Val(metrics.UpdateBulk, int64(len(entities)))
+	rc.gm.Inc(metrics.Updated, int64(len(entities)))
+
+reply:
+	api.WriteResult(rc, w, entities, err)
+}
+
+// deleteEntitiesHandler godoc
+// @Summary Remove matching entities in bulk
+// @Description Deletes the set of entities of the given :type, matching the labels in the `query` query parameter.
+// @ID deleteEntitiesHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param query query string true "Selector"
+// @Param setOp query string false "SetOp"
+// @Param setId query string false "SetId"
+// @Param setSize query int false "SetSize"
+// @Success 200 {array} etre.Entity "OK"
+// @Failure 400 {object} etre.Error
+// @Router /entities/:type [delete]
+func (api *API) deleteEntitiesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.DeleteQuery, 1) // specific write type
+
+	// Return values at reply (not mutually exclusive)
+	var entities []etre.Entity
+	var err error
+
+	// Parse query (label selector) from URL
+	var q query.Query
+	q, err = parseQuery(r)
+	if err != nil {
+		goto reply
+	}
+
+	// Label metrics
+	rc.gm.Val(metrics.Labels, int64(len(q.AllPredicates())))
+	for _, p := range q.AllPredicates() {
+		rc.gm.IncLabel(metrics.LabelRead, p.Label)
+	}
+
+	// Delete entities, returns the deleted entities
+	autoSet(rc, "delete")
+	entities, err = api.es.DeleteEntities(ctx, rc.wo, q)
+	rc.gm.Val(metrics.DeleteBulk, int64(len(entities)))
+	rc.gm.Inc(metrics.Deleted, int64(len(entities)))
+	if readable := api.readableLabels(rc); readable != nil {
+		for _, e := range entities {
+			stripLabels(e, readable)
+		}
+	}
+
+reply:
+	api.WriteResult(rc, w, entities, err)
+}
+
+// deleteAllHandler godoc
+// @Summary Remove all entities of a type
+// @Description Deletes all entities of the given :type, including soft-deleted entities, like truncating the collection.
+// @Description Entities are always removed (not soft-deleted). Requires admin access.
+// @Description The `confirm` query parameter must be the entity type to prevent accidental deletion.
+// @ID deleteAllHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param confirm query string true "Entity type"
+// @Param setOp query string false "SetOp"
+// @Param setId query string false "SetId"
+// @Param setSize query int false "SetSize"
+// @Success 200 {array} etre.Entity "OK"
+// @Failure 400,403 {object} etre.Error
+// @Router /entities/:type/all [delete]
+func (api *API) deleteAllHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.DeleteQuery, 1) // specific write type
+
+	// Return values at reply (not mutually exclusive)
+	var entities []etre.Entity
+	var err error
+
+	// Caller must confirm the entity type to delete all of it
+	confirm, ok := r.URL.Query()["confirm"]
+	if !ok || confirm[0] == "" {
+		err = ErrMissingParam.New("missing confirm param: must be the entity type (%s)", rc.entityType)
+		goto reply
+	}
+	if confirm[0] != rc.entityType {
+		err = ErrInvalidParam.New("confirm param '%s' does not match entity type %s", confirm[0], rc.entityType)
+		goto reply
+	}
+
+	// Delete all entities, returns the deleted entities
+	autoSet(rc, "delete-all")
+	entities, err = api.es.DeleteAll(ctx, rc.wo)
+	rc.gm.Val(metrics.DeleteBulk, int64(len(entities)))
+	rc.gm.Inc(metrics.Deleted, int64(len(entities)))
+
+reply:
+	api.WriteResult(rc, w, entities, err)
+}
+
+// //////////////////////////////////////////////////////////////////////////
+// Single Entity
+// //////////////////////////////////////////////////////////////////////////
+
+// getEntityHandler godoc
+// @Summary Get one entity by id
+// @Description Return one entity of the given :type, identified by the path parameter :id.
+// @Description All labels of each entity are returned, unless specific labels are specified in the `labels` query parameter.
+// @Description If the `history` query parameter is given, the entity's most recent CDC events are returned inline
+// @Description in meta-label `_history`, oldest first. This requires CDC access.
+// @ID getEntityHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param id path string true "Entity ID"
+// @Param labels query string false "Comma-separated list of labels to return"
+// @Param aliases query string false "Comma-separated list of label:alias to return labels renamed, like dc:datacenter"
+// @Param deleted query boolean false "Return the entity if it's soft-deleted"
+// @Param history query integer false "Include up to N CDC events (default and max: cdc.max_history)"
+// @Param If-None-Match header string false "ETag of a previous response"
+// @Success 200 {object} etre.Entity "OK"
+// @Header 200 {string} ETag "Hash of the response"
+// @Success 304 "Not modified"
+// @Failure 400,403,404 {object} etre.Error
+// @Router /entity/:type/:id [get]
+func (api *API) getEntityHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadId, 1) // specific read type
+
+	// Query Filter
+	f := etre.QueryFilter{}
+	qv := r.URL.Query() // ?x=1&y=2&z -> https://godoc.org/net/url#Values
+	if csv, ok := qv["labels"]; ok {
+		f.ReturnLabels = strings.Split(csv[0], ",")
+	}
+	if _, ok := qv["deleted"]; ok {
+		f.IncludeDeleted = true
+	}
+	var err error
+	if f.Aliases, err = api.aliases(rc, qv); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	// Inline CDC history: check before reading the entity because it requires
+	// CDC auth, which the caller might not have
+	maxHistory := api.maxHistory()
+	history := 0
+	if v, ok := qv["history"]; ok {
+		if err := api.authorizeCDC(rc, r); err != nil {
+			api.readError(rc, w, err)
+			return
+		}
+		history = maxHistory
+		if v[0] != "" {
+			n, err := strconv.Atoi(v[0])
+			if err != nil || n < 1 {
+				api.readError(rc, w, ErrInvalidParam.New("invalid history: %s", v[0]))
+				return
+			}
+			if n < maxHistory {
+				history = n
+			}
+		}
+	}
+
+	// Read the entity by ID
+	entity, err := api.es.ReadEntity(ctx, rc.entityType, rc.entityId, f)
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	if entity == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	stripLabels(entity, api.readableLabels(rc))
+
+	if history > 0 {
+		events, err := api.entityHistory(rc, history)
+		if err != nil {
+			api.readError(rc, w, err)
+			return
+		}
+		readable := api.readableLabels(rc)
+		for i := range events {
+			events[i] = stripEventLabels(events[i], readable)
+		}
+		entity["_history"] = events
+	}
+
+	body, err := json.Marshal(entity)
+	if err != nil {
+		api.readError(rc, w, ErrInternal.New("cannot encode entity: %s", err))
+		return
+	}
+	writeWithETag(w, r, append(body, '\n'))
+}
+
+// headEntityHandler godoc
+// @Summary Check if an entity exists
+// @Description Returns 200 if the entity of the given :type and :id exists, else 404.
+// @Description There is no response body. It's cheaper than a get because it reads only the entity id.
+// @ID headEntityHandler
+// @Param type path string true "Entity type"
+// @Param id path string true "Entity ID"
+// @Param deleted query boolean false "Return 200 if the entity is soft-deleted"
+// @Success 200 "Entity exists"
+// @Failure 400,403,404 "No body"
+// @Router /entity/:type/:id [head]
+func (api *API) headEntityHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadId, 1) // specific read type
+
+	f := etre.QueryFilter{ReturnLabels: []string{"_id"}}
+	if _, ok := r.URL.Query()["deleted"]; ok {
+		f.IncludeDeleted = true
+	}
+	rc.inst.Start("db")
+	entity, err := api.es.ReadEntity(ctx, rc.entityType, rc.entityId, f)
+	rc.inst.Stop("db")
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	if entity == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
-// //////////////////////////////////////////////////////////////////////////
-// Single Entity
-// //////////////////////////////////////////////////////////////////////////
+// historyHandler godoc
+// @Summary Get the change history of one entity
+// @Description Return the most recent CDC events (up to config cdc.max_history) for one entity of the given :type, identified by the path parameter :id, oldest first (ordered by entity revision).
+// @Description Events are returned for deleted entities, too, but only as far back as CDC retention. This requires CDC access.
+// @Description Labels the caller cannot read (security.acl or entity.filter) are removed from event old and new values.
+// @ID historyHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param id path string true "Entity ID"
+// @Success 200 {array} etre.CDCEvent "OK"
+// @Failure 400,403,503 {object} etre.Error
+// @Router /entity/:type/:id/history [get]
+func (api *API) historyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.ReadId, 1) // specific read type
 
-// getEntityHandler godoc
-// @Summary Get one entity by id
-// @Description Return one entity of the given :type, identified by the path parameter :id.
-// @Description All labels of each entity are returned, unless specific labels are specified in the `labels` query parameter.
-// @ID getEntityHandler
+	if err := api.authorizeCDC(rc, r); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	// Entity might not exist (deleted), so don't read it: history is all its events
+	events, err := api.entityHistory(rc, api.maxHistory())
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	readable := api.readableLabels(rc)
+	for i := range events {
+		events[i] = stripEventLabels(events[i], readable)
+	}
+	json.NewEncoder(w).Encode(events)
+}
+
+// entityAtHandler godoc
+// @Summary Get one entity as of a revision or time
+// @Description Return one entity of the given :type, identified by the path parameter :id, as it was at revision `rev`
+// @Description or time `ts` (Unix milliseconds, like CDC event `ts`). The entity is reconstructed by replaying its CDC events,
+// @Description so this requires CDC access. If CDC events no longer go back far enough (see config cdc.retention),
+// @Description the error is cdc-history-gone (410). It's the same error if the entity has more than cdc.max_history events.
+// @Description If the entity did not exist or was deleted at that point, it's not found (404).
+// @ID entityAtHandler
 // @Produce json
 // @Param type path string true "Entity type"
 // @Param id path string true "Entity ID"
-// @Param labels query string false "Comma-separated list of labels to return"
+// @Param rev query integer false "Entity revision (rev or ts required)"
+// @Param ts query integer false "Unix timestamp in milliseconds (rev or ts required)"
 // @Success 200 {object} etre.Entity "OK"
-// @Failure 400,404 {object} etre.Error
-// @Router /entity/:type/:id [get]
-func (api *API) getEntityHandler(w http.ResponseWriter, r *http.Request) {
+// @Failure 400,403,404,410 {object} etre.Error
+// @Router /entity/:type/:id/at [get]
+func (api *API) entityAtHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()             // query timeout
 	rc := ctx.Value(reqKey).(*req) // Etre request context
 	rc.inst.Start("handler")
@@ -876,27 +2079,116 @@ func (api *API) getEntityHandler(w http.ResponseWriter, r *http.Request) {
 
 	rc.gm.Inc(metrics.ReadId, 1) // specific read type
 
-	// Query Filter
-	f := etre.QueryFilter{}
-	qv := r.URL.Query() // ?x=1&y=2&z -> https://godoc.org/net/url#Values
-	if csv, ok := qv["labels"]; ok {
-		f.ReturnLabels = strings.Split(csv[0], ",")
+	// Exactly one of rev or ts
+	qv := r.URL.Query()
+	revStr, revOk := qv["rev"]
+	tsStr, tsOk := qv["ts"]
+	if revOk == tsOk {
+		api.readError(rc, w, ErrMissingParam.New("rev or ts param required (not both)"))
+		return
+	}
+	var at func([]etre.CDCEvent) (etre.Entity, error)
+	if revOk {
+		rev, err := strconv.ParseInt(revStr[0], 10, 64)
+		if err != nil || rev < 0 {
+			api.readError(rc, w, ErrInvalidParam.New("invalid rev: %s", revStr[0]))
+			return
+		}
+		at = func(events []etre.CDCEvent) (etre.Entity, error) { return cdc.EntityAtRev(events, rev) }
+	} else {
+		ts, err := strconv.ParseInt(tsStr[0], 10, 64)
+		if err != nil || ts < 1 {
+			api.readError(rc, w, ErrInvalidParam.New("invalid ts: %s", tsStr[0]))
+			return
+		}
+		at = func(events []etre.CDCEvent) (etre.Entity, error) { return cdc.EntityAtTs(events, ts) }
 	}
 
-	// Read the entity by ID
-	entity, err := api.es.ReadEntity(ctx, rc.entityType, rc.entityId, f)
+	if err := api.authorizeCDC(rc, r); err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+
+	// If the entity has more than max history events, the insert event isn't
+	// read and replay returns etre.ErrCDCHistoryGone
+	events, err := api.entityHistory(rc, api.maxHistory())
 	if err != nil {
 		api.readError(rc, w, err)
 		return
 	}
-	if entity == nil {
+	if len(events) == 0 {
+		// No history: entity never existed, or it exists but all its events
+		// are older than CDC retention
+		current, err := api.es.ReadEntity(ctx, rc.entityType, rc.entityId, etre.QueryFilter{IncludeDeleted: true})
+		if err != nil {
+			api.readError(rc, w, err)
+			return
+		}
+		if current != nil {
+			api.readError(rc, w, etre.ErrCDCHistoryGone.New("no CDC events for entity %s", rc.entityId))
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	entity, err := at(events)
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	if entity == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	stripLabels(entity, api.readableLabels(rc))
 	json.NewEncoder(w).Encode(entity)
 }
 
+// authorizeCDC returns an error if CDC is disabled or the caller is not authorized
+// to read CDC events for the entity type. Entity history is read from CDC, so it
+// requires CDC access, not only read access.
+func (api *API) authorizeCDC(rc *req, r *http.Request) error {
+	if api.cdcDisabled {
+		return ErrCDCDisabled
+	}
+	if err := api.auth.Authorize(rc.caller, auth.Action{EntityType: rc.entityType, Op: auth.OP_CDC}); err != nil {
+		log.Printf("AUTH: not authorized: %s (caller: %+v request: %+v)", err, rc.caller, r)
+		rc.gm.Inc(metrics.AuthorizationFailed, 1)
+		return auth.Error{
+			Err:        err,
+			Type:       "not-authorized",
+			HTTPStatus: http.StatusForbidden,
+		}
+	}
+	return nil
+}
+
+// maxHistory returns config cdc.max_history, or the default if not set.
+func (api *API) maxHistory() int {
+	if api.cdcMaxHistory <= 0 {
+		return config.DEFAULT_CDC_MAX_HISTORY
+	}
+	return api.cdcMaxHistory
+}
+
+// entityHistory returns the most recent limit CDC events for the entity, oldest first.
+func (api *API) entityHistory(rc *req, limit int) ([]etre.CDCEvent, error) {
+	rc.inst.Start("cdc")
+	defer rc.inst.Stop("cdc")
+	events, err := api.cdcStore.Read(cdc.Filter{
+		SinceTs:    1, // all events, not the default (last hour)
+		EntityId:   rc.entityId,
+		EntityType: rc.entityType,
+		Limit:      int64(limit),
+		Order:      cdc.ByEntityIdRevAsc{},
+	})
+	if err != nil {
+		return nil, ErrInternal.New("cannot read CDC events: %s", err)
+	}
+	return events, nil
+}
+
 // getLabelsHandler godoc
 // @Summary Return the labels for a single entity.
 // @Description Return an array of label names used by a single entity of the given :type, identified by the path parameter :id.
@@ -926,6 +2218,7 @@ func (api *API) getLabelsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	stripLabels(entity, api.readableLabels(rc))
 	json.NewEncoder(w).Encode(entity.Labels())
 }
 
@@ -938,13 +2231,18 @@ func (api *API) getLabelsHandler(w http.ResponseWriter, r *http.Request) {
 // @Description Given JSON payload, create one new entity of the given :type.
 // @Description Some meta-labels are filled in by Etre, e.g. `_id`.
 // @Description Optionally specify `setOp`, `setId`, and `setSize` together to define a SetOp.
+// @Description Optionally specify `query` to create the entity only if no entity matches the query.
+// @Description If an entity matches, nothing is written and the existing entity is returned as the write diff.
+// @Description The check and insert are atomic only if the collection has a unique index on the query labels.
 // @ID postEntityHandler
 // @Accept json
 // @Produce json
 // @Param type path string true "Entity type"
+// @Param query query string false "Selector: create only if no entity matches"
 // @Param setOp query string false "SetOp"
 // @Param setId query string false "SetId"
 // @Param setSize query int false "SetSize"
+// @Success 200 {object} etre.WriteResult "Entity matching `query` already exists"
 // @Success 201 {array} string "List of new entity id's"
 // @Failure 400,404 {object} etre.Error
 // @Router /entity/:type [post]
@@ -960,15 +2258,44 @@ func (api *API) postEntityHandler(w http.ResponseWriter, r *http.Request) {
 	var ids []string
 	var err error
 
+	var q query.Query
+	var conditional bool
+	var got etre.Entity
+	var created bool
+
 	// Read and validate new entity
 	if err = json.NewDecoder(r.Body).Decode(&newEntity); err != nil {
-		err = ErrInvalidContent
+		err = api.contentError(err)
 		goto reply
 	}
 
 	if err = api.validate.Entities([]etre.Entity{newEntity}, entity.VALIDATE_ON_CREATE); err != nil {
 		goto reply
 	}
+	if err = api.validate.Schema(rc.entityType, []etre.Entity{newEntity}, entity.VALIDATE_ON_CREATE); err != nil {
+		goto reply
+	}
+	if err = api.authorizeLabels(rc, auth.OP_INSERT, entityLabels(newEntity)); err != nil {
+		goto reply
+	}
+
+	// Conditional insert if query given: create only if no entity matches
+	if r.URL.Query().Get("query") != "" {
+		conditional = true
+		q, err = parseQuery(r)
+		if err != nil {
+			goto reply
+		}
+		rc.gm.Val(metrics.Labels, int64(len(q.AllPredicates())))
+		for _, p := range q.AllPredicates() {
+			rc.gm.IncLabel(metrics.LabelRead, p.Label)
+		}
+		got, created, err = api.es.CreateEntityIfNotExists(ctx, rc.wo, q, newEntity)
+		if err == nil && created {
+			rc.gm.Inc(metrics.Created, 1)
+		}
+		goto reply
+	}
 
 	// Create new entity
 	ids, err = api.es.CreateEntities(ctx, rc.wo, []etre.Entity{newEntity})
@@ -977,6 +2304,17 @@ func (api *API) postEntityHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 reply:
+	if conditional && err == nil {
+		if created {
+			// Same as plain insert: new id, HTTP 201
+			api.WriteResult(rc, w, []string{entity.IdString(got["_id"])}, nil)
+		} else {
+			// Not an error: existing entity as diff, HTTP 200
+			stripLabels(got, api.readableLabels(rc))
+			api.WriteResult(rc, w, got, nil)
+		}
+		return
+	}
 	api.WriteResult(rc, w, ids, err)
 }
 
@@ -984,6 +2322,7 @@ reply:
 // @Summary Patch one entity by _id
 // @Description Given JSON payload, update labels in the entity of the given :type and :id.
 // @Description Optionally specify `setOp`, `setId`, and `setSize` together to define a SetOp.
+// @Description Or, with Content-Type application/json-patch+json, JSON Patch (RFC 6902) operations add, replace, and remove. Paths like /label/field change nested fields.
 // @ID putEntityHandler
 // @Accept json
 // @Produce json
@@ -1008,19 +2347,24 @@ func (api *API) putEntityHandler(w http.ResponseWriter, r *http.Request) {
 	var entities []etre.Entity
 	var err error
 
-	q, _ := query.Translate("_id=" + rc.entityId)
+	q := query.ById(rc.entityId)
 
 	// Read and validate patch entity
-	if err = json.NewDecoder(r.Body).Decode(&patch); err != nil {
-		err = ErrInvalidContent
+	if patch, err = api.readPatch(r); err != nil {
 		goto reply
 	}
 	if err = api.validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
 		goto reply
 	}
+	if err = api.validate.Schema(rc.entityType, []etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
+		goto reply
+	}
+	if err = api.authorizeLabels(rc, auth.OP_UPDATE, entity.PatchLabels(patch)); err != nil {
+		goto reply
+	}
 
 	// Label metrics (update)
-	for label := range patch {
+	for _, label := range entity.PatchLabels(patch) {
 		rc.gm.IncLabel(metrics.LabelUpdate, label)
 	}
 
@@ -1066,7 +2410,7 @@ func (api *API) deleteEntityHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get and validate entity id from URL (:id).
 	// wo has the same (string) value but didn't validate it.
-	q, _ := query.Translate("_id=" + rc.entityId)
+	q := query.ById(rc.entityId)
 
 	// Delete one entity by ID
 	entities, err = api.es.DeleteEntities(ctx, rc.wo, q)
@@ -1076,8 +2420,231 @@ func (api *API) deleteEntityHandler(w http.ResponseWriter, r *http.Request) {
 		err = ErrNotFound
 	} else {
 		rc.gm.Inc(metrics.Deleted, 1)
+		stripLabels(entities[0], api.readableLabels(rc))
+	}
+
+reply:
+	api.WriteResult(rc, w, entities, err)
+}
+
+// restoreEntityHandler godoc
+// @Summary Restore one soft-deleted entity
+// @Description Restore one soft-deleted entity of the given :type and matching the :id parameter.
+// @Description It's an error if the entity is not soft-deleted. See config entity.soft_delete.
+// @ID restoreEntityHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param id path string true "Entity ID"
+// @Param setOp query string false "SetOp"
+// @Param setId query string false "SetId"
+// @Param setSize query int false "SetSize"
+// @Success 200 {array} etre.Entity "Set of restored entities before they were restored."
+// @Failure 400,404 {object} etre.Error
+// @Router /entity/:type/:id/restore [put]
+func (api *API) restoreEntityHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.UpdateId, 1)
+
+	var entities []etre.Entity
+	var err error
+
+	// Get and validate entity id from URL (:id).
+	// wo has the same (string) value but didn't validate it.
+	q := query.ById(rc.entityId)
+
+	// Restore one entity by ID
+	entities, err = api.es.RestoreEntities(ctx, rc.wo, q)
+	if err != nil {
+		goto reply
+	} else if len(entities) == 0 {
+		err = ErrNotFound
+	} else {
+		rc.gm.Inc(metrics.Updated, 1)
+	}
+
+reply:
+	api.WriteResult(rc, w, entities, err)
+}
+
+// deleteLabelByQueryHandler godoc
+// @Summary Delete a label from matching entities in bulk
+// @Description Remove one label from all entities of the given :type matching the labels in the `query` query parameter.
+// @Description Labels should be stable, so this is for migrations: it requires an admin role.
+// @ID deleteLabelByQueryHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param label path string true "Label name"
+// @Param query query string true "Selector"
+// @Param setOp query string false "SetOp"
+// @Param setId query string false "SetId"
+// @Param setSize query int false "SetSize"
+// @Success 200 {array} etre.Entity "Set of matching entities before the label is deleted."
+// @Failure 400,403 {object} etre.Error
+// @Router /entities/:type/labels/:label [delete]
+func (api *API) deleteLabelByQueryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.DeleteLabel, 1)
+
+	// Return values at reply (not mutually exclusive)
+	var entities []etre.Entity
+	var err error
+
+	var q query.Query
+	label := r.PathValue("label")
+	rc.gm.IncLabel(metrics.LabelDelete, label)
+	if err = api.validate.DeleteLabel(rc.entityType, label); err != nil {
+		goto reply
+	}
+	if err = api.authorizeLabels(rc, auth.OP_UPDATE, []string{label}); err != nil {
+		goto reply
+	}
+
+	// Parse query (label selector) from URL
+	q, err = parseQuery(r)
+	if err != nil {
+		goto reply
+	}
+
+	// Label metrics
+	rc.gm.Val(metrics.Labels, int64(len(q.AllPredicates())))
+	for _, p := range q.AllPredicates() {
+		rc.gm.IncLabel(metrics.LabelRead, p.Label)
+	}
+
+	// Delete label from all matching entities, returns the entities before
+	autoSet(rc, "delete-label")
+	entities, err = api.es.DeleteLabelByQuery(ctx, rc.wo, q, label)
+	rc.gm.Val(metrics.UpdateBulk, int64(len(entities)))
+	rc.gm.Inc(metrics.Updated, int64(len(entities)))
+
+reply:
+	api.WriteResult(rc, w, entities, err)
+}
+
+// renameLabelHandler godoc
+// @Summary Rename a label in matching entities in bulk
+// @Description Rename one label to the `name` query parameter in all entities of the given :type matching the labels in the `query` query parameter.
+// @Description Each entity is renamed atomically. If an entity already has the new label, the request fails unless `overwrite` is true.
+// @Description Labels should be stable, so this is for migrations: it requires an admin role.
+// @ID renameLabelHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param label path string true "Label name"
+// @Param query query string true "Selector"
+// @Param name query string true "New label name"
+// @Param overwrite query bool false "If true, replace the value of the new label if an entity already has it"
+// @Param setOp query string false "SetOp"
+// @Param setId query string false "SetId"
+// @Param setSize query int false "SetSize"
+// @Success 200 {array} etre.Entity "Set of matching entities before the label is renamed."
+// @Failure 400,403 {object} etre.Error
+// @Router /entities/:type/labels/:label [put]
+func (api *API) renameLabelHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.UpdateQuery, 1) // specific write type
+
+	// Return values at reply (not mutually exclusive)
+	var entities []etre.Entity
+	var err error
+
+	var q query.Query
+	var overwrite bool
+	label := r.PathValue("label")
+	newLabel := r.URL.Query().Get("name")
+	if newLabel == "" {
+		err = ErrMissingParam.New("missing name param (new label name)")
+		goto reply
+	}
+	if err = api.validate.RenameLabel(rc.entityType, label, newLabel); err != nil {
+		goto reply
+	}
+	if err = api.authorizeLabels(rc, auth.OP_UPDATE, []string{label, newLabel}); err != nil {
+		goto reply
+	}
+	overwrite = r.URL.Query().Get("overwrite") == "true"
+
+	// Parse query (label selector) from URL
+	q, err = parseQuery(r)
+	if err != nil {
+		goto reply
+	}
+
+	// Label metrics (read and update): renaming removes the label and adds the new label
+	rc.gm.Val(metrics.Labels, int64(len(q.AllPredicates())))
+	for _, p := range q.AllPredicates() {
+		rc.gm.IncLabel(metrics.LabelRead, p.Label)
+	}
+	rc.gm.IncLabel(metrics.LabelDelete, label)
+	rc.gm.IncLabel(metrics.LabelUpdate, newLabel)
+
+	// Rename label in all matching entities, returns the entities before
+	autoSet(rc, "rename-label")
+	entities, err = api.es.RenameLabel(ctx, rc.wo, q, label, newLabel, overwrite)
+	rc.gm.Val(metrics.UpdateBulk, int64(len(entities)))
+	rc.gm.Inc(metrics.Updated, int64(len(entities)))
+
+reply:
+	api.WriteResult(rc, w, entities, err)
+}
+
+// restoreEntitiesHandler godoc
+// @Summary Restore soft-deleted entities in bulk
+// @Description Restore all soft-deleted entities of the given :type matching the labels in the `query` query parameter.
+// @Description Matching entities that are not soft-deleted are ignored.
+// @Description See config entity.soft_delete.
+// @ID restoreEntitiesHandler
+// @Produce json
+// @Param type path string true "Entity type"
+// @Param query query string true "Selector"
+// @Param setOp query string false "SetOp"
+// @Param setId query string false "SetId"
+// @Param setSize query int false "SetSize"
+// @Success 200 {array} etre.Entity "Set of restored entities before they were restored."
+// @Failure 400 {object} etre.Error
+// @Router /entities/:type/restore [put]
+func (api *API) restoreEntitiesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()             // query timeout
+	rc := ctx.Value(reqKey).(*req) // Etre request context
+	rc.inst.Start("handler")
+	defer rc.inst.Stop("handler")
+
+	rc.gm.Inc(metrics.UpdateQuery, 1) // specific write type
+
+	// Return values at reply (not mutually exclusive)
+	var entities []etre.Entity
+	var err error
+
+	// Parse query (label selector) from URL
+	var q query.Query
+	q, err = parseQuery(r)
+	if err != nil {
+		goto reply
 	}
 
+	// Label metrics
+	rc.gm.Val(metrics.Labels, int64(len(q.AllPredicates())))
+	for _, p := range q.AllPredicates() {
+		rc.gm.IncLabel(metrics.LabelRead, p.Label)
+	}
+
+	// Restore entities, returns the entities before they were restored
+	autoSet(rc, "restore")
+	entities, err = api.es.RestoreEntities(ctx, rc.wo, q)
+	rc.gm.Val(metrics.UpdateBulk, int64(len(entities)))
+	rc.gm.Inc(metrics.Updated, int64(len(entities)))
+
 reply:
 	api.WriteResult(rc, w, entities, err)
 }
@@ -1114,7 +2681,10 @@ func (api *API) deleteLabelHandler(w http.ResponseWriter, r *http.Request) {
 		goto reply
 	}
 	rc.gm.IncLabel(metrics.LabelDelete, label)
-	if err = api.validate.DeleteLabel(label); err != nil {
+	if err = api.validate.DeleteLabel(rc.entityType, label); err != nil {
+		goto reply
+	}
+	if err = api.authorizeLabels(rc, auth.OP_UPDATE, []string{label}); err != nil {
 		goto reply
 	}
 
@@ -1140,9 +2710,12 @@ reply:
 // @Description System Report includes a counter of queries, a `load` which is the number of currently executing queries, and counters of errors and failed authentications.
 // @Description Group Reports are made for each user-defined group, which correspond to authentication types.
 // @Description Group Reports have sub-reports for request failures, query traffic per entity type, and CDC activity.
+// @Description If `format=prometheus` or the Accept header is `text/plain` (like Prometheus scrapers), metrics are returned in Prometheus text exposition format.
 // @ID metricsHandler
 // @Produce json
+// @Produce plain
 // @Param reset query string no "If 'yes' or 'true' then reset metrics to zero."
+// @Param format query string no "If 'prometheus' then return Prometheus text exposition format."
 // @Success 200 {object} etre.Metrics "OK"
 // @Router /metrics [get]
 func (api *API) metricsHandler(w http.ResponseWriter, r *http.Request) {
@@ -1162,14 +2735,10 @@ func (api *API) metricsHandler(w http.ResponseWriter, r *http.Request) {
 	// will be the default metric group: "etre". Else, the user-defined auth
 	// plugin can specify zero or more groups.
 	groups := api.metricsStore.Names()
-	if len(groups) == 0 { // no user-defined metric groups
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(all)
-		return
+	if len(groups) > 0 {
+		all.Groups = make([]etre.MetricsGroupReport, len(groups))
 	}
 
-	all.Groups = make([]etre.MetricsGroupReport, len(groups))
-
 	// Get metrics for each group, which also returns an etre.Metrics with
 	// System nil and Groups[0] = the group metrics
 	for i, name := range groups {
@@ -1182,25 +2751,76 @@ func (api *API) metricsHandler(w http.ResponseWriter, r *http.Request) {
 		r.Groups[0].Group = name
 		all.Groups[i] = r.Groups[0]
 	}
+
+	if prometheusFormat(r) {
+		w.Header().Set("Content-Type", metrics.PROMETHEUS_CONTENT_TYPE)
+		if err := metrics.WritePrometheus(w, all); err != nil {
+			log.Printf("Error writing Prometheus metrics: %s", err)
+		}
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(all)
 }
 
+// prometheusFormat returns true if the client requested metrics in Prometheus
+// text format: ?format=prometheus, or Accept: text/plain without application/json.
+// JSON is the default for backwards-compatibility.
+func prometheusFormat(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return strings.ToLower(f) == "prometheus"
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "application/json")
+}
+
 // statusHandler godoc
 // @Summary Report service status
 // @Description Report if the service is up, and what version of the Etre service.
+// @Description If CDC is enabled, "cdc" is the change stream server status: clients and buffer usage.
 // @ID statusHandler
-// @Success 200 {string} string "returns a map[string]string"
+// @Success 200 {object} map[string]interface{} "returns a map[string]interface{}"
 // @Router /status [get]
 func (api *API) statusHandler(w http.ResponseWriter, r *http.Request) {
-	status := map[string]string{
+	status := map[string]interface{}{
 		"ok":      "yes",
 		"version": etre.VERSION,
 	}
+	if !api.cdcDisabled && api.changesServer != nil {
+		status["cdc"] = api.changesServer.Status()
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
 }
 
+// healthHandler godoc
+// @Summary Report service health
+// @Description Report if the service is connected to its databases. Returns HTTP 503
+// @Description if a required database (main, or CDC if enabled) is not connected.
+// @ID healthHandler
+// @Produce json
+// @Success 200 {object} etre.Health
+// @Failure 503 {object} etre.Health
+// @Router /health [get]
+func (api *API) healthHandler(w http.ResponseWriter, r *http.Request) {
+	health := etre.Health{
+		MainDb:  true,
+		CDCDb:   !api.cdcDisabled,
+		Version: etre.VERSION,
+	}
+	if api.health != nil {
+		health.MainDb = api.health.MainDb()
+		health.CDCDb = !api.cdcDisabled && api.health.CDCDb()
+	}
+	status := http.StatusOK
+	if !health.MainDb || (!api.cdcDisabled && !health.CDCDb) {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(health)
+}
+
 // --------------------------------------------------------------------------
 // Change feed
 // --------------------------------------------------------------------------
@@ -1214,6 +2834,7 @@ var upgrader = websocket.Upgrader{
 // @Summary Starts a websocket response.
 // @Description Starts streaming changes from the Etre CDC on a websocket interface.
 // @Description See Etre documentation for details about consuming the changes stream.
+// @Description Labels the caller cannot read (security.acl or entity.filter) are removed from event old and new values.
 // @ID changesHandler
 // @Router /changes [get]
 func (api *API) changesHandler(w http.ResponseWriter, r *http.Request) {
@@ -1240,7 +2861,9 @@ func (api *API) changesHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("CDC: %s: connected", clientId)
 
 	stream := api.streamFactory.Make(clientId)
-	client := changestream.NewWebsocketClient(clientId, wsConn, stream)
+	client := changestream.NewWebsocketClient(clientId, wsConn, stream, rc.gm).WithEventFilter(func(e etre.CDCEvent) etre.CDCEvent {
+		return stripEventLabels(e, api.entityReadableLabels(rc.caller, e.EntityType))
+	})
 	if err := client.Run(); err != nil {
 		switch err {
 		case changestream.ErrWebsocketClosed:
@@ -1251,12 +2874,138 @@ func (api *API) changesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// replayHandler godoc
+// @Summary Replay past CDC events to one change feed client.
+// @Description Sends a range of past CDC events to only the change feed client with the given clientId, so it can reprocess them.
+// @Description The client must be connected to this Etre instance (see GET /status). The range is inclusive: sinceId and untilId, or sinceSeq and untilSeq.
+// @Description Events are sent in sequence order. Requires admin.
+// @ID replayHandler
+// @Accept json
+// @Produce json
+// @Param replay body etre.CDCReplay true "Client and range of events"
+// @Success 200 {object} etre.CDCReplayResult "OK"
+// @Failure 400,403,404,409,501 {object} etre.Error
+// @Router /changes/replay [post]
+func (api *API) replayHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rc := ctx.Value(reqKey).(*req)
+
+	if api.cdcDisabled || api.changesServer == nil {
+		api.readError(rc, w, ErrCDCDisabled)
+		return
+	}
+
+	// Replaying can make a client reprocess many events, so it's an admin op,
+	// not only a CDC op like the feed (see cdcWrapper)
+	if err := api.auth.Authorize(rc.caller, auth.Action{Op: auth.OP_ADMIN}); err != nil {
+		log.Printf("AUTH: not authorized: %s (caller: %+v request: %+v)", err, rc.caller, r)
+		rc.gm.Inc(metrics.AuthorizationFailed, 1)
+		api.readError(rc, w, auth.Error{
+			Err:        err,
+			Type:       "not-authorized",
+			HTTPStatus: http.StatusForbidden,
+		})
+		return
+	}
+
+	var replay etre.CDCReplay
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, api.maxBodyBytes)).Decode(&replay); err != nil {
+		api.readError(rc, w, api.contentError(err))
+		return
+	}
+	if replay.ClientId == "" {
+		api.readError(rc, w, ErrMissingParam.New("missing clientId: replay must target one CDC client"))
+		return
+	}
+
+	sinceSeq, untilSeq, err := api.replayRange(replay)
+	if err != nil {
+		api.readError(rc, w, err)
+		return
+	}
+	events, err := api.cdcStore.Read(cdc.Filter{
+		SinceSeq: sinceSeq - 1, // exclusive
+		UntilSeq: untilSeq + 1, // exclusive
+		Order:    cdc.BySeqAsc{},
+	})
+	if err != nil {
+		api.readError(rc, w, ErrInternal.New("cannot read CDC events: %s", err))
+		return
+	}
+
+	if err := api.changesServer.Replay(replay.ClientId, events); err != nil {
+		switch err {
+		case changestream.ErrClientNotFound:
+			api.readError(rc, w, ErrCDCClientNotFound.New("CDC client %s not connected to this Etre instance", replay.ClientId))
+		case changestream.ErrReplayBusy:
+			api.readError(rc, w, ErrCDCReplayBusy)
+		default:
+			api.readError(rc, w, ErrInternal.New("%s", err))
+		}
+		return
+	}
+	log.Printf("CDC: %s: replayed %d events (seq %d to %d) by %s", replay.ClientId, len(events), sinceSeq, untilSeq, rc.caller.Name)
+
+	json.NewEncoder(w).Encode(etre.CDCReplayResult{
+		ClientId: replay.ClientId,
+		Events:   len(events),
+	})
+}
+
+// replayRange returns the inclusive range of sequence numbers to replay. An
+// id range is resolved to the sequence numbers of the events.
+func (api *API) replayRange(replay etre.CDCReplay) (int64, int64, error) {
+	byId := replay.SinceId != "" || replay.UntilId != ""
+	bySeq := replay.SinceSeq != 0 || replay.UntilSeq != 0
+	if byId && bySeq {
+		return 0, 0, ErrInvalidParam.New("sinceId and untilId are mutually exclusive with sinceSeq and untilSeq")
+	}
+	sinceSeq, untilSeq := replay.SinceSeq, replay.UntilSeq
+	if byId {
+		if replay.SinceId == "" || replay.UntilId == "" {
+			return 0, 0, ErrMissingParam.New("sinceId and untilId are required")
+		}
+		var err error
+		if sinceSeq, err = api.eventSeq(replay.SinceId); err != nil {
+			return 0, 0, err
+		}
+		if untilSeq, err = api.eventSeq(replay.UntilId); err != nil {
+			return 0, 0, err
+		}
+	} else if sinceSeq <= 0 || untilSeq <= 0 {
+		return 0, 0, ErrMissingParam.New("sinceId and untilId, or sinceSeq and untilSeq greater than zero, are required")
+	}
+	if sinceSeq > untilSeq {
+		return 0, 0, ErrInvalidParam.New("start of range (seq %d) is after end of range (seq %d)", sinceSeq, untilSeq)
+	}
+	if n := untilSeq - sinceSeq + 1; n > CDC_REPLAY_MAX_EVENTS {
+		return 0, 0, ErrResultTooLarge.New("range of %d events exceeds max %d", n, CDC_REPLAY_MAX_EVENTS)
+	}
+	return sinceSeq, untilSeq, nil
+}
+
+// eventSeq returns the sequence number of the CDC event.
+func (api *API) eventSeq(eventId string) (int64, error) {
+	events, err := api.cdcStore.Read(cdc.Filter{EventId: eventId})
+	if err != nil {
+		return 0, ErrInternal.New("cannot read CDC event %s: %s", eventId, err)
+	}
+	if len(events) == 0 {
+		return 0, ErrNotFound.New("CDC event %s not found", eventId)
+	}
+	if events[0].Seq == 0 {
+		return 0, ErrInvalidParam.New("CDC event %s has no sequence number; it was written by an older version of Etre", eventId)
+	}
+	return events[0].Seq, nil
+}
+
 // Return error on read. Writes always return an etre.WriteResult by calling WriteResult.
 func (api *API) readError(rc *req, w http.ResponseWriter, err error) {
 	api.systemMetrics.Inc(metrics.Error, 1)
 	var httpStatus = http.StatusInternalServerError
 	var ret interface{}
-	log.Printf("API READ ERROR: %v", err)
+	log.Printf("API READ ERROR: %v (request %s)", err, rc.requestId)
+	spanError(rc, err)
 	switch v := err.(type) {
 	case etre.Error:
 		maybeInc(metrics.ClientError, 1, rc.gm)
@@ -1264,10 +3013,15 @@ func (api *API) readError(rc *req, w http.ResponseWriter, err error) {
 		ret = err
 	case entity.ValidationError:
 		maybeInc(metrics.ClientError, 1, rc.gm)
-		ret = etre.Error{
-			Message:    v.Err.Error(),
-			Type:       v.Type,
-			HTTPStatus: http.StatusBadRequest,
+		switch v.Type {
+		case ErrResultTooLarge.Type:
+			ret = ErrResultTooLarge.New("%s", v.Err)
+		default:
+			ret = etre.Error{
+				Message:    v.Err.Error(),
+				Type:       v.Type,
+				HTTPStatus: http.StatusBadRequest,
+			}
 		}
 		httpStatus = http.StatusBadRequest
 	case auth.Error:
@@ -1280,7 +3034,7 @@ func (api *API) readError(rc *req, w http.ResponseWriter, err error) {
 		httpStatus = v.HTTPStatus
 	case entity.DbError:
 		dbErr := err.(entity.DbError)
-		if dbErr.Err == context.DeadlineExceeded {
+		if dbErr.Err == context.DeadlineExceeded || dbErr.Type == "query-timeout" {
 			maybeInc(metrics.QueryTimeout, 1, rc.gm)
 		} else {
 			maybeInc(metrics.DbError, 1, rc.gm)
@@ -1297,10 +3051,67 @@ func (api *API) readError(rc *req, w http.ResponseWriter, err error) {
 		httpStatus = http.StatusInternalServerError
 	}
 
+	if e, ok := ret.(etre.Error); ok {
+		e.RequestId = rc.requestId
+		ret = e
+	}
+
 	w.WriteHeader(httpStatus)
 	json.NewEncoder(w).Encode(ret)
 }
 
+// queryError maps an error from one query in a batch query to an etre.Error.
+// It's like readError, but it returns the error instead of writing it, and it
+// does not increment metrics.
+func queryError(err error) *etre.Error {
+	var e etre.Error
+	switch v := err.(type) {
+	case etre.Error:
+		e = v
+	case entity.ValidationError:
+		if v.Type == ErrResultTooLarge.Type {
+			e = ErrResultTooLarge.New("%s", v.Err)
+		} else {
+			e = etre.Error{Message: v.Err.Error(), Type: v.Type, HTTPStatus: http.StatusBadRequest}
+		}
+	case auth.Error:
+		e = etre.Error{Message: v.Err.Error(), Type: v.Type, HTTPStatus: v.HTTPStatus}
+	case entity.DbError:
+		e = etre.Error{Message: v.Error(), Type: v.Type, HTTPStatus: http.StatusServiceUnavailable, EntityId: v.EntityId}
+	default:
+		e = ErrInternal.New("%s", err)
+	}
+	return &e
+}
+
+// contentError returns ErrPayloadTooLarge if the error from decoding the request
+// body is because it's larger than max body bytes, else ErrInvalidContent.
+func (api *API) contentError(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return ErrPayloadTooLarge.New("HTTP payload larger than %d bytes (config.server.max_body_bytes)", maxErr.Limit)
+	}
+	return ErrInvalidContent
+}
+
+// readPatch reads the update patch from the request body: an etre.Entity, or
+// JSON Patch operations if the Content-Type is etre.JSON_PATCH_CONTENT_TYPE.
+func (api *API) readPatch(r *http.Request) (etre.Entity, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != etre.JSON_PATCH_CONTENT_TYPE {
+		var patch etre.Entity
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			return nil, api.contentError(err)
+		}
+		return patch, nil
+	}
+	var ops []etre.JSONPatchOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		return nil, api.contentError(err)
+	}
+	return entity.JSONPatch(ops)
+}
+
 // Return an etre.WriteResult for all writes, successful of not. ids are the
 // writes from entity.Store calls, which is why it can be different types.
 // ids and err are not mutually exclusive; writes can be partially successful.
@@ -1309,71 +3120,23 @@ func (api *API) WriteResult(rc *req, w http.ResponseWriter, ids interface{}, err
 	var wr etre.WriteResult
 	var writes []etre.Write
 
+	if rc.autoSet {
+		wr.SetId = rc.wo.SetId
+	}
+
 	// Map error to etre.Error
 	if err != nil {
-		log.Printf("API WRITE ERROR: %v", err)
+		log.Printf("API WRITE ERROR: %v (request %s)", err, rc.requestId)
+		spanError(rc, err)
 		api.systemMetrics.Inc(metrics.Error, 1)
-		switch v := err.(type) {
-		case etre.Error:
-			wr.Error = &v
-			switch err {
-			case ErrNotFound:
-				// Not an error
-			default:
-				maybeInc(metrics.ClientError, 1, rc.gm)
-			}
-		case entity.ValidationError:
-			maybeInc(metrics.ClientError, 1, rc.gm)
-			wr.Error = &etre.Error{
-				Message:    v.Err.Error(),
-				Type:       v.Type,
-				HTTPStatus: http.StatusBadRequest,
-			}
-		case entity.DbError:
-			if err.(entity.DbError).Err == context.DeadlineExceeded {
-				maybeInc(metrics.QueryTimeout, 1, rc.gm)
-			} else {
-				maybeInc(metrics.DbError, 1, rc.gm)
-			}
-			switch v.Type {
-			case "duplicate-entity":
-				dupeErr := ErrDuplicateEntity // copy
-				dupeErr.EntityId = v.EntityId
-				dupeErr.Message += " (db err: " + v.Err.Error() + ")"
-				wr.Error = &dupeErr
-			case "db-insert":
-				insertErr := ErrDBInsertFailed
-				insertErr.EntityId = v.EntityId
-				insertErr.Message += " (db err: " + v.Err.Error() + ")"
-				wr.Error = &insertErr
-			case "db-update":
-				updateErr := ErrDBUpdateFailed
-				updateErr.EntityId = v.EntityId
-				updateErr.Message += " (db err: " + v.Err.Error() + ")"
-				wr.Error = &updateErr
-			default:
-				wr.Error = &etre.Error{
-					Message:    v.Err.Error(),
-					Type:       v.Type,
-					HTTPStatus: http.StatusServiceUnavailable,
-					EntityId:   v.EntityId,
-				}
-			}
-		case auth.Error:
-			// Metric incremented by caller
-			wr.Error = &etre.Error{
-				Message:    v.Err.Error(),
-				Type:       v.Type,
-				HTTPStatus: v.HTTPStatus,
-			}
-		default:
-			maybeInc(metrics.APIError, 1, rc.gm)
-			wr.Error = &etre.Error{
-				Message:    err.Error(),
-				Type:       "unhandled-error",
-				HTTPStatus: http.StatusInternalServerError,
-			}
+		if insertErrs, ok := err.(entity.InsertErrors); ok {
+			wr.Error, wr.Errors = api.insertErrors(rc, insertErrs)
+		} else if updateErrs, ok := err.(entity.UpdateErrors); ok {
+			wr.Error, wr.Errors = api.updateErrors(rc, updateErrs)
+		} else {
+			wr.Error = api.writeError(rc, err)
 		}
+		wr.Error.RequestId = rc.requestId
 		httpStatus = wr.Error.HTTPStatus
 	} else {
 		httpStatus = http.StatusOK
@@ -1387,8 +3150,8 @@ func (api *API) WriteResult(rc *req, w http.ResponseWriter, ids interface{}, err
 			diffs := ids.([]etre.Entity)
 			writes = make([]etre.Write, len(diffs))
 			for i, diff := range diffs {
-				// _id from db is bson.ObjectID, convert to string
-				id := diff["_id"].(bson.ObjectID).Hex()
+				// _id from db is bson.ObjectID (or string), convert to string
+				id := entity.IdString(diff["_id"])
 				writes[i] = etre.Write{
 					EntityId: id,
 					URI:      api.addr + etre.API_ROOT + "/entity/" + id,
@@ -1414,9 +3177,9 @@ func (api *API) WriteResult(rc *req, w http.ResponseWriter, ids interface{}, err
 			// Entity from DeleteLabel
 			diff := ids.(etre.Entity)
 
-			// _id from db is bson.ObjectID, convert to string
+			// _id from db is bson.ObjectID (or string), convert to string
 			if diff != nil && diff["_id"] != nil {
-				id = diff["_id"].(bson.ObjectID).Hex()
+				id = entity.IdString(diff["_id"])
 			}
 			writes = []etre.Write{
 				{
@@ -1435,6 +3198,146 @@ func (api *API) WriteResult(rc *req, w http.ResponseWriter, ids interface{}, err
 	json.NewEncoder(w).Encode(wr)
 }
 
+// writeError maps a write error to an etre.Error and increments its metric.
+func (api *API) writeError(rc *req, err error) *etre.Error {
+	switch v := err.(type) {
+	case etre.Error:
+		switch err {
+		case ErrNotFound:
+			// Not an error
+		default:
+			maybeInc(metrics.ClientError, 1, rc.gm)
+		}
+		return &v
+	case entity.ValidationError:
+		maybeInc(metrics.ClientError, 1, rc.gm)
+		return &etre.Error{
+			Message:     v.Err.Error(),
+			Type:        v.Type,
+			HTTPStatus:  http.StatusBadRequest,
+			EntityIndex: v.EntityIndex,
+			Label:       v.Label,
+		}
+	case entity.DbError:
+		if err.(entity.DbError).Err == context.DeadlineExceeded {
+			maybeInc(metrics.QueryTimeout, 1, rc.gm)
+		} else {
+			maybeInc(metrics.DbError, 1, rc.gm)
+		}
+		switch v.Type {
+		case "duplicate-entity":
+			dupeErr := ErrDuplicateEntity // copy
+			dupeErr.EntityId = v.EntityId
+			// Conflict values are entity values, so return only the labels the
+			// caller can read
+			readable := api.readableLabels(rc)
+			conflict := etre.Entity{}
+			for label, val := range v.Conflict {
+				conflict[label] = val
+			}
+			stripLabels(conflict, readable)
+			if len(conflict) > 0 {
+				dupeErr.Conflict = &conflict
+				dupeErr.Message += ": " + conflictLabels(conflict)
+			}
+			dbErr := v.Err.Error()
+			if readable != nil && (v.Conflict == nil || len(conflict) < len(v.Conflict)) {
+				// MongoDB error has all values, like "... dup key: { x: 6 }"
+				dbErr, _, _ = strings.Cut(dbErr, " dup key:")
+			}
+			dupeErr.Message += " (db err: " + dbErr + ")"
+			return &dupeErr
+		case "db-insert":
+			insertErr := ErrDBInsertFailed
+			insertErr.EntityId = v.EntityId
+			insertErr.Message += " (db err: " + v.Err.Error() + ")"
+			return &insertErr
+		case "db-update":
+			updateErr := ErrDBUpdateFailed
+			updateErr.EntityId = v.EntityId
+			updateErr.Message += " (db err: " + v.Err.Error() + ")"
+			return &updateErr
+		default:
+			return &etre.Error{
+				Message:    v.Err.Error(),
+				Type:       v.Type,
+				HTTPStatus: http.StatusServiceUnavailable,
+				EntityId:   v.EntityId,
+			}
+		}
+	case auth.Error:
+		// Metric incremented by caller
+		return &etre.Error{
+			Message:    v.Err.Error(),
+			Type:       v.Type,
+			HTTPStatus: v.HTTPStatus,
+		}
+	default:
+		maybeInc(metrics.APIError, 1, rc.gm)
+		return &etre.Error{
+			Message:    err.Error(),
+			Type:       "unhandled-error",
+			HTTPStatus: http.StatusInternalServerError,
+		}
+	}
+}
+
+// insertErrors maps the errors of an unordered insert to the top-level error
+// and the per-entity errors of a WriteResult. The top-level error is the error
+// of the first entity not inserted, so its HTTP status is the response status.
+func (api *API) insertErrors(rc *req, insertErrs entity.InsertErrors) (*etre.Error, []etre.WriteError) {
+	indexes := make([]int, 0, len(insertErrs))
+	for i := range insertErrs {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	errs := make([]etre.WriteError, len(indexes))
+	for n, i := range indexes {
+		errs[n] = etre.WriteError{
+			Index: i,
+			Error: *api.writeError(rc, insertErrs[i]),
+		}
+	}
+	first := errs[0].Error // copy
+	first.Message = fmt.Sprintf("%s; first error: entity %d: %s", insertErrs.Error(), errs[0].Index, first.Message)
+	return &first, errs
+}
+
+// updateErrors maps the errors of an unordered update to the top-level error
+// and the per-entity errors of a WriteResult, like insertErrors. The entities
+// were matched by query, not sent by the client, so each error has Index -1 and
+// the entity _id in Error.EntityId. Errors are sorted by entity _id.
+func (api *API) updateErrors(rc *req, updateErrs entity.UpdateErrors) (*etre.Error, []etre.WriteError) {
+	ids := make([]string, 0, len(updateErrs))
+	for id := range updateErrs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	errs := make([]etre.WriteError, len(ids))
+	for n, id := range ids {
+		errs[n] = etre.WriteError{
+			Index: -1,
+			Error: *api.writeError(rc, updateErrs[id]),
+		}
+		errs[n].Error.EntityId = id
+	}
+	first := errs[0].Error // copy
+	first.Message = fmt.Sprintf("%s; first error: entity %s: %s", updateErrs.Error(), ids[0], first.Message)
+	return &first, errs
+}
+
+// autoSet sets a server-generated SetOp and SetId for a bulk write if the caller
+// did not set a set op. SetSize is left zero for the entity store to set to the
+// number of entities written (see entity.WriteOp).
+func autoSet(rc *req, op string) {
+	if rc.wo.SetOp != "" || rc.wo.SetId != "" || rc.wo.SetSize > 0 {
+		return
+	}
+	rc.wo.SetOp = op
+	rc.wo.SetId = bson.NewObjectID().Hex()
+	rc.autoSet = true
+}
+
 func writeOp(r *http.Request, caller auth.Caller) entity.WriteOp {
 	wo := entity.WriteOp{
 		Caller:     caller.Name,
@@ -1456,10 +3359,217 @@ func writeOp(r *http.Request, caller auth.Caller) entity.WriteOp {
 		i, _ := strconv.Atoi(setSize)
 		wo.SetSize = i
 	}
+	if qv.Get("ordered") == "false" {
+		wo.Unordered = true
+	}
+	if qv.Get("upsert") == "true" {
+		wo.Upsert = true
+	}
 
 	return wo
 }
 
+// authorizeUpsert authorizes an insert by an upsert, which the request wrapper
+// cannot do because it authorizes an update for PUT.
+func (api *API) authorizeUpsert(rc *req, labels []string) error {
+	if err := api.auth.Authorize(rc.caller, auth.Action{EntityType: rc.entityType, Op: auth.OP_INSERT}); err != nil {
+		log.Printf("AUTH: not authorized: %s (caller: %+v)", err, rc.caller)
+		rc.gm.Inc(metrics.AuthorizationFailed, 1)
+		return auth.Error{
+			Err:        err,
+			Type:       "not-authorized",
+			HTTPStatus: http.StatusForbidden,
+		}
+	}
+	return api.authorizeLabels(rc, auth.OP_INSERT, labels)
+}
+
+// incQueryLabels increments the LabelQuery metric once for each label in the
+// read query that is in the entity type schema. Other labels are not counted
+// to bound metrics cardinality.
+func (api *API) incQueryLabels(rc *req, q query.Query) {
+	for _, label := range q.Labels() {
+		if api.entityConfig.SchemaLabel(rc.entityType, label) {
+			rc.gm.IncLabel(metrics.LabelQuery, label)
+		}
+	}
+}
+
+// authorizeLabels authorizes the op on the labels, which the request wrapper
+// cannot do because it authorizes before the request body is read. Labels not
+// returned by the default filter of the entity type cannot be read by any caller.
+func (api *API) authorizeLabels(rc *req, op string, labels []string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	if op == auth.OP_READ {
+		f := api.entityConfig.Filter[rc.entityType]
+		for _, label := range labels {
+			if f.LabelReturned(label) {
+				continue
+			}
+			log.Printf("AUTH: not authorized: label %s not returned by entity.filter.%s (caller: %+v)", label, rc.entityType, rc.caller)
+			rc.gm.Inc(metrics.AuthorizationFailed, 1)
+			return auth.Error{
+				Err:        fmt.Errorf("label %s of entity type %s cannot be read (entity.filter)", label, rc.entityType),
+				Type:       "not-authorized",
+				HTTPStatus: http.StatusForbidden,
+			}
+		}
+	}
+	err := api.auth.AuthorizeLabels(rc.caller, auth.Action{EntityType: rc.entityType, Op: op, Labels: labels})
+	if err != nil {
+		log.Printf("AUTH: not authorized: %s (caller: %+v)", err, rc.caller)
+		rc.gm.Inc(metrics.AuthorizationFailed, 1)
+		return auth.Error{
+			Err:        err,
+			Type:       "not-authorized",
+			HTTPStatus: http.StatusForbidden,
+		}
+	}
+	return nil
+}
+
+// validGroupBy returns an error if the groupBy param is not a plain label. With
+// "$" or ".", it's a MongoDB expression or nested path, like "$$ROOT" which groups
+// whole entities and returns every label value, bypassing label authorization.
+func validGroupBy(groupBy string) error {
+	if strings.ContainsAny(groupBy, "$.") {
+		return ErrInvalidParam.New("invalid groupBy %s: must be a label without . or $", groupBy)
+	}
+	return nil
+}
+
+// entityLabels returns the unique labels in the entities.
+func entityLabels(entities ...etre.Entity) []string {
+	labels := []string{}
+	seen := map[string]bool{}
+	for _, e := range entities {
+		for label := range e {
+			if seen[label] {
+				continue
+			}
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// readableLabels returns a func that reports whether the caller can read a label
+// of the request entity type, or nil if the caller can read all labels. A label is
+// readable if auth allows it (auth.Manager.ReadableLabels) and the default filter
+// of the entity type returns it (config.EntityConfig.Filter).
+func (api *API) readableLabels(rc *req) func(label string) bool {
+	return api.entityReadableLabels(rc.caller, rc.entityType)
+}
+
+// entityReadableLabels is readableLabels for the given entity type, like the
+// entity type of a CDC event, which is not the request entity type.
+func (api *API) entityReadableLabels(caller auth.Caller, entityType string) func(label string) bool {
+	readable := api.auth.ReadableLabels(caller, entityType)
+	f, ok := api.entityConfig.Filter[entityType]
+	if !ok || (len(f.Labels) == 0 && len(f.StripLabels) == 0) {
+		return readable
+	}
+	return func(label string) bool {
+		return f.LabelReturned(label) && (readable == nil || readable(label))
+	}
+}
+
+// queryFilter merges the default filter of the entity type into the caller's
+// query filter: the default limit and sort if the caller did not set them. The
+// default filter labels are enforced by readableLabels, not the query filter, so
+// that metalabels are returned.
+func (api *API) queryFilter(entityType string, f etre.QueryFilter) etre.QueryFilter {
+	if f.Limit == 0 {
+		f.Limit = api.entityConfig.Filter[entityType].Limit
+	}
+	if f.Sort == "" {
+		f.Sort = api.entityConfig.Filter[entityType].Sort
+	}
+	return f
+}
+
+// stripLabels removes the labels that are not readable from the entity.
+// If readable is nil, all labels are readable and the entity is not changed.
+func stripLabels(e etre.Entity, readable func(string) bool) {
+	if readable == nil {
+		return
+	}
+	for label := range e {
+		if !readable(label) {
+			delete(e, label)
+		}
+	}
+}
+
+// stripEventLabels returns the CDC event without the labels that are not readable
+// in its old and new values. The event entities are copied, not changed, because
+// the change feed sends the same event to all clients. If readable is nil, all
+// labels are readable and the event is returned as is.
+func stripEventLabels(e etre.CDCEvent, readable func(string) bool) etre.CDCEvent {
+	if readable == nil {
+		return e
+	}
+	strip := func(entity *etre.Entity) *etre.Entity {
+		if entity == nil {
+			return nil
+		}
+		stripped := etre.Entity{}
+		for label, v := range *entity {
+			if readable(label) {
+				stripped[label] = v
+			}
+		}
+		return &stripped
+	}
+	e.Old = strip(e.Old)
+	e.New = strip(e.New)
+	return e
+}
+
+// conflictLabels returns the labels and values of a duplicate-entity conflict
+// (entity.DbError.Conflict) as "label=value" sorted by label, like "x=6, y=a".
+func conflictLabels(conflict etre.Entity) string {
+	labels := make([]string, 0, len(conflict))
+	for label := range conflict {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for i, label := range labels {
+		labels[i] = fmt.Sprintf("%s=%v", label, conflict[label])
+	}
+	return strings.Join(labels, ", ")
+}
+
+// writeAuthOp returns the auth op for the write request: POST inserts, PUT updates,
+// and DELETE deletes entities. Deleting a label updates the entity, so it's
+// authorized as an update, as is restoring soft-deleted entities. Deleting or
+// renaming a label in bulk is an admin write.
+func writeAuthOp(r *http.Request) string {
+	switch r.Method {
+	case "POST":
+		return auth.OP_INSERT
+	case "PUT":
+		if r.PathValue("label") != "" && r.PathValue("id") == "" {
+			return auth.OP_ADMIN // bulk label rename
+		}
+	case "DELETE":
+		if r.Pattern == "DELETE "+etre.API_ROOT+"/entities/{type}/all" {
+			return auth.OP_ADMIN // delete all entities of type
+		}
+		if r.PathValue("label") != "" {
+			if r.PathValue("id") == "" {
+				return auth.OP_ADMIN // bulk label delete
+			}
+			return auth.OP_UPDATE
+		}
+		return auth.OP_DELETE
+	}
+	return auth.OP_UPDATE
+}
+
 func maybeInc(metric byte, n int64, v interface{}) {
 	if v == nil {
 		return
@@ -1472,6 +3582,8 @@ func maybeInc(metric byte, n int64, v interface{}) {
 }
 
 func parseQuery(r *http.Request) (query.Query, error) {
+	_, span := tracer.Start(r.Context(), "translate query")
+	defer span.End()
 	var q query.Query
 	var err error
 	qv := r.URL.Query() // ?x=1&y=2&z -> https://godoc.org/net/url#Values
@@ -1479,13 +3591,125 @@ func parseQuery(r *http.Request) (query.Query, error) {
 	if labelSelector == "" {
 		return q, ErrInvalidQuery.New("query string is empty")
 	}
-	q, err = query.Translate(labelSelector)
+	version, err := queryVersion(r)
+	if err != nil {
+		return q, err
+	}
+	return translateQuery(labelSelector, version)
+}
+
+// translateQuery validates and translates the query (label selector). Every
+// endpoint uses it so that queries are validated the same. It returns ErrInvalidQuery
+// if the query is too long (QUERY_MAX_LENGTH) or invalid.
+func translateQuery(labelSelector string, version int) (query.Query, error) {
+	if len(labelSelector) > QUERY_MAX_LENGTH {
+		return query.Query{}, ErrInvalidQuery.New("query longer than max length %d bytes", QUERY_MAX_LENGTH)
+	}
+	q, err := query.TranslateVersion(labelSelector, version)
 	if err != nil {
 		return q, ErrInvalidQuery.New("invalid query: %s", err)
 	}
 	return q, nil
 }
 
+// queryVersion returns the query language version from the etre.QUERY_VERSION_HEADER
+// header, or the default version (query.DEFAULT_VERSION) if not set.
+func queryVersion(r *http.Request) (int, error) {
+	v := r.Header.Get(etre.QUERY_VERSION_HEADER)
+	if v == "" {
+		return query.DEFAULT_VERSION, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, ErrInvalidQuery.New("invalid %s header: %s", etre.QUERY_VERSION_HEADER, v)
+	}
+	return version, nil
+}
+
+// parseCollation parses the collation query parameter: "locale" or "locale:strength".
+func parseCollation(v string) (*etre.Collation, error) {
+	locale, strength, ok := strings.Cut(v, ":")
+	c := &etre.Collation{Locale: locale}
+	if ok {
+		n, err := strconv.Atoi(strength)
+		if err != nil {
+			return nil, ErrInvalidQuery.New("invalid collation %s: strength is not a number", v)
+		}
+		c.Strength = n
+	}
+	if err := validateCollation(c); err != nil {
+		return nil, ErrInvalidQuery.New("invalid collation %s: %s", v, err)
+	}
+	return c, nil
+}
+
+// validateCollation returns an error if the collation is invalid. A nil collation
+// is valid: the query has no collation.
+func validateCollation(c *etre.Collation) error {
+	if c == nil {
+		return nil
+	}
+	if c.Locale == "" {
+		return fmt.Errorf("locale is empty")
+	}
+	if c.Strength < 0 || c.Strength > 5 {
+		return fmt.Errorf("strength %d is not 1 to 5", c.Strength)
+	}
+	return nil
+}
+
+// aliases returns the label aliases from the aliases query parameter: a comma-separated
+// list of label:alias, like "dc:datacenter,y:letter" (see etre.QueryFilter.Aliases).
+// The labels and aliases must be readable because an alias returns a label value.
+func (api *API) aliases(rc *req, qv url.Values) (map[string]string, error) {
+	v := qv.Get("aliases")
+	if v == "" {
+		return nil, nil
+	}
+	aliases := map[string]string{}
+	for _, pair := range strings.Split(v, ",") {
+		label, alias, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, ErrInvalidQuery.New("invalid alias: %s: must be label:alias", pair)
+		}
+		if _, ok := aliases[label]; ok {
+			return nil, ErrInvalidQuery.New("invalid alias: %s: label %s has another alias", pair, label)
+		}
+		aliases[label] = alias
+	}
+	if err := api.validate.Aliases(aliases); err != nil {
+		return nil, err
+	}
+	if err := api.authorizeLabels(rc, auth.OP_READ, aliasedLabels(aliases)); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// aliasedLabels returns the labels and aliases of the label aliases, sorted.
+func aliasedLabels(aliases map[string]string) []string {
+	labels := make([]string, 0, 2*len(aliases))
+	for label, alias := range aliases {
+		labels = append(labels, label, alias)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// sortLabels returns the labels of the sort (etre.QueryFilter.Sort), like [x y]
+// for "x:1,y:-1". The store validates the sort directions.
+func sortLabels(sort string) []string {
+	if sort == "" {
+		return nil
+	}
+	labels := []string{}
+	for _, key := range strings.Split(sort, ",") {
+		label, _, _ := strings.Cut(key, ":")
+		labels = append(labels, label)
+	}
+	return labels
+}
+
 func isWriteRequest(method string) bool {
 	// Only these HTTP methods are writes
 	// method != "GET" doesn't work because of "HEAD", "OPTIONS", etc.
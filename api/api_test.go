@@ -11,17 +11,23 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	"github.com/square/etre"
 	"github.com/square/etre/api"
 	"github.com/square/etre/app"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/cdc/changestream"
 	"github.com/square/etre/config"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/metrics"
@@ -49,6 +55,7 @@ type server struct {
 	streamerFactory *mock.StreamerFactory
 	metricsrec      *mock.MetricRecorder
 	sysmetrics      *mock.MetricRecorder
+	health          *app.Health
 }
 
 var testEntities = []etre.Entity{
@@ -81,6 +88,12 @@ var defaultConfig = config.Config{
 }
 
 func setup(t *testing.T, cfg config.Config, store mock.EntityStore) *server {
+	return setupCDC(t, cfg, store, nil)
+}
+
+// setupCDC is like setup, but the API uses the change stream server, which is
+// required for endpoints like POST /changes/replay.
+func setupCDC(t *testing.T, cfg config.Config, store mock.EntityStore, changesServer changestream.Server) *server {
 	etre.DebugEnabled = true
 
 	server := &server{
@@ -91,6 +104,7 @@ func setup(t *testing.T, cfg config.Config, store mock.EntityStore) *server {
 		streamerFactory: &mock.StreamerFactory{},
 		metricsrec:      mock.NewMetricsRecorder(),
 		sysmetrics:      mock.NewMetricsRecorder(),
+		health:          &app.Health{},
 	}
 
 	acls, err := srv.MapConfigACLRoles(cfg.Security.ACL)
@@ -104,11 +118,14 @@ func setup(t *testing.T, cfg config.Config, store mock.EntityStore) *server {
 		Config:          server.cfg,
 		EntityStore:     server.store,
 		EntityValidator: validate,
+		CDCStore:        server.cdcStore,
 		Auth:            auth.NewManager(acls, server.auth),
 		MetricsStore:    ms,
 		MetricsFactory:  mock.NewMetricsFactory(mf, server.metricsrec),
 		StreamerFactory: server.streamerFactory,
+		ChangesServer:   changesServer,
 		SystemMetrics:   mock.NewSystemMetrics(sm, server.sysmetrics),
+		Health:          server.health,
 	}
 	server.api = api.NewAPI(appCtx)
 	server.ts = httptest.NewServer(server.api)
@@ -154,6 +171,99 @@ func TestStatus(t *testing.T) {
 	assert.Equal(t, expectStatus, gotStatus)
 }
 
+func TestStatusCDC(t *testing.T) {
+	// Test that GET /status reports the change stream server status if CDC is enabled
+	cdcStatus := changestream.ServerStatus{
+		Clients:    2,
+		MaxClients: 10,
+		BufferSize: 100,
+		BufferLen:  map[string]int{"c1": 0, "c2": 99},
+		Dropped:    1,
+	}
+	appCtx := app.Context{
+		Config: defaultConfig,
+		ChangesServer: mock.ChangeStreamServer{
+			StatusFunc: func() changestream.ServerStatus {
+				return cdcStatus
+			},
+		},
+		SystemMetrics: metrics.NewSystemMetrics(),
+	}
+	ts := httptest.NewServer(api.NewAPI(appCtx))
+	defer ts.Close()
+
+	var gotStatus struct {
+		OK      string                    `json:"ok"`
+		Version string                    `json:"version"`
+		CDC     changestream.ServerStatus `json:"cdc"`
+	}
+	statusCode, err := test.MakeHTTPRequest("GET", ts.URL+etre.API_ROOT+"/status", nil, &gotStatus)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "yes", gotStatus.OK)
+	assert.Equal(t, cdcStatus, gotStatus.CDC)
+}
+
+func TestHealth(t *testing.T) {
+	// Test that GET /health returns HTTP 503 until connected to the required dbs
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+	url := server.url + etre.API_ROOT + "/health"
+
+	// Not connected to any db
+	var gotHealth etre.Health
+	statusCode, err := test.MakeHTTPRequest("GET", url, nil, &gotHealth)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+	assert.Equal(t, etre.Health{Version: etre.VERSION}, gotHealth)
+
+	// Connected to main db but not CDC db, which is required because CDC is enabled
+	server.health.SetMainDb(true)
+	gotHealth = etre.Health{}
+	statusCode, err = test.MakeHTTPRequest("GET", url, nil, &gotHealth)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+	assert.Equal(t, etre.Health{MainDb: true, Version: etre.VERSION}, gotHealth)
+
+	// Connected to both
+	server.health.SetCDCDb(true)
+	gotHealth = etre.Health{}
+	statusCode, err = test.MakeHTTPRequest("GET", url, nil, &gotHealth)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.Health{MainDb: true, CDCDb: true, Version: etre.VERSION}, gotHealth)
+
+	// Lost connection to an entity type datasource, which is part of the main db
+	server.health.SetEntityDb("mongodb://nodes", false)
+	gotHealth = etre.Health{}
+	statusCode, err = test.MakeHTTPRequest("GET", url, nil, &gotHealth)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+	assert.Equal(t, etre.Health{CDCDb: true, Version: etre.VERSION}, gotHealth)
+	server.health.SetEntityDb("mongodb://nodes", true)
+
+	// Lost connection to main db
+	server.health.SetMainDb(false)
+	statusCode, err = test.MakeHTTPRequest("GET", url, nil, &gotHealth)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+}
+
+func TestHealthCDCDisabled(t *testing.T) {
+	// Test that the CDC db is not required when CDC is disabled
+	cfg := defaultConfig
+	cfg.CDC.Disabled = true
+	server := setup(t, cfg, mock.EntityStore{})
+	defer server.ts.Close()
+	server.health.SetMainDb(true)
+
+	var gotHealth etre.Health
+	statusCode, err := test.MakeHTTPRequest("GET", server.url+etre.API_ROOT+"/health", nil, &gotHealth)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.Health{MainDb: true, Version: etre.VERSION}, gotHealth)
+}
+
 func TestValidateEntityType(t *testing.T) {
 	server := setup(t, defaultConfig, mock.EntityStore{})
 	defer server.ts.Close()
@@ -237,6 +347,115 @@ func TestClientQueryTimeout(t *testing.T) {
 	assert.True(t, -d >= 4.8 && -d <= 5.2, "deadline %f, expected between 4.8-5.2s (5s client)", d)
 }
 
+func TestRequestId(t *testing.T) {
+	// Test that the request ID from the client (X-Request-Id, etre.REQUEST_ID_HEADER)
+	// is echoed in the response header, returned in errors, and passed to the
+	// entity.Store context. If the client doesn't send one, the API generates one.
+	var gotCtx context.Context
+	var readErr error
+	store := mock.EntityStore{}
+	store.ReadEntityFunc = func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+		gotCtx = ctx
+		if readErr != nil {
+			return nil, readErr
+		}
+		return testEntitiesWithObjectIDs[0], nil
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	get := func(requestId string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", etreurl, nil)
+		require.NoError(t, err)
+		if requestId != "" {
+			req.Header.Set(etre.REQUEST_ID_HEADER, requestId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, body
+	}
+
+	// Client sends request ID: it round-trips
+	resp, _ := get("req-123")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "req-123", resp.Header.Get(etre.REQUEST_ID_HEADER))
+	require.NotNil(t, gotCtx)
+	assert.Equal(t, "req-123", etre.RequestId(gotCtx))
+
+	readErr = entity.DbError{Err: fmt.Errorf("fake error"), Type: "db-read"}
+	resp, body := get("req-456")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "req-456", resp.Header.Get(etre.REQUEST_ID_HEADER))
+	var gotErr etre.Error
+	require.NoError(t, json.Unmarshal(body, &gotErr))
+	assert.Equal(t, "db-read", gotErr.Type)
+	assert.Equal(t, "req-456", gotErr.RequestId)
+
+	// Client doesn't send request ID: API generates one
+	resp, body = get("")
+	generatedId := resp.Header.Get(etre.REQUEST_ID_HEADER)
+	assert.NotEmpty(t, generatedId)
+	gotErr = etre.Error{}
+	require.NoError(t, json.Unmarshal(body, &gotErr))
+	assert.Equal(t, generatedId, gotErr.RequestId)
+	assert.Equal(t, generatedId, etre.RequestId(gotCtx))
+
+	// Invalid request ID is replaced
+	resp, _ = get("bad id")
+	assert.NotEmpty(t, resp.Header.Get(etre.REQUEST_ID_HEADER))
+	assert.NotEqual(t, "bad id", resp.Header.Get(etre.REQUEST_ID_HEADER))
+	assert.NotEqual(t, generatedId, resp.Header.Get(etre.REQUEST_ID_HEADER))
+}
+
+// The global tracer provider can be set only once because package tracers
+// delegate to the first one set, so tests share the exporter and reset it.
+var (
+	spanExporter    = tracetest.NewInMemoryExporter()
+	setSpanExporter sync.Once
+)
+
+func TestTracing(t *testing.T) {
+	// Test that a read creates a request span with child spans for authenticate,
+	// authorize, and query translation when a tracer provider is set
+	setSpanExporter.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+	})
+	spanExporter.Reset()
+
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			return mock.DoStreamEntities(testEntitiesWithObjectIDs[0:1], nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape("foo=bar")
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	spans := spanExporter.GetSpans()
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	assert.ElementsMatch(t, []string{"authenticate", "authorize", "translate query", "GET " + etre.API_ROOT + "/entities/{type}"}, names)
+
+	root := spans[len(spans)-1] // request span ends last
+	require.Equal(t, "GET "+etre.API_ROOT+"/entities/{type}", root.Name)
+	assert.Contains(t, root.Attributes, attribute.String("etre.entity_type", entityType))
+	for _, span := range spans[:len(spans)-1] {
+		assert.Equal(t, root.SpanContext.SpanID(), span.Parent.SpanID(), span.Name)
+		assert.Equal(t, root.SpanContext.TraceID(), span.SpanContext.TraceID(), span.Name)
+	}
+}
+
 func TestContextPropagation(t *testing.T) {
 	// Make sure context values from the request are propagated all the way down to the entity.Store context
 	var gotCtx context.Context
@@ -3,6 +3,7 @@
 package api_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -13,6 +14,9 @@ import (
 
 	"github.com/square/etre"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/config"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/query"
 	"github.com/square/etre/test"
 	"github.com/square/etre/test/mock"
 )
@@ -107,7 +111,131 @@ func TestAuthNotAuthorizedWNoACLs(t *testing.T) {
 
 	expectAction = auth.Action{
 		EntityType: entityType,
-		Op:         auth.OP_WRITE,
+		Op:         auth.OP_INSERT,
 	}
 	assert.Equal(t, expectAction, gotAction)
 }
+
+func TestAuthLabels(t *testing.T) {
+	// Role ops can read and write nodes, but not label foo: writes that touch
+	// foo are rejected and foo is stripped from entities returned on read
+	cfg := defaultConfig
+	cfg.Security.ACL = []config.ACL{
+		{
+			Role:       "ops",
+			Read:       []string{entityType},
+			Write:      []string{entityType},
+			DenyLabels: map[string][]string{entityType: {"foo"}},
+		},
+	}
+	entities := []etre.Entity{
+		{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "x": "1", "foo": "bar"},
+		{"_id": testEntityId1, "_type": entityType, "_rev": int64(0), "x": "2", "foo": "bar"},
+	}
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			copies := make([]etre.Entity, len(entities))
+			for i := range entities {
+				copies[i] = etre.Entity{}
+				for k, v := range entities[i] {
+					copies[i][k] = v
+				}
+			}
+			return mock.DoStreamEntities(copies, nil)
+		},
+		ReadEntityFunc: func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+			return etre.Entity{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "x": "1", "foo": "bar"}, nil
+		},
+		CreateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			return []string{testEntityIds[0]}, nil
+		},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "dev", Roles: []string{"ops"}}, nil
+	}
+
+	// ----------------------------------------------------------------------
+	// Allowed write
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType
+	payload, err := json.Marshal(etre.Entity{"x": "3"})
+	require.NoError(t, err)
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.Nil(t, gotWR.Error)
+
+	// ----------------------------------------------------------------------
+	// Denied writes
+	payload, err = json.Marshal(etre.Entity{"x": "3", "foo": "baz"})
+	require.NoError(t, err)
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "not-authorized", gotWR.Error.Type)
+
+	etreurl = server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "not-authorized", gotWR.Error.Type)
+
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("DELETE", etreurl+"/labels/foo", nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "not-authorized", gotWR.Error.Type)
+
+	// ----------------------------------------------------------------------
+	// Counts by a denied label reveal its values
+	var gotErr etre.Error
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/aggregate?query=x&groupBy=foo"
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Equal(t, "not-authorized", gotErr.Type)
+
+	// ----------------------------------------------------------------------
+	// Stripped on read
+	var gotEntities []etre.Entity
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "?query=x"
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	require.Len(t, gotEntities, 2)
+	for _, e := range gotEntities {
+		assert.NotContains(t, e, "foo")
+		assert.Contains(t, e, "x")
+		assert.Contains(t, e, "_id")
+	}
+
+	var gotEntity etre.Entity
+	etreurl = server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotEntity)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.NotContains(t, gotEntity, "foo")
+	assert.Equal(t, "1", gotEntity["x"])
+
+	var gotLabels []string
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"/labels", nil, &gotLabels)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, []string{"_id", "_rev", "_type", "x"}, gotLabels)
+
+	// Querying a denied label would reveal its values
+	var etreErr etre.Error
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "?query=foo=bar"
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &etreErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Equal(t, "not-authorized", etreErr.Type)
+}
@@ -5,6 +5,7 @@ package api_test
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 	"testing"
@@ -13,6 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/square/etre"
+	"github.com/square/etre/api"
 	"github.com/square/etre/auth"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/metrics"
@@ -58,12 +60,16 @@ func TestPostEntitiesOK(t *testing.T) {
 			{EntityId: "id1", URI: uri("id1")},
 			{EntityId: "id2", URI: uri("id2")},
 		},
+		SetId: gotWO.SetId, // server-generated set for bulk write
 	}
 	assert.Equal(t, expectWR, gotWR)
+	assert.NotEmpty(t, gotWR.SetId)
 
 	expectWO := entity.WriteOp{
 		Caller:     "test", // from mock.AuthRecorder
 		EntityType: entityType,
+		SetOp:      "insert",
+		SetId:      gotWR.SetId,
 	}
 	assert.Equal(t, expectWO, gotWO)
 
@@ -85,11 +91,102 @@ func TestPostEntitiesOK(t *testing.T) {
 	// -- Auth -----------------------------------------------------------
 	require.Len(t, server.auth.AuthenticateArgs, 1)
 	assert.Equal(t, []mock.AuthorizeArgs{{
-		Action: auth.Action{Op: auth.OP_WRITE, EntityType: entityType},
+		Action: auth.Action{Op: auth.OP_INSERT, EntityType: entityType},
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestPostEntitiesUnordered(t *testing.T) {
+	// Test that ?ordered=false sets WriteOp.Unordered and that the WriteResult
+	// has the inserted entities and the errors for the entities not inserted:
+	// the 1st and 3rd entities are inserted, the 2nd is a dupe.
+	var gotWO entity.WriteOp
+	store := mock.EntityStore{
+		CreateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			gotWO = wo
+			return []string{"id1", "id3"}, entity.InsertErrors{
+				1: entity.DbError{Type: "duplicate-entity", Err: fmt.Errorf("E11000 duplicate key error")},
+			}
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	entities := []etre.Entity{{"x": 5}, {"x": 6}, {"x": 7}}
+	payload, err := json.Marshal(entities)
+	require.NoError(t, err)
+
+	var gotWR etre.WriteResult
+	url := server.url + etre.API_ROOT + "/entities/" + entityType + "?ordered=false"
+	statusCode, err := test.MakeHTTPRequest("POST", url, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, statusCode)
+	assert.True(t, gotWO.Unordered)
+
+	expectWrites := []etre.Write{
+		{EntityId: "id1", URI: uri("id1")},
+		{EntityId: "id3", URI: uri("id3")},
+	}
+	assert.Equal(t, expectWrites, gotWR.Writes)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "duplicate-entity", gotWR.Error.Type)
+	require.Len(t, gotWR.Errors, 1)
+	assert.Equal(t, 1, gotWR.Errors[0].Index)
+	assert.Equal(t, "duplicate-entity", gotWR.Errors[0].Error.Type)
+	assert.Equal(t, http.StatusConflict, gotWR.Errors[0].Error.HTTPStatus)
+
+	// Default is ordered
+	server2 := setup(t, defaultConfig, store)
+	defer server2.ts.Close()
+	url = server2.url + etre.API_ROOT + "/entities/" + entityType
+	_, err = test.MakeHTTPRequest("POST", url, payload, &gotWR)
+	require.NoError(t, err)
+	assert.False(t, gotWO.Unordered)
+}
+
+func TestPostEntitiesMaxBodyBytes(t *testing.T) {
+	// Test that a payload larger than config.server.max_body_bytes returns
+	// HTTP 413 and a payload-too-large error, and CreateEntities is not called.
+	created := false
+	store := mock.EntityStore{
+		CreateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			created = true
+			return []string{"id1"}, nil
+		},
+	}
+	payload, err := json.Marshal([]etre.Entity{{"a": "1"}})
+	require.NoError(t, err)
+
+	// Just under the limit
+	cfg := defaultConfig
+	cfg.Server.MaxBodyBytes = int64(len(payload) + 1)
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+	url := server.url + etre.API_ROOT + "/entities/" + entityType
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("POST", url, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.Nil(t, gotWR.Error)
+	assert.True(t, created, "CreateEntities not called, expected call")
+
+	// Just over the limit
+	created = false
+	cfg.Server.MaxBodyBytes = int64(len(payload) - 1)
+	server2 := setup(t, cfg, store)
+	defer server2.ts.Close()
+	url = server2.url + etre.API_ROOT + "/entities/" + entityType
+
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("POST", url, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "payload-too-large", gotWR.Error.Type)
+	assert.False(t, created, "CreateEntities called, expected no call due to error")
+}
+
 func TestPostEntitiesErrors(t *testing.T) {
 	// Test that POST /entities handler validate the clients HTTP payload.
 	// If invalid, it should return an etre.WriteResult with an error.
@@ -154,6 +251,9 @@ func TestPostEntitiesErrors(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, statusCode)
 	require.Error(t, gotWR.Error)
 	assert.Equal(t, "invalid-value-type", gotWR.Error.Type)
+	require.NotNil(t, gotWR.Error.EntityIndex)
+	assert.Equal(t, 1, *gotWR.Error.EntityIndex) // entity2
+	assert.Equal(t, "y", gotWR.Error.Label)
 	assert.False(t, created, "CreateEntities called, expected no call due to error")
 
 	// -- Metrics -----------------------------------------------------------
@@ -233,10 +333,197 @@ func TestPostEntitiesErrors(t *testing.T) {
 	assert.Equal(t, expectMetrics, server.metricsrec.Called)
 }
 
+func TestImport(t *testing.T) {
+	// Test that POST /entities/:type/import inserts the NDJSON stream in batches
+	// of batchSize with unordered inserts, and returns a summary: duplicates,
+	// invalid JSON, and invalid entities are counted as failed with their index
+	// in the stream, and they do not stop the import. The mock store has a unique
+	// index on x, like a real store.
+	var gotWO []entity.WriteOp
+	var gotBatches [][]etre.Entity
+	seen := map[string]bool{}
+	store := mock.EntityStore{
+		CreateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			gotWO = append(gotWO, wo)
+			gotBatches = append(gotBatches, entities)
+			ids := []string{}
+			insertErrs := entity.InsertErrors{}
+			for i, e := range entities {
+				x := fmt.Sprint(e["x"])
+				if seen[x] {
+					insertErrs[i] = entity.DbError{Type: "duplicate-entity", Err: fmt.Errorf("E11000 duplicate key error")}
+					continue
+				}
+				seen[x] = true
+				ids = append(ids, "id"+x)
+			}
+			if len(insertErrs) > 0 {
+				return ids, insertErrs
+			}
+			return ids, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	payload := []byte(`{"x":1}
+{"x":2}
+
+{"x":1}
+{"x":
+{"x":3}
+{"x":2}
+{"_id":"abc","x":9}
+`)
+	var gotResult etre.ImportResult
+	url := server.url + etre.API_ROOT + "/entities/" + entityType + "/import?batchSize=2"
+	statusCode, err := test.MakeHTTPRequest("POST", url, payload, &gotResult)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	assert.Equal(t, 3, gotResult.Inserted)
+	assert.Equal(t, 4, gotResult.Failed)
+	assert.Nil(t, gotResult.Error)
+	require.Len(t, gotResult.Errors, 4)
+	expectErrors := []struct {
+		index int
+		typ   string
+	}{
+		{3, "invalid-content"},
+		{2, "duplicate-entity"},
+		{6, "cannot-set-metalabel"},
+		{5, "duplicate-entity"},
+	}
+	for i, e := range expectErrors {
+		assert.Equal(t, e.index, gotResult.Errors[i].Index, "error %d", i)
+		assert.Equal(t, e.typ, gotResult.Errors[i].Error.Type, "error %d", i)
+		// Index in stream, not batch, for every error
+		if assert.NotNil(t, gotResult.Errors[i].Error.EntityIndex, "error %d", i) {
+			assert.Equal(t, e.index, *gotResult.Errors[i].Error.EntityIndex, "error %d", i)
+		}
+	}
+	assert.Contains(t, gotResult.Errors[2].Error.Message, "(entity index 6)")
+
+	// Valid entities in batches of 2, all unordered inserts
+	expectBatches := [][]etre.Entity{
+		{{"x": 1}, {"x": 2}},
+		{{"x": 1}, {"x": 3}},
+		{{"x": 2}},
+	}
+	assert.Equal(t, expectBatches, gotBatches)
+	for i := range gotWO {
+		assert.True(t, gotWO[i].Unordered)
+	}
+
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Write, IntVal: 1},
+		{Method: "Inc", Metric: metrics.CreateMany, IntVal: 1},
+		{Method: "Inc", Metric: metrics.ClientError, IntVal: 1}, // invalid JSON
+		{Method: "Inc", Metric: metrics.DbError, IntVal: 1},     // duplicate
+		{Method: "Inc", Metric: metrics.ClientError, IntVal: 1}, // _id
+		{Method: "Inc", Metric: metrics.DbError, IntVal: 1},     // duplicate
+		{Method: "Val", Metric: metrics.CreateBulk, IntVal: 7},
+		{Method: "Inc", Metric: metrics.Created, IntVal: 3},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+}
+
+func TestImportErrors(t *testing.T) {
+	// Test that an error that stops the import, like a db error, returns the
+	// summary of the entities before it with the error, and that an invalid
+	// batchSize or an empty stream is an error before anything is inserted
+	calls := 0
+	store := mock.EntityStore{
+		CreateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			calls++
+			if calls == 2 {
+				return []string{"id3"}, entity.DbError{Type: "db-insert", Err: fmt.Errorf("connection lost")}
+			}
+			ids := make([]string, len(entities))
+			for i := range entities {
+				ids[i] = fmt.Sprintf("id%d", i)
+			}
+			return ids, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+	url := server.url + etre.API_ROOT + "/entities/" + entityType + "/import"
+
+	// 2nd batch fails after inserting 1 of 2 entities, 5th entity not read
+	payload := []byte("{\"x\":1}\n{\"x\":2}\n{\"x\":3}\n{\"x\":4}\n{\"x\":5}\n")
+	var gotResult etre.ImportResult
+	statusCode, err := test.MakeHTTPRequest("POST", url+"?batchSize=2", payload, &gotResult)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode) // ErrDBInsertFailed
+	assert.Equal(t, 3, gotResult.Inserted)
+	assert.Equal(t, 1, gotResult.Failed)
+	require.NotNil(t, gotResult.Error)
+	assert.Equal(t, "db-insert-failed", gotResult.Error.Type)
+	assert.NotEmpty(t, gotResult.Error.RequestId)
+	assert.Equal(t, 2, calls)
+
+	for _, batchSize := range []string{"0", "x", fmt.Sprint(api.IMPORT_BATCH_SIZE_MAX + 1)} {
+		calls = 0
+		gotResult = etre.ImportResult{}
+		statusCode, err = test.MakeHTTPRequest("POST", url+"?batchSize="+batchSize, payload, &gotResult)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, batchSize)
+		require.NotNil(t, gotResult.Error, batchSize)
+		assert.Equal(t, "invalid-param", gotResult.Error.Type)
+		assert.Equal(t, 0, calls)
+	}
+
+	gotResult = etre.ImportResult{}
+	statusCode, err = test.MakeHTTPRequest("POST", url, []byte("\n\n"), &gotResult)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotResult.Error)
+	assert.Equal(t, "no-content", gotResult.Error.Type)
+	assert.Equal(t, 0, calls)
+}
+
 // --------------------------------------------------------------------------
 // Update
 // --------------------------------------------------------------------------
 
+func TestPutEntitiesWithSet(t *testing.T) {
+	// Test that a set op from the caller is passed to UpdateEntities as-is:
+	// a server-generated set is only used if the caller does not set one.
+	var gotWO entity.WriteOp
+	store := mock.EntityStore{
+		UpdateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			gotWO = wo
+			return []etre.Entity{{"_id": testEntityId0, "_type": entityType, "_rev": int64(0)}}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	payload, err := json.Marshal(etre.Entity{"foo": "bar"})
+	require.NoError(t, err)
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&setOp=migrate&setId=abc&setSize=3"
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	expectWO := entity.WriteOp{
+		Caller:     "test", // from mock.AuthRecorder
+		EntityType: entityType,
+		SetOp:      "migrate",
+		SetId:      "abc",
+		SetSize:    3,
+	}
+	assert.Equal(t, expectWO, gotWO)
+	assert.Empty(t, gotWR.SetId)
+}
+
 func TestPutEntitiesOK(t *testing.T) {
 	// Test that PUT /entities handler passes all the correct values to
 	// UpdateEntities() which would update the matching entities. For this
@@ -288,12 +575,16 @@ func TestPutEntitiesOK(t *testing.T) {
 				},
 			},
 		},
+		SetId: gotWO.SetId, // server-generated set for bulk write
 	}
 	assert.Equal(t, expectWR, gotWR)
+	assert.NotEmpty(t, gotWR.SetId)
 
 	expectWO := entity.WriteOp{
 		Caller:     "test", // from mock.AuthRecorder
 		EntityType: entityType,
+		SetOp:      "update",
+		SetId:      gotWR.SetId,
 	}
 	assert.Equal(t, expectWO, gotWO)
 
@@ -321,11 +612,54 @@ func TestPutEntitiesOK(t *testing.T) {
 	// -- Auth -----------------------------------------------------------
 	require.Len(t, server.auth.AuthenticateArgs, 1)
 	assert.Equal(t, []mock.AuthorizeArgs{{
-		Action: auth.Action{Op: auth.OP_WRITE, EntityType: entityType},
+		Action: auth.Action{Op: auth.OP_UPDATE, EntityType: entityType},
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestPutEntitiesUnordered(t *testing.T) {
+	// Test that ?ordered=false sets WriteOp.Unordered for a bulk update and that
+	// the WriteResult has the updated entities and the errors for the entities
+	// not updated: the 1st and 3rd entities are updated, the 2nd is a dupe.
+	var gotWO entity.WriteOp
+	store := mock.EntityStore{
+		UpdateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			gotWO = wo
+			diffs := []etre.Entity{
+				{"_id": testEntityIds[0], "_type": entityType, "_rev": int64(0), "x": int64(1)},
+				{"_id": testEntityIds[2], "_type": entityType, "_rev": int64(0), "x": int64(3)},
+			}
+			return diffs, entity.UpdateErrors{
+				testEntityIds[1]: entity.DbError{Type: "duplicate-entity", Err: fmt.Errorf("E11000 duplicate key error")},
+			}
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	payload, err := json.Marshal(etre.Entity{entity.PATCH_INC: map[string]interface{}{"x": 1}})
+	require.NoError(t, err)
+
+	var gotWR etre.WriteResult
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?ordered=false&query=" + url.QueryEscape("a=b")
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, statusCode)
+	assert.True(t, gotWO.Unordered)
+
+	require.Len(t, gotWR.Writes, 2)
+	assert.Equal(t, testEntityIds[0], gotWR.Writes[0].EntityId)
+	assert.Equal(t, testEntityIds[2], gotWR.Writes[1].EntityId)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "duplicate-entity", gotWR.Error.Type)
+	assert.Equal(t, testEntityIds[1], gotWR.Error.EntityId)
+	require.Len(t, gotWR.Errors, 1)
+	assert.Equal(t, -1, gotWR.Errors[0].Index)
+	assert.Equal(t, testEntityIds[1], gotWR.Errors[0].Error.EntityId)
+	assert.Equal(t, "duplicate-entity", gotWR.Errors[0].Error.Type)
+	assert.Equal(t, http.StatusConflict, gotWR.Errors[0].Error.HTTPStatus)
+}
+
 func TestPutEntitiesErrors(t *testing.T) {
 	// Test that PUT /entities returns the proper errors and increments the proper
 	// metrics when any input is invalid. The UpdateEntities() should not be called.
@@ -536,12 +870,16 @@ func TestDeleteEntitiesOK(t *testing.T) {
 				},
 			},
 		},
+		SetId: gotWO.SetId, // server-generated set for bulk write
 	}
 	assert.Equal(t, expectWR, gotWR)
+	assert.NotEmpty(t, gotWR.SetId)
 
 	expectWO := entity.WriteOp{
 		Caller:     "test", // from mock.AuthRecorder
 		EntityType: entityType,
+		SetOp:      "delete",
+		SetId:      gotWR.SetId,
 	}
 	assert.Equal(t, expectWO, gotWO)
 
@@ -566,7 +904,7 @@ func TestDeleteEntitiesOK(t *testing.T) {
 	// -- Auth -----------------------------------------------------------
 	require.Len(t, server.auth.AuthenticateArgs, 1)
 	assert.Equal(t, []mock.AuthorizeArgs{{
-		Action: auth.Action{Op: auth.OP_WRITE, EntityType: entityType},
+		Action: auth.Action{Op: auth.OP_DELETE, EntityType: entityType},
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
 }
@@ -669,3 +1007,294 @@ func TestDeleteEntitiesErrors(t *testing.T) {
 	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
 	assert.Equal(t, expectMetrics, server.metricsrec.Called)
 }
+
+func TestRenameLabel(t *testing.T) {
+	// Test that PUT /entities/:type/labels/:label renames the label to the name
+	// param in all matching entities, which is an admin write
+	var gotWO entity.WriteOp
+	var gotQuery query.Query
+	var gotLabel, gotNewLabel string
+	var gotOverwrite bool
+	store := mock.EntityStore{
+		RenameLabelFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query, label, newLabel string, overwrite bool) ([]etre.Entity, error) {
+			gotWO = wo
+			gotQuery = q
+			gotLabel = label
+			gotNewLabel = newLabel
+			gotOverwrite = overwrite
+			return []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "dc": "east"},
+			}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/labels/dc" +
+		"?query=" + url.QueryEscape("a=b") + "&name=datacenter&overwrite=true"
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	require.Nil(t, gotWR.Error)
+
+	// Returns the entities before the rename
+	expectWR := etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: testEntityIds[0],
+				URI:      uri(testEntityIds[0]),
+				Diff: etre.Entity{
+					"_id":   testEntityIds[0],
+					"_type": entityType,
+					"_rev":  float64(0),
+					"dc":    "east",
+				},
+			},
+		},
+		SetId: gotWO.SetId, // server-generated set for bulk write
+	}
+	assert.Equal(t, expectWR, gotWR)
+
+	assert.Equal(t, "dc", gotLabel)
+	assert.Equal(t, "datacenter", gotNewLabel)
+	assert.True(t, gotOverwrite)
+	assert.Equal(t, "rename-label", gotWO.SetOp)
+	expectQuery, _ := query.Translate("a=b")
+	assert.Equal(t, expectQuery, gotQuery)
+
+	// -- Metrics -----------------------------------------------------------
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Write, IntVal: 1},
+		{Method: "Inc", Metric: metrics.UpdateQuery, IntVal: 1},
+		{Method: "Val", Metric: metrics.Labels, IntVal: 1},
+		{Method: "IncLabel", Metric: metrics.LabelRead, StringVal: "a"},
+		{Method: "IncLabel", Metric: metrics.LabelDelete, StringVal: "dc"},
+		{Method: "IncLabel", Metric: metrics.LabelUpdate, StringVal: "datacenter"},
+		{Method: "Val", Metric: metrics.UpdateBulk, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Updated, IntVal: 1},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// -- Auth -----------------------------------------------------------
+	assert.Equal(t, []mock.AuthorizeArgs{{
+		Action: auth.Action{Op: auth.OP_ADMIN, EntityType: entityType},
+		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+	}}, server.auth.AuthorizeArgs)
+
+	// -- Errors -----------------------------------------------------------
+	// Missing or invalid params are client errors, and the store error when
+	// an entity already has the new label is returned
+	store.RenameLabelFunc = func(ctx context.Context, wo entity.WriteOp, q query.Query, label, newLabel string, overwrite bool) ([]etre.Entity, error) {
+		return nil, entity.ValidationError{Err: fmt.Errorf("1 matching entities already have label %s", newLabel), Type: "label-exists"}
+	}
+	server = setup(t, defaultConfig, store)
+	defer server.ts.Close()
+	base := server.url + etre.API_ROOT + "/entities/" + entityType + "/labels/dc?query=" + url.QueryEscape("a=b")
+	errs := map[string]string{
+		base:                                   "missing-param",
+		base + "&name=_id":                     "cannot-change-metalabel",
+		base + "&name=datacenter":              "label-exists",
+		base + "&name=datacenter&overwrite=no": "label-exists",
+	}
+	for u, errType := range errs {
+		gotWR = etre.WriteResult{}
+		statusCode, err := test.MakeHTTPRequest("PUT", u, nil, &gotWR)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, u)
+		require.NotNil(t, gotWR.Error, u)
+		assert.Equal(t, errType, gotWR.Error.Type, u)
+	}
+}
+
+func TestRestoreEntities(t *testing.T) {
+	// Test that PUT /entities/:type/restore restores all matching soft-deleted
+	// entities. Restore has no payload.
+	var gotWO entity.WriteOp
+	var gotQuery query.Query
+	store := mock.EntityStore{
+		RestoreEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+			gotWO = wo
+			gotQuery = q
+			return []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(1), "_deleted": int64(100)},
+			}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/restore?query=" + url.QueryEscape("a=b")
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	require.Nil(t, gotWR.Error)
+
+	// Returns the entities before they were restored
+	expectWR := etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: testEntityIds[0],
+				URI:      uri(testEntityIds[0]),
+				Diff: etre.Entity{
+					"_id":      testEntityIds[0],
+					"_type":    entityType,
+					"_rev":     float64(1),
+					"_deleted": float64(100),
+				},
+			},
+		},
+		SetId: gotWO.SetId, // server-generated set for bulk write
+	}
+	assert.Equal(t, expectWR, gotWR)
+
+	assert.Equal(t, "restore", gotWO.SetOp)
+	expectQuery, _ := query.Translate("a=b")
+	assert.Equal(t, expectQuery, gotQuery)
+
+	// -- Metrics -----------------------------------------------------------
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Write, IntVal: 1},
+		{Method: "Inc", Metric: metrics.UpdateQuery, IntVal: 1},
+		{Method: "Val", Metric: metrics.Labels, IntVal: 1},
+		{Method: "IncLabel", Metric: metrics.LabelRead, StringVal: "a"},
+		{Method: "Val", Metric: metrics.UpdateBulk, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Updated, IntVal: 1},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// -- Auth -----------------------------------------------------------
+	assert.Equal(t, []mock.AuthorizeArgs{{
+		Action: auth.Action{Op: auth.OP_UPDATE, EntityType: entityType},
+		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+	}}, server.auth.AuthorizeArgs)
+
+	// -- Errors -----------------------------------------------------------
+	// Missing query is an invalid query, and store errors are returned
+	store.RestoreEntitiesFunc = func(ctx context.Context, wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+		return nil, entity.ValidationError{Err: fmt.Errorf("not deleted"), Type: "entity-not-deleted"}
+	}
+	server = setup(t, defaultConfig, store)
+	defer server.ts.Close()
+	base := server.url + etre.API_ROOT + "/entities/" + entityType + "/restore"
+	errs := map[string]string{
+		base: "invalid-query",
+		base + "?query=" + url.QueryEscape("a=b"): "entity-not-deleted",
+	}
+	for u, errType := range errs {
+		gotWR = etre.WriteResult{}
+		statusCode, err := test.MakeHTTPRequest("PUT", u, nil, &gotWR)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, u)
+		require.NotNil(t, gotWR.Error, u)
+		assert.Equal(t, errType, gotWR.Error.Type, u)
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	// Test that DELETE /entities/:type/all deletes all entities of the type
+	// when the caller is an admin and confirms the entity type
+	var gotWO entity.WriteOp
+	store := mock.EntityStore{
+		DeleteAllFunc: func(ctx context.Context, wo entity.WriteOp) ([]etre.Entity, error) {
+			gotWO = wo
+			return []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(1)},
+			}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/all?confirm=" + entityType
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("DELETE", etreurl, nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	require.Nil(t, gotWR.Error)
+
+	expectWR := etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: testEntityIds[0],
+				URI:      uri(testEntityIds[0]),
+				Diff: etre.Entity{
+					"_id":   testEntityIds[0],
+					"_type": entityType,
+					"_rev":  float64(1),
+				},
+			},
+		},
+		SetId: gotWO.SetId, // server-generated set for bulk write
+	}
+	assert.Equal(t, expectWR, gotWR)
+	assert.Equal(t, "delete-all", gotWO.SetOp)
+
+	// -- Metrics -----------------------------------------------------------
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Write, IntVal: 1},
+		{Method: "Inc", Metric: metrics.DeleteQuery, IntVal: 1},
+		{Method: "Val", Metric: metrics.DeleteBulk, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Deleted, IntVal: 1},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// -- Auth -----------------------------------------------------------
+	// Requires admin, not delete
+	assert.Equal(t, []mock.AuthorizeArgs{{
+		Action: auth.Action{Op: auth.OP_ADMIN, EntityType: entityType},
+		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+	}}, server.auth.AuthorizeArgs)
+
+	// Non-admin caller is not authorized, so nothing is deleted
+	gotWO = entity.WriteOp{}
+	server.auth.AuthorizeFunc = func(caller auth.Caller, action auth.Action) error {
+		if action.Op != auth.OP_ADMIN {
+			return nil
+		}
+		return fmt.Errorf("not admin")
+	}
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("DELETE", etreurl, nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "not-authorized", gotWR.Error.Type)
+	assert.Empty(t, gotWO.EntityType)
+
+	// -- Errors -----------------------------------------------------------
+	// Confirm param is required and must be the entity type
+	server = setup(t, defaultConfig, store)
+	defer server.ts.Close()
+	base := server.url + etre.API_ROOT + "/entities/" + entityType + "/all"
+	errs := map[string]string{
+		base:                 "missing-param",
+		base + "?confirm=":   "missing-param",
+		base + "?confirm=xx": "invalid-param",
+	}
+	for u, errType := range errs {
+		gotWR = etre.WriteResult{}
+		statusCode, err := test.MakeHTTPRequest("DELETE", u, nil, &gotWR)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, u)
+		require.NotNil(t, gotWR.Error, u)
+		assert.Equal(t, errType, gotWR.Error.Type, u)
+	}
+	assert.Empty(t, gotWO.EntityType)
+}
@@ -3,6 +3,9 @@
 package api_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 	"testing"
@@ -12,8 +15,12 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/square/etre"
+	"github.com/square/etre/api"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
+	"github.com/square/etre/metrics"
+	"github.com/square/etre/test"
 	"github.com/square/etre/test/mock"
 )
 
@@ -83,6 +90,30 @@ func TestChanges(t *testing.T) {
 		t.Fatal("timeout waiting for recv goroutine to finish")
 	}
 
+	// Wait for the server-side handler to return: it decrements CDCClients last,
+	// so it's done with the connection and won't outlive the test. The change
+	// stream client also records CDC lag, which isn't checked here.
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "Inc", Metric: metrics.CDCClients, IntVal: 1},  // client connect
+		{Method: "Inc", Metric: metrics.CDCClients, IntVal: -1}, // client disconnect
+	}
+	var gotMetrics []mock.MetricMethodArgs
+	for len(gotMetrics) < len(expectMetrics) {
+		gotMetrics = nil
+		for _, m := range server.metricsrec.Calls() {
+			if m.Metric == metrics.CDCClients {
+				gotMetrics = append(gotMetrics, m)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		select {
+		case <-timeout:
+			t.Fatal("timeout waiting for changes handler to return")
+		default:
+		}
+	}
+	assert.Equal(t, expectMetrics, gotMetrics)
+
 	assert.Equal(t, mock.CDCEvents[0:1], events)
 	assert.Equal(t, int64(0), gotSinceTs)
 
@@ -92,18 +123,121 @@ func TestChanges(t *testing.T) {
 		Action: auth.Action{Op: auth.OP_CDC, EntityType: ""}, // no entity type for CDC
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
+}
+
+func TestChangesReplay(t *testing.T) {
+	// Test that POST /changes/replay resolves an event id range to sequence numbers,
+	// reads the range, and replays the events in order to only the given client
+	events := make([]etre.CDCEvent, len(mock.CDCEvents))
+	for i, e := range mock.CDCEvents {
+		e.Seq = int64(i + 1)
+		events[i] = e
+	}
+
+	var gotClientId string
+	var gotEvents []etre.CDCEvent
+	changesServer := &mock.ChangeStreamServer{
+		ReplayFunc: func(clientId string, events []etre.CDCEvent) error {
+			if clientId != "c1" {
+				return changestream.ErrClientNotFound
+			}
+			gotClientId = clientId
+			gotEvents = events
+			return nil
+		},
+	}
+	server := setupCDC(t, defaultConfig, mock.EntityStore{}, changesServer)
+	defer server.ts.Close()
 
-	/*
-		@todo Fix data race
-		// -- Metrics -----------------------------------------------------------
-		expectMetrics := []mock.MetricMethodArgs{
-			{Method: "Inc", Metric: metrics.CDCClients, IntVal: 1},  // client connect
-			{Method: "Inc", Metric: metrics.CDCClients, IntVal: -1}, // client disconnect
+	var gotFilters []cdc.Filter
+	server.cdcStore.ReadFunc = func(f cdc.Filter) ([]etre.CDCEvent, error) {
+		gotFilters = append(gotFilters, f)
+		if f.EventId != "" {
+			for _, e := range events {
+				if e.Id == f.EventId {
+					return []etre.CDCEvent{e}, nil
+				}
+			}
+			return nil, nil
 		}
-		if diffs := deep.Equal(server.metricsrec.Called, expectMetrics); diffs != nil {
-			t.Logf("   got: %+v", server.metricsrec.Called)
-			t.Logf("expect: %+v", expectMetrics)
-			t.Error(diffs)
+		ret := []etre.CDCEvent{}
+		for _, e := range events {
+			if e.Seq > f.SinceSeq && e.Seq < f.UntilSeq {
+				ret = append(ret, e)
+			}
 		}
-	*/
+		return ret, nil
+	}
+
+	// Events 2-5 by id: "4pi" (seq 3) through "bnu" (seq 6)
+	url := server.url + etre.API_ROOT + "/changes/replay"
+	payload, _ := json.Marshal(etre.CDCReplay{ClientId: "c1", SinceId: "4pi", UntilId: "bnu"})
+	var gotResult etre.CDCReplayResult
+	statusCode, err := test.MakeHTTPRequest("POST", url, payload, &gotResult)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.CDCReplayResult{ClientId: "c1", Events: 4}, gotResult)
+
+	assert.Equal(t, "c1", gotClientId)
+	assert.Equal(t, events[2:6], gotEvents)
+	assert.Equal(t, []cdc.Filter{
+		{EventId: "4pi"},
+		{EventId: "bnu"},
+		{SinceSeq: 2, UntilSeq: 7, Order: cdc.BySeqAsc{}},
+	}, gotFilters)
+
+	// Replaying requires admin, not only CDC
+	assert.Equal(t, []mock.AuthorizeArgs{
+		{Action: auth.Action{Op: auth.OP_CDC}, Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}}},
+		{Action: auth.Action{Op: auth.OP_ADMIN}, Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}}},
+	}, server.auth.AuthorizeArgs)
+
+	// Same by seq
+	gotEvents = nil
+	payload, _ = json.Marshal(etre.CDCReplay{ClientId: "c1", SinceSeq: 3, UntilSeq: 6})
+	statusCode, err = test.MakeHTTPRequest("POST", url, payload, &gotResult)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, events[2:6], gotEvents)
+
+	// -- Errors -----------------------------------------------------------
+	errs := []struct {
+		replay     etre.CDCReplay
+		statusCode int
+		errType    string
+	}{
+		{etre.CDCReplay{SinceSeq: 3, UntilSeq: 6}, http.StatusBadRequest, "missing-param"},                                    // no client
+		{etre.CDCReplay{ClientId: "c1"}, http.StatusBadRequest, "missing-param"},                                              // no range
+		{etre.CDCReplay{ClientId: "c1", SinceId: "4pi"}, http.StatusBadRequest, "missing-param"},                              // half range
+		{etre.CDCReplay{ClientId: "c1", SinceId: "4pi", UntilId: "bnu", SinceSeq: 3}, http.StatusBadRequest, "invalid-param"}, // id and seq
+		{etre.CDCReplay{ClientId: "c1", SinceSeq: 6, UntilSeq: 3}, http.StatusBadRequest, "invalid-param"},                    // backwards
+		{etre.CDCReplay{ClientId: "c1", SinceSeq: 1, UntilSeq: api.CDC_REPLAY_MAX_EVENTS + 1}, http.StatusBadRequest, "result-too-large"},
+		{etre.CDCReplay{ClientId: "c1", SinceId: "xxx", UntilId: "bnu"}, http.StatusNotFound, "entity-not-found"}, // no such event
+		{etre.CDCReplay{ClientId: "c2", SinceSeq: 3, UntilSeq: 6}, http.StatusNotFound, "cdc-client-not-found"},   // no such client
+	}
+	for _, e := range errs {
+		gotEvents = nil
+		payload, _ = json.Marshal(e.replay)
+		var gotErr etre.Error
+		statusCode, err = test.MakeHTTPRequest("POST", url, payload, &gotErr)
+		require.NoError(t, err)
+		assert.Equal(t, e.statusCode, statusCode, "%+v", e.replay)
+		assert.Equal(t, e.errType, gotErr.Type, "%+v", e.replay)
+		assert.Nil(t, gotEvents, "%+v", e.replay)
+	}
+
+	// Non-admin caller is not authorized
+	server.auth.AuthorizeFunc = func(caller auth.Caller, action auth.Action) error {
+		if action.Op != auth.OP_ADMIN {
+			return nil
+		}
+		return fmt.Errorf("not admin")
+	}
+	payload, _ = json.Marshal(etre.CDCReplay{ClientId: "c1", SinceSeq: 3, UntilSeq: 6})
+	var gotErr etre.Error
+	statusCode, err = test.MakeHTTPRequest("POST", url, payload, &gotErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Equal(t, "not-authorized", gotErr.Type)
+	assert.Nil(t, gotEvents)
 }
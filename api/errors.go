@@ -66,6 +66,18 @@ var ErrCDCDisabled = etre.Error{
 	Message:    "CDC disabled",
 }
 
+var ErrCDCClientNotFound = etre.Error{
+	Type:       "cdc-client-not-found",
+	HTTPStatus: http.StatusNotFound,
+	Message:    "CDC client not connected to this Etre instance",
+}
+
+var ErrCDCReplayBusy = etre.Error{
+	Type:       "cdc-replay-busy",
+	HTTPStatus: http.StatusConflict,
+	Message:    "CDC client has not received the previous replay",
+}
+
 var ErrNoContent = etre.Error{
 	Message:    "no entities provided (PUT or POST with zero-length HTTP payload or JSON array)",
 	Type:       "no-content",
@@ -78,6 +90,24 @@ var ErrInvalidContent = etre.Error{
 	HTTPStatus: http.StatusBadRequest,
 }
 
+var ErrResultTooLarge = etre.Error{
+	Type:       "result-too-large",
+	HTTPStatus: http.StatusBadRequest,
+	Message:    "query result too large",
+}
+
+var ErrPayloadTooLarge = etre.Error{
+	Type:       "payload-too-large",
+	HTTPStatus: http.StatusRequestEntityTooLarge,
+	Message:    "HTTP payload too large",
+}
+
+var ErrRateLimited = etre.Error{
+	Type:       "rate-limited",
+	HTTPStatus: http.StatusTooManyRequests,
+	Message:    "too many requests",
+}
+
 var ErrEndpointNotFound = etre.Error{
 	Message:    "API endpoint not found",
 	Type:       "endpoint-not-found",
@@ -0,0 +1,99 @@
+// Copyright 2026, Square, Inc.
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ETAG_MAX_BYTES is the maximum response size (uncompressed JSON) for which
+// GET /entities/:type computes an ETag. The response must be buffered to compute
+// its ETag before it is sent, so larger responses are streamed without an ETag
+// to bound memory usage.
+const ETAG_MAX_BYTES = 4 << 20 // 4 MiB
+
+// etag returns the ETag of a response body: a hash of the body. It's a weak
+// ETag because the same body can be sent with different encodings (gzip).
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified returns true if the request If-None-Match header matches the ETag.
+// If-None-Match uses weak comparison, so the "W/" prefix is ignored.
+func notModified(r *http.Request, etag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeWithETag writes the response body with its ETag, or only HTTP status 304
+// (Not Modified) if the request If-None-Match header matches the ETag.
+func writeWithETag(w http.ResponseWriter, r *http.Request, body []byte) {
+	tag := etag(body)
+	w.Header().Set("ETag", tag)
+	if notModified(r, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body)
+}
+
+// etagWriter buffers a response up to max bytes so its ETag can be computed
+// before it is sent. If the response is larger, it calls start to get the
+// real writer (after start sets headers, like Content-Encoding), writes the
+// buffered response, and streams the rest of the response.
+type etagWriter struct {
+	buf   bytes.Buffer
+	max   int
+	start func() io.Writer
+	out   io.Writer // set by start
+}
+
+func newETagWriter(max int, start func() io.Writer) *etagWriter {
+	return &etagWriter{
+		max:   max,
+		start: start,
+	}
+}
+
+func (ew *etagWriter) Write(p []byte) (int, error) {
+	if ew.out != nil {
+		return ew.out.Write(p)
+	}
+	if ew.buf.Len()+len(p) <= ew.max {
+		return ew.buf.Write(p)
+	}
+	// Response too large for an ETag: stop buffering and stream
+	ew.out = ew.start()
+	if _, err := ew.out.Write(ew.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	ew.buf = bytes.Buffer{}
+	return ew.out.Write(p)
+}
+
+// Streaming returns true if the response is being streamed, i.e. it's too
+// large for an ETag and some of it has been sent.
+func (ew *etagWriter) Streaming() bool {
+	return ew.out != nil
+}
+
+// Bytes returns the buffered response. It's empty if Streaming is true.
+func (ew *etagWriter) Bytes() []byte {
+	return ew.buf.Bytes()
+}
@@ -4,6 +4,7 @@ package api_test
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -78,6 +79,86 @@ func TestMetricsGet(t *testing.T) {
 	assert.Len(t, gotMetrics.Groups, 1)
 }
 
+func TestMetricsGetPrometheus(t *testing.T) {
+	// GET /metrics?format=prometheus or with Accept: text/plain (like Prometheus
+	// scrapers) should return Prometheus text format. JSON is still the default.
+	server := setupWithMetrics(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=x"
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	get := func(url, accept string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, string(body)
+	}
+
+	etreurl = server.url + etre.API_ROOT + "/metrics"
+	for _, tc := range []struct{ url, accept string }{
+		{etreurl + "?format=prometheus", ""},
+		{etreurl, "text/plain;version=0.0.4;q=0.5,*/*;q=0.1"},
+	} {
+		res, body := get(tc.url, tc.accept)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, metrics.PROMETHEUS_CONTENT_TYPE, res.Header.Get("Content-Type"))
+		assert.Contains(t, body, "# TYPE etre_system_query_total counter\n")
+		assert.Contains(t, body, `etre_query_read_query_total{group="etre",entity_type="`+entityType+`"} 1`)
+	}
+
+	res, _ := get(etreurl, "")
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+}
+
+func TestMetricsQueryLabel(t *testing.T) {
+	// Read queries count each label once per query, but only labels in the
+	// entity type schema to bound metrics cardinality
+	cfg := defaultConfig
+	cfg.Entity.Schema = map[string]config.SchemaConfig{
+		entityType: {Labels: []config.LabelSchema{{Name: "x"}, {Name: "y"}}},
+	}
+	server := setupWithMetrics(t, cfg, mock.EntityStore{})
+	defer server.ts.Close()
+
+	for _, q := range []string{"x=1", "x=1,y=2", "x=1,z=3", "y=2,y!=3", "z=1"} {
+		etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape(q)
+		statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, statusCode, q)
+	}
+
+	etreurl := server.url + etre.API_ROOT + "/metrics"
+	var gotMetrics etre.Metrics
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotMetrics)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Len(t, gotMetrics.Groups, 1)
+	expect := map[string]int64{
+		"x": 3,
+		"y": 2, // once per query
+	}
+	assert.Equal(t, expect, gotMetrics.Groups[0].Entity[entityType].QueryLabel)
+
+	// Also in Prometheus format
+	res, err := http.Get(etreurl + "?format=prometheus")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `etre_query_label_total{group="etre",entity_type="`+entityType+`",label="x"} 3`)
+	assert.NotContains(t, string(body), `label="z"`)
+}
+
 func TestMetricsBadRoute(t *testing.T) {
 	// Test that metrics, especially Load, are correct when route is 404 and not
 	// under /api/v1/ route group. This addresses a bug where Load could be negative
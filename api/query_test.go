@@ -4,9 +4,14 @@ package api_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,6 +21,7 @@ import (
 	"github.com/square/etre"
 	"github.com/square/etre/api"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/config"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/metrics"
 	"github.com/square/etre/query"
@@ -241,6 +247,8 @@ func TestQueryErrorsDatabaseError(t *testing.T) {
 		Type:       "db-read",
 		HTTPStatus: http.StatusServiceUnavailable, // 503
 	}
+	assert.NotEmpty(t, gotError.RequestId) // server-generated
+	expectError.RequestId = gotError.RequestId
 	assert.Equal(t, expectError, gotError)
 
 	// -- Metrics -----------------------------------------------------------
@@ -354,6 +362,136 @@ func TestQueryErrorsTimeout(t *testing.T) {
 	assert.Equal(t, expectMetrics, server.metricsrec.Called)
 }
 
+func longQuery(n int) string {
+	vals := make([]string, n)
+	for i := range vals {
+		vals[i] = fmt.Sprintf("h%05d", i)
+	}
+	return "host in (" + strings.Join(vals, ",") + ")"
+}
+
+func TestQueryPost(t *testing.T) {
+	// Test that POST /query/:type validates the query exactly like GET /entities/:type:
+	// same query, same status code and error type, even if the query is very long
+	var gotQuery query.Query
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			gotQuery = q
+			gotFilter = f
+			return mock.DoStreamEntities(testEntitiesWithObjectIDs, nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	valid := longQuery(2000) // ~16 KiB
+	require.Greater(t, len(valid), 2000)
+	require.Less(t, len(valid), api.QUERY_MAX_LENGTH)
+	tooLong := longQuery(10000) // ~78 KiB
+	require.Greater(t, len(tooLong), api.QUERY_MAX_LENGTH)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"long valid", valid, http.StatusOK},
+		{"long invalid", valid + ",=x", http.StatusBadRequest},
+		{"too long", tooLong, http.StatusBadRequest},
+		{"empty", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		// GET /entities/:type?query=Q
+		gotQuery = query.Query{}
+		getURL := server.url + etre.API_ROOT + "/entities/" + entityType + "?labels=host&query=" + url.QueryEscape(tt.query)
+		var getResp json.RawMessage
+		getStatus, err := test.MakeHTTPRequest("GET", getURL, nil, &getResp)
+		require.NoError(t, err, tt.name)
+		getQuery := gotQuery
+
+		// POST /query/:type with query Q in body
+		gotQuery = query.Query{}
+		postURL := server.url + etre.API_ROOT + "/query/" + entityType + "?labels=host"
+		var postResp json.RawMessage
+		postStatus, err := test.MakeHTTPRequest("POST", postURL, []byte(tt.query), &postResp)
+		require.NoError(t, err, tt.name)
+
+		assert.Equal(t, tt.status, getStatus, tt.name)
+		assert.Equal(t, getStatus, postStatus, tt.name)
+		assert.Equal(t, getQuery, gotQuery, tt.name)
+		if tt.status == http.StatusOK {
+			assert.Len(t, gotQuery.Predicates[0].Value, 2000, tt.name)
+			assert.Equal(t, etre.QueryFilter{ReturnLabels: []string{"host"}}, gotFilter, tt.name)
+			assert.Equal(t, getResp, postResp, tt.name)
+			continue
+		}
+		var getErr, postErr etre.Error
+		require.NoError(t, json.Unmarshal(getResp, &getErr), tt.name)
+		require.NoError(t, json.Unmarshal(postResp, &postErr), tt.name)
+		assert.Equal(t, "invalid-query", getErr.Type, tt.name)
+		getErr.RequestId, postErr.RequestId = "", "" // server-generated per request
+		assert.Equal(t, getErr, postErr, tt.name)
+	}
+
+	// Batch query uses the same max length
+	reqs, _ := json.Marshal([]etre.QueryRequest{{Query: valid}, {Query: tooLong}})
+	var results []etre.QueryResult
+	statusCode, err := test.MakeHTTPRequest("POST", server.url+etre.API_ROOT+"/entities/"+entityType+"/batch-query", reqs, &results)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	require.Len(t, results, 2)
+	assert.Nil(t, results[0].Error)
+	require.NotNil(t, results[1].Error)
+	assert.Equal(t, "invalid-query", results[1].Error.Type)
+}
+
+func TestQueryVersionHeader(t *testing.T) {
+	// Test that X-Etre-Query-Version selects the query language version
+	var gotQuery query.Query
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			gotQuery = q
+			return mock.DoStreamEntities(nil, nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("z>1.5")
+
+	// No header: version 1, so existing clients get the original translation
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	expectQuery, _ := query.TranslateVersion("z>1.5", query.VERSION_1)
+	assert.Equal(t, expectQuery, gotQuery)
+	assert.Equal(t, query.VERSION_1, query.DEFAULT_VERSION)
+
+	// Latest version is opt-in
+	test.Headers = map[string]string{
+		etre.QUERY_VERSION_HEADER: strconv.Itoa(query.LATEST_VERSION),
+	}
+	defer func() { test.Headers = map[string]string{} }()
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	expectQuery, _ = query.TranslateVersion("z>1.5", query.LATEST_VERSION)
+	assert.Equal(t, expectQuery, gotQuery)
+
+	// Invalid version
+	for _, v := range []string{"abc", "99"} {
+		test.Headers[etre.QUERY_VERSION_HEADER] = v
+		var gotError etre.Error
+		statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode)
+		assert.Equal(t, "invalid-query", gotError.Type)
+	}
+}
+
 func TestQueryLimit(t *testing.T) {
 	// Test that GET /entities/:type?query=Q&limit=N caps the result set
 	var gotFilter etre.QueryFilter
@@ -400,6 +538,382 @@ func TestQueryLimitZero(t *testing.T) {
 	assert.Equal(t, int64(0), gotFilter.Limit)
 }
 
+func TestQueryIncludeDeleted(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&deleted includes soft-deleted entities
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			gotFilter = f
+			return mock.DoStreamEntities(testEntitiesWithObjectIDs, nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b")
+
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.False(t, gotFilter.IncludeDeleted)
+
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"&deleted", nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.True(t, gotFilter.IncludeDeleted)
+}
+
+func TestHeadEntities(t *testing.T) {
+	// Test that HEAD /entities/:type?query=Q returns 200 if an entity matches,
+	// else 404, with no body, and that it reads only the id of one entity
+	var gotQuery query.Query
+	var gotFilter etre.QueryFilter
+	var entities []etre.Entity
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			gotQuery = q
+			gotFilter = f
+			return mock.DoStreamEntities(entities, nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape("a=b")
+
+	entities = []etre.Entity{{"_id": testEntityIds[0]}}
+	status, body := head(t, etreurl)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, body)
+	expectQuery, err := query.Translate("a=b")
+	require.NoError(t, err)
+	assert.Equal(t, expectQuery, gotQuery)
+	assert.Equal(t, etre.QueryFilter{ReturnLabels: []string{"_id"}, Limit: 1}, gotFilter)
+
+	entities = nil
+	status, body = head(t, etreurl)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Empty(t, body)
+
+	// Store errors are returned, but without a body
+	store.StreamEntitiesFunc = func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+		return mock.DoStreamEntities(nil, entity.DbError{Err: fmt.Errorf("db error"), Type: "db-query"})
+	}
+	server = setup(t, defaultConfig, store)
+	defer server.ts.Close()
+	status, body = head(t, server.url+etre.API_ROOT+"/entities/"+entityType+"?query="+url.QueryEscape("a=b"))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Empty(t, body)
+}
+
+func TestExport(t *testing.T) {
+	// Test that GET /entities/:type/export streams all entities as NDJSON, one
+	// per line, with an optional query and without the default limit
+	var gotQuery query.Query
+	var gotFilter etre.QueryFilter
+	entities := make([]etre.Entity, 250) // more than EXPORT_FLUSH_ENTITIES
+	for i := range entities {
+		entities[i] = etre.Entity{"_id": fmt.Sprintf("%024x", i), "_type": entityType, "x": fmt.Sprint(i)}
+	}
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			gotQuery = q
+			gotFilter = f
+			return mock.DoStreamEntities(entities, nil)
+		},
+	}
+	cfg := defaultConfig
+	cfg.Entity.Filter = map[string]config.FilterConfig{entityType: {Limit: 10}}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	export := func(params string) (*http.Response, []string) {
+		resp, err := http.Get(server.url + etre.API_ROOT + "/entities/" + entityType + "/export" + params)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		var lines []string
+		if len(body) > 0 {
+			lines = strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+		}
+		return resp, lines
+	}
+
+	// All entities
+	resp, lines := export("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etre.NDJSON_CONTENT_TYPE, resp.Header.Get("Content-Type"))
+	assert.Empty(t, resp.Trailer.Get(etre.ERROR_TRAILER))
+	require.Len(t, lines, len(entities))
+	for i, line := range lines {
+		var e etre.Entity
+		require.NoError(t, json.Unmarshal([]byte(line), &e), line)
+		assert.Equal(t, entities[i], e)
+	}
+	assert.Equal(t, query.Query{}, gotQuery)
+	assert.Equal(t, etre.QueryFilter{}, gotFilter) // no default limit
+
+	// Query, labels, and deleted
+	_, lines = export("?query=" + url.QueryEscape("x in (1,2)") + "&labels=x&deleted")
+	assert.Len(t, lines, len(entities)) // mock store ignores the query
+	expectQuery, err := query.Translate("x in (1,2)")
+	require.NoError(t, err)
+	assert.Equal(t, expectQuery, gotQuery)
+	assert.Equal(t, etre.QueryFilter{ReturnLabels: []string{"x"}, IncludeDeleted: true}, gotFilter)
+
+	// No entities
+	entities = nil
+	resp, lines = export("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etre.NDJSON_CONTENT_TYPE, resp.Header.Get("Content-Type"))
+	assert.Empty(t, lines)
+
+	// Invalid query
+	resp, _ = export("?query=" + url.QueryEscape("x=("))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// An error before the first entity is a normal error response
+	dbErr := entity.DbError{Err: fmt.Errorf("db error"), Type: "db-query"}
+	store.StreamEntitiesFunc = func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+		return mock.DoStreamEntities(nil, dbErr)
+	}
+	server = setup(t, cfg, store)
+	defer server.ts.Close()
+	resp, lines = export("")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], "db-query")
+
+	// An error after the first entity is in the trailer
+	store.StreamEntitiesFunc = func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+		ch := make(chan entity.EntityResult, 2)
+		ch <- entity.EntityResult{Entity: etre.Entity{"x": "1"}}
+		ch <- entity.EntityResult{Err: dbErr}
+		close(ch)
+		return ch
+	}
+	server = setup(t, cfg, store)
+	defer server.ts.Close()
+	resp, lines = export("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{`{"x":"1"}`}, lines)
+	var gotErr etre.Error
+	require.NoError(t, json.Unmarshal([]byte(resp.Trailer.Get(etre.ERROR_TRAILER)), &gotErr))
+	assert.Equal(t, "db-query", gotErr.Type)
+	assert.Equal(t, http.StatusServiceUnavailable, gotErr.HTTPStatus)
+}
+
+func TestQueryHint(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&hint=H passes the index hint to the store
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			gotFilter = f
+			return mock.DoStreamEntities(testEntitiesWithObjectIDs, nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&hint=" + url.QueryEscape("a:1,b:-1")
+
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.QueryFilter{Hint: "a:1,b:-1"}, gotFilter)
+}
+
+func TestQueryCollation(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&collation=C passes the collation to
+	// the store, and an invalid collation is an invalid query
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			gotFilter = f
+			return mock.DoStreamEntities(testEntitiesWithObjectIDs, nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape("a=B")
+
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl+"&collation=en:2", nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.QueryFilter{Collation: &etre.Collation{Locale: "en", Strength: 2}}, gotFilter)
+
+	for _, c := range []string{":2", "en:x", "en:6"} {
+		var gotError etre.Error
+		statusCode, err := test.MakeHTTPRequest("GET", etreurl+"&collation="+c, nil, &gotError)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, c)
+		assert.Equal(t, "invalid-query", gotError.Type, c)
+	}
+}
+
+func TestQueryAliases(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&aliases=label:alias,... passes the
+	// aliases to the store, and invalid or unreadable aliases are errors
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			gotFilter = f
+			return mock.DoStreamEntities([]etre.Entity{{"datacenter": "us-east", "letter": "a"}}, nil)
+		},
+	}
+	cfg := defaultConfig
+	cfg.Entity.Filter = map[string]config.FilterConfig{
+		entityType: {StripLabels: []string{"secret"}},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape("a=b")
+
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl+"&aliases="+url.QueryEscape("dc:datacenter,y:letter"), nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, map[string]string{"dc": "datacenter", "y": "letter"}, gotFilter.Aliases)
+	assert.Equal(t, []etre.Entity{{"datacenter": "us-east", "letter": "a"}}, gotEntities)
+
+	errTypes := map[string]string{
+		"dc":               "invalid-query", // not label:alias
+		"dc:a,dc:b":        "invalid-query", // two aliases
+		"dc:_id":           "cannot-change-metalabel",
+		"a:b,b:c":          "invalid-alias",  // alias is an aliased label
+		"secret:notsecret": "not-authorized", // alias reveals label value
+		"dc:secret":        "not-authorized",
+	}
+	for aliases, errType := range errTypes {
+		var gotError etre.Error
+		statusCode, err := test.MakeHTTPRequest("GET", etreurl+"&aliases="+url.QueryEscape(aliases), nil, &gotError)
+		require.NoError(t, err)
+		assert.NotEqual(t, http.StatusOK, statusCode, aliases)
+		assert.Equal(t, errType, gotError.Type, aliases)
+	}
+}
+
+func TestQueryMaxTime(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&maxTimeMS=N passes the max time to
+	// the store, and its query timeout error is returned as a query timeout
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			gotFilter = f
+			return mock.DoStreamEntities(nil, entity.DbError{Err: fmt.Errorf("query exceeded max query time"), Type: "query-timeout"})
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("a=b") + "&maxTimeMS=5"
+
+	var gotError etre.Error
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+	assert.Equal(t, "query-timeout", gotError.Type)
+	assert.Equal(t, int64(5), gotFilter.MaxTimeMS)
+
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Read, IntVal: 1},
+		{Method: "Inc", Metric: metrics.ReadQuery, IntVal: 1},
+		{Method: "Val", Metric: metrics.Labels, IntVal: 1},
+		{Method: "IncLabel", Metric: metrics.LabelRead, StringVal: "a"},
+		{Method: "Inc", Metric: metrics.QueryTimeout, IntVal: 1},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// Invalid max time
+	gotError = etre.Error{}
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"0x", nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "invalid-query", gotError.Type)
+}
+
+func TestQueryDefaultFilter(t *testing.T) {
+	// Test that the default filter of the entity type (config entity.filter)
+	// applies to all callers: only its labels are returned even if the caller
+	// requests more, strip labels are never returned, and its limit and sort are
+	// the defaults. Querying or sorting by a label that is not returned is not
+	// authorized.
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			gotFilter = f
+			return mock.DoStreamEntities([]etre.Entity{
+				{"_id": testEntityIds[0], "host": "a", "env": "prod", "rack": "r1", "secret": "s1"},
+			}, nil)
+		},
+	}
+	cfg := defaultConfig
+	cfg.Entity.Filter = map[string]config.FilterConfig{
+		entityType: {Labels: []string{"host", "env"}, StripLabels: []string{"_id"}, Limit: 10, Sort: "host:1"},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	base := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape("env=prod")
+
+	// No labels requested: all filter labels
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", base, nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, []etre.Entity{{"host": "a", "env": "prod"}}, gotEntities)
+	assert.Equal(t, int64(10), gotFilter.Limit)
+	assert.Equal(t, "host:1", gotFilter.Sort)
+
+	// More labels requested: still only filter labels, and caller can set limit and sort
+	gotEntities = nil
+	statusCode, err = test.MakeHTTPRequest("GET", base+"&labels=host,rack,secret,_id&limit=100&sort=env:-1", nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, []etre.Entity{{"host": "a", "env": "prod"}}, gotEntities)
+	assert.Equal(t, etre.QueryFilter{ReturnLabels: []string{"host", "rack", "secret", "_id"}, Limit: 100, Sort: "env:-1"}, gotFilter)
+
+	// Sorting by a label not returned by the filter would reveal the order of its values
+	var gotSortErr etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", base+"&sort=secret:1", nil, &gotSortErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Equal(t, "not-authorized", gotSortErr.Type)
+
+	// Querying a label not returned by the filter would reveal its values
+	var gotErr etre.Error
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape("secret=s1")
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Equal(t, "not-authorized", gotErr.Type)
+
+	// Other entity types are not filtered
+	cfg.Entity.Filter = map[string]config.FilterConfig{"other": {Labels: []string{"host"}}}
+	server2 := setup(t, cfg, store)
+	defer server2.ts.Close()
+	gotEntities = nil
+	statusCode, err = test.MakeHTTPRequest("GET", server2.url+etre.API_ROOT+"/entities/"+entityType+"?query=rack", nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	require.Len(t, gotEntities, 1)
+	assert.Len(t, gotEntities[0], 5)
+	assert.Equal(t, int64(0), gotFilter.Limit)
+}
+
 func TestQueryErrorsInvalidLimitNegative(t *testing.T) {
 	// Test that a negative limit returns HTTP 400 with an invalid-query error
 	store := mock.EntityStore{}
@@ -436,6 +950,162 @@ func TestQueryErrorsInvalidLimitNonNumeric(t *testing.T) {
 	assert.Contains(t, gotError.Message, "invalid limit")
 }
 
+func TestQueryGroupBy(t *testing.T) {
+	// Test that GET /entities/:type?query=Q&groupBy=L calls GroupEntities
+	// and returns an object of label value to entities
+	var gotGroupBy string
+	var gotFilter etre.QueryFilter
+	groups := map[string][]etre.Entity{
+		"a": {{"x": "2", "y": "a"}},
+		"b": {{"x": "4", "y": "b"}, {"x": "6", "y": "b"}},
+	}
+	store := mock.EntityStore{
+		GroupEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, groupBy string, f etre.QueryFilter) (map[string][]etre.Entity, error) {
+			gotGroupBy = groupBy
+			gotFilter = f
+			return groups, nil
+		},
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			t.Error("StreamEntities called, expected only GroupEntities")
+			return mock.DoStreamEntities(nil, nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("y") + "&groupBy=y&labels=x"
+
+	var gotGroups map[string][]etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotGroups)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "y", gotGroupBy)
+	assert.Equal(t, etre.QueryFilter{ReturnLabels: []string{"x"}}, gotFilter)
+	assert.Equal(t, groups, gotGroups)
+
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Read, IntVal: 1},
+		{Method: "Inc", Metric: metrics.ReadQuery, IntVal: 1},
+		{Method: "Val", Metric: metrics.Labels, IntVal: 1},
+		{Method: "IncLabel", Metric: metrics.LabelRead, StringVal: "y"},
+		{Method: "Val", Metric: metrics.ReadMatch, IntVal: 3}, // all entities in all groups
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+}
+
+func TestQueryGroupByTooManyGroups(t *testing.T) {
+	// Test that the store error for too many groups is returned as HTTP 400
+	store := mock.EntityStore{
+		GroupEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, groupBy string, f etre.QueryFilter) (map[string][]etre.Entity, error) {
+			return nil, entity.ValidationError{Err: fmt.Errorf("more than 1 groups"), Type: "too-many-groups"}
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("y") + "&groupBy=y"
+
+	var gotError etre.Error
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "too-many-groups", gotError.Type)
+}
+
+func TestQueryResultTooLarge(t *testing.T) {
+	// Test that the store error for too many results is returned as HTTP 400
+	// with the api.ErrResultTooLarge type
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			return mock.DoStreamEntities(nil, entity.ValidationError{Err: fmt.Errorf("query matches more than 2 entities"), Type: "result-too-large"})
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("y")
+
+	var gotError etre.Error
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	expectError := api.ErrResultTooLarge.New("query matches more than 2 entities")
+	expectError.RequestId = gotError.RequestId // server-generated
+	assert.Equal(t, expectError, gotError)
+}
+
+func TestQueryAggregate(t *testing.T) {
+	// Test GET /entities/:type/aggregate?query=Q&groupBy=label
+	var gotQuery query.Query
+	var gotGroupBy string
+	store := mock.EntityStore{
+		CountGroupsFunc: func(ctx context.Context, entityType string, q query.Query, groupBy string) ([]etre.GroupCount, error) {
+			gotQuery = q
+			gotGroupBy = groupBy
+			return []etre.GroupCount{{Value: "a", Count: 1}, {Value: "b", Count: 2}}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/aggregate" +
+		"?query=" + url.QueryEscape("y") + "&groupBy=y"
+
+	var gotCounts []etre.GroupCount
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotCounts)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, []etre.GroupCount{{Value: "a", Count: 1}, {Value: "b", Count: 2}}, gotCounts)
+	expectQuery, _ := query.Translate("y")
+	assert.Equal(t, expectQuery, gotQuery)
+	assert.Equal(t, "y", gotGroupBy)
+
+	// -- Metrics -----------------------------------------------------------
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Read, IntVal: 1},
+		{Method: "Inc", Metric: metrics.ReadQuery, IntVal: 1},
+		{Method: "Val", Metric: metrics.Labels, IntVal: 1},
+		{Method: "IncLabel", Metric: metrics.LabelRead, StringVal: "y"},
+		{Method: "Val", Metric: metrics.ReadMatch, IntVal: 3},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// groupBy is required
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/aggregate?query=y"
+	var gotError etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "missing-param", gotError.Type)
+
+	// groupBy must be a plain label, not an aggregation expression or nested
+	// path that would group whole entities and return their label values
+	for _, groupBy := range []string{"$ROOT", "$$ROOT", "y.z"} {
+		gotGroupBy = ""
+		etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/aggregate?query=y&groupBy=" + url.QueryEscape(groupBy)
+		gotError = etre.Error{}
+		statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, groupBy)
+		assert.Equal(t, "invalid-param", gotError.Type, groupBy)
+		assert.Empty(t, gotGroupBy, "CountGroups called with groupBy %s", groupBy)
+	}
+}
+
 func TestResponseCompression(t *testing.T) {
 	// Stand up the server
 	store := mock.EntityStore{
@@ -466,6 +1136,95 @@ func TestResponseCompression(t *testing.T) {
 	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
 }
 
+// getETag makes a GET request with the If-None-Match header, if set, and returns
+// the status code, ETag header, and body.
+func getETag(t *testing.T, url, ifNoneMatch string) (int, string, []byte) {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	res, err := http.DefaultClient.Do(req) // gzip enabled
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res.StatusCode, res.Header.Get("ETag"), body
+}
+
+func TestQueryETag(t *testing.T) {
+	// Test that GET /entities/:type returns an ETag, and a second identical query
+	// with the ETag in If-None-Match returns 304 Not Modified if the result is the same
+	rev := int64(0)
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			entities := make([]etre.Entity, len(testEntitiesWithObjectIDs))
+			for i, e := range testEntitiesWithObjectIDs {
+				entities[i] = etre.Entity{}
+				for k, v := range e {
+					entities[i][k] = v
+				}
+			}
+			entities[1]["_rev"] = rev
+			return mock.DoStreamEntities(entities, nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape("foo=bar")
+
+	status, tag1, body := getETag(t, etreurl, "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, tag1)
+	var gotEntities []etre.Entity
+	require.NoError(t, json.Unmarshal(body, &gotEntities))
+	assert.Len(t, gotEntities, 3)
+
+	// Same query and result: 304 and no body
+	status, tag, body := getETag(t, etreurl, tag1)
+	assert.Equal(t, http.StatusNotModified, status)
+	assert.Equal(t, tag1, tag)
+	assert.Empty(t, body)
+
+	// Entity changed: new result, new ETag
+	rev = 1
+	status, tag2, body := getETag(t, etreurl, tag1)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, tag1, tag2)
+	require.NoError(t, json.Unmarshal(body, &gotEntities))
+	assert.Len(t, gotEntities, 3)
+
+	status, _, _ = getETag(t, etreurl, tag1+", "+tag2)
+	assert.Equal(t, http.StatusNotModified, status)
+}
+
+func TestQueryETagLargeResponse(t *testing.T) {
+	// Test that a response larger than ETAG_MAX_BYTES is streamed without an ETag
+	big := strings.Repeat("x", 1024)
+	n := api.ETAG_MAX_BYTES/len(big) + 100
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			entities := make([]etre.Entity, n)
+			for i := range entities {
+				entities[i] = etre.Entity{"_id": fmt.Sprintf("%d", i), "big": big}
+			}
+			return mock.DoStreamEntities(entities, nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=" + url.QueryEscape("foo=bar")
+	status, tag, body := getETag(t, etreurl, "*")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, tag)
+	var gotEntities []etre.Entity
+	require.NoError(t, json.Unmarshal(body, &gotEntities))
+	assert.Len(t, gotEntities, n)
+}
+
 // fixLatencyMetric is a helper function that fixes the non-deterministic latency to ensure actual==expected for assertions.
 // Since latency is non-deterministic, it can cause tests to fail intermittently. This function replaces the latency metric
 // in the "expect" metrics with the "actual" value, so that the test can pass.
@@ -483,3 +1242,113 @@ func fixLatencyMetric(t *testing.T, max int, expect, actual []mock.MetricMethodA
 		}
 	}
 }
+
+func TestBatchQuery(t *testing.T) {
+	// Test POST /entities/:type/batch-query with valid and invalid queries.
+	// Invalid queries and store errors are returned per query and don't fail
+	// the other queries.
+	var mux sync.Mutex
+	gotFilters := map[string]etre.QueryFilter{}
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			label := q.Predicates[0].Label
+			mux.Lock()
+			gotFilters[label] = f
+			mux.Unlock()
+			switch label {
+			case "x":
+				return mock.DoStreamEntities([]etre.Entity{{"x": "1"}, {"x": "2"}}, nil)
+			case "y":
+				return mock.DoStreamEntities([]etre.Entity{{"y": "a"}}, nil)
+			case "db":
+				return mock.DoStreamEntities(nil, entity.DbError{Err: fmt.Errorf("fake error"), Type: "db-read"})
+			}
+			return mock.DoStreamEntities(nil, nil)
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	// All queries in the batch use the version in the header
+	test.Headers = map[string]string{
+		etre.QUERY_VERSION_HEADER: "2",
+	}
+	defer func() { test.Headers = map[string]string{} }()
+
+	reqs := []etre.QueryRequest{
+		{Query: "x"},
+		{Query: "z>foo"}, // invalid in version 2: not a number
+		{Query: "y=a", Filter: etre.QueryFilter{ReturnLabels: []string{"y"}, Limit: 5}},
+		{Query: ""},   // invalid: empty
+		{Query: "db"}, // store error
+		{Query: "none"},
+	}
+	payload, err := json.Marshal(reqs)
+	require.NoError(t, err)
+
+	var gotResults []etre.QueryResult
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/batch-query"
+	statusCode, err := test.MakeHTTPRequest("POST", etreurl, payload, &gotResults)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	require.Len(t, gotResults, len(reqs))
+	assert.Equal(t, etre.QueryResult{Entities: []etre.Entity{{"x": "1"}, {"x": "2"}}}, gotResults[0])
+	require.NotNil(t, gotResults[1].Error)
+	assert.Equal(t, "invalid-query", gotResults[1].Error.Type)
+	assert.Nil(t, gotResults[1].Entities)
+	assert.Equal(t, etre.QueryResult{Entities: []etre.Entity{{"y": "a"}}}, gotResults[2])
+	require.NotNil(t, gotResults[3].Error)
+	assert.Equal(t, "invalid-query", gotResults[3].Error.Type)
+	require.NotNil(t, gotResults[4].Error)
+	assert.Equal(t, etre.Error{Message: "fake error", Type: "db-read", HTTPStatus: http.StatusServiceUnavailable}, *gotResults[4].Error)
+	assert.Equal(t, etre.QueryResult{Entities: []etre.Entity{}}, gotResults[5])
+
+	// Filters are passed to the store; invalid queries are not run
+	assert.Equal(t, map[string]etre.QueryFilter{
+		"x":    {},
+		"y":    {ReturnLabels: []string{"y"}, Limit: 5},
+		"db":   {},
+		"none": {},
+	}, gotFilters)
+
+	// Batch query is a read, not a write
+	assert.Equal(t, []mock.AuthorizeArgs{{
+		Action: auth.Action{Op: auth.OP_READ, EntityType: entityType},
+		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+	}}, server.auth.AuthorizeArgs)
+}
+
+func TestBatchQueryErrors(t *testing.T) {
+	// Test that errors for the whole batch return an etre.Error
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/batch-query"
+
+	// Not JSON
+	var gotError etre.Error
+	statusCode, err := test.MakeHTTPRequest("POST", etreurl, []byte("x=1"), &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "invalid-content", gotError.Type)
+
+	// No queries
+	gotError = etre.Error{}
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, []byte("[]"), &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "no-content", gotError.Type)
+
+	// Too many queries
+	reqs := make([]etre.QueryRequest, api.BATCH_QUERY_MAX+1)
+	for i := range reqs {
+		reqs[i].Query = "x"
+	}
+	payload, err := json.Marshal(reqs)
+	require.NoError(t, err)
+	gotError = etre.Error{}
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, payload, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "invalid-query", gotError.Type)
+}
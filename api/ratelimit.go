@@ -0,0 +1,86 @@
+// Copyright 2026, Square, Inc.
+
+package api
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/square/etre/config"
+)
+
+// rateLimiter limits requests per metric group with a token bucket per group.
+// Each request takes one token from the bucket of every caller metric group.
+// Buckets refill at the group rate (requests/second) up to the group burst.
+type rateLimiter struct {
+	cfg     config.RateLimitConfig
+	mux     *sync.Mutex
+	buckets map[string]*bucket // keyed on metric group
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter, or nil if rate limiting is not configured.
+func newRateLimiter(cfg config.RateLimitConfig) *rateLimiter {
+	if cfg.RequestsPerSecond <= 0 && len(cfg.Groups) == 0 {
+		return nil
+	}
+	return &rateLimiter{
+		cfg:     cfg,
+		mux:     &sync.Mutex{},
+		buckets: map[string]*bucket{},
+	}
+}
+
+// allow returns true if the request is allowed for all groups. If not, it
+// returns false and the first group that exceeded its limit. Tokens are taken
+// only if the request is allowed.
+func (rl *rateLimiter) allow(groups []string) (bool, string) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	now := time.Now()
+	limited := make([]*bucket, 0, len(groups))
+	for _, group := range groups {
+		rps, burst := rl.limit(group)
+		if rps <= 0 {
+			continue // group not limited
+		}
+		b, ok := rl.buckets[group]
+		if !ok {
+			b = &bucket{tokens: burst, last: now}
+			rl.buckets[group] = b
+		} else {
+			b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rps)
+			b.last = now
+		}
+		if b.tokens < 1 {
+			return false, group
+		}
+		limited = append(limited, b)
+	}
+	for _, b := range limited {
+		b.tokens--
+	}
+	return true, ""
+}
+
+// limit returns the requests/second and burst for the group. A group limit
+// overrides the default limit. If burst is not set, it's the rate (minimum 1).
+func (rl *rateLimiter) limit(group string) (float64, float64) {
+	l := config.RateLimit{
+		RequestsPerSecond: rl.cfg.RequestsPerSecond,
+		Burst:             rl.cfg.Burst,
+	}
+	if gl, ok := rl.cfg.Groups[group]; ok {
+		l = gl
+	}
+	burst := float64(l.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(l.RequestsPerSecond))
+	}
+	return l.RequestsPerSecond, burst
+}
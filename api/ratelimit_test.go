@@ -0,0 +1,86 @@
+// Copyright 2026, Square, Inc.
+
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/square/etre"
+	"github.com/square/etre/auth"
+	"github.com/square/etre/config"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/query"
+	"github.com/square/etre/test"
+	"github.com/square/etre/test/mock"
+)
+
+func TestRateLimit(t *testing.T) {
+	// Group "test" has a burst of 2 and refills so slowly that the 3rd request
+	// is rate limited. Group "unlimited" overrides the default with no limit.
+	cfg := defaultConfig
+	cfg.Server.RateLimit = config.RateLimitConfig{
+		RequestsPerSecond: 0.001,
+		Burst:             2,
+		Groups: map[string]config.RateLimit{
+			"unlimited": {RequestsPerSecond: 0},
+		},
+	}
+	store := mock.EntityStore{
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			return mock.DoStreamEntities(nil, nil)
+		},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	groups := []string{"test"}
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "test", MetricGroups: groups}, nil
+	}
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=x"
+	for i := 0; i < 2; i++ {
+		var gotEntities []etre.Entity
+		statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, statusCode, "request %d", i)
+	}
+
+	// Read over limit
+	var etreErr etre.Error
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &etreErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, statusCode)
+	assert.Equal(t, "rate-limited", etreErr.Type)
+
+	// Write over limit
+	payload, err := json.Marshal(etre.Entity{"x": "1"})
+	require.NoError(t, err)
+	var gotWR etre.WriteResult
+	statusCode, err = test.MakeHTTPRequest("POST", server.url+etre.API_ROOT+"/entity/"+entityType, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "rate-limited", gotWR.Error.Type)
+
+	// Other groups have their own limit
+	groups = []string{"unlimited"}
+	for i := 0; i < 5; i++ {
+		var gotEntities []etre.Entity
+		statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, statusCode, "request %d", i)
+	}
+
+	// Limited if any group is over its limit
+	groups = []string{"unlimited", "test"}
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &etreErr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, statusCode)
+}
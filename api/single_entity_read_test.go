@@ -4,9 +4,12 @@ package api_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,6 +18,8 @@ import (
 	"github.com/square/etre"
 	"github.com/square/etre/api"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/cdc"
+	"github.com/square/etre/config"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/metrics"
 	"github.com/square/etre/test"
@@ -75,6 +80,122 @@ func TestGetEntityBasic(t *testing.T) {
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestGetEntityETag(t *testing.T) {
+	// Test that GET /entity/:type/:id returns 304 Not Modified if the ETag matches
+	store := mock.EntityStore{
+		ReadEntityFunc: func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+			return etre.Entity{"_id": entityId, "_rev": int64(2), "x": "1"}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	status, tag, body := getETag(t, etreurl, "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, tag)
+	assert.NotEmpty(t, body)
+
+	status, _, body = getETag(t, etreurl, tag)
+	assert.Equal(t, http.StatusNotModified, status)
+	assert.Empty(t, body)
+
+	status, _, _ = getETag(t, etreurl, `W/"old"`)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestReadByIds(t *testing.T) {
+	// Test GET and POST /entities/:type/by-ids return entities in request order,
+	// null for missing ids, and the same entity for duplicate ids
+	var gotIds []string
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		ReadByIdsFunc: func(ctx context.Context, entityType string, entityIds []string, f etre.QueryFilter) ([]etre.Entity, error) {
+			gotIds = entityIds
+			gotFilter = f
+			byId := map[string]etre.Entity{
+				testEntityIds[0]: testEntitiesWithObjectIDs[0],
+				testEntityIds[1]: testEntitiesWithObjectIDs[1],
+			}
+			entities := make([]etre.Entity, len(entityIds))
+			for i, id := range entityIds {
+				entities[i] = byId[id]
+			}
+			return entities, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	ids := []string{testEntityIds[1], "missing", testEntityIds[0], testEntityIds[1]}
+	expect := []etre.Entity{testEntities[1], nil, testEntities[0], testEntities[1]}
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/by-ids"
+
+	// GET ?ids=a,b,c
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl+"?ids="+strings.Join(ids, ","), nil, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, ids, gotIds)
+	for _, e := range gotEntities {
+		if e != nil {
+			fixInt64([]etre.Entity{e}) // JSON float64(_rev) ->, int64(_rev)
+		}
+	}
+	assert.Equal(t, expect, gotEntities)
+
+	// -- Metrics -----------------------------------------------------------
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Read, IntVal: 1},
+		{Method: "Inc", Metric: metrics.ReadId, IntVal: 1},
+		{Method: "Val", Metric: metrics.ReadMatch, IntVal: 3},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// POST ["a","b","c"] with return labels
+	body, _ := json.Marshal(ids)
+	gotEntities = nil
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl+"?labels=x,foo", body, &gotEntities)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, ids, gotIds)
+	assert.Equal(t, etre.QueryFilter{ReturnLabels: []string{"x", "foo"}}, gotFilter)
+	for _, e := range gotEntities {
+		if e != nil {
+			fixInt64([]etre.Entity{e}) // JSON float64(_rev) ->, int64(_rev)
+		}
+	}
+	assert.Equal(t, expect, gotEntities)
+
+	// Errors: no ids, empty id, invalid JSON
+	for _, tt := range []struct {
+		method  string
+		query   string
+		body    string
+		errType string
+	}{
+		{"GET", "", "", "missing-param"},
+		{"GET", "?ids=a,,b", "", "invalid-param"},
+		{"POST", "", "[]", "missing-param"},
+		{"POST", "", `["a",""]`, "invalid-param"},
+		{"POST", "", `{"a":1}`, "invalid-content"},
+	} {
+		var gotError etre.Error
+		var body []byte
+		if tt.body != "" {
+			body = []byte(tt.body)
+		}
+		statusCode, err := test.MakeHTTPRequest(tt.method, etreurl+tt.query, body, &gotError)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, tt)
+		assert.Equal(t, tt.errType, gotError.Type, tt)
+	}
+}
+
 func TestGetEntityReturnLabels(t *testing.T) {
 	// Test that GET /entity/:type/:id works with etre.QueryFilter.ReturnLabels.
 	// The real entity.Store does this and is tested in that pkg, so here we're testing
@@ -122,6 +243,313 @@ func TestGetEntityReturnLabels(t *testing.T) {
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestGetEntityHistory(t *testing.T) {
+	// Test that GET /entity/:type/:id?history includes the entity's CDC events
+	// inline, most recent N, and that history is omitted by default
+	store := mock.EntityStore{
+		ReadEntityFunc: func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+			return etre.Entity{"_id": entityId, "x": "a"}, nil // copy, handler adds _history
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	var gotFilter cdc.Filter
+	events := []etre.CDCEvent{
+		{Id: "e0", EntityId: testEntityIds[0], EntityRev: 0, Op: "i"},
+		{Id: "e1", EntityId: testEntityIds[0], EntityRev: 1, Op: "u"},
+		{Id: "e2", EntityId: testEntityIds[0], EntityRev: 2, Op: "u"},
+	}
+	server.cdcStore.ReadFunc = func(f cdc.Filter) ([]etre.CDCEvent, error) {
+		gotFilter = f
+		if f.Limit > 0 && int(f.Limit) < len(events) {
+			return events[len(events)-int(f.Limit):], nil // most recent
+		}
+		return events, nil
+	}
+
+	// Default: no history
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	var gotEntity etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntity)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.NotContains(t, gotEntity, "_history")
+	assert.Empty(t, gotFilter.EntityId) // CDC store not read
+
+	// history=2: most recent 2 events, oldest first
+	var gotEntityHistory struct {
+		Id      string          `json:"_id"`
+		History []etre.CDCEvent `json:"_history"`
+	}
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"?history=2", nil, &gotEntityHistory)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, testEntityIds[0], gotFilter.EntityId)
+	assert.Equal(t, int64(2), gotFilter.Limit)
+	assert.Equal(t, events[1:], gotEntityHistory.History)
+
+	// history: all events up to the max
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"?history", nil, &gotEntityHistory)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, events, gotEntityHistory.History)
+	assert.Equal(t, int64(config.DEFAULT_CDC_MAX_HISTORY), gotFilter.Limit)
+
+	// Invalid history value
+	var gotError etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"?history=-1", nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestGetEntityHistoryNotAuthorized(t *testing.T) {
+	// Test that history requires CDC auth: caller can read entities but not CDC
+	readEntity := false
+	store := mock.EntityStore{
+		ReadEntityFunc: func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+			readEntity = true
+			return etre.Entity{"_id": entityId}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+	server.auth.AuthorizeFunc = func(caller auth.Caller, a auth.Action) error {
+		if a.Op == auth.OP_CDC {
+			return fmt.Errorf("no CDC")
+		}
+		return nil
+	}
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0] + "?history"
+	var gotError etre.Error
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Equal(t, "not-authorized", gotError.Type)
+	assert.False(t, readEntity, "entity read, expected auth error first")
+
+	assert.Equal(t, []mock.AuthorizeArgs{
+		{
+			Action: auth.Action{Op: auth.OP_READ, EntityType: entityType},
+			Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+		},
+		{
+			Action: auth.Action{Op: auth.OP_CDC, EntityType: entityType},
+			Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+		},
+	}, server.auth.AuthorizeArgs)
+}
+
+func TestEntityHistory(t *testing.T) {
+	// Test that GET /entity/:type/:id/history returns all CDC events for the
+	// entity in order: created, updated, and deleted. The entity is not read
+	// because it might not exist (deleted).
+	readEntity := false
+	store := mock.EntityStore{
+		ReadEntityFunc: func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+			readEntity = true
+			return nil, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	var gotFilter cdc.Filter
+	events := []etre.CDCEvent{
+		{Id: "e0", EntityId: testEntityIds[0], EntityType: entityType, EntityRev: 0, Op: "i", Ts: 1, New: &etre.Entity{"x": "a"}},
+		{Id: "e1", EntityId: testEntityIds[0], EntityType: entityType, EntityRev: 1, Op: "u", Ts: 2, Old: &etre.Entity{"x": "a"}, New: &etre.Entity{"x": "b"}},
+		{Id: "e2", EntityId: testEntityIds[0], EntityType: entityType, EntityRev: 2, Op: "d", Ts: 3, Old: &etre.Entity{"x": "b"}},
+	}
+	server.cdcStore.ReadFunc = func(f cdc.Filter) ([]etre.CDCEvent, error) {
+		gotFilter = f
+		return events, nil
+	}
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0] + "/history"
+	var gotEvents []etre.CDCEvent
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEvents)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, events, gotEvents)
+	assert.False(t, readEntity)
+
+	// Most recent events for the entity, ordered by rev
+	expectFilter := cdc.Filter{
+		SinceTs:    1,
+		EntityId:   testEntityIds[0],
+		EntityType: entityType,
+		Limit:      config.DEFAULT_CDC_MAX_HISTORY,
+		Order:      cdc.ByEntityIdRevAsc{},
+	}
+	assert.Equal(t, expectFilter, gotFilter)
+
+	// -- Auth -----------------------------------------------------------
+	// Read and CDC
+	assert.Equal(t, []mock.AuthorizeArgs{
+		{
+			Action: auth.Action{Op: auth.OP_READ, EntityType: entityType},
+			Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+		},
+		{
+			Action: auth.Action{Op: auth.OP_CDC, EntityType: entityType},
+			Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+		},
+	}, server.auth.AuthorizeArgs)
+
+	// -- Errors -----------------------------------------------------------
+	// Not authorized for CDC
+	gotFilter = cdc.Filter{}
+	server.auth.AuthorizeFunc = func(caller auth.Caller, a auth.Action) error {
+		if a.Op == auth.OP_CDC {
+			return fmt.Errorf("no CDC")
+		}
+		return nil
+	}
+	var gotError etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Equal(t, "not-authorized", gotError.Type)
+	assert.Empty(t, gotFilter.EntityId) // CDC store not read
+
+	// CDC disabled
+	cfg := defaultConfig
+	cfg.CDC.Disabled = true
+	server = setup(t, cfg, store)
+	defer server.ts.Close()
+	etreurl = server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0] + "/history"
+	gotError = etre.Error{}
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, api.ErrCDCDisabled.HTTPStatus, statusCode)
+	assert.Equal(t, api.ErrCDCDisabled.Type, gotError.Type)
+}
+
+func TestEntityHistoryDefaultFilter(t *testing.T) {
+	// Test that labels not returned by the default filter of the entity type
+	// (config entity.filter) are removed from the old and new values of history
+	// events, both /history and inline ?history, like they are from the entity
+	store := mock.EntityStore{
+		ReadEntityFunc: func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+			return etre.Entity{"_id": entityId, "x": "b"}, nil
+		},
+	}
+	cfg := defaultConfig
+	cfg.Entity.Filter = map[string]config.FilterConfig{
+		entityType: {StripLabels: []string{"secret"}},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	created := etre.Entity{"x": "a", "secret": "s1"}
+	events := []etre.CDCEvent{
+		{Id: "e0", EntityId: testEntityIds[0], EntityType: entityType, EntityRev: 0, Op: "i", New: &created},
+		{Id: "e1", EntityId: testEntityIds[0], EntityType: entityType, EntityRev: 1, Op: "u", Old: &etre.Entity{"x": "a", "secret": "s1"}, New: &etre.Entity{"x": "b", "secret": "s2"}},
+	}
+	server.cdcStore.ReadFunc = func(f cdc.Filter) ([]etre.CDCEvent, error) {
+		return events, nil
+	}
+	expectEvents := []etre.CDCEvent{
+		{Id: "e0", EntityId: testEntityIds[0], EntityType: entityType, EntityRev: 0, Op: "i", New: &etre.Entity{"x": "a"}},
+		{Id: "e1", EntityId: testEntityIds[0], EntityType: entityType, EntityRev: 1, Op: "u", Old: &etre.Entity{"x": "a"}, New: &etre.Entity{"x": "b"}},
+	}
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	var gotEvents []etre.CDCEvent
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl+"/history", nil, &gotEvents)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, expectEvents, gotEvents)
+
+	var gotEntityHistory struct {
+		Id      string          `json:"_id"`
+		History []etre.CDCEvent `json:"_history"`
+	}
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"?history", nil, &gotEntityHistory)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, expectEvents, gotEntityHistory.History)
+
+	// Event entities are copied, not changed
+	assert.Equal(t, etre.Entity{"x": "a", "secret": "s1"}, created)
+}
+
+func TestEntityAt(t *testing.T) {
+	// Test that GET /entity/:type/:id/at?rev=N|ts=T reconstructs the entity from
+	// its CDC events
+	var current etre.Entity
+	store := mock.EntityStore{
+		ReadEntityFunc: func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+			return current, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	events := []etre.CDCEvent{
+		{Id: "e0", EntityId: testEntityIds[0], EntityRev: 0, Op: "i", Ts: 10, New: &etre.Entity{"_id": testEntityIds[0], "_rev": int64(0), "x": "a"}},
+		{Id: "e1", EntityId: testEntityIds[0], EntityRev: 1, Op: "u", Ts: 20, Old: &etre.Entity{"x": "a"}, New: &etre.Entity{"x": "b"}},
+		{Id: "e2", EntityId: testEntityIds[0], EntityRev: 2, Op: "u", Ts: 30, Old: &etre.Entity{"x": "b"}, New: &etre.Entity{"x": "c"}},
+	}
+	server.cdcStore.ReadFunc = func(f cdc.Filter) ([]etre.CDCEvent, error) {
+		return events, nil
+	}
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0] + "/at"
+
+	// Intermediate rev and ts
+	var gotEntity etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl+"?rev=1", nil, &gotEntity)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.Entity{"_id": testEntityIds[0], "_rev": float64(1), "x": "b"}, gotEntity)
+
+	gotEntity = nil
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"?ts=25", nil, &gotEntity)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, etre.Entity{"_id": testEntityIds[0], "_rev": float64(1), "x": "b"}, gotEntity)
+
+	// Before insert: not found
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"?ts=5", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+
+	// Requires CDC auth
+	assert.Equal(t, auth.Action{Op: auth.OP_CDC, EntityType: entityType}, server.auth.AuthorizeArgs[1].Action)
+
+	// Invalid params
+	for _, params := range []string{"", "?rev=1&ts=25", "?rev=-1", "?ts=x"} {
+		var gotError etre.Error
+		statusCode, err = test.MakeHTTPRequest("GET", etreurl+params, nil, &gotError)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, params)
+	}
+
+	// CDC events don't go back far enough (insert deleted by retention)
+	events = events[1:]
+	var gotError etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"?rev=1", nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGone, statusCode)
+	assert.Equal(t, etre.ErrCDCHistoryGone.Type, gotError.Type)
+
+	// No events: entity exists but all its events are gone, else not found
+	events = nil
+	current = etre.Entity{"_id": testEntityIds[0], "_rev": int64(2), "x": "c"}
+	gotError = etre.Error{}
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"?rev=1", nil, &gotError)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGone, statusCode)
+	assert.Equal(t, etre.ErrCDCHistoryGone.Type, gotError.Type)
+
+	current = nil
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"?rev=1", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+}
+
 func TestGetEntityNotFound(t *testing.T) {
 	// Test that GET /entity/:type/:id returns 404 when the entity doesn't exist.
 	// We simulate this by making ReadEntities() below return an empty list which
@@ -156,6 +584,67 @@ func TestGetEntityNotFound(t *testing.T) {
 	assert.Equal(t, expectMetrics, server.metricsrec.Called)
 }
 
+// head makes a HEAD request and returns the response status code and body.
+func head(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	res, err := http.Head(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res.StatusCode, body
+}
+
+func TestHeadEntity(t *testing.T) {
+	// Test that HEAD /entity/:type/:id returns 200 if the entity exists, else 404,
+	// with no body, and that it reads only the entity id
+	var gotEntityId string
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		ReadEntityFunc: func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+			gotEntityId = entityId
+			gotFilter = f
+			if entityId == testEntityIds[0] {
+				return etre.Entity{"_id": testEntitiesWithObjectIDs[0]["_id"]}, nil
+			}
+			return nil, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/"
+
+	status, body := head(t, etreurl+testEntityIds[0])
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, body)
+	assert.Equal(t, testEntityIds[0], gotEntityId)
+	assert.Equal(t, etre.QueryFilter{ReturnLabels: []string{"_id"}}, gotFilter)
+
+	// -- Metrics -----------------------------------------------------------
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Read, IntVal: 1},
+		{Method: "Inc", Metric: metrics.ReadId, IntVal: 1},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// -- Auth -----------------------------------------------------------
+	assert.Equal(t, []mock.AuthorizeArgs{{
+		Action: auth.Action{Op: auth.OP_READ, EntityType: entityType},
+		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+	}}, server.auth.AuthorizeArgs)
+
+	status, body = head(t, etreurl+testEntityIds[1]+"?deleted")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Empty(t, body)
+	assert.Equal(t, testEntityIds[1], gotEntityId)
+	assert.Equal(t, etre.QueryFilter{ReturnLabels: []string{"_id"}, IncludeDeleted: true}, gotFilter)
+}
+
 func TestGetEntityErrors(t *testing.T) {
 	// Test that GET /entity/:type/:id returns correct errors
 	read := false
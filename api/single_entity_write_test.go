@@ -15,6 +15,7 @@ import (
 	"github.com/square/etre"
 	"github.com/square/etre/api"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/config"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/metrics"
 	"github.com/square/etre/query"
@@ -88,7 +89,7 @@ func TestPostEntityOK(t *testing.T) {
 	// -- Auth -----------------------------------------------------------
 	require.Len(t, server.auth.AuthenticateArgs, 1)
 	assert.Equal(t, []mock.AuthorizeArgs{{
-		Action: auth.Action{Op: auth.OP_WRITE, EntityType: entityType},
+		Action: auth.Action{Op: auth.OP_INSERT, EntityType: entityType},
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
 }
@@ -136,11 +137,176 @@ func TestPostEntityDuplicate(t *testing.T) {
 	// -- Auth -----------------------------------------------------------
 	require.Len(t, server.auth.AuthenticateArgs, 1)
 	assert.Equal(t, []mock.AuthorizeArgs{{
-		Action: auth.Action{Op: auth.OP_WRITE, EntityType: entityType},
+		Action: auth.Action{Op: auth.OP_INSERT, EntityType: entityType},
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestPostEntityIfNotExists(t *testing.T) {
+	// Test that POST /entity/:type?query= calls entity.Store.CreateEntityIfNotExists
+	// and returns HTTP 201 with the new id if created, or HTTP 200 with the
+	// existing entity as the diff if an entity already matched the query.
+	var gotQuery query.Query
+	var gotEntity etre.Entity
+	created := true
+	store := mock.EntityStore{
+		CreateIfNotExistsFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query, e etre.Entity) (etre.Entity, bool, error) {
+			gotQuery = q
+			gotEntity = e
+			return etre.Entity{"_id": "id1", "host": "local"}, created, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	newEntity := etre.Entity{"host": "local"}
+	payload, err := json.Marshal(newEntity)
+	require.NoError(t, err)
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "?query=host=local"
+
+	// Created
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, statusCode)
+	expectWR := etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "id1",
+				URI:      addr + etre.API_ROOT + "/entity/id1",
+			},
+		},
+	}
+	assert.Equal(t, expectWR, gotWR)
+	assert.Equal(t, newEntity, gotEntity)
+	expectQuery, _ := query.Translate("host=local")
+	assert.Equal(t, expectQuery, gotQuery)
+
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Write, IntVal: 1},
+		{Method: "Inc", Metric: metrics.CreateOne, IntVal: 1},
+		{Method: "Val", Metric: metrics.Labels, IntVal: 1},
+		{Method: "IncLabel", Metric: metrics.LabelRead, StringVal: "host"},
+		{Method: "Inc", Metric: metrics.Created, IntVal: 1},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// Already exists: not an error
+	created = false
+	server.metricsrec.Reset()
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	expectWR = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "id1",
+				URI:      addr + etre.API_ROOT + "/entity/id1",
+				Diff:     etre.Entity{"_id": "id1", "host": "local"},
+			},
+		},
+	}
+	assert.Equal(t, expectWR, gotWR)
+	for _, m := range server.metricsrec.Called {
+		assert.NotEqual(t, metrics.Created, m.Metric)
+	}
+}
+
+func TestWriteEntitySchema(t *testing.T) {
+	// Test that inserts and updates are validated against the entity type schema
+	// before writing, required labels cannot be deleted or renamed, and the error
+	// names the offending label
+	defaultValidate := validate
+	defer func() { validate = defaultValidate }()
+	validate = entity.NewValidator([]string{entityType}).WithSchema(map[string]config.SchemaConfig{
+		entityType: {Labels: []config.LabelSchema{
+			{Name: "env", Required: true, Enum: []string{"prod", "staging"}},
+		}},
+	})
+
+	written := false
+	store := mock.EntityStore{
+		CreateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			written = true
+			return []string{testEntityIds[0]}, nil
+		},
+		UpdateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			written = true
+			return []etre.Entity{{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "env": "prod"}}, nil
+		},
+		DeleteLabelFunc: func(ctx context.Context, wo entity.WriteOp, label string) (etre.Entity, error) {
+			written = true
+			return nil, nil
+		},
+		DeleteLabelByQueryFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query, label string) ([]etre.Entity, error) {
+			written = true
+			return nil, nil
+		},
+		RenameLabelFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query, label, newLabel string, overwrite bool) ([]etre.Entity, error) {
+			written = true
+			return nil, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	postURL := server.url + etre.API_ROOT + "/entity/" + entityType
+	putURL := postURL + "/" + testEntityIds[0]
+	labelsURL := server.url + etre.API_ROOT + "/entities/" + entityType + "/labels/env?query=host"
+	writes := []struct {
+		method  string
+		url     string
+		entity  etre.Entity
+		errType string
+	}{
+		{"POST", postURL, etre.Entity{"host": "local"}, "missing-required-label"},
+		{"POST", postURL, etre.Entity{"host": "local", "env": "dev"}, "invalid-label-value"},
+		{"PUT", putURL, etre.Entity{"env": "dev"}, "invalid-label-value"},
+		{"DELETE", putURL + "/labels/env", nil, "missing-required-label"}, // required label
+		{"DELETE", labelsURL, nil, "missing-required-label"},
+		{"PUT", labelsURL + "&name=environment", nil, "missing-required-label"},
+	}
+	for _, w := range writes {
+		payload, err := json.Marshal(w.entity)
+		require.NoError(t, err)
+		var gotWR etre.WriteResult
+		statusCode, err := test.MakeHTTPRequest(w.method, w.url, payload, &gotWR)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, w)
+		require.NotNil(t, gotWR.Error, w)
+		assert.Equal(t, w.errType, gotWR.Error.Type, w)
+		assert.Contains(t, gotWR.Error.Message, "env", w)
+		assert.False(t, written, "entity written, expected schema error first: %+v", w)
+	}
+
+	// Valid: written
+	for _, w := range []struct {
+		method string
+		url    string
+		entity etre.Entity
+		status int
+	}{
+		{"POST", postURL, etre.Entity{"host": "local", "env": "prod"}, http.StatusCreated},
+		{"PUT", putURL, etre.Entity{"host": "remote"}, http.StatusOK}, // patch doesn't need required labels
+	} {
+		written = false
+		payload, err := json.Marshal(w.entity)
+		require.NoError(t, err)
+		var gotWR etre.WriteResult
+		statusCode, err := test.MakeHTTPRequest(w.method, w.url, payload, &gotWR)
+		require.NoError(t, err)
+		assert.Equal(t, w.status, statusCode, w)
+		assert.Nil(t, gotWR.Error, w)
+		assert.True(t, written, w)
+	}
+}
+
 func TestPostEntityErrors(t *testing.T) {
 	// Test that POST /entities/:type returns an error for any issue
 	created := false
@@ -321,7 +487,7 @@ func TestPutEntityOK(t *testing.T) {
 	// -- Auth -----------------------------------------------------------
 	require.Len(t, server.auth.AuthenticateArgs, 1)
 	assert.Equal(t, []mock.AuthorizeArgs{{
-		Action: auth.Action{Op: auth.OP_WRITE, EntityType: entityType},
+		Action: auth.Action{Op: auth.OP_UPDATE, EntityType: entityType},
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
 }
@@ -335,6 +501,7 @@ func TestPutEntityDuplicate(t *testing.T) {
 				Type:     "duplicate-entity", // the key to making this happen
 				EntityId: testEntityIds[0],
 				Err:      fmt.Errorf("some error msg from mongo"),
+				Conflict: etre.Entity{"foo": "bar", "a": "b"},
 			}
 		},
 	}
@@ -353,6 +520,8 @@ func TestPutEntityDuplicate(t *testing.T) {
 	assert.Equal(t, http.StatusConflict, statusCode)
 	require.Error(t, gotWR.Error)
 	assert.Equal(t, "duplicate-entity", gotWR.Error.Type)
+	assert.Equal(t, &etre.Entity{"foo": "bar", "a": "b"}, gotWR.Error.Conflict)
+	assert.Contains(t, gotWR.Error.Message, "conflict with another entity: a=b, foo=bar")
 	assert.Len(t, gotWR.Writes, 0)
 
 	// -- Metrics -----------------------------------------------------------
@@ -372,11 +541,45 @@ func TestPutEntityDuplicate(t *testing.T) {
 	// -- Auth -----------------------------------------------------------
 	require.Len(t, server.auth.AuthenticateArgs, 1)
 	assert.Equal(t, []mock.AuthorizeArgs{{
-		Action: auth.Action{Op: auth.OP_WRITE, EntityType: entityType},
+		Action: auth.Action{Op: auth.OP_UPDATE, EntityType: entityType},
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestPutEntityDuplicateUnreadableConflict(t *testing.T) {
+	// Test that a duplicate-entity error does not return the values of conflict
+	// labels the caller cannot read, in Conflict or the message, including the
+	// dup key values in the MongoDB error
+	store := mock.EntityStore{
+		UpdateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			return nil, entity.DbError{
+				Type:     "duplicate-entity",
+				EntityId: testEntityIds[0],
+				Err:      fmt.Errorf(`E11000 duplicate key error collection: etre.nodes index: foo_1_secret_1 dup key: { foo: "bar", secret: "s1" }`),
+				Conflict: etre.Entity{"foo": "bar", "secret": "s1"},
+			}
+		},
+	}
+	cfg := defaultConfig
+	cfg.Entity.Filter = map[string]config.FilterConfig{
+		entityType: {StripLabels: []string{"secret"}},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, []byte(`{"foo":"bar"}`), &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, statusCode)
+	require.Error(t, gotWR.Error)
+	assert.Equal(t, "duplicate-entity", gotWR.Error.Type)
+	assert.Equal(t, &etre.Entity{"foo": "bar"}, gotWR.Error.Conflict)
+	assert.Contains(t, gotWR.Error.Message, "conflict with another entity: foo=bar")
+	assert.Contains(t, gotWR.Error.Message, "index: foo_1_secret_1")
+	assert.NotContains(t, gotWR.Error.Message, "s1")
+}
+
 func TestPutEntityNotFound(t *testing.T) {
 	// Test that PUT /entities/:type/:id returns HTTP 404 when there's no entity
 	// with the given id. In this case, the entity.Store returns an empty diff:
@@ -416,6 +619,87 @@ func TestPutEntityNotFound(t *testing.T) {
 	assert.Equal(t, expectMetrics, server.metricsrec.Called)
 }
 
+func TestPutEntityJSONPatch(t *testing.T) {
+	// Test that PUT /entities/:type/:id with Content-Type application/json-patch+json
+	// translates the JSON Patch ops to a patch with nested label paths
+	var gotPatch etre.Entity
+	store := mock.EntityStore{
+		UpdateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			gotPatch = patch
+			diff := []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "config": map[string]interface{}{"port": 80, "debug": true}},
+			}
+			return diff, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	test.Headers = map[string]string{
+		"Content-Type": etre.JSON_PATCH_CONTENT_TYPE,
+	}
+	defer func() { test.Headers = map[string]string{} }()
+
+	ops := []etre.JSONPatchOp{
+		{Op: "replace", Path: "/config/port", Value: 8080},
+		{Op: "remove", Path: "/config/debug"},
+	}
+	payload, err := json.Marshal(ops)
+	require.NoError(t, err)
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	require.Nil(t, gotWR.Error)
+	require.Len(t, gotWR.Writes, 1)
+
+	expectPatch := etre.Entity{
+		"config.port":      8080,
+		entity.PATCH_UNSET: []string{"config.debug"},
+	}
+	assert.Equal(t, expectPatch, gotPatch)
+
+	// Label metrics and auth are the top-level label, not the nested label path
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Write, IntVal: 1},
+		{Method: "Inc", Metric: metrics.UpdateId, IntVal: 1},
+		{Method: "IncLabel", Metric: metrics.LabelUpdate, StringVal: "config"},
+		{Method: "Inc", Metric: metrics.Updated, IntVal: 1},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// Invalid ops and paths are client errors and not written
+	invalid := [][]etre.JSONPatchOp{
+		{},                                        // no ops
+		{{Op: "move", Path: "/config/port"}},      // op not supported
+		{{Op: "add", Path: "config/port"}},        // not a JSON Pointer
+		{{Op: "add", Path: "/config/a.b"}},        // "." in field
+		{{Op: "replace", Path: "/_id", Value: 1}}, // metalabel
+		{
+			{Op: "replace", Path: "/config", Value: "x"},
+			{Op: "remove", Path: "/config/debug"}, // conflicts with /config
+		},
+	}
+	for _, ops := range invalid {
+		gotPatch = nil
+		payload, err := json.Marshal(ops)
+		require.NoError(t, err)
+		gotWR = etre.WriteResult{}
+		statusCode, err := test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, statusCode, "ops: %v", ops)
+		require.NotNil(t, gotWR.Error, "ops: %v", ops)
+		assert.Nil(t, gotPatch, "UpdateEntities called, expected no call due to error")
+	}
+}
+
 func TestPutEntityErrors(t *testing.T) {
 	// Test that PUT /entities/:type/:id returns errors unless all inputs are correct
 	updated := false
@@ -581,6 +865,69 @@ func TestPutEntityErrors(t *testing.T) {
 	assert.Equal(t, expectMetrics, server.metricsrec.Called)
 }
 
+func TestPutEntityIdFormat(t *testing.T) {
+	// Test that :id is validated and made canonical by the id format of the entity
+	// type (config.entity.id), and not parsed as a query: natural-key ids can have
+	// any characters, and UUID ids are lowercase
+	var gotWO entity.WriteOp
+	var gotQuery query.Query
+	store := mock.EntityStore{
+		UpdateEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			gotWO = wo
+			gotQuery = q
+			return []etre.Entity{{"_id": wo.EntityId, "_type": entityType, "_rev": int64(0), "foo": "oldVal"}}, nil
+		},
+	}
+	payload, err := json.Marshal(etre.Entity{"foo": "bar"})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		format string
+		urlId  string // escaped in URL
+		id     string // expected
+	}{
+		{config.ID_FORMAT_UUID, "6F9619FF-8B86-D011-B42D-00C04FC964FF", "6f9619ff-8b86-d011-b42d-00c04fc964ff"},
+		{config.ID_FORMAT_STRING, "us-east%2C%20rack%20%221%22", `us-east, rack "1"`},
+		{config.ID_FORMAT_STRING, testEntityIds[0], testEntityIds[0]}, // string, not an ObjectID
+	}
+	for _, tc := range testCases {
+		cfg := defaultConfig
+		cfg.Entity.Id = map[string]config.IdConfig{
+			entityType: {Strategy: config.ID_STRATEGY_LABEL, Labels: []string{"name"}, Format: tc.format},
+		}
+		server := setup(t, cfg, store)
+
+		gotWO = entity.WriteOp{}
+		gotQuery = query.Query{}
+		var gotWR etre.WriteResult
+		etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + tc.urlId
+		statusCode, err := test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, statusCode, tc.urlId)
+		require.Nil(t, gotWR.Error)
+		assert.Equal(t, tc.id, gotWO.EntityId)
+		assert.Equal(t, query.ById(tc.id), gotQuery)
+		server.ts.Close()
+	}
+
+	// Invalid UUID
+	cfg := defaultConfig
+	cfg.Entity.Id = map[string]config.IdConfig{entityType: {Strategy: config.ID_STRATEGY_UUID}}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	gotWO = entity.WriteOp{}
+	var gotWR etre.WriteResult
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "invalid-param", gotWR.Error.Type)
+	assert.Contains(t, gotWR.Error.Message, "not a valid UUID")
+	assert.Empty(t, gotWO.EntityType, "UpdateEntities called, expected no call due to error")
+}
+
 // //////////////////////////////////////////////////////////////////////////
 // Delete
 // //////////////////////////////////////////////////////////////////////////
@@ -658,11 +1005,111 @@ func TestDeleteEntityOK(t *testing.T) {
 	// -- Auth -----------------------------------------------------------
 	require.Len(t, server.auth.AuthenticateArgs, 1)
 	assert.Equal(t, []mock.AuthorizeArgs{{
-		Action: auth.Action{Op: auth.OP_WRITE, EntityType: entityType},
+		Action: auth.Action{Op: auth.OP_DELETE, EntityType: entityType},
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
 }
 
+func TestRestoreEntity(t *testing.T) {
+	// Test that PUT /entity/:type/:id/restore restores one soft-deleted entity
+	// by calling entity.Store.RestoreEntities() with the id. Restore has no payload.
+	var gotWO entity.WriteOp
+	var gotQuery query.Query
+	store := mock.EntityStore{
+		RestoreEntitiesFunc: func(ctx context.Context, wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+			gotWO = wo
+			gotQuery = q
+			return []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(1), "_deleted": int64(100)},
+			}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0] + "/restore"
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("PUT", etreurl, nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	require.Nil(t, gotWR.Error)
+
+	// Returns the entity before it was restored
+	expectWR := etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: testEntityIds[0],
+				URI:      uri(testEntityIds[0]),
+				Diff: etre.Entity{
+					"_id":      testEntityIds[0],
+					"_type":    entityType,
+					"_rev":     float64(1),
+					"_deleted": float64(100),
+				},
+			},
+		},
+	}
+	assert.Equal(t, expectWR, gotWR)
+
+	expectWO := entity.WriteOp{
+		Caller:     "test", // from mock.AuthRecorder
+		EntityType: entityType,
+		EntityId:   testEntityIds[0],
+	}
+	assert.Equal(t, expectWO, gotWO)
+
+	expectQuery, _ := query.Translate("_id=" + testEntityIds[0])
+	assert.Equal(t, expectQuery, gotQuery)
+
+	// -- Metrics -----------------------------------------------------------
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Write, IntVal: 1},
+		{Method: "Inc", Metric: metrics.UpdateId, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Updated, IntVal: 1},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	fixLatencyMetric(t, 150, expectMetrics, server.metricsrec.Called)
+	assert.Equal(t, expectMetrics, server.metricsrec.Called)
+
+	// -- Auth -----------------------------------------------------------
+	assert.Equal(t, []mock.AuthorizeArgs{{
+		Action: auth.Action{Op: auth.OP_UPDATE, EntityType: entityType},
+		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
+	}}, server.auth.AuthorizeArgs)
+
+	// -- Errors -----------------------------------------------------------
+	// Entity not found (nothing restored) is 404, and the store error when
+	// the entity is not soft-deleted is returned
+	store.RestoreEntitiesFunc = func(ctx context.Context, wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+		return nil, nil
+	}
+	server = setup(t, defaultConfig, store)
+	defer server.ts.Close()
+	etreurl = server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0] + "/restore"
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl, nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "entity-not-found", gotWR.Error.Type)
+
+	store.RestoreEntitiesFunc = func(ctx context.Context, wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+		return nil, entity.ValidationError{Err: fmt.Errorf("not deleted"), Type: "entity-not-deleted"}
+	}
+	server = setup(t, defaultConfig, store)
+	defer server.ts.Close()
+	etreurl = server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0] + "/restore"
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl, nil, &gotWR)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	require.NotNil(t, gotWR.Error)
+	assert.Equal(t, "entity-not-deleted", gotWR.Error.Type)
+}
+
 // //////////////////////////////////////////////////////////////////////////
 // Delete label
 // //////////////////////////////////////////////////////////////////////////
@@ -732,7 +1179,7 @@ func TestDeleteLabel(t *testing.T) {
 	// -- Auth -----------------------------------------------------------
 	require.Len(t, server.auth.AuthenticateArgs, 1)
 	assert.Equal(t, []mock.AuthorizeArgs{{
-		Action: auth.Action{Op: auth.OP_WRITE, EntityType: entityType},
+		Action: auth.Action{Op: auth.OP_UPDATE, EntityType: entityType},
 		Caller: auth.Caller{Name: "test", MetricGroups: []string{"test"}},
 	}}, server.auth.AuthorizeArgs)
 }
@@ -807,5 +1254,8 @@ func TestDeleteLabelError(t *testing.T) {
 		HTTPStatus: http.StatusInternalServerError,
 	}
 	assert.Equal(t, expectWrite, gotWR.Writes[0])
+	require.NotNil(t, gotWR.Error)
+	assert.NotEmpty(t, gotWR.Error.RequestId) // server-generated
+	expectedError.RequestId = gotWR.Error.RequestId
 	assert.Equal(t, expectedError, gotWR.Error)
 }
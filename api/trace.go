@@ -0,0 +1,52 @@
+// Copyright 2026, Square, Inc.
+
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/square/etre/auth"
+)
+
+// tracer uses the OpenTelemetry global tracer provider, which is a no-op unless
+// the program that runs Etre sets one with otel.SetTracerProvider. Every entity
+// request has a span (see wrapRequest) with child spans for authenticate, authorize,
+// query translation, and entity.Store calls (see entity.NewTracedStore).
+var tracer = otel.Tracer("github.com/square/etre/api")
+
+// authenticate calls auth.Manager.Authenticate in a child span of the request span.
+func (api *API) authenticate(ctx context.Context, r *http.Request) (auth.Caller, error) {
+	_, span := tracer.Start(ctx, "authenticate")
+	defer span.End()
+	caller, err := api.auth.Authenticate(r)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return caller, err
+}
+
+// authorize calls auth.Manager.Authorize in a child span of the request span.
+func (api *API) authorize(ctx context.Context, caller auth.Caller, action auth.Action) error {
+	_, span := tracer.Start(ctx, "authorize", trace.WithAttributes(attribute.String("etre.op", action.Op)))
+	defer span.End()
+	err := api.auth.Authorize(caller, action)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// spanError records the error on the request span, if the request has one.
+func spanError(rc *req, err error) {
+	if rc.span == nil {
+		return
+	}
+	rc.span.RecordError(err)
+	rc.span.SetStatus(codes.Error, err.Error())
+}
@@ -6,6 +6,7 @@ package app
 import (
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 
 	"github.com/square/etre/auth"
@@ -34,6 +35,17 @@ type Context struct {
 	SystemMetrics   metrics.Metrics
 	Auth            auth.Manager
 
+	// Health is the database connection state set by the server. If nil, the
+	// API reports that it's healthy, which is the case when it's run by a hook.
+	Health *Health
+
+	// Logger is the structured logger for components that log with attributes
+	// (like entity_type, op, caller, and duration) instead of formatted strings.
+	// The default is slog.Default, which writes through the standard log package
+	// like the rest of Etre. Set a logger with a JSON handler, for example, for
+	// log aggregation. If nil, the server uses slog.Default.
+	Logger *slog.Logger
+
 	// 3rd-party extensions, all optional
 	Hooks   Hooks
 	Plugins Plugins
@@ -58,6 +70,11 @@ type Hooks struct {
 	// Etre is shutting down, and it should cause RunAPI to return.
 	// If you provide this hook, you need to provide RunAPI as well.
 	StopAPI func() error
+
+	// AuditAuth is called after every authorization decision with the caller,
+	// the action, and the decision error (nil if allowed). Use it to emit audit
+	// events. It is called synchronously on every request, so it should not block.
+	AuditAuth func(auth.Caller, auth.Action, error)
 }
 
 // Plugins allow users to provide custom components. All plugins are optional;
@@ -69,6 +86,10 @@ type Hooks struct {
 type Plugins struct {
 	Auth auth.Plugin
 	DB   db.Plugin
+
+	// AuthChain is a list of auth plugins tried in order until one authenticates
+	// the caller. If set, it is used instead of Auth.
+	AuthChain []auth.Plugin
 }
 
 // Defaults returns a Context with default (built-in) hooks and plugins.
@@ -79,6 +100,7 @@ type Plugins struct {
 // package) which loads the configs and creates the core service singleton.
 func Defaults() Context {
 	return Context{
+		Logger: slog.Default(),
 		Hooks: Hooks{
 			LoadConfig: LoadConfig,
 		},
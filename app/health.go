@@ -0,0 +1,62 @@
+// Copyright 2026, Square, Inc.
+
+package app
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Health is the database connection state of the server. The server sets it
+// when it connects to (or loses) the main and CDC databases, and the API reports
+// it in GET /health. It is safe for use by multiple goroutines. The zero value
+// is not connected.
+type Health struct {
+	mainDb atomic.Bool
+	cdcDb  atomic.Bool
+
+	// Entity type datasources (config.entity.datasource) that use their own
+	// client, keyed on name (usually URL). They are part of the main database.
+	entityDbMux sync.Mutex
+	entityDb    map[string]bool
+}
+
+func (h *Health) SetMainDb(connected bool) {
+	h.mainDb.Store(connected)
+}
+
+func (h *Health) SetCDCDb(connected bool) {
+	h.cdcDb.Store(connected)
+}
+
+// SetEntityDb sets the connection state of an entity type datasource. Once set,
+// MainDb is false unless the datasource is connected.
+func (h *Health) SetEntityDb(name string, connected bool) {
+	h.entityDbMux.Lock()
+	defer h.entityDbMux.Unlock()
+	if h.entityDb == nil {
+		h.entityDb = map[string]bool{}
+	}
+	h.entityDb[name] = connected
+}
+
+// MainDb returns true if the server is connected to the main database and all
+// entity type datasources.
+func (h *Health) MainDb() bool {
+	if !h.mainDb.Load() {
+		return false
+	}
+	h.entityDbMux.Lock()
+	defer h.entityDbMux.Unlock()
+	for _, connected := range h.entityDb {
+		if !connected {
+			return false
+		}
+	}
+	return true
+}
+
+// CDCDb returns true if the server is connected to the CDC database.
+func (h *Health) CDCDb() bool {
+	return h.cdcDb.Load()
+}
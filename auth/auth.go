@@ -27,11 +27,52 @@ type ACL struct {
 	// Write entity types granted to the role. Does not apply to admin roles.
 	Write []string
 
+	// Insert, Update, and Delete entity types granted to the role. These are
+	// finer-grained write permissions. If nil, Write is used instead, so existing
+	// ACLs with only Write allow all three ops. Does not apply to admin roles.
+	Insert []string
+	Update []string
+	Delete []string
+
+	// DenyLabels and AllowLabels restrict the labels the role can read and write,
+	// keyed on entity type. A denied label cannot be written, and it is removed
+	// from entities returned to the caller. If AllowLabels is set for an entity
+	// type, all other labels are denied. Meta-labels (like _id) are never denied.
+	// Does not apply to admin roles.
+	DenyLabels  map[string][]string
+	AllowLabels map[string][]string
+
 	// Role grants access to CDC events for all entity types.
 	CDC bool
 
 	// Trace keys required to be set. Applies to admin roles.
 	TraceKeysRequired []string
+
+	// Regex patterns that trace values must match, keyed on trace key. A pattern
+	// must match the entire value. It is checked only if the key is set; list the
+	// key in TraceKeysRequired to require it, too. Applies to admin roles.
+	TraceKeyPatterns map[string]string
+
+	// Deny denies ops on entity types even if this or another caller role
+	// allows them. Deny always wins, and it applies to admin roles, too.
+	Deny Deny
+
+	// Other roles whose permissions this role includes, recursively. Use
+	// ValidateInherits to check them. The Manager checks each inherited role
+	// separately, so a role's label restrictions apply only to the ops it allows.
+	// Trace keys required by inherited roles are not inherited.
+	Inherits []string
+}
+
+// Deny lists the entity types for which ops are denied. Write denies all write
+// ops (insert, update, and delete); Insert, Update, and Delete deny only that op.
+type Deny struct {
+	Read   []string
+	Write  []string
+	Insert []string
+	Update []string
+	Delete []string
+	CDC    bool
 }
 
 // Caller represents a client making a request. The Authentication method of the
@@ -41,6 +82,8 @@ type Caller struct {
 	Roles        []string          // caller roles to match against ACL roles
 	MetricGroups []string          // metric groups to add metric values to
 	Trace        map[string]string // key-value pairs to report in trace metrics
+
+	plugin int // index of Manager plugin that authenticated the caller
 }
 
 // Action is what a Caller is trying to do. The Authorize method of the auth plugin
@@ -48,14 +91,34 @@ type Caller struct {
 type Action struct {
 	EntityType string
 	Op         string
+	Labels     []string // labels read or written, if known
 }
 
 const (
-	OP_READ  = "r"
-	OP_WRITE = "w"
-	OP_CDC   = "c"
+	OP_READ   = "r"
+	OP_WRITE  = "w"
+	OP_INSERT = "i"
+	OP_UPDATE = "u"
+	OP_DELETE = "d"
+	OP_CDC    = "c"
+
+	// OP_ADMIN is an admin-only write, like a bulk label delete. Only roles
+	// with ACL.Admin are allowed.
+	OP_ADMIN = "a"
 )
 
+// IsWrite returns true if the action op is OP_WRITE or one of the finer-grained
+// write ops: OP_INSERT, OP_UPDATE, OP_DELETE, or OP_ADMIN. The API authorizes
+// writes with the finer-grained ops, so plugins that only distinguish reads from
+// writes should use this instead of comparing Op to OP_WRITE.
+func (a Action) IsWrite() bool {
+	switch a.Op {
+	case OP_WRITE, OP_INSERT, OP_UPDATE, OP_DELETE, OP_ADMIN:
+		return true
+	}
+	return false
+}
+
 // Plugin is the auth plugin. Implement this interface to enable custom auth.
 type Plugin interface {
 	// Authenticate determines the Caller from the HTTP request. To allow, return
@@ -65,6 +128,8 @@ type Plugin interface {
 
 	// Authorize authorizes the caller to do the action. To allow, return nil.
 	// To deny, return an error and Etre will return HTTP status 403 (Forbidden).
+	// Writes are authorized as OP_INSERT, OP_UPDATE, OP_DELETE, or OP_ADMIN, never
+	// OP_WRITE, so use Action.IsWrite to match all writes.
 	Authorize(Caller, Action) error
 }
 
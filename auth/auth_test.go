@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"github.com/stretchr/testify/assert"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/square/etre"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/metrics"
 	"github.com/square/etre/test/mock"
 )
 
@@ -159,6 +161,493 @@ func TestManager(t *testing.T) {
 	caller.Roles = []string{"foo"}
 	err = man.Authorize(caller, auth.Action{Op: auth.OP_CDC})
 	require.Error(t, err)
+
+	// Admin authorization
+	// ---------------------------------------------------------------------------
+
+	// Only admin role finch can do admin writes, even to entities bar can write
+	caller.Roles = []string{"finch"}
+	err = man.Authorize(caller, auth.Action{EntityType: "bar", Op: auth.OP_ADMIN})
+	require.NoError(t, err)
+
+	caller.Roles = []string{"bar"}
+	err = man.Authorize(caller, auth.Action{EntityType: "bar", Op: auth.OP_ADMIN})
+	require.Error(t, err)
+}
+
+func TestManagerWriteOps(t *testing.T) {
+	acls := []auth.ACL{
+		{
+			// Can insert and update foo, but not delete foo
+			Role:   "foo",
+			Write:  []string{"foo"},
+			Delete: []string{},
+		},
+		{
+			// Only Write, so all write ops fall back to it
+			Role:  "bar",
+			Write: []string{"bar"},
+		},
+		{
+			Role:   "baz",
+			Insert: []string{"baz"},
+		},
+	}
+	man := auth.NewManager(acls, auth.NewAllowAll())
+
+	caller := auth.Caller{Name: "test", Roles: []string{"foo"}}
+	err := man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_INSERT})
+	require.NoError(t, err)
+	err = man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_UPDATE})
+	require.NoError(t, err)
+	err = man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_DELETE})
+	require.Error(t, err)
+
+	caller.Roles = []string{"bar"}
+	for _, op := range []string{auth.OP_WRITE, auth.OP_INSERT, auth.OP_UPDATE, auth.OP_DELETE} {
+		err = man.Authorize(caller, auth.Action{EntityType: "bar", Op: op})
+		require.NoError(t, err, "op %s", op)
+		err = man.Authorize(caller, auth.Action{EntityType: "foo", Op: op})
+		require.Error(t, err, "op %s", op)
+	}
+
+	// baz can only insert baz: Update and Delete fall back to Write, which is empty
+	caller.Roles = []string{"baz"}
+	err = man.Authorize(caller, auth.Action{EntityType: "baz", Op: auth.OP_INSERT})
+	require.NoError(t, err)
+	err = man.Authorize(caller, auth.Action{EntityType: "baz", Op: auth.OP_UPDATE})
+	require.Error(t, err)
+	err = man.Authorize(caller, auth.Action{EntityType: "baz", Op: auth.OP_DELETE})
+	require.Error(t, err)
+
+	// Roles are checked until one allows the op
+	caller.Roles = []string{"foo", "bar"}
+	err = man.Authorize(caller, auth.Action{EntityType: "bar", Op: auth.OP_DELETE})
+	require.NoError(t, err)
+
+	assert.True(t, auth.Action{Op: auth.OP_DELETE}.IsWrite())
+	assert.False(t, auth.Action{Op: auth.OP_READ}.IsWrite())
+}
+
+func TestManagerLabels(t *testing.T) {
+	acls := []auth.ACL{
+		{
+			Role:       "foo",
+			Read:       []string{"foo"},
+			Write:      []string{"foo"},
+			DenyLabels: map[string][]string{"foo": {"secret"}},
+		},
+		{
+			Role:        "bar",
+			Read:        []string{"foo"},
+			Write:       []string{"foo"},
+			AllowLabels: map[string][]string{"foo": {"a", "b"}},
+		},
+		{
+			Role:  "admin",
+			Admin: true,
+		},
+	}
+	man := auth.NewManager(acls, auth.NewAllowAll())
+
+	// Allowed labels
+	caller := auth.Caller{Name: "test", Roles: []string{"foo"}}
+	err := man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_UPDATE, Labels: []string{"a", "_id"}})
+	require.NoError(t, err)
+
+	// Denied label
+	err = man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_UPDATE, Labels: []string{"a", "secret"}})
+	require.Error(t, err)
+	err = man.AuthorizeLabels(caller, auth.Action{EntityType: "foo", Op: auth.OP_INSERT, Labels: []string{"secret"}})
+	require.Error(t, err)
+
+	// Only allowed labels; meta-labels are always allowed
+	caller.Roles = []string{"bar"}
+	err = man.AuthorizeLabels(caller, auth.Action{EntityType: "foo", Op: auth.OP_INSERT, Labels: []string{"a", "b", "_type"}})
+	require.NoError(t, err)
+	err = man.AuthorizeLabels(caller, auth.Action{EntityType: "foo", Op: auth.OP_INSERT, Labels: []string{"a", "c"}})
+	require.Error(t, err)
+
+	// Readable labels
+	readable := man.ReadableLabels(caller, "foo")
+	require.NotNil(t, readable)
+	assert.True(t, readable("a"))
+	assert.True(t, readable("_id"))
+	assert.False(t, readable("secret"))
+	assert.False(t, readable("c"))
+
+	// Roles are combined: a label is readable if any role allows it
+	caller.Roles = []string{"foo", "bar"}
+	readable = man.ReadableLabels(caller, "foo")
+	require.NotNil(t, readable)
+	assert.True(t, readable("c"))
+	assert.False(t, readable("secret"))
+	err = man.AuthorizeLabels(caller, auth.Action{EntityType: "foo", Op: auth.OP_UPDATE, Labels: []string{"c"}})
+	require.NoError(t, err)
+
+	// No label rules for the entity type, or admin: all labels readable
+	readable = man.ReadableLabels(caller, "other")
+	assert.Nil(t, readable)
+	caller.Roles = []string{"foo", "admin"}
+	readable = man.ReadableLabels(caller, "foo")
+	assert.Nil(t, readable)
+	err = man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_UPDATE, Labels: []string{"secret"}})
+	require.NoError(t, err)
+}
+
+func TestManagerDeny(t *testing.T) {
+	acls := []auth.ACL{
+		{
+			Role:  "writer",
+			Read:  []string{"foo"},
+			Write: []string{"foo", "bar"},
+		},
+		{
+			Role: "no-delete",
+			Deny: auth.Deny{Delete: []string{"foo"}},
+		},
+		{
+			Role:  "admin",
+			Admin: true,
+			Deny:  auth.Deny{Write: []string{"bar"}, CDC: true},
+		},
+	}
+	man := auth.NewManager(acls, auth.NewAllowAll())
+
+	// writer alone can delete foo
+	caller := auth.Caller{Name: "test", Roles: []string{"writer"}}
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_DELETE}))
+
+	// But with a denying role, deny wins over allow
+	caller.Roles = []string{"writer", "no-delete"}
+	require.Error(t, man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_DELETE}))
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_UPDATE}))
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "bar", Op: auth.OP_DELETE}))
+
+	// Order of roles doesn't matter
+	caller.Roles = []string{"no-delete", "writer"}
+	require.Error(t, man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_DELETE}))
+
+	// Deny applies to admin roles, too. Deny.Write denies all write ops.
+	caller.Roles = []string{"admin"}
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "bar", Op: auth.OP_READ}))
+	for _, op := range []string{auth.OP_WRITE, auth.OP_INSERT, auth.OP_UPDATE, auth.OP_DELETE} {
+		require.Error(t, man.Authorize(caller, auth.Action{EntityType: "bar", Op: op}), "op %s", op)
+	}
+	require.Error(t, man.Authorize(caller, auth.Action{Op: auth.OP_CDC}))
+}
+
+func TestInherits(t *testing.T) {
+	// Two-level chain: admin inherits ops, ops inherits reader
+	acls := []auth.ACL{
+		{
+			Role:     "admin",
+			Write:    []string{"bar"},
+			Delete:   []string{"bar"},
+			Inherits: []string{"ops"},
+		},
+		{
+			Role:     "ops",
+			Write:    []string{"foo"},
+			Delete:   []string{},
+			Inherits: []string{"reader"},
+		},
+		{
+			Role: "reader",
+			Read: []string{"foo", "bar"},
+			CDC:  true,
+		},
+	}
+	require.NoError(t, auth.ValidateInherits(acls))
+
+	// Caller with role admin has the union of inherited permissions
+	man := auth.NewManager(acls, auth.NewAllowAll())
+	caller := auth.Caller{Name: "test", Roles: []string{"admin"}}
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_READ}))
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_UPDATE}))
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "bar", Op: auth.OP_DELETE}))
+	require.NoError(t, man.Authorize(caller, auth.Action{Op: auth.OP_CDC}))
+	require.Error(t, man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_DELETE})) // ops cannot delete
+
+	// Deny in an inherited role wins
+	acls[2].Deny = auth.Deny{Read: []string{"bar"}}
+	man = auth.NewManager(acls, auth.NewAllowAll())
+	require.Error(t, man.Authorize(caller, auth.Action{EntityType: "bar", Op: auth.OP_READ}))
+
+	// Cycle
+	err := auth.ValidateInherits([]auth.ACL{
+		{Role: "a", Inherits: []string{"b"}},
+		{Role: "b", Inherits: []string{"c"}},
+		{Role: "c", Inherits: []string{"a"}},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "a -> b -> c -> a")
+
+	// Unknown role
+	err = auth.ValidateInherits([]auth.ACL{
+		{Role: "a", Inherits: []string{"x"}},
+	})
+	require.Error(t, err)
+}
+
+func TestInheritsLabels(t *testing.T) {
+	// Inheriting a role with label restrictions does not restrict the child:
+	// each role is checked separately, and a label is allowed if any role allows it
+	acls := []auth.ACL{
+		{
+			Role:     "child",
+			Read:     []string{"nodes"},
+			Inherits: []string{"parent"},
+		},
+		{
+			Role:        "parent",
+			Read:        []string{"nodes", "racks"},
+			AllowLabels: map[string][]string{"nodes": {"a"}, "racks": {"a"}},
+		},
+	}
+	man := auth.NewManager(acls, auth.NewAllowAll())
+	caller := auth.Caller{Name: "test", Roles: []string{"child"}}
+
+	// Child can read label b of nodes, which parent AllowLabels do not include,
+	// and AuthorizeLabels (used by the API after reading the request) agrees
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "nodes", Op: auth.OP_READ, Labels: []string{"a", "b"}}))
+	require.NoError(t, man.AuthorizeLabels(caller, auth.Action{EntityType: "nodes", Op: auth.OP_READ, Labels: []string{"b"}}))
+	assert.Nil(t, man.ReadableLabels(caller, "nodes"))
+
+	// Racks are readable only by the inherited parent role, so its restrictions apply
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "racks", Op: auth.OP_READ}))
+	require.Error(t, man.Authorize(caller, auth.Action{EntityType: "racks", Op: auth.OP_READ, Labels: []string{"b"}}))
+	require.Error(t, man.AuthorizeLabels(caller, auth.Action{EntityType: "racks", Op: auth.OP_READ, Labels: []string{"b"}}))
+	readable := man.ReadableLabels(caller, "racks")
+	require.NotNil(t, readable)
+	assert.True(t, readable("a"))
+	assert.False(t, readable("b"))
+
+	// Reverse: child restricted, inherited parent not, so parent allows the label
+	acls = []auth.ACL{
+		{
+			Role:       "child",
+			Read:       []string{"nodes"},
+			DenyLabels: map[string][]string{"nodes": {"b"}},
+			Inherits:   []string{"parent"},
+		},
+		{
+			Role: "parent",
+			Read: []string{"nodes"},
+		},
+	}
+	man = auth.NewManager(acls, auth.NewAllowAll())
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "nodes", Op: auth.OP_READ, Labels: []string{"b"}}))
+	require.NoError(t, man.AuthorizeLabels(caller, auth.Action{EntityType: "nodes", Op: auth.OP_READ, Labels: []string{"b"}}))
+	assert.Nil(t, man.ReadableLabels(caller, "nodes"))
+}
+
+func TestManagerTraceKeyPatterns(t *testing.T) {
+	acls := []auth.ACL{
+		{
+			Role:              "foo",
+			Read:              []string{"foo"},
+			TraceKeysRequired: []string{"app"},
+			TraceKeyPatterns: map[string]string{
+				"app":  "[a-z]+-(prod|staging)",
+				"host": `\w+\.local`,
+			},
+		},
+		{
+			Role:              "bar",
+			Read:              []string{"bar"},
+			TraceKeysRequired: []string{"app"},
+		},
+	}
+	require.NoError(t, auth.CompileTracePatterns(acls))
+
+	var caller auth.Caller
+	plugin := &mock.AuthRecorder{
+		AuthenticateFunc: func(req *http.Request) (auth.Caller, error) {
+			return caller, nil
+		},
+	}
+	man := auth.NewManager(acls, plugin)
+
+	// Present and matching
+	caller = auth.Caller{Roles: []string{"foo"}, Trace: map[string]string{"app": "etre-prod"}}
+	_, err := man.Authenticate(&http.Request{})
+	require.NoError(t, err)
+
+	// Present but not matching; pattern must match the entire value
+	for _, app := range []string{"etre", "ETRE-prod", "etre-prod-2"} {
+		caller = auth.Caller{Roles: []string{"foo"}, Trace: map[string]string{"app": app}}
+		_, err = man.Authenticate(&http.Request{})
+		require.Error(t, err, app)
+		assert.Contains(t, err.Error(), "trace key app")
+	}
+
+	// Optional key host is checked only when set
+	caller = auth.Caller{Roles: []string{"foo"}, Trace: map[string]string{"app": "etre-prod", "host": "db1.local"}}
+	_, err = man.Authenticate(&http.Request{})
+	require.NoError(t, err)
+	caller.Trace["host"] = "db1.example.com"
+	_, err = man.Authenticate(&http.Request{})
+	require.Error(t, err)
+
+	// No pattern: presence-only
+	caller = auth.Caller{Roles: []string{"bar"}, Trace: map[string]string{"app": "anything"}}
+	_, err = man.Authenticate(&http.Request{})
+	require.NoError(t, err)
+
+	// Invalid pattern
+	acls = []auth.ACL{{Role: "foo", TraceKeyPatterns: map[string]string{"app": "("}}}
+	require.Error(t, auth.CompileTracePatterns(acls))
+	man = auth.NewManager(acls, plugin)
+	caller = auth.Caller{Roles: []string{"foo"}, Trace: map[string]string{"app": "etre"}}
+	_, err = man.Authenticate(&http.Request{})
+	require.Error(t, err)
+}
+
+func TestManagerAudit(t *testing.T) {
+	type record struct {
+		caller auth.Caller
+		action auth.Action
+		err    error
+	}
+	var records []record
+	audit := func(caller auth.Caller, action auth.Action, err error) {
+		records = append(records, record{caller, action, err})
+	}
+	acls := []auth.ACL{
+		{
+			Role:  "foo",
+			Read:  []string{"foo"},
+			Write: []string{"foo"},
+		},
+	}
+	man := auth.NewManager(acls, auth.NewAllowAll()).WithAuditFunc(audit)
+
+	caller := auth.Caller{Name: "test", Roles: []string{"foo"}}
+	allowed := auth.Action{EntityType: "foo", Op: auth.OP_READ}
+	denied := auth.Action{EntityType: "bar", Op: auth.OP_READ}
+	labels := auth.Action{EntityType: "foo", Op: auth.OP_UPDATE, Labels: []string{"a"}}
+
+	require.NoError(t, man.Authorize(caller, allowed))
+	require.Error(t, man.Authorize(caller, denied))
+	require.NoError(t, man.AuthorizeLabels(caller, labels))
+
+	require.Len(t, records, 3)
+	assert.Equal(t, record{caller, allowed, nil}, records[0])
+	assert.Equal(t, caller, records[1].caller)
+	assert.Equal(t, denied, records[1].action)
+	assert.Error(t, records[1].err)
+	assert.Equal(t, record{caller, labels, nil}, records[2])
+
+	// Plugin errors are audited, too
+	plugin := &mock.AuthRecorder{
+		AuthorizeFunc: func(caller auth.Caller, action auth.Action) error {
+			return fmt.Errorf("forced test error")
+		},
+	}
+	records = nil
+	man = auth.NewManager(acls, plugin).WithAuditFunc(audit)
+	require.Error(t, man.Authorize(caller, allowed))
+	require.Len(t, records, 1)
+	assert.Error(t, records[0].err)
+
+	// Nil audit func is a no-op
+	man = auth.NewManager(acls, auth.NewAllowAll()).WithAuditFunc(nil)
+	require.NoError(t, man.Authorize(caller, allowed))
+	require.Error(t, man.Authorize(caller, denied))
+}
+
+func TestManagerPluginChain(t *testing.T) {
+	// First plugin authenticates services with tokens, second authenticates
+	// users with JWTs. Each plugin authorizes only the callers it authenticated.
+	var tokenAuthorized, jwtAuthorized int
+	tokenPlugin := &mock.AuthRecorder{
+		AuthenticateFunc: func(req *http.Request) (auth.Caller, error) {
+			if req.Header.Get("X-Token") == "" {
+				return auth.Caller{}, fmt.Errorf("no token")
+			}
+			return auth.Caller{Name: "service", Roles: []string{"foo"}}, nil
+		},
+		AuthorizeFunc: func(caller auth.Caller, action auth.Action) error {
+			tokenAuthorized++
+			return nil
+		},
+	}
+	jwtPlugin := &mock.AuthRecorder{
+		AuthenticateFunc: func(req *http.Request) (auth.Caller, error) {
+			if req.Header.Get("Authorization") == "" {
+				return auth.Caller{}, fmt.Errorf("no JWT")
+			}
+			return auth.Caller{Name: "user", Roles: []string{"foo"}}, nil
+		},
+		AuthorizeFunc: func(caller auth.Caller, action auth.Action) error {
+			jwtAuthorized++
+			return nil
+		},
+	}
+	acls := []auth.ACL{{Role: "foo", Read: []string{"foo"}}}
+	man := auth.NewManager(acls, tokenPlugin, jwtPlugin)
+	action := auth.Action{EntityType: "foo", Op: auth.OP_READ}
+
+	// First fails, second succeeds
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("Authorization", "Bearer jwt")
+	caller, err := man.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, "user", caller.Name)
+	require.NoError(t, man.Authorize(caller, action))
+	assert.Equal(t, 0, tokenAuthorized)
+	assert.Equal(t, 1, jwtAuthorized)
+
+	// First succeeds, second not tried
+	req, _ = http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("X-Token", "secret")
+	req.Header.Set("Authorization", "Bearer jwt")
+	caller, err = man.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, "service", caller.Name)
+	require.NoError(t, man.Authorize(caller, action))
+	assert.Equal(t, 1, tokenAuthorized)
+	assert.Equal(t, 1, jwtAuthorized)
+	assert.Len(t, jwtPlugin.AuthenticateArgs, 1)
+
+	// All fail: errors are aggregated
+	req, _ = http.NewRequest("GET", "http://example.com", nil)
+	_, err = man.Authenticate(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no token")
+	assert.Contains(t, err.Error(), "no JWT")
+}
+
+func TestManagerMetrics(t *testing.T) {
+	var authErr error
+	plugin := &mock.AuthRecorder{
+		AuthenticateFunc: func(req *http.Request) (auth.Caller, error) {
+			return auth.Caller{Name: "test", Roles: []string{"foo"}}, authErr
+		},
+	}
+	acls := []auth.ACL{{Role: "foo", Read: []string{"foo"}}}
+	m := mock.NewMetricsRecorder()
+	man := auth.NewManager(acls, plugin).WithMetrics(m)
+
+	caller, err := man.Authenticate(&http.Request{})
+	require.NoError(t, err)
+	authErr = fmt.Errorf("forced test error")
+	_, err = man.Authenticate(&http.Request{})
+	require.Error(t, err)
+
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_READ}))
+	require.Error(t, man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_UPDATE}))
+	require.Error(t, man.Authorize(caller, auth.Action{EntityType: "bar", Op: auth.OP_READ}))
+
+	expect := []mock.MetricMethodArgs{
+		{Method: "Inc", Metric: metrics.AuthenticateOK, IntVal: 1},
+		{Method: "Inc", Metric: metrics.AuthenticateError, IntVal: 1},
+		{Method: "Inc", Metric: metrics.AuthorizeOK, IntVal: 1},
+		{Method: "Inc", Metric: metrics.AuthorizeDenied, IntVal: 1},
+		{Method: "Inc", Metric: metrics.AuthorizeDenied, IntVal: 1},
+	}
+	assert.Equal(t, expect, m.Called)
 }
 
 func TestManagerNoACLs(t *testing.T) {
@@ -274,3 +763,137 @@ func TestTraceHeader(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, expectCaller, gotCaller)
 }
+
+func TestCachingAuthenticator(t *testing.T) {
+	calls := 0
+	var authErr error
+	plugin := &mock.AuthRecorder{
+		AuthenticateFunc: func(req *http.Request) (auth.Caller, error) {
+			calls++
+			if authErr != nil {
+				return auth.Caller{}, authErr
+			}
+			return auth.Caller{Name: req.Header.Get("Authorization"), Roles: []string{"foo"}}, nil
+		},
+	}
+	now := time.Unix(1000, 0)
+	c := auth.NewCachingAuthenticator(plugin, auth.CacheConfig{
+		TTL:         10 * time.Second,
+		NegativeTTL: 2 * time.Second,
+		MaxSize:     2,
+		Now:         func() time.Time { return now },
+	})
+
+	req := func(token string) *http.Request {
+		r, _ := http.NewRequest("GET", "http://example.com", nil)
+		if token != "" {
+			r.Header.Set("Authorization", token)
+		}
+		return r
+	}
+
+	// Miss then hit
+	caller, err := c.Authenticate(req("a"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", caller.Name)
+	assert.Equal(t, 1, calls)
+
+	caller, err = c.Authenticate(req("a"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", caller.Name)
+	assert.Equal(t, 1, calls)
+
+	// Changing the returned caller doesn't change the cached caller
+	caller.Roles[0] = "changed"
+	caller, err = c.Authenticate(req("a"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, caller.Roles)
+	assert.Equal(t, 1, calls)
+
+	// Different key is a miss
+	caller, err = c.Authenticate(req("b"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", caller.Name)
+	assert.Equal(t, 2, calls)
+
+	// No key is never cached
+	c.Authenticate(req(""))
+	c.Authenticate(req(""))
+	assert.Equal(t, 4, calls)
+
+	// TTL expiry
+	now = now.Add(9 * time.Second)
+	c.Authenticate(req("a"))
+	assert.Equal(t, 4, calls)
+	now = now.Add(1 * time.Second)
+	c.Authenticate(req("a"))
+	assert.Equal(t, 5, calls)
+
+	// Negative caching uses the shorter TTL
+	authErr = fmt.Errorf("forced test error")
+	_, err = c.Authenticate(req("c"))
+	require.Error(t, err)
+	assert.Equal(t, 6, calls)
+	authErr = nil
+	_, err = c.Authenticate(req("c"))
+	require.Error(t, err)
+	assert.Equal(t, 6, calls)
+	now = now.Add(2 * time.Second)
+	_, err = c.Authenticate(req("c"))
+	require.NoError(t, err)
+	assert.Equal(t, 7, calls)
+
+	// Bounded size: c and a are cached (most recent), so b was evicted
+	c.Authenticate(req("b"))
+	assert.Equal(t, 8, calls)
+}
+
+func TestStaticAuth(t *testing.T) {
+	static := auth.NewStaticAuth(map[string]auth.Caller{
+		"abc123": {Name: "deploy", Roles: []string{"ops"}, MetricGroups: []string{"deploy"}},
+		"def456": {Name: "dashboard", Roles: []string{"ro"}},
+	})
+
+	req := func(header string) *http.Request {
+		r, _ := http.NewRequest("GET", "http://example.com", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		return r
+	}
+
+	// Valid tokens
+	caller, err := static.Authenticate(req("Bearer abc123"))
+	require.NoError(t, err)
+	assert.Equal(t, auth.Caller{Name: "deploy", Roles: []string{"ops"}, MetricGroups: []string{"deploy"}}, caller)
+
+	caller, err = static.Authenticate(req("Bearer def456"))
+	require.NoError(t, err)
+	assert.Equal(t, auth.Caller{Name: "dashboard", Roles: []string{"ro"}, MetricGroups: []string{auth.DefaultMetricGroup}}, caller)
+
+	// Unknown token
+	_, err = static.Authenticate(req("Bearer nope"))
+	require.Error(t, err)
+
+	// Missing header, or not a bearer token
+	_, err = static.Authenticate(req(""))
+	require.Error(t, err)
+	_, err = static.Authenticate(req("Basic abc123"))
+	require.Error(t, err)
+	_, err = static.Authenticate(req("Bearer "))
+	require.Error(t, err)
+
+	// Drops into Manager with ACLs, and trace values set per request
+	// don't change the static caller
+	man := auth.NewManager([]auth.ACL{{Role: "ops", Write: []string{"foo"}}}, static)
+	r := req("Bearer abc123")
+	r.Header.Set(etre.TRACE_HEADER, "app=foo")
+	caller, err = man.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app": "foo"}, caller.Trace)
+	require.NoError(t, man.Authorize(caller, auth.Action{EntityType: "foo", Op: auth.OP_INSERT}))
+
+	caller, err = man.Authenticate(req("Bearer abc123"))
+	require.NoError(t, err)
+	assert.Nil(t, caller.Trace)
+}
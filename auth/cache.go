@@ -0,0 +1,142 @@
+// Copyright 2026, Square, Inc.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+)
+
+const (
+	DEFAULT_CACHE_TTL          = 1 * time.Minute
+	DEFAULT_CACHE_NEGATIVE_TTL = 5 * time.Second
+	DEFAULT_CACHE_MAX_SIZE     = 10000
+)
+
+// CacheConfig configures a CachingAuthenticator. Zero values use the defaults.
+type CacheConfig struct {
+	// TTL is how long an authenticated Caller is cached.
+	TTL time.Duration
+
+	// NegativeTTL is how long an Authenticate error is cached. It should be
+	// shorter than TTL so that callers recover quickly from transient failures.
+	NegativeTTL time.Duration
+
+	// MaxSize is the maximum number of cached callers. When full, the least
+	// recently used caller is evicted.
+	MaxSize int
+
+	// Key returns the cache key for the request. The default key is the value
+	// of the Authorization header. If the key is empty, the request is not cached.
+	// Keys are hashed, so secret values like tokens are not kept in memory.
+	Key func(*http.Request) string
+
+	// Now returns the current time. The default is time.Now. Tests use a fake clock.
+	Now func() time.Time
+}
+
+// CachingAuthenticator is a Plugin that caches the Caller returned by the
+// Authenticate method of another Plugin. Use it when Authenticate is slow,
+// for example when it makes a network call to introspect a token. Authorize
+// is not cached; it calls the other Plugin directly.
+type CachingAuthenticator struct {
+	plugin Plugin
+	cfg    CacheConfig
+	mux    *sync.Mutex
+	cache  *lru.Cache
+}
+
+var _ Plugin = &CachingAuthenticator{}
+
+type cachedCaller struct {
+	caller  Caller
+	err     error
+	expires time.Time
+}
+
+func NewCachingAuthenticator(plugin Plugin, cfg CacheConfig) *CachingAuthenticator {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DEFAULT_CACHE_TTL
+	}
+	if cfg.NegativeTTL <= 0 {
+		cfg.NegativeTTL = DEFAULT_CACHE_NEGATIVE_TTL
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = DEFAULT_CACHE_MAX_SIZE
+	}
+	if cfg.Key == nil {
+		cfg.Key = func(req *http.Request) string {
+			return req.Header.Get("Authorization")
+		}
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	return &CachingAuthenticator{
+		plugin: plugin,
+		cfg:    cfg,
+		mux:    &sync.Mutex{},
+		cache:  lru.New(cfg.MaxSize),
+	}
+}
+
+func (c *CachingAuthenticator) Authenticate(req *http.Request) (Caller, error) {
+	key := c.cfg.Key(req)
+	if key == "" {
+		return c.plugin.Authenticate(req)
+	}
+	hash := sha256.Sum256([]byte(key))
+
+	c.mux.Lock()
+	if v, ok := c.cache.Get(hash); ok {
+		cc := v.(cachedCaller)
+		if c.cfg.Now().Before(cc.expires) {
+			c.mux.Unlock()
+			return copyCaller(cc.caller), cc.err // cache hit
+		}
+		c.cache.Remove(hash) // expired
+	}
+	c.mux.Unlock()
+
+	// Cache miss. Don't hold the lock while calling the plugin because it's slow.
+	caller, err := c.plugin.Authenticate(req)
+	ttl := c.cfg.TTL
+	if err != nil {
+		ttl = c.cfg.NegativeTTL
+	}
+	c.mux.Lock()
+	c.cache.Add(hash, cachedCaller{
+		caller:  copyCaller(caller),
+		err:     err,
+		expires: c.cfg.Now().Add(ttl),
+	})
+	c.mux.Unlock()
+	return caller, err
+}
+
+func (c *CachingAuthenticator) Authorize(caller Caller, a Action) error {
+	return c.plugin.Authorize(caller, a)
+}
+
+// copyCaller returns a deep copy of the caller because the Manager sets trace
+// values from the request, which must not change the cached caller.
+func copyCaller(c Caller) Caller {
+	cp := c
+	if c.Roles != nil {
+		cp.Roles = append([]string{}, c.Roles...)
+	}
+	if c.MetricGroups != nil {
+		cp.MetricGroups = append([]string{}, c.MetricGroups...)
+	}
+	if c.Trace != nil {
+		cp.Trace = make(map[string]string, len(c.Trace))
+		for k, v := range c.Trace {
+			cp.Trace[k] = v
+		}
+	}
+	return cp
+}
@@ -3,31 +3,198 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
+
+	"github.com/square/etre"
+	"github.com/square/etre/metrics"
 )
 
 type Manager struct {
-	disabled bool
-	plugin   Plugin
-	acl      map[string]ACL
+	disabled      bool
+	plugins       []Plugin
+	acl           map[string]ACL
+	inherits      map[string][]string                // role => inherited roles, recursively
+	tracePatterns map[string]map[string]tracePattern // role => trace key => pattern
+	audit         AuditFunc
+	metrics       metrics.Metrics
+}
+
+// AuditFunc receives every authorization decision: the caller, the action, and
+// the error returned to the API. A nil error means the action was allowed.
+// It is called synchronously, so it should not block.
+type AuditFunc func(Caller, Action, error)
+
+type tracePattern struct {
+	re  *regexp.Regexp
+	err error // invalid pattern
 }
 
-func NewManager(acls []ACL, plugin Plugin) Manager {
+// NewManager returns a Manager that authenticates callers with the plugins, which
+// are tried in order until one authenticates the caller. Usually there is only
+// one plugin, but a chain of plugins lets Etre accept different kinds of callers,
+// like services with tokens and users with JWTs. The plugin that authenticated
+// a caller also authorizes the caller.
+func NewManager(acls []ACL, plugins ...Plugin) Manager {
+	if len(plugins) == 0 {
+		plugins = []Plugin{NewAllowAll()}
+	}
 	byRole := map[string]ACL{}
+	tracePatterns := map[string]map[string]tracePattern{}
 	for _, acl := range acls {
 		byRole[acl.Role] = acl
+		if len(acl.TraceKeyPatterns) == 0 {
+			continue
+		}
+		// Compile once here, not per request. An invalid pattern is reported by
+		// Authenticate, which fails closed; use CompileTracePatterns to validate
+		// patterns before calling NewManager.
+		tracePatterns[acl.Role] = map[string]tracePattern{}
+		for key, pattern := range acl.TraceKeyPatterns {
+			re, err := compileTracePattern(pattern)
+			tracePatterns[acl.Role][key] = tracePattern{re: re, err: err}
+		}
 	}
 	return Manager{
-		disabled: len(acls) == 0, // no auth if no acls
-		plugin:   plugin,
-		acl:      byRole,
+		disabled:      len(acls) == 0, // no auth if no acls
+		plugins:       plugins,
+		acl:           byRole,
+		inherits:      inheritedRoles(byRole),
+		tracePatterns: tracePatterns,
+	}
+}
+
+// inheritedRoles returns the roles that each role inherits, recursively. Unknown
+// roles and cycles are ignored; ValidateInherits reports them.
+func inheritedRoles(byRole map[string]ACL) map[string][]string {
+	inherits := map[string][]string{}
+	for role := range byRole {
+		seen := map[string]bool{role: true}
+		var walk func(string)
+		walk = func(r string) {
+			for _, parent := range byRole[r].Inherits {
+				if _, ok := byRole[parent]; !ok || seen[parent] {
+					continue
+				}
+				seen[parent] = true
+				inherits[role] = append(inherits[role], parent)
+				walk(parent)
+			}
+		}
+		walk(role)
+	}
+	return inherits
+}
+
+// roles returns the caller roles and the roles they inherit. Each role is checked
+// separately, so the label restrictions of a role apply only to the ops it allows,
+// and an inherited role adds permissions but never removes them.
+func (m Manager) roles(caller Caller) []string {
+	if len(m.inherits) == 0 {
+		return caller.Roles
+	}
+	roles := append([]string{}, caller.Roles...)
+	for _, role := range caller.Roles {
+		for _, parent := range m.inherits[role] {
+			if !inList(parent, roles) {
+				roles = append(roles, parent)
+			}
+		}
 	}
+	return roles
+}
+
+// WithAuditFunc returns a copy of the Manager that calls f after every Authorize
+// and AuthorizeLabels, for both allowed and denied actions. If f is nil, there
+// is no audit.
+func (m Manager) WithAuditFunc(f AuditFunc) Manager {
+	m.audit = f
+	return m
+}
+
+// WithMetrics returns a copy of the Manager that counts authentication and
+// authorization outcomes in sm, which should be the system metrics because
+// callers are not authenticated yet, so metric groups are unknown.
+// If sm is nil, there are no metrics.
+func (m Manager) WithMetrics(sm metrics.Metrics) Manager {
+	m.metrics = sm
+	return m
+}
+
+// CompileTracePatterns returns an error if any ACL.TraceKeyPatterns is not a valid regex.
+func CompileTracePatterns(acls []ACL) error {
+	for _, acl := range acls {
+		for key, pattern := range acl.TraceKeyPatterns {
+			if _, err := compileTracePattern(pattern); err != nil {
+				return fmt.Errorf("role %s trace key %s: invalid pattern: %s", acl.Role, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func compileTracePattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$") // match entire value
+}
+
+// ValidateInherits returns an error if a role inherits an unknown role or if there
+// is a cycle. The Manager resolves inherited roles (ACL.Inherits): it checks each
+// inherited role separately, like the caller's own roles.
+func ValidateInherits(acls []ACL) error {
+	byRole := map[string]ACL{}
+	for _, acl := range acls {
+		byRole[acl.Role] = acl
+	}
+	valid := map[string]bool{}
+	visiting := map[string]bool{}
+	var validate func(role string, path []string) error
+	validate = func(role string, path []string) error {
+		if valid[role] {
+			return nil
+		}
+		path = append(path, role)
+		if visiting[role] {
+			return fmt.Errorf("role inheritance cycle: %s", strings.Join(path, " -> "))
+		}
+		acl, ok := byRole[role]
+		if !ok {
+			return fmt.Errorf("role %s inherits unknown role %s", path[len(path)-2], role)
+		}
+		visiting[role] = true
+		for _, parentRole := range acl.Inherits {
+			if err := validate(parentRole, path); err != nil {
+				return err
+			}
+		}
+		visiting[role] = false
+		valid[role] = true
+		return nil
+	}
+	for _, acl := range acls {
+		if err := validate(acl.Role, nil); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (m Manager) Authenticate(req *http.Request) (Caller, error) {
-	caller, err := m.plugin.Authenticate(req)
+	caller, err := m.authenticate(req)
+	if m.metrics != nil {
+		if err != nil {
+			m.metrics.Inc(metrics.AuthenticateError, 1)
+		} else {
+			m.metrics.Inc(metrics.AuthenticateOK, 1)
+		}
+	}
+	return caller, err
+}
+
+func (m Manager) authenticate(req *http.Request) (Caller, error) {
+	caller, err := m.authenticatePlugins(req)
 	if err != nil {
 		return caller, err
 	}
@@ -72,23 +239,138 @@ func (m Manager) Authenticate(req *http.Request) (Caller, error) {
 				}
 			}
 		}
+		for key, p := range m.tracePatterns[role] {
+			val, ok := caller.Trace[key]
+			if !ok {
+				continue // presence is checked by TraceKeysRequired
+			}
+			if p.err != nil {
+				return caller, fmt.Errorf("role %s trace key %s has an invalid pattern: %s", role, key, p.err)
+			}
+			if !p.re.MatchString(val) {
+				return caller, fmt.Errorf("role %s requires trace key %s value to match pattern %s but caller value is %q", role, key, m.acl[role].TraceKeyPatterns[key], val)
+			}
+		}
 	}
 	return caller, nil
 }
 
+// authenticatePlugins tries each plugin in order and returns the first caller that
+// authenticates. If all plugins fail, their errors are returned together.
+// With only one plugin, its caller and error are returned as-is.
+func (m Manager) authenticatePlugins(req *http.Request) (Caller, error) {
+	if len(m.plugins) == 1 {
+		return m.plugins[0].Authenticate(req)
+	}
+	var caller Caller
+	errs := make([]error, 0, len(m.plugins))
+	for i, p := range m.plugins {
+		var err error
+		caller, err = p.Authenticate(req)
+		if err == nil {
+			caller.plugin = i
+			return caller, nil
+		}
+		errs = append(errs, err)
+	}
+	return caller, fmt.Errorf("all %d auth plugins failed: %w", len(m.plugins), errors.Join(errs...))
+}
+
+// plugin returns the plugin that authenticated the caller.
+func (m Manager) plugin(caller Caller) Plugin {
+	if caller.plugin < len(m.plugins) {
+		return m.plugins[caller.plugin]
+	}
+	return m.plugins[0]
+}
+
 func (m Manager) Authorize(caller Caller, a Action) error {
+	err := m.authorize(caller, a)
+	m.decided(caller, a, err)
+	return err
+}
+
+func (m Manager) authorize(caller Caller, a Action) error {
 	// No ACLs = no auth
 	if m.disabled {
-		return m.plugin.Authorize(caller, a)
+		return m.plugin(caller).Authorize(caller, a)
+	}
+
+	if err := m.authorizeACL(caller, a); err != nil {
+		return err
+	}
+
+	// Let plugin do final authorization
+	return m.plugin(caller).Authorize(caller, a)
+}
+
+// AuthorizeLabels authorizes the action against the ACLs, like Authorize, but it
+// does not call the plugin. The API calls it with Action.Labels after Authorize
+// because the labels being written are not known until the request body is read.
+func (m Manager) AuthorizeLabels(caller Caller, a Action) error {
+	var err error
+	if !m.disabled {
+		err = m.authorizeACL(caller, a)
+	}
+	m.decided(caller, a, err)
+	return err
+}
+
+// decided records an authorization decision in metrics and the audit func, if set.
+func (m Manager) decided(caller Caller, a Action, err error) {
+	if m.metrics != nil {
+		if err != nil {
+			m.metrics.Inc(metrics.AuthorizeDenied, 1)
+		} else {
+			m.metrics.Inc(metrics.AuthorizeOK, 1)
+		}
+	}
+	if m.audit != nil {
+		m.audit(caller, a, err)
+	}
+}
+
+// ReadableLabels returns a func that reports whether the caller can read a label
+// of entities of the given type, or nil if the caller can read all labels. A label
+// is readable if any caller role that can read the entity type allows it.
+func (m Manager) ReadableLabels(caller Caller, entityType string) func(label string) bool {
+	if m.disabled {
+		return nil
+	}
+	acls := []ACL{}
+	for _, role := range m.roles(caller) {
+		acl, ok := m.acl[role]
+		if !ok || !(acl.Admin || inList(entityType, acl.Read)) {
+			continue
+		}
+		if !acl.restrictsLabels(entityType) {
+			return nil // this role can read all labels
+		}
+		acls = append(acls, acl)
 	}
+	if len(acls) == 0 {
+		return nil // caller cannot read entity type, so Authorize denies the read
+	}
+	return func(label string) bool {
+		for _, acl := range acls {
+			if acl.labelAllowed(entityType, label) {
+				return true
+			}
+		}
+		return false
+	}
+}
 
+func (m Manager) authorizeACL(caller Caller, a Action) error {
 	// Check each caller role against configured role ACLs
 	allowed := false
 	opName := ""
+	deniedLabel := ""
 
-	// Check all roles until we find one that allows access
-	for i := 0; i < len(caller.Roles) && !allowed; i++ {
-		acl := m.acl[caller.Roles[i]]
+	// Check all roles, including inherited roles, until we find one that allows access
+	roles := m.roles(caller)
+	for i := 0; i < len(roles) && !allowed; i++ {
+		acl := m.acl[roles[i]]
 
 		switch a.Op {
 		case OP_READ:
@@ -97,17 +379,103 @@ func (m Manager) Authorize(caller Caller, a Action) error {
 		case OP_WRITE:
 			opName = "writing"
 			allowed = acl.Admin || inList(a.EntityType, acl.Write)
+		case OP_INSERT:
+			opName = "inserting"
+			allowed = acl.Admin || inList(a.EntityType, writeList(acl.Insert, acl.Write))
+		case OP_UPDATE:
+			opName = "updating"
+			allowed = acl.Admin || inList(a.EntityType, writeList(acl.Update, acl.Write))
+		case OP_DELETE:
+			opName = "deleting"
+			allowed = acl.Admin || inList(a.EntityType, writeList(acl.Delete, acl.Write))
 		case OP_CDC:
 			opName = "CDC"
 			allowed = acl.Admin || acl.CDC
+		case OP_ADMIN:
+			opName = "admin writes to"
+			allowed = acl.Admin
+		}
+
+		// Role allows op, but it must allow all labels, too
+		if allowed && !acl.Admin {
+			for _, label := range a.Labels {
+				if !acl.labelAllowed(a.EntityType, label) {
+					allowed = false
+					deniedLabel = label
+					break
+				}
+			}
 		}
 	}
 	if !allowed {
+		if deniedLabel != "" {
+			return fmt.Errorf("caller %s has no role that allows %s label %s of %s entities; caller roles: %v", caller.Name, opName, deniedLabel, a.EntityType, caller.Roles)
+		}
 		return fmt.Errorf("caller %s has no role that allows %s %s entities; caller roles: %v", caller.Name, opName, a.EntityType, caller.Roles)
 	}
 
-	// Let plugin do final authorization
-	return m.plugin.Authorize(caller, a)
+	// Deny rules are checked after allow because deny wins: if any caller role
+	// denies the op, it's denied even if another role allows it
+	for _, role := range roles {
+		acl, ok := m.acl[role]
+		if ok && acl.Deny.denies(a) {
+			return fmt.Errorf("caller %s role %s denies %s %s entities; caller roles: %v", caller.Name, role, opName, a.EntityType, caller.Roles)
+		}
+	}
+	return nil
+}
+
+// denies returns true if the action op on the entity type is denied.
+func (d Deny) denies(a Action) bool {
+	switch a.Op {
+	case OP_READ:
+		return inList(a.EntityType, d.Read)
+	case OP_WRITE:
+		return inList(a.EntityType, d.Write)
+	case OP_INSERT:
+		return inList(a.EntityType, d.Write) || inList(a.EntityType, d.Insert)
+	case OP_UPDATE:
+		return inList(a.EntityType, d.Write) || inList(a.EntityType, d.Update)
+	case OP_DELETE:
+		return inList(a.EntityType, d.Write) || inList(a.EntityType, d.Delete)
+	case OP_CDC:
+		return d.CDC
+	}
+	return false
+}
+
+// restrictsLabels returns true if the ACL denies or allows specific labels of the entity type.
+func (acl ACL) restrictsLabels(entityType string) bool {
+	if acl.Admin {
+		return false
+	}
+	_, deny := acl.DenyLabels[entityType]
+	_, allow := acl.AllowLabels[entityType]
+	return deny || allow
+}
+
+// labelAllowed returns true if the ACL allows the label of the entity type.
+// Meta-labels are always allowed because Etre requires them.
+func (acl ACL) labelAllowed(entityType, label string) bool {
+	if acl.Admin || etre.IsMetalabel(label) {
+		return true
+	}
+	if inList(label, acl.DenyLabels[entityType]) {
+		return false
+	}
+	if allow, ok := acl.AllowLabels[entityType]; ok {
+		return inList(label, allow)
+	}
+	return true
+}
+
+// writeList returns the op-specific entity types (ACL.Insert, .Update, or .Delete)
+// if set, else the general ACL.Write entity types for backwards compatibility.
+func writeList(opTypes, writeTypes []string) []string {
+	if opTypes != nil {
+		return opTypes
+	}
+	return writeTypes
 }
 
 func inList(s string, l []string) bool {
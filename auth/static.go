@@ -0,0 +1,54 @@
+// Copyright 2026, Square, Inc.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// StaticAuth is a Plugin that authenticates callers by bearer token (HTTP header
+// "Authorization: Bearer <token>") using a static map of tokens to callers. It is
+// meant for small deployments without an external identity provider. Authorize
+// allows all actions: use ACLs to authorize caller roles.
+type StaticAuth struct {
+	callers map[[sha256.Size]byte]Caller // keyed on token hash
+}
+
+var _ Plugin = StaticAuth{}
+
+// NewStaticAuth returns a StaticAuth for the map of token to caller. If a caller
+// has no metric groups, DefaultMetricGroup is used.
+func NewStaticAuth(tokens map[string]Caller) StaticAuth {
+	// Tokens are hashed so that a lookup does not compare secret values directly
+	callers := make(map[[sha256.Size]byte]Caller, len(tokens))
+	for token, caller := range tokens {
+		if len(caller.MetricGroups) == 0 {
+			caller.MetricGroups = []string{DefaultMetricGroup}
+		}
+		callers[sha256.Sum256([]byte(token))] = copyCaller(caller)
+	}
+	return StaticAuth{callers: callers}
+}
+
+func (a StaticAuth) Authenticate(req *http.Request) (Caller, error) {
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return Caller{}, fmt.Errorf("missing Authorization header")
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return Caller{}, fmt.Errorf("invalid Authorization header: expected Bearer token")
+	}
+	caller, ok := a.callers[sha256.Sum256([]byte(token))]
+	if !ok {
+		return Caller{}, fmt.Errorf("invalid token")
+	}
+	return copyCaller(caller), nil // copy because Manager sets Trace
+}
+
+func (a StaticAuth) Authorize(Caller, Action) error {
+	return nil
+}
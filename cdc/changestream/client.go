@@ -13,6 +13,7 @@ import (
 	"github.com/gorilla/websocket"
 
 	"github.com/square/etre"
+	"github.com/square/etre/metrics"
 )
 
 var (
@@ -24,26 +25,37 @@ type WebsocketClient struct {
 	clientId string // clientId for this client
 	wsConn   *websocket.Conn
 	stream   Streamer
+	metrics  metrics.Metrics
 	// --
 	*sync.Mutex   // guards function calls
 	stopped       bool
 	streamStarted bool              // true once client sends start control msg
 	wsMutex       *sync.Mutex       // guards wsConn.Write
 	pingChan      chan etre.Latency // for Ping
-
+	eventFilter   func(etre.CDCEvent) etre.CDCEvent
 }
 
-func NewWebsocketClient(clientId string, wsConn *websocket.Conn, stream Streamer) *WebsocketClient {
+func NewWebsocketClient(clientId string, wsConn *websocket.Conn, stream Streamer, m metrics.Metrics) *WebsocketClient {
 	return &WebsocketClient{
 		clientId: clientId,
 		wsConn:   wsConn,
 		stream:   stream,
+		metrics:  m,
 		wsMutex:  &sync.Mutex{},
 		Mutex:    &sync.Mutex{},
 		pingChan: make(chan etre.Latency, 1),
 	}
 }
 
+// WithEventFilter sets a func that returns the event to send to the client, like
+// the event without labels the client cannot read. It must not modify the event
+// entities (Old and New) because the streamer sends the same event to all clients.
+// It must be set before calling Run.
+func (f *WebsocketClient) WithEventFilter(filter func(etre.CDCEvent) etre.CDCEvent) *WebsocketClient {
+	f.eventFilter = filter
+	return f
+}
+
 func (f *WebsocketClient) Run() error {
 	etre.Debug("Run call")
 	defer etre.Debug("Run return")
@@ -183,8 +195,29 @@ func (f *WebsocketClient) control(msg map[string]interface{}, now time.Time) err
 		} else {
 			startTs = time.Now().Unix()
 		}
-		etre.Debug("startTs %d", startTs)
-		go f.runStreamer(startTs)
+		opts := StartOptions{SinceTs: startTs}
+		if v, ok := msg["startId"]; ok {
+			opts.SinceId, _ = v.(string)
+		}
+		if v, ok := msg["startSeq"]; ok {
+			seq, _ := v.(float64)
+			opts.SinceSeq = int64(seq)
+		}
+		if v, ok := msg["entityType"]; ok {
+			opts.Filter.EntityType, _ = v.(string)
+		}
+		if v, ok := msg["labels"]; ok {
+			labels, _ := v.([]interface{})
+			for _, l := range labels {
+				label, ok := l.(string)
+				if !ok {
+					return fmt.Errorf("invalid labels in start control message: %v", v)
+				}
+				opts.Filter.Labels = append(opts.Filter.Labels, label)
+			}
+		}
+		etre.Debug("start options %+v", opts)
+		go f.runStreamer(opts)
 
 		// Client expects us to ack their start
 		ack := map[string]string{
@@ -200,7 +233,7 @@ func (f *WebsocketClient) control(msg map[string]interface{}, now time.Time) err
 	return nil
 }
 
-func (f *WebsocketClient) runStreamer(startTs int64) {
+func (f *WebsocketClient) runStreamer(opts StartOptions) {
 	etre.Debug("runStreamer call")
 	defer etre.Debug("runStreamer return")
 
@@ -208,11 +241,16 @@ func (f *WebsocketClient) runStreamer(startTs int64) {
 	// means Streamer has already stopped. Closing the chan is the last thing it
 	// does on shutdown.
 	var sendErr error
-	eventsChan := f.stream.Start(startTs)
+	eventsChan := f.stream.StartWith(opts)
 	for event := range eventsChan {
+		if f.eventFilter != nil {
+			event = f.eventFilter(event)
+		}
 		if sendErr = f.send(event); sendErr != nil {
 			break
 		}
+		// CDC lag: event age when sent to client (event.Ts is Unix milliseconds)
+		f.metrics.Val(metrics.CDCLagMs, time.Now().UnixMilli()-event.Ts)
 	}
 
 	// Steamer and Client are tied together: if Streamer stops, so do we.
@@ -225,6 +263,8 @@ func (f *WebsocketClient) runStreamer(startTs int64) {
 	}
 	if sendErr != nil {
 		log.Printf("Error sending event to cdc client %s, shutting down: %s", f.clientId, sendErr)
+	} else if e, ok := f.stream.Error().(etre.Error); ok {
+		f.sendError(e) // typed error like etre.ErrCDCPositionGone
 	} else {
 		f.sendError(fmt.Errorf("Steamer closed channel (error: %v), shutting down", f.stream.Error()))
 	}
@@ -239,6 +279,11 @@ func (f *WebsocketClient) sendError(err error) error {
 		"control": "error",
 		"error":   err.Error(),
 	}
+	if e, ok := err.(etre.Error); ok {
+		// Client returns etre.Error so caller can check the type
+		msg["type"] = e.Type
+		msg["message"] = e.Message
+	}
 	if err2 := f.send(msg); err2 != nil {
 		// Error sending the error, just ignore. The client has probably gone away.
 		log.Printf("Error sending error control message to cdc client %s, ignoring: %s", f.clientId, err2)
@@ -17,6 +17,7 @@ import (
 
 	"github.com/square/etre"
 	"github.com/square/etre/cdc/changestream"
+	"github.com/square/etre/metrics"
 	"github.com/square/etre/test/mock"
 )
 
@@ -38,6 +39,7 @@ type server struct {
 	ts            *httptest.Server
 	url           string
 	Client        *changestream.WebsocketClient
+	metrics       *mock.MetricRecorder
 	clientRunning chan struct{}
 	doneChan      chan struct{}
 	err           error
@@ -46,11 +48,16 @@ type server struct {
 var clientNo int
 
 func setupClient(t *testing.T, streamer changestream.Streamer) *server {
+	return setupClientWithFilter(t, streamer, nil)
+}
+
+func setupClientWithFilter(t *testing.T, streamer changestream.Streamer, filter func(etre.CDCEvent) etre.CDCEvent) *server {
 	//etre.DebugEnabled = true
 	server := &server{
 		Mutex:         &sync.Mutex{},
 		doneChan:      make(chan struct{}),
 		clientRunning: make(chan struct{}),
+		metrics:       mock.NewMetricsRecorder(),
 	}
 	wsHandler := func(w http.ResponseWriter, r *http.Request) {
 		defer close(server.doneChan)
@@ -61,7 +68,7 @@ func setupClient(t *testing.T, streamer changestream.Streamer) *server {
 		clientNo++
 		clientId := fmt.Sprintf("client%d", clientNo)
 		server.Lock()
-		server.Client = changestream.NewWebsocketClient(clientId, wsConn, streamer)
+		server.Client = changestream.NewWebsocketClient(clientId, wsConn, streamer, server.metrics).WithEventFilter(filter)
 		server.Unlock()
 		runChan := make(chan struct{})
 		go func() {
@@ -237,6 +244,180 @@ func TestClientStreamer(t *testing.T) {
 	assert.Equal(t, changestream.ErrWebsocketClosed, gotErr)
 }
 
+func TestClientStreamerPositionGone(t *testing.T) {
+	// Test that startId is passed to the Streamer and, if the position is gone,
+	// the client gets the typed error in the error control message
+	var gotOpts changestream.StartOptions
+	streamer := mock.Stream{
+		StartWithFunc: func(opts changestream.StartOptions) <-chan etre.CDCEvent {
+			gotOpts = opts
+			eventsChan := make(chan etre.CDCEvent)
+			close(eventsChan)
+			return eventsChan
+		},
+		ErrorFunc: func() error {
+			return etre.ErrCDCPositionGone.New("CDC event abc not found")
+		},
+	}
+	server := setupClient(t, streamer)
+	defer server.ts.Close()
+
+	clientConn, _, err := websocket.DefaultDialer.Dial(server.url, nil)
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	start := map[string]interface{}{
+		"control": "start",
+		"startTs": 1,
+		"startId": "abc",
+	}
+	err = clientConn.WriteJSON(start)
+	require.NoError(t, err)
+
+	var ack map[string]interface{}
+	err = clientConn.ReadJSON(&ack)
+	require.NoError(t, err)
+	assert.Equal(t, "start", ack["control"])
+
+	var errControl map[string]interface{}
+	err = clientConn.ReadJSON(&errControl)
+	require.NoError(t, err)
+	assert.Equal(t, "error", errControl["control"])
+	assert.Equal(t, "cdc-position-gone", errControl["type"])
+	assert.Equal(t, "CDC event abc not found", errControl["message"])
+
+	<-server.doneChan
+	assert.Equal(t, changestream.StartOptions{SinceTs: 1, SinceId: "abc"}, gotOpts)
+}
+
+func TestClientStreamerFilter(t *testing.T) {
+	// Test that the filter in the start control message is passed to the Streamer
+	optsChan := make(chan changestream.StartOptions, 1)
+	streamer := mock.Stream{
+		StartWithFunc: func(opts changestream.StartOptions) <-chan etre.CDCEvent {
+			optsChan <- opts
+			return make(chan etre.CDCEvent)
+		},
+	}
+	server := setupClient(t, streamer)
+	defer server.ts.Close()
+
+	clientConn, _, err := websocket.DefaultDialer.Dial(server.url, nil)
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	start := map[string]interface{}{
+		"control":    "start",
+		"startTs":    1,
+		"entityType": "node",
+		"labels":     []string{"foo", "bar"},
+	}
+	err = clientConn.WriteJSON(start)
+	require.NoError(t, err)
+
+	var ack map[string]interface{}
+	err = clientConn.ReadJSON(&ack)
+	require.NoError(t, err)
+	assert.Empty(t, ack["error"], "got an error in the ack response. Expected no error")
+
+	select {
+	case gotOpts := <-optsChan:
+		expectOpts := changestream.StartOptions{
+			SinceTs: 1,
+			Filter: changestream.Filter{
+				EntityType: "node",
+				Labels:     []string{"foo", "bar"},
+			},
+		}
+		assert.Equal(t, expectOpts, gotOpts)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timeout waiting for StartWith call")
+	}
+}
+
+func TestClientEventFilter(t *testing.T) {
+	// Test that the event filter is applied to every event sent to the client,
+	// like the API removing labels the caller cannot read
+	eventsChan := make(chan etre.CDCEvent, 2)
+	streamer := mock.Stream{
+		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+			return eventsChan
+		},
+	}
+	filter := func(e etre.CDCEvent) etre.CDCEvent {
+		e.New = &etre.Entity{"x": (*e.New)["x"]}
+		return e
+	}
+	server := setupClientWithFilter(t, streamer, filter)
+	defer server.ts.Close()
+
+	clientConn, _, err := websocket.DefaultDialer.Dial(server.url, nil)
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	err = clientConn.WriteJSON(map[string]interface{}{"control": "start", "startTs": 1})
+	require.NoError(t, err)
+	var ack map[string]interface{}
+	err = clientConn.ReadJSON(&ack)
+	require.NoError(t, err)
+	assert.Empty(t, ack["error"], "got an error in the ack response. Expected no error")
+
+	eventsChan <- etre.CDCEvent{Id: "abc", Ts: 2, New: &etre.Entity{"x": "a", "secret": "s1"}}
+	eventsChan <- etre.CDCEvent{Id: "def", Ts: 3, New: &etre.Entity{"x": "b", "secret": "s2"}}
+	expectEvents := []etre.CDCEvent{
+		{Id: "abc", Ts: 2, New: &etre.Entity{"x": "a"}},
+		{Id: "def", Ts: 3, New: &etre.Entity{"x": "b"}},
+	}
+	var gotEvents []etre.CDCEvent
+	for i := 0; i < len(expectEvents); i++ {
+		var recvdEvent etre.CDCEvent
+		err = clientConn.ReadJSON(&recvdEvent)
+		require.NoError(t, err)
+		gotEvents = append(gotEvents, recvdEvent)
+	}
+	assert.Equal(t, expectEvents, gotEvents)
+	close(eventsChan)
+}
+
+func TestClientStreamerLag(t *testing.T) {
+	// Test that sending an old CDC event records its age (now - Ts) as CDC lag
+	eventsChan := make(chan etre.CDCEvent, 1)
+	streamer := mock.Stream{
+		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+			return eventsChan
+		},
+	}
+	server := setupClient(t, streamer)
+	defer server.ts.Close()
+
+	clientConn, _, err := websocket.DefaultDialer.Dial(server.url, nil)
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	err = clientConn.WriteJSON(map[string]interface{}{"control": "start", "startTs": 1})
+	require.NoError(t, err)
+	var ack map[string]interface{}
+	err = clientConn.ReadJSON(&ack)
+	require.NoError(t, err)
+
+	// Event is 5s old when delivered
+	eventsChan <- etre.CDCEvent{Id: "abc", Ts: time.Now().Add(-5 * time.Second).UnixMilli()}
+	var recvdEvent etre.CDCEvent
+	err = clientConn.ReadJSON(&recvdEvent)
+	require.NoError(t, err)
+
+	// Wait for Client to shut down, so it's done recording metrics
+	close(eventsChan)
+	<-server.doneChan
+
+	require.Len(t, server.metrics.Called, 1)
+	got := server.metrics.Called[0]
+	assert.Equal(t, "Val", got.Method)
+	assert.Equal(t, metrics.CDCLagMs, got.Metric)
+	assert.GreaterOrEqual(t, got.IntVal, int64(5000))
+	assert.Less(t, got.IntVal, int64(6000))
+}
+
 func TestClientInvalidMessageType(t *testing.T) {
 	// Test that client returns an error control message if given an invalid message
 	eventsChan := make(chan etre.CDCEvent, 1)
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/square/etre"
+	"github.com/square/etre/metrics"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
@@ -19,6 +20,8 @@ var (
 	ErrNoMoreClients   = errors.New("max clients reached, no more clients allowed")
 	ErrDuplicateClient = errors.New("Watch called with duplicate clientId")
 	ErrAlreadyRunning  = errors.New("already running")
+	ErrClientNotFound  = errors.New("client not found")
+	ErrReplayBusy      = errors.New("previous replay not received by client")
 )
 
 type Server interface {
@@ -26,12 +29,79 @@ type Server interface {
 	Stop()
 	Watch(clientId string) (<-chan etre.CDCEvent, error)
 	Close(clientId string)
+
+	// Err returns the reason the server closed the client channel, like
+	// etre.ErrSlowConsumer, or nil if the client is running or closed by Close.
+	Err(clientId string) error
+
+	// Status returns a snapshot of the server status: clients and buffer usage.
+	Status() ServerStatus
+
+	// Replay sends past events to only the client, in the given order, so it
+	// can reprocess them. The events are received on the Replays channel, not
+	// the Watch channel, because they're not new events. It returns
+	// ErrClientNotFound if the client is not watching, or ErrReplayBusy if the
+	// client has not received the previous replay.
+	Replay(clientId string, events []etre.CDCEvent) error
+
+	// Replays returns the channel on which the client receives replayed events,
+	// or nil if the client is not watching.
+	Replays(clientId string) <-chan []etre.CDCEvent
 }
 
+const (
+	// SLOW_CLIENT_DROP drops a client as soon as its buffer is full. This is
+	// the default slow client policy.
+	SLOW_CLIENT_DROP = "drop"
+
+	// SLOW_CLIENT_DISCONNECT holds events for a client when its buffer is full,
+	// and disconnects the client if its buffer stays full longer than the grace
+	// period (ServerConfig.SlowClientGrace).
+	SLOW_CLIENT_DISCONNECT = "disconnect"
+)
+
 type ServerConfig struct {
 	CDCCollection *mongo.Collection
 	MaxClients    uint
 	BufferSize    uint
+
+	// SlowClientPolicy is what the server does when a client buffer is full:
+	// SLOW_CLIENT_DROP (default) or SLOW_CLIENT_DISCONNECT. In both cases, the
+	// client is closed with reason etre.ErrSlowConsumer (see Server.Err).
+	SlowClientPolicy string
+
+	// SlowClientGrace is how long a client buffer can stay full before the client
+	// is disconnected. It's only used with SLOW_CLIENT_DISCONNECT. If zero, the
+	// client is disconnected as soon as its buffer is full, like SLOW_CLIENT_DROP.
+	SlowClientGrace time.Duration
+
+	// Metrics are system metrics. If set, the server increments metrics.CDCDropped
+	// when it drops a client because its buffer is full.
+	Metrics metrics.Metrics
+
+	// OnDrop is called when the server drops a client because its buffer is full.
+	// It is called while the server is locked, so it must not block or call the server.
+	OnDrop func(DropEvent)
+}
+
+// ServerStatus is a snapshot of the change stream server status. It's reported
+// in the API /status response.
+type ServerStatus struct {
+	Clients    int            `json:"clients"`     // number of active clients
+	MaxClients uint           `json:"max-clients"` // ServerConfig.MaxClients
+	BufferSize uint           `json:"buffer-size"` // ServerConfig.BufferSize, per-client
+	BufferLen  map[string]int `json:"buffer-len"`  // number of buffered and held events, keyed on client id
+	Dropped    int64          `json:"dropped"`     // number of clients dropped because buffer was full
+}
+
+// DropEvent describes a client dropped by the server because its buffer was full.
+// The client is too slow to receive events, so it has to reconnect and resume
+// from its last event.
+type DropEvent struct {
+	ClientId   string
+	BufferSize uint
+	Event      etre.CDCEvent // first event not sent to the client
+	Ts         time.Time
 }
 
 var _ Server = &MongoDBServer{}
@@ -40,23 +110,32 @@ type MongoDBServer struct {
 	cfg ServerConfig
 	*sync.Mutex
 	stream   *mongo.ChangeStream
-	clients  map[string]client
+	clients  map[string]*client
+	closed   map[string]error // reason server closed client, until Close called
 	ctx      context.Context
 	cancel   context.CancelFunc
 	doneChan chan struct{}
 	running  bool
+	dropped  int64
 }
 
 type client struct {
-	clientId string
-	c        chan etre.CDCEvent
+	clientId  string
+	c         chan etre.CDCEvent
+	replay    chan []etre.CDCEvent // events from Replay
+	held      []etre.CDCEvent      // events held while c is full (SLOW_CLIENT_DISCONNECT)
+	fullSince time.Time            // when c became full, zero if not full
 }
 
 func NewMongoDBServer(cfg ServerConfig) *MongoDBServer {
+	if cfg.SlowClientPolicy == "" {
+		cfg.SlowClientPolicy = SLOW_CLIENT_DROP
+	}
 	s := &MongoDBServer{
 		cfg:     cfg,
 		Mutex:   &sync.Mutex{},
-		clients: map[string]client{},
+		clients: map[string]*client{},
+		closed:  map[string]error{},
 	}
 	s.ctx, s.cancel = context.WithCancel(context.Background())
 	return s
@@ -75,10 +154,12 @@ func (s *MongoDBServer) Watch(clientId string) (<-chan etre.CDCEvent, error) {
 		return nil, ErrDuplicateClient
 	}
 	c := make(chan etre.CDCEvent, s.cfg.BufferSize)
-	s.clients[clientId] = client{
+	s.clients[clientId] = &client{
 		clientId: clientId,
 		c:        c,
+		replay:   make(chan []etre.CDCEvent, 1),
 	}
+	delete(s.closed, clientId)
 	etre.Debug("added client %s", clientId)
 	return c, nil
 }
@@ -89,6 +170,13 @@ func (s *MongoDBServer) Close(clientId string) {
 	s.Lock()
 	defer s.Unlock()
 	s.close(clientId)
+	delete(s.closed, clientId)
+}
+
+func (s *MongoDBServer) Err(clientId string) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.closed[clientId]
 }
 
 func (s *MongoDBServer) close(clientId string) {
@@ -99,6 +187,54 @@ func (s *MongoDBServer) close(clientId string) {
 	}
 }
 
+func (s *MongoDBServer) Replay(clientId string, events []etre.CDCEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.clients[clientId]
+	if !ok {
+		return ErrClientNotFound
+	}
+	select {
+	case c.replay <- events:
+		etre.Debug("replay %d events to client %s", len(events), clientId)
+		return nil
+	default:
+		return ErrReplayBusy
+	}
+}
+
+func (s *MongoDBServer) Replays(clientId string) <-chan []etre.CDCEvent {
+	s.Lock()
+	defer s.Unlock()
+	if c, ok := s.clients[clientId]; ok {
+		return c.replay
+	}
+	return nil
+}
+
+// ActiveClients returns the number of active clients.
+func (s *MongoDBServer) ActiveClients() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.clients)
+}
+
+func (s *MongoDBServer) Status() ServerStatus {
+	s.Lock()
+	defer s.Unlock()
+	status := ServerStatus{
+		Clients:    len(s.clients),
+		MaxClients: s.cfg.MaxClients,
+		BufferSize: s.cfg.BufferSize,
+		BufferLen:  make(map[string]int, len(s.clients)),
+		Dropped:    s.dropped,
+	}
+	for clientId, c := range s.clients {
+		status.BufferLen[clientId] = len(c.c) + len(c.held)
+	}
+	return status
+}
+
 type rawCDCEvent struct {
 	EtreCDCEvent etre.CDCEvent `bson:"fullDocument"`
 }
@@ -140,22 +276,19 @@ func (s *MongoDBServer) Run() error {
 		cancel()
 	}()
 
+	if s.holdEvents() {
+		runDone := make(chan struct{})
+		defer close(runDone)
+		go s.checkSlowClients(runDone)
+	}
+
 	for stream.Next(s.ctx) {
 		var e rawCDCEvent
 		if err := stream.Decode(&e); err != nil {
 			return err
 		}
 		etre.Debug("cdc event: %+v", e.EtreCDCEvent)
-		s.Lock()
-		for clientId, c := range s.clients {
-			select {
-			case c.c <- e.EtreCDCEvent:
-			default:
-				etre.Debug("client %s blocked, closing", clientId)
-				s.close(clientId)
-			}
-		}
-		s.Unlock()
+		s.send(e.EtreCDCEvent)
 	}
 
 	if err := stream.Err(); err != nil {
@@ -170,6 +303,109 @@ func (s *MongoDBServer) Run() error {
 	return nil
 }
 
+// send sends the event to all clients. A client cannot block other clients,
+// so if its buffer is full, the event is held (SLOW_CLIENT_DISCONNECT) or the
+// client is dropped (SLOW_CLIENT_DROP).
+func (s *MongoDBServer) send(e etre.CDCEvent) {
+	s.Lock()
+	defer s.Unlock()
+	for clientId, c := range s.clients {
+		if s.holdEvents() {
+			// Send held events first to keep order
+			if s.flush(c) {
+				select {
+				case c.c <- e:
+					continue
+				default:
+				}
+			}
+			c.held = append(c.held, e)
+			if c.fullSince.IsZero() {
+				etre.Debug("client %s blocked, holding events", clientId)
+				c.fullSince = time.Now()
+			}
+			continue
+		}
+		select {
+		case c.c <- e:
+		default:
+			etre.Debug("client %s blocked, closing", clientId)
+			s.drop(c, e)
+		}
+	}
+}
+
+// holdEvents returns true if events are held for slow clients during the grace period.
+func (s *MongoDBServer) holdEvents() bool {
+	return s.cfg.SlowClientPolicy == SLOW_CLIENT_DISCONNECT && s.cfg.SlowClientGrace > 0
+}
+
+// flush sends held events to the client until its buffer is full. It returns
+// true if all held events were sent. The caller must lock the server.
+func (s *MongoDBServer) flush(c *client) bool {
+	for len(c.held) > 0 {
+		select {
+		case c.c <- c.held[0]:
+			c.held = c.held[1:]
+		default:
+			return false
+		}
+	}
+	c.held = nil
+	c.fullSince = time.Time{}
+	return true
+}
+
+// checkSlowClients periodically sends held events to clients, and disconnects
+// clients that have been full longer than the grace period, until done is closed.
+func (s *MongoDBServer) checkSlowClients(done chan struct{}) {
+	interval := s.cfg.SlowClientGrace / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	} else if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		s.Lock()
+		for clientId, c := range s.clients {
+			if s.flush(c) {
+				continue
+			}
+			if time.Since(c.fullSince) >= s.cfg.SlowClientGrace {
+				etre.Debug("client %s blocked longer than %s, closing", clientId, s.cfg.SlowClientGrace)
+				s.drop(c, c.held[0])
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// drop closes a slow client with reason etre.ErrSlowConsumer. The caller must
+// lock the server.
+func (s *MongoDBServer) drop(c *client, e etre.CDCEvent) {
+	s.close(c.clientId)
+	s.closed[c.clientId] = etre.ErrSlowConsumer
+	s.dropped++
+	if s.cfg.Metrics != nil {
+		s.cfg.Metrics.Inc(metrics.CDCDropped, 1)
+	}
+	if s.cfg.OnDrop != nil {
+		s.cfg.OnDrop(DropEvent{
+			ClientId:   c.clientId,
+			BufferSize: s.cfg.BufferSize,
+			Event:      e,
+			Ts:         time.Now(),
+		})
+	}
+}
+
 func (s *MongoDBServer) Stop() {
 	etre.Debug("Stop call")
 	defer etre.Debug("Stop return")
@@ -15,7 +15,9 @@ import (
 	"github.com/square/etre"
 	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
+	"github.com/square/etre/metrics"
 	"github.com/square/etre/test"
+	"github.com/square/etre/test/mock"
 )
 
 var (
@@ -84,10 +86,18 @@ func TestServer(t *testing.T) {
 func TestServerClientBlock(t *testing.T) {
 	setup(t)
 
+	// Slow consumer: client c1 doesn't receive, so its buffer (size 0) is full
+	// on the first event and the server drops it
+	sm := mock.NewMetricsRecorder()
+	var drops []changestream.DropEvent
 	server := changestream.NewMongoDBServer(changestream.ServerConfig{
 		CDCCollection: coll["cdc"],
 		MaxClients:    1,
 		BufferSize:    0,
+		Metrics:       sm,
+		OnDrop: func(e changestream.DropEvent) {
+			drops = append(drops, e)
+		},
 	})
 	go server.Run()
 	defer server.Stop()
@@ -95,6 +105,7 @@ func TestServerClientBlock(t *testing.T) {
 
 	stream, err := server.Watch("c1")
 	require.NoError(t, err)
+	assert.Equal(t, 1, server.ActiveClients())
 
 	if err := store.Write(context.TODO(), events1[0]); err != nil {
 		t.Fatal(err)
@@ -108,6 +119,76 @@ func TestServerClientBlock(t *testing.T) {
 	default:
 		t.Error("client channel not closed by server after blocking")
 	}
+
+	// Overflow counter incremented and drop event emitted
+	expectStatus := changestream.ServerStatus{
+		Clients:    0,
+		MaxClients: 1,
+		BufferSize: 0,
+		BufferLen:  map[string]int{},
+		Dropped:    1,
+	}
+	assert.Equal(t, expectStatus, server.Status())
+	assert.Equal(t, []mock.MetricMethodArgs{{Method: "Inc", Metric: metrics.CDCDropped, IntVal: 1}}, sm.Called)
+	require.Len(t, drops, 1)
+	assert.Equal(t, "c1", drops[0].ClientId)
+	assert.Equal(t, events1[0].Id, drops[0].Event.Id)
+}
+
+func TestServerSlowClientDisconnect(t *testing.T) {
+	setup(t)
+
+	// Stalled reader c1 is disconnected after the grace period because its
+	// buffer stays full. Client c2 receives all events, so it's not disconnected.
+	grace := 500 * time.Millisecond
+	server := changestream.NewMongoDBServer(changestream.ServerConfig{
+		CDCCollection:    coll["cdc"],
+		MaxClients:       2,
+		BufferSize:       1,
+		SlowClientPolicy: changestream.SLOW_CLIENT_DISCONNECT,
+		SlowClientGrace:  grace,
+	})
+	go server.Run()
+	defer server.Stop()
+	time.Sleep(200 * time.Millisecond) // given server.Run() a moment to start
+
+	stalled, err := server.Watch("c1")
+	require.NoError(t, err)
+	reader, err := server.Watch("c2")
+	require.NoError(t, err)
+
+	for _, e := range events1[0:3] {
+		require.NoError(t, store.Write(context.TODO(), e))
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-reader:
+		case <-time.After(1 * time.Second):
+			t.Fatal("timeout waiting for event on c2")
+		}
+	}
+
+	// Within the grace period, c1 is connected and its events are held
+	time.Sleep(100 * time.Millisecond)
+	status := server.Status()
+	assert.Equal(t, 2, status.Clients)
+	assert.Equal(t, 3, status.BufferLen["c1"])
+	assert.NoError(t, server.Err("c1"))
+
+	// After the grace period, c1 is disconnected with a typed reason
+	time.Sleep(grace)
+	assert.Equal(t, 1, server.ActiveClients())
+	assert.Equal(t, etre.ErrSlowConsumer, server.Err("c1"))
+	n := 0
+	for range stalled {
+		n++ // buffered events, then closed
+	}
+	assert.Equal(t, 1, n)
+
+	// Close clears the reason
+	server.Close("c1")
+	assert.NoError(t, server.Err("c1"))
+	assert.NoError(t, server.Err("c2"))
 }
 
 func TestServerStop(t *testing.T) {
@@ -136,3 +217,43 @@ func TestServerStop(t *testing.T) {
 		t.Error("client channel not closed when server stopped")
 	}
 }
+
+func TestServerReplay(t *testing.T) {
+	// Test that replayed events are sent only to the given client on its
+	// Replays channel, and only after it receives the previous replay
+	server := changestream.NewMongoDBServer(changestream.ServerConfig{
+		MaxClients: 2,
+		BufferSize: 1,
+	})
+	_, err := server.Watch("c1")
+	require.NoError(t, err)
+	_, err = server.Watch("c2")
+	require.NoError(t, err)
+
+	err = server.Replay("c3", events1)
+	assert.ErrorIs(t, err, changestream.ErrClientNotFound)
+	assert.Nil(t, server.Replays("c3"))
+
+	require.NoError(t, server.Replay("c1", events1))
+	err = server.Replay("c1", events1[0:1])
+	assert.ErrorIs(t, err, changestream.ErrReplayBusy)
+
+	select {
+	case got := <-server.Replays("c1"):
+		assert.Equal(t, events1, got)
+	default:
+		t.Fatal("no replay for c1")
+	}
+	select {
+	case got := <-server.Replays("c2"):
+		t.Errorf("got replay for c2, expected none: %v", got)
+	default:
+	}
+
+	// Previous replay received, so the next one is accepted
+	require.NoError(t, server.Replay("c1", events1[0:1]))
+
+	server.Close("c1")
+	err = server.Replay("c1", events1)
+	assert.ErrorIs(t, err, changestream.ErrClientNotFound)
+}
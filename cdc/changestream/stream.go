@@ -39,6 +39,10 @@ type Streamer interface {
 	// is called or until it encounters an error.
 	Start(sinceTs int64) <-chan etre.CDCEvent
 
+	// StartWith is like Start with additional options: a start event id and
+	// an event filter. Start(sinceTs) is the same as StartWith(StartOptions{SinceTs: sinceTs}).
+	StartWith(StartOptions) <-chan etre.CDCEvent
+
 	InSync() chan struct{}
 
 	Status() Status
@@ -51,6 +55,60 @@ type Streamer interface {
 	Error() error
 }
 
+// StartOptions are options for Streamer.StartWith.
+type StartOptions struct {
+	// SinceTs is the same as the Start argument.
+	SinceTs int64
+
+	// SinceId starts streaming after the event with this id: from the event
+	// timestamp, excluding the event. SinceTs is ignored. If the event does not
+	// exist (for example, it was purged from the CDC store), the streamer stops
+	// with error etre.ErrCDCPositionGone.
+	SinceId string
+
+	// SinceSeq starts streaming after the event with this sequence number
+	// (etre.CDCEvent.Seq): the backlog is events with a greater sequence number.
+	// SinceTs and SinceId are ignored. If the event does not exist, the streamer
+	// stops with error etre.ErrCDCPositionGone. If the streamer was not made with
+	// ServerStreamFactory.ResumeBySeq, it stops with error etre.ErrCDCSeqDisabled.
+	SinceSeq int64
+
+	// Filter streams only matching events.
+	Filter Filter
+}
+
+// Filter matches CDC events that a client subscribes to. Unset fields match
+// all events. Events are filtered by the streamer before sending them to the
+// client, which reduces bandwidth to clients that only need some events.
+type Filter struct {
+	// EntityType matches events for this entity type.
+	EntityType string
+
+	// Labels matches events that change at least one of these labels: the label
+	// is in the old or new values of the event. Insert and delete events have
+	// all labels of the entity.
+	Labels []string
+}
+
+// Match returns true if the event matches the filter.
+func (f Filter) Match(e etre.CDCEvent) bool {
+	if f.EntityType != "" && e.EntityType != f.EntityType {
+		return false
+	}
+	if len(f.Labels) == 0 {
+		return true
+	}
+	for _, label := range f.Labels {
+		if e.Old != nil && e.Old.Has(label) {
+			return true
+		}
+		if e.New != nil && e.New.Has(label) {
+			return true
+		}
+	}
+	return false
+}
+
 type StreamerFactory interface {
 	Make(clientId string) Streamer
 }
@@ -58,10 +116,24 @@ type StreamerFactory interface {
 type ServerStreamFactory struct {
 	Server Server
 	Store  cdc.Store
+
+	// Retention is config.CDCConfig.Retention. If set, streams cannot start
+	// before the retention window because those events might have been purged.
+	Retention time.Duration
+
+	// ResumeBySeq allows streams to start from a sequence number (StartOptions.SinceSeq).
+	// It must be true only if CDC events are written in transactions
+	// (config.EntityConfig.Transactions), else events can be committed out of
+	// sequence order, and a stream could skip an event committed after a greater
+	// sequence number was read.
+	ResumeBySeq bool
 }
 
 func (f ServerStreamFactory) Make(clientId string) Streamer {
-	return NewServerStream(clientId, f.Server, f.Store)
+	s := NewServerStream(clientId, f.Server, f.Store)
+	s.retention = f.Retention
+	s.resumeBySeq = f.ResumeBySeq
+	return s
 }
 
 type Status struct {
@@ -78,13 +150,17 @@ type Status struct {
 var _ Streamer = &ServerStream{}
 
 type ServerStream struct {
-	clientId string
-	server   Server
-	store    cdc.Store
+	clientId  string
+	server    Server
+	store     cdc.Store
+	retention time.Duration
+	// Allow StartOptions.SinceSeq, see ServerStreamFactory.ResumeBySeq
+	resumeBySeq bool
 	// --
 	toClientChan chan etre.CDCEvent // to WebsocketClient or plugin code using streamer directly
 
 	revorder *etre.RevOrder
+	filter   Filter
 	stopChan chan struct{} // channel that gets closed when Stop is called
 	wg       *sync.WaitGroup
 
@@ -118,6 +194,10 @@ func NewServerStream(clientId string, server Server, store cdc.Store) *ServerStr
 }
 
 func (s *ServerStream) Start(sinceTs int64) <-chan etre.CDCEvent {
+	return s.StartWith(StartOptions{SinceTs: sinceTs})
+}
+
+func (s *ServerStream) StartWith(opts StartOptions) <-chan etre.CDCEvent {
 	s.runMux.Lock()
 	defer s.runMux.Unlock()
 
@@ -129,6 +209,7 @@ func (s *ServerStream) Start(sinceTs int64) <-chan etre.CDCEvent {
 		panic("ServerStream.Start called after Stop")
 	default:
 	}
+	s.filter = opts.Filter
 
 	go func() {
 		defer func() {
@@ -144,7 +225,7 @@ func (s *ServerStream) Start(sinceTs int64) <-chan etre.CDCEvent {
 		}()
 		s.wg.Add(1)
 
-		err := s.stream(sinceTs)
+		err := s.stream(opts)
 		s.runMux.Lock()
 		s.err = err
 		s.runMux.Unlock()
@@ -213,23 +294,60 @@ func (s *ServerStream) InSync() chan struct{} {
 
 // --------------------------------------------------------------------------
 
-func (s *ServerStream) stream(sinceTs int64) error {
+func (s *ServerStream) stream(opts StartOptions) error {
 	etre.Debug("stream call")
 	defer etre.Debug("stream return")
 	defer s.wg.Done()
 
+	sinceTs, sinceId := opts.SinceTs, opts.SinceId
+
+	// Start from the event's timestamp or sequence number, if it still exists.
+	// Do this before Watch so the client gets the error without any events.
+	if opts.SinceSeq > 0 {
+		if !s.resumeBySeq {
+			return etre.ErrCDCSeqDisabled
+		}
+		events, err := s.store.Read(cdc.Filter{Seq: opts.SinceSeq})
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return etre.ErrCDCPositionGone.New("CDC event seq %d not found", opts.SinceSeq)
+		}
+		sinceTs, sinceId = 0, ""
+		etre.Debug("sinceSeq %d", opts.SinceSeq)
+	} else if sinceId != "" {
+		events, err := s.store.Read(cdc.Filter{EventId: sinceId})
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return etre.ErrCDCPositionGone.New("CDC event %s not found", sinceId)
+		}
+		sinceTs = events[0].Ts
+		etre.Debug("sinceId %s: sinceTs %d", sinceId, sinceTs)
+	} else if sinceTs > 0 && s.retention > 0 {
+		// Events before the retention window might have been purged, so the
+		// client would silently miss events
+		minTs := time.Now().Add(-s.retention).UnixNano() / int64(time.Millisecond)
+		if sinceTs < minTs {
+			return etre.ErrCDCPositionGone.New("start timestamp %d is before CDC retention window (%s)", sinceTs, s.retention)
+		}
+	}
+
 	serverStreamChan, err := s.server.Watch(s.clientId)
 	if err != nil {
 		return err
 	}
 	defer s.server.Close(s.clientId)
+	replayChan := s.server.Replays(s.clientId)
 
 	// ----------------------------------------------------------------------
 	// Backlog
 	// ----------------------------------------------------------------------
-	if sinceTs > 0 {
+	if sinceTs > 0 || opts.SinceSeq > 0 {
 		s.wg.Add(1)
-		if err := s.backlog(sinceTs, serverStreamChan); err != nil {
+		if err := s.backlog(cdc.Filter{SinceTs: sinceTs, SkipId: sinceId, SinceSeq: opts.SinceSeq}, serverStreamChan); err != nil {
 			return err
 		}
 	}
@@ -251,18 +369,29 @@ func (s *ServerStream) stream(sinceTs int64) error {
 				s.runMux.Lock()
 				s.status.ServerClosedStream = true
 				s.runMux.Unlock()
-				return ErrServerClosedStream
+				return s.serverClosedErr()
 			}
 			if err := s.sendToClient(e); err != nil {
 				return err
 			}
+		case events := <-replayChan:
+			// Replayed events are past revisions, so they're sent as-is,
+			// not through revorder which ignores past revisions
+			etre.Debug("replaying %d events", len(events))
+			for _, e := range events {
+				if err := s.send(e); err != nil {
+					return err
+				}
+			}
 		case <-s.stopChan:
 			return ErrStopped
 		}
 	}
 }
 
-func (s *ServerStream) backlog(sinceTs int64, serverStreamChan <-chan etre.CDCEvent) error {
+// backlog streams past events that match the filter: SinceTs and SkipId, or
+// SinceSeq. Current events are buffered meanwhile and sent after the backlog.
+func (s *ServerStream) backlog(f cdc.Filter, serverStreamChan <-chan etre.CDCEvent) error {
 	etre.Debug("backlog call")
 	defer etre.Debug("backlog return")
 	defer s.wg.Done()
@@ -290,7 +419,7 @@ func (s *ServerStream) backlog(sinceTs int64, serverStreamChan <-chan etre.CDCEv
 	// Send backlog evnets to client. Close backlogDoneChan when done to stop
 	// bufferCurrentEvents goroutine.
 	s.wg.Add(1)
-	if err := s.streamBacklog(sinceTs, backlogDoneChan); err != nil {
+	if err := s.streamBacklog(f, backlogDoneChan); err != nil {
 		etre.Debug("streamBacklog error: %v", err)
 		return err
 	}
@@ -341,7 +470,7 @@ func (s *ServerStream) bufferCurrentEvents(serverStreamChan <-chan etre.CDCEvent
 				s.runMux.Lock()
 				s.status.ServerClosedStream = true
 				s.runMux.Unlock()
-				return ErrServerClosedStream
+				return s.serverClosedErr()
 			}
 			s.buff = append(s.buff, e)
 			i += 1
@@ -359,7 +488,7 @@ func (s *ServerStream) bufferCurrentEvents(serverStreamChan <-chan etre.CDCEvent
 	return ErrBufferTooSmall
 }
 
-func (s *ServerStream) streamBacklog(sinceTs int64, backlogDoneChan chan struct{}) error {
+func (s *ServerStream) streamBacklog(f cdc.Filter, backlogDoneChan chan struct{}) error {
 	etre.Debug("streamBacklog call")
 	defer etre.Debug("streamBacklog return")
 	defer s.wg.Done()
@@ -383,14 +512,17 @@ func (s *ServerStream) streamBacklog(sinceTs int64, backlogDoneChan chan struct{
 		1,000 writes/s = 1 write per 1ms = 100 writes per 100ms.
 	*/
 	time.Sleep(BacklogWait)
-	untilTs := time.Now().UnixNano() / int64(time.Millisecond)
-	etre.Debug("since %d  until %d", sinceTs, untilTs)
-
-	events, err := s.store.Read(cdc.Filter{
-		SinceTs: sinceTs, // >= sinceTs
-		UntilTs: untilTs, //  < untilTs
-		Order:   cdc.ByTsAsc{},
-	})
+	f.UntilTs = time.Now().UnixNano() / int64(time.Millisecond) // < untilTs
+	etre.Debug("since %d (seq %d)  until %d", f.SinceTs, f.SinceSeq, f.UntilTs)
+
+	// Since events are >= SinceTs excluding SkipId (already sent to client),
+	// or > SinceSeq
+	if f.SinceSeq > 0 {
+		f.Order = cdc.BySeqAsc{}
+	} else {
+		f.Order = cdc.ByTsAsc{}
+	}
+	events, err := s.store.Read(f)
 	if err != nil {
 		return err
 	}
@@ -403,6 +535,15 @@ func (s *ServerStream) streamBacklog(sinceTs int64, backlogDoneChan chan struct{
 	return nil
 }
 
+// serverClosedErr returns the reason the server closed the stream, like
+// etre.ErrSlowConsumer, else ErrServerClosedStream.
+func (s *ServerStream) serverClosedErr() error {
+	if err := s.server.Err(s.clientId); err != nil {
+		return err
+	}
+	return ErrServerClosedStream
+}
+
 // sendToClient sends the event to the client if it's in order. If not, the
 // event is saved and sent later once revorder receives the other out-of-order
 // event. This means a single call to sendToClient can send zero or more events.
@@ -435,10 +576,14 @@ func (s *ServerStream) sendToClient(e etre.CDCEvent) error {
 	return nil
 }
 
-// send actually sends the event to the client, unless the streamer is stopped.
-// Do not call this fucntion directly; always call sendToClient to ensure proper
-// event ordering.
+// send actually sends the event to the client, unless the streamer is stopped
+// or the event does not match the filter. Do not call this fucntion directly;
+// always call sendToClient to ensure proper event ordering. Events are filtered
+// here, after revorder, because revorder needs every rev of an entity.
 func (s *ServerStream) send(e etre.CDCEvent) error {
+	if !s.filter.Match(e) {
+		return nil
+	}
 	// Don't send if already stopped
 	select {
 	case <-s.stopChan:
@@ -511,3 +511,344 @@ func TestStreamServerClosedStreamDuringSync(t *testing.T) {
 	err = stream.Error()
 	assert.Equal(t, changestream.ErrServerClosedStream, err)
 }
+
+func TestStreamStartFromId(t *testing.T) {
+	// Test resuming from a known event id: the streamer reads the event to get
+	// its Ts, then streams the backlog from that Ts excluding the event
+	serverChan := make(chan etre.CDCEvent, 1)
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			return serverChan, nil
+		},
+	}
+	var gotFilters []cdc.Filter
+	store := mock.CDCStore{
+		ReadFunc: func(f cdc.Filter) ([]etre.CDCEvent, error) {
+			gotFilters = append(gotFilters, f)
+			if f.EventId != "" {
+				return []etre.CDCEvent{events1[1]}, nil // Ts 200
+			}
+			return events1[2:], nil // after events1[1]
+		},
+	}
+	stream := changestream.NewServerStream("client1", srv, store)
+	streamChan := stream.StartWith(changestream.StartOptions{SinceTs: 1, SinceId: events1[1].Id}) // SinceTs ignored
+	defer stream.Stop()
+
+	var gotEvents []etre.CDCEvent
+	for len(gotEvents) < 2 {
+		select {
+		case e := <-streamChan:
+			gotEvents = append(gotEvents, e)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("timeout waiting for events, got %v", gotEvents)
+		}
+	}
+	assert.Equal(t, events1[2:], gotEvents)
+
+	select {
+	case <-stream.InSync():
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timeout waiting for InSync()")
+	}
+
+	require.Len(t, gotFilters, 2)
+	assert.Equal(t, cdc.Filter{EventId: events1[1].Id}, gotFilters[0])
+	gotFilters[1].UntilTs = 0
+	expectFilter := cdc.Filter{
+		SinceTs: events1[1].Ts,
+		SkipId:  events1[1].Id,
+		Order:   cdc.ByTsAsc{},
+	}
+	assert.Equal(t, expectFilter, gotFilters[1])
+}
+
+func TestStreamStartFromSeq(t *testing.T) {
+	// Test resuming from a sequence number: the streamer checks that the event
+	// exists, then streams the backlog after it in sequence order
+	serverChan := make(chan etre.CDCEvent, 1)
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			return serverChan, nil
+		},
+	}
+	events := []etre.CDCEvent{
+		{Id: "a", EntityId: "e1", EntityRev: 0, Ts: 100, Seq: 7},
+		{Id: "b", EntityId: "e2", EntityRev: 0, Ts: 100, Seq: 8},
+		{Id: "c", EntityId: "e1", EntityRev: 1, Ts: 99, Seq: 9},
+	}
+	var gotFilters []cdc.Filter
+	store := mock.CDCStore{
+		ReadFunc: func(f cdc.Filter) ([]etre.CDCEvent, error) {
+			gotFilters = append(gotFilters, f)
+			if f.Seq != 0 {
+				return events[0:1], nil
+			}
+			return events[1:], nil
+		},
+	}
+	f := changestream.ServerStreamFactory{Server: srv, Store: store, ResumeBySeq: true}
+	stream := f.Make("client1")
+	streamChan := stream.StartWith(changestream.StartOptions{SinceTs: 1, SinceSeq: 7}) // SinceTs ignored
+	defer stream.Stop()
+
+	var gotEvents []etre.CDCEvent
+	for len(gotEvents) < 2 {
+		select {
+		case e := <-streamChan:
+			gotEvents = append(gotEvents, e)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("timeout waiting for events, got %v", gotEvents)
+		}
+	}
+	assert.Equal(t, events[1:], gotEvents)
+
+	select {
+	case <-stream.InSync():
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timeout waiting for InSync()")
+	}
+
+	require.Len(t, gotFilters, 2)
+	assert.Equal(t, cdc.Filter{Seq: 7}, gotFilters[0])
+	gotFilters[1].UntilTs = 0
+	assert.Equal(t, cdc.Filter{SinceSeq: 7, Order: cdc.BySeqAsc{}}, gotFilters[1])
+}
+
+func TestStreamStartFromSeqDisabled(t *testing.T) {
+	// Test that resuming from a sequence number is an error unless enabled
+	// because, without transactions, events can be committed out of seq order
+	watched := false
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			watched = true
+			return make(chan etre.CDCEvent), nil
+		},
+	}
+	store := mock.CDCStore{
+		ReadFunc: func(f cdc.Filter) ([]etre.CDCEvent, error) {
+			return []etre.CDCEvent{{Id: "a", Seq: 7}}, nil
+		},
+	}
+	stream := changestream.NewServerStream("client1", srv, store)
+	streamChan := stream.StartWith(changestream.StartOptions{SinceSeq: 7})
+	require.NoError(t, waitUntilClosed(streamChan))
+
+	err := stream.Error()
+	require.Error(t, err)
+	e, ok := err.(etre.Error)
+	require.True(t, ok, "got error %v, expected etre.ErrCDCSeqDisabled", err)
+	assert.Equal(t, etre.ErrCDCSeqDisabled.Type, e.Type)
+	assert.False(t, watched, "server Watch called, expected error before streaming")
+}
+
+func TestStreamStartFromIdGone(t *testing.T) {
+	// Test resuming from an event that was purged from the CDC store: the
+	// streamer stops with the typed etre.ErrCDCPositionGone error
+	watched := false
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			watched = true
+			return make(chan etre.CDCEvent), nil
+		},
+	}
+	store := mock.CDCStore{
+		ReadFunc: func(f cdc.Filter) ([]etre.CDCEvent, error) {
+			return nil, nil // not found
+		},
+	}
+	stream := changestream.NewServerStream("client1", srv, store)
+	streamChan := stream.StartWith(changestream.StartOptions{SinceId: "purged"})
+	require.NoError(t, waitUntilClosed(streamChan))
+
+	err := stream.Error()
+	require.Error(t, err)
+	assert.True(t, etre.IsCDCPositionGone(err), "got error %v, expected etre.ErrCDCPositionGone", err)
+	assert.False(t, watched, "server Watch called, expected error before streaming")
+}
+
+func TestStreamRetention(t *testing.T) {
+	// Test starting before the retention window: events might have been
+	// purged, so the streamer stops with etre.ErrCDCPositionGone
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			return make(chan etre.CDCEvent), nil
+		},
+	}
+	f := changestream.ServerStreamFactory{
+		Server:    srv,
+		Store:     mock.CDCStore{},
+		Retention: time.Hour,
+	}
+	stream := f.Make("client1")
+	sinceTs := time.Now().Add(-2*time.Hour).UnixNano() / int64(time.Millisecond)
+	streamChan := stream.Start(sinceTs)
+	require.NoError(t, waitUntilClosed(streamChan))
+	err := stream.Error()
+	assert.True(t, etre.IsCDCPositionGone(err), "got error %v, expected etre.ErrCDCPositionGone", err)
+
+	// Within the retention window is ok
+	stream = f.Make("client2")
+	sinceTs = time.Now().Add(-30*time.Minute).UnixNano() / int64(time.Millisecond)
+	stream.Start(sinceTs)
+	select {
+	case <-stream.InSync():
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timeout waiting for InSync()")
+	}
+	assert.NoError(t, stream.Error())
+	stream.Stop()
+}
+
+func TestStreamFilter(t *testing.T) {
+	// Test subscribing with a filter: only events for the entity type that
+	// change the label are sent to the client, from backlog and current events
+	serverChan := make(chan etre.CDCEvent, 10)
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			return serverChan, nil
+		},
+	}
+	rack := etre.CDCEvent{Id: "r1", EntityId: "r1", EntityType: "rack", Ts: 150, Op: "i", New: &etre.Entity{"_id": "r1", "hostname": "rack1"}}
+	store := mock.CDCStore{
+		ReadFunc: func(f cdc.Filter) ([]etre.CDCEvent, error) {
+			return []etre.CDCEvent{events1[0], rack, events1[1]}, nil
+		},
+	}
+	stream := changestream.NewServerStream("client1", srv, store)
+	streamChan := stream.StartWith(changestream.StartOptions{
+		SinceTs: 100,
+		Filter: changestream.Filter{
+			EntityType: "node",
+			Labels:     []string{"hostname"},
+		},
+	})
+	defer stream.Stop()
+
+	select {
+	case <-stream.InSync():
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timeout waiting for InSync()")
+	}
+
+	// Current events: a node event that doesn't change hostname (filtered),
+	// another rack event (filtered), and a node event that changes hostname
+	noLabel := etre.CDCEvent{Id: "5", EntityId: "e1", EntityType: "node", EntityRev: 3, Ts: 400, Op: "u", New: &etre.Entity{"foo": "bar"}}
+	rack2 := etre.CDCEvent{Id: "r2", EntityId: "r1", EntityType: "rack", EntityRev: 1, Ts: 401, Op: "u", New: &etre.Entity{"hostname": "rack2"}}
+	node := etre.CDCEvent{Id: "6", EntityId: "e1", EntityType: "node", EntityRev: 4, Ts: 402, Op: "u", Old: &etre.Entity{"hostname": "host2"}, New: &etre.Entity{"hostname": "host4"}}
+	serverChan <- events1[2]
+	serverChan <- noLabel
+	serverChan <- rack2
+	serverChan <- node
+
+	expectEvents := []etre.CDCEvent{events1[0], events1[1], events1[2], node}
+	var gotEvents []etre.CDCEvent
+	for len(gotEvents) < len(expectEvents) {
+		select {
+		case e := <-streamChan:
+			gotEvents = append(gotEvents, e)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("timeout waiting for events, got %v", gotEvents)
+		}
+	}
+	assert.Equal(t, expectEvents, gotEvents)
+
+	// Unrelated events were not delivered
+	select {
+	case e := <-streamChan:
+		t.Errorf("got unexpected event: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStreamReplay(t *testing.T) {
+	// Test that replayed events are sent to the client in order after it's in
+	// sync, even though they're past revisions that revorder would ignore, and
+	// that the client's filter applies to them
+	serverChan := make(chan etre.CDCEvent, 10)
+	replayChan := make(chan []etre.CDCEvent, 1)
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			return serverChan, nil
+		},
+		ReplaysFunc: func(clientId string) <-chan []etre.CDCEvent {
+			return replayChan
+		},
+	}
+	store := mock.CDCStore{
+		ReadFunc: func(f cdc.Filter) ([]etre.CDCEvent, error) {
+			return events1, nil
+		},
+	}
+	stream := changestream.NewServerStream("client1", srv, store)
+	streamChan := stream.StartWith(changestream.StartOptions{
+		SinceTs: 1,
+		Filter:  changestream.Filter{EntityType: "node"},
+	})
+	defer stream.Stop()
+
+	var gotEvents []etre.CDCEvent
+	for len(gotEvents) < len(events1) {
+		select {
+		case e := <-streamChan:
+			gotEvents = append(gotEvents, e)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("timeout waiting for backlog, got %v", gotEvents)
+		}
+	}
+	select {
+	case <-stream.InSync():
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timeout waiting for InSync()")
+	}
+
+	// Replay events 1 and 2 again, plus an event filtered out
+	rack := etre.CDCEvent{Id: "r1", EntityId: "r1", EntityType: "rack", Ts: 150, Op: "i"}
+	replayChan <- []etre.CDCEvent{events1[1], rack, events1[2]}
+
+	gotEvents = nil
+	for len(gotEvents) < 2 {
+		select {
+		case e := <-streamChan:
+			gotEvents = append(gotEvents, e)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("timeout waiting for replayed events, got %v", gotEvents)
+		}
+	}
+	assert.Equal(t, events1[1:3], gotEvents)
+
+	// New events are still sent after the replay
+	next := etre.CDCEvent{Id: "5", EntityId: "e1", EntityType: "node", EntityRev: 4, Ts: 500, Op: "u"}
+	serverChan <- next
+	select {
+	case e := <-streamChan:
+		assert.Equal(t, next, e)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timeout waiting for new event after replay")
+	}
+}
+
+func TestStreamSlowConsumer(t *testing.T) {
+	// Test that the streamer stops with the reason the server closed the stream
+	serverChan := make(chan etre.CDCEvent)
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			return serverChan, nil
+		},
+		ErrFunc: func(clientId string) error {
+			return etre.ErrSlowConsumer
+		},
+	}
+	stream := changestream.NewServerStream("client1", srv, mock.CDCStore{})
+	streamChan := stream.Start(0)
+	select {
+	case <-stream.InSync():
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timeout waiting for InSync()")
+	}
+
+	close(serverChan) // server drops client
+	require.NoError(t, waitUntilClosed(streamChan))
+	assert.Equal(t, etre.ErrSlowConsumer, stream.Error())
+	assert.True(t, stream.Status().ServerClosedStream)
+}
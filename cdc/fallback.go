@@ -0,0 +1,314 @@
+// Copyright 2026, Square, Inc.
+
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+
+	"github.com/square/etre"
+)
+
+// Fallback file formats. Both are JSON lines: one JSON object per line.
+const (
+	// FALLBACK_FORMAT_EVENT writes the etre.CDCEvent. This is the default.
+	FALLBACK_FORMAT_EVENT = "event"
+
+	// FALLBACK_FORMAT_RECORD writes a FallbackRecord: the event, when it was
+	// written to the fallback file, and why it was not written to the data store.
+	FALLBACK_FORMAT_RECORD = "record"
+)
+
+// FALLBACK_ROTATE_TIME_FORMAT is the time format of the suffix of rotated fallback
+// files: <file>.<time>, like /tmp/etre-cdc.json.20260102T150405.000000000. The
+// time is UTC, and rotated files sort by name oldest to newest.
+const FALLBACK_ROTATE_TIME_FORMAT = "20060102T150405.000000000"
+
+// FallbackConfig configures the fallback file that Store.Write writes events to
+// when it cannot write them to the data store. Only File is required. The file
+// is rotated when it reaches MaxSize or MaxAge, whichever is first.
+type FallbackConfig struct {
+	File     string        // path to fallback file, or empty to disable
+	Format   string        // FALLBACK_FORMAT_EVENT (default) or FALLBACK_FORMAT_RECORD
+	MaxSize  int64         // rotate before the file exceeds this many bytes, or zero for no limit
+	MaxAge   time.Duration // rotate when the file is older than this, or zero for no limit
+	MaxFiles int           // number of rotated files to keep (the oldest are deleted), or zero to keep all
+}
+
+// FallbackRecord is a line in the fallback file with FALLBACK_FORMAT_RECORD.
+type FallbackRecord struct {
+	Ts    int64         `json:"ts"`    // Unix milliseconds when written to the fallback file
+	Error string        `json:"error"` // error writing the event to the data store
+	Event etre.CDCEvent `json:"event"`
+}
+
+// ReadFallbackFile returns the events in a fallback file, current or rotated,
+// in the order they were written. It reads both formats, and files written by
+// older versions of Etre that do not have one event per line.
+func ReadFallbackFile(file string) ([]etre.CDCEvent, error) {
+	events, _, err := readFallback(file)
+	return events, err
+}
+
+// readFallback returns the events in the fallback file and the raw JSON of each,
+// which is used to rewrite the file with the events not replayed.
+func readFallback(file string) ([]etre.CDCEvent, []json.RawMessage, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	events := []etre.CDCEvent{}
+	raws := []json.RawMessage{}
+	dec := json.NewDecoder(f)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, fmt.Errorf("invalid JSON in CDC fallback file %s after %d events: %s", file, len(events), err)
+		}
+
+		// Record (FALLBACK_FORMAT_RECORD) has the event, else it's the event
+		var rec struct {
+			Event *etre.CDCEvent `json:"event"`
+		}
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return nil, nil, fmt.Errorf("invalid event in CDC fallback file %s after %d events: %s", file, len(events), err)
+		}
+		var event etre.CDCEvent
+		if rec.Event != nil {
+			event = *rec.Event
+		} else if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, nil, fmt.Errorf("invalid event in CDC fallback file %s after %d events: %s", file, len(events), err)
+		}
+		events = append(events, event)
+		raws = append(raws, raw)
+	}
+	return events, raws, nil
+}
+
+// writeFallback appends the event to the fallback file, rotating the file first
+// if needed. werr is the error writing the event to the data store.
+func (s *store) writeFallback(event etre.CDCEvent, werr error) error {
+	var v interface{} = event
+	if s.fallback.Format == FALLBACK_FORMAT_RECORD {
+		v = FallbackRecord{
+			Ts:    time.Now().UnixMilli(),
+			Error: werr.Error(),
+			Event: event,
+		}
+	}
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("cannot marshal CDCEvent as JSON: %s", err)
+	}
+	line = append(line, '\n')
+
+	s.fallbackMux.Lock()
+	defer s.fallbackMux.Unlock()
+
+	if err := s.rotate(int64(len(line)), time.Now()); err != nil {
+		return fmt.Errorf("cannot rotate CDC fallback file: %s", err)
+	}
+
+	// If the file doesn't exist, create it, or append to the file.
+	f, err := os.OpenFile(s.fallback.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open CDC fallback file: %s", err)
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write to CDC fallback file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot close CDC fallback file: %s", err)
+	}
+	return nil
+}
+
+// rotate rotates the fallback file if writing n more bytes would exceed MaxSize,
+// or it's older than MaxAge. The caller must lock fallbackMux.
+func (s *store) rotate(n int64, now time.Time) error {
+	fi, err := os.Stat(s.fallback.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.fallbackCreated = now // file created by next write
+			return nil
+		}
+		return err
+	}
+	if s.fallbackCreated.IsZero() {
+		// File from before Etre started, so the best we know is when it was
+		// last written to
+		s.fallbackCreated = fi.ModTime()
+	}
+	tooBig := s.fallback.MaxSize > 0 && fi.Size() > 0 && fi.Size()+n > s.fallback.MaxSize
+	tooOld := s.fallback.MaxAge > 0 && now.Sub(s.fallbackCreated) >= s.fallback.MaxAge
+	if !tooBig && !tooOld {
+		return nil
+	}
+	return s.rotateFile(now)
+}
+
+// rotateFile renames the fallback file to <file>.<now>, then deletes the oldest
+// rotated files if there are more than MaxFiles. The caller must lock fallbackMux.
+func (s *store) rotateFile(now time.Time) error {
+	rotated := s.fallback.File + "." + now.UTC().Format(FALLBACK_ROTATE_TIME_FORMAT)
+	if err := os.Rename(s.fallback.File, rotated); err != nil {
+		return err
+	}
+	s.fallbackCreated = time.Time{}
+	if s.fallback.MaxFiles <= 0 {
+		return nil
+	}
+	files, err := s.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(files) > s.fallback.MaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// rotatedFiles returns the rotated fallback files, oldest first.
+func (s *store) rotatedFiles() ([]string, error) {
+	dir, base := filepath.Split(s.fallback.File)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range entries {
+		suffix, ok := strings.CutPrefix(e.Name(), base+".")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(FALLBACK_ROTATE_TIME_FORMAT, suffix); err != nil {
+			continue // not a rotated file
+		}
+		files = append(files, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *store) ReplayFallback(ctx context.Context) (int, error) {
+	if s.fallback.File == "" {
+		return 0, nil
+	}
+	s.replayMux.Lock()
+	defer s.replayMux.Unlock()
+
+	// Rotate the current file so events written while replaying go to a new
+	// file, which is replayed next time
+	s.fallbackMux.Lock()
+	_, err := os.Stat(s.fallback.File)
+	if err == nil {
+		err = s.rotateFile(time.Now())
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	var files []string
+	if err == nil {
+		files, err = s.rotatedFiles()
+	}
+	s.fallbackMux.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("cannot rotate CDC fallback file: %s", err)
+	}
+
+	n := 0
+	for _, file := range files {
+		m, err := s.replayFile(ctx, file)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// replayFile writes the events in the rotated fallback file to the data store,
+// then deletes the file. If writing an event fails, the file is rewritten with
+// the events not written, so they're replayed next time.
+func (s *store) replayFile(ctx context.Context, file string) (int, error) {
+	events, raws, err := readFallback(file)
+	if err != nil {
+		return 0, err
+	}
+	for i := range events {
+		if err := s.replay(ctx, events[i]); err != nil {
+			if i > 0 {
+				if rerr := rewriteFallback(file, raws[i:]); rerr != nil {
+					return i, fmt.Errorf("cannot rewrite CDC fallback file %s after error replaying event: %s (replay error: %s)", file, rerr, err)
+				}
+			}
+			return i, fmt.Errorf("cannot replay CDC fallback file %s: %s", file, err)
+		}
+	}
+	return len(events), os.Remove(file)
+}
+
+// replay writes the event to the data store, if it wasn't already written. An
+// event with a sequence number or id might have been written, for example if the
+// write timed out but succeeded. An event without a sequence number is assigned
+// the next one because the event was not written.
+func (s *store) replay(ctx context.Context, event etre.CDCEvent) error {
+	if event.Seq > 0 {
+		n, err := s.coll.CountDocuments(ctx, bson.M{"seq": event.Seq})
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return nil // already written
+		}
+	} else {
+		seq, err := s.nextSeq(ctx)
+		if err != nil {
+			return err
+		}
+		event.Seq = seq
+	}
+	if _, err := s.coll.InsertOne(ctx, event); err != nil {
+		if event.Id != "" && mongo.IsDuplicateKeyError(err) {
+			return nil // already written
+		}
+		return err
+	}
+	return nil
+}
+
+// rewriteFallback replaces the file with the given events, one per line.
+func rewriteFallback(file string, raws []json.RawMessage) error {
+	var buf bytes.Buffer
+	for _, raw := range raws {
+		buf.Write(raw)
+		buf.WriteByte('\n')
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,210 @@
+// Copyright 2026, Square, Inc.
+
+package cdc_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+)
+
+// offlineStore returns a store that cannot connect to MongoDB, so every event is
+// written to the fallback file.
+func offlineStore(t *testing.T, fallback cdc.FallbackConfig) cdc.Store {
+	client, err := mongo.Connect(options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(10 * time.Millisecond))
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return cdc.NewStoreWithFallback(client.Database("etre_test").Collection("cdc"), fallback, cdc.NoRetryPolicy)
+}
+
+// fallbackFiles returns the rotated fallback files, oldest first, and the current file.
+func fallbackFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	files := []string{}
+	for _, e := range entries {
+		files = append(files, filepath.Join(dir, e.Name()))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		// Current file (no rotated suffix) is last
+		if strings.HasSuffix(files[i], ".json") != strings.HasSuffix(files[j], ".json") {
+			return strings.HasSuffix(files[j], ".json")
+		}
+		return files[i] < files[j]
+	})
+	return files
+}
+
+func TestFallbackRotateSize(t *testing.T) {
+	// Test that the fallback file is rotated before it exceeds MaxSize, and that
+	// only MaxFiles rotated files are kept
+	events := make([]etre.CDCEvent, 7)
+	for i := range events {
+		events[i] = etre.CDCEvent{Id: fmt.Sprintf("e%d", i), EntityId: "e1", EntityRev: int64(i), Ts: 1000}
+	}
+	line, err := json.Marshal(events[0]) // all events are the same size
+	require.NoError(t, err)
+	maxSize := int64(2*(len(line)+1) + 1) // 2 events per file
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "etre-cdc.json")
+	cdcs := offlineStore(t, cdc.FallbackConfig{
+		File:     file,
+		MaxSize:  maxSize,
+		MaxFiles: 2,
+	})
+	for _, event := range events {
+		err := cdcs.Write(context.Background(), event)
+		require.Error(t, err) // MongoDB error even though written to the fallback file
+	}
+
+	// 7 events = 4 files (2+2+2+1), but only 2 rotated files are kept, so the
+	// first file (e0, e1) was deleted
+	files := fallbackFiles(t, dir)
+	require.Len(t, files, 3)
+	assert.Equal(t, file, files[2])
+	expectIds := [][]string{{"e2", "e3"}, {"e4", "e5"}, {"e6"}}
+	for i, f := range files {
+		fi, err := os.Stat(f)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, fi.Size(), maxSize, f)
+
+		events, err := cdc.ReadFallbackFile(f)
+		require.NoError(t, err)
+		gotIds := []string{}
+		for _, e := range events {
+			gotIds = append(gotIds, e.Id)
+		}
+		assert.Equal(t, expectIds[i], gotIds, f)
+	}
+
+	// Default format: one event per line
+	bytes, err := os.ReadFile(file)
+	require.NoError(t, err)
+	line, err = json.Marshal(events[6])
+	require.NoError(t, err)
+	assert.Equal(t, string(line)+"\n", string(bytes))
+}
+
+func TestFallbackRotateAge(t *testing.T) {
+	// Test that the fallback file is rotated when it's older than MaxAge, and
+	// the record format has the event and the MongoDB error
+	dir := t.TempDir()
+	file := filepath.Join(dir, "etre-cdc.json")
+	cdcs := offlineStore(t, cdc.FallbackConfig{
+		File:   file,
+		Format: cdc.FALLBACK_FORMAT_RECORD,
+		MaxAge: 50 * time.Millisecond,
+	})
+
+	e1 := etre.CDCEvent{Id: "e1", EntityId: "e1", Ts: 1000}
+	e2 := etre.CDCEvent{Id: "e2", EntityId: "e1", EntityRev: 1, Ts: 1001}
+	e3 := etre.CDCEvent{Id: "e3", EntityId: "e1", EntityRev: 2, Ts: 1002}
+	require.Error(t, cdcs.Write(context.Background(), e1))
+	require.Error(t, cdcs.Write(context.Background(), e2))
+	time.Sleep(100 * time.Millisecond)
+	require.Error(t, cdcs.Write(context.Background(), e3))
+
+	files := fallbackFiles(t, dir)
+	require.Len(t, files, 2)
+	events, err := cdc.ReadFallbackFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, []etre.CDCEvent{e1, e2}, events)
+
+	bytes, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(bytes), "}\n"), "no newline after record")
+	var rec cdc.FallbackRecord
+	require.NoError(t, json.Unmarshal(bytes, &rec))
+	assert.Equal(t, e3, rec.Event)
+	assert.NotEmpty(t, rec.Error)
+	assert.Greater(t, rec.Ts, time.Now().Add(-10*time.Second).UnixMilli())
+}
+
+func TestReadFallbackFileLegacy(t *testing.T) {
+	// Test that fallback files written by older versions, without a newline
+	// between events, can be read
+	file := filepath.Join(t.TempDir(), "etre-cdc.json")
+	err := os.WriteFile(file, []byte(`{"eventId":"e1","ts":1}{"eventId":"e2","ts":2}`), 0644)
+	require.NoError(t, err)
+	events, err := cdc.ReadFallbackFile(file)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "e1", events[0].Id)
+	assert.Equal(t, "e2", events[1].Id)
+
+	require.NoError(t, os.WriteFile(file, []byte(`{"eventId":"e1","ts":1}{"eventId":`), 0644))
+	_, err = cdc.ReadFallbackFile(file)
+	assert.Error(t, err)
+}
+
+func TestReplayFallback(t *testing.T) {
+	// Test that events in the current and rotated fallback files are written to
+	// the CDC collection, oldest first, and the files are deleted. An event that
+	// was already written (same seq) is not written again.
+	dir := t.TempDir()
+	file := filepath.Join(dir, "etre-cdc.json")
+	cdcs := setup(t, file, cdc.NoRetryPolicy)
+
+	// An event already in the CDC collection, but also in the fallback file,
+	// for example because the write timed out but succeeded
+	written := etre.CDCEvent{EntityId: "r1", EntityType: "node", Op: "i", Ts: 200}
+	require.NoError(t, cdcs.Write(context.TODO(), written))
+	events, err := cdcs.Read(cdc.Filter{SinceTs: 200, UntilTs: 201})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	written = events[0]
+
+	e1 := etre.CDCEvent{EntityId: "r1", EntityType: "node", Op: "u", EntityRev: 1, Ts: 201}
+	e2 := etre.CDCEvent{EntityId: "r1", EntityType: "node", Op: "u", EntityRev: 2, Ts: 202}
+	e3 := etre.CDCEvent{EntityId: "r1", EntityType: "node", Op: "d", EntityRev: 3, Ts: 203}
+	rotated := file + "." + time.Now().UTC().Format(cdc.FALLBACK_ROTATE_TIME_FORMAT)
+	writeLines(t, rotated, written, e1)
+	rec := cdc.FallbackRecord{Ts: 1, Error: "timeout", Event: e2}
+	writeLines(t, file, rec, e3)
+
+	n, err := cdcs.ReplayFallback(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Empty(t, fallbackFiles(t, dir))
+
+	events, err = cdcs.Read(cdc.Filter{SinceTs: 200, UntilTs: 300, Order: cdc.BySeqAsc{}})
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	assert.Equal(t, written, events[0])
+	for i, e := range []etre.CDCEvent{e1, e2, e3} {
+		got := events[i+1]
+		assert.Greater(t, got.Seq, events[i].Seq)
+		got.Id, got.Seq = "", 0
+		assert.Equal(t, e, got)
+	}
+
+	// Nothing to replay
+	n, err = cdcs.ReplayFallback(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func writeLines(t *testing.T, file string, v ...interface{}) {
+	f, err := os.Create(file)
+	require.NoError(t, err)
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, l := range v {
+		require.NoError(t, enc.Encode(l))
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2026, Square, Inc.
+
+package cdc
+
+import (
+	"github.com/square/etre"
+)
+
+// EntityAtRev returns the entity as of revision rev by replaying its CDC events.
+// See Replay.
+func EntityAtRev(events []etre.CDCEvent, rev int64) (etre.Entity, error) {
+	return Replay(events, func(e etre.CDCEvent) bool { return e.EntityRev <= rev })
+}
+
+// EntityAtTs returns the entity as of timestamp ts (Unix milliseconds, like
+// etre.CDCEvent.Ts): after the last event at or before ts. See Replay.
+func EntityAtTs(events []etre.CDCEvent, ts int64) (etre.Entity, error) {
+	return Replay(events, func(e etre.CDCEvent) bool { return e.Ts <= ts })
+}
+
+// Replay returns the entity reconstructed by replaying its CDC events, starting
+// from the insert event, while apply returns true. The events must be for one
+// entity sorted by ByEntityIdRevAsc, like Store.Read returns for a Filter with
+// EntityId and that order.
+//
+// The entity is nil if it did not exist yet (no events applied) or it was
+// deleted (including soft-deleted and not restored). If the insert event or
+// an event between it and the last applied event is missing, usually because
+// it's older than CDC retention, the error is etre.ErrCDCHistoryGone because
+// the entity cannot be reconstructed.
+func Replay(events []etre.CDCEvent, apply func(etre.CDCEvent) bool) (etre.Entity, error) {
+	var e etre.Entity
+	for i, event := range events {
+		if !apply(event) {
+			break
+		}
+		if i == 0 && (event.Op != "i" || event.EntityRev != 0) {
+			return nil, etre.ErrCDCHistoryGone.New("CDC event for insert of entity %s not found (first event: rev %d)", event.EntityId, event.EntityRev)
+		}
+		if i > 0 && event.EntityRev != events[i-1].EntityRev+1 {
+			return nil, etre.ErrCDCHistoryGone.New("CDC event for entity %s rev %d not found", event.EntityId, events[i-1].EntityRev+1)
+		}
+		switch event.Op {
+		case "i":
+			e = etre.Entity{}
+			if event.New != nil {
+				for k, v := range *event.New {
+					e[k] = v
+				}
+			}
+		case "u":
+			// Labels only in old were removed, labels in new were set
+			if event.Old != nil {
+				for k := range *event.Old {
+					if event.New == nil {
+						delete(e, k)
+					} else if _, ok := (*event.New)[k]; !ok {
+						delete(e, k)
+					}
+				}
+			}
+			if event.New != nil {
+				for k, v := range *event.New {
+					e[k] = v
+				}
+			}
+		case "d":
+			// Hard or soft delete. A later restore (update) removes _deleted.
+			e[etre.META_LABEL_DELETED] = event.Ts
+		}
+		e["_rev"] = event.EntityRev
+	}
+	if _, deleted := e[etre.META_LABEL_DELETED]; deleted {
+		return nil, nil
+	}
+	return e, nil
+}
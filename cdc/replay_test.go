@@ -0,0 +1,85 @@
+// Copyright 2026, Square, Inc.
+
+package cdc_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+)
+
+// Entity created, updated 3 times (set, change, remove label), soft-deleted, and restored
+var replayEvents = []etre.CDCEvent{
+	{Id: "e0", EntityId: "abc", EntityRev: 0, Op: "i", Ts: 10, New: &etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(0), "x": "a"}},
+	{Id: "e1", EntityId: "abc", EntityRev: 1, Op: "u", Ts: 20, Old: &etre.Entity{"y": nil}, New: &etre.Entity{"y": "b"}},
+	{Id: "e2", EntityId: "abc", EntityRev: 2, Op: "u", Ts: 30, Old: &etre.Entity{"x": "a"}, New: &etre.Entity{"x": "c"}},
+	{Id: "e3", EntityId: "abc", EntityRev: 3, Op: "u", Ts: 40, Old: &etre.Entity{"y": "b"}, New: &etre.Entity{}},
+	{Id: "e4", EntityId: "abc", EntityRev: 4, Op: "d", Ts: 50, Old: &etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(3), "x": "c"}},
+	{Id: "e5", EntityId: "abc", EntityRev: 5, Op: "u", Ts: 60, Old: &etre.Entity{"_deleted": int64(50)}, New: &etre.Entity{}},
+}
+
+func TestEntityAtRev(t *testing.T) {
+	// Test that intermediate revisions are reconstructed from a sequence of updates
+	expect := []etre.Entity{
+		{"_id": "abc", "_type": "node", "_rev": int64(0), "x": "a"},
+		{"_id": "abc", "_type": "node", "_rev": int64(1), "x": "a", "y": "b"},
+		{"_id": "abc", "_type": "node", "_rev": int64(2), "x": "c", "y": "b"},
+		{"_id": "abc", "_type": "node", "_rev": int64(3), "x": "c"},
+		nil, // deleted
+		{"_id": "abc", "_type": "node", "_rev": int64(5), "x": "c"}, // restored
+	}
+	for rev := range expect {
+		got, err := cdc.EntityAtRev(replayEvents, int64(rev))
+		require.NoError(t, err, "rev %d", rev)
+		assert.Equal(t, expect[rev], got, "rev %d", rev)
+	}
+
+	// Future rev is the current entity
+	got, err := cdc.EntityAtRev(replayEvents, 9)
+	require.NoError(t, err)
+	assert.Equal(t, expect[5], got)
+
+	// Events must not be modified
+	assert.Equal(t, &etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(0), "x": "a"}, replayEvents[0].New)
+}
+
+func TestEntityAtTs(t *testing.T) {
+	// Before insert: did not exist
+	got, err := cdc.EntityAtTs(replayEvents, 5)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	// Between updates: as of last event at or before ts
+	got, err = cdc.EntityAtTs(replayEvents, 35)
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(2), "x": "c", "y": "b"}, got)
+	got, err = cdc.EntityAtTs(replayEvents, 40)
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(3), "x": "c"}, got)
+
+	// Deleted
+	got, err = cdc.EntityAtTs(replayEvents, 55)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestEntityAtHistoryGone(t *testing.T) {
+	// Test that missing events (older than retention) is ErrCDCHistoryGone
+	_, err := cdc.EntityAtRev(replayEvents[2:], 3) // insert gone
+	require.Error(t, err)
+	assert.Equal(t, etre.ErrCDCHistoryGone.Type, err.(etre.Error).Type)
+
+	gap := []etre.CDCEvent{replayEvents[0], replayEvents[1], replayEvents[3]}
+	_, err = cdc.EntityAtRev(gap, 3)
+	require.Error(t, err)
+	assert.Equal(t, etre.ErrCDCHistoryGone.Type, err.(etre.Error).Type)
+
+	// Missing events after the rev don't matter
+	got, err := cdc.EntityAtRev(gap, 1)
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_id": "abc", "_type": "node", "_rev": int64(1), "x": "a", "y": "b"}, got)
+}
@@ -5,10 +5,9 @@ package cdc
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"os"
 	"sort"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -21,10 +20,17 @@ import (
 // Filter contains fields that are used to filter events that the CDC reads.
 // Unset fields are ignored.
 type Filter struct {
-	SinceTs int64 // Only read events that have a timestamp greater than or equal to this value.
-	UntilTs int64 // Only read events that have a timestamp less than this value.
-	Limit   int64
-	Order   sort.Interface
+	SinceTs    int64  // Only read events that have a timestamp greater than or equal to this value.
+	UntilTs    int64  // Only read events that have a timestamp less than this value.
+	EntityId   string // Only read events for this entity.
+	EntityType string // Only read events for this entity type.
+	EventId    string // Only read the event with this id. SinceTs and UntilTs are ignored.
+	SkipId     string // Do not read the event with this id.
+	SinceSeq   int64  // Only read events that have a sequence number greater than this value. SinceTs is ignored.
+	UntilSeq   int64  // Only read events that have a sequence number less than this value. SinceTs is ignored.
+	Seq        int64  // Only read the event with this sequence number. SinceTs and UntilTs are ignored.
+	Limit      int64  // Only read the most recent events: by entityRev if EntityId is set, else by ts.
+	Order      sort.Interface
 }
 
 // NoFilter is a convenience var for calls like Read(cdc.NoFilter). Other
@@ -64,6 +70,14 @@ func (a ByTsAsc) Len() int           { return len(a) }
 func (a ByTsAsc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByTsAsc) Less(i, j int) bool { return a[i].Ts < a[j].Ts }
 
+// BySeqAsc sorts a slice of etre.CDCEvent by Seq ascending, which is the order
+// in which the events were written.
+type BySeqAsc []etre.CDCEvent
+
+func (a BySeqAsc) Len() int           { return len(a) }
+func (a BySeqAsc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a BySeqAsc) Less(i, j int) bool { return a[i].Seq < a[j].Seq }
+
 // A Store reads and writes CDC events to/from a persistent data store.
 type Store interface {
 	// Write writes the CDC event to a persisitent data store. If writing
@@ -71,43 +85,128 @@ type Store interface {
 	// the event is written to the fallbackFile. An error is returned if
 	// writing to the persistent data store fails, even if writing to
 	// fallback file succeeds.
+	//
+	// If the event does not have a sequence number (etre.CDCEvent.Seq), the
+	// next one is assigned before writing it.
+	//
+	// If the context has a MongoDB session in a transaction (the entity store
+	// with config.EntityConfig.Transactions), the event is written once in the
+	// transaction: it's not retried or written to the fallbackFile because an
+	// error aborts the transaction, so the entity write is not committed either.
 	Write(context.Context, etre.CDCEvent) error
 
 	// Read queries a persistent data store for events that satisfy the
 	// given filter.
 	Read(Filter) ([]etre.CDCEvent, error)
+
+	// Purge deletes events with a timestamp less than beforeTs (Unix milliseconds)
+	// and returns the number of events deleted. The server calls it periodically
+	// to enforce config.CDCConfig.Retention.
+	Purge(ctx context.Context, beforeTs int64) (int64, error)
+
+	// ReplayFallback writes the events in the fallback file and rotated fallback
+	// files to the persistent data store, oldest first, and returns the number
+	// of events replayed. Events already written, like an event that timed out
+	// but was written, are not written again. Replayed files are deleted. If
+	// writing an event fails, it stops and returns the error, and the unwritten
+	// events are replayed next time. The server calls it periodically while
+	// connected to the CDC database.
+	ReplayFallback(context.Context) (int, error)
 }
 
+// SEQ_COLLECTION_SUFFIX is appended to the CDC collection name to make the name
+// of the collection that has the sequence number counter: "cdc_seq" for "cdc".
+const SEQ_COLLECTION_SUFFIX = "_seq"
+
 // mongoStore implements the Store interface with MongoDB.
 type store struct {
-	coll         *mongo.Collection
-	wrp          RetryPolicy // retry policy for writing CDC events to Mongo
-	fallbackFile string      // path to file that CDC events are written to if we can't write to Mongo
+	coll     *mongo.Collection
+	seqColl  *mongo.Collection // sequence number counter, see nextSeq
+	wrp      RetryPolicy       // retry policy for writing CDC events to Mongo
+	fallback FallbackConfig    // file that CDC events are written to if we can't write to Mongo
+	// --
+	fallbackMux     *sync.Mutex // guards fallback file writes and rotation
+	fallbackCreated time.Time   // when the fallback file was created, for MaxAge
+	replayMux       *sync.Mutex // serializes ReplayFallback
 }
 
+// NewStore returns a Store that reads and writes CDC events in coll. Sequence
+// numbers are assigned from a counter document in a collection in the same
+// database named like coll plus SEQ_COLLECTION_SUFFIX, so they are globally
+// ordered across all Etre instances.
 func NewStore(coll *mongo.Collection, fallbackFile string, writeRetryPolicy RetryPolicy) Store {
+	return NewStoreWithFallback(coll, FallbackConfig{File: fallbackFile}, writeRetryPolicy)
+}
+
+// NewStoreWithFallback returns a Store like NewStore with additional fallback
+// file options, like rotation.
+func NewStoreWithFallback(coll *mongo.Collection, fallback FallbackConfig, writeRetryPolicy RetryPolicy) Store {
+	if fallback.Format == "" {
+		fallback.Format = FALLBACK_FORMAT_EVENT
+	}
 	return &store{
-		coll:         coll,
-		fallbackFile: fallbackFile,
-		wrp:          writeRetryPolicy,
+		coll:        coll,
+		seqColl:     coll.Database().Collection(coll.Name() + SEQ_COLLECTION_SUFFIX),
+		fallback:    fallback,
+		wrp:         writeRetryPolicy,
+		fallbackMux: &sync.Mutex{},
+		replayMux:   &sync.Mutex{},
 	}
 }
 
 func (s *store) Read(f Filter) ([]etre.CDCEvent, error) {
-	if f.SinceTs == 0 {
-		f.SinceTs = time.Now().Add(-1 * time.Hour).UnixNano()
+	q := bson.M{}
+	if f.EventId != "" {
+		q["_id"] = eventId(f.EventId)
+	} else if f.Seq > 0 {
+		q["seq"] = f.Seq
+	} else if f.SinceSeq > 0 || f.UntilSeq > 0 {
+		seq := bson.M{}
+		if f.SinceSeq > 0 {
+			seq["$gt"] = f.SinceSeq
+		}
+		if f.UntilSeq > 0 {
+			seq["$lt"] = f.UntilSeq
+		}
+		q["seq"] = seq
+		if f.UntilTs > 0 {
+			q["ts"] = bson.M{"$lt": f.UntilTs}
+		}
+	} else {
+		if f.SinceTs == 0 {
+			f.SinceTs = time.Now().Add(-1 * time.Hour).UnixNano()
+		}
+		ts := bson.M{"$gte": f.SinceTs}
+		if f.UntilTs > 0 {
+			ts["$lt"] = f.UntilTs
+		}
+		q["ts"] = ts
+	}
+	if f.SkipId != "" {
+		// Don't replace the EventId, if any: the event must be it and not SkipId
+		skip := bson.M{"$ne": eventId(f.SkipId)}
+		if id, ok := q["_id"]; ok {
+			q["$and"] = bson.A{bson.M{"_id": id}, bson.M{"_id": skip}}
+			delete(q, "_id")
+		} else {
+			q["_id"] = skip
+		}
+	}
+	if f.EntityId != "" {
+		q["entityId"] = f.EntityId
 	}
-	ts := bson.M{"$gte": f.SinceTs}
-	if f.UntilTs > 0 {
-		ts["$lt"] = f.UntilTs
+	if f.EntityType != "" {
+		q["entityType"] = f.EntityType
 	}
-	q := bson.M{"ts": ts}
 
 	// Count number of docs we're about to fetch so we can make a slice of
 	// etre.CDC to match so, below, cursor.All() doesn't have to realloc the
 	// slice. For small fetches, this is overkill, but it makes large fetchs
 	// (>100k events) very quick and efficient.
 	opts := options.Count()
+	if f.Limit > 0 {
+		opts.SetLimit(f.Limit)
+	}
 	cctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	count, err := s.coll.CountDocuments(cctx, q, opts)
@@ -119,7 +218,18 @@ func (s *store) Read(f Filter) ([]etre.CDCEvent, error) {
 	// collection of ~200k CDC events shows that Mongo will use the biggest
 	// and fewest batches possible. We don't want a limit, we want all results.
 	// And we offload sorting from Mongo to Etre which can scale out more easily.
-	cursor, err := s.coll.Find(context.TODO(), q)
+	// The exception is Filter.Limit: Mongo must sort to return the most recent
+	// events, but there are at most Limit.
+	fopts := options.Find()
+	if f.Limit > 0 {
+		if f.EntityId != "" {
+			fopts.SetSort(bson.D{{Key: "entityRev", Value: -1}})
+		} else {
+			fopts.SetSort(bson.D{{Key: "ts", Value: -1}, {Key: "_id", Value: -1}})
+		}
+		fopts.SetLimit(f.Limit)
+	}
+	cursor, err := s.coll.Find(context.TODO(), q, fopts)
 	if err != nil {
 		return nil, err
 	}
@@ -138,19 +248,85 @@ func (s *store) Read(f Filter) ([]etre.CDCEvent, error) {
 			sort.Sort(ByEntityIdRevAsc(events))
 		case ByTsAsc:
 			sort.Sort(ByTsAsc(events))
+		case BySeqAsc:
+			sort.Sort(BySeqAsc(events))
 		default:
-			panic(fmt.Sprintf("invalid cdc.Filter.Order value type: %T, expected cdc.ByEntityIdRevAsc or cdc.ByTsAsc", f.Order))
+			panic(fmt.Sprintf("invalid cdc.Filter.Order value type: %T, expected cdc.ByEntityIdRevAsc, cdc.ByTsAsc, or cdc.BySeqAsc", f.Order))
 		}
 	}
 
 	return events, nil
 }
 
+func (s *store) Purge(ctx context.Context, beforeTs int64) (int64, error) {
+	res, err := s.coll.DeleteMany(ctx, bson.M{"ts": bson.M{"$lt": beforeTs}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// eventId returns the MongoDB _id of the event. Event ids are ObjectIDs created
+// by MongoDB on insert, returned as hex strings in etre.CDCEvent.Id.
+func eventId(id string) interface{} {
+	if oid, err := bson.ObjectIDFromHex(id); err == nil {
+		return oid
+	}
+	return id
+}
+
+// nextSeq returns the next sequence number by incrementing the counter document,
+// which is created on first use. In a transaction, the counter is incremented in
+// the transaction, so concurrent transactions conflict and are retried, and the
+// sequence numbers of committed events are in commit order. Without a transaction,
+// the number is reserved before the event is inserted, so concurrent writers can
+// commit events out of sequence order, and a reader can see seq 6 before seq 5.
+// Therefore, resuming a feed by sequence number is safe only with transactions.
+// Sequence numbers are strictly increasing but not contiguous: a number is not
+// reused if writing the event fails.
+//
+// There is one counter for all entity types, so sequence numbers serialize all
+// writes with transactions: a transaction holds the counter until it commits,
+// and a concurrent transaction that increments it gets a WriteConflict and is
+// retried by the driver (see entity.DbError.Unwrap). Concurrent writes succeed,
+// but only one commits at a time.
+func (s *store) nextSeq(ctx context.Context) (int64, error) {
+	var counter struct {
+		N int64 `bson:"n"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := s.seqColl.FindOneAndUpdate(ctx, bson.M{"_id": "seq"}, bson.M{"$inc": bson.M{"n": int64(1)}}, opts).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.N, nil
+}
+
 func (s *store) Write(ctx context.Context, event etre.CDCEvent) error {
+	if sess := mongo.SessionFromContext(ctx); sess != nil {
+		// In transaction
+		if event.Seq == 0 {
+			seq, err := s.nextSeq(ctx)
+			if err != nil {
+				return err
+			}
+			event.Seq = seq
+		}
+		_, err := s.coll.InsertOne(ctx, event)
+		return err
+	}
+
 	var werr error
 	tries := 1 + s.wrp.RetryCount
 	for tryNo := 1; tryNo <= tries; tryNo++ {
-		if _, werr = s.coll.InsertOne(ctx, event); werr != nil {
+		// Assign the sequence number once: if inserting fails, retry with the same one
+		if event.Seq == 0 {
+			event.Seq, werr = s.nextSeq(ctx)
+		}
+		if werr == nil {
+			_, werr = s.coll.InsertOne(ctx, event)
+		}
+		if werr != nil {
 			if ctxErr := ctx.Err(); ctxErr != nil {
 				break // don't retry when context is done
 			}
@@ -173,26 +349,11 @@ func (s *store) Write(ctx context.Context, event etre.CDCEvent) error {
 	// specified, try to write the event to that file. Even if we succeed
 	// at writing to the file, return an error so that the caller knows
 	// there was a problem.
-	if s.fallbackFile == "" {
+	if s.fallback.File == "" {
 		return werr
 	}
-
-	bytes, ferr := json.Marshal(event)
-	if ferr != nil {
-		return fmt.Errorf("cannot marshal CDCEvent as JSON: %s", ferr)
-	}
-
-	// If the file doesn't exist, create it, or append to the file.
-	f, ferr := os.OpenFile(s.fallbackFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if ferr != nil {
-		return fmt.Errorf("cannot open CDC fallback file: %s", ferr)
-	}
-	if _, ferr := f.Write(bytes); ferr != nil {
-		return fmt.Errorf("cannot write to CDC fallback file: %s", ferr)
+	if ferr := s.writeFallback(event, werr); ferr != nil {
+		return ferr
 	}
-	if ferr := f.Close(); ferr != nil {
-		return fmt.Errorf("cannot close CDC fallback file: %s", ferr)
-	}
-
 	return werr
 }
@@ -5,9 +5,11 @@ package cdc_test
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"sort"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -110,6 +112,89 @@ func TestRead(t *testing.T) {
 	assert.Equal(t, expectedIds, actualIds)
 }
 
+func TestReadEventId(t *testing.T) {
+	cdcs := setup(t, "", cdc.NoRetryPolicy)
+
+	// Read one event by id, which ignores the default SinceTs
+	events, err := cdcs.Read(cdc.Filter{EventId: "p34"})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, int64(22), events[0].Ts)
+
+	events, err = cdcs.Read(cdc.Filter{EventId: "gone"})
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	// Resume after an event: same Ts but not the event
+	filter := cdc.Filter{
+		SinceTs: 35,
+		SkipId:  "vb0",
+		Order:   cdc.ByTsAsc{},
+	}
+	events, err = cdcs.Read(filter)
+	require.NoError(t, err)
+	actualIds := []string{}
+	for _, event := range events {
+		actualIds = append(actualIds, event.Id)
+	}
+	assert.Equal(t, []string{"bnu", "qwp", "61p", "2oi"}, actualIds)
+
+	// SkipId doesn't replace EventId: the event is read only if it isn't skipped
+	events, err = cdcs.Read(cdc.Filter{EventId: "p34", SkipId: "vb0"})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "p34", events[0].Id)
+	events, err = cdcs.Read(cdc.Filter{EventId: "p34", SkipId: "p34"})
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestReadEntityTypeLimit(t *testing.T) {
+	cdcs := setup(t, "", cdc.NoRetryPolicy)
+
+	// Most recent events by rev for an entity, returned in the given order
+	ids := func(events []etre.CDCEvent) []string {
+		actualIds := []string{}
+		for _, event := range events {
+			actualIds = append(actualIds, event.Id)
+		}
+		return actualIds
+	}
+	events, err := cdcs.Read(cdc.Filter{SinceTs: 1, EntityId: "e1", Limit: 2, Order: cdc.ByEntityIdRevAsc{}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"61p", "qwp"}, ids(events))
+
+	// Most recent events by ts
+	events, err = cdcs.Read(cdc.Filter{SinceTs: 1, Limit: 3, Order: cdc.ByTsAsc{}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"qwp", "61p", "2oi"}, ids(events))
+
+	// Only events for the entity type
+	err = cdcs.Write(context.TODO(), etre.CDCEvent{EntityId: "e1", EntityType: "host", EntityRev: 4, Ts: 50})
+	require.NoError(t, err)
+	events, err = cdcs.Read(cdc.Filter{SinceTs: 1, EntityId: "e1", EntityType: "host"})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, int64(4), events[0].EntityRev)
+}
+
+func TestPurge(t *testing.T) {
+	cdcs := setup(t, "", cdc.NoRetryPolicy)
+
+	// Events with old timestamps (Ts < 35) are deleted; others are kept
+	n, err := cdcs.Purge(context.TODO(), 35)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+
+	events, err := cdcs.Read(cdc.Filter{SinceTs: 1})
+	require.NoError(t, err)
+	actualIds := []string{}
+	for _, event := range events {
+		actualIds = append(actualIds, event.Id)
+	}
+	assert.ElementsMatch(t, []string{"vb0", "bnu", "qwp", "61p", "2oi"}, actualIds)
+}
+
 func TestWriteSuccess(t *testing.T) {
 	cdcs := setup(t, "", cdc.NoRetryPolicy)
 
@@ -154,10 +239,143 @@ func TestWriteSuccess(t *testing.T) {
 	require.NoError(t, err)
 	actualEvents[0].Id = ""
 
+	// Write assigns the next sequence number, which depends on previous tests
+	assert.Greater(t, actualEvents[0].Seq, int64(0))
+	event.Seq = actualEvents[0].Seq
+
 	// Compare the rest of the event
 	assert.Equal(t, event, actualEvents[0])
 }
 
+func TestWriteSeq(t *testing.T) {
+	// Test that a burst of concurrent writes get unique, strictly increasing
+	// sequence numbers: in the order each writer wrote its events, and without
+	// duplicates across writers
+	cdcs := setup(t, "", cdc.NoRetryPolicy)
+
+	writers := 4
+	n := 25
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*n)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				event := etre.CDCEvent{Ts: 100, EntityId: fmt.Sprintf("w%d", w), EntityRev: int64(i)}
+				if err := cdcs.Write(context.TODO(), event); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	events, err := cdcs.Read(cdc.Filter{SinceTs: 100, UntilTs: 101, Order: cdc.BySeqAsc{}})
+	require.NoError(t, err)
+	require.Len(t, events, writers*n)
+	lastRev := map[string]int64{}
+	for i, e := range events {
+		if i > 0 {
+			assert.Greater(t, e.Seq, events[i-1].Seq, "event %d", i)
+		}
+		if rev, ok := lastRev[e.EntityId]; ok {
+			assert.Equal(t, rev+1, e.EntityRev, "writer %s events out of order by seq", e.EntityId)
+		}
+		lastRev[e.EntityId] = e.EntityRev
+	}
+
+	// Resume after the 10th event by sequence number
+	resume, err := cdcs.Read(cdc.Filter{SinceSeq: events[9].Seq, Order: cdc.BySeqAsc{}})
+	require.NoError(t, err)
+	assert.Equal(t, events[10:], resume)
+
+	got, err := cdcs.Read(cdc.Filter{Seq: events[9].Seq})
+	require.NoError(t, err)
+	assert.Equal(t, events[9:10], got)
+}
+
+func TestWriteSeqResume(t *testing.T) {
+	// Test that a reader resuming by sequence number while writers write events
+	// concurrently in transactions doesn't miss events: in a transaction, events
+	// are committed in sequence order, so a reader never sees seq N+1 before N
+	cdcs := setup(t, "", cdc.NoRetryPolicy)
+
+	inTxn := func(fn func(context.Context) error) error {
+		sess, err := client.StartSession()
+		if err != nil {
+			return err
+		}
+		defer sess.EndSession(context.TODO())
+		_, err = sess.WithTransaction(context.TODO(), func(ctx context.Context) (interface{}, error) {
+			return nil, fn(ctx)
+		})
+		return err
+	}
+	if err := inTxn(func(ctx context.Context) error { return nil }); err != nil {
+		t.Skipf("transactions not supported: %s", err)
+	}
+
+	writers := 4
+	n := 25
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*n)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				event := etre.CDCEvent{Ts: 200, EntityId: fmt.Sprintf("w%d", w), EntityRev: int64(i)}
+				if err := inTxn(func(ctx context.Context) error { return cdcs.Write(ctx, event) }); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	writing := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(writing)
+	}()
+
+	// Read and resume from the last event read, like a CDC feed, until writers
+	// are done and the last read returns nothing new
+	var got []etre.CDCEvent
+	var lastSeq int64
+	done := false
+	for {
+		events, err := cdcs.Read(cdc.Filter{SinceSeq: lastSeq, Order: cdc.BySeqAsc{}})
+		require.NoError(t, err)
+		if len(events) > 0 {
+			got = append(got, events...)
+			lastSeq = events[len(events)-1].Seq
+			continue
+		}
+		if done {
+			break
+		}
+		select {
+		case <-writing:
+			done = true // one more read to get the last events
+		default:
+		}
+	}
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// All events read once, in seq order
+	all, err := cdcs.Read(cdc.Filter{SinceTs: 200, UntilTs: 201, Order: cdc.BySeqAsc{}})
+	require.NoError(t, err)
+	require.Len(t, all, writers*n)
+	assert.Equal(t, all, got)
+}
+
 func TestWriteFallbackFile(t *testing.T) {
 	fallbackFile, err := ioutil.TempFile("", "etre-cdc-test.json")
 	require.NoError(t, err)
@@ -182,6 +400,8 @@ func TestWriteFallbackFile(t *testing.T) {
 	if err := json.Unmarshal(bytes, &gotEvent); err != nil {
 		t.Fatal(err)
 	}
+	assert.Greater(t, gotEvent.Seq, int64(0)) // assigned before writing
+	gotEvent.Seq = 0
 	assert.Equal(t, event, gotEvent)
 }
 
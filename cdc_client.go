@@ -29,6 +29,16 @@ type CDCClient interface {
 	// Error returns the error.
 	Start(time.Time) (<-chan CDCEvent, error)
 
+	// StartFrom starts the CDC feed from the given position. Start(t) is the
+	// same as StartFrom(CDCPosition{Ts: t}). To resume a feed, pass the last
+	// Position of the previous feed.
+	StartFrom(CDCPosition) (<-chan CDCEvent, error)
+
+	// Position returns the position of the last event sent on the feed channel.
+	// It is the position from which the client resumes after a reconnect. The
+	// caller can save it to resume the feed in a new client by calling StartFrom.
+	Position() CDCPosition
+
 	// Stop stops the feed and closes the feed channel returned by Start. It is
 	// safe to call multiple times.
 	Stop()
@@ -38,10 +48,71 @@ type CDCClient interface {
 	Ping(timeout time.Duration) Latency
 
 	// Error returns the error that caused the feed channel to be closed. Start
-	// resets the error.
+	// resets the error. If the start position is no longer available, the error
+	// is etre.ErrCDCPositionGone (check with etre.IsCDCPositionGone).
 	Error() error
 }
 
+// CDCPosition is a position in the CDC feed. The zero value is now (start
+// with new events). If only Ts is set, the feed starts with events at or after
+// Ts. If Id is set, too, it's the event at Ts after which the feed starts: the
+// feed starts at Ts but does not resend event Id. Other events with the same
+// Ts (milliseconds) can be sent again, so consumers should be idempotent, for
+// example by ignoring events with an EntityRev already seen. If event Id no
+// longer exists, the feed returns ErrCDCPositionGone.
+//
+// If Seq is set, the feed starts after the event with this sequence number
+// (CDCEvent.Seq), and Ts and Id are ignored. Unlike Ts, sequence numbers do not
+// collide, so events are not sent again. Events written concurrently can be
+// received out of Seq order, so Seq is the highest sequence number received.
+// Starting from Seq requires the server to write entities and CDC events in
+// transactions (entity.transactions config), else the feed returns ErrCDCSeqDisabled.
+type CDCPosition struct {
+	Ts  time.Time
+	Id  string
+	Seq int64
+}
+
+// CDCClientConfig configures a CDCClient made by NewCDCClientWithConfig.
+type CDCClientConfig struct {
+	// Addr is the websocket address: ws://host:port or wss://host:port.
+	Addr string
+
+	TLSConfig *tls.Config
+
+	// BufferSize is the size of the feed channel. See NewCDCClient.
+	BufferSize int
+
+	// Reconnect the feed if the connection is lost or the API disconnects the
+	// client because it's too slow (ErrSlowConsumer). The client resumes from
+	// its Position, so the caller receives events on the same feed channel
+	// without missing or repeating events (except as noted for CDCPosition).
+	// If false (default), the feed channel is closed when the connection is lost.
+	Reconnect bool
+
+	// ReconnectWait is the time to wait before each reconnect try. If zero,
+	// DEFAULT_CDC_RECONNECT_WAIT is used.
+	ReconnectWait time.Duration
+
+	// MaxReconnectTries is the maximum number of consecutive reconnect tries.
+	// If reached, the feed channel is closed and Error returns the last error.
+	// If zero, the client tries to reconnect until Stop is called.
+	MaxReconnectTries int
+
+	// EntityType subscribes to events for only this entity type. The API
+	// filters events, so other events are not sent to the client.
+	EntityType string
+
+	// Labels subscribes to events that change at least one of these labels.
+	// Insert and delete events have all labels of the entity.
+	Labels []string
+
+	// Debug prints a lot of low-level feed/websocket logging to STDERR.
+	Debug bool
+}
+
+const DEFAULT_CDC_RECONNECT_WAIT = 1 * time.Second
+
 var _ CDCClient = &cdcClient{}
 
 // Internal implementation of CDCClient over a websocket.
@@ -50,15 +121,24 @@ type cdcClient struct {
 	tlsConfig  *tls.Config
 	bufferSize int
 	dbg        bool
+	cfg        CDCClientConfig
 	// --
 	*sync.Mutex             // guard function calls
 	wsMutex     *sync.Mutex // guard ws send/write
 	wsConn      *websocket.Conn
 	events      chan CDCEvent
-	err         error        // last error in recv()
-	started     bool         // Start called and successful
-	stopped     bool         // Stop called
-	pingChan    chan Latency // for Ping
+	err         error         // last error in recv()
+	started     bool          // Start called and successful
+	stopped     bool          // Stop called
+	stopChan    chan struct{} // closed by Stop to stop reconnecting
+	pingChan    chan Latency  // for Ping
+	// --
+	posMutex *sync.Mutex     // guard position
+	posTs    int64           // Ts (milliseconds) of last event sent to caller
+	posId    string          // Id of last event sent to caller
+	posIds   map[string]bool // Ids of events at posTs sent to caller
+	posSeq   int64           // highest Seq of events sent to caller
+	bySeq    bool            // resume from posSeq, not posTs and posId
 }
 
 // NewCDCClient creates a CDC feed consumer on the given websocket address.
@@ -73,22 +153,42 @@ type cdcClient struct {
 // The client does not automatically ping the server. The caller should run a
 // separate goroutine to periodically call Ping. Every 10-60s is reasonable.
 func NewCDCClient(addr string, tlsConfig *tls.Config, bufferSize int, debug bool) CDCClient {
-	addr += API_ROOT + "/changes"
+	return NewCDCClientWithConfig(CDCClientConfig{
+		Addr:       addr,
+		TLSConfig:  tlsConfig,
+		BufferSize: bufferSize,
+		Debug:      debug,
+	})
+}
+
+// NewCDCClientWithConfig creates a CDC feed consumer like NewCDCClient with
+// additional options, like reconnecting when the connection is lost.
+func NewCDCClientWithConfig(cfg CDCClientConfig) CDCClient {
+	if cfg.ReconnectWait <= 0 {
+		cfg.ReconnectWait = DEFAULT_CDC_RECONNECT_WAIT
+	}
+	addr := cfg.Addr + API_ROOT + "/changes"
 	c := &cdcClient{
 		addr:       addr,
-		tlsConfig:  tlsConfig,
-		bufferSize: bufferSize,
-		dbg:        debug,
+		tlsConfig:  cfg.TLSConfig,
+		bufferSize: cfg.BufferSize,
+		dbg:        cfg.Debug,
+		cfg:        cfg,
 		// --
 		Mutex:    &sync.Mutex{},
 		wsMutex:  &sync.Mutex{},
 		pingChan: make(chan Latency, 1),
+		posMutex: &sync.Mutex{},
 	}
 	c.debug("addr: %s", addr)
 	return c
 }
 
 func (c *cdcClient) Start(startTime time.Time) (<-chan CDCEvent, error) {
+	return c.StartFrom(CDCPosition{Ts: startTime})
+}
+
+func (c *cdcClient) StartFrom(pos CDCPosition) (<-chan CDCEvent, error) {
 	c.debug("Start call")
 	defer c.debug("Start return")
 	c.Lock()
@@ -100,7 +200,53 @@ func (c *cdcClient) Start(startTime time.Time) (<-chan CDCEvent, error) {
 		return c.events, nil
 	}
 
-	// Connect
+	c.posMutex.Lock()
+	c.posTs = 0
+	if !pos.Ts.IsZero() {
+		c.posTs = pos.Ts.UnixNano() / int64(time.Millisecond)
+	}
+	c.posId = pos.Id
+	c.posIds = map[string]bool{}
+	if pos.Id != "" {
+		c.posIds[pos.Id] = true
+	}
+	c.posSeq = pos.Seq
+	c.bySeq = pos.Seq > 0
+	c.posMutex.Unlock()
+
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	c.wsConn = conn
+
+	// Start consuming CDC feed
+	c.debug("cdc feed started")
+	c.started = true
+	c.stopped = false
+	c.stopChan = make(chan struct{})
+	c.err = nil
+	c.events = make(chan CDCEvent, c.bufferSize)
+	go c.recv()
+
+	return c.events, nil
+}
+
+func (c *cdcClient) Position() CDCPosition {
+	c.posMutex.Lock()
+	defer c.posMutex.Unlock()
+	var pos CDCPosition
+	if c.posTs > 0 {
+		pos.Ts = time.Unix(0, c.posTs*int64(time.Millisecond))
+	}
+	pos.Id = c.posId
+	pos.Seq = c.posSeq
+	return pos
+}
+
+// connect connects to the API and does the start sequence: send start control
+// message from the current position and receive the start ack.
+func (c *cdcClient) connect() (*websocket.Conn, error) {
 	u, err := url.Parse(c.addr)
 	if err != nil {
 		return nil, err
@@ -119,46 +265,82 @@ func (c *cdcClient) Start(startTime time.Time) (<-chan CDCEvent, error) {
 		}
 		return nil, fmt.Errorf("websocket.DefaultDialer.Dial(%s): %s", u.String(), err)
 	}
-	c.wsConn = conn
-
-	startTs := int64(0)
-	if !startTime.IsZero() {
-		startTs = startTime.UnixNano() / int64(time.Millisecond)
-	}
 
-	// Send start control message
+	// Send start control message. Not concurrent yet, so don't need send()
+	c.posMutex.Lock()
 	start := map[string]interface{}{
 		"control": "start",
-		"startTs": startTs,
+		"startTs": c.posTs,
 	}
+	if c.bySeq {
+		start["startSeq"] = c.posSeq // API starts after this event
+	} else if c.posId != "" {
+		start["startId"] = c.posId // API starts after this event
+	}
+	if c.cfg.EntityType != "" {
+		start["entityType"] = c.cfg.EntityType
+	}
+	if len(c.cfg.Labels) > 0 {
+		start["labels"] = c.cfg.Labels
+	}
+	c.posMutex.Unlock()
 	c.debug("sending start")
-	if err := c.send(start); err != nil {
-		c.wsConn.Close()
-		return nil, err
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(CDC_WRITE_TIMEOUT) * time.Second))
+	if err := conn.WriteJSON(start); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("c.wsConn.WriteJSON: %s", err)
 	}
 
 	// Receive start control ack
 	var ack map[string]string
 	c.debug("waiting for start ack")
-	if err := c.wsConn.ReadJSON(&ack); err != nil {
-		c.wsConn.Close()
+	if err := conn.ReadJSON(&ack); err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("wsConn.ReadJSON: %s", err)
 	}
 	c.debug("start ack received: %#v", ack)
 	errMsg, ok := ack["error"]
 	if ok && errMsg != "" {
+		conn.Close()
 		return nil, fmt.Errorf("API error: %s", errMsg)
 	}
+	return conn, nil
+}
 
-	// Start consuming CDC feed
-	c.debug("cdc feed started")
-	c.started = true
-	c.stopped = false
-	c.err = nil
-	c.events = make(chan CDCEvent, c.bufferSize)
-	go c.recv()
-
-	return c.events, nil
+// reconnect reconnects after the connection is lost, if enabled. It returns
+// false if not enabled, Stop was called, or all tries failed. err is the error
+// that lost the connection; it's updated to the last connect error.
+func (c *cdcClient) reconnect(err *error) bool {
+	if !c.cfg.Reconnect {
+		return false
+	}
+	c.wsConn.Close()
+	for try := 1; c.cfg.MaxReconnectTries == 0 || try <= c.cfg.MaxReconnectTries; try++ {
+		c.debug("reconnect %d after error: %v", try, *err)
+		select {
+		case <-time.After(c.cfg.ReconnectWait):
+		case <-c.stopChan:
+			return false
+		}
+		conn, cerr := c.connect()
+		if cerr != nil {
+			*err = cerr
+			continue
+		}
+		c.Lock()
+		if c.stopped {
+			c.Unlock()
+			conn.Close()
+			return false
+		}
+		c.wsMutex.Lock()
+		c.wsConn = conn
+		c.wsMutex.Unlock()
+		c.Unlock()
+		c.debug("reconnected")
+		return true
+	}
+	return false
 }
 
 func (c *cdcClient) Stop() {
@@ -174,6 +356,9 @@ func (c *cdcClient) Stop() {
 		c.wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1000, "etre.CDCClient stopped"))
 		c.wsConn.Close()
 	}
+	if c.stopChan != nil {
+		close(c.stopChan)
+	}
 	c.stopped = true
 }
 
@@ -232,8 +417,14 @@ func (c *cdcClient) recv() {
 	for {
 		_, bytes, rerr := c.wsConn.ReadMessage()
 		now = time.Now()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		if rerr != nil {
+			if c.isStopped() {
+				return
+			}
+			if c.reconnect(&rerr) {
+				continue // resume from position
+			}
+			if c.cfg.Reconnect || websocket.IsUnexpectedCloseError(rerr, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				err = rerr
 			}
 			return
@@ -248,8 +439,13 @@ func (c *cdcClient) recv() {
 		// If event ID is set (not empty), then it's a CDC event as expected
 		if e.Id != "" {
 			c.debug("cdc event: %#v", e)
+			if c.sent(e) {
+				c.debug("already sent")
+				continue
+			}
 			select {
 			case c.events <- e: // send CDC event to caller
+				c.setPosition(e)
 			default:
 				c.debug("caller blocked")
 				c.shutdown(ErrCallerBlocked)
@@ -267,6 +463,10 @@ func (c *cdcClient) recv() {
 				return
 			}
 			if err = c.control(msg, now); err != nil {
+				if IsSlowConsumer(err) && c.reconnect(&err) {
+					err = nil
+					continue // resume from position
+				}
 				return
 			}
 		}
@@ -283,6 +483,11 @@ func (c *cdcClient) control(msg map[string]interface{}, now time.Time) error {
 	case "error":
 		// API is letting us know that something on its end broke it's closing
 		// the connection. This is the last data it sends.
+		if errType, ok := msg["type"].(string); ok && errType != "" {
+			// Typed error like etre.ErrCDCPositionGone
+			errMsg, _ := msg["message"].(string)
+			return Error{Type: errType, Message: errMsg}
+		}
 		return fmt.Errorf("API error: %s", msg["error"].(string))
 	case "ping":
 		// Ping from API
@@ -328,6 +533,40 @@ func (c *cdcClient) control(msg map[string]interface{}, now time.Time) error {
 	return nil
 }
 
+// sent returns true if the event was already sent to the caller: it's at the
+// current position, so it was resent after a reconnect.
+func (c *cdcClient) sent(e CDCEvent) bool {
+	c.posMutex.Lock()
+	defer c.posMutex.Unlock()
+	return e.Ts == c.posTs && c.posIds[e.Id]
+}
+
+// setPosition sets the position to the event sent to the caller. Events can be
+// out of order by Ts (from different Etre instances), so the position is the
+// latest Ts, and likewise the highest Seq.
+func (c *cdcClient) setPosition(e CDCEvent) {
+	c.posMutex.Lock()
+	defer c.posMutex.Unlock()
+	if e.Seq > c.posSeq {
+		c.posSeq = e.Seq
+	}
+	switch {
+	case e.Ts > c.posTs:
+		c.posTs = e.Ts
+		c.posIds = map[string]bool{e.Id: true}
+		c.posId = e.Id
+	case e.Ts == c.posTs:
+		c.posIds[e.Id] = true
+		c.posId = e.Id
+	}
+}
+
+func (c *cdcClient) isStopped() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.stopped
+}
+
 func (c *cdcClient) send(v interface{}) error {
 	c.debug("send call")
 	defer c.debug("send return")
@@ -372,10 +611,12 @@ func (c *cdcClient) debug(msg string, v ...interface{}) {
 var _ CDCClient = MockCDCClient{}
 
 type MockCDCClient struct {
-	StartFunc func(time.Time) (<-chan CDCEvent, error)
-	StopFunc  func()
-	PingFunc  func(time.Duration) Latency
-	ErrorFunc func() error
+	StartFunc     func(time.Time) (<-chan CDCEvent, error)
+	StartFromFunc func(CDCPosition) (<-chan CDCEvent, error)
+	PositionFunc  func() CDCPosition
+	StopFunc      func()
+	PingFunc      func(time.Duration) Latency
+	ErrorFunc     func() error
 }
 
 func (c MockCDCClient) Start(startTs time.Time) (<-chan CDCEvent, error) {
@@ -385,6 +626,20 @@ func (c MockCDCClient) Start(startTs time.Time) (<-chan CDCEvent, error) {
 	return nil, nil
 }
 
+func (c MockCDCClient) StartFrom(pos CDCPosition) (<-chan CDCEvent, error) {
+	if c.StartFromFunc != nil {
+		return c.StartFromFunc(pos)
+	}
+	return nil, nil
+}
+
+func (c MockCDCClient) Position() CDCPosition {
+	if c.PositionFunc != nil {
+		return c.PositionFunc()
+	}
+	return CDCPosition{}
+}
+
 func (c MockCDCClient) Stop() {
 	if c.StopFunc != nil {
 		c.StopFunc()
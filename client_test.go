@@ -5,10 +5,12 @@ package etre_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,6 +31,7 @@ var (
 	gotPath   string
 	gotQuery  string
 	gotBody   []byte
+	gotCalls  int // number of requests
 
 	// Response to test
 	respData       interface{}
@@ -42,6 +45,7 @@ var httpClient = &http.Client{
 
 func init() {
 	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotCalls++
 		gotMethod = r.Method
 		gotPath = r.URL.Path
 		gotQuery, _ = url.QueryUnescape(r.URL.RawQuery)
@@ -82,6 +86,7 @@ func setup(t *testing.T) {
 	gotPath = ""
 	gotQuery = ""
 	gotBody = nil
+	gotCalls = 0
 	respError = nil
 	respData = nil
 	respStatusCode = http.StatusOK
@@ -170,6 +175,65 @@ func TestQueryOK(t *testing.T) {
 	assert.Equal(t, time.Unix(0, 2000), got[0].Updated())
 }
 
+func TestQueryETagCache(t *testing.T) {
+	// Test that the client with ETagCache sends If-None-Match with the ETag of the
+	// last same query and returns ErrNotModified on HTTP 304
+	tag := `W/"v1"`
+	var gotINM []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotINM = append(gotINM, r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", tag)
+		if r.Header.Get("If-None-Match") == tag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode([]etre.Entity{{"_id": "abc"}})
+	}))
+	defer server.Close()
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       server.URL,
+		HTTPClient: http.DefaultClient,
+		ETagCache:  true,
+	})
+	ctx := testContext()
+
+	got, err := ec.Query(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+
+	// Same query, same ETag: not modified. The cache is shared by derived clients.
+	got, err = ec.WithTrace("app=test").Query(ctx, "x=y", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrNotModified)
+	assert.Nil(t, got)
+
+	// Different query: no ETag yet
+	_, err = ec.Query(ctx, "x=z", etre.QueryFilter{})
+	require.NoError(t, err)
+
+	// Same query with different headers (e.g. another user): no ETag yet
+	got, err = ec.WithHeaders(http.Header{"X-Etre-User": {"other"}}).Query(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+
+	// Result changed: new ETag, full response
+	tag = `W/"v2"`
+	got, err = ec.Query(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+	assert.Equal(t, []string{"", `W/"v1"`, "", "", `W/"v1"`}, gotINM)
+
+	// Without ETagCache, If-None-Match is never sent
+	gotINM = nil
+	ec = etre.NewEntityClient("node", server.URL, http.DefaultClient)
+	_, err = ec.Query(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	_, err = ec.Query(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", ""}, gotINM)
+}
+
 func TestQueryNoResults(t *testing.T) {
 	// Same test as TestQueryOK but no results to make sure client handles
 	// status code 200 but an empty list.
@@ -205,6 +269,235 @@ func TestQueryHandledError(t *testing.T) {
 	assert.Nil(t, got)
 }
 
+func TestQueryTypedError(t *testing.T) {
+	// Known API error types are returned as errors that match the corresponding
+	// etre.Err* sentinel with errors.Is. Unknown types match none but keep the
+	// formatted message.
+	tests := []struct {
+		status  int
+		errType string
+		is      error
+	}{
+		{http.StatusNotFound, "entity-not-found", etre.ErrEntityNotFound},
+		{http.StatusBadRequest, "invalid-query", etre.ErrInvalidQuery},
+		{http.StatusServiceUnavailable, "query-timeout", etre.ErrQueryTimeout},
+		{http.StatusNotFound, "endpoint-not-found", etre.ErrEndpointNotFound}, // not ErrEntityNotFound
+		{http.StatusTooManyRequests, "rate-limited", etre.ErrRateLimited},
+		{http.StatusInternalServerError, "db-update-failed", etre.ErrDBUpdateFailed},
+		{http.StatusBadRequest, "fake_error", nil},
+	}
+	sentinels := []error{etre.ErrEntityNotFound, etre.ErrInvalidQuery, etre.ErrQueryTimeout, etre.ErrDuplicate, etre.ErrInternal,
+		etre.ErrEndpointNotFound, etre.ErrRateLimited, etre.ErrDBUpdateFailed}
+	for _, tt := range tests {
+		t.Run(tt.errType, func(t *testing.T) {
+			setup(t)
+
+			// Set global vars used by httptest.Server
+			respStatusCode = tt.status
+			respError = &etre.Error{
+				Type:    tt.errType,
+				Message: "this is a fake error",
+			}
+
+			ec := etre.NewEntityClient("node", ts.URL, httpClient)
+			got, err := ec.Query(testContext(), "any=thing", etre.QueryFilter{})
+			require.Error(t, err)
+			assert.Nil(t, got)
+			for _, sentinel := range sentinels {
+				assert.Equal(t, sentinel == tt.is, errors.Is(err, sentinel), "errors.Is(%s)", sentinel)
+			}
+			if tt.is == nil {
+				assert.Equal(t, "Client error: fake_error: this is a fake error (HTTP status 400)", err.Error())
+			}
+		})
+	}
+}
+
+func TestWithHeaders(t *testing.T) {
+	// Custom headers are sent with every request. They compose with the trace
+	// header, but cannot replace it or other Etre headers.
+	var gotHeader http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header
+		json.NewEncoder(w).Encode([]etre.Entity{})
+	}))
+	defer server.Close()
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       server.URL,
+		HTTPClient: http.DefaultClient,
+		Headers:    http.Header{"X-Gateway-Route": {"etre-a"}},
+	})
+	ec = ec.WithTrace("app=foo").WithHeaders(http.Header{
+		"Authorization":   {"Bearer token"},
+		"X-Gateway-Route": {"etre-b"},   // replaces config header
+		etre.TRACE_HEADER: {"app=bar"},  // Etre header not replaced
+		"Content-Type":    {"text/xml"}, // Etre header not replaced
+	})
+
+	_, err := ec.Query(testContext(), "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer token", gotHeader.Get("Authorization"))
+	assert.Equal(t, []string{"etre-b"}, gotHeader.Values("X-Gateway-Route"))
+	assert.Equal(t, "app=foo", gotHeader.Get(etre.TRACE_HEADER))
+	assert.Equal(t, "application/json", gotHeader.Get("Content-Type"))
+
+	// Headers are sent with every request, not only queries
+	gotHeader = nil
+	_, err = ec.Labels(testContext(), "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer token", gotHeader.Get("Authorization"))
+}
+
+func TestExportStream(t *testing.T) {
+	// ExportStream returns the NDJSON response body as a stream. An error in
+	// the trailer (export failed after it started) is returned by Read at the end.
+	var gotPath, gotQuery string
+	trailerErr := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotQuery = r.URL.RawQuery
+		if r.URL.Query().Get("query") == "x=(" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(etre.Error{Type: "invalid-query", Message: "invalid query"})
+			return
+		}
+		w.Header().Set("Content-Type", etre.NDJSON_CONTENT_TYPE)
+		w.Header().Set("Trailer", etre.ERROR_TRAILER)
+		w.Write([]byte("{\"x\":\"1\"}\n{\"x\":\"2\"}\n"))
+		if trailerErr != "" {
+			w.Header().Set(etre.ERROR_TRAILER, trailerErr)
+		}
+	}))
+	defer server.Close()
+
+	ec := etre.NewEntityClient("node", server.URL, http.DefaultClient)
+	stream, err := ec.ExportStream(testContext(), "y=a", etre.QueryFilter{ReturnLabels: []string{"x", "a&b"}, IncludeDeleted: true})
+	require.NoError(t, err)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/export", gotPath)
+	assert.Equal(t, "query=y%3Da&labels=x%2Ca%26b&deleted", gotQuery) // labels escaped like query
+	var got []etre.Entity
+	dec := json.NewDecoder(stream)
+	for {
+		var e etre.Entity
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else {
+			require.NoError(t, err)
+		}
+		got = append(got, e)
+	}
+	require.NoError(t, stream.Close())
+	assert.Equal(t, []etre.Entity{{"x": "1"}, {"x": "2"}}, got)
+
+	// Empty query exports all entities
+	stream, err = ec.ExportStream(testContext(), "", etre.QueryFilter{})
+	require.NoError(t, err)
+	stream.Close()
+	assert.Empty(t, gotQuery)
+
+	// Error after the export started
+	trailerErr = `{"type":"db-query","message":"db error","httpStatus":503}`
+	stream, err = ec.ExportStream(testContext(), "", etre.QueryFilter{})
+	require.NoError(t, err)
+	defer stream.Close()
+	body, err := io.ReadAll(stream)
+	require.Error(t, err)
+	assert.Equal(t, "{\"x\":\"1\"}\n{\"x\":\"2\"}\n", string(body))
+	var apiErr etre.Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, "db-query", apiErr.Type)
+	assert.Contains(t, err.Error(), "Server error")
+
+	// Error before the export started
+	_, err = ec.ExportStream(testContext(), "x=(", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrInvalidQuery)
+}
+
+func TestImportStream(t *testing.T) {
+	// ImportStream streams the reader as the NDJSON request body and returns the
+	// import summary. Failed entities are not an error, but an error that stops
+	// the import is returned with the summary.
+	var gotPath, gotContentType, gotBody string
+	var result etre.ImportResult
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotContentType = r.Header.Get("Content-Type")
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(result)
+	}))
+	defer server.Close()
+
+	result = etre.ImportResult{
+		Inserted: 2,
+		Failed:   1,
+		Errors: []etre.WriteError{
+			{Index: 1, Error: etre.Error{Type: "duplicate-entity", Message: "duplicate", HTTPStatus: http.StatusConflict}},
+		},
+	}
+	ec := etre.NewEntityClient("node", server.URL, http.DefaultClient)
+	stream := "{\"x\":1}\n{\"x\":1}\n{\"x\":2}\n"
+	got, err := ec.ImportStream(testContext(), strings.NewReader(stream))
+	require.NoError(t, err)
+	assert.Equal(t, result, got)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/import", gotPath)
+	assert.Equal(t, etre.NDJSON_CONTENT_TYPE, gotContentType)
+	assert.Equal(t, stream, gotBody)
+
+	// Import stopped
+	status = http.StatusServiceUnavailable
+	result = etre.ImportResult{
+		Inserted: 1,
+		Error:    &etre.Error{Type: "db-error", Message: "connection lost", HTTPStatus: status},
+	}
+	got, err = ec.ImportStream(testContext(), strings.NewReader(stream))
+	require.Error(t, err)
+	assert.Equal(t, 1, got.Inserted)
+	var apiErr etre.Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, "db-error", apiErr.Type)
+	assert.Contains(t, err.Error(), "Server error")
+}
+
+func TestRequestId(t *testing.T) {
+	// The request ID set with etre.WithRequestId is sent in the X-Request-Id
+	// header (etre.REQUEST_ID_HEADER). The API echoes it or generates one, and
+	// the client returns it in the error.
+	var gotRequestId string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRequestId = r.Header.Get(etre.REQUEST_ID_HEADER)
+		id := gotRequestId
+		if id == "" {
+			id = "generated-id"
+		}
+		w.Header().Set(etre.REQUEST_ID_HEADER, id)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(etre.Error{Type: "invalid-query", Message: "bad query"}) // no requestId in body
+	}))
+	defer server.Close()
+
+	ec := etre.NewEntityClient("node", server.URL, http.DefaultClient)
+
+	ctx := etre.WithRequestId(testContext(), "req-123")
+	_, err := ec.Query(ctx, "x=y", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.Equal(t, "req-123", gotRequestId)
+	var e etre.Error
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, "req-123", e.RequestId)
+
+	// No request ID: client doesn't send one, error has the server-generated one
+	_, err = ec.Query(testContext(), "x=y", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.Equal(t, "", gotRequestId)
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, "generated-id", e.RequestId)
+}
+
 func TestQueryUnhandledError(t *testing.T) {
 	// Like TestQueryHandledError above, but simulating a more severe error,
 	// like a panic, that makes the API _not_ return an etre.Error. The client
@@ -222,6 +515,162 @@ func TestQueryUnhandledError(t *testing.T) {
 	assert.Nil(t, got)
 }
 
+func TestQueryRateLimited(t *testing.T) {
+	// API returns 429 and a rate-limited error. The client does not retry: it
+	// returns an error that IsRateLimited and wraps the etre.Error.
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respStatusCode = http.StatusTooManyRequests
+	respError = &etre.Error{
+		Type:       "rate-limited",
+		Message:    "too many requests",
+		HTTPStatus: http.StatusTooManyRequests,
+	}
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ts.URL,
+		HTTPClient: httpClient,
+		Retry:      1,
+		RetryWait:  time.Millisecond,
+	})
+	ctx := testContext()
+	got, err := ec.Query(ctx, "any=thing", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.Nil(t, got)
+	assert.True(t, etre.IsRateLimited(err))
+	var e etre.Error
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, *respError, e)
+	assert.Contains(t, err.Error(), "Client error: rate-limited: too many requests (HTTP status 429)")
+	assert.Equal(t, 1, gotCalls, "rate-limited request retried")
+
+	// Other errors are not rate limited
+	assert.False(t, etre.IsRateLimited(nil))
+	assert.False(t, etre.IsRateLimited(etre.ErrNoQuery))
+	respStatusCode = http.StatusBadRequest
+	respError = &etre.Error{Type: "invalid-query", Message: "bad query"}
+	_, err = ec.Query(ctx, "any=thing", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.False(t, etre.IsRateLimited(err))
+}
+
+func TestQueryResultTooLarge(t *testing.T) {
+	// API returns 400 and a result-too-large error. The client returns an error
+	// that wraps the etre.Error so the caller can check its type.
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respStatusCode = http.StatusBadRequest
+	respError = &etre.Error{
+		Type:       "result-too-large",
+		Message:    "query matches more than 2 entities",
+		HTTPStatus: http.StatusBadRequest,
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ctx := testContext()
+	got, err := ec.Query(ctx, "y", etre.QueryFilter{})
+	require.Error(t, err)
+	assert.Nil(t, got)
+	var e etre.Error
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, *respError, e)
+	assert.False(t, etre.IsRateLimited(err))
+}
+
+func TestQueryBatch(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respData = []etre.QueryResult{
+		{Entities: []etre.Entity{{"x": "1"}}},
+		{Error: &etre.Error{Type: "invalid-query", Message: "invalid query", HTTPStatus: http.StatusBadRequest}},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ctx := testContext()
+	reqs := []etre.QueryRequest{
+		{Query: "x", Filter: etre.QueryFilter{ReturnLabels: []string{"x"}}},
+		{Query: "z>foo"},
+	}
+	got, err := ec.QueryBatch(ctx, reqs)
+	require.NoError(t, err)
+	assert.Equal(t, respData, got)
+
+	// Verify call and response
+	assert.Equal(t, "POST", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/batch-query", gotPath)
+	var gotReqs []etre.QueryRequest
+	require.NoError(t, json.Unmarshal(gotBody, &gotReqs))
+	assert.Equal(t, reqs, gotReqs)
+
+	// Empty batch or query
+	_, err = ec.QueryBatch(ctx, nil)
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+	_, err = ec.QueryBatch(ctx, []etre.QueryRequest{{Query: "x"}, {}})
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+}
+
+func TestGroupCount(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respData = []etre.GroupCount{
+		{Value: nil, Count: 4},
+		{Value: "a", Count: 1},
+		{Value: "b", Count: 2},
+		{Value: 3, Count: 5},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ctx := testContext()
+	got, err := ec.GroupCount(ctx, "y", "y")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"": 4, "a": 1, "b": 2, "3": 5}, got)
+
+	// Verify call
+	assert.Equal(t, "GET", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/aggregate", gotPath)
+	assert.Equal(t, "query=y&groupBy=y", gotQuery)
+
+	// Query and label are required
+	_, err = ec.GroupCount(ctx, "", "y")
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+	_, err = ec.GroupCount(ctx, "y", "")
+	assert.ErrorIs(t, err, etre.ErrNoLabel)
+}
+
+func TestExists(t *testing.T) {
+	// Test that Exists sends HEAD with the query and returns true on 200, false on 404
+	setup(t)
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ctx := testContext()
+	exists, err := ec.Exists(ctx, "x=y")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// Verify call
+	assert.Equal(t, "HEAD", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node", gotPath)
+	assert.Equal(t, "query=x=y", gotQuery)
+
+	respStatusCode = http.StatusNotFound
+	exists, err = ec.Exists(ctx, "x=z")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Other errors are returned
+	respStatusCode = http.StatusForbidden
+	_, err = ec.Exists(ctx, "x=z")
+	require.Error(t, err)
+
+	_, err = ec.Exists(ctx, "")
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+}
+
 func TestQueryLimitFilter(t *testing.T) {
 	// Test that QueryFilter.Limit is serialized as a query parameter
 	setup(t)
@@ -247,6 +696,79 @@ func TestQueryLimitFilter(t *testing.T) {
 	assert.Equal(t, got, respData)
 }
 
+func TestQueryIncludeDeletedFilter(t *testing.T) {
+	// Test that QueryFilter.IncludeDeleted is serialized as a query parameter
+	setup(t)
+
+	respData = []etre.Entity{
+		{
+			"_id":      "abc",
+			"_deleted": 1,
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	_, err := ec.Query(ctx, "x=y", etre.QueryFilter{IncludeDeleted: true})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&deleted", gotQuery)
+
+	_, err = ec.Query(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y", gotQuery)
+}
+
+func TestQueryHintFilter(t *testing.T) {
+	// Test that QueryFilter.Hint, Sort, MaxTimeMS, and Collation are serialized as query parameters
+	setup(t)
+
+	respData = []etre.Entity{{"_id": "abc"}}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	_, err := ec.Query(ctx, "x=y", etre.QueryFilter{Hint: "x:1,y:-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&hint=x:1,y:-1", gotQuery)
+
+	_, err = ec.Query(ctx, "x=y", etre.QueryFilter{Sort: "x:1,y:-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&sort=x:1,y:-1", gotQuery)
+
+	_, err = ec.Query(ctx, "x=y", etre.QueryFilter{MaxTimeMS: 50})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&maxTimeMS=50", gotQuery)
+
+	_, err = ec.Query(ctx, "x=y", etre.QueryFilter{Collation: &etre.Collation{Locale: "en", Strength: 2}})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&collation=en:2", gotQuery)
+
+	_, err = ec.Query(ctx, "x=y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y", gotQuery)
+}
+
+func TestQueryAliasesFilter(t *testing.T) {
+	// Test that QueryFilter.Aliases is serialized as a query parameter sorted
+	// by label, so the request path is the same for the same aliases
+	setup(t)
+
+	respData = []etre.Entity{{"letter": "a"}}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	_, err := ec.Query(ctx, "x=y", etre.QueryFilter{Aliases: map[string]string{"y": "letter", "dc": "datacenter"}})
+	require.NoError(t, err)
+	assert.Equal(t, "query=x=y&aliases=dc:datacenter,y:letter", gotQuery)
+
+	respData = etre.Entity{"letter": "a"}
+	_, err = ec.ReadOne(ctx, "abc", etre.QueryFilter{Aliases: map[string]string{"y": "letter"}})
+	require.NoError(t, err)
+	assert.Equal(t, "aliases=y:letter", gotQuery)
+}
+
 func TestQueryLimitFilterZeroNotSent(t *testing.T) {
 	// Test that QueryFilter.Limit=0 does not add a limit query parameter
 	setup(t)
@@ -298,6 +820,61 @@ func TestGetOK(t *testing.T) {
 	assert.Equal(t, ctx, httpRT.gotCtx)
 }
 
+func TestHistory(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respData = []etre.CDCEvent{
+		{Id: "e0", EntityId: "abc", EntityType: "node", EntityRev: 0, Op: "i", Ts: 1},
+		{Id: "e1", EntityId: "abc", EntityType: "node", EntityRev: 1, Op: "u", Ts: 2},
+		{Id: "e2", EntityId: "abc", EntityType: "node", EntityRev: 2, Op: "d", Ts: 3},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	got, err := ec.History(ctx, "abc")
+	require.NoError(t, err)
+
+	// Verify call and response
+	assert.Equal(t, "GET", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc/history", gotPath)
+	assert.Equal(t, respData, got)
+
+	// Id is required
+	_, err = ec.History(ctx, "")
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+}
+
+func TestReadByIds(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respData = []etre.Entity{
+		{"_id": "abc", "hostname": "localhost"},
+		nil,
+		{"_id": "abc", "hostname": "localhost"},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	got, err := ec.ReadByIds(ctx, []string{"abc", "missing", "abc"})
+	require.NoError(t, err)
+
+	// Verify call and response
+	assert.Equal(t, "POST", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/by-ids", gotPath)
+	assert.JSONEq(t, `["abc","missing","abc"]`, string(gotBody))
+	assert.Equal(t, respData, got)
+	assert.Nil(t, got[1])
+
+	_, err = ec.ReadByIds(ctx, nil)
+	assert.ErrorIs(t, err, etre.ErrNoEntity)
+	_, err = ec.ReadByIds(ctx, []string{"abc", ""})
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+}
+
 func TestGetHandledError(t *testing.T) {
 	// Test that client returns error on API error and no entity
 	setup(t)
@@ -334,6 +911,101 @@ func TestGetUnhandledError(t *testing.T) {
 	assert.Nil(t, got)
 }
 
+func TestReadOne(t *testing.T) {
+	// Test that ReadOne gets the entity with the filter as query parameters, and
+	// returns ErrEntityNotFound, not an empty entity, if it doesn't exist
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respData = etre.Entity{
+		"_id":      "abc",
+		"hostname": "localhost",
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ctx := testContext()
+	got, err := ec.ReadOne(ctx, "abc", etre.QueryFilter{ReturnLabels: []string{"_id", "hostname"}, IncludeDeleted: true})
+	require.NoError(t, err)
+	assert.Equal(t, respData, got)
+
+	// Verify call
+	assert.Equal(t, "GET", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc", gotPath)
+	assert.Equal(t, "labels=_id,hostname&deleted", gotQuery)
+
+	// No filter, no query parameters
+	_, err = ec.ReadOne(ctx, "abc", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "", gotQuery)
+
+	respData = nil
+	respStatusCode = http.StatusNotFound
+	got, err = ec.ReadOne(ctx, "abc", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrEntityNotFound)
+	assert.Nil(t, got)
+
+	_, err = ec.ReadOne(ctx, "", etre.QueryFilter{})
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+}
+
+func TestErrorResponses(t *testing.T) {
+	// Test errors for a JSON etre.Error body, a non-JSON body from a proxy in
+	// front of the API, and an empty body, on read and write
+	var status int
+	var contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	ec := etre.NewEntityClient("node", server.URL, http.DefaultClient)
+	ctx := testContext()
+
+	// JSON etre.Error: the client returns it
+	status = http.StatusBadRequest
+	contentType = "application/json"
+	body = `{"type":"invalid-query","message":"bad query","httpStatus":400}`
+	_, err := ec.Get(ctx, "abc")
+	require.Error(t, err)
+	var e etre.Error
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, "invalid-query", e.Type)
+	assert.Equal(t, http.StatusBadRequest, e.HTTPStatus)
+	_, err = ec.Insert(ctx, []etre.Entity{{"foo": "bar"}})
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, "invalid-query", e.Type)
+
+	// HTML page from a proxy: error has the Content-Type and a one-line snippet
+	// of the body, truncated if long
+	status = http.StatusBadGateway
+	contentType = "text/html; charset=utf-8"
+	body = "<html>\n<head><title>502 Bad Gateway</title></head>\n<body>" + strings.Repeat("x", 500) + "</body>\n</html>"
+	_, err = ec.Get(ctx, "abc")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Server error: HTTP status 502")
+	assert.Contains(t, err.Error(), "Content-Type text/html")
+	assert.Contains(t, err.Error(), "<html> <head><title>502 Bad Gateway</title></head> <body>xxx")
+	assert.True(t, strings.HasSuffix(err.Error(), "..."), err.Error())
+	assert.NotContains(t, err.Error(), "</html>")
+	_, err = ec.Insert(ctx, []etre.Entity{{"foo": "bar"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Content-Type text/html")
+
+	// Empty body
+	contentType = ""
+	body = ""
+	_, err = ec.Get(ctx, "abc")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "HTTP status 502, no response")
+	_, err = ec.Insert(ctx, []etre.Entity{{"foo": "bar"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "HTTP status 502, no response")
+}
+
 func TestGetNotFound(t *testing.T) {
 	// Like TestGetHandledError above, but simulating a more severe error,
 	// like a panic, that makes the API _not_ return an etre.Error. The client
@@ -391,14 +1063,15 @@ func TestInsertOK(t *testing.T) {
 }
 
 func TestInsertAPIError(t *testing.T) {
-	// API should return error in WriteResult.Error
+	// API should return error in WriteResult.Error, and the client returns it
+	// as the error, too
 	setup(t)
 
 	// Set global vars used by httptest.Server
 	respStatusCode = http.StatusInternalServerError
 	respData = etre.WriteResult{
 		Error: &etre.Error{
-			Type:    "fake_error",
+			Type:    "db-insert-failed",
 			Message: "this is a fake error",
 		},
 	}
@@ -412,8 +1085,124 @@ func TestInsertAPIError(t *testing.T) {
 	}
 	ctx := testContext()
 	got, err := ec.Insert(ctx, entities)
-	require.NoError(t, err)
+	require.Error(t, err)
+	var e etre.Error
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, "db-insert-failed", e.Type)
+	assert.Equal(t, http.StatusInternalServerError, e.HTTPStatus)
+	assert.ErrorIs(t, err, etre.ErrDBInsertFailed)
+	assert.Contains(t, err.Error(), "Server error")
+	respData.(etre.WriteResult).Error.HTTPStatus = http.StatusInternalServerError // set by client
+	assert.Equal(t, respData, got)
+	assert.Equal(t, 1, gotCalls) // write not retried
+}
+
+func TestInsertValidationError(t *testing.T) {
+	// API returns which entity and label are invalid in a bulk insert
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respStatusCode = http.StatusBadRequest
+	entityIndex := 1
+	respData = etre.WriteResult{
+		Error: &etre.Error{
+			Type:        "invalid-label",
+			Message:     "invalid label: 'a.b': labels cannot contain . or $ (entity index 1)",
+			HTTPStatus:  http.StatusBadRequest,
+			EntityIndex: &entityIndex,
+			Label:       "a.b",
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	got, err := ec.Insert(testContext(), []etre.Entity{{"foo": "bar"}, {"a.b": "c"}})
+	require.Error(t, err)
+	assert.Equal(t, respData, got)
+	require.NotNil(t, got.Error)
+	require.NotNil(t, got.Error.EntityIndex)
+	assert.Equal(t, 1, *got.Error.EntityIndex)
+	assert.Equal(t, "a.b", got.Error.Label)
+}
+
+func TestInsertDuplicate(t *testing.T) {
+	// API returns 409 and WriteResult.Error for a duplicate entity. The client
+	// returns both, and the error is ErrDuplicate.
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respStatusCode = http.StatusConflict
+	respData = etre.WriteResult{
+		Error: &etre.Error{
+			Type:       "duplicate-entity",
+			Message:    "cannot insert or update entity because identifying labels conflict with another entity: hostname=foo",
+			HTTPStatus: http.StatusConflict,
+			Conflict:   &etre.Entity{"hostname": "foo"},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ctx := testContext()
+	got, err := ec.Insert(ctx, []etre.Entity{{"foo": "bar"}})
+	require.Error(t, err)
+	assert.Equal(t, respData, got)
+	assert.True(t, errors.Is(err, etre.ErrDuplicate))
+	assert.False(t, errors.Is(err, etre.ErrEntityNotFound))
+	var e etre.Error
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, "duplicate-entity", e.Type)
+	assert.Equal(t, &etre.Entity{"hostname": "foo"}, e.Conflict)
+
+	_, err = ec.UpdateOne(ctx, "abc", etre.Entity{"foo": "bar"})
+	assert.True(t, errors.Is(err, etre.ErrDuplicate))
+
+	// Other API errors are not ErrDuplicate
+	respStatusCode = http.StatusBadRequest
+	respData = etre.WriteResult{
+		Error: &etre.Error{Type: "invalid-label", Message: "invalid label", HTTPStatus: http.StatusBadRequest},
+	}
+	got, err = ec.Insert(ctx, []etre.Entity{{"foo": "bar"}})
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, etre.ErrDuplicate))
+	assert.False(t, errors.Is(got.Error, etre.ErrDuplicate))
+}
+
+func TestInsertRateLimited(t *testing.T) {
+	// API returns 429 and WriteResult.Error. The client returns both, and both
+	// are rate limited. Writes are not idempotent, so the client does not retry.
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respStatusCode = http.StatusTooManyRequests
+	respData = etre.WriteResult{
+		Error: &etre.Error{
+			Type:       "rate-limited",
+			Message:    "too many requests",
+			HTTPStatus: http.StatusTooManyRequests,
+		},
+	}
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ts.URL,
+		HTTPClient: httpClient,
+		Retry:      1,
+		RetryWait:  time.Millisecond,
+	})
+	entities := []etre.Entity{
+		{
+			"foo": "bar",
+		},
+	}
+	ctx := testContext()
+	got, err := ec.Insert(ctx, entities)
+	require.Error(t, err)
+	assert.Equal(t, 1, gotCalls, "rate-limited write retried")
 	assert.Equal(t, respData, got)
+	assert.True(t, etre.IsRateLimited(err))
+	assert.True(t, etre.IsRateLimited(got.Error))
+	var e etre.Error
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, "rate-limited", e.Type)
 }
 
 func TestInsertUnhandledError(t *testing.T) {
@@ -447,6 +1236,76 @@ func TestInsertNoEntityError(t *testing.T) {
 	assert.Nil(t, got.Writes)
 }
 
+func TestInsertIfNotExistsInserted(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server: no entity matched the query,
+	// so API inserted it and returns status code 201 and the new id (no diff)
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+			},
+		},
+	}
+	respStatusCode = http.StatusCreated
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ctx := testContext()
+	got, err := ec.InsertIfNotExists(ctx, "host=foo", etre.Entity{"host": "foo"})
+	require.NoError(t, err)
+
+	// Verify call and response
+	assert.Equal(t, "POST", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node", gotPath)
+	assert.Equal(t, "query=host=foo", gotQuery)
+	assert.JSONEq(t, `{"host":"foo"}`, string(gotBody))
+	assert.Equal(t, respData, got)
+	assert.Nil(t, got.Writes[0].Diff)
+}
+
+func TestInsertIfNotExistsExisting(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server: entity matched the query, so
+	// API returns status code 200 and the existing entity as the diff
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"_id":  "abc",
+					"host": "foo",
+				},
+			},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ctx := testContext()
+	got, err := ec.InsertIfNotExists(ctx, "host=foo", etre.Entity{"host": "foo"})
+	require.NoError(t, err)
+	assert.Nil(t, got.Error)
+	assert.Equal(t, respData, got)
+}
+
+func TestInsertIfNotExistsErrors(t *testing.T) {
+	setup(t)
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+	ctx := testContext()
+
+	_, err := ec.InsertIfNotExists(ctx, "", etre.Entity{"host": "foo"})
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+
+	_, err = ec.InsertIfNotExists(ctx, "host=foo", etre.Entity{})
+	assert.ErrorIs(t, err, etre.ErrNoEntity)
+
+	assert.Empty(t, gotMethod) // no requests
+}
+
 // //////////////////////////////////////////////////////////////////////////
 // Update
 // //////////////////////////////////////////////////////////////////////////
@@ -639,6 +1498,33 @@ func TestDeleteWithSet(t *testing.T) {
 // DeleteOne
 // //////////////////////////////////////////////////////////////////////////
 
+func TestDeleteAllOK(t *testing.T) {
+	setup(t)
+
+	// Set global vars used by httptest.Server
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+			},
+		},
+	}
+
+	// New etre.Client
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	// Entity type is the confirmation
+	got, err := ec.DeleteAll(testContext(), "node")
+	require.NoError(t, err)
+
+	// Verify call and response
+	assert.Equal(t, "DELETE", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/all", gotPath)
+	assert.Equal(t, "confirm=node", gotQuery)
+	assert.Equal(t, respData, got)
+}
+
 func TestDeleteOneOK(t *testing.T) {
 	// Same test as DeleteOK, just using the DeleteOne convenience function instead
 	setup(t)
@@ -668,6 +1554,45 @@ func TestDeleteOneOK(t *testing.T) {
 	assert.Equal(t, ctx, httpRT.gotCtx)
 }
 
+func TestIdPathEscaped(t *testing.T) {
+	// Entity ids are escaped in the URL path because natural-key ids can have
+	// any characters, like / and spaces
+	id := `us-east/rack "1"`
+	escaped := etre.API_ROOT + "/entity/node/us-east%2Frack%20%221%22"
+	var gotPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPaths = append(gotPaths, r.Method+" "+r.URL.EscapedPath())
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode([]string{})
+			return
+		}
+		json.NewEncoder(w).Encode(etre.WriteResult{Writes: []etre.Write{{EntityId: id}}})
+	}))
+	defer server.Close()
+
+	ec := etre.NewEntityClient("node", server.URL, http.DefaultClient)
+	ctx := testContext()
+	_, err := ec.UpdateOne(ctx, id, etre.Entity{"foo": "bar"})
+	require.NoError(t, err)
+	_, err = ec.DeleteOne(ctx, id)
+	require.NoError(t, err)
+	_, err = ec.RestoreOne(ctx, id)
+	require.NoError(t, err)
+	_, err = ec.Labels(ctx, id)
+	require.NoError(t, err)
+	_, err = ec.DeleteLabel(ctx, id, "foo")
+	require.NoError(t, err)
+
+	expect := []string{
+		"PUT " + escaped,
+		"DELETE " + escaped,
+		"PUT " + escaped + "/restore",
+		"GET " + escaped + "/labels",
+		"DELETE " + escaped + "/labels/foo",
+	}
+	assert.Equal(t, expect, gotPaths)
+}
+
 func TestDeleteOneWithSet(t *testing.T) {
 	// With a set up, the query should contain the set op params
 	setup(t)
@@ -751,6 +1676,112 @@ func TestDeleteLabelOK(t *testing.T) {
 	assert.Equal(t, ctx, httpRT.gotCtx)
 }
 
+func TestDeleteLabelByQueryOK(t *testing.T) {
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"foo": "foo",
+				},
+			},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	got, err := ec.DeleteLabelByQuery(ctx, "y=a", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "DELETE", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/labels/foo", gotPath)
+	assert.Equal(t, "query=y=a", gotQuery)
+	assert.Equal(t, respData, got)
+
+	// Query and label are required
+	_, err = ec.DeleteLabelByQuery(ctx, "", "foo")
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+	_, err = ec.DeleteLabelByQuery(ctx, "y=a", "")
+	assert.ErrorIs(t, err, etre.ErrNoLabel)
+}
+
+func TestRenameLabelOK(t *testing.T) {
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"dc": "east",
+				},
+			},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	got, err := ec.RenameLabel(ctx, "y=a", "dc", "datacenter", false)
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/labels/dc", gotPath)
+	assert.Equal(t, "query=y=a&name=datacenter", gotQuery)
+	assert.Equal(t, respData, got)
+
+	_, err = ec.RenameLabel(ctx, "y=a", "dc", "datacenter", true)
+	require.NoError(t, err)
+	assert.Equal(t, "query=y=a&name=datacenter&overwrite=true", gotQuery)
+
+	// Query and labels are required
+	_, err = ec.RenameLabel(ctx, "", "dc", "datacenter", false)
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+	_, err = ec.RenameLabel(ctx, "y=a", "dc", "", false)
+	assert.ErrorIs(t, err, etre.ErrNoLabel)
+}
+
+func TestRestoreOK(t *testing.T) {
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"_deleted": float64(100),
+				},
+			},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	ctx := testContext()
+	got, err := ec.Restore(ctx, "y=a")
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entities/node/restore", gotPath)
+	assert.Equal(t, "query=y=a", gotQuery)
+	assert.Equal(t, respData, got)
+
+	got, err = ec.RestoreOne(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", gotMethod)
+	assert.Equal(t, etre.API_ROOT+"/entity/node/abc/restore", gotPath)
+	assert.Equal(t, respData, got)
+
+	// Query and id are required
+	_, err = ec.Restore(ctx, "")
+	assert.ErrorIs(t, err, etre.ErrNoQuery)
+	_, err = ec.RestoreOne(ctx, "")
+	assert.ErrorIs(t, err, etre.ErrIdNotSet)
+}
+
 // //////////////////////////////////////////////////////////////////////////
 // CDC
 // //////////////////////////////////////////////////////////////////////////
@@ -936,6 +1967,283 @@ func TestCDCClient(t *testing.T) {
 	assert.Contains(t, gotError, "fake error")
 }
 
+func TestCDCClientReconnect(t *testing.T) {
+	// The fake feed sends e1 and e2 on the first connection, then closes it.
+	// The client reconnects from e2, so the feed resends e2 (same Ts) and e3
+	// on the second connection. The client should send e1, e2, e3 in order
+	// on the same events chan: no missing or repeated events.
+	e1 := etre.CDCEvent{Id: "e1", Ts: 1001, Op: "i", EntityId: "a", EntityType: "node"}
+	e2 := etre.CDCEvent{Id: "e2", Ts: 1002, Op: "u", EntityId: "a", EntityType: "node"}
+	e3 := etre.CDCEvent{Id: "e3", Ts: 1003, Op: "d", EntityId: "a", EntityType: "node"}
+
+	startChan := make(chan map[string]interface{}, 2)
+	doneChan := make(chan struct{})
+	nConn := 0
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		nConn++
+		upgrader := websocket.Upgrader{}
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer wsConn.Close()
+		var start map[string]interface{}
+		require.NoError(t, wsConn.ReadJSON(&start))
+		require.NoError(t, wsConn.WriteJSON(map[string]interface{}{"control": "start"}))
+		startChan <- start
+		if nConn == 1 {
+			require.NoError(t, wsConn.WriteJSON(e1))
+			require.NoError(t, wsConn.WriteJSON(e2))
+			return // lose connection
+		}
+		require.NoError(t, wsConn.WriteJSON(e2))
+		require.NoError(t, wsConn.WriteJSON(e3))
+		<-doneChan
+	}
+	ts = httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer ts.Close()
+	defer close(doneChan)
+
+	url, _ := url.Parse(ts.URL)
+	ec := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:          "ws://" + url.Host,
+		BufferSize:    10,
+		Reconnect:     true,
+		ReconnectWait: 10 * time.Millisecond,
+	})
+	defer ec.Stop()
+
+	events, err := ec.Start(time.Time{})
+	require.NoError(t, err)
+
+	var got []etre.CDCEvent
+	for len(got) < 3 {
+		select {
+		case e, ok := <-events:
+			require.True(t, ok, "events chan closed, expected client to reconnect: %v", ec.Error())
+			got = append(got, e)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout receiving events, got %v", got)
+		}
+	}
+	assert.Equal(t, []etre.CDCEvent{e1, e2, e3}, got)
+
+	// First start is now (0), reconnect start is position of last event recv'ed
+	// before connection was lost: e2
+	start := <-startChan
+	assert.Equal(t, float64(0), start["startTs"])
+	start = <-startChan
+	assert.Equal(t, float64(e2.Ts), start["startTs"])
+
+	assert.Equal(t, etre.CDCPosition{Ts: time.Unix(0, e3.Ts*int64(time.Millisecond)), Id: "e3"}, ec.Position())
+	assert.NoError(t, ec.Error())
+}
+
+func TestCDCClientSlowConsumerReconnect(t *testing.T) {
+	// The API disconnects the client because it's too slow. The client
+	// reconnects and resumes after the last event it received.
+	e1 := etre.CDCEvent{Id: "e1", Ts: 1001, Op: "i", EntityId: "a", EntityType: "node"}
+	e2 := etre.CDCEvent{Id: "e2", Ts: 1002, Op: "u", EntityId: "a", EntityType: "node"}
+
+	startChan := make(chan map[string]interface{}, 2)
+	doneChan := make(chan struct{})
+	nConn := 0
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		nConn++
+		upgrader := websocket.Upgrader{}
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer wsConn.Close()
+		var start map[string]interface{}
+		require.NoError(t, wsConn.ReadJSON(&start))
+		require.NoError(t, wsConn.WriteJSON(map[string]interface{}{"control": "start"}))
+		startChan <- start
+		if nConn == 1 {
+			require.NoError(t, wsConn.WriteJSON(e1))
+			slow := map[string]interface{}{
+				"control": "error",
+				"error":   etre.ErrSlowConsumer.Error(),
+				"type":    etre.ErrSlowConsumer.Type,
+				"message": etre.ErrSlowConsumer.Message,
+			}
+			require.NoError(t, wsConn.WriteJSON(slow))
+			return
+		}
+		require.NoError(t, wsConn.WriteJSON(e2))
+		<-doneChan
+	}
+	ts = httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer ts.Close()
+	defer close(doneChan)
+
+	url, _ := url.Parse(ts.URL)
+	ec := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:          "ws://" + url.Host,
+		BufferSize:    10,
+		Reconnect:     true,
+		ReconnectWait: 10 * time.Millisecond,
+	})
+	defer ec.Stop()
+
+	events, err := ec.Start(time.Time{})
+	require.NoError(t, err)
+
+	var got []etre.CDCEvent
+	for len(got) < 2 {
+		select {
+		case e, ok := <-events:
+			require.True(t, ok, "events chan closed, expected client to reconnect: %v", ec.Error())
+			got = append(got, e)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout receiving events, got %v", got)
+		}
+	}
+	assert.Equal(t, []etre.CDCEvent{e1, e2}, got)
+
+	<-startChan
+	start := <-startChan
+	assert.Equal(t, "e1", start["startId"])
+}
+
+func TestCDCClientStartFrom(t *testing.T) {
+	// Starting from an event position should start at its Ts and skip the event
+	e1 := etre.CDCEvent{Id: "e1", Ts: 1001, Op: "i", EntityId: "a", EntityType: "node"}
+	e2 := etre.CDCEvent{Id: "e2", Ts: 1001, Op: "u", EntityId: "a", EntityType: "node"}
+
+	var gotStart map[string]interface{}
+	doneChan := make(chan struct{})
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer wsConn.Close()
+		require.NoError(t, wsConn.ReadJSON(&gotStart))
+		require.NoError(t, wsConn.WriteJSON(map[string]interface{}{"control": "start"}))
+		require.NoError(t, wsConn.WriteJSON(e1))
+		require.NoError(t, wsConn.WriteJSON(e2))
+		<-doneChan
+	}
+	ts = httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer ts.Close()
+	defer close(doneChan)
+
+	url, _ := url.Parse(ts.URL)
+	ec := etre.NewCDCClient("ws://"+url.Host, nil, 10, false)
+	defer ec.Stop()
+
+	pos := etre.CDCPosition{Ts: time.Unix(0, e1.Ts*int64(time.Millisecond)), Id: "e1"}
+	events, err := ec.StartFrom(pos)
+	require.NoError(t, err)
+
+	select {
+	case e := <-events:
+		assert.Equal(t, e2, e)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout receiving event from client chan")
+	}
+	assert.Equal(t, float64(e1.Ts), gotStart["startTs"])
+	assert.Equal(t, "e1", gotStart["startId"])
+}
+
+func TestCDCClientStartFromSeq(t *testing.T) {
+	// Starting from a sequence number sends only startSeq, and the client
+	// reconnects from the highest sequence number received, even if events
+	// were received out of sequence order
+	e1 := etre.CDCEvent{Id: "e1", Ts: 1001, Seq: 6, Op: "i", EntityId: "a", EntityType: "node"}
+	e2 := etre.CDCEvent{Id: "e2", Ts: 1001, Seq: 8, Op: "i", EntityId: "b", EntityType: "node"}
+	e3 := etre.CDCEvent{Id: "e3", Ts: 1002, Seq: 7, Op: "i", EntityId: "c", EntityType: "node"}
+
+	startChan := make(chan map[string]interface{}, 2)
+	doneChan := make(chan struct{})
+	nConn := 0
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		nConn++
+		upgrader := websocket.Upgrader{}
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer wsConn.Close()
+		var start map[string]interface{}
+		require.NoError(t, wsConn.ReadJSON(&start))
+		require.NoError(t, wsConn.WriteJSON(map[string]interface{}{"control": "start"}))
+		startChan <- start
+		if nConn == 1 {
+			require.NoError(t, wsConn.WriteJSON(e1))
+			require.NoError(t, wsConn.WriteJSON(e2))
+			require.NoError(t, wsConn.WriteJSON(e3))
+			return // lose connection
+		}
+		<-doneChan
+	}
+	ts = httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer ts.Close()
+	defer close(doneChan)
+
+	url, _ := url.Parse(ts.URL)
+	ec := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:          "ws://" + url.Host,
+		BufferSize:    10,
+		Reconnect:     true,
+		ReconnectWait: 10 * time.Millisecond,
+	})
+	defer ec.Stop()
+
+	events, err := ec.StartFrom(etre.CDCPosition{Seq: 5})
+	require.NoError(t, err)
+
+	var got []etre.CDCEvent
+	for len(got) < 3 {
+		select {
+		case e, ok := <-events:
+			require.True(t, ok, "events chan closed, expected client to reconnect: %v", ec.Error())
+			got = append(got, e)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout receiving events, got %v", got)
+		}
+	}
+	assert.Equal(t, []etre.CDCEvent{e1, e2, e3}, got)
+
+	start := <-startChan
+	assert.Equal(t, float64(5), start["startSeq"])
+	assert.NotContains(t, start, "startId")
+	start = <-startChan
+	assert.Equal(t, float64(8), start["startSeq"])
+
+	assert.Equal(t, int64(8), ec.Position().Seq)
+}
+
+func TestCDCClientFilter(t *testing.T) {
+	// The subscription filter is sent in the start control message
+	startChan := make(chan map[string]interface{}, 1)
+	doneChan := make(chan struct{})
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer wsConn.Close()
+		var start map[string]interface{}
+		require.NoError(t, wsConn.ReadJSON(&start))
+		require.NoError(t, wsConn.WriteJSON(map[string]interface{}{"control": "start"}))
+		startChan <- start
+		<-doneChan
+	}
+	ts = httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer ts.Close()
+	defer close(doneChan)
+
+	url, _ := url.Parse(ts.URL)
+	ec := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+		Addr:       "ws://" + url.Host,
+		BufferSize: 10,
+		EntityType: "node",
+		Labels:     []string{"foo"},
+	})
+	defer ec.Stop()
+	_, err := ec.Start(time.Time{})
+	require.NoError(t, err)
+
+	start := <-startChan
+	assert.Equal(t, "node", start["entityType"])
+	assert.Equal(t, []interface{}{"foo"}, start["labels"])
+}
+
 func testContext() context.Context {
 	return context.WithValue(context.Background(), "key", "test-context-"+time.Now().String())
 }
@@ -6,9 +6,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/square/etre"
 )
 
 const (
@@ -16,12 +21,14 @@ const (
 	DEFAULT_DATASOURCE_URL                 = "mongodb://localhost:27017"
 	DEFAULT_DB                             = "etre_dev"
 	DEFAULT_DB_CONNECT_TIMEOUT             = "5s"
+	DEFAULT_DB_SERVER_SELECTION_TIMEOUT    = "500ms"
 	DEFAULT_DB_QUERY_TIMEOUT               = "2s"
 	DEFAULT_DB_MIN_CONN                    = 10
 	DEFAULT_DB_MAX_CONN                    = 1000
 	DEFAULT_CDC_WRITE_RETRY_COUNT          = 2
 	DEFAULT_CDC_WRITE_RETRY_WAIT           = 2
 	DEFAULT_CDC_FALLBACK_FILE              = "/tmp/etre-cdc.json"
+	DEFAULT_CDC_MAX_HISTORY                = 100
 	DEFAULT_CHANGESTREAM_BUFFER_SIZE       = 100
 	DEFAULT_CHANGESTREAM_MAX_CLIENTS       = 100
 	DEFAULT_ENTITY_TYPE                    = "host"
@@ -29,10 +36,35 @@ const (
 	DEFAULT_QUERY_PROFILE_SAMPLE_RATE      = 0.2
 	DEFAULT_QUERY_PROFILE_REPORT_THRESHOLD = "500ms"
 	DEFAULT_BATCH_SIZE                     = 5000
+	DEFAULT_MAX_GROUPS                     = 1000
+	DEFAULT_MAX_BODY_BYTES                 = 32 << 20 // 32 MiB
+	DEFAULT_IMPORT_BATCH_SIZE              = 1000
 )
 
 const CDC_COLLECTION = "cdc"
 
+// Entity _id strategies, see IdConfig.
+const (
+	ID_STRATEGY_OBJECTID = "objectid"
+	ID_STRATEGY_UUID     = "uuid"
+	ID_STRATEGY_HASH     = "hash"
+	ID_STRATEGY_LABEL    = "label"
+)
+
+// Entity _id formats, see IdConfig.
+const (
+	ID_FORMAT_OBJECTID = "objectid"
+	ID_FORMAT_UUID     = "uuid"
+	ID_FORMAT_STRING   = "string"
+)
+
+// Label schema types, see LabelSchema.
+const (
+	LABEL_TYPE_STRING = "string"
+	LABEL_TYPE_INT    = "int"
+	LABEL_TYPE_BOOL   = "bool"
+)
+
 var reservedNames = []string{"entity", "entities", "cdc", "etre"}
 
 func Default() Config {
@@ -40,30 +72,36 @@ func Default() Config {
 		Entity: EntityConfig{
 			Types:     []string{DEFAULT_ENTITY_TYPE},
 			BatchSize: DEFAULT_BATCH_SIZE,
+			MaxGroups: DEFAULT_MAX_GROUPS,
 		},
 		Server: ServerConfig{
-			Addr: DEFAULT_ADDR,
+			Addr:            DEFAULT_ADDR,
+			MaxBodyBytes:    DEFAULT_MAX_BODY_BYTES,
+			ImportBatchSize: DEFAULT_IMPORT_BATCH_SIZE,
 		},
 		Datasource: DatasourceConfig{
-			URL:            DEFAULT_DATASOURCE_URL,
-			Database:       DEFAULT_DB,
-			ConnectTimeout: DEFAULT_DB_CONNECT_TIMEOUT,
-			QueryTimeout:   DEFAULT_DB_QUERY_TIMEOUT,
-			MinConnections: DEFAULT_DB_MIN_CONN,
-			MaxConnections: DEFAULT_DB_MAX_CONN,
+			URL:                    DEFAULT_DATASOURCE_URL,
+			Database:               DEFAULT_DB,
+			ConnectTimeout:         DEFAULT_DB_CONNECT_TIMEOUT,
+			ServerSelectionTimeout: DEFAULT_DB_SERVER_SELECTION_TIMEOUT,
+			QueryTimeout:           DEFAULT_DB_QUERY_TIMEOUT,
+			MinConnections:         DEFAULT_DB_MIN_CONN,
+			MaxConnections:         DEFAULT_DB_MAX_CONN,
 		},
 		CDC: CDCConfig{
 			Datasource: DatasourceConfig{
-				URL:            DEFAULT_DATASOURCE_URL,
-				Database:       DEFAULT_DB,
-				ConnectTimeout: DEFAULT_DB_CONNECT_TIMEOUT,
-				QueryTimeout:   DEFAULT_DB_QUERY_TIMEOUT,
-				MinConnections: DEFAULT_DB_MIN_CONN,
-				MaxConnections: DEFAULT_DB_MAX_CONN,
+				URL:                    DEFAULT_DATASOURCE_URL,
+				Database:               DEFAULT_DB,
+				ConnectTimeout:         DEFAULT_DB_CONNECT_TIMEOUT,
+				ServerSelectionTimeout: DEFAULT_DB_SERVER_SELECTION_TIMEOUT,
+				QueryTimeout:           DEFAULT_DB_QUERY_TIMEOUT,
+				MinConnections:         DEFAULT_DB_MIN_CONN,
+				MaxConnections:         DEFAULT_DB_MAX_CONN,
 			},
 			FallbackFile:    DEFAULT_CDC_FALLBACK_FILE,
 			WriteRetryCount: DEFAULT_CDC_WRITE_RETRY_COUNT,
 			WriteRetryWait:  DEFAULT_CDC_WRITE_RETRY_WAIT,
+			MaxHistory:      DEFAULT_CDC_MAX_HISTORY,
 			ChangeStream: ChangeStreamConfig{
 				MaxClients: DEFAULT_CHANGESTREAM_MAX_CLIENTS,
 				BufferSize: DEFAULT_CHANGESTREAM_BUFFER_SIZE,
@@ -110,6 +148,187 @@ func Validate(config Config) error {
 		}
 	}
 
+	if err := config.Datasource.Validate(); err != nil {
+		return fmt.Errorf("datasource: %s", err)
+	}
+	if err := config.CDC.Datasource.Validate(); err != nil {
+		return fmt.Errorf("cdc.datasource: %s", err)
+	}
+
+	for t, idCfg := range config.Entity.Id {
+		if !inList(t, config.Entity.Types) {
+			return fmt.Errorf("entity.id.%s: not an entity type in entity.types", t)
+		}
+		switch idCfg.Strategy {
+		case "", ID_STRATEGY_OBJECTID, ID_STRATEGY_UUID:
+			if len(idCfg.Labels) > 0 {
+				return fmt.Errorf("entity.id.%s: labels are only valid with strategy %s or %s", t, ID_STRATEGY_HASH, ID_STRATEGY_LABEL)
+			}
+		case ID_STRATEGY_HASH:
+			if len(idCfg.Labels) == 0 {
+				return fmt.Errorf("entity.id.%s: strategy %s requires at least one label", t, ID_STRATEGY_HASH)
+			}
+		case ID_STRATEGY_LABEL:
+			if len(idCfg.Labels) != 1 {
+				return fmt.Errorf("entity.id.%s: strategy %s requires exactly one label, got %d", t, ID_STRATEGY_LABEL, len(idCfg.Labels))
+			}
+		default:
+			return fmt.Errorf("entity.id.%s: invalid strategy: %s; valid strategies: %s, %s, %s, %s",
+				t, idCfg.Strategy, ID_STRATEGY_OBJECTID, ID_STRATEGY_UUID, ID_STRATEGY_HASH, ID_STRATEGY_LABEL)
+		}
+		switch idCfg.Format {
+		case "":
+		case ID_FORMAT_UUID, ID_FORMAT_STRING:
+			if idCfg.Strategy != ID_STRATEGY_LABEL {
+				return fmt.Errorf("entity.id.%s: format is only valid with strategy %s", t, ID_STRATEGY_LABEL)
+			}
+		default:
+			return fmt.Errorf("entity.id.%s: invalid format: %s; valid formats: %s, %s", t, idCfg.Format, ID_FORMAT_UUID, ID_FORMAT_STRING)
+		}
+	}
+
+	if config.Entity.MaxLabels < 0 {
+		return fmt.Errorf("invalid entity.max_labels: %d: must be >= 0", config.Entity.MaxLabels)
+	}
+	if config.Entity.MaxValueBytes < 0 {
+		return fmt.Errorf("invalid entity.max_value_bytes: %d: must be >= 0", config.Entity.MaxValueBytes)
+	}
+
+	if config.Entity.MaxQueryTime != "" {
+		d, err := time.ParseDuration(config.Entity.MaxQueryTime)
+		if err != nil {
+			return fmt.Errorf("invalid entity.max_query_time: %s: %s", config.Entity.MaxQueryTime, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid entity.max_query_time: %s: must be greater than zero", config.Entity.MaxQueryTime)
+		}
+	}
+
+	if config.Entity.LabelPattern != "" {
+		if _, err := regexp.Compile(config.Entity.LabelPattern); err != nil {
+			return fmt.Errorf("invalid entity.label_pattern: %s: %s", config.Entity.LabelPattern, err)
+		}
+	}
+
+	for t, schema := range config.Entity.Schema {
+		if !inList(t, config.Entity.Types) {
+			return fmt.Errorf("entity.schema.%s: not an entity type in entity.types", t)
+		}
+		seen := map[string]bool{}
+		for i, l := range schema.Labels {
+			if l.Name == "" {
+				return fmt.Errorf("entity.schema.%s: label %d: name not set", t, i)
+			}
+			if seen[l.Name] {
+				return fmt.Errorf("entity.schema.%s: duplicate label: %s", t, l.Name)
+			}
+			seen[l.Name] = true
+			switch l.Type {
+			case "", LABEL_TYPE_STRING, LABEL_TYPE_INT, LABEL_TYPE_BOOL:
+			default:
+				return fmt.Errorf("entity.schema.%s: label %s: invalid type: %s; valid types: %s, %s, %s",
+					t, l.Name, l.Type, LABEL_TYPE_STRING, LABEL_TYPE_INT, LABEL_TYPE_BOOL)
+			}
+			for _, v := range l.Enum {
+				var err error
+				switch l.Type {
+				case LABEL_TYPE_INT:
+					_, err = strconv.Atoi(v)
+				case LABEL_TYPE_BOOL:
+					_, err = strconv.ParseBool(v)
+				}
+				if err != nil {
+					return fmt.Errorf("entity.schema.%s: label %s: enum value %s is not type %s", t, l.Name, v, l.Type)
+				}
+			}
+		}
+	}
+
+	for t, f := range config.Entity.Filter {
+		if !inList(t, config.Entity.Types) {
+			return fmt.Errorf("entity.filter.%s: not an entity type in entity.types", t)
+		}
+		if f.Limit < 0 {
+			return fmt.Errorf("entity.filter.%s: invalid limit: %d: must be >= 0", t, f.Limit)
+		}
+		for _, label := range f.Labels {
+			if inList(label, f.StripLabels) {
+				return fmt.Errorf("entity.filter.%s: label %s in both labels and strip_labels", t, label)
+			}
+		}
+		if f.Sort != "" {
+			for _, key := range strings.Split(f.Sort, ",") {
+				label, dir, _ := strings.Cut(key, ":")
+				if label == "" || (dir != "1" && dir != "-1") {
+					return fmt.Errorf("entity.filter.%s: invalid sort %s: key %s is not label:1 or label:-1", t, f.Sort, key)
+				}
+				if !f.LabelReturned(label) {
+					return fmt.Errorf("entity.filter.%s: invalid sort %s: label %s is not returned by the filter", t, f.Sort, label)
+				}
+			}
+		}
+	}
+
+	for t := range config.Entity.Datasource {
+		if !inList(t, config.Entity.Types) {
+			return fmt.Errorf("entity.datasource.%s: not an entity type in entity.types", t)
+		}
+		ds := config.EntityDatasource(t)
+		if err := ds.Validate(); err != nil {
+			return fmt.Errorf("entity.datasource.%s: %s", t, err)
+		}
+		// Transactions cannot span clients: entity and CDC writes use the main client
+		if config.Entity.Transactions && ds.ClientConfig() != config.Datasource.ClientConfig() {
+			return fmt.Errorf("entity.datasource.%s: entity.transactions requires the same cluster as the main datasource; only database and collection options can differ", t)
+		}
+	}
+
+	if config.Entity.Transactions && config.CDC.Disabled {
+		return fmt.Errorf("entity.transactions requires CDC, but cdc.disabled=true")
+	}
+
+	switch config.CDC.ChangeStream.SlowClientPolicy {
+	case "", "drop", "disconnect":
+	default:
+		return fmt.Errorf("invalid cdc.change_stream.slow_client_policy: %s; valid policies: drop, disconnect", config.CDC.ChangeStream.SlowClientPolicy)
+	}
+	if config.CDC.ChangeStream.SlowClientGrace != "" {
+		if _, err := time.ParseDuration(config.CDC.ChangeStream.SlowClientGrace); err != nil {
+			return fmt.Errorf("invalid cdc.change_stream.slow_client_grace: %s: %s", config.CDC.ChangeStream.SlowClientGrace, err)
+		}
+	}
+
+	switch config.CDC.FallbackFormat {
+	case "", "event", "record":
+	default:
+		return fmt.Errorf("invalid cdc.fallback_format: %s; valid formats: event, record", config.CDC.FallbackFormat)
+	}
+	if config.CDC.FallbackMaxSize < 0 {
+		return fmt.Errorf("invalid cdc.fallback_max_size: %d: must be zero or greater", config.CDC.FallbackMaxSize)
+	}
+	if config.CDC.FallbackMaxAge != "" {
+		d, err := time.ParseDuration(config.CDC.FallbackMaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid cdc.fallback_max_age: %s: %s", config.CDC.FallbackMaxAge, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid cdc.fallback_max_age: %s: must be greater than zero", config.CDC.FallbackMaxAge)
+		}
+	}
+	if config.CDC.FallbackMaxFiles < 0 {
+		return fmt.Errorf("invalid cdc.fallback_max_files: %d: must be zero or greater", config.CDC.FallbackMaxFiles)
+	}
+
+	if config.CDC.Retention != "" {
+		d, err := time.ParseDuration(config.CDC.Retention)
+		if err != nil {
+			return fmt.Errorf("invalid cdc.retention: %s: %s", config.CDC.Retention, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid cdc.retention: %s: must be greater than zero", config.CDC.Retention)
+		}
+	}
+
 	return nil
 }
 
@@ -122,19 +341,55 @@ type Config struct {
 	Metrics    MetricsConfig    `yaml:"metrics"`
 }
 
+// EntityDatasource returns the datasource of the entity type: the main datasource
+// or, if set, entity.datasource for the entity type with defaults from the main
+// datasource.
+func (c Config) EntityDatasource(entityType string) DatasourceConfig {
+	ds, ok := c.Entity.Datasource[entityType]
+	if !ok {
+		return c.Datasource
+	}
+	return ds.WithDefaults(c.Datasource)
+}
+
 func Redact(c Config) Config {
 	c.Datasource.Password = "<redacted>"
 	c.CDC.Datasource.Password = "<redacted>"
+	if len(c.Entity.Datasource) > 0 {
+		ds := make(map[string]DatasourceConfig, len(c.Entity.Datasource))
+		for t, d := range c.Entity.Datasource {
+			d.Password = "<redacted>"
+			ds[t] = d
+		}
+		c.Entity.Datasource = ds
+	}
+	if len(c.Security.StaticTokens) > 0 {
+		tokens := make([]StaticToken, len(c.Security.StaticTokens))
+		for i, t := range c.Security.StaticTokens {
+			t.Token = "<redacted>"
+			tokens[i] = t
+		}
+		c.Security.StaticTokens = tokens
+	}
 	return c
 }
 
 type DatasourceConfig struct {
-	URL            string `yaml:"url"`
-	Database       string `yaml:"database"`
-	ConnectTimeout string `yaml:"connect_timeout"`
-	QueryTimeout   string `yaml:"query_timeout"`
-	MinConnections uint64 `yaml:"min_connections"`
-	MaxConnections uint64 `yaml:"max_connections"`
+	URL          string `yaml:"url"`
+	Database     string `yaml:"database"`
+	QueryTimeout string `yaml:"query_timeout"`
+
+	// Connection pool and timeouts of the client. MinConnections and MaxConnections
+	// are the min and max pool size per server (default 10 and 1000). Under load,
+	// requests wait for a free connection when the pool is full, so MaxConnections
+	// should be greater than the number of concurrent requests. ConnectTimeout
+	// (default 5s) is the timeout to open a connection. ServerSelectionTimeout
+	// (default 500ms) is how long to wait for a suitable server (the primary),
+	// which is usually instantaneous, so keep it short to fail fast on failover.
+	ConnectTimeout         string `yaml:"connect_timeout"`
+	ServerSelectionTimeout string `yaml:"server_selection_timeout"`
+	MinConnections         uint64 `yaml:"min_connections"`
+	MaxConnections         uint64 `yaml:"max_connections"`
 
 	// Certs
 	TLSCert string `yaml:"tls_cert"`
@@ -146,6 +401,29 @@ type DatasourceConfig struct {
 	Password  string `yaml:"password"`
 	Source    string `yaml:"source"`
 	Mechanism string `yaml:"mechanism"`
+
+	// Write concern, read concern, and read preference of collections. If not
+	// set, the MongoDB driver default (or URL option) is used. WriteConcern is
+	// "majority" or a number of nodes like "1". ReadConcern is "local", "available",
+	// "majority", "linearizable", or "snapshot". ReadPreference is "primary",
+	// "primaryPreferred", "secondary", "secondaryPreferred", or "nearest".
+	// CDC should use write concern "majority", else a CDC event acknowledged
+	// by the primary can be lost on failover.
+	WriteConcern   string `yaml:"write_concern"`
+	ReadConcern    string `yaml:"read_concern"`
+	ReadPreference string `yaml:"read_preference"`
+}
+
+// ClientConfig returns the config without the fields that do not affect the
+// client connection: database, query timeout, and collection options. Datasources
+// with the same ClientConfig can use the same client.
+func (c DatasourceConfig) ClientConfig() DatasourceConfig {
+	c.Database = ""
+	c.QueryTimeout = ""
+	c.WriteConcern = ""
+	c.ReadConcern = ""
+	c.ReadPreference = ""
+	return c
 }
 
 func (c DatasourceConfig) WithDefaults(d DatasourceConfig) DatasourceConfig {
@@ -158,6 +436,9 @@ func (c DatasourceConfig) WithDefaults(d DatasourceConfig) DatasourceConfig {
 	if c.ConnectTimeout == "" {
 		c.ConnectTimeout = d.ConnectTimeout
 	}
+	if c.ServerSelectionTimeout == "" {
+		c.ServerSelectionTimeout = d.ServerSelectionTimeout
+	}
 	if c.QueryTimeout == "" {
 		c.QueryTimeout = d.QueryTimeout
 	}
@@ -190,12 +471,228 @@ func (c DatasourceConfig) WithDefaults(d DatasourceConfig) DatasourceConfig {
 	if c.Mechanism == "" {
 		c.Mechanism = d.Mechanism
 	}
+
+	if c.WriteConcern == "" {
+		c.WriteConcern = d.WriteConcern
+	}
+	if c.ReadConcern == "" {
+		c.ReadConcern = d.ReadConcern
+	}
+	if c.ReadPreference == "" {
+		c.ReadPreference = d.ReadPreference
+	}
 	return c
 }
 
+// Validate returns an error if a timeout, the pool size, the write concern,
+// read concern, or read preference is invalid. Empty values are valid: the
+// driver default.
+func (c DatasourceConfig) Validate() error {
+	for _, t := range []struct{ name, val string }{
+		{"connect_timeout", c.ConnectTimeout},
+		{"server_selection_timeout", c.ServerSelectionTimeout},
+		{"query_timeout", c.QueryTimeout},
+	} {
+		if t.val == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(t.val); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s: %s: must be a duration > 0 like \"5s\"", t.name, t.val)
+		}
+	}
+	if c.MaxConnections > 0 && c.MinConnections > c.MaxConnections {
+		return fmt.Errorf("min_connections %d > max_connections %d", c.MinConnections, c.MaxConnections)
+	}
+	if c.WriteConcern != "" && c.WriteConcern != "majority" {
+		if n, err := strconv.Atoi(c.WriteConcern); err != nil || n < 0 {
+			return fmt.Errorf("invalid write_concern: %s: must be \"majority\" or a number of nodes >= 0", c.WriteConcern)
+		}
+	}
+	switch c.ReadConcern {
+	case "", "local", "available", "majority", "linearizable", "snapshot":
+	default:
+		return fmt.Errorf("invalid read_concern: %s: valid values: local, available, majority, linearizable, snapshot", c.ReadConcern)
+	}
+	switch strings.ToLower(c.ReadPreference) {
+	case "", "primary", "primarypreferred", "secondary", "secondarypreferred", "nearest":
+	default:
+		return fmt.Errorf("invalid read_preference: %s: valid values: primary, primaryPreferred, secondary, secondaryPreferred, nearest", c.ReadPreference)
+	}
+	return nil
+}
+
 type EntityConfig struct {
 	Types     []string `yaml:"types"`
 	BatchSize int      `yaml:"batch_size"`
+
+	// MaxGroups is the maximum number of groups returned by a grouped query
+	// (GET /entities/:type?groupBy=label). If zero, DEFAULT_MAX_GROUPS is used.
+	MaxGroups int `yaml:"max_groups"`
+
+	// MaxResults is the maximum number of entities returned by a query. A query
+	// that matches more entities returns a "result-too-large" error instead of
+	// partial results. If zero (default), there is no limit.
+	MaxResults int64 `yaml:"max_results"`
+
+	// MaxQueryTime is the maximum time a query runs on MongoDB, like "5s", to bound
+	// slow queries independent of the request timeout (datasource.query_timeout).
+	// A query that exceeds it returns a "query-timeout" error. A caller can lower it
+	// per query (etre.QueryFilter.MaxTimeMS). If empty (default), there is no limit.
+	MaxQueryTime string `yaml:"max_query_time"`
+
+	// Id is the optional _id strategy keyed on entity type. Entity types not
+	// listed use the default strategy: a random MongoDB ObjectID.
+	Id map[string]IdConfig `yaml:"id"`
+
+	// Transactions writes each entity and its CDC event in one MongoDB transaction,
+	// so a crash or CDC write error cannot change an entity without a CDC event.
+	// It requires a replica set (not supported by DocumentDB) and CDC enabled.
+	// CDC events are written to the main datasource; cdc.datasource is ignored.
+	// If false (default), the entity is written first, then the CDC event is
+	// written according to the cdc.write_retry_* and cdc.fallback_file config.
+	// With transactions, every CDC event increments one sequence number counter,
+	// which serializes all writes: concurrent writes conflict on the counter and
+	// are retried, so write throughput is lower than without transactions.
+	Transactions bool `yaml:"transactions"`
+
+	// SoftDelete makes deletes reversible: instead of removing an entity, a delete
+	// sets metalabel _deleted to the delete time (Unix nanoseconds), and a CDC
+	// delete event is written as usual. Soft-deleted entities are not returned
+	// by queries unless requested (etre.QueryFilter.IncludeDeleted), and they
+	// cannot be updated or deleted again. They still count for unique indexes.
+	// Entities soft-deleted before this is disabled remain hidden.
+	SoftDelete bool `yaml:"soft_delete"`
+
+	// Datasource is the optional datasource keyed on entity type to store entity
+	// types in different databases or clusters. Entity types not listed use the
+	// main datasource. Fields not set default to the main datasource, so usually
+	// only url or database is set. See Config.EntityDatasource.
+	Datasource map[string]DatasourceConfig `yaml:"datasource"`
+
+	// MaxLabels is the maximum number of labels per entity, not counting metalabels.
+	// MaxValueBytes is the maximum size of a string label value in bytes. Inserts
+	// and updates exceeding a limit return an "entity-too-large" error. Updates
+	// are checked by patch and, for MaxLabels, the entity after the update: an
+	// update cannot make the entity have more labels than the max (an entity
+	// already over the max can be updated if it doesn't gain labels). Zero
+	// (default) is no limit.
+	MaxLabels     int `yaml:"max_labels"`
+	MaxValueBytes int `yaml:"max_value_bytes"`
+
+	// LabelPattern is an optional regular expression that new label names must
+	// match, like "^[a-z][a-z0-9_-]*$". It's in addition to the fixed rules: label
+	// names cannot contain "." or "$", or begin with "_" (reserved for metalabels).
+	// Existing labels that do not match can be read and removed.
+	LabelPattern string `yaml:"label_pattern"`
+
+	// Schema is the optional label schema keyed on entity type: the known labels
+	// of each entity type. Query label usage metrics count only schema labels.
+	// Inserts and updates are validated against schema label constraints, if any.
+	Schema map[string]SchemaConfig `yaml:"schema"`
+
+	// Filter is the optional default query filter keyed on entity type, which the
+	// API merges with the query filter of every read. It's a coarse policy for all
+	// callers, in addition to label-level auth (security.acl allow/deny labels).
+	Filter map[string]FilterConfig `yaml:"filter"`
+}
+
+// FilterConfig is the default query filter for one entity type. If Labels is set,
+// only these labels are returned: they are the labels returned if the caller does
+// not request specific labels, and other requested labels are removed. StripLabels
+// are never returned, like secrets. Metalabels are always returned unless stripped.
+// Limit is the query limit if the caller does not set one; the caller can set a
+// greater or lesser limit. Sort is the query sort if the caller does not set one,
+// like "x:1,y:-1" (see etre.QueryFilter.Sort); it should be an indexed label.
+// Callers cannot override Labels or StripLabels.
+type FilterConfig struct {
+	Labels      []string `yaml:"labels"`
+	StripLabels []string `yaml:"strip_labels"`
+	Limit       int64    `yaml:"limit"`
+	Sort        string   `yaml:"sort"`
+}
+
+// LabelReturned returns true if the label is returned by the filter: it's a
+// metalabel or in Labels (if set), and it's not in StripLabels.
+func (c FilterConfig) LabelReturned(label string) bool {
+	if inList(label, c.StripLabels) {
+		return false
+	}
+	if len(c.Labels) == 0 || etre.IsMetalabel(label) {
+		return true
+	}
+	return inList(label, c.Labels)
+}
+
+// SchemaConfig is the label schema for one entity type.
+type SchemaConfig struct {
+	Labels []LabelSchema `yaml:"labels"`
+}
+
+// LabelSchema is one label in a SchemaConfig. The constraints are optional.
+// Required labels must be set (not null) on insert and cannot be removed.
+// Type is the label value type: LABEL_TYPE_STRING, LABEL_TYPE_INT, or
+// LABEL_TYPE_BOOL. Enum is the list of valid values, written as strings
+// even for int and bool labels (like "1" or "true").
+type LabelSchema struct {
+	Name     string   `yaml:"name"`
+	Required bool     `yaml:"required"`
+	Type     string   `yaml:"type"`
+	Enum     []string `yaml:"enum"`
+}
+
+// SchemaLabel returns true if the label is in the entity type schema.
+func (c EntityConfig) SchemaLabel(entityType, label string) bool {
+	for _, l := range c.Schema[entityType].Labels {
+		if l.Name == label {
+			return true
+		}
+	}
+	return false
+}
+
+// IdConfig defines how the entity store generates _id for new entities of one
+// entity type. Strategy objectid (default) generates a MongoDB ObjectID, uuid
+// generates a random (version 4) UUID string, and hash generates the hex SHA-256
+// of the natural-key Labels, which must be set on every new entity. Hash ids are
+// content-addressable: inserting two entities with the same natural-key values
+// returns a duplicate entity error.
+//
+// Strategy label uses the string value of the one natural-key label as _id, like
+// a UUID assigned by the user. Format is the format of the label value: uuid, or
+// string (default) for any non-empty string. Like hash, _id is set on create and
+// does not change if the label is updated. Formats are fixed for other strategies,
+// see IdFormat.
+type IdConfig struct {
+	Strategy string   `yaml:"strategy"`
+	Labels   []string `yaml:"labels"`
+	Format   string   `yaml:"format"`
+}
+
+// IdStrategy returns the _id strategy for the entity type, which is
+// ID_STRATEGY_OBJECTID if not configured.
+func (c EntityConfig) IdStrategy(entityType string) string {
+	if s := c.Id[entityType].Strategy; s != "" {
+		return s
+	}
+	return ID_STRATEGY_OBJECTID
+}
+
+// IdFormat returns the _id format for the entity type, which is used to validate
+// entity ids: ID_FORMAT_OBJECTID for strategy objectid, ID_FORMAT_UUID for uuid,
+// and ID_FORMAT_STRING for hash. For strategy label, it's the configured format,
+// or ID_FORMAT_STRING if not configured.
+func (c EntityConfig) IdFormat(entityType string) string {
+	switch c.IdStrategy(entityType) {
+	case ID_STRATEGY_OBJECTID:
+		return ID_FORMAT_OBJECTID
+	case ID_STRATEGY_UUID:
+		return ID_FORMAT_UUID
+	case ID_STRATEGY_LABEL:
+		if f := c.Id[entityType].Format; f != "" {
+			return f
+		}
+	}
+	return ID_FORMAT_STRING
 }
 
 type CDCConfig struct {
@@ -206,10 +703,32 @@ type CDCConfig struct {
 	// If set, CDC events will attempt to be written to this file if they cannot
 	// be written to mongo.
 	FallbackFile string `yaml:"fallback_file"`
+	// Format of the fallback file, one JSON object per line: "event" (default)
+	// is the CDC event; "record" is the event with the time and the error writing
+	// it to mongo.
+	FallbackFormat string `yaml:"fallback_format"`
+	// Rotate the fallback file before it exceeds this many bytes. If not set,
+	// the file is not rotated by size.
+	FallbackMaxSize int64 `yaml:"fallback_max_size"`
+	// Rotate the fallback file when it's older than this (duration string, e.g.
+	// "24h"). If not set, the file is not rotated by age.
+	FallbackMaxAge string `yaml:"fallback_max_age"`
+	// Number of rotated fallback files to keep. The oldest are deleted, and their
+	// events are lost. If not set, all rotated files are kept until replayed.
+	FallbackMaxFiles int `yaml:"fallback_max_files"`
 	// Number of times CDC events will retry writing to mongo in the event of an error.
 	WriteRetryCount int `yaml:"write_retry_count"`
 	// Wait time in milliseconds between write retry events.
 	WriteRetryWait int `yaml:"write_retry_wait"` // milliseconds
+	// Maximum number of CDC events read for one entity: the most recent are
+	// returned by GET /entity/:type/:id/history and inline by ?history, and
+	// GET /entity/:type/:id/at cannot reconstruct an entity with more events.
+	MaxHistory int `yaml:"max_history"`
+	// How long CDC events are kept (duration string, e.g. "720h"). If set, the
+	// server periodically deletes older events, and change feeds cannot start
+	// before the retention window (etre.ErrCDCPositionGone). If not set, events
+	// are kept forever.
+	Retention string `yaml:"retention"`
 	// The collection that delays are stored in.
 
 	ChangeStream ChangeStreamConfig `yaml:"change_stream"`
@@ -222,6 +741,17 @@ type ChangeStreamConfig struct {
 	// buffer fills because the client is slow to receive events, the server
 	// drops the client.
 	BufferSize uint `yaml:"buffer_size"`
+
+	// SlowClientPolicy is what the server does when a client buffer is full:
+	// "drop" (default) drops the client immediately; "disconnect" holds events
+	// for the client and disconnects it if its buffer is still full after
+	// SlowClientGrace. Either way, the client is closed with error type
+	// "slow-consumer" and can reconnect and resume.
+	SlowClientPolicy string `yaml:"slow_client_policy"`
+
+	// SlowClientGrace is how long a client buffer can stay full with
+	// slow_client_policy=disconnect (duration string, e.g. "10s").
+	SlowClientGrace string `yaml:"slow_client_grace"`
 }
 
 type ServerConfig struct {
@@ -229,19 +759,81 @@ type ServerConfig struct {
 	TLSCert string `yaml:"tls_cert"`
 	TLSKey  string `yaml:"tls_key"`
 	TLSCA   string `yaml:"tls_ca"`
+
+	// MaxBodyBytes is the maximum size of a request body (entities to insert or
+	// update). Larger requests return HTTP status 413 (Payload Too Large). If zero,
+	// DEFAULT_MAX_BODY_BYTES is used.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+
+	// ImportBatchSize is the number of entities inserted per batch by an import
+	// (POST /entities/:type/import) unless the request sets batchSize. An import
+	// has no max body size, but each entity (line) is limited to MaxBodyBytes.
+	// If zero, DEFAULT_IMPORT_BATCH_SIZE is used.
+	ImportBatchSize int `yaml:"import_batch_size"`
+
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+}
+
+// RateLimitConfig limits entity requests per metric group (auth.Caller.MetricGroups).
+// The default limit applies to every group unless the group has its own limit in
+// Groups. If the rate is zero, the group is not limited. When a group exceeds its
+// limit, the API returns HTTP status 429 (Too Many Requests).
+type RateLimitConfig struct {
+	RequestsPerSecond float64              `yaml:"requests_per_second"`
+	Burst             int                  `yaml:"burst"`
+	Groups            map[string]RateLimit `yaml:"groups"`
+}
+
+// RateLimit is the rate limit for one metric group. If Burst is zero, it's
+// RequestsPerSecond (minimum 1).
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
 }
 
 type SecurityConfig struct {
 	ACL []ACL `yaml:"acl"`
+
+	// StaticTokens enables built-in bearer token authentication (auth.StaticAuth)
+	// for deployments without an external identity provider.
+	StaticTokens []StaticToken `yaml:"static_tokens"`
+}
+
+// StaticToken maps a bearer token to a caller, see auth.StaticAuth.
+type StaticToken struct {
+	Token        string   `yaml:"token"`
+	Name         string   `yaml:"name"`
+	Roles        []string `yaml:"roles"`
+	MetricGroups []string `yaml:"metric_groups"`
 }
 
 type ACL struct {
-	Role              string   `yaml:"role"`
-	Admin             bool     `yaml:"admin"`
-	Read              []string `yaml:"read"`
-	Write             []string `yaml:"write"`
-	CDC               bool     `yaml:"cdc"`
-	TraceKeysRequired []string `yaml:"trace_keys_required"`
+	Role              string            `yaml:"role"`
+	Admin             bool              `yaml:"admin"`
+	Read              []string          `yaml:"read"`
+	Write             []string          `yaml:"write"`
+	Insert            []string          `yaml:"insert"`
+	Update            []string          `yaml:"update"`
+	Delete            []string          `yaml:"delete"`
+	CDC               bool              `yaml:"cdc"`
+	TraceKeysRequired []string          `yaml:"trace_keys_required"`
+	TraceKeyPatterns  map[string]string `yaml:"trace_key_patterns"`
+	Inherits          []string          `yaml:"inherits"`
+	Deny              ACLDeny           `yaml:"deny"`
+
+	// Labels denied or allowed by entity type, see auth.ACL
+	DenyLabels  map[string][]string `yaml:"deny_labels"`
+	AllowLabels map[string][]string `yaml:"allow_labels"`
+}
+
+// ACLDeny denies ops on entity types, see auth.Deny.
+type ACLDeny struct {
+	Read   []string `yaml:"read"`
+	Write  []string `yaml:"write"`
+	Insert []string `yaml:"insert"`
+	Update []string `yaml:"update"`
+	Delete []string `yaml:"delete"`
+	CDC    bool     `yaml:"cdc"`
 }
 
 type MetricsConfig struct {
@@ -249,3 +841,12 @@ type MetricsConfig struct {
 	QueryProfileSampleRate      float64 `yaml:"query_profile_sample_rate"`
 	QueryProfileReportThreshold string  `yaml:"query_profile_report_threshold"` // duration string
 }
+
+func inList(s string, l []string) bool {
+	for _, v := range l {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -105,3 +105,292 @@ func TestLoadTestACL(t *testing.T) {
 	}
 	assert.Equal(t, expect, got)
 }
+
+func TestLoadTestStaticTokens(t *testing.T) {
+	got, err := config.Load("../test/config/testStaticTokens.yaml", config.Default())
+	require.NoError(t, err)
+
+	expect := config.Default()
+	expect.Security.StaticTokens = []config.StaticToken{
+		{
+			Token:        "abc123",
+			Name:         "deploy",
+			Roles:        []string{"ops"},
+			MetricGroups: []string{"deploy"},
+		},
+		{
+			Token: "def456",
+			Name:  "dashboard",
+			Roles: []string{"ro"},
+		},
+	}
+	assert.Equal(t, expect, got)
+
+	// Tokens are secret, so they're redacted like passwords, without
+	// modifying the original config
+	redacted := config.Redact(got)
+	assert.Equal(t, "<redacted>", redacted.Security.StaticTokens[0].Token)
+	assert.Equal(t, "deploy", redacted.Security.StaticTokens[0].Name)
+	assert.Equal(t, "abc123", got.Security.StaticTokens[0].Token)
+}
+
+func TestValidateIdStrategy(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.Types = []string{"node", "host", "rack", "pod"}
+	cfg.Entity.Id = map[string]config.IdConfig{
+		"node": {Strategy: config.ID_STRATEGY_UUID},
+		"host": {Strategy: config.ID_STRATEGY_HASH, Labels: []string{"hostname"}},
+		"rack": {Strategy: config.ID_STRATEGY_LABEL, Labels: []string{"uuid"}, Format: config.ID_FORMAT_UUID},
+		"pod":  {Strategy: config.ID_STRATEGY_LABEL, Labels: []string{"name"}},
+	}
+	require.NoError(t, config.Validate(cfg))
+	assert.Equal(t, config.ID_STRATEGY_UUID, cfg.Entity.IdStrategy("node"))
+	assert.Equal(t, config.ID_STRATEGY_HASH, cfg.Entity.IdStrategy("host"))
+	assert.Equal(t, config.ID_STRATEGY_LABEL, cfg.Entity.IdStrategy("rack"))
+	assert.Equal(t, config.ID_FORMAT_UUID, cfg.Entity.IdFormat("node"))
+	assert.Equal(t, config.ID_FORMAT_STRING, cfg.Entity.IdFormat("host"))
+	assert.Equal(t, config.ID_FORMAT_UUID, cfg.Entity.IdFormat("rack"))
+	assert.Equal(t, config.ID_FORMAT_STRING, cfg.Entity.IdFormat("pod"))
+
+	invalid := []map[string]config.IdConfig{
+		{"node": {Strategy: "random"}},                                                                           // unknown strategy
+		{"node": {Strategy: config.ID_STRATEGY_HASH}},                                                            // hash without labels
+		{"node": {Strategy: config.ID_STRATEGY_UUID, Labels: []string{"a"}}},                                     // labels without hash
+		{"dns": {Strategy: config.ID_STRATEGY_UUID}},                                                             // not an entity type
+		{"node": {Strategy: config.ID_STRATEGY_LABEL}},                                                           // label without labels
+		{"node": {Strategy: config.ID_STRATEGY_LABEL, Labels: []string{"a", "b"}}},                               // label with two labels
+		{"node": {Strategy: config.ID_STRATEGY_LABEL, Labels: []string{"a"}, Format: "int"}},                     // unknown format
+		{"node": {Strategy: config.ID_STRATEGY_LABEL, Labels: []string{"a"}, Format: config.ID_FORMAT_OBJECTID}}, // objectid format
+		{"node": {Strategy: config.ID_STRATEGY_UUID, Format: config.ID_FORMAT_STRING}},                           // format without label
+	}
+	for _, id := range invalid {
+		cfg.Entity.Id = id
+		assert.Error(t, config.Validate(cfg), "%+v", id)
+	}
+
+	cfg.Entity.Id = nil
+	assert.Equal(t, config.ID_STRATEGY_OBJECTID, cfg.Entity.IdStrategy("node"))
+	assert.Equal(t, config.ID_FORMAT_OBJECTID, cfg.Entity.IdFormat("node"))
+}
+
+func TestValidateSchema(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.Types = []string{"node"}
+	cfg.Entity.Schema = map[string]config.SchemaConfig{
+		"node": {Labels: []config.LabelSchema{
+			{Name: "zone"},
+			{Name: "env", Required: true, Type: config.LABEL_TYPE_STRING, Enum: []string{"prod", "staging"}},
+			{Name: "cpus", Type: config.LABEL_TYPE_INT, Enum: []string{"8", "16"}},
+		}},
+	}
+	require.NoError(t, config.Validate(cfg))
+	assert.True(t, cfg.Entity.SchemaLabel("node", "zone"))
+	assert.False(t, cfg.Entity.SchemaLabel("node", "rack"))
+	assert.False(t, cfg.Entity.SchemaLabel("host", "zone"))
+
+	invalid := []map[string]config.SchemaConfig{
+		{"host": {Labels: []config.LabelSchema{{Name: "zone"}}}},                                                        // not an entity type
+		{"node": {Labels: []config.LabelSchema{{Name: ""}}}},                                                            // no name
+		{"node": {Labels: []config.LabelSchema{{Name: "zone"}, {Name: "zone"}}}},                                        // duplicate
+		{"node": {Labels: []config.LabelSchema{{Name: "zone", Type: "float"}}}},                                         // invalid type
+		{"node": {Labels: []config.LabelSchema{{Name: "cpus", Type: config.LABEL_TYPE_INT, Enum: []string{"8", "x"}}}}}, // enum not type
+	}
+	for _, schema := range invalid {
+		cfg.Entity.Schema = schema
+		assert.Error(t, config.Validate(cfg), "%+v", schema)
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.Types = []string{"node"}
+	cfg.Entity.Filter = map[string]config.FilterConfig{
+		"node": {Labels: []string{"zone", "env"}, StripLabels: []string{"secret"}, Limit: 100, Sort: "zone:1,_id:-1"},
+	}
+	require.NoError(t, config.Validate(cfg))
+	f := cfg.Entity.Filter["node"]
+	assert.True(t, f.LabelReturned("zone"))
+	assert.True(t, f.LabelReturned("_id"))
+	assert.False(t, f.LabelReturned("rack"))
+	assert.False(t, f.LabelReturned("secret"))
+	assert.True(t, config.FilterConfig{StripLabels: []string{"secret"}}.LabelReturned("rack"))
+
+	invalid := []map[string]config.FilterConfig{
+		{"host": {Limit: 1}},  // not an entity type
+		{"node": {Limit: -1}}, // invalid limit
+		{"node": {Labels: []string{"zone"}, StripLabels: []string{"zone"}}}, // both
+		{"node": {Sort: "zone"}},                                      // no direction
+		{"node": {Sort: "zone:1,:-1"}},                                // no label
+		{"node": {Sort: "secret:1", StripLabels: []string{"secret"}}}, // not returned
+	}
+	for _, filter := range invalid {
+		cfg.Entity.Filter = filter
+		assert.Error(t, config.Validate(cfg), "%+v", filter)
+	}
+}
+
+func TestValidateEntityLimits(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.MaxLabels = 100
+	cfg.Entity.MaxValueBytes = 1024
+	require.NoError(t, config.Validate(cfg))
+	cfg.Entity.MaxLabels = -1
+	assert.Error(t, config.Validate(cfg))
+	cfg.Entity.MaxLabels = 0
+	cfg.Entity.MaxValueBytes = -1
+	assert.Error(t, config.Validate(cfg))
+	cfg.Entity.MaxValueBytes = 0
+	cfg.Entity.MaxQueryTime = "5s"
+	require.NoError(t, config.Validate(cfg))
+	for _, d := range []string{"5", "0s", "-1s"} {
+		cfg.Entity.MaxQueryTime = d
+		assert.Error(t, config.Validate(cfg), d)
+	}
+}
+
+func TestValidateLabelPattern(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.LabelPattern = "^[a-z][a-z0-9-]*$"
+	require.NoError(t, config.Validate(cfg))
+	cfg.Entity.LabelPattern = "[a-z"
+	assert.Error(t, config.Validate(cfg))
+}
+
+func TestValidateDatasourceConcerns(t *testing.T) {
+	cfg := config.Default()
+	cfg.Datasource.WriteConcern = "majority"
+	cfg.Datasource.ReadConcern = "majority"
+	cfg.Datasource.ReadPreference = "primaryPreferred"
+	cfg.CDC.Datasource = cfg.CDC.Datasource.WithDefaults(cfg.Datasource)
+	assert.Equal(t, "majority", cfg.CDC.Datasource.WriteConcern) // inherited
+	require.NoError(t, config.Validate(cfg))
+
+	cfg.CDC.Datasource.WriteConcern = "1"
+	require.NoError(t, config.Validate(cfg))
+
+	cfg.CDC.Datasource.WriteConcern = "one"
+	assert.Error(t, config.Validate(cfg))
+	cfg.CDC.Datasource.WriteConcern = ""
+
+	cfg.Datasource.ReadConcern = "strong"
+	assert.Error(t, config.Validate(cfg))
+	cfg.Datasource.ReadConcern = ""
+
+	cfg.Datasource.ReadPreference = "any"
+	assert.Error(t, config.Validate(cfg))
+}
+
+func TestValidateDatasourcePool(t *testing.T) {
+	cfg := config.Default()
+	require.NoError(t, config.Validate(cfg))
+
+	cfg.Datasource.MinConnections = 100
+	cfg.Datasource.MaxConnections = 50
+	assert.Error(t, config.Validate(cfg))
+	cfg.Datasource.MaxConnections = 0 // driver default
+	require.NoError(t, config.Validate(cfg))
+
+	for _, d := range []string{"5", "-1s", "0s", "fast"} {
+		cfg := config.Default()
+		cfg.CDC.Datasource.ServerSelectionTimeout = d
+		assert.Error(t, config.Validate(cfg), "server_selection_timeout %s", d)
+		cfg = config.Default()
+		cfg.Datasource.ConnectTimeout = d
+		assert.Error(t, config.Validate(cfg), "connect_timeout %s", d)
+	}
+}
+
+func TestEntityDatasource(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.Types = []string{"node", "host", "rack"}
+	cfg.Entity.Datasource = map[string]config.DatasourceConfig{
+		"node": {URL: "mongodb://nodes:27017"},
+		"host": {Database: "hosts"},
+	}
+	require.NoError(t, config.Validate(cfg))
+
+	node := cfg.EntityDatasource("node")
+	assert.Equal(t, "mongodb://nodes:27017", node.URL)
+	assert.Equal(t, cfg.Datasource.Database, node.Database) // default
+	assert.Equal(t, cfg.Datasource.ConnectTimeout, node.ConnectTimeout)
+	assert.NotEqual(t, cfg.Datasource.ClientConfig(), node.ClientConfig())
+
+	host := cfg.EntityDatasource("host")
+	assert.Equal(t, "hosts", host.Database)
+	assert.Equal(t, cfg.Datasource.ClientConfig(), host.ClientConfig()) // same cluster
+
+	assert.Equal(t, cfg.Datasource, cfg.EntityDatasource("rack"))
+
+	// Transactions require the same cluster
+	cfg.CDC.Disabled = false
+	cfg.Entity.Transactions = true
+	assert.Error(t, config.Validate(cfg))
+	delete(cfg.Entity.Datasource, "node")
+	require.NoError(t, config.Validate(cfg))
+	cfg.Entity.Transactions = false
+
+	cfg.Entity.Datasource["dns"] = config.DatasourceConfig{Database: "dns"}
+	assert.Error(t, config.Validate(cfg)) // not an entity type
+}
+
+func TestValidateTransactions(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.Transactions = true
+	require.NoError(t, config.Validate(cfg))
+
+	// Entity and CDC writes are in one transaction, so CDC is required
+	cfg.CDC.Disabled = true
+	assert.Error(t, config.Validate(cfg))
+}
+
+func TestValidateCDCRetention(t *testing.T) {
+	cfg := config.Default()
+	cfg.CDC.Retention = "720h"
+	require.NoError(t, config.Validate(cfg))
+
+	cfg.CDC.Retention = "30 days"
+	assert.Error(t, config.Validate(cfg))
+
+	cfg.CDC.Retention = "-1h"
+	assert.Error(t, config.Validate(cfg))
+}
+
+func TestValidateCDCFallback(t *testing.T) {
+	cfg := config.Default()
+	cfg.CDC.FallbackFormat = "record"
+	cfg.CDC.FallbackMaxSize = 1 << 20
+	cfg.CDC.FallbackMaxAge = "24h"
+	cfg.CDC.FallbackMaxFiles = 10
+	require.NoError(t, config.Validate(cfg))
+
+	cfg.CDC.FallbackFormat = "csv"
+	assert.Error(t, config.Validate(cfg))
+	cfg.CDC.FallbackFormat = ""
+
+	cfg.CDC.FallbackMaxAge = "1 day"
+	assert.Error(t, config.Validate(cfg))
+	cfg.CDC.FallbackMaxAge = "0s"
+	assert.Error(t, config.Validate(cfg))
+	cfg.CDC.FallbackMaxAge = ""
+
+	cfg.CDC.FallbackMaxSize = -1
+	assert.Error(t, config.Validate(cfg))
+	cfg.CDC.FallbackMaxSize = 0
+
+	cfg.CDC.FallbackMaxFiles = -1
+	assert.Error(t, config.Validate(cfg))
+}
+
+func TestValidateSlowClientPolicy(t *testing.T) {
+	cfg := config.Default()
+	cfg.CDC.ChangeStream.SlowClientPolicy = "disconnect"
+	cfg.CDC.ChangeStream.SlowClientGrace = "10s"
+	require.NoError(t, config.Validate(cfg))
+
+	cfg.CDC.ChangeStream.SlowClientGrace = "10"
+	assert.Error(t, config.Validate(cfg))
+
+	cfg.CDC.ChangeStream.SlowClientGrace = ""
+	cfg.CDC.ChangeStream.SlowClientPolicy = "block"
+	assert.Error(t, config.Validate(cfg))
+}
@@ -7,10 +7,15 @@ import (
 	"crypto/x509"
 	"io/ioutil"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+	"go.mongodb.org/mongo-driver/v2/mongo/writeconcern"
 
 	"github.com/square/etre/config"
 )
@@ -24,12 +29,30 @@ type Plugin interface {
 type Default struct{}
 
 func (d Default) Connect(cfg config.DatasourceConfig) (*mongo.Client, error) {
-	tlsConfig, err := loadTLS(cfg)
+	opts, err := ClientOptions(cfg)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Username == "" {
+		log.Printf("WARNING: No database username for %s specified in config. Authentication will fail unless MongoDB access control is disabled.", cfg.URL)
+	}
+
+	// mongo.Connect() does not actually connect to the database.
+	// The caller must call client.Ping() to actually connect. Consequently,
+	// we don't need a context here. As long as there's not a bug in the mongo
+	// driver, this won't block.
+	return mongo.Connect(opts)
+}
 
-	timeout, err := time.ParseDuration(cfg.ConnectTimeout)
+// ClientOptions returns the client options for the datasource config: URL, TLS,
+// connection pool size, timeouts, and credentials. Pool size and timeouts not
+// set in the config are not set, so the driver default is used.
+func ClientOptions(cfg config.DatasourceConfig) (*options.ClientOptions, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := loadTLS(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -41,19 +64,29 @@ func (d Default) Connect(cfg config.DatasourceConfig) (*mongo.Client, error) {
 	// instantaneous when the cluster is ok _and_ when it's down. When a node
 	// is down, it's reflected in the topology, so there's no need to wait for
 	// another server because we only use one server: the master replica.
-	// The 500ms below is really how long the driver will wait for the master
-	// replica to come back online.
+	// The server selection timeout (default 500ms) is really how long the driver
+	// will wait for the master replica to come back online.
 	//
 	// SetConnectTimeout is what is seems: timeout when a connection is actually
 	// made. This guards against slows networks, or the case when the mongo driver
 	// thinks the master is online but really it's not.
 	opts := options.Client().
 		ApplyURI(cfg.URL).
-		SetTLSConfig(tlsConfig).
-		SetMaxPoolSize(cfg.MinConnections).
-		SetMaxPoolSize(cfg.MaxConnections).
-		SetConnectTimeout(timeout).
-		SetServerSelectionTimeout(time.Duration(500 * time.Millisecond))
+		SetTLSConfig(tlsConfig)
+	if cfg.MinConnections > 0 {
+		opts.SetMinPoolSize(cfg.MinConnections)
+	}
+	if cfg.MaxConnections > 0 {
+		opts.SetMaxPoolSize(cfg.MaxConnections)
+	}
+	if cfg.ConnectTimeout != "" {
+		timeout, _ := time.ParseDuration(cfg.ConnectTimeout) // validated above
+		opts.SetConnectTimeout(timeout)
+	}
+	if cfg.ServerSelectionTimeout != "" {
+		timeout, _ := time.ParseDuration(cfg.ServerSelectionTimeout) // validated above
+		opts.SetServerSelectionTimeout(timeout)
+	}
 
 	if cfg.Username != "" {
 		creds := options.Credential{
@@ -63,15 +96,46 @@ func (d Default) Connect(cfg config.DatasourceConfig) (*mongo.Client, error) {
 			Password:      cfg.Password,
 		}
 		opts = opts.SetAuth(creds)
-	} else {
-		log.Printf("WARNING: No database username for %s specified in config. Authentication will fail unless MongoDB access control is disabled.", cfg.URL)
 	}
 
-	// mongo.Connect() does not actually connect to the database.
-	// The caller must call client.Ping() to actually connect. Consequently,
-	// we don't need a context here. As long as there's not a bug in the mongo
-	// driver, this won't block.
-	return mongo.Connect(opts)
+	return opts, nil
+}
+
+// CollectionOptions returns collection options for the write concern, read concern,
+// and read preference in the datasource config. Options not set in the config are
+// not set, so the client (driver or URL) default is used.
+func CollectionOptions(cfg config.DatasourceConfig) (*options.CollectionOptionsBuilder, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	opts := options.Collection()
+
+	switch cfg.WriteConcern {
+	case "":
+	case "majority":
+		opts.SetWriteConcern(writeconcern.Majority())
+	default:
+		w, _ := strconv.Atoi(cfg.WriteConcern) // validated above
+		opts.SetWriteConcern(&writeconcern.WriteConcern{W: w})
+	}
+
+	if cfg.ReadConcern != "" {
+		opts.SetReadConcern(&readconcern.ReadConcern{Level: cfg.ReadConcern})
+	}
+
+	if cfg.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(strings.ToLower(cfg.ReadPreference))
+		if err != nil {
+			return nil, err
+		}
+		rp, err := readpref.New(mode)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetReadPreference(rp)
+	}
+
+	return opts, nil
 }
 
 func loadTLS(cfg config.DatasourceConfig) (*tls.Config, error) {
@@ -0,0 +1,102 @@
+// Copyright 2026, Square, Inc.
+
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+
+	"github.com/square/etre/config"
+	"github.com/square/etre/db"
+)
+
+func collectionOptions(t *testing.T, cfg config.DatasourceConfig) *options.CollectionOptions {
+	t.Helper()
+	builder, err := db.CollectionOptions(cfg)
+	require.NoError(t, err)
+	opts := &options.CollectionOptions{}
+	for _, set := range builder.List() {
+		require.NoError(t, set(opts))
+	}
+	return opts
+}
+
+func TestCollectionOptions(t *testing.T) {
+	// Nothing set: driver defaults
+	opts := collectionOptions(t, config.DatasourceConfig{})
+	assert.Nil(t, opts.WriteConcern)
+	assert.Nil(t, opts.ReadConcern)
+	assert.Nil(t, opts.ReadPreference)
+
+	opts = collectionOptions(t, config.DatasourceConfig{
+		WriteConcern:   "majority",
+		ReadConcern:    "majority",
+		ReadPreference: "secondaryPreferred",
+	})
+	require.NotNil(t, opts.WriteConcern)
+	assert.Equal(t, "majority", opts.WriteConcern.W)
+	require.NotNil(t, opts.ReadConcern)
+	assert.Equal(t, "majority", opts.ReadConcern.Level)
+	require.NotNil(t, opts.ReadPreference)
+	assert.Equal(t, readpref.SecondaryPreferredMode, opts.ReadPreference.Mode())
+
+	opts = collectionOptions(t, config.DatasourceConfig{WriteConcern: "2"})
+	require.NotNil(t, opts.WriteConcern)
+	assert.Equal(t, 2, opts.WriteConcern.W)
+
+	for _, cfg := range []config.DatasourceConfig{
+		{WriteConcern: "all"},
+		{WriteConcern: "-1"},
+		{ReadConcern: "strong"},
+		{ReadPreference: "primaryOnly"},
+	} {
+		_, err := db.CollectionOptions(cfg)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	cfg := config.Default().Datasource
+	opts, err := db.ClientOptions(cfg)
+	require.NoError(t, err)
+	require.NotNil(t, opts.MinPoolSize)
+	assert.Equal(t, uint64(config.DEFAULT_DB_MIN_CONN), *opts.MinPoolSize)
+	require.NotNil(t, opts.MaxPoolSize)
+	assert.Equal(t, uint64(config.DEFAULT_DB_MAX_CONN), *opts.MaxPoolSize)
+	require.NotNil(t, opts.ConnectTimeout)
+	assert.Equal(t, 5*time.Second, *opts.ConnectTimeout)
+	require.NotNil(t, opts.ServerSelectionTimeout)
+	assert.Equal(t, 500*time.Millisecond, *opts.ServerSelectionTimeout)
+	assert.Nil(t, opts.Auth)
+
+	cfg.MinConnections = 50
+	cfg.MaxConnections = 200
+	cfg.ConnectTimeout = "2s"
+	cfg.ServerSelectionTimeout = "3s"
+	cfg.Username = "etre"
+	opts, err = db.ClientOptions(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(50), *opts.MinPoolSize)
+	assert.Equal(t, uint64(200), *opts.MaxPoolSize)
+	assert.Equal(t, 2*time.Second, *opts.ConnectTimeout)
+	assert.Equal(t, 3*time.Second, *opts.ServerSelectionTimeout)
+	require.NotNil(t, opts.Auth)
+	assert.Equal(t, "etre", opts.Auth.Username)
+
+	// Not set: driver defaults
+	opts, err = db.ClientOptions(config.DatasourceConfig{URL: config.DEFAULT_DATASOURCE_URL})
+	require.NoError(t, err)
+	assert.Nil(t, opts.MinPoolSize)
+	assert.Nil(t, opts.MaxPoolSize)
+	assert.Nil(t, opts.ConnectTimeout)
+	assert.Nil(t, opts.ServerSelectionTimeout)
+
+	cfg.MinConnections = 500
+	_, err = db.ClientOptions(cfg)
+	assert.Error(t, err)
+}
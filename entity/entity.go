@@ -4,8 +4,10 @@ package entity
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/square/etre"
+	"github.com/square/etre/config"
 	"github.com/square/etre/query"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -16,12 +18,41 @@ type DbError struct {
 	Err      error
 	Type     string
 	EntityId string
+
+	// Conflict is the labels and values of the unique index that conflict with
+	// another entity if Type is "duplicate-entity", like {"hostname": "foo"}.
+	// It's nil if MongoDB did not return the key values (see dupeKeyConflict).
+	Conflict etre.Entity
 }
 
 func (e DbError) Error() string {
 	return e.Err.Error()
 }
 
+// Unwrap returns the MongoDB error so the driver can check its error labels,
+// like TransientTransactionError, to retry a transaction.
+func (e DbError) Unwrap() error {
+	return e.Err
+}
+
+// InsertErrors is returned by CreateEntities for an unordered insert (WriteOp.Unordered)
+// when some entities are not inserted. It maps the index of each entity that was
+// not inserted to its error. All other entities were inserted.
+type InsertErrors map[int]error
+
+func (e InsertErrors) Error() string {
+	return fmt.Sprintf("%d entities not inserted", len(e))
+}
+
+// UpdateErrors is returned by UpdateEntities for an unordered update (WriteOp.Unordered)
+// when some matching entities are not updated. It maps the _id of each entity that
+// was not updated to its error. All other matching entities were updated.
+type UpdateErrors map[string]error
+
+func (e UpdateErrors) Error() string {
+	return fmt.Sprintf("%d entities not updated", len(e))
+}
+
 // WriteOp represents common metadata for insert, update, and delete Store methods.
 type WriteOp struct {
 	Caller     string // required (auth.Caller.Name)
@@ -34,9 +65,22 @@ type WriteOp struct {
 	// will pass along the set op values. This could (but not currently) also
 	// be used to impose/inject a set op on a write op that doesn't specify
 	// a set op.
+	//
+	// If SetId is set but SetSize is zero, bulk writes set SetSize to the
+	// number of entities written. The API does this for bulk writes without
+	// a set so that all their CDC events share one server-generated SetId.
 	SetOp   string // optional
 	SetId   string // optional
 	SetSize int    // optional
+
+	// Unordered inserts and updates continue after an entity is not written (for
+	// example, a duplicate) instead of stopping at the first error. Only CreateEntities
+	// and UpdateEntities use it; the API sets it with ?ordered=false.
+	Unordered bool // optional
+
+	// Upsert inserts an entity if no entity matches the update query. Only
+	// UpdateEntities uses it; the API sets it with ?upsert=true.
+	Upsert bool // optional
 }
 
 // Map of Kubernetes Selection Operator to mongoDB Operator.
@@ -53,8 +97,29 @@ var operatorMap = map[string]string{
 }
 
 // Filter translates a query.Query into a mongo-driver filter paramter.
+//
+// Array-valued labels (for example, tags: ["prod", "db"]) use MongoDB array
+// element matching, so operators have "contains" semantics: tags=prod and
+// tags in (prod) match if any element is prod; tags!=prod and tags notin (prod)
+// match if no element is prod. Like scalar labels, != and notin also match
+// entities that do not have the label.
+//
+// Or queries are translated to $or. _id values are translated by IdValue.
 func Filter(q query.Query) bson.M {
+	return filterIds(q, IdValue)
+}
+
+// filterIds is Filter with _id values translated by idValue, which depends on
+// the id format of the entity type (see store.idValue).
+func filterIds(q query.Query, idValue func(string) interface{}) bson.M {
 	filter := bson.M{}
+	if len(q.Or) > 0 {
+		or := make(bson.A, len(q.Or))
+		for i, sub := range q.Or {
+			or[i] = filterIds(sub, idValue)
+		}
+		filter["$or"] = or
+	}
 	for _, p := range q.Predicates {
 		switch p.Operator {
 		case "exists":
@@ -65,15 +130,14 @@ func Filter(q query.Query) bson.M {
 			if p.Label == etre.META_LABEL_ID {
 				switch p.Value.(type) {
 				case string:
-					id, _ := bson.ObjectIDFromHex(p.Value.(string))
-					filter[p.Label] = bson.M{operatorMap[p.Operator]: id}
+					filter[p.Label] = bson.M{operatorMap[p.Operator]: idValue(p.Value.(string))}
 				case []string:
 					vals := p.Value.([]string)
-					oids := make([]bson.ObjectID, len(vals))
+					ids := make([]interface{}, len(vals))
 					for i, v := range vals {
-						oids[i], _ = bson.ObjectIDFromHex(v)
+						ids[i] = idValue(v)
 					}
-					filter[p.Label] = bson.M{operatorMap[p.Operator]: oids}
+					filter[p.Label] = bson.M{operatorMap[p.Operator]: ids}
 				case bson.ObjectID:
 					filter[p.Label] = bson.M{operatorMap[p.Operator]: p.Value}
 				default:
@@ -87,8 +151,74 @@ func Filter(q query.Query) bson.M {
 	return filter
 }
 
+// IdValue returns the _id value stored in MongoDB for the given entity id string.
+// An ObjectID hex string (24 hex characters) is returned as a bson.ObjectID because
+// that is the default _id type. Any other string (UUID, hash, etc.) is returned
+// as-is because entity types with a non-default id strategy store _id as a string.
+func IdValue(id string) interface{} {
+	if oid, err := bson.ObjectIDFromHex(id); err == nil {
+		return oid
+	}
+	return id
+}
+
+// ParseId returns the id in canonical form if it's valid for the id format
+// (config.EntityConfig.IdFormat): an ObjectID or UUID hex string, which is
+// returned lowercase, or any non-empty string.
+func ParseId(format, id string) (string, error) {
+	if id == "" {
+		return "", fmt.Errorf("empty id")
+	}
+	switch format {
+	case config.ID_FORMAT_OBJECTID:
+		oid, err := bson.ObjectIDFromHex(id)
+		if err != nil {
+			return "", fmt.Errorf("id '%s' is not a valid ObjectID: %v", id, err)
+		}
+		return oid.Hex(), nil
+	case config.ID_FORMAT_UUID:
+		if len(id) != 36 {
+			return "", fmt.Errorf("id '%s' is not a valid UUID: length %d, expected 36", id, len(id))
+		}
+		for i := 0; i < len(id); i++ {
+			c := id[i]
+			switch i {
+			case 8, 13, 18, 23:
+				if c != '-' {
+					return "", fmt.Errorf("id '%s' is not a valid UUID: expected - at index %d", id, i)
+				}
+			default:
+				if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+					return "", fmt.Errorf("id '%s' is not a valid UUID: invalid hex character %q", id, c)
+				}
+			}
+		}
+		return strings.ToLower(id), nil
+	}
+	return id, nil
+}
+
+// IdString returns the string form of an _id value from MongoDB: the hex value
+// of a bson.ObjectID, or the string as-is.
+func IdString(id interface{}) string {
+	switch v := id.(type) {
+	case bson.ObjectID:
+		return v.Hex()
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
 const dupeKeyCode = 11000
 
+// typeMismatchCode is the MongoDB error code for an update operator applied to
+// a value of the wrong type, like $inc on a string label.
+const typeMismatchCode = 14
+
 func IsDupeKeyError(err error) error {
 	// mongo.WriteException{
 	//	 WriteConcernError:(*mongo.WriteConcernError)(nil),
@@ -116,3 +246,29 @@ func IsDupeKeyError(err error) error {
 	}
 	return nil
 }
+
+// dupeKeyConflict returns the labels and values of the unique index from a
+// duplicate key error returned by IsDupeKeyError. MongoDB returns them in field
+// keyValue of the error, like keyValue: { x: 6 }. It returns nil if not set.
+func dupeKeyConflict(err error) etre.Entity {
+	var raw bson.Raw
+	switch v := err.(type) {
+	case mongo.WriteError:
+		raw = v.Raw
+	case mongo.CommandError:
+		raw = v.Raw
+	}
+	kv, ok := raw.Lookup("keyValue").DocumentOK()
+	if !ok {
+		return nil
+	}
+	var keys bson.D
+	if err := bson.Unmarshal(kv, &keys); err != nil || len(keys) == 0 {
+		return nil
+	}
+	conflict := etre.Entity{}
+	for _, k := range keys {
+		conflict[k.Key] = k.Value
+	}
+	return conflict
+}
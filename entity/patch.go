@@ -0,0 +1,414 @@
+// Copyright 2026, Square, Inc.
+
+package entity
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/square/etre"
+)
+
+// Patch directives are reserved keys in an update patch that are not labels.
+// Other patch keys are labels or nested label paths (like "a.b") to set.
+const (
+	// PATCH_UNSET is a list of labels or nested label paths to remove.
+	PATCH_UNSET = "$unset"
+
+	// PATCH_INC is an object of labels or nested label paths to increment by
+	// an amount, like {"$inc": {"retries": 1}}. A missing label is set to the
+	// amount. The increment is atomic, so concurrent increments are not lost.
+	PATCH_INC = "$inc"
+)
+
+// JSON Patch (RFC 6902) ops allowed by JSONPatch. Ops move, copy, and test
+// are not supported.
+const (
+	JSON_PATCH_ADD     = "add"
+	JSON_PATCH_REPLACE = "replace"
+	JSON_PATCH_REMOVE  = "remove"
+)
+
+// JSONPatch returns the update patch for the JSON Patch operations. Paths are
+// translated from JSON Pointers (like "/a/b") to nested label paths (like "a.b"),
+// so a nested field of an object label can be changed without sending the whole
+// object. Add and replace set the value, creating parent objects as needed, and
+// remove removes the label or field. Unlike RFC 6902, replace does not require
+// the path to exist, and removing a path that does not exist is not an error.
+// A path can be changed only once, and a path cannot be changed with one of its
+// parents (like "/a" and "/a/b").
+func JSONPatch(ops []etre.JSONPatchOp) (etre.Entity, error) {
+	if len(ops) == 0 {
+		return nil, ValidationError{
+			Err:  fmt.Errorf("no JSON Patch operations"),
+			Type: "empty-entity",
+		}
+	}
+	patch := etre.Entity{}
+	unset := []string{}
+	paths := make([]string, 0, len(ops))
+	for i, op := range ops {
+		path, err := jsonPointerPath(op.Path)
+		if err != nil {
+			return nil, ValidationError{
+				Err:  fmt.Errorf("op %d: %s", i, err),
+				Type: "invalid-json-patch",
+			}
+		}
+		for _, p := range paths {
+			if p == path || strings.HasPrefix(path, p+".") || strings.HasPrefix(p, path+".") {
+				return nil, ValidationError{
+					Err:  fmt.Errorf("op %d: path %s conflicts with path %s in a previous op; a path and its parents can be changed only once", i, op.Path, p),
+					Type: "invalid-json-patch",
+				}
+			}
+		}
+		paths = append(paths, path)
+		switch op.Op {
+		case JSON_PATCH_ADD, JSON_PATCH_REPLACE:
+			patch[path] = op.Value
+		case JSON_PATCH_REMOVE:
+			unset = append(unset, path)
+		default:
+			return nil, ValidationError{
+				Err:  fmt.Errorf("op %d: invalid op: %s; valid ops: %s, %s, %s", i, op.Op, JSON_PATCH_ADD, JSON_PATCH_REPLACE, JSON_PATCH_REMOVE),
+				Type: "invalid-json-patch",
+			}
+		}
+	}
+	if len(unset) > 0 {
+		patch[PATCH_UNSET] = unset
+	}
+	return patch, nil
+}
+
+// jsonPointerPath returns the nested label path (like "a.b") for the JSON Pointer
+// (like "/a/b"). Field names cannot contain "." or begin with "$" because MongoDB
+// uses those in paths and operators.
+func jsonPointerPath(ptr string) (string, error) {
+	if !strings.HasPrefix(ptr, "/") || ptr == "/" {
+		return "", fmt.Errorf("invalid path: %q: must be a JSON Pointer like /label or /label/field", ptr)
+	}
+	fields := strings.Split(ptr[1:], "/")
+	for i, f := range fields {
+		f = strings.ReplaceAll(strings.ReplaceAll(f, "~1", "/"), "~0", "~")
+		if f == "" || f == "-" || strings.Contains(f, ".") || strings.HasPrefix(f, "$") {
+			return "", fmt.Errorf("invalid path: %q: field %q is empty, \"-\", contains \".\", or begins with \"$\"", ptr, f)
+		}
+		fields[i] = f
+	}
+	return strings.Join(fields, "."), nil
+}
+
+// PatchLabels returns the labels changed by the patch: its keys, the label of
+// nested label paths (like "a" for "a.b"), and the labels in patch directives.
+// Labels are unique and in no particular order.
+func PatchLabels(patch etre.Entity) []string {
+	labels := []string{}
+	seen := map[string]bool{}
+	for _, path := range patchPaths(patch) {
+		label := strings.SplitN(path, ".", 2)[0]
+		if !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// patchPaths returns the labels and nested label paths changed by the patch,
+// including those in patch directives.
+func patchPaths(patch etre.Entity) []string {
+	paths := make([]string, 0, len(patch))
+	for k := range patch {
+		switch k {
+		case PATCH_UNSET:
+			paths = append(paths, patchUnset(patch)...)
+		case PATCH_INC:
+			for path := range patchInc(patch) {
+				paths = append(paths, path)
+			}
+		default:
+			paths = append(paths, k)
+		}
+	}
+	return paths
+}
+
+// patchUnset returns the PATCH_UNSET paths. The validator makes it a []string.
+func patchUnset(patch etre.Entity) []string {
+	unset, _ := patch[PATCH_UNSET].([]string)
+	return unset
+}
+
+// patchInc returns the PATCH_INC paths and amounts. The validator makes it
+// a map[string]interface{} of int amounts.
+func patchInc(patch etre.Entity) map[string]interface{} {
+	inc, _ := patch[PATCH_INC].(map[string]interface{})
+	return inc
+}
+
+// maxLabelsExpr returns an $expr for the update filter that matches an entity
+// only if it has at most max labels after the patch, or no more labels than
+// before, so an entity over the limit can still be changed. Labels beginning
+// with _ are metalabels and not counted, like the validator. It returns nil if
+// the patch does not add labels. The validator checks only the patch, so two
+// patches can add more labels than max; this guard makes the check atomic.
+func maxLabelsExpr(patch etre.Entity, max int) interface{} {
+	added := bson.A{}
+	for k := range patch {
+		paths := []string{k}
+		switch k {
+		case PATCH_UNSET:
+			continue
+		case PATCH_INC:
+			paths = paths[:0]
+			for path := range patchInc(patch) {
+				paths = append(paths, path)
+			}
+		}
+		for _, path := range paths {
+			if label := strings.SplitN(path, ".", 2)[0]; !strings.HasPrefix(label, "_") {
+				added = append(added, label)
+			}
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	removed := bson.A{}
+	for _, path := range patchUnset(patch) {
+		if !strings.Contains(path, ".") {
+			removed = append(removed, path) // nested path doesn't remove the label
+		}
+	}
+	labels := bson.M{"$map": bson.M{
+		"input": bson.M{"$filter": bson.M{
+			"input": bson.M{"$objectToArray": "$$ROOT"},
+			"cond":  bson.M{"$ne": bson.A{bson.M{"$substrCP": bson.A{"$$this.k", 0, 1}}, "_"}},
+		}},
+		"in": "$$this.k",
+	}}
+	return bson.M{"$let": bson.M{
+		"vars": bson.M{"before": labels},
+		"in": bson.M{"$let": bson.M{
+			"vars": bson.M{"after": bson.M{"$size": bson.M{"$setUnion": bson.A{
+				bson.M{"$setDifference": bson.A{"$$before", removed}},
+				added,
+			}}}},
+			"in": bson.M{"$or": bson.A{
+				bson.M{"$lte": bson.A{"$$after", max}},
+				bson.M{"$lte": bson.A{"$$after", bson.M{"$size": "$$before"}}},
+			}},
+		}},
+	}}
+}
+
+// patchUpdate returns the MongoDB update document for the patch: $set for
+// labels and nested label paths, $unset for PATCH_UNSET, and $inc for PATCH_INC
+// and _rev.
+func patchUpdate(patch etre.Entity) bson.M {
+	set := bson.M{}
+	for k, v := range patch {
+		if k == PATCH_UNSET || k == PATCH_INC {
+			continue
+		}
+		set[k] = v
+	}
+	inc := bson.M{
+		"_rev": 1, // increment the revision
+	}
+	for path, n := range patchInc(patch) {
+		inc[path] = n
+	}
+	update := bson.M{
+		"$set": set,
+		"$inc": inc,
+	}
+	if unset := patchUnset(patch); len(unset) > 0 {
+		u := bson.M{}
+		for _, path := range unset {
+			u[path] = "" // Mongo expects "" (see $unset docs)
+		}
+		update["$unset"] = u
+	}
+	return update
+}
+
+// applyPatch returns the new values of the labels changed by the patch, given
+// the old entity (before the patch) with at least those labels. It's the CDC
+// event new entity. A removed label is not in the new entity. A nested label
+// path changes a copy of the old label value. An incremented label is the old
+// value plus the amount, which is what MongoDB computed because the old entity
+// is returned by the same atomic update.
+func applyPatch(old, patch etre.Entity) etre.Entity {
+	new := etre.Entity{}
+	top := func(path string) (string, []string, bool) {
+		fields := strings.Split(path, ".")
+		if len(fields) == 1 {
+			return path, nil, false
+		}
+		if _, ok := new[fields[0]]; !ok {
+			new[fields[0]] = copyValue(old[fields[0]])
+		}
+		return fields[0], fields[1:], true
+	}
+	for k, v := range patch {
+		if k == PATCH_UNSET || k == PATCH_INC {
+			continue
+		}
+		label, fields, nested := top(k)
+		if !nested {
+			new[k] = v
+			continue
+		}
+		new[label] = setField(new[label], fields, v)
+	}
+	for _, path := range patchUnset(patch) {
+		label, fields, nested := top(path)
+		if !nested {
+			continue // removed
+		}
+		new[label] = unsetField(new[label], fields)
+	}
+	for path, n := range patchInc(patch) {
+		label, fields, nested := top(path)
+		if !nested {
+			new[label] = addNumber(old[label], n)
+			continue
+		}
+		new[label] = setField(new[label], fields, addNumber(getField(new[label], fields), n))
+	}
+	return new
+}
+
+// addNumber returns v + n like MongoDB $inc: n if v is nil (missing), a float64
+// if v is a float64, else an int64.
+func addNumber(v, n interface{}) interface{} {
+	d := toInt64(n)
+	switch v := v.(type) {
+	case nil:
+		return n
+	case float64:
+		return v + float64(d)
+	default:
+		return toInt64(v) + d
+	}
+}
+
+func toInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// getField returns the nested field in v (a copied label value), or nil if
+// it does not exist.
+func getField(v interface{}, fields []string) interface{} {
+	for _, f := range fields {
+		switch e := v.(type) {
+		case map[string]interface{}:
+			v = e[f]
+		case []interface{}:
+			i, err := strconv.Atoi(f)
+			if err != nil || i < 0 || i >= len(e) {
+				return nil
+			}
+			v = e[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// copyValue returns a deep copy of a label value. Documents (bson.D, bson.M)
+// are copied to map[string]interface{} and arrays to []interface{}.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = copyValue(e.Value)
+		}
+		return m
+	case bson.M:
+		return copyValue(map[string]interface{}(v))
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = copyValue(e)
+		}
+		return m
+	case bson.A:
+		return copyValue([]interface{}(v))
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = copyValue(e)
+		}
+		return a
+	default:
+		return v
+	}
+}
+
+// setField sets the nested field in v (a copied label value). Missing parents
+// are created as documents and an array index past the end pads the array with
+// nulls, like MongoDB $set. Unlike $set, which fails if a parent is not a
+// document (or an array for an index), such a parent is replaced with a document.
+// That doesn't happen in applyPatch because it's called after MongoDB applied
+// the same patch without error.
+func setField(v interface{}, fields []string, val interface{}) interface{} {
+	if len(fields) == 0 {
+		return val
+	}
+	if a, ok := v.([]interface{}); ok {
+		if i, err := strconv.Atoi(fields[0]); err == nil && i >= 0 {
+			for len(a) <= i {
+				a = append(a, nil)
+			}
+			a[i] = setField(a[i], fields[1:], val)
+			return a
+		}
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		m = map[string]interface{}{}
+	}
+	m[fields[0]] = setField(m[fields[0]], fields[1:], val)
+	return m
+}
+
+// unsetField removes the nested field from v (a copied label value) like
+// MongoDB $unset: an array element is set to null, not removed.
+func unsetField(v interface{}, fields []string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(fields) == 1 {
+			delete(v, fields[0])
+		} else if e, ok := v[fields[0]]; ok {
+			v[fields[0]] = unsetField(e, fields[1:])
+		}
+	case []interface{}:
+		if i, err := strconv.Atoi(fields[0]); err == nil && i >= 0 && i < len(v) {
+			if len(fields) == 1 {
+				v[i] = nil
+			} else {
+				v[i] = unsetField(v[i], fields[1:])
+			}
+		}
+	}
+	return v
+}
@@ -4,7 +4,16 @@ package entity
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -21,32 +30,115 @@ import (
 type Store interface {
 	ReadEntity(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error)
 
+	ReadEntitiesByIds(ctx context.Context, entityType string, entityIds []string, f etre.QueryFilter) ([]etre.Entity, error)
+
 	CreateEntities(context.Context, WriteOp, []etre.Entity) ([]string, error)
 
+	CreateEntityIfNotExists(context.Context, WriteOp, query.Query, etre.Entity) (etre.Entity, bool, error)
+
 	UpdateEntities(context.Context, WriteOp, query.Query, etre.Entity) ([]etre.Entity, error)
 
 	DeleteEntities(context.Context, WriteOp, query.Query) ([]etre.Entity, error)
 
+	DeleteAll(context.Context, WriteOp) ([]etre.Entity, error)
+
+	RestoreEntities(context.Context, WriteOp, query.Query) ([]etre.Entity, error)
+
 	DeleteLabel(context.Context, WriteOp, string) (etre.Entity, error)
 
+	DeleteLabelByQuery(context.Context, WriteOp, query.Query, string) ([]etre.Entity, error)
+
+	RenameLabel(ctx context.Context, wo WriteOp, q query.Query, label, newLabel string, overwrite bool) ([]etre.Entity, error)
+
 	StreamEntities(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan EntityResult
+
+	GroupEntities(ctx context.Context, entityType string, q query.Query, groupBy string, f etre.QueryFilter) (map[string][]etre.Entity, error)
+
+	CountGroups(ctx context.Context, entityType string, q query.Query, groupBy string) ([]etre.GroupCount, error)
 }
 
 type store struct {
-	coll   map[string]*mongo.Collection
-	cdcs   cdc.Store
-	config config.EntityConfig
+	coll    map[string]*mongo.Collection
+	cdcs    cdc.Store
+	config  config.EntityConfig
+	log     *slog.Logger
+	maxTime time.Duration // config.MaxQueryTime
+	clock   Clock
 }
 
-// NewStore creates a Store.
+// NewStore creates a Store that logs to the default slog logger and uses a
+// MonotonicClock. See WithLogger and WithClock.
 func NewStore(entities map[string]*mongo.Collection, cdcStore cdc.Store, cfg config.EntityConfig) store {
+	maxTime, _ := time.ParseDuration(cfg.MaxQueryTime) // validated by config.Validate
 	return store{
-		coll:   entities,
-		cdcs:   cdcStore,
-		config: cfg,
+		coll:    entities,
+		cdcs:    cdcStore,
+		config:  cfg,
+		log:     slog.Default(),
+		maxTime: maxTime,
+		clock:   MonotonicClock(),
 	}
 }
 
+// Clock returns the current time of a write: the _created, _updated, and _deleted
+// meta-labels, and CDCEvent.Ts (milliseconds). See WithClock.
+type Clock func() time.Time
+
+// MonotonicClock returns a Clock that never goes backwards, even if the system
+// clock does (like an NTP adjustment): each time is at least 1 nanosecond after
+// the previous time. It's safe for concurrent use.
+func MonotonicClock() Clock {
+	var mux sync.Mutex
+	var last time.Time
+	return func() time.Time {
+		mux.Lock()
+		defer mux.Unlock()
+		now := time.Now().Round(0) // wall clock, not monotonic reading
+		if !now.After(last) {
+			now = last.Add(time.Nanosecond)
+		}
+		last = now
+		return now
+	}
+}
+
+// WithClock returns a copy of the store that uses the clock for the time of writes,
+// like a fixed clock in tests or a logical clock.
+func (s store) WithClock(clock Clock) store {
+	s.clock = clock
+	return s
+}
+
+// WithLogger returns a copy of the store that logs to the logger (app.Context.Logger).
+// Every write is logged with attributes entity_type, op, caller, n (number of
+// entities written), and duration: at debug level if successful, else at warn level.
+func (s store) WithLogger(logger *slog.Logger) store {
+	s.log = logger
+	return s
+}
+
+// logWrite logs a write. See WithLogger.
+func (s store) logWrite(ctx context.Context, op string, wo WriteOp, n int, t0 time.Time, err error) {
+	attrs := []slog.Attr{
+		slog.String("entity_type", wo.EntityType),
+		slog.String("op", op),
+		slog.String("caller", wo.Caller),
+		slog.Int("n", n),
+		slog.Duration("duration", time.Since(t0)),
+	}
+	if wo.SetOp != "" {
+		attrs = append(attrs, slog.String("set_op", wo.SetOp), slog.String("set_id", wo.SetId))
+	}
+	if id := etre.RequestId(ctx); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	if err != nil {
+		s.log.LogAttrs(ctx, slog.LevelWarn, "write failed", append(attrs, slog.String("err", err.Error()))...)
+		return
+	}
+	s.log.LogAttrs(ctx, slog.LevelDebug, "write", attrs...)
+}
+
 // ReadEntity queries the db for a single entity. Returns nil if not found.
 func (s store) ReadEntity(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
 	c, ok := s.coll[entityType]
@@ -69,12 +161,7 @@ func (s store) ReadEntity(ctx context.Context, entityType string, entityId strin
 	}
 
 	// Query, we should only get one row
-	q, err := query.Translate("_id=" + entityId)
-	if err != nil {
-		return nil, s.dbError(ctx, err, "invalid-query")
-	}
-
-	result := c.FindOne(ctx, Filter(q), options.FindOne().SetProjection(p))
+	result := c.FindOne(ctx, s.filter(entityType, query.ById(entityId), f.IncludeDeleted), options.FindOne().SetProjection(p))
 	if err := result.Err(); err != nil {
 		nfe := mongo.ErrNoDocuments
 		if errors.Is(err, nfe) {
@@ -86,9 +173,81 @@ func (s store) ReadEntity(ctx context.Context, entityType string, entityId strin
 	if err := result.Decode(&entity); err != nil {
 		return nil, s.dbError(ctx, err, "db-read-cursor")
 	}
+	aliasLabels(entity, f.Aliases)
 	return entity, nil
 }
 
+// ReadEntitiesByIds queries the db for the entities with the given ids in one
+// query. The returned entities are in the same order as the ids: one per id,
+// or nil if not found. A duplicate id returns the same entity more than once.
+func (s store) ReadEntitiesByIds(ctx context.Context, entityType string, entityIds []string, f etre.QueryFilter) ([]etre.Entity, error) {
+	c, ok := s.coll[entityType]
+	if !ok {
+		panic("invalid entity type passed to ReadEntitiesByIds: " + entityType)
+	}
+
+	// Ids as stored in the db (see idValue), without duplicates
+	ids := make([]interface{}, 0, len(entityIds))
+	seen := map[string]bool{}
+	for _, id := range entityIds {
+		v := s.idValue(entityType, id)
+		if k := IdString(v); !seen[k] {
+			seen[k] = true
+			ids = append(ids, v)
+		}
+	}
+	if s.tooManyResults(int64(len(ids))) {
+		return nil, s.resultTooLarge()
+	}
+
+	// Always return _id to order the entities, but remove it after if not
+	// explicitly set in f.ReturnLabels, like ReadEntity
+	p := bson.M{}
+	stripId := false
+	if len(f.ReturnLabels) > 0 {
+		for _, label := range f.ReturnLabels {
+			p[label] = 1
+		}
+		if _, ok := p["_id"]; !ok {
+			p["_id"] = 1
+			stripId = true
+		}
+	}
+
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	if !f.IncludeDeleted {
+		filter[etre.META_LABEL_DELETED] = bson.M{"$exists": false}
+	}
+	cursor, err := c.Find(ctx, filter, options.Find().SetProjection(p))
+	if err != nil {
+		return nil, s.dbError(ctx, err, "db-query")
+	}
+	defer cursor.Close(ctx)
+	found := make(map[string]etre.Entity, len(ids))
+	for cursor.Next(ctx) {
+		entity := etre.Entity{}
+		if err := cursor.Decode(&entity); err != nil {
+			return nil, s.dbError(ctx, err, "db-read-cursor")
+		}
+		found[IdString(entity[etre.META_LABEL_ID])] = entity
+		aliasLabels(entity, f.Aliases)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, s.dbError(ctx, err, "db-read-cursor")
+	}
+	if stripId {
+		for _, entity := range found {
+			delete(entity, etre.META_LABEL_ID)
+		}
+	}
+
+	entities := make([]etre.Entity, len(entityIds))
+	for i, id := range entityIds {
+		entities[i] = found[IdString(s.idValue(entityType, id))] // nil if not found
+	}
+	return entities, nil
+}
+
 type EntityResult struct {
 	Entity etre.Entity
 	Err    error
@@ -104,25 +263,38 @@ func (s store) StreamEntities(ctx context.Context, entityType string, q query.Qu
 	go func() {
 		defer close(ch)
 
+		// Bound the db operations by the max query time, if any. The parent ctx
+		// is still used to write to the channel, so a query timeout is returned.
+		dbCtx := ctx
+		if maxTime := s.maxQueryTime(f); maxTime > 0 {
+			var cancel context.CancelFunc
+			dbCtx, cancel = context.WithTimeout(ctx, maxTime)
+			defer cancel()
+		}
+
 		// Distinct optimization: unique values for the one return label. For example,
 		// "es -u node.metacluster zone=pd" returns a list of unique metacluster names.
 		// This is 10x faster than "es node.metacluster zone=pd | sort -u".
 		if len(f.ReturnLabels) == 1 && f.Distinct {
-			dr := c.Distinct(ctx, f.ReturnLabels[0], Filter(q))
+			dopts := options.Distinct()
+			if collation := mongoCollation(f); collation != nil {
+				dopts.SetCollation(collation)
+			}
+			dr := c.Distinct(dbCtx, f.ReturnLabels[0], s.filter(entityType, q, f.IncludeDeleted), dopts)
 			if err := dr.Err(); err != nil {
 				nfe := mongo.ErrNoDocuments
 				if errors.Is(err, nfe) {
 					// No documents found, return to close the channel
 					return
 				}
-				s.writeErrToChannel(ctx, ch, s.dbError(ctx, err, "db-query-distinct"))
+				s.writeErrToChannel(ctx, ch, s.queryError(ctx, dbCtx, err, "db-query-distinct"))
 				return
 			}
 
 			var values []string
 			err := dr.Decode(&values)
 			if err != nil {
-				s.writeErrToChannel(ctx, ch, s.dbError(ctx, err, "db-query-distinct"))
+				s.writeErrToChannel(ctx, ch, s.queryError(ctx, dbCtx, err, "db-query-distinct"))
 				return
 			}
 			// Distinct doesn't return a cursor, so we just have to loop and send the results.
@@ -130,13 +302,27 @@ func (s store) StreamEntities(ctx context.Context, entityType string, q query.Qu
 			if f.Limit > 0 && int64(len(values)) > f.Limit {
 				values = values[:f.Limit]
 			}
+			if s.tooManyResults(int64(len(values))) {
+				s.writeErrToChannel(ctx, ch, s.resultTooLarge())
+				return
+			}
 			for _, v := range values {
-				s.writeEntityToChannel(ctx, ch, etre.Entity{f.ReturnLabels[0]: v})
+				e := etre.Entity{f.ReturnLabels[0]: v}
+				aliasLabels(e, f.Aliases)
+				s.writeEntityToChannel(ctx, ch, e)
 			}
 			return
 		}
 
 		// Find and return all matching entities
+		var hint interface{}
+		if f.Hint != "" {
+			var err error
+			if hint, err = s.hint(dbCtx, c, f.Hint); err != nil {
+				s.writeErrToChannel(ctx, ch, err)
+				return
+			}
+		}
 		p := bson.M{}
 		if len(f.ReturnLabels) > 0 {
 			for _, label := range f.ReturnLabels {
@@ -155,31 +341,321 @@ func (s store) StreamEntities(ctx context.Context, entityType string, q query.Qu
 		if f.Limit > 0 {
 			opts.SetLimit(f.Limit)
 		}
-		cursor, err := c.Find(ctx, Filter(q), opts)
+		if hint != nil {
+			opts.SetHint(hint)
+		}
+		if collation := mongoCollation(f); collation != nil {
+			opts.SetCollation(collation)
+		}
+		if f.Sort != "" {
+			sort, err := sortKeys(f.Sort)
+			if err != nil {
+				s.writeErrToChannel(ctx, ch, err)
+				return
+			}
+			opts.SetSort(sort)
+		}
+
+		// Enforce max results in the same query: read at most max+1 entities,
+		// and if there are more than max, return an error instead of the rest.
+		// The caller gets the first max entities before the error, so it must
+		// not use partial results (the API returns only the error until it
+		// starts streaming the response).
+		maxResults := s.config.MaxResults
+		if maxResults > 0 && (f.Limit == 0 || f.Limit > maxResults) {
+			opts.SetLimit(maxResults + 1)
+		} else {
+			maxResults = 0 // limit within max results
+		}
+
+		cursor, err := c.Find(dbCtx, s.filter(entityType, q, f.IncludeDeleted), opts)
 		if err != nil {
-			s.writeErrToChannel(ctx, ch, s.dbError(ctx, err, "db-query"))
+			s.writeErrToChannel(ctx, ch, s.queryError(ctx, dbCtx, err, "db-query"))
 			return
 		}
 		defer cursor.Close(ctx)
 
 		// Stream results
-		for cursor.Next(ctx) {
+		n := int64(0)
+		for cursor.Next(dbCtx) {
+			if n++; maxResults > 0 && n > maxResults {
+				s.writeErrToChannel(ctx, ch, s.resultTooLarge())
+				return
+			}
 			var entity etre.Entity
 			if err := cursor.Decode(&entity); err != nil {
-				s.writeErrToChannel(ctx, ch, s.dbError(ctx, err, "db-read-cursor"))
+				s.writeErrToChannel(ctx, ch, s.queryError(ctx, dbCtx, err, "db-read-cursor"))
 				return
 			}
+			aliasLabels(entity, f.Aliases)
 			s.writeEntityToChannel(ctx, ch, entity)
 		}
 		// Check for errors from iterating over cursor
 		if err := cursor.Err(); err != nil {
-			s.writeErrToChannel(ctx, ch, s.dbError(ctx, err, "db-read-cursor"))
+			s.writeErrToChannel(ctx, ch, s.queryError(ctx, dbCtx, err, "db-read-cursor"))
 			return
 		}
 	}()
 	return ch
 }
 
+// hint returns the name of the index for etre.QueryFilter.Hint, which is an index
+// name or an index key spec like "x:1,y:-1". If no index of the collection has the
+// name or keys, it returns a ValidationError because MongoDB returns an error for
+// a hint to an index that does not exist.
+func (s store) hint(ctx context.Context, c *mongo.Collection, hint string) (interface{}, error) {
+	var keys bson.D
+	if strings.Contains(hint, ":") {
+		for _, key := range strings.Split(hint, ",") {
+			label, dir, _ := strings.Cut(key, ":")
+			if label == "" || (dir != "1" && dir != "-1") {
+				return nil, ValidationError{
+					Err:  fmt.Errorf("invalid hint %s: key %s is not label:1 or label:-1", hint, key),
+					Type: "invalid-hint",
+				}
+			}
+			keys = append(keys, bson.E{Key: label, Value: dir})
+		}
+	}
+	specs, err := c.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return nil, s.dbError(ctx, err, "db-list-indexes")
+	}
+	for _, spec := range specs {
+		if keys == nil {
+			if spec.Name == hint {
+				return spec.Name, nil
+			}
+			continue
+		}
+		var specKeys bson.D
+		if err := bson.Unmarshal(spec.KeysDocument, &specKeys); err != nil {
+			return nil, s.dbError(ctx, err, "db-list-indexes")
+		}
+		if sameKeys(keys, specKeys) {
+			return spec.Name, nil
+		}
+	}
+	return nil, ValidationError{
+		Err:  fmt.Errorf("invalid hint %s: no such index", hint),
+		Type: "invalid-hint",
+	}
+}
+
+// sortKeys returns the sort document for etre.QueryFilter.Sort, which is labels
+// and directions like "x:1,y:-1". It returns a ValidationError if a key is not
+// label:1 or label:-1.
+func sortKeys(sort string) (bson.D, error) {
+	var keys bson.D
+	for _, key := range strings.Split(sort, ",") {
+		label, dir, _ := strings.Cut(key, ":")
+		if label == "" || (dir != "1" && dir != "-1") {
+			return nil, ValidationError{
+				Err:  fmt.Errorf("invalid sort %s: key %s is not label:1 or label:-1", sort, key),
+				Type: "invalid-sort",
+			}
+		}
+		n := 1
+		if dir == "-1" {
+			n = -1
+		}
+		keys = append(keys, bson.E{Key: label, Value: n})
+	}
+	return keys, nil
+}
+
+// aliasLabels renames the labels of the entity to their aliases (etre.QueryFilter.Aliases).
+// If the entity has a label with the same name as an alias, the aliased label
+// replaces it. Aliases are validated by Validator.Aliases, so the result does not
+// depend on the order of the aliases.
+func aliasLabels(e etre.Entity, aliases map[string]string) {
+	for label, alias := range aliases {
+		if v, ok := e[label]; ok {
+			delete(e, label)
+			e[alias] = v
+		}
+	}
+}
+
+// mongoCollation returns the MongoDB collation for etre.QueryFilter.Collation, or nil
+// if not set. MongoDB uses an index for a query only if the index has the same
+// collation, so a collated query without one is a collection scan.
+func mongoCollation(f etre.QueryFilter) *options.Collation {
+	if f.Collation == nil {
+		return nil
+	}
+	return &options.Collation{
+		Locale:   f.Collation.Locale,
+		Strength: f.Collation.Strength,
+	}
+}
+
+// sameKeys returns true if the index keys are the same labels in the same order
+// with the same direction. Index key values can be any number type, so they are
+// compared as strings.
+func sameKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || fmt.Sprint(a[i].Value) != fmt.Sprint(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxQueryTime returns the max time of one query: config.EntityConfig.MaxQueryTime,
+// or etre.QueryFilter.MaxTimeMS if less. Zero is no max time.
+func (s store) maxQueryTime(f etre.QueryFilter) time.Duration {
+	maxTime := s.maxTime
+	if f.MaxTimeMS > 0 {
+		if d := time.Duration(f.MaxTimeMS) * time.Millisecond; maxTime == 0 || d < maxTime {
+			maxTime = d
+		}
+	}
+	return maxTime
+}
+
+// queryError returns a DbError type "query-timeout" if the query exceeded its max
+// time (see maxQueryTime): dbCtx timed out, or MongoDB returned MaxTimeMSExpired,
+// but the request ctx is ok. Else, it returns dbError.
+func (s store) queryError(ctx, dbCtx context.Context, err error, errType string) error {
+	if ctx.Err() == nil && (dbCtx.Err() == context.DeadlineExceeded || mongo.IsTimeout(err)) {
+		return DbError{Err: fmt.Errorf("query exceeded max query time: %w", err), Type: "query-timeout"}
+	}
+	return s.dbError(ctx, err, errType)
+}
+
+func (s store) tooManyResults(n int64) bool {
+	return s.config.MaxResults > 0 && n > s.config.MaxResults
+}
+
+func (s store) resultTooLarge() error {
+	return ValidationError{
+		Err:  fmt.Errorf("query matches more than %d entities; narrow the query or set a limit", s.config.MaxResults),
+		Type: "result-too-large",
+	}
+}
+
+// GroupEntities queries the db and returns matching entities grouped by the value
+// of the groupBy label. Entities without the label are grouped under the empty
+// string. If ReturnLabels is set, the groupBy label is always returned. Distinct
+// is not supported. Returns a ValidationError if there are more than the configured
+// max groups because the whole result is held in memory.
+func (s store) GroupEntities(ctx context.Context, entityType string, q query.Query, groupBy string, f etre.QueryFilter) (map[string][]etre.Entity, error) {
+	if f.Distinct {
+		return nil, ValidationError{
+			Err:  fmt.Errorf("distinct is not supported with groupBy"),
+			Type: "invalid-group-by",
+		}
+	}
+	if len(f.ReturnLabels) > 0 && !slices.Contains(f.ReturnLabels, groupBy) {
+		f.ReturnLabels = append(append([]string{}, f.ReturnLabels...), groupBy) // copy
+	}
+	groupLabel := groupBy // in returned entities
+	if alias, ok := f.Aliases[groupBy]; ok {
+		groupLabel = alias
+	}
+	maxGroups := s.config.MaxGroups
+	if maxGroups <= 0 {
+		maxGroups = config.DEFAULT_MAX_GROUPS
+	}
+
+	// Cancel StreamEntities if we return early (too many groups or error)
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	groups := map[string][]etre.Entity{}
+	for r := range s.StreamEntities(streamCtx, entityType, q, f) {
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		var key string
+		if v, ok := r.Entity[groupLabel]; ok && v != nil {
+			key = fmt.Sprintf("%v", v)
+		}
+		if _, ok := groups[key]; !ok && len(groups) == maxGroups {
+			return nil, ValidationError{
+				Err:  fmt.Errorf("more than %d groups for label %s; narrow the query or group by another label", maxGroups, groupBy),
+				Type: "too-many-groups",
+			}
+		}
+		groups[key] = append(groups[key], r.Entity)
+	}
+
+	// StreamEntities closes the channel without an error on timeout
+	if err := ctx.Err(); err != nil {
+		return nil, s.dbError(ctx, err, "db-query")
+	}
+	return groups, nil
+}
+
+// CountGroups queries the db and returns the number of matching entities for
+// each value of the groupBy label, sorted by value. Entities without the label
+// are counted with a nil value. Unlike GroupEntities, entities are counted by
+// the db (a $group aggregation), not returned. Returns a ValidationError if there
+// are more than the configured max groups, or if groupBy is not a plain label:
+// it's a $group expression, so "$" or "." would group by something else.
+func (s store) CountGroups(ctx context.Context, entityType string, q query.Query, groupBy string) ([]etre.GroupCount, error) {
+	c, ok := s.coll[entityType]
+	if !ok {
+		panic("invalid entity type passed to CountGroups: " + entityType)
+	}
+	if groupBy == "" || strings.ContainsAny(groupBy, "$.") {
+		return nil, ValidationError{
+			Err:  fmt.Errorf("invalid group by label '%s': must be a label without . or $", groupBy),
+			Type: "invalid-label",
+		}
+	}
+	maxGroups := s.config.MaxGroups
+	if maxGroups <= 0 {
+		maxGroups = config.DEFAULT_MAX_GROUPS
+	}
+
+	// Bound the db operations by the max query time, if any
+	dbCtx := ctx
+	if maxTime := s.maxQueryTime(etre.QueryFilter{}); maxTime > 0 {
+		var cancel context.CancelFunc
+		dbCtx, cancel = context.WithTimeout(ctx, maxTime)
+		defer cancel()
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: s.filter(entityType, q, false)}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$" + groupBy},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: maxGroups + 1}},
+	}
+	cursor, err := c.Aggregate(dbCtx, pipeline)
+	if err != nil {
+		return nil, s.queryError(ctx, dbCtx, err, "db-aggregate")
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Value interface{} `bson:"_id"`
+		Count int64       `bson:"count"`
+	}
+	if err := cursor.All(dbCtx, &groups); err != nil {
+		return nil, s.queryError(ctx, dbCtx, err, "db-read-cursor")
+	}
+	if len(groups) > maxGroups {
+		return nil, ValidationError{
+			Err:  fmt.Errorf("more than %d groups for label %s; narrow the query or group by another label", maxGroups, groupBy),
+			Type: "too-many-groups",
+		}
+	}
+	counts := make([]etre.GroupCount, len(groups))
+	for i, g := range groups {
+		counts[i] = etre.GroupCount{Value: g.Value, Count: g.Count}
+	}
+	return counts, nil
+}
+
 func (s store) writeEntityToChannel(ctx context.Context, ch chan EntityResult, entity etre.Entity) {
 	select {
 	case <-ctx.Done():
@@ -221,7 +697,19 @@ func (s store) writeErrToChannel(ctx context.Context, ch chan EntityResult, err
 // entities inserted. Since the entities were inserted in order (guranteed by
 // inserting one by one), caller should only return subset of entities that
 // failed to be inserted.
+//
+// If wo.Unordered is true, an entity that fails to insert does not stop the
+// insert process: the IDs of all inserted entities are returned with an
+// InsertErrors for the others. A CDC error still stops the insert process
+// because the entity was inserted without a CDC event.
 func (s store) CreateEntities(ctx context.Context, wo WriteOp, entities []etre.Entity) ([]string, error) {
+	t0 := time.Now()
+	ids, err := s.createEntities(ctx, wo, entities)
+	s.logWrite(ctx, "create", wo, len(ids), t0, err)
+	return ids, err
+}
+
+func (s store) createEntities(ctx context.Context, wo WriteOp, entities []etre.Entity) ([]string, error) {
 	c, ok := s.coll[wo.EntityType]
 	if !ok {
 		panic("invalid entity type passed to CreateEntities: " + wo.EntityType)
@@ -230,35 +718,157 @@ func (s store) CreateEntities(ctx context.Context, wo WriteOp, entities []etre.E
 	// A slice of IDs we generate to insert along with entities into DB
 	newIds := make([]string, 0, len(entities))
 
-	now := time.Now().UnixNano()
+	// Errors for entities not inserted if unordered
+	insertErrs := InsertErrors{}
+
+	wo = autoSetSize(wo, len(entities))
+
+	now := s.clock().UnixNano()
 	for i := range entities {
-		entities[i]["_id"] = bson.NewObjectID()
+		newId, err := s.newId(wo.EntityType, entities[i])
+		if err != nil {
+			if wo.Unordered {
+				insertErrs[i] = err
+				continue
+			}
+			return newIds, err
+		}
+		entities[i]["_id"] = newId
 		entities[i]["_type"] = wo.EntityType
 		entities[i]["_rev"] = int64(0)
 		entities[i]["_created"] = now
 		entities[i]["_updated"] = now
 
-		res, err := c.InsertOne(ctx, entities[i])
+		var id string
+		written, err := s.txn(ctx, c, func(ctx context.Context) error {
+			res, err := c.InsertOne(ctx, entities[i])
+			if err != nil {
+				return s.dbError(ctx, err, "db-insert")
+			}
+			id = IdString(res.InsertedID)
+
+			// Create a CDC event.
+			cp := cdcPartial{
+				op:  "i",
+				id:  id,
+				new: &entities[i],
+				old: nil,
+				rev: int64(0),
+			}
+			return s.cdcWrite(ctx, entities[i], wo, cp)
+		})
+		if written {
+			newIds = append(newIds, id)
+		}
 		if err != nil {
-			return newIds, s.dbError(ctx, err, "db-insert")
+			if wo.Unordered && !written && !cdcError(err) && ctx.Err() == nil {
+				insertErrs[i] = err
+				continue
+			}
+			return newIds, err
+		}
+	}
+
+	if len(insertErrs) > 0 {
+		return newIds, insertErrs
+	}
+	return newIds, nil
+}
+
+// CreateEntityIfNotExists inserts the entity only if no entity matches the query.
+// If an entity matches, it is returned with false and nothing is written. Else,
+// the new entity is returned with true and a CDC insert event is written. The
+// given entity is not modified.
+//
+// It is one upsert with $setOnInsert, but it is atomic only if the collection has
+// a unique index on the query labels. Without one, concurrent callers that match
+// no entity can both insert.
+//
+// Equality predicates in the query (label=value) are set on the new entity by
+// MongoDB, so the entity must not set those labels to different values.
+func (s store) CreateEntityIfNotExists(ctx context.Context, wo WriteOp, q query.Query, e etre.Entity) (etre.Entity, bool, error) {
+	t0 := time.Now()
+	got, created, err := s.createEntityIfNotExists(ctx, wo, q, e)
+	n := 0
+	if created {
+		n = 1
+	}
+	s.logWrite(ctx, "create", wo, n, t0, err)
+	return got, created, err
+}
+
+func (s store) createEntityIfNotExists(ctx context.Context, wo WriteOp, q query.Query, e etre.Entity) (etre.Entity, bool, error) {
+	c, ok := s.coll[wo.EntityType]
+	if !ok {
+		panic("invalid entity type passed to CreateEntityIfNotExists: " + wo.EntityType)
+	}
+
+	newId, err := s.newId(wo.EntityType, e)
+	if err != nil {
+		return nil, false, err
+	}
+	now := s.clock().UnixNano()
+	e = maps.Clone(e) // don't modify caller's entity
+	e["_id"] = newId
+	e["_type"] = wo.EntityType
+	e["_rev"] = int64(0)
+	e["_created"] = now
+	e["_updated"] = now
+
+	// MongoDB errors if $setOnInsert sets a path that the upsert query also
+	// sets by equality, so remove those labels after checking they match
+	onInsert := etre.Entity{}
+	for k, v := range e {
+		onInsert[k] = v
+	}
+	for _, p := range q.Predicates {
+		if p.Operator != "=" && p.Operator != "==" {
+			continue
+		}
+		v, ok := onInsert[p.Label]
+		if !ok {
+			continue
+		}
+		if fmt.Sprintf("%v", v) != fmt.Sprintf("%v", p.Value) {
+			return nil, false, ValidationError{
+				Err:  fmt.Errorf("label %s=%v conflicts with query %s=%v", p.Label, v, p.Label, p.Value),
+				Type: "query-conflict",
+			}
+		}
+		delete(onInsert, p.Label)
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var got etre.Entity
+	var created bool
+	written, err := s.txn(ctx, c, func(ctx context.Context) error {
+		if err := c.FindOneAndUpdate(ctx, s.filter(wo.EntityType, q, false), bson.M{"$setOnInsert": onInsert}, opts).Decode(&got); err != nil {
+			return s.dbError(ctx, err, "db-insert")
+		}
+
+		// Upsert matched an existing entity if its _id isn't the one we generated
+		id := IdString(got["_id"])
+		created = id == IdString(newId)
+		if !created {
+			return nil
 		}
-		id := res.InsertedID.(bson.ObjectID)
-		newIds = append(newIds, id.Hex())
 
-		// Create a CDC event.
 		cp := cdcPartial{
 			op:  "i",
 			id:  id,
-			new: &entities[i],
+			new: &got,
 			old: nil,
 			rev: int64(0),
 		}
-		if err := s.cdcWrite(ctx, entities[i], wo, cp); err != nil {
-			return newIds, err
+		return s.cdcWrite(ctx, got, wo, cp)
+	})
+	if err != nil {
+		if written {
+			return got, true, err // CDC error
 		}
+		return nil, false, err
 	}
-
-	return newIds, nil
+	return got, created, nil
 }
 
 // UpdateEntities queries the db and updates all Entity matching that query.
@@ -275,78 +885,213 @@ func (s store) CreateEntities(ctx context.Context, wo WriteOp, entities []etre.E
 //	update := db.Entity{"y": "bar"}
 //
 //	diffs, err := c.UpdateEntities(q, update)
+//
+// The patch can set nested label paths (like "a.b") and have patch directives
+// PATCH_UNSET and PATCH_INC. If PATCH_INC increments a label that is not a
+// number, a ValidationError is returned.
+//
+// If wo.Upsert is true and no entity matches the query, a new entity made from
+// the query and the patch is inserted, and its diff has only its _id because
+// there are no previous values. The query must be only label=value predicates
+// (no metalabels and no OR), else a ValidationError is returned because the
+// new entity cannot be made from the query.
+//
+// If wo.Unordered is true, an entity that fails to update (like a duplicate on
+// a unique index) does not stop the update process: the diffs of all updated
+// entities are returned with an UpdateErrors for the others. Like CreateEntities,
+// a CDC error still stops the update process.
 func (s store) UpdateEntities(ctx context.Context, wo WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+	t0 := time.Now()
+	diffs, err := s.updateEntities(ctx, wo, q, patch)
+	s.logWrite(ctx, "update", wo, len(diffs), t0, err)
+	return diffs, err
+}
+
+func (s store) updateEntities(ctx context.Context, wo WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
 	c, ok := s.coll[wo.EntityType]
 	if !ok {
 		panic("invalid entity type passed to UpdateEntities: " + wo.EntityType)
 	}
 
-	fopts := options.Find().SetProjection(bson.M{"_id": 1})
-	cursor, err := c.Find(ctx, Filter(q), fopts)
+	if wo.Upsert {
+		if err := upsertQuery(q); err != nil {
+			return nil, err
+		}
+		if err := upsertPatch(patch); err != nil {
+			return nil, err
+		}
+	}
+
+	ids, err := s.findIds(ctx, c, s.filter(wo.EntityType, q, false))
 	if err != nil {
-		return nil, s.dbError(ctx, err, "db-query")
+		return nil, err
 	}
-	defer cursor.Close(ctx)
+	wo = autoSetSize(wo, len(ids))
 
 	// diffs is a slice made up of a diff for each doc updated
 	diffs := []etre.Entity{}
 
-	patch["_updated"] = time.Now().UnixNano()
-	updates := bson.M{
-		"$set": patch,
-		"$inc": bson.M{
-			"_rev": 1, // increment the revision
-		},
-	}
+	// Errors for entities not updated if unordered
+	updateErrs := UpdateErrors{}
+
+	patch["_updated"] = s.clock().UnixNano()
+	updates := patchUpdate(patch)
 
 	p := bson.M{"_id": 1, "_type": 1, "_rev": 1, "_updated": 1}
-	for label := range patch {
+	for _, label := range PatchLabels(patch) {
 		p[label] = 1
 	}
 	opts := options.FindOneAndUpdate().SetProjection(p)
 
-	nextId := map[string]bson.ObjectID{}
-	for cursor.Next(ctx) {
-		if err := cursor.Decode(&nextId); err != nil {
-			return diffs, s.dbError(ctx, err, "db-cursor-decode")
-		}
-		uq, _ := query.Translate("_id=" + nextId["_id"].Hex())
+	// Guard config.entity.max_labels after the update (see maxLabelsExpr)
+	var maxLabels interface{}
+	if s.config.MaxLabels > 0 {
+		maxLabels = maxLabelsExpr(patch, s.config.MaxLabels)
+	}
 
+	for _, id := range ids {
 		var orig etre.Entity
-		err := c.FindOneAndUpdate(ctx, Filter(uq), updates, opts).Decode(&orig)
+		written, err := s.txn(ctx, c, func(ctx context.Context) error {
+			filter := bson.M{"_id": id}
+			if maxLabels != nil {
+				filter["$expr"] = maxLabels
+			}
+			err := c.FindOneAndUpdate(ctx, filter, updates, opts).Decode(&orig)
+			if err != nil {
+				if err == mongo.ErrNoDocuments {
+					if maxLabels != nil {
+						if n, cerr := c.CountDocuments(ctx, bson.M{"_id": id}); cerr == nil && n > 0 {
+							return ValidationError{
+								Err:  fmt.Errorf("entity %s would have more than %d labels after the update (config.entity.max_labels)", IdString(id), s.config.MaxLabels),
+								Type: "entity-too-large",
+							}
+						}
+					}
+					return err
+				}
+				var se mongo.ServerError
+				if errors.As(err, &se) && se.HasErrorCode(typeMismatchCode) {
+					return ValidationError{
+						Err:  fmt.Errorf("cannot patch entity %s: %s", IdString(id), err),
+						Type: "invalid-patch-target",
+					}
+				}
+				return s.dbError(ctx, err, "db-update")
+			}
+
+			old := etre.Entity{}
+			for k, v := range orig {
+				if k == "_id" || k == "_type" || k == "_rev" {
+					continue
+				}
+				old[k] = v
+			}
+
+			new := applyPatch(old, patch)
+
+			cp := cdcPartial{
+				op:  "u",
+				id:  IdString(orig["_id"]),
+				rev: orig.Rev() + 1,
+				old: &old,
+				new: &new,
+			}
+			return s.cdcWrite(ctx, patch, wo, cp)
+		})
+		if written {
+			diffs = append(diffs, orig)
+		}
 		if err != nil {
 			if err == mongo.ErrNoDocuments {
-				break
+				continue // deleted since the query
 			}
-			return diffs, s.dbError(ctx, err, "db-update")
-		}
-		diffs = append(diffs, orig)
-
-		old := etre.Entity{}
-		for k, v := range orig {
-			if k == "_id" || k == "_type" || k == "_rev" {
+			if wo.Unordered && !written && !cdcError(err) && ctx.Err() == nil {
+				updateErrs[IdString(id)] = err
 				continue
 			}
-			old[k] = v
+			return diffs, err
 		}
+	}
 
-		cp := cdcPartial{
-			op:  "u",
-			id:  orig["_id"].(bson.ObjectID),
-			rev: orig.Rev() + 1,
-			old: &old,
-			new: &patch,
+	if len(updateErrs) > 0 {
+		return diffs, updateErrs
+	}
+
+	if wo.Upsert && len(diffs) == 0 {
+		return s.upsert(ctx, wo, q, patch)
+	}
+
+	return diffs, nil
+}
+
+// upsert inserts a new entity made from the query and the patch by calling
+// CreateEntityIfNotExists, which writes the CDC insert event. If an entity
+// matching the query was inserted after UpdateEntities queried (a race with
+// another caller), the upsert does not insert and the entity is updated instead.
+func (s store) upsert(ctx context.Context, wo WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+	e := etre.Entity{}
+	for _, p := range q.Predicates {
+		e[p.Label] = p.Value
+	}
+	for k, v := range patch {
+		if k == "_updated" {
+			continue // set by CreateEntityIfNotExists
 		}
-		if err := s.cdcWrite(ctx, patch, wo, cp); err != nil {
-			return diffs, err
+		e[k] = v
+	}
+	got, created, err := s.createEntityIfNotExists(ctx, wo, q, e)
+	if err != nil {
+		if created {
+			return []etre.Entity{{"_id": got["_id"]}}, err // CDC error
 		}
+		return nil, err
+	}
+	if !created {
+		wo.Upsert = false
+		return s.updateEntities(ctx, wo, q, patch)
 	}
+	return []etre.Entity{{"_id": got["_id"]}}, nil
+}
 
-	if err := cursor.Err(); err != nil {
-		return diffs, s.dbError(ctx, err, "db-cursor-next")
+// upsertQuery returns a ValidationError if the query cannot be used to make a
+// new entity for an upsert: it must have only label=value predicates.
+func upsertQuery(q query.Query) error {
+	if len(q.Or) > 0 {
+		return ValidationError{
+			Err:  fmt.Errorf("upsert query cannot use OR (^) because the new entity cannot be made from it"),
+			Type: "invalid-upsert-query",
+		}
+	}
+	for _, p := range q.Predicates {
+		if p.Operator != "=" && p.Operator != "==" {
+			return ValidationError{
+				Err:  fmt.Errorf("upsert query can only use label=value, not operator %s (label %s), because the new entity cannot be made from it", p.Operator, p.Label),
+				Type: "invalid-upsert-query",
+			}
+		}
+		if etre.IsMetalabel(p.Label) {
+			return ValidationError{
+				Err:  fmt.Errorf("upsert query cannot select metalabel %s", p.Label),
+				Type: "invalid-upsert-query",
+			}
+		}
 	}
+	return nil
+}
 
-	return diffs, nil
+// upsertPatch returns a ValidationError if the patch cannot be used to make a
+// new entity for an upsert: it must have only labels, no nested label paths or
+// patch directives.
+func upsertPatch(patch etre.Entity) error {
+	for k := range patch {
+		if strings.Contains(k, ".") || strings.HasPrefix(k, "$") {
+			return ValidationError{
+				Err:  fmt.Errorf("upsert patch cannot have nested label path or patch directive %s because the new entity cannot be made from it", k),
+				Type: "invalid-upsert-patch",
+			}
+		}
+	}
+	return nil
 }
 
 // DeleteEntities queries the db and deletes all Entity matching that query.
@@ -357,31 +1102,131 @@ func (s store) UpdateEntities(ctx context.Context, wo WriteOp, q query.Query, pa
 // Returns a slice of successfully deleted entities an error if there is one.
 // For example, if 4 entities were supposed to be deleted and 3 are ok and the
 // 4th fails, a slice with 3 deleted entities and an error will be returned.
+//
+// If config.EntityConfig.SoftDelete is true, entities are not removed: metalabel
+// _deleted is set to the delete time, which hides them from queries and writes.
+// The CDC event is a delete event either way.
 func (s store) DeleteEntities(ctx context.Context, wo WriteOp, q query.Query) ([]etre.Entity, error) {
+	t0 := time.Now()
+	deleted, err := s.deleteEntities(ctx, wo, q)
+	s.logWrite(ctx, "delete", wo, len(deleted), t0, err)
+	return deleted, err
+}
+
+func (s store) deleteEntities(ctx context.Context, wo WriteOp, q query.Query) ([]etre.Entity, error) {
 	c, ok := s.coll[wo.EntityType]
 	if !ok {
 		panic("invalid entity type passed to DeleteEntities: " + wo.EntityType)
 	}
 
+	filter := s.filter(wo.EntityType, q, false)
+	ids, err := s.findIds(ctx, c, filter)
+	if err != nil {
+		return nil, err
+	}
+	wo = autoSetSize(wo, len(ids))
+
+	// Soft delete: set _deleted instead of deleting (see config.EntityConfig.SoftDelete)
+	softDelete := bson.M{
+		"$set": bson.M{etre.META_LABEL_DELETED: s.clock().UnixNano()},
+		"$inc": bson.M{"_rev": 1}, // increment the revision
+	}
+
 	deleted := []etre.Entity{}
-	for {
+	for _, id := range ids {
 		var old etre.Entity
-		err := c.FindOneAndDelete(ctx, Filter(q)).Decode(&old)
+		written, err := s.txn(ctx, c, func(ctx context.Context) error {
+			// Entity must still match the query
+			idFilter := bson.M{"$and": bson.A{bson.M{"_id": id}, filter}}
+			var err error
+			if s.config.SoftDelete {
+				err = c.FindOneAndUpdate(ctx, idFilter, softDelete).Decode(&old) // returns doc before update
+			} else {
+				err = c.FindOneAndDelete(ctx, idFilter).Decode(&old)
+			}
+			if err != nil {
+				if err == mongo.ErrNoDocuments {
+					return err
+				}
+				return s.dbError(ctx, err, "db-delete")
+			}
+			ce := cdcPartial{
+				op:  "d",
+				id:  IdString(old["_id"]),
+				old: &old,
+				new: nil,
+				rev: old.Rev() + 1,
+			}
+			return s.cdcWrite(ctx, old, wo, ce)
+		})
+		if written {
+			deleted = append(deleted, old)
+		}
 		if err != nil {
 			if err == mongo.ErrNoDocuments {
-				break
+				continue // deleted or changed since the query
 			}
-			return deleted, s.dbError(ctx, err, "db-delete")
+			return deleted, err
 		}
-		deleted = append(deleted, old)
-		ce := cdcPartial{
-			op:  "d",
-			id:  old["_id"].(bson.ObjectID),
-			old: &old,
-			new: nil,
-			rev: old.Rev() + 1,
+	}
+
+	return deleted, nil
+}
+
+// DeleteAll deletes all entities of the entity type, like truncating the collection.
+// Unlike DeleteEntities, entities are removed even if config.EntityConfig.SoftDelete
+// is true, and soft-deleted entities are removed too. A CDC delete event is written
+// for each entity that was not soft-deleted (soft-deleted entities already have one).
+// Like DeleteEntities, it allows partial success and failure: it returns the entities
+// (_id, _type, and _rev) that were deleted and an error if there is one.
+func (s store) DeleteAll(ctx context.Context, wo WriteOp) ([]etre.Entity, error) {
+	t0 := time.Now()
+	deleted, err := s.deleteAll(ctx, wo)
+	s.logWrite(ctx, "delete-all", wo, len(deleted), t0, err)
+	return deleted, err
+}
+
+func (s store) deleteAll(ctx context.Context, wo WriteOp) ([]etre.Entity, error) {
+	c, ok := s.coll[wo.EntityType]
+	if !ok {
+		panic("invalid entity type passed to DeleteAll: " + wo.EntityType)
+	}
+
+	ids, err := s.findIds(ctx, c, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	wo = autoSetSize(wo, len(ids))
+
+	deleted := []etre.Entity{}
+	for _, id := range ids {
+		var old etre.Entity
+		written, err := s.txn(ctx, c, func(ctx context.Context) error {
+			if err := c.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&old); err != nil {
+				if err == mongo.ErrNoDocuments {
+					return err
+				}
+				return s.dbError(ctx, err, "db-delete")
+			}
+			if _, ok := old[etre.META_LABEL_DELETED]; ok {
+				return nil // soft-deleted: already has CDC delete event
+			}
+			ce := cdcPartial{
+				op:  "d",
+				id:  IdString(old["_id"]),
+				old: &old,
+				new: nil,
+				rev: old.Rev() + 1,
+			}
+			return s.cdcWrite(ctx, old, wo, ce)
+		})
+		if written {
+			deleted = append(deleted, etre.Entity{"_id": old["_id"], "_type": old["_type"], "_rev": old["_rev"]})
 		}
-		if err := s.cdcWrite(ctx, old, wo, ce); err != nil {
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				continue // deleted since the query
+			}
 			return deleted, err
 		}
 	}
@@ -389,15 +1234,123 @@ func (s store) DeleteEntities(ctx context.Context, wo WriteOp, q query.Query) ([
 	return deleted, nil
 }
 
+// RestoreEntities restores all soft-deleted entities matching the query by
+// removing metalabel _deleted (see DeleteEntities). Entities matching the query
+// that are not soft-deleted are ignored, except when restoring one entity by id
+// (query.ById): then it returns a ValidationError if the entity is not deleted.
+// Like UpdateEntities, it allows partial success and failure: it returns the
+// entities (_id, _type, _rev, _updated, and _deleted) before they were restored
+// and an error if there is one. A CDC update event is written for each entity:
+// old has _deleted, new does not.
+func (s store) RestoreEntities(ctx context.Context, wo WriteOp, q query.Query) ([]etre.Entity, error) {
+	t0 := time.Now()
+	restored, err := s.restoreEntities(ctx, wo, q)
+	s.logWrite(ctx, "restore", wo, len(restored), t0, err)
+	return restored, err
+}
+
+func (s store) restoreEntities(ctx context.Context, wo WriteOp, q query.Query) ([]etre.Entity, error) {
+	c, ok := s.coll[wo.EntityType]
+	if !ok {
+		panic("invalid entity type passed to RestoreEntities: " + wo.EntityType)
+	}
+
+	if isById(q) {
+		notDeleted := bson.M{"$and": bson.A{
+			s.filter(wo.EntityType, q, true),
+			bson.M{etre.META_LABEL_DELETED: bson.M{"$exists": false}},
+		}}
+		n, err := c.CountDocuments(ctx, notDeleted)
+		if err != nil {
+			return nil, s.dbError(ctx, err, "db-query")
+		}
+		if n > 0 {
+			return nil, ValidationError{
+				Err:  fmt.Errorf("entity %s is not deleted; only soft-deleted entities can be restored", q.Predicates[0].Value),
+				Type: "entity-not-deleted",
+			}
+		}
+	}
+
+	isDeleted := bson.M{etre.META_LABEL_DELETED: bson.M{"$exists": true}}
+	ids, err := s.findIds(ctx, c, bson.M{"$and": bson.A{s.filter(wo.EntityType, q, true), isDeleted}})
+	if err != nil {
+		return nil, err
+	}
+	wo = autoSetSize(wo, len(ids))
+
+	updated := s.clock().UnixNano()
+	update := bson.M{
+		"$unset": bson.M{etre.META_LABEL_DELETED: ""}, // Mongo expects "" (see $unset docs)
+		"$set":   bson.M{etre.META_LABEL_UPDATED: updated},
+		"$inc":   bson.M{"_rev": 1}, // increment the revision
+	}
+	opts := options.FindOneAndUpdate().
+		SetProjection(bson.M{"_id": 1, "_type": 1, "_rev": 1, "_updated": 1, "_deleted": 1}).
+		SetReturnDocument(options.Before)
+
+	restored := []etre.Entity{}
+	for _, id := range ids {
+		var orig etre.Entity
+		written, err := s.txn(ctx, c, func(ctx context.Context) error {
+			// Entity must still be deleted
+			filter := bson.M{"_id": id, etre.META_LABEL_DELETED: bson.M{"$exists": true}}
+			if err := c.FindOneAndUpdate(ctx, filter, update, opts).Decode(&orig); err != nil {
+				if err == mongo.ErrNoDocuments {
+					return err
+				}
+				return s.dbError(ctx, err, "db-update")
+			}
+
+			old := etre.Entity{
+				etre.META_LABEL_DELETED: orig[etre.META_LABEL_DELETED],
+				etre.META_LABEL_UPDATED: orig[etre.META_LABEL_UPDATED],
+			}
+			new := etre.Entity{
+				etre.META_LABEL_UPDATED: updated,
+			}
+			cp := cdcPartial{
+				op:  "u",
+				id:  IdString(orig["_id"]),
+				rev: orig.Rev() + 1,
+				old: &old,
+				new: &new,
+			}
+			return s.cdcWrite(ctx, etre.Entity{}, wo, cp)
+		})
+		if written {
+			restored = append(restored, orig)
+		}
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				continue // restored or purged since the query
+			}
+			return restored, err
+		}
+	}
+
+	return restored, nil
+}
+
 // DeleteLabel deletes a label from an entity.
 func (s store) DeleteLabel(ctx context.Context, wo WriteOp, label string) (etre.Entity, error) {
+	t0 := time.Now()
+	diff, err := s.deleteLabel(ctx, wo, label)
+	n := 0
+	if diff != nil {
+		n = 1
+	}
+	s.logWrite(ctx, "delete-label", wo, n, t0, err)
+	return diff, err
+}
+
+func (s store) deleteLabel(ctx context.Context, wo WriteOp, label string) (etre.Entity, error) {
 	c, ok := s.coll[wo.EntityType]
 	if !ok {
 		panic("invalid entity type passed to DeleteLabel: " + wo.EntityType)
 	}
 
-	id, _ := bson.ObjectIDFromHex(wo.EntityId)
-	filter := bson.M{"_id": id}
+	filter := bson.M{"_id": s.idValue(wo.EntityType, wo.EntityId), etre.META_LABEL_DELETED: bson.M{"$exists": false}}
 	update := bson.M{
 		"$unset": bson.M{label: ""}, // removes label, Mongo expects "" (see $unset docs)
 		"$inc":   bson.M{"_rev": 1}, // increment the revision
@@ -406,42 +1359,354 @@ func (s store) DeleteLabel(ctx context.Context, wo WriteOp, label string) (etre.
 		SetProjection(bson.M{"_id": 1, "_type": 1, "_rev": 1, label: 1}).
 		SetReturnDocument(options.Before)
 	var old etre.Entity
-	err := c.FindOneAndUpdate(ctx, filter, update, opts).Decode(&old)
+	written, err := s.txn(ctx, c, func(ctx context.Context) error {
+		if err := c.FindOneAndUpdate(ctx, filter, update, opts).Decode(&old); err != nil {
+			return s.dbError(ctx, err, "db-update")
+		}
+
+		// Make the new Entity by copying the old and deleting the label
+		new := etre.Entity{}
+		for k, v := range old {
+			new[k] = v
+		}
+		delete(new, label)
+		// We need to increment "_rev" by one, but the type needs to match
+		// what it was on "old"
+		switch old["_rev"].(type) {
+		case int:
+			new["_rev"] = old["_rev"].(int) + 1
+		case int32:
+			new["_rev"] = old["_rev"].(int32) + 1
+		case int64:
+			new["_rev"] = old["_rev"].(int64) + 1
+		default:
+			new["_rev"] = old.Rev() + 1
+		}
+
+		cp := cdcPartial{
+			op:  "u",
+			id:  IdString(old["_id"]),
+			new: &new,
+			old: &old,
+			rev: old.Rev() + 1,
+		}
+		return s.cdcWrite(ctx, etre.Entity{}, wo, cp)
+	})
 	if err != nil {
-		return nil, s.dbError(ctx, err, "db-update")
-	}
-
-	// Make the new Entity by copying the old and deleting the label
-	new := etre.Entity{}
-	for k, v := range old {
-		new[k] = v
-	}
-	delete(new, label)
-	// We need to increment "_rev" by one, but the type needs to match
-	// what it was on "old"
-	switch old["_rev"].(type) {
-	case int:
-		new["_rev"] = old["_rev"].(int) + 1
-	case int32:
-		new["_rev"] = old["_rev"].(int32) + 1
-	case int64:
-		new["_rev"] = old["_rev"].(int64) + 1
-	default:
-		new["_rev"] = old.Rev() + 1
+		if written {
+			return old, err // CDC error
+		}
+		return nil, err
 	}
 
-	cp := cdcPartial{
-		op:  "u",
-		id:  old["_id"].(bson.ObjectID),
-		new: &new,
-		old: &old,
-		rev: old.Rev() + 1,
+	return old, nil
+}
+
+// DeleteLabelByQuery deletes a label from all entities matching the query that
+// have the label. Like UpdateEntities, it allows partial success and failure:
+// it returns the entities (_id, _type, _rev, and the label) before the label
+// was deleted and an error if there is one. A CDC event is written for each
+// entity by DeleteLabel.
+func (s store) DeleteLabelByQuery(ctx context.Context, wo WriteOp, q query.Query, label string) ([]etre.Entity, error) {
+	t0 := time.Now()
+	diffs, err := s.deleteLabelByQuery(ctx, wo, q, label)
+	s.logWrite(ctx, "delete-label", wo, len(diffs), t0, err)
+	return diffs, err
+}
+
+func (s store) deleteLabelByQuery(ctx context.Context, wo WriteOp, q query.Query, label string) ([]etre.Entity, error) {
+	c, ok := s.coll[wo.EntityType]
+	if !ok {
+		panic("invalid entity type passed to DeleteLabelByQuery: " + wo.EntityType)
+	}
+
+	// Only entities with the label, else DeleteLabel increments _rev and
+	// writes a CDC event for entities that don't change
+	filter := s.filter(wo.EntityType, q, false)
+	if _, ok := filter[label]; ok {
+		filter = bson.M{"$and": bson.A{filter, bson.M{label: bson.M{"$exists": true}}}}
+	} else {
+		filter[label] = bson.M{"$exists": true}
 	}
-	if err := s.cdcWrite(ctx, etre.Entity{}, wo, cp); err != nil {
-		return old, err
+
+	ids, err := s.findIds(ctx, c, filter)
+	if err != nil {
+		return nil, err
 	}
+	wo = autoSetSize(wo, len(ids))
 
-	return old, nil
+	diffs := []etre.Entity{}
+	for _, id := range ids {
+		eo := wo // copy
+		eo.EntityId = IdString(id)
+		old, err := s.deleteLabel(ctx, eo, label)
+		if err != nil {
+			if err == etre.ErrEntityNotFound {
+				continue // deleted since the query
+			}
+			if old != nil {
+				diffs = append(diffs, old) // CDC error
+			}
+			return diffs, err
+		}
+		diffs = append(diffs, old)
+	}
+
+	return diffs, nil
+}
+
+// RenameLabel renames a label to newLabel in all entities matching the query
+// that have the label, like "dc" to "datacenter" during a migration. Each entity
+// is renamed atomically (MongoDB $rename) and a CDC event is written for each:
+// old has the label (and newLabel if it existed), new has only newLabel. Like
+// UpdateEntities, it allows partial success and failure: it returns the entities
+// (_id, _type, _rev, label, and newLabel) before the rename and an error if
+// there is one.
+//
+// If overwrite is false and a matching entity already has newLabel, a
+// ValidationError is returned and no entities are renamed. If overwrite is true,
+// the value of newLabel is replaced.
+func (s store) RenameLabel(ctx context.Context, wo WriteOp, q query.Query, label, newLabel string, overwrite bool) ([]etre.Entity, error) {
+	t0 := time.Now()
+	diffs, err := s.renameLabel(ctx, wo, q, label, newLabel, overwrite)
+	s.logWrite(ctx, "rename-label", wo, len(diffs), t0, err)
+	return diffs, err
+}
+
+func (s store) renameLabel(ctx context.Context, wo WriteOp, q query.Query, label, newLabel string, overwrite bool) ([]etre.Entity, error) {
+	c, ok := s.coll[wo.EntityType]
+	if !ok {
+		panic("invalid entity type passed to RenameLabel: " + wo.EntityType)
+	}
+
+	// Only entities with the label, else the rename increments _rev and
+	// writes a CDC event for entities that don't change
+	hasLabel := bson.M{label: bson.M{"$exists": true}}
+	filter := bson.M{"$and": bson.A{s.filter(wo.EntityType, q, false), hasLabel}}
+
+	if !overwrite {
+		hasNew := bson.M{"$and": bson.A{s.filter(wo.EntityType, q, false), hasLabel, bson.M{newLabel: bson.M{"$exists": true}}}}
+		n, err := c.CountDocuments(ctx, hasNew)
+		if err != nil {
+			return nil, s.dbError(ctx, err, "db-query")
+		}
+		if n > 0 {
+			return nil, ValidationError{
+				Err:  fmt.Errorf("%d matching entities already have label %s; set overwrite to replace its value", n, newLabel),
+				Type: "label-exists",
+			}
+		}
+	}
+
+	ids, err := s.findIds(ctx, c, filter)
+	if err != nil {
+		return nil, err
+	}
+	wo = autoSetSize(wo, len(ids))
+
+	updated := s.clock().UnixNano()
+	update := bson.M{
+		"$rename": bson.M{label: newLabel},
+		"$set":    bson.M{"_updated": updated},
+		"$inc":    bson.M{"_rev": 1}, // increment the revision
+	}
+	opts := options.FindOneAndUpdate().
+		SetProjection(bson.M{"_id": 1, "_type": 1, "_rev": 1, "_updated": 1, label: 1, newLabel: 1}).
+		SetReturnDocument(options.Before)
+
+	diffs := []etre.Entity{}
+	for _, id := range ids {
+		// The entity must still have the label and, unless overwrite, not have
+		// newLabel; else it changed since the query and is not renamed
+		idFilter := bson.M{"_id": id, label: bson.M{"$exists": true}}
+		if !overwrite {
+			idFilter[newLabel] = bson.M{"$exists": false}
+		}
+		var orig etre.Entity
+		written, err := s.txn(ctx, c, func(ctx context.Context) error {
+			if err := c.FindOneAndUpdate(ctx, idFilter, update, opts).Decode(&orig); err != nil {
+				if err == mongo.ErrNoDocuments {
+					return err
+				}
+				return s.dbError(ctx, err, "db-update")
+			}
+
+			old := etre.Entity{}
+			for k, v := range orig {
+				if k == "_id" || k == "_type" || k == "_rev" {
+					continue
+				}
+				old[k] = v
+			}
+			new := etre.Entity{
+				newLabel:   orig[label],
+				"_updated": updated,
+			}
+
+			cp := cdcPartial{
+				op:  "u",
+				id:  IdString(orig["_id"]),
+				rev: orig.Rev() + 1,
+				old: &old,
+				new: &new,
+			}
+			return s.cdcWrite(ctx, etre.Entity{}, wo, cp)
+		})
+		if written {
+			diffs = append(diffs, orig)
+		}
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				continue // changed or deleted since the query
+			}
+			return diffs, err
+		}
+	}
+
+	return diffs, nil
+}
+
+// filter returns Filter(q) with _id values for the entity type (see idValue), and
+// soft-deleted entities excluded unless includeDeleted is true or the query selects
+// metalabel _deleted.
+func (s store) filter(entityType string, q query.Query, includeDeleted bool) bson.M {
+	filter := filterIds(q, func(id string) interface{} { return s.idValue(entityType, id) })
+	if includeDeleted {
+		return filter
+	}
+	for _, p := range q.AllPredicates() {
+		if p.Label == etre.META_LABEL_DELETED {
+			return filter
+		}
+	}
+	filter[etre.META_LABEL_DELETED] = bson.M{"$exists": false}
+	return filter
+}
+
+// isById returns true if the query is one _id, like query.ById.
+func isById(q query.Query) bool {
+	return len(q.Or) == 0 && len(q.Predicates) == 1 &&
+		q.Predicates[0].Label == etre.META_LABEL_ID && q.Predicates[0].Operator == "="
+}
+
+// findIds returns the _id of each entity matching the filter. Bulk writes query
+// the ids first, then write each entity by _id, so the number of entities to
+// write is known for the set size (see autoSetSize).
+//
+// Each _id is returned once: MongoDB can return a document more than once if
+// it's updated while a cursor is open (for example, when an update doesn't
+// change the queried labels and the document moves in the index), so an
+// entity is never written twice and a bulk write cannot loop forever.
+func (s store) findIds(ctx context.Context, c *mongo.Collection, filter bson.M) ([]interface{}, error) {
+	fopts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := c.Find(ctx, filter, fopts)
+	if err != nil {
+		return nil, s.dbError(ctx, err, "db-query")
+	}
+	defer cursor.Close(ctx)
+
+	ids := []interface{}{}
+	seen := map[string]bool{}
+	for cursor.Next(ctx) {
+		var doc struct {
+			Id interface{} `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, s.dbError(ctx, err, "db-cursor-decode")
+		}
+		id := IdString(doc.Id)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, doc.Id)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, s.dbError(ctx, err, "db-cursor-next")
+	}
+	return ids, nil
+}
+
+// autoSetSize sets wo.SetSize to n, the number of entities a bulk write will
+// write, if wo.SetId is set without a size. The API sets SetId without a size
+// for bulk writes that the caller did not give a set, so all CDC events from
+// one call share one server-generated SetId with the correct SetSize.
+func autoSetSize(wo WriteOp, n int) WriteOp {
+	if wo.SetId != "" && wo.SetSize == 0 {
+		wo.SetSize = n
+	}
+	return wo
+}
+
+// idValue returns the _id value stored in MongoDB for the entity id. For entity
+// types with id format objectid (default), it's IdValue. For other types, _id is
+// always a string, even if it looks like an ObjectID, like a natural-key id.
+func (s store) idValue(entityType, id string) interface{} {
+	if s.config.IdFormat(entityType) == config.ID_FORMAT_OBJECTID {
+		return IdValue(id)
+	}
+	return id
+}
+
+// newId returns a new _id for the entity according to the id strategy configured
+// for the entity type (config.EntityConfig.Id).
+func (s store) newId(entityType string, e etre.Entity) (interface{}, error) {
+	switch s.config.IdStrategy(entityType) {
+	case config.ID_STRATEGY_UUID:
+		var u [16]byte
+		if _, err := rand.Read(u[:]); err != nil {
+			return nil, DbError{Err: err, Type: "db-insert"}
+		}
+		u[6] = (u[6] & 0x0f) | 0x40 // version 4
+		u[8] = (u[8] & 0x3f) | 0x80 // variant 10
+		return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+	case config.ID_STRATEGY_HASH:
+		// Hash natural-key labels in config order as the label, a NUL byte, and
+		// the BSON type and value, so that different labels with the same values,
+		// or values of different types like "1" and 1, don't hash the same.
+		h := sha256.New()
+		for _, label := range s.config.Id[entityType].Labels {
+			v, ok := e[label]
+			if !ok || v == nil {
+				return nil, ValidationError{
+					Err:  fmt.Errorf("natural-key label %s not set; entity type %s _id is a hash of labels %v", label, entityType, s.config.Id[entityType].Labels),
+					Type: "missing-id-label",
+				}
+			}
+			t, b, err := bson.MarshalValue(v)
+			if err != nil {
+				return nil, ValidationError{
+					Err:  fmt.Errorf("cannot hash natural-key label %s: %s", label, err),
+					Type: "invalid-id",
+				}
+			}
+			h.Write([]byte(label))
+			h.Write([]byte{0, byte(t)})
+			h.Write(b)
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	case config.ID_STRATEGY_LABEL:
+		// Natural-key id: the label value as is, in the configured format
+		label := s.config.Id[entityType].Labels[0]
+		v, ok := e[label].(string)
+		if !ok {
+			return nil, ValidationError{
+				Err:  fmt.Errorf("natural-key label %s not set or not a string; entity type %s _id is the value of label %s", label, entityType, label),
+				Type: "missing-id-label",
+			}
+		}
+		id, err := ParseId(s.config.IdFormat(entityType), v)
+		if err != nil {
+			return nil, ValidationError{
+				Err:   fmt.Errorf("invalid natural-key label %s: %s", label, err),
+				Type:  "invalid-id",
+				Label: label,
+			}
+		}
+		return id, nil
+	default:
+		return bson.NewObjectID(), nil
+	}
 }
 
 func (s store) dbError(ctx context.Context, err error, errType string) error {
@@ -449,7 +1714,7 @@ func (s store) dbError(ctx context.Context, err error, errType string) error {
 		return DbError{Err: ctxErr, Type: errType}
 	}
 	if dupe := IsDupeKeyError(err); dupe != nil {
-		return DbError{Err: dupe, Type: "duplicate-entity"}
+		return DbError{Err: dupe, Type: "duplicate-entity", Conflict: dupeKeyConflict(dupe)}
 	}
 	if err == mongo.ErrNoDocuments {
 		return etre.ErrEntityNotFound
@@ -461,11 +1726,53 @@ func (s store) dbError(ctx context.Context, err error, errType string) error {
 // CDC write
 // --------------------------------------------------------------------------
 
+// txn calls fn, which writes one entity and its CDC event. If config.EntityConfig.Transactions
+// is true, fn is called in a MongoDB transaction so that the entity write and
+// CDC event commit atomically: both or neither. Else, the entity is written
+// first and, if the CDC write fails, the entity write is not undone; the CDC
+// store retries the event according to its RetryPolicy before it writes the
+// event to the fallback file and returns an error.
+//
+// written is true if the entity write was committed, which is possible with
+// an error only without transactions and only for a CDC error (DbError type
+// "cdc-write").
+func (s store) txn(ctx context.Context, c *mongo.Collection, fn func(context.Context) error) (written bool, err error) {
+	if !s.config.Transactions {
+		err = fn(ctx)
+		return err == nil || cdcError(err), err
+	}
+
+	sess, err := c.Database().Client().StartSession()
+	if err != nil {
+		return false, s.dbError(ctx, err, "db-txn")
+	}
+	defer sess.EndSession(ctx)
+
+	var fnErr error
+	_, err = sess.WithTransaction(ctx, func(ctx context.Context) (interface{}, error) {
+		fnErr = fn(ctx)
+		return nil, fnErr
+	})
+	if err != nil {
+		if fnErr != nil {
+			return false, fnErr // aborted
+		}
+		return false, s.dbError(ctx, err, "db-txn") // commit failed
+	}
+	return true, nil
+}
+
+// cdcError returns true if the error is from writing a CDC event.
+func cdcError(err error) bool {
+	dbErr, ok := err.(DbError)
+	return ok && dbErr.Type == "cdc-write"
+}
+
 // cdcPartial represents part of a full etre.CDCEvent. It's passed to cdcWrite
 // which makes a complete CDCEvent from the partial and a WriteOp.
 type cdcPartial struct {
 	op  string
-	id  bson.ObjectID
+	id  string // IdString of _id
 	old *etre.Entity
 	new *etre.Entity
 	rev int64
@@ -480,11 +1787,11 @@ func (s store) cdcWrite(ctx context.Context, e etre.Entity, wo WriteOp, cp cdcPa
 		set.Size = wo.SetSize
 	}
 	event := etre.CDCEvent{
-		Ts:     time.Now().UnixNano() / int64(time.Millisecond),
+		Ts:     s.clock().UnixMilli(),
 		Op:     cp.op,
 		Caller: wo.Caller,
 
-		EntityId:   cp.id.Hex(),
+		EntityId:   cp.id,
 		EntityType: wo.EntityType,
 		EntityRev:  cp.rev,
 		Old:        cp.old,
@@ -495,7 +1802,7 @@ func (s store) cdcWrite(ctx context.Context, e etre.Entity, wo WriteOp, cp cdcPa
 		SetSize: set.Size,
 	}
 	if err := s.cdcs.Write(ctx, event); err != nil {
-		return DbError{Err: err, Type: "cdc-write", EntityId: cp.id.Hex()}
+		return DbError{Err: err, Type: "cdc-write", EntityId: cp.id}
 	}
 	return nil
 }
@@ -4,6 +4,10 @@ package entity_test
 
 import (
 	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,6 +18,7 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 
 	"github.com/square/etre"
+	"github.com/square/etre/cdc"
 	"github.com/square/etre/config"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/query"
@@ -126,6 +131,30 @@ type readTest struct {
 	expect []etre.Entity
 }
 
+func TestStreamEntitiesInequalityBoundary(t *testing.T) {
+	// Test that <= and >= include the boundary value but < and > do not.
+	// Only the first test node has z (z=9).
+	store := setup(t, &mock.CDCStore{})
+	readTests := []readTest{
+		{query: "z>=9", expect: testNodes[:1]},
+		{query: "z >= 9", expect: testNodes[:1]},
+		{query: "z>9", expect: []etre.Entity{}},
+		{query: "z<=9", expect: testNodes[:1]},
+		{query: "z <= 9", expect: testNodes[:1]},
+		{query: "z<9", expect: []etre.Entity{}},
+		{query: "x>=4", expect: testNodes[1:]},
+		{query: "x<=4", expect: testNodes[:2]},
+	}
+	for _, rt := range readTests {
+		q, err := query.Translate(rt.query)
+		require.NoError(t, err, rt.query)
+
+		got, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+		require.NoError(t, err, rt.query)
+		assert.Equal(t, rt.expect, got, rt.query)
+	}
+}
+
 func TestStreamEntitiesMatching(t *testing.T) {
 	// Test various combinations of queries to ensure that we match and return
 	// the correct entities. This is the fundamental job of Etre, so it should
@@ -147,6 +176,22 @@ func TestStreamEntitiesMatching(t *testing.T) {
 			query:  "x>2",
 			expect: testNodes[1:],
 		},
+		{
+			// Values for < and > are numbers that match int64 values in the db, but
+			// a quoted value is a string, which doesn't match numbers, so none match
+			query:  `x>"2"`,
+			expect: []etre.Entity{},
+		},
+		{
+			// OR: union of 1st test node (y=a) and 3rd test node (x=6)
+			query:  "y=a ^ x=6",
+			expect: []etre.Entity{testNodes[0], testNodes[2]},
+		},
+		{
+			// OR with AND terms: 1st test node matches neither term
+			query:  "y=a,x>2 ^ y=b,bar",
+			expect: testNodes[1:],
+		},
 		{
 			// All test nodes have label y but none with y=y, so none match
 			query:  "y=y",
@@ -154,7 +199,7 @@ func TestStreamEntitiesMatching(t *testing.T) {
 		},
 	}
 	for _, rt := range readTests {
-		q, err := query.Translate(rt.query)
+		q, err := query.TranslateVersion(rt.query, query.LATEST_VERSION)
 		require.NoError(t, err)
 
 		got, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
@@ -190,6 +235,24 @@ func TestReadEntityMatching(t *testing.T) {
 	}
 }
 
+func TestReadEntitiesByIds(t *testing.T) {
+	// Test that entities are returned in id order, nil for missing ids, and
+	// the same entity for duplicate ids
+	store := setup(t, &mock.CDCStore{})
+	id0 := testNodes[0]["_id"].(bson.ObjectID).Hex()
+	id2 := testNodes[2]["_id"].(bson.ObjectID).Hex()
+	missing := bson.NewObjectID().Hex()
+
+	got, err := store.ReadEntitiesByIds(context.Background(), entityType, []string{id2, missing, id0, "bogus", id2}, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{testNodes[2], nil, testNodes[0], nil, testNodes[2]}, got)
+
+	// Return labels: _id is used to order the entities but not returned
+	got, err = store.ReadEntitiesByIds(context.Background(), entityType, []string{id2, id0}, etre.QueryFilter{ReturnLabels: []string{"x"}})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"x": int64(6)}, {"x": int64(2)}}, got)
+}
+
 func TestStreamEntitiesFilterDistinct(t *testing.T) {
 	// Test that etre.QueryFilter{Distinct: true} returns a list of unique values
 	// for one label. The 1st test node has y=a and the 2nd and 3rd both have y=b,
@@ -228,6 +291,183 @@ func TestStreamEntitiesFilterDistinctNoResult(t *testing.T) {
 	assert.Empty(t, got)
 }
 
+func TestGroupEntities(t *testing.T) {
+	// Test grouping the test nodes by y: y=a has x=2, y=b has x=4 and x=6.
+	// Return label x only, but y is returned too because it's the group label.
+	store := setup(t, &mock.CDCStore{})
+	q, err := query.Translate("y")
+	require.NoError(t, err)
+
+	got, err := store.GroupEntities(context.Background(), entityType, q, "y", etre.QueryFilter{ReturnLabels: []string{"x"}})
+	require.NoError(t, err)
+	expect := map[string][]etre.Entity{
+		"a": {{"x": int64(2), "y": "a"}},
+		"b": {{"x": int64(4), "y": "b"}, {"x": int64(6), "y": "b"}},
+	}
+	assert.Equal(t, expect, got)
+
+	// Entities without the group label are grouped under ""
+	got, err = store.GroupEntities(context.Background(), entityType, q, "z", etre.QueryFilter{ReturnLabels: []string{"x"}})
+	require.NoError(t, err)
+	expect = map[string][]etre.Entity{
+		"9": {{"x": int64(2), "z": int64(9)}},
+		"":  {{"x": int64(4)}, {"x": int64(6)}},
+	}
+	assert.Equal(t, expect, got)
+
+	// Distinct isn't supported
+	_, err = store.GroupEntities(context.Background(), entityType, q, "y", etre.QueryFilter{ReturnLabels: []string{"y"}, Distinct: true})
+	require.Error(t, err)
+	assert.IsType(t, entity.ValidationError{}, err)
+}
+
+func TestGroupEntitiesMaxGroups(t *testing.T) {
+	// There are 3 distinct values of x, so max 2 groups is an error
+	setup(t, &mock.CDCStore{})
+	store := entity.NewStore(coll, &mock.CDCStore{}, config.EntityConfig{
+		Types:     []string{entityType},
+		BatchSize: 5000,
+		MaxGroups: 2,
+	})
+	q, err := query.Translate("y")
+	require.NoError(t, err)
+
+	_, err = store.GroupEntities(context.Background(), entityType, q, "x", etre.QueryFilter{})
+	require.Error(t, err)
+	verr, ok := err.(entity.ValidationError)
+	require.True(t, ok, "got error %T, expected entity.ValidationError", err)
+	assert.Equal(t, "too-many-groups", verr.Type)
+
+	// y has only 2 distinct values
+	got, err := store.GroupEntities(context.Background(), entityType, q, "y", etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+}
+
+func TestStreamEntitiesMaxResults(t *testing.T) {
+	// There are 3 test nodes, so max 2 results is an error unless the query
+	// matches fewer entities or the limit is within max results
+	setup(t, &mock.CDCStore{})
+	store := entity.NewStore(coll, &mock.CDCStore{}, config.EntityConfig{
+		Types:      []string{entityType},
+		BatchSize:  5000,
+		MaxResults: 2,
+	})
+
+	// Over: all 3 nodes
+	q, err := query.Translate("y")
+	require.NoError(t, err)
+	_, err = readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+	require.Error(t, err)
+	verr, ok := err.(entity.ValidationError)
+	require.True(t, ok, "got error %T, expected entity.ValidationError", err)
+	assert.Equal(t, "result-too-large", verr.Type)
+
+	// Under with limit
+	got, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{Limit: 2}))
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+
+	// Under: only 2 nodes have y=b
+	q, err = query.Translate("y=b")
+	require.NoError(t, err)
+	got, err = readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+}
+
+func TestStreamEntitiesArrayLabel(t *testing.T) {
+	// Test query operators on an array-valued label. The API doesn't write arrays,
+	// but MongoDB matches array elements, so the operators have "contains"
+	// semantics. See entity.Filter.
+	store := setup(t, &mock.CDCStore{})
+	_, err := coll[entityType].InsertOne(context.TODO(), bson.M{"_type": entityType, "_rev": int64(0), "x": int64(8), "tags": bson.A{"prod", "db"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		query string
+		match []int64 // x values of matching entities
+	}{
+		// Positive: match if any element matches
+		{"tags=prod", []int64{8}},
+		{"tags==db", []int64{8}},
+		{"tags in (prod)", []int64{8}},
+		{"tags in (web, db)", []int64{8}},
+		{"tags=web", []int64{}},
+		{"tags in (web)", []int64{}},
+		// Negative: match if no element matches, including entities without the label
+		{"tags!=prod", []int64{2, 4, 6}},
+		{"tags notin (prod)", []int64{2, 4, 6}},
+		{"tags notin (web, db)", []int64{2, 4, 6}},
+		{"tags!=web", []int64{2, 4, 6, 8}},
+		{"tags notin (web)", []int64{2, 4, 6, 8}},
+		// Exists: an array is a value like any other
+		{"tags", []int64{8}},
+		{"!tags", []int64{2, 4, 6}},
+	}
+	for _, tc := range tests {
+		q, err := query.Translate(tc.query)
+		require.NoError(t, err, tc.query)
+		got, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{ReturnLabels: []string{"x"}}))
+		require.NoError(t, err, tc.query)
+		x := []int64{}
+		for _, e := range got {
+			x = append(x, e["x"].(int64))
+		}
+		assert.ElementsMatch(t, tc.match, x, tc.query)
+	}
+}
+
+func TestCountGroups(t *testing.T) {
+	// 1st test node has y=a, 2nd and 3rd have y=b
+	store := setup(t, &mock.CDCStore{})
+	q, err := query.Translate("y")
+	require.NoError(t, err)
+
+	got, err := store.CountGroups(context.Background(), entityType, q, "y")
+	require.NoError(t, err)
+	expect := []etre.GroupCount{
+		{Value: "a", Count: 1},
+		{Value: "b", Count: 2},
+	}
+	assert.Equal(t, expect, got)
+
+	// Query scopes the counts
+	q, err = query.Translate("x>2")
+	require.NoError(t, err)
+	got, err = store.CountGroups(context.Background(), entityType, q, "y")
+	require.NoError(t, err)
+	assert.Equal(t, []etre.GroupCount{{Value: "b", Count: 2}}, got)
+
+	// Entities without the label are counted with nil value: only 1st node has z
+	q, err = query.Translate("y")
+	require.NoError(t, err)
+	got, err = store.CountGroups(context.Background(), entityType, q, "z")
+	require.NoError(t, err)
+	assert.Equal(t, []etre.GroupCount{{Value: nil, Count: 2}, {Value: int64(9), Count: 1}}, got)
+
+	// Max groups
+	store = entity.NewStore(coll, &mock.CDCStore{}, config.EntityConfig{
+		Types:     []string{entityType},
+		BatchSize: 5000,
+		MaxGroups: 2,
+	})
+	_, err = store.CountGroups(context.Background(), entityType, q, "x")
+	require.Error(t, err)
+	verr, ok := err.(entity.ValidationError)
+	require.True(t, ok, "got error %T, expected entity.ValidationError", err)
+	assert.Equal(t, "too-many-groups", verr.Type)
+
+	// Group by must be a label, not an expression like $$ROOT (whole entities)
+	for _, groupBy := range []string{"$$ROOT", "$x", "x.y"} {
+		_, err = store.CountGroups(context.Background(), entityType, q, groupBy)
+		require.Error(t, err, groupBy)
+		verr, ok = err.(entity.ValidationError)
+		require.True(t, ok, "got error %T, expected entity.ValidationError", err)
+		assert.Equal(t, "invalid-label", verr.Type)
+	}
+}
+
 func TestStreamEntitiesFilterReturnLabels(t *testing.T) {
 	// Test that etre.QueryFilter{ReturnLabels: []string{x}} returns only that
 	// label and not the others (y, z, bar, foo). We'll select/match by label y
@@ -265,6 +505,56 @@ func TestReadEntityFilterReturnLabels(t *testing.T) {
 	assert.Equal(t, expect, got)
 }
 
+func TestStreamEntitiesFilterAliases(t *testing.T) {
+	// Test that etre.QueryFilter.Aliases renames labels in the result: project
+	// label y and return it as letter. Query and ReturnLabels use stored labels.
+	store := setup(t, &mock.CDCStore{})
+	q, err := query.Translate("y=a")
+	require.NoError(t, err)
+
+	f := etre.QueryFilter{
+		ReturnLabels: []string{"y"},
+		Aliases:      map[string]string{"y": "letter"}, // testing this
+	}
+	got, err := readStream(store.StreamEntities(context.Background(), entityType, q, f))
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"letter": "a"}}, got)
+
+	// Distinct returns the alias, too
+	f.Distinct = true
+	q, err = query.Translate("y")
+	require.NoError(t, err)
+	got, err = readStream(store.StreamEntities(context.Background(), entityType, q, f))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []etre.Entity{{"letter": "a"}, {"letter": "b"}}, got)
+
+	// An alias that collides with an existing label replaces it: x is the value of y
+	f = etre.QueryFilter{
+		ReturnLabels: []string{"x", "y"},
+		Aliases:      map[string]string{"y": "x"},
+	}
+	got, err = readStream(store.StreamEntities(context.Background(), entityType, q, f))
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"x": "a"}, {"x": "b"}, {"x": "b"}}, got)
+
+	// Single entity and group by the stored label, returned as the alias
+	f = etre.QueryFilter{
+		ReturnLabels: []string{"x"},
+		Aliases:      map[string]string{"x": "num"},
+	}
+	e, err := store.ReadEntity(context.Background(), entityType, testNodes[0]["_id"].(bson.ObjectID).Hex(), f)
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"num": int64(2)}, e)
+
+	groups, err := store.GroupEntities(context.Background(), entityType, q, "x", f)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]etre.Entity{
+		"2": {{"num": int64(2)}},
+		"4": {{"num": int64(4)}},
+		"6": {{"num": int64(6)}},
+	}, groups)
+}
+
 func TestStreamEntitiesFilterReturnMetalabels(t *testing.T) {
 	store := setup(t, &mock.CDCStore{})
 	q, err := query.Translate("y=a")
@@ -363,6 +653,70 @@ func TestCreateEntitiesMultiple(t *testing.T) {
 	assert.Equal(t, expectEvents, gotEvents)
 }
 
+// logRecorder is a slog.Handler that records log records.
+type logRecorder struct {
+	sync.Mutex
+	records []slog.Record
+}
+
+func (h *logRecorder) Enabled(context.Context, slog.Level) bool { return true }
+func (h *logRecorder) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *logRecorder) WithGroup(string) slog.Handler            { return h }
+
+func (h *logRecorder) Handle(ctx context.Context, r slog.Record) error {
+	h.Lock()
+	defer h.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *logRecorder) attrs(i int) map[string]slog.Value {
+	h.Lock()
+	defer h.Unlock()
+	attrs := map[string]slog.Value{}
+	h.records[i].Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value
+		return true
+	})
+	return attrs
+}
+
+func TestCreateEntitiesLog(t *testing.T) {
+	// Test that writes are logged with structured attributes: at debug level
+	// if successful, else at warn level with the error
+	setup(t, &mock.CDCStore{})
+	rec := &logRecorder{}
+	store := entity.NewStore(coll, &mock.CDCStore{}, config.EntityConfig{Types: entityTypes, BatchSize: 5000}).
+		WithLogger(slog.New(rec))
+	ctx := etre.WithRequestId(context.Background(), "req-1")
+
+	ids, err := store.CreateEntities(ctx, wo, []etre.Entity{{"x": 7}})
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+
+	// Duplicate of x=2 in the test nodes (unique index on x)
+	_, err = store.CreateEntities(ctx, wo, []etre.Entity{{"x": 2}})
+	require.Error(t, err)
+
+	require.Len(t, rec.records, 2)
+
+	assert.Equal(t, slog.LevelDebug, rec.records[0].Level)
+	assert.Equal(t, "write", rec.records[0].Message)
+	attrs := rec.attrs(0)
+	assert.Equal(t, entityType, attrs["entity_type"].String())
+	assert.Equal(t, "create", attrs["op"].String())
+	assert.Equal(t, username, attrs["caller"].String())
+	assert.Equal(t, int64(1), attrs["n"].Int64())
+	assert.Equal(t, "req-1", attrs["request_id"].String())
+	assert.Equal(t, slog.KindDuration, attrs["duration"].Kind())
+
+	assert.Equal(t, slog.LevelWarn, rec.records[1].Level)
+	assert.Equal(t, "write failed", rec.records[1].Message)
+	attrs = rec.attrs(1)
+	assert.Equal(t, int64(0), attrs["n"].Int64())
+	assert.Equal(t, err.Error(), attrs["err"].String())
+}
+
 func TestCreateEntitiesMultiplePartialSuccess(t *testing.T) {
 	// Test that create handles dupes and returns partial success. The first
 	// entity here works, but the 2nd is a dupe of x=6 in the test nodes.
@@ -387,6 +741,7 @@ func TestCreateEntitiesMultiplePartialSuccess(t *testing.T) {
 	dberr, ok := err.(entity.DbError)
 	require.True(t, ok, "got error type %#v, expected entity.DbError", err)
 	assert.Equal(t, "duplicate-entity", dberr.Type)
+	assert.Equal(t, etre.Entity{"x": int32(6)}, dberr.Conflict) // unique index label and value
 	assert.Len(t, ids, 1)
 
 	// Only x=5 written/inserted, so only a CDC event for it
@@ -409,14 +764,9 @@ func TestCreateEntitiesMultiplePartialSuccess(t *testing.T) {
 	assert.Equal(t, expectEvents, gotEvents)
 }
 
-// --------------------------------------------------------------------------
-// Update
-// --------------------------------------------------------------------------
-
-func TestUpdateEntities(t *testing.T) {
-	// Test that basic update changes the correct label values. We'll change
-	// the test nodes, but setup() will restore them for other tests. Also
-	// test the CDC events correctly reflect the changes.
+func TestWriteClock(t *testing.T) {
+	// Test that writes use the injected clock for _created/_updated and CDC
+	// event timestamps, so they're deterministic
 	gotEvents := []etre.CDCEvent{}
 	cdcm := &mock.CDCStore{
 		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
@@ -424,131 +774,46 @@ func TestUpdateEntities(t *testing.T) {
 			return nil
 		},
 	}
-	store := setup(t, cdcm)
+	setup(t, cdcm)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	store := entity.NewStore(coll, cdcm, config.EntityConfig{Types: entityTypes, BatchSize: 5000}).
+		WithClock(func() time.Time { return now })
 
-	// ----------------------------------------------------------------------
-	// This matches first test node
-	q, err := query.Translate("y=a")
-	require.NoError(t, err)
-
-	patch := etre.Entity{"y": "y"} // y=a -> y=y
-	wo1 := entity.WriteOp{
-		EntityType: entityType,
-		Caller:     username,
-		SetOp:      "update-y1",
-		SetId:      "111",
-		SetSize:    1,
-	}
-	gotDiffs, err := store.UpdateEntities(context.Background(), wo1, q, patch)
+	ids, err := store.CreateEntities(context.Background(), wo, []etre.Entity{{"x": 7}})
 	require.NoError(t, err)
-	assert.Len(t, gotDiffs, 1)
-	expectDiffs := []etre.Entity{
-		{
-			"_id":      testNodes[0]["_id"],
-			"_type":    entityType,
-			"_rev":     int64(0),
-			"_updated": testNodes[0]["_updated"],
-			"y":        "a",
-		},
-	}
-	assert.Equal(t, expectDiffs, gotDiffs)
-
-	// ----------------------------------------------------------------------
-	// And this matches 2nd and 3rd test nodes
-	q, err = query.Translate("y=b")
+	require.Len(t, ids, 1)
+	require.Len(t, gotEvents, 1)
+	assert.Equal(t, now.UnixMilli(), gotEvents[0].Ts)
+	assert.Equal(t, now.UnixNano(), (*gotEvents[0].New)["_created"])
+	assert.Equal(t, now.UnixNano(), (*gotEvents[0].New)["_updated"])
+
+	// Update one second later: _updated and the event time change
+	now = now.Add(time.Second)
+	q, err := query.Translate("x=7")
 	require.NoError(t, err)
-
-	patch = etre.Entity{"y": "c"} // y=b -> y=c
-	wo2 := entity.WriteOp{
-		EntityType: entityType,
-		Caller:     username,
-		SetOp:      "update-y2",
-		SetId:      "222",
-		SetSize:    1,
-	}
-	gotDiffs, err = store.UpdateEntities(context.Background(), wo2, q, patch)
+	_, err = store.UpdateEntities(context.Background(), wo, q, etre.Entity{"y": "a"})
 	require.NoError(t, err)
-	assert.Len(t, gotDiffs, 2)
-	expectDiffs = []etre.Entity{
-		{
-			"_id":      testNodes[1]["_id"],
-			"_type":    entityType,
-			"_rev":     int64(0),
-			"_updated": testNodes[1]["_updated"],
-			"y":        "b",
-		},
-		{
-			"_id":      testNodes[2]["_id"],
-			"_type":    entityType,
-			"_rev":     int64(0),
-			"_updated": testNodes[2]["_updated"],
-			"y":        "b",
-		},
-	}
-	assert.Equal(t, expectDiffs, gotDiffs)
+	require.Len(t, gotEvents, 2)
+	assert.Equal(t, now.UnixMilli(), gotEvents[1].Ts)
+	assert.Equal(t, now.Add(-time.Second).UnixNano(), (*gotEvents[1].Old)["_updated"])
+	assert.Equal(t, now.UnixNano(), (*gotEvents[1].New)["_updated"])
+}
 
-	// ----------------------------------------------------------------------
-	// 3 CDC events because 3 entities were updated
-	for i := range gotEvents {
-		gotEvents[i].Id = ""
-		gotEvents[i].Ts = 0
-	}
-	id1, _ := testNodes[0]["_id"].(bson.ObjectID)
-	id2, _ := testNodes[1]["_id"].(bson.ObjectID)
-	id3, _ := testNodes[2]["_id"].(bson.ObjectID)
-	upd1 := (*gotEvents[0].New)["_updated"].(int64)
-	upd2 := (*gotEvents[1].New)["_updated"].(int64)
-	upd3 := (*gotEvents[2].New)["_updated"].(int64)
-	expectEvent := []etre.CDCEvent{
-		{
-			EntityId:   id1.Hex(),
-			EntityType: entityType,
-			EntityRev:  int64(1),
-			Caller:     username,
-			Op:         "u",
-			Old:        &etre.Entity{"y": "a", "_updated": testNodes[0]["_updated"]},
-			New:        &etre.Entity{"y": "y", "_updated": upd1},
-			SetId:      "111",
-			SetOp:      "update-y1",
-			SetSize:    1,
-		},
-		{
-			EntityId:   id2.Hex(),
-			EntityType: entityType,
-			EntityRev:  int64(1),
-			Caller:     username,
-			Op:         "u",
-			Old:        &etre.Entity{"y": "b", "_updated": testNodes[0]["_updated"]},
-			New:        &etre.Entity{"y": "c", "_updated": upd2},
-			SetId:      "222",
-			SetOp:      "update-y2",
-			SetSize:    1,
-		},
-		{
-			EntityId:   id3.Hex(),
-			EntityType: entityType,
-			EntityRev:  int64(1),
-			Caller:     username,
-			Op:         "u",
-			Old:        &etre.Entity{"y": "b", "_updated": testNodes[0]["_updated"]},
-			New:        &etre.Entity{"y": "c", "_updated": upd3},
-			SetId:      "222",
-			SetOp:      "update-y2",
-			SetSize:    1,
-		},
+func TestMonotonicClock(t *testing.T) {
+	// Test that the production clock never goes backwards or repeats, even when
+	// called faster than the system clock resolution
+	clock := entity.MonotonicClock()
+	last := clock()
+	for i := 0; i < 1000; i++ {
+		now := clock()
+		require.True(t, now.After(last), "%s not after %s", now, last)
+		last = now
 	}
-	assert.Equal(t, expectEvent, gotEvents)
-	assert.Greater(t, upd1, testNodes[0]["_updated"].(int64), "expected _updated to be greater than original value")
-	assert.Greater(t, upd2, testNodes[1]["_updated"].(int64), "expected _updated to be greater than original value")
-	assert.Greater(t, upd3, testNodes[2]["_updated"].(int64), "expected _updated to be greater than original value")
 }
 
-func TestUpdateEntitiesById(t *testing.T) {
-	// Test that an update by object ID works. In the test above, we look up
-	// label y and also change it: y=a -> y=y. So the store can loop over calls
-	// to FindOneAndUpdate() and the loop is self-terminating as it changes
-	// all y=a to y=y. But if we look up _id and chagne y, the loop become infinite
-	// because it'll keep finding _id.
+func TestCreateEntitiesUnordered(t *testing.T) {
+	// Same as previous test but unordered, so the 3rd entity is created
+	// even though the 2nd is a dupe.
 	gotEvents := []etre.CDCEvent{}
 	cdcm := &mock.CDCStore{
 		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
@@ -558,9 +823,684 @@ func TestUpdateEntitiesById(t *testing.T) {
 	}
 	store := setup(t, cdcm)
 
-	// ----------------------------------------------------------------------
-	// This matches first test node
-	q, _ := query.Translate("_id=" + testNodes[0]["_id"].(bson.ObjectID).Hex())
+	testData := []etre.Entity{
+		etre.Entity{"x": 5}, // ok
+		etre.Entity{"x": 6}, // dupe
+		etre.Entity{"x": 7}, // ok
+	}
+	uwo := wo // copy
+	uwo.Unordered = true
+	ids, err := store.CreateEntities(context.Background(), uwo, testData)
+	require.Error(t, err)
+	insertErrs, ok := err.(entity.InsertErrors)
+	require.True(t, ok, "got error type %#v, expected entity.InsertErrors", err)
+	require.Len(t, insertErrs, 1)
+	dberr, ok := insertErrs[1].(entity.DbError)
+	require.True(t, ok, "got error type %#v, expected entity.DbError", insertErrs[1])
+	assert.Equal(t, "duplicate-entity", dberr.Type)
+	require.Len(t, ids, 2)
+
+	// x=5 and x=7 written/inserted, so a CDC event for each
+	require.Len(t, gotEvents, 2)
+	for i, x := range []int{5, 7} {
+		id, _ := bson.ObjectIDFromHex(ids[i])
+		assert.Equal(t, id.Hex(), gotEvents[i].EntityId)
+		assert.Equal(t, "i", gotEvents[i].Op)
+		assert.Equal(t, x, (*gotEvents[i].New)["x"])
+	}
+
+	// Entities after the dupe were inserted
+	got, err := store.ReadEntity(context.Background(), entityType, ids[1], etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 7, got["x"])
+}
+
+func TestCreateEntitiesCDCWriteError(t *testing.T) {
+	// Test the documented behavior without transactions (the default): the
+	// entity is written first, so if the CDC write fails, the entity is still
+	// inserted, its id is returned, and the error is a "cdc-write" DbError for
+	// the entity. The insert process stops at the CDC error.
+	cdcErr := errors.New("cdc write failed")
+	cdcWrites := 0
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			cdcWrites++
+			return cdcErr
+		},
+	}
+	store := setup(t, cdcm)
+
+	testData := []etre.Entity{
+		etre.Entity{"x": 5}, // inserted, CDC error
+		etre.Entity{"x": 7}, // not inserted due to CDC error
+	}
+	ids, err := store.CreateEntities(context.Background(), wo, testData)
+	require.Error(t, err)
+	dberr, ok := err.(entity.DbError)
+	require.True(t, ok, "got error type %#v, expected entity.DbError", err)
+	assert.Equal(t, "cdc-write", dberr.Type)
+	assert.Equal(t, cdcErr, dberr.Err)
+	require.Len(t, ids, 1)
+	assert.Equal(t, ids[0], dberr.EntityId)
+	assert.Equal(t, 1, cdcWrites)
+
+	got, err := store.ReadEntity(context.Background(), entityType, ids[0], etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, got["x"])
+	q, _ := query.Translate("x>6") // x=7
+	gotEntities, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	assert.Empty(t, gotEntities)
+
+	// Same for unordered: the CDC error stops the insert process because an
+	// entity was inserted without a CDC event
+	uwo := wo // copy
+	uwo.Unordered = true
+	ids, err = store.CreateEntities(context.Background(), uwo, []etre.Entity{{"x": 8}, {"x": 9}})
+	require.Error(t, err)
+	_, ok = err.(entity.DbError)
+	require.True(t, ok, "got error type %#v, expected entity.DbError", err)
+	assert.Len(t, ids, 1)
+}
+
+func TestDbErrorUnwrap(t *testing.T) {
+	// Test that a DbError exposes the error labels of the MongoDB error it wraps
+	// because the driver retries a transaction only if errors.As finds the label
+	err := entity.DbError{
+		Err:  mongo.CommandError{Code: 112, Name: "WriteConflict", Labels: []string{"TransientTransactionError"}},
+		Type: "db-insert",
+	}
+	var le mongo.LabeledError
+	require.True(t, errors.As(err, &le))
+	assert.True(t, le.HasErrorLabel("TransientTransactionError"))
+}
+
+func TestCreateEntitiesTransactionRetry(t *testing.T) {
+	// Test that a transient transaction error, like a write conflict, is retried
+	// with transactions: the first insert fails with a TransientTransactionError,
+	// the driver retries the transaction, and the entity is inserted once. The
+	// fail point requires test commands and transactions (a replica set).
+	cdcWrites := 0
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			cdcWrites++
+			return nil
+		},
+	}
+	setup(t, cdcm)
+	store := entity.NewStore(coll, cdcm, config.EntityConfig{
+		Types:        []string{entityType},
+		BatchSize:    5000,
+		Transactions: true,
+	})
+	ctx := context.Background()
+	sess, err := client.StartSession()
+	require.NoError(t, err)
+	_, err = sess.WithTransaction(ctx, func(ctx context.Context) (interface{}, error) {
+		return nil, coll[entityType].FindOne(ctx, bson.M{}).Err()
+	})
+	sess.EndSession(ctx)
+	if err != nil {
+		t.Skipf("transactions not supported: %s", err)
+	}
+	err = client.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "configureFailPoint", Value: "failCommand"},
+		{Key: "mode", Value: bson.D{{Key: "times", Value: 1}}},
+		{Key: "data", Value: bson.D{
+			{Key: "failCommands", Value: bson.A{"insert"}},
+			{Key: "errorCode", Value: 112}, // WriteConflict
+			{Key: "errorLabels", Value: bson.A{"TransientTransactionError"}},
+		}},
+	}).Err()
+	if err != nil {
+		t.Skipf("cannot set fail point: %s", err)
+	}
+
+	ids, err := store.CreateEntities(ctx, wo, []etre.Entity{{"x": 8}})
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+	assert.Equal(t, 1, cdcWrites) // first try failed before its CDC write
+
+	q, err := query.Translate("x=8")
+	require.NoError(t, err)
+	got, err := readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+}
+
+func TestCreateEntitiesTransactionConcurrent(t *testing.T) {
+	// Test that concurrent inserts with transactions all succeed with the real
+	// CDC store: every CDC write increments the same sequence number counter, so
+	// concurrent transactions conflict on it (WriteConflict) and the driver
+	// retries them. Every entity has one CDC event, and sequence numbers are
+	// unique. Like TestCreateEntitiesTransactionRetry, this requires a replica set.
+	setup(t, &mock.CDCStore{})
+	ctx := context.Background()
+	sess, err := client.StartSession()
+	require.NoError(t, err)
+	_, err = sess.WithTransaction(ctx, func(ctx context.Context) (interface{}, error) {
+		return nil, coll[entityType].FindOne(ctx, bson.M{}).Err()
+	})
+	sess.EndSession(ctx)
+	if err != nil {
+		t.Skipf("transactions not supported: %s", err)
+	}
+
+	// CDC collection on the same client because a transaction cannot span clients
+	cdcOpts := options.Collection().SetBSONOptions(&options.BSONOptions{ObjectIDAsHexString: true})
+	cdcColl := coll[entityType].Database().Collection("cdc", cdcOpts)
+	_, err = cdcColl.DeleteMany(ctx, bson.D{})
+	require.NoError(t, err)
+	cdcs := cdc.NewStore(cdcColl, "", cdc.NoRetryPolicy)
+	store := entity.NewStore(coll, cdcs, config.EntityConfig{
+		Types:        []string{entityType},
+		BatchSize:    5000,
+		Transactions: true,
+	})
+
+	writers := 4
+	n := 5
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			entities := make([]etre.Entity, n)
+			for i := range entities {
+				entities[i] = etre.Entity{"x": 100 + w*n + i}
+			}
+			if _, err := store.CreateEntities(ctx, wo, entities); err != nil {
+				errs <- err
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	q, err := query.Translate("x>=100")
+	require.NoError(t, err)
+	got, err := readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	assert.Len(t, got, writers*n)
+
+	events, err := cdcs.Read(cdc.Filter{SinceTs: 1, Order: cdc.BySeqAsc{}})
+	require.NoError(t, err)
+	require.Len(t, events, writers*n)
+	seen := map[string]bool{}
+	for i, e := range events {
+		if i > 0 {
+			assert.Greater(t, e.Seq, events[i-1].Seq, "event %d", i)
+		}
+		assert.False(t, seen[e.EntityId], "entity %s has more than one CDC event", e.EntityId)
+		seen[e.EntityId] = true
+	}
+}
+
+func TestCreateEntitiesIdStrategy(t *testing.T) {
+	// Test each config.EntityConfig.Id strategy: the new ids are unique, the
+	// stored _id has the expected type, and reads and queries by id work.
+	setup(t, &mock.CDCStore{})
+	strategies := []config.IdConfig{
+		{Strategy: config.ID_STRATEGY_OBJECTID},
+		{Strategy: config.ID_STRATEGY_UUID},
+		{Strategy: config.ID_STRATEGY_HASH, Labels: []string{"x"}},
+	}
+	for _, idCfg := range strategies {
+		t.Run(idCfg.Strategy, func(t *testing.T) {
+			setup(t, &mock.CDCStore{})
+			store := entity.NewStore(coll, &mock.CDCStore{}, config.EntityConfig{
+				Types:     []string{entityType},
+				BatchSize: 5000,
+				Id:        map[string]config.IdConfig{entityType: idCfg},
+			})
+
+			testData := []etre.Entity{{"x": 7}, {"x": 8}}
+			ids, err := store.CreateEntities(context.Background(), wo, testData)
+			require.NoError(t, err)
+			require.Len(t, ids, 2)
+			assert.NotEqual(t, ids[0], ids[1])
+
+			switch idCfg.Strategy {
+			case config.ID_STRATEGY_OBJECTID:
+				assert.IsType(t, bson.ObjectID{}, testData[0]["_id"])
+			default:
+				assert.IsType(t, "", testData[0]["_id"])
+			}
+
+			got, err := store.ReadEntity(context.Background(), entityType, ids[1], etre.QueryFilter{})
+			require.NoError(t, err)
+			require.NotNil(t, got)
+			assert.Equal(t, ids[1], entity.IdString(got["_id"]))
+			assert.EqualValues(t, 8, got["x"])
+
+			q, err := query.Translate("_id in (" + ids[0] + "," + ids[1] + ")")
+			require.NoError(t, err)
+			gotAll, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+			require.NoError(t, err)
+			assert.Len(t, gotAll, 2)
+
+			wo := wo // copy
+			wo.EntityId = ids[0]
+			q, err = query.Translate("_id=" + ids[0])
+			require.NoError(t, err)
+			diffs, err := store.UpdateEntities(context.Background(), wo, q, etre.Entity{"y": "c"})
+			require.NoError(t, err)
+			require.Len(t, diffs, 1)
+			assert.Equal(t, ids[0], entity.IdString(diffs[0]["_id"]))
+		})
+	}
+}
+
+func TestCreateEntitiesIdStrategyHash(t *testing.T) {
+	// Hash ids are content-addressable: same natural-key values = same _id,
+	// so the second insert is a duplicate. The natural-key label is required.
+	setup(t, &mock.CDCStore{})
+	store := entity.NewStore(coll, &mock.CDCStore{}, config.EntityConfig{
+		Types:     []string{entityType},
+		BatchSize: 5000,
+		Id: map[string]config.IdConfig{
+			entityType: {Strategy: config.ID_STRATEGY_HASH, Labels: []string{"y", "z"}},
+		},
+	})
+
+	ids, err := store.CreateEntities(context.Background(), wo, []etre.Entity{{"x": 7, "y": "c", "z": 1}})
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+	assert.Len(t, ids[0], 64) // hex SHA-256
+
+	_, err = store.CreateEntities(context.Background(), wo, []etre.Entity{{"x": 8, "y": "c", "z": 1}})
+	require.Error(t, err)
+	dberr, ok := err.(entity.DbError)
+	require.True(t, ok, "got error type %#v, expected entity.DbError", err)
+	assert.Equal(t, "duplicate-entity", dberr.Type)
+
+	// Same value as a string is a different entity: the value type is hashed, too
+	ids2, err := store.CreateEntities(context.Background(), wo, []etre.Entity{{"x": 8, "y": "c", "z": "1"}})
+	require.NoError(t, err)
+	require.Len(t, ids2, 1)
+	assert.NotEqual(t, ids[0], ids2[0])
+
+	_, err = store.CreateEntities(context.Background(), wo, []etre.Entity{{"x": 9, "y": "c"}})
+	require.Error(t, err)
+	verr, ok := err.(entity.ValidationError)
+	require.True(t, ok, "got error type %#v, expected entity.ValidationError", err)
+	assert.Equal(t, "missing-id-label", verr.Type)
+}
+
+func TestCreateEntitiesIdStrategyLabel(t *testing.T) {
+	// Natural-key ids: _id is the value of the uuid label, lowercase because the
+	// id format is uuid. Reads and writes by id work with the string _id.
+	setup(t, &mock.CDCStore{})
+	store := entity.NewStore(coll, &mock.CDCStore{}, config.EntityConfig{
+		Types:     []string{entityType},
+		BatchSize: 5000,
+		Id: map[string]config.IdConfig{
+			entityType: {Strategy: config.ID_STRATEGY_LABEL, Labels: []string{"uuid"}, Format: config.ID_FORMAT_UUID},
+		},
+	})
+	ctx := context.Background()
+
+	id := "6f9619ff-8b86-d011-b42d-00c04fc964ff"
+	ids, err := store.CreateEntities(ctx, wo, []etre.Entity{{"x": 7, "uuid": "6F9619FF-8B86-D011-B42D-00C04FC964FF"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{id}, ids)
+
+	got, err := store.ReadEntity(ctx, entityType, id, etre.QueryFilter{ReturnLabels: []string{"_id", "uuid"}})
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"_id": id, "uuid": "6F9619FF-8B86-D011-B42D-00C04FC964FF"}, got)
+
+	gotAll, err := store.ReadEntitiesByIds(ctx, entityType, []string{id}, etre.QueryFilter{ReturnLabels: []string{"_id"}})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"_id": id}}, gotAll)
+
+	wo := wo // copy
+	wo.EntityId = id
+	diffs, err := store.UpdateEntities(ctx, wo, query.ById(id), etre.Entity{"y": "c"})
+	require.NoError(t, err)
+	require.Len(t, diffs, 1)
+	assert.Equal(t, id, diffs[0]["_id"])
+
+	diff, err := store.DeleteLabel(ctx, wo, "y")
+	require.NoError(t, err)
+	assert.Equal(t, "c", diff["y"])
+
+	// Same natural key is a duplicate
+	_, err = store.CreateEntities(ctx, wo, []etre.Entity{{"x": 8, "uuid": id}})
+	require.Error(t, err)
+	dberr, ok := err.(entity.DbError)
+	require.True(t, ok, "got error type %#v, expected entity.DbError", err)
+	assert.Equal(t, "duplicate-entity", dberr.Type)
+
+	// Natural-key label is required, and must be a valid UUID
+	for _, e := range []etre.Entity{{"x": 9}, {"x": 9, "uuid": 1}, {"x": 9, "uuid": "6f9619ff"}} {
+		_, err = store.CreateEntities(ctx, wo, []etre.Entity{e})
+		require.Error(t, err)
+		verr, ok := err.(entity.ValidationError)
+		require.True(t, ok, "got error type %#v, expected entity.ValidationError", err)
+		assert.Contains(t, []string{"missing-id-label", "invalid-id"}, verr.Type)
+	}
+}
+
+func TestCreateEntitiesIdStrategyLabelString(t *testing.T) {
+	// A natural-key id that looks like an ObjectID is a string, and an id with
+	// query characters is not parsed as a query
+	setup(t, &mock.CDCStore{})
+	store := entity.NewStore(coll, &mock.CDCStore{}, config.EntityConfig{
+		Types:     []string{entityType},
+		BatchSize: 5000,
+		Id: map[string]config.IdConfig{
+			entityType: {Strategy: config.ID_STRATEGY_LABEL, Labels: []string{"name"}},
+		},
+	})
+	ctx := context.Background()
+
+	names := []string{"507f1f77bcf86cd799439011", `us-east, rack "1"`}
+	ids, err := store.CreateEntities(ctx, wo, []etre.Entity{{"x": 7, "name": names[0]}, {"x": 8, "name": names[1]}})
+	require.NoError(t, err)
+	assert.Equal(t, names, ids)
+
+	for _, id := range names {
+		got, err := store.ReadEntity(ctx, entityType, id, etre.QueryFilter{ReturnLabels: []string{"_id"}})
+		require.NoError(t, err)
+		assert.Equal(t, etre.Entity{"_id": id}, got)
+	}
+}
+
+func TestParseId(t *testing.T) {
+	valid := []struct {
+		format string
+		id     string
+		expect string
+	}{
+		{config.ID_FORMAT_OBJECTID, "507F1F77BCF86CD799439011", "507f1f77bcf86cd799439011"},
+		{config.ID_FORMAT_UUID, "6F9619FF-8B86-D011-B42D-00C04FC964FF", "6f9619ff-8b86-d011-b42d-00c04fc964ff"},
+		{config.ID_FORMAT_STRING, "Any string, with spaces", "Any string, with spaces"},
+	}
+	for _, tc := range valid {
+		got, err := entity.ParseId(tc.format, tc.id)
+		require.NoError(t, err, tc.id)
+		assert.Equal(t, tc.expect, got)
+	}
+
+	invalid := []struct {
+		format string
+		id     string
+	}{
+		{config.ID_FORMAT_OBJECTID, "foo"},
+		{config.ID_FORMAT_OBJECTID, "6f9619ff-8b86-d011-b42d-00c04fc964ff"},
+		{config.ID_FORMAT_UUID, "507f1f77bcf86cd799439011"},
+		{config.ID_FORMAT_UUID, "6f9619ff-8b86-d011-b42d_00c04fc964ff"},
+		{config.ID_FORMAT_UUID, "6f9619ff-8b86-d011-b42d-00c04fc964fg"},
+		{config.ID_FORMAT_STRING, ""},
+	}
+	for _, tc := range invalid {
+		_, err := entity.ParseId(tc.format, tc.id)
+		assert.Error(t, err, tc.id)
+	}
+}
+
+func TestCreateEntityIfNotExists(t *testing.T) {
+	// Test the insert branch: no entity matches query y=c, so the entity is
+	// created with the query label, and one CDC insert event is written.
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	q, err := query.Translate("y=c")
+	require.NoError(t, err)
+	newEntity := etre.Entity{"x": 7, "y": "c"}
+	got, created, err := store.CreateEntityIfNotExists(context.Background(), wo, q, newEntity)
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, etre.Entity{"x": 7, "y": "c"}, newEntity) // caller's entity not modified
+	require.NotNil(t, got)
+	assert.IsType(t, bson.ObjectID{}, got["_id"])
+	assert.Equal(t, "c", got["y"])
+	assert.EqualValues(t, 7, got["x"])
+	assert.Equal(t, int64(0), got["_rev"])
+
+	require.Len(t, gotEvents, 1)
+	assert.Equal(t, "i", gotEvents[0].Op)
+	assert.Equal(t, entity.IdString(got["_id"]), gotEvents[0].EntityId)
+
+	// Same call again matches the entity just created: nothing written
+	got2, created, err := store.CreateEntityIfNotExists(context.Background(), wo, q, etre.Entity{"x": 7, "y": "c"})
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, got["_id"], got2["_id"])
+	assert.Len(t, gotEvents, 1)
+}
+
+func TestCreateEntityIfNotExistsExisting(t *testing.T) {
+	// Test the already-exists branch: query y=a matches testNodes[0], so it's
+	// returned as-is, nothing is inserted, and no CDC event is written.
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			t.Errorf("unexpected CDC event: %+v", e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	q, err := query.Translate("y=a")
+	require.NoError(t, err)
+	got, created, err := store.CreateEntityIfNotExists(context.Background(), wo, q, etre.Entity{"x": 8})
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, testNodes[0]["_id"], got["_id"])
+	assert.Equal(t, int64(2), got["x"])
+
+	all, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+
+	// Entity label that conflicts with query equality predicate is an error
+	_, _, err = store.CreateEntityIfNotExists(context.Background(), wo, q, etre.Entity{"y": "b"})
+	require.Error(t, err)
+	assert.IsType(t, entity.ValidationError{}, err)
+}
+
+// --------------------------------------------------------------------------
+// Update
+// --------------------------------------------------------------------------
+
+func TestUpdateEntities(t *testing.T) {
+	// Test that basic update changes the correct label values. We'll change
+	// the test nodes, but setup() will restore them for other tests. Also
+	// test the CDC events correctly reflect the changes.
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	// ----------------------------------------------------------------------
+	// This matches first test node
+	q, err := query.Translate("y=a")
+	require.NoError(t, err)
+
+	patch := etre.Entity{"y": "y"} // y=a -> y=y
+	wo1 := entity.WriteOp{
+		EntityType: entityType,
+		Caller:     username,
+		SetOp:      "update-y1",
+		SetId:      "111",
+		SetSize:    1,
+	}
+	gotDiffs, err := store.UpdateEntities(context.Background(), wo1, q, patch)
+	require.NoError(t, err)
+	assert.Len(t, gotDiffs, 1)
+	expectDiffs := []etre.Entity{
+		{
+			"_id":      testNodes[0]["_id"],
+			"_type":    entityType,
+			"_rev":     int64(0),
+			"_updated": testNodes[0]["_updated"],
+			"y":        "a",
+		},
+	}
+	assert.Equal(t, expectDiffs, gotDiffs)
+
+	// ----------------------------------------------------------------------
+	// And this matches 2nd and 3rd test nodes
+	q, err = query.Translate("y=b")
+	require.NoError(t, err)
+
+	patch = etre.Entity{"y": "c"} // y=b -> y=c
+	wo2 := entity.WriteOp{
+		EntityType: entityType,
+		Caller:     username,
+		SetOp:      "update-y2",
+		SetId:      "222",
+		SetSize:    1,
+	}
+	gotDiffs, err = store.UpdateEntities(context.Background(), wo2, q, patch)
+	require.NoError(t, err)
+	assert.Len(t, gotDiffs, 2)
+	expectDiffs = []etre.Entity{
+		{
+			"_id":      testNodes[1]["_id"],
+			"_type":    entityType,
+			"_rev":     int64(0),
+			"_updated": testNodes[1]["_updated"],
+			"y":        "b",
+		},
+		{
+			"_id":      testNodes[2]["_id"],
+			"_type":    entityType,
+			"_rev":     int64(0),
+			"_updated": testNodes[2]["_updated"],
+			"y":        "b",
+		},
+	}
+	assert.Equal(t, expectDiffs, gotDiffs)
+
+	// ----------------------------------------------------------------------
+	// 3 CDC events because 3 entities were updated
+	for i := range gotEvents {
+		gotEvents[i].Id = ""
+		gotEvents[i].Ts = 0
+	}
+	id1, _ := testNodes[0]["_id"].(bson.ObjectID)
+	id2, _ := testNodes[1]["_id"].(bson.ObjectID)
+	id3, _ := testNodes[2]["_id"].(bson.ObjectID)
+	upd1 := (*gotEvents[0].New)["_updated"].(int64)
+	upd2 := (*gotEvents[1].New)["_updated"].(int64)
+	upd3 := (*gotEvents[2].New)["_updated"].(int64)
+	expectEvent := []etre.CDCEvent{
+		{
+			EntityId:   id1.Hex(),
+			EntityType: entityType,
+			EntityRev:  int64(1),
+			Caller:     username,
+			Op:         "u",
+			Old:        &etre.Entity{"y": "a", "_updated": testNodes[0]["_updated"]},
+			New:        &etre.Entity{"y": "y", "_updated": upd1},
+			SetId:      "111",
+			SetOp:      "update-y1",
+			SetSize:    1,
+		},
+		{
+			EntityId:   id2.Hex(),
+			EntityType: entityType,
+			EntityRev:  int64(1),
+			Caller:     username,
+			Op:         "u",
+			Old:        &etre.Entity{"y": "b", "_updated": testNodes[0]["_updated"]},
+			New:        &etre.Entity{"y": "c", "_updated": upd2},
+			SetId:      "222",
+			SetOp:      "update-y2",
+			SetSize:    1,
+		},
+		{
+			EntityId:   id3.Hex(),
+			EntityType: entityType,
+			EntityRev:  int64(1),
+			Caller:     username,
+			Op:         "u",
+			Old:        &etre.Entity{"y": "b", "_updated": testNodes[0]["_updated"]},
+			New:        &etre.Entity{"y": "c", "_updated": upd3},
+			SetId:      "222",
+			SetOp:      "update-y2",
+			SetSize:    1,
+		},
+	}
+	assert.Equal(t, expectEvent, gotEvents)
+	assert.Greater(t, upd1, testNodes[0]["_updated"].(int64), "expected _updated to be greater than original value")
+	assert.Greater(t, upd2, testNodes[1]["_updated"].(int64), "expected _updated to be greater than original value")
+	assert.Greater(t, upd3, testNodes[2]["_updated"].(int64), "expected _updated to be greater than original value")
+}
+
+func TestUpdateEntitiesMaxLabels(t *testing.T) {
+	// Test that config.entity.max_labels applies to the entity after the update,
+	// not only the patch: two patches within the limit cannot add more labels
+	// than the limit. First test node has 4 labels: x, y, z, and foo.
+	setup(t, &mock.CDCStore{})
+	store := entity.NewStore(coll, &mock.CDCStore{}, config.EntityConfig{
+		Types:     []string{entityType},
+		BatchSize: 5000,
+		MaxLabels: 5,
+	})
+	ctx := context.Background()
+	q, err := query.Translate("y=a")
+	require.NoError(t, err)
+
+	diffs, err := store.UpdateEntities(ctx, wo, q, etre.Entity{"a": "1"})
+	require.NoError(t, err)
+	require.Len(t, diffs, 1)
+
+	diffs, err = store.UpdateEntities(ctx, wo, q, etre.Entity{"b": "1"})
+	require.Error(t, err)
+	verr, ok := err.(entity.ValidationError)
+	require.True(t, ok, "got %T, expected entity.ValidationError", err)
+	assert.Equal(t, "entity-too-large", verr.Type)
+	assert.Empty(t, diffs)
+
+	// Changing existing labels and replacing a label are allowed at the limit
+	diffs, err = store.UpdateEntities(ctx, wo, q, etre.Entity{"a": "2", "z": int64(1)})
+	require.NoError(t, err)
+	require.Len(t, diffs, 1)
+	diffs, err = store.UpdateEntities(ctx, wo, q, etre.Entity{"b": "1", entity.PATCH_UNSET: []string{"a"}})
+	require.NoError(t, err)
+	require.Len(t, diffs, 1)
+
+	got, err := readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, "1", got[0]["b"])
+	assert.NotContains(t, got[0], "a")
+}
+
+func TestUpdateEntitiesById(t *testing.T) {
+	// Test that an update by object ID works. In the test above, we look up
+	// label y and also change it: y=a -> y=y. So the store can loop over calls
+	// to FindOneAndUpdate() and the loop is self-terminating as it changes
+	// all y=a to y=y. But if we look up _id and chagne y, the loop become infinite
+	// because it'll keep finding _id.
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	// ----------------------------------------------------------------------
+	// This matches first test node
+	q, _ := query.Translate("_id=" + testNodes[0]["_id"].(bson.ObjectID).Hex())
 	patch := etre.Entity{"y": "y"} // y=a -> y=y
 	wo1 := entity.WriteOp{
 		EntityType: entityType,
@@ -665,14 +1605,250 @@ func TestUpdateEntitiesById(t *testing.T) {
 			SetSize:    1,
 		},
 	}
-	assert.Greater(t, upd1, testNodes[0]["_updated"].(int64), "expected _updated to increase after update")
-	assert.Greater(t, upd2, testNodes[1]["_updated"].(int64), "expected _updated to increase after update")
-	assert.Greater(t, upd3, testNodes[2]["_updated"].(int64), "expected _updated to increase after update")
-	assert.Equal(t, expectEvent, gotEvents)
+	assert.Greater(t, upd1, testNodes[0]["_updated"].(int64), "expected _updated to increase after update")
+	assert.Greater(t, upd2, testNodes[1]["_updated"].(int64), "expected _updated to increase after update")
+	assert.Greater(t, upd3, testNodes[2]["_updated"].(int64), "expected _updated to increase after update")
+	assert.Equal(t, expectEvent, gotEvents)
+}
+
+func TestUpdateEntitiesDuplicate(t *testing.T) {
+	// Test that dupes are handled on update. There's a uniqe index on x.
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	// This matches first test node
+	q, err := query.Translate("y=a")
+	require.NoError(t, err)
+
+	patch := etre.Entity{"x": 6} // x=2 -> x=6 conflicts with 3rd test node
+	wo1 := entity.WriteOp{
+		EntityType: entityType,
+		Caller:     username,
+	}
+	gotDiffs, err := store.UpdateEntities(context.Background(), wo1, q, patch)
+	require.Error(t, err)
+	dberr, ok := err.(entity.DbError)
+	require.True(t, ok, "got error type %#v, expected entity.DbError", err)
+	assert.Equal(t, "duplicate-entity", dberr.Type)
+	assert.Equal(t, etre.Entity{"x": int32(6)}, dberr.Conflict) // unique index label and value
+	assert.Empty(t, gotDiffs)
+	assert.Empty(t, gotEvents)
+}
+
+func TestUpdateEntitiesUnordered(t *testing.T) {
+	// Test that an unordered update continues past an entity that conflicts on
+	// the unique index on x: the other matching entities are still updated, and
+	// the conflicting entity is returned in UpdateErrors
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	// x=4 -> x=5 on 2nd test node conflicts with this entity
+	_, err := coll[entityType].InsertOne(context.Background(), etre.Entity{"_type": entityType, "_rev": int64(0), "x": int64(5), "y": "c"})
+	require.NoError(t, err)
+
+	// Matches all test nodes
+	q, err := query.Translate("y in (a,b)")
+	require.NoError(t, err)
+	patch := etre.Entity{entity.PATCH_INC: map[string]interface{}{"x": 1}}
+	wo1 := entity.WriteOp{
+		EntityType: entityType,
+		Caller:     username,
+		Unordered:  true,
+	}
+	gotDiffs, err := store.UpdateEntities(context.Background(), wo1, q, patch)
+	require.Error(t, err)
+	updateErrs, ok := err.(entity.UpdateErrors)
+	require.True(t, ok, "got error type %#v, expected entity.UpdateErrors", err)
+
+	id2 := testNodes[1]["_id"].(bson.ObjectID)
+	require.Len(t, updateErrs, 1)
+	dberr, ok := updateErrs[id2.Hex()].(entity.DbError)
+	require.True(t, ok, "got error %#v for 2nd test node, expected entity.DbError", updateErrs)
+	assert.Equal(t, "duplicate-entity", dberr.Type)
+
+	require.Len(t, gotDiffs, 2)
+	assert.Equal(t, testNodes[0]["_id"], gotDiffs[0]["_id"])
+	assert.Equal(t, int64(2), gotDiffs[0]["x"])
+	assert.Equal(t, testNodes[2]["_id"], gotDiffs[1]["_id"])
+	assert.Equal(t, int64(6), gotDiffs[1]["x"])
+	assert.Len(t, gotEvents, 2)
+
+	// The rest were updated
+	all, err := query.Translate("x")
+	require.NoError(t, err)
+	got, err := readStream(store.StreamEntities(context.Background(), entityType, all, etre.QueryFilter{ReturnLabels: []string{"x"}}))
+	require.NoError(t, err)
+	gotX := []interface{}{}
+	for _, e := range got {
+		gotX = append(gotX, e["x"])
+	}
+	assert.ElementsMatch(t, []interface{}{int64(3), int64(4), int64(5), int64(7)}, gotX)
+}
+
+func TestUpdateEntitiesPatchNotQueryLabel(t *testing.T) {
+	// Test that a patch which doesn't change the queried label updates each
+	// matching entity exactly once. The query keeps matching the updated
+	// entities, so the loop must not update any entity twice or run forever.
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	// Matches 2nd and 3rd test nodes before and after the update
+	q, err := query.Translate("y=b")
+	require.NoError(t, err)
+	gotDiffs, err := store.UpdateEntities(context.Background(), wo, q, etre.Entity{"z": int64(1)})
+	require.NoError(t, err)
+	require.Len(t, gotDiffs, 2)
+	require.Len(t, gotEvents, 2)
+	gotIds := []string{gotEvents[0].EntityId, gotEvents[1].EntityId}
+	assert.ElementsMatch(t, []string{
+		testNodes[1]["_id"].(bson.ObjectID).Hex(),
+		testNodes[2]["_id"].(bson.ObjectID).Hex(),
+	}, gotIds)
+
+	// Each updated once: _rev 0 -> 1
+	got, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	for _, e := range got {
+		assert.Equal(t, int64(1), e["_rev"])
+		assert.Equal(t, int64(1), e["z"])
+	}
+}
+
+func TestUpdateEntitiesNestedPatch(t *testing.T) {
+	// Test that a patch from JSON Patch ops sets and removes nested fields of
+	// an object label, and the CDC event has the whole label before and after
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	// Object labels can't be created through the API, so set one directly
+	id := testNodes[0]["_id"].(bson.ObjectID)
+	_, err := coll[entityType].UpdateOne(context.TODO(),
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"config": bson.D{{Key: "port", Value: int64(80)}, {Key: "debug", Value: true}}}},
+	)
+	require.NoError(t, err)
+
+	patch, err := entity.JSONPatch([]etre.JSONPatchOp{
+		{Op: "replace", Path: "/config/port", Value: int64(8080)},
+		{Op: "remove", Path: "/config/debug"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE))
+
+	q, err := query.Translate("_id=" + id.Hex())
+	require.NoError(t, err)
+	gotDiffs, err := store.UpdateEntities(context.Background(), wo, q, patch)
+	require.NoError(t, err)
+	require.Len(t, gotDiffs, 1)
+	assert.Equal(t, bson.D{{Key: "port", Value: int64(80)}, {Key: "debug", Value: true}}, gotDiffs[0]["config"])
+
+	got, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, bson.D{{Key: "port", Value: int64(8080)}}, got[0]["config"])
+	assert.Equal(t, int64(1), got[0]["_rev"])
+
+	require.Len(t, gotEvents, 1)
+	assert.Equal(t, "u", gotEvents[0].Op)
+	assert.Equal(t, bson.D{{Key: "port", Value: int64(80)}, {Key: "debug", Value: true}}, (*gotEvents[0].Old)["config"])
+	assert.Equal(t, map[string]interface{}{"port": int64(8080)}, (*gotEvents[0].New)["config"])
+	_, ok := (*gotEvents[0].New)[entity.PATCH_UNSET]
+	assert.False(t, ok, "patch directive in CDC new entity")
+}
+
+func TestUpdateEntitiesInc(t *testing.T) {
+	// Test that PATCH_INC increments atomically: concurrent increments of the
+	// same label are not lost, and each CDC event has the old and new values
+	var mux sync.Mutex
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			mux.Lock()
+			gotEvents = append(gotEvents, e)
+			mux.Unlock()
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	// Matches 1st test node, which has z=9
+	q, err := query.Translate("x=2")
+	require.NoError(t, err)
+
+	n := 20
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			patch := etre.Entity{entity.PATCH_INC: map[string]interface{}{"z": 1}}
+			_, err := store.UpdateEntities(context.Background(), wo, q, patch)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	got, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, int64(9+n), got[0]["z"])
+	assert.Equal(t, int64(n), got[0]["_rev"])
+
+	// Each event is one increment, and all together are every value from 9 to 9+n
+	require.Len(t, gotEvents, n)
+	gotOld := []int{}
+	for _, e := range gotEvents {
+		old := (*e.Old)["z"].(int64)
+		assert.Equal(t, old+1, (*e.New)["z"])
+		gotOld = append(gotOld, int(old))
+	}
+	sort.Ints(gotOld)
+	for i := range gotOld {
+		assert.Equal(t, 9+i, gotOld[i])
+	}
+
+	// Cannot increment a label that is not a number
+	patch := etre.Entity{entity.PATCH_INC: map[string]interface{}{"y": 1}}
+	_, err = store.UpdateEntities(context.Background(), wo, q, patch)
+	var ve entity.ValidationError
+	require.ErrorAs(t, err, &ve)
+	assert.Equal(t, "invalid-patch-target", ve.Type)
 }
 
-func TestUpdateEntitiesDuplicate(t *testing.T) {
-	// Test that dupes are handled on update. There's a uniqe index on x.
+func TestUpdateEntitiesAutoSetSize(t *testing.T) {
+	// Test that a bulk update with a SetId but no SetSize (the API sets a
+	// server-generated SetId for bulk writes without a set) writes CDC events
+	// that share the SetId with SetSize equal to the number of entities written
 	gotEvents := []etre.CDCEvent{}
 	cdcm := &mock.CDCStore{
 		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
@@ -682,21 +1858,98 @@ func TestUpdateEntitiesDuplicate(t *testing.T) {
 	}
 	store := setup(t, cdcm)
 
-	// This matches first test node
-	q, err := query.Translate("y=a")
+	// Matches 2nd and 3rd test nodes
+	q, err := query.Translate("y=b")
 	require.NoError(t, err)
+	swo := wo // copy
+	swo.SetOp = "update"
+	swo.SetId = "auto-set-id"
+	gotDiffs, err := store.UpdateEntities(context.Background(), swo, q, etre.Entity{"y": "c"})
+	require.NoError(t, err)
+	require.Len(t, gotDiffs, 2)
 
-	patch := etre.Entity{"x": 6} // x=2 -> x=6 conflicts with 3rd test node
-	wo1 := entity.WriteOp{
-		EntityType: entityType,
-		Caller:     username,
+	require.Len(t, gotEvents, 2)
+	for _, event := range gotEvents {
+		assert.Equal(t, "update", event.SetOp)
+		assert.Equal(t, "auto-set-id", event.SetId)
+		assert.Equal(t, len(gotDiffs), event.SetSize)
+	}
+}
+
+func TestUpdateEntitiesUpsert(t *testing.T) {
+	// Test that an upsert inserts a new entity made from the query and patch
+	// (CDC op "i") if no entity matches, else it updates (CDC op "u").
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+	uwo := wo // copy
+	uwo.Upsert = true
+
+	// No match: insert
+	q, err := query.Translate("x=8")
+	require.NoError(t, err)
+	gotDiffs, err := store.UpdateEntities(context.Background(), uwo, q, etre.Entity{"y": "c"})
+	require.NoError(t, err)
+	require.Len(t, gotDiffs, 1)
+	id := entity.IdString(gotDiffs[0]["_id"])
+	require.NotEmpty(t, id)
+	assert.Equal(t, etre.Entity{"_id": gotDiffs[0]["_id"]}, gotDiffs[0])
+
+	require.Len(t, gotEvents, 1)
+	assert.Equal(t, "i", gotEvents[0].Op)
+	assert.Equal(t, id, gotEvents[0].EntityId)
+	assert.Equal(t, int64(0), gotEvents[0].EntityRev)
+	assert.Nil(t, gotEvents[0].Old)
+	require.NotNil(t, gotEvents[0].New)
+	assert.Equal(t, "8", (*gotEvents[0].New)["x"])
+	assert.Equal(t, "c", (*gotEvents[0].New)["y"])
+
+	got, err := store.ReadEntity(context.Background(), entityType, id, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "8", got["x"])
+	assert.Equal(t, "c", got["y"])
+
+	// Match: update the entity inserted above
+	gotEvents = []etre.CDCEvent{}
+	gotDiffs, err = store.UpdateEntities(context.Background(), uwo, q, etre.Entity{"y": "d"})
+	require.NoError(t, err)
+	require.Len(t, gotDiffs, 1)
+	assert.Equal(t, "c", gotDiffs[0]["y"]) // previous value
+	require.Len(t, gotEvents, 1)
+	assert.Equal(t, "u", gotEvents[0].Op)
+	assert.Equal(t, id, gotEvents[0].EntityId)
+	assert.Equal(t, int64(1), gotEvents[0].EntityRev)
+}
+
+func TestUpdateEntitiesUpsertInvalidQuery(t *testing.T) {
+	// Test that an upsert query must be only label=value because the new
+	// entity is made from it
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+	uwo := wo // copy
+	uwo.Upsert = true
+
+	for _, qs := range []string{"x>100", "y in (a,b)", "!y", "x=100 ^ x=101", "_id=abc"} {
+		q, err := query.TranslateVersion(qs, query.LATEST_VERSION)
+		require.NoError(t, err, qs)
+		gotDiffs, err := store.UpdateEntities(context.Background(), uwo, q, etre.Entity{"z": 1})
+		require.Error(t, err, qs)
+		verr, ok := err.(entity.ValidationError)
+		require.True(t, ok, "got error type %#v, expected entity.ValidationError", err)
+		assert.Equal(t, "invalid-upsert-query", verr.Type, qs)
+		assert.Empty(t, gotDiffs, qs)
 	}
-	gotDiffs, err := store.UpdateEntities(context.Background(), wo1, q, patch)
-	require.Error(t, err)
-	dberr, ok := err.(entity.DbError)
-	require.True(t, ok, "got error type %#v, expected entity.DbError", err)
-	assert.Equal(t, "duplicate-entity", dberr.Type)
-	assert.Empty(t, gotDiffs)
 	assert.Empty(t, gotEvents)
 }
 
@@ -770,6 +2023,227 @@ func TestDeleteEntities(t *testing.T) {
 // Delete Label
 // --------------------------------------------------------------------------
 
+func TestDeleteEntitiesSoftDelete(t *testing.T) {
+	// Test that soft delete sets _deleted instead of removing the entity, writes
+	// a CDC delete event, and hides the entity unless IncludeDeleted is set
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	setup(t, cdcm)
+	store := entity.NewStore(coll, cdcm, config.EntityConfig{
+		Types:      []string{entityType},
+		BatchSize:  5000,
+		SoftDelete: true,
+	})
+	ctx := context.Background()
+	id := testNodes[0]["_id"].(bson.ObjectID)
+
+	// Match first test node
+	q, err := query.Translate("y=a")
+	require.NoError(t, err)
+	deleted, err := store.DeleteEntities(ctx, wo, q)
+	require.NoError(t, err)
+	require.Len(t, deleted, 1)
+	assert.Equal(t, id, deleted[0]["_id"])
+	assert.NotContains(t, deleted[0], "_deleted") // before delete
+
+	require.Len(t, gotEvents, 1)
+	assert.Equal(t, "d", gotEvents[0].Op)
+	assert.Equal(t, id.Hex(), gotEvents[0].EntityId)
+	assert.Equal(t, int64(1), gotEvents[0].EntityRev)
+	assert.Nil(t, gotEvents[0].New)
+
+	// Hidden by default: queries, reads, and writes
+	got, err := readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+	all, err := query.Translate("x")
+	require.NoError(t, err)
+	got, err = readStream(store.StreamEntities(ctx, entityType, all, etre.QueryFilter{}))
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+	e, err := store.ReadEntity(ctx, entityType, id.Hex(), etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Nil(t, e)
+	byIds, err := store.ReadEntitiesByIds(ctx, entityType, []string{id.Hex()}, etre.QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{nil}, byIds)
+	diffs, err := store.UpdateEntities(ctx, wo, q, etre.Entity{"foo": "bar"})
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+	deleted, err = store.DeleteEntities(ctx, wo, q)
+	require.NoError(t, err)
+	assert.Empty(t, deleted)
+	assert.Len(t, gotEvents, 1)
+
+	// Visible with IncludeDeleted
+	got, err = readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{IncludeDeleted: true}))
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, int64(1), got[0]["_rev"])
+	assert.False(t, got[0].Deleted().IsZero())
+	e, err = store.ReadEntity(ctx, entityType, id.Hex(), etre.QueryFilter{IncludeDeleted: true})
+	require.NoError(t, err)
+	require.NotNil(t, e)
+	assert.Contains(t, e, "_deleted")
+
+	// Undelete: visible again
+	_, err = coll[entityType].UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"_deleted": ""}})
+	require.NoError(t, err)
+	got, err = readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, id, got[0]["_id"])
+}
+
+func TestDeleteAll(t *testing.T) {
+	// Test that DeleteAll removes all entities, including soft-deleted entities
+	// even though soft delete is enabled, and writes a CDC delete event for each
+	// entity that was not already soft-deleted
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	setup(t, cdcm)
+	store := entity.NewStore(coll, cdcm, config.EntityConfig{
+		Types:      []string{entityType},
+		BatchSize:  5000,
+		SoftDelete: true,
+	})
+	ctx := context.Background()
+
+	// Soft-delete first test node: 1 CDC event
+	q, err := query.Translate("y=a")
+	require.NoError(t, err)
+	_, err = store.DeleteEntities(ctx, wo, q)
+	require.NoError(t, err)
+	require.Len(t, gotEvents, 1)
+
+	deleted, err := store.DeleteAll(ctx, wo)
+	require.NoError(t, err)
+	require.Len(t, deleted, 3)
+	gotIds := []interface{}{}
+	for _, e := range deleted {
+		assert.Equal(t, entityType, e["_type"])
+		gotIds = append(gotIds, e["_id"])
+	}
+	assert.ElementsMatch(t, []interface{}{testNodes[0]["_id"], testNodes[1]["_id"], testNodes[2]["_id"]}, gotIds)
+
+	// Collection is empty
+	n, err := coll[entityType].CountDocuments(ctx, bson.M{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	// CDC delete events for the last two test nodes, not the soft-deleted one
+	require.Len(t, gotEvents, 3)
+	gotEventIds := []string{}
+	for _, e := range gotEvents[1:] {
+		assert.Equal(t, "d", e.Op)
+		assert.Equal(t, int64(1), e.EntityRev)
+		assert.NotNil(t, e.Old)
+		assert.Nil(t, e.New)
+		gotEventIds = append(gotEventIds, e.EntityId)
+	}
+	id2, _ := testNodes[1]["_id"].(bson.ObjectID)
+	id3, _ := testNodes[2]["_id"].(bson.ObjectID)
+	assert.ElementsMatch(t, []string{id2.Hex(), id3.Hex()}, gotEventIds)
+
+	// Nothing to delete
+	deleted, err = store.DeleteAll(ctx, wo)
+	require.NoError(t, err)
+	assert.Empty(t, deleted)
+	assert.Len(t, gotEvents, 3)
+}
+
+func TestRestoreEntities(t *testing.T) {
+	// Test that restoring a soft-deleted entity removes _deleted, increments
+	// _rev, writes a CDC update event, and makes the entity queryable again
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	setup(t, cdcm)
+	store := entity.NewStore(coll, cdcm, config.EntityConfig{
+		Types:      []string{entityType},
+		BatchSize:  5000,
+		SoftDelete: true,
+	})
+	ctx := context.Background()
+	id := testNodes[0]["_id"].(bson.ObjectID)
+
+	// Can't restore an entity by id that's not deleted
+	byId := query.ById(id.Hex())
+	restored, err := store.RestoreEntities(ctx, wo, byId)
+	require.Error(t, err)
+	verr, ok := err.(entity.ValidationError)
+	require.True(t, ok, "got %T, expected entity.ValidationError", err)
+	assert.Equal(t, "entity-not-deleted", verr.Type)
+	assert.Empty(t, restored)
+	assert.Empty(t, gotEvents)
+
+	// A query that matches only entities that are not deleted restores nothing
+	q, err := query.Translate("y=a")
+	require.NoError(t, err)
+	restored, err = store.RestoreEntities(ctx, wo, q)
+	require.NoError(t, err)
+	assert.Empty(t, restored)
+	assert.Empty(t, gotEvents)
+
+	// Soft delete then restore first test node
+	deleted, err := store.DeleteEntities(ctx, wo, q)
+	require.NoError(t, err)
+	require.Len(t, deleted, 1)
+
+	// Query matches all test nodes, but only the deleted one is restored
+	all, err := query.Translate("x")
+	require.NoError(t, err)
+	restored, err = store.RestoreEntities(ctx, wo, all)
+	require.NoError(t, err)
+	require.Len(t, restored, 1)
+	assert.Equal(t, id, restored[0]["_id"])
+	assert.Equal(t, int64(1), restored[0]["_rev"])
+	assert.Contains(t, restored[0], "_deleted") // before restore
+
+	require.Len(t, gotEvents, 2)
+	assert.Equal(t, "u", gotEvents[1].Op)
+	assert.Equal(t, id.Hex(), gotEvents[1].EntityId)
+	assert.Equal(t, int64(2), gotEvents[1].EntityRev)
+	require.NotNil(t, gotEvents[1].Old)
+	assert.Contains(t, *gotEvents[1].Old, "_deleted")
+	require.NotNil(t, gotEvents[1].New)
+	assert.NotContains(t, *gotEvents[1].New, "_deleted")
+
+	// Queryable again with incremented _rev
+	got, err := readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, id, got[0]["_id"])
+	assert.Equal(t, int64(2), got[0]["_rev"])
+	assert.NotContains(t, got[0], "_deleted")
+
+	// Restoring again by id is an error because it's no longer deleted
+	_, err = store.RestoreEntities(ctx, wo, byId)
+	require.Error(t, err)
+	assert.Len(t, gotEvents, 2)
+
+	// Query that matches nothing restores nothing
+	q, err = query.Translate("y=nope")
+	require.NoError(t, err)
+	restored, err = store.RestoreEntities(ctx, wo, q)
+	require.NoError(t, err)
+	assert.Empty(t, restored)
+}
+
 func TestDeleteLabel(t *testing.T) {
 	gotEvents := []etre.CDCEvent{}
 	cdcm := &mock.CDCStore{
@@ -834,6 +2308,328 @@ func TestDeleteLabel(t *testing.T) {
 	assert.Equal(t, expectEvent, gotEvents)
 }
 
+func TestDeleteLabelByQuery(t *testing.T) {
+	// Test that the label is deleted from all matching entities that have it,
+	// with a CDC event for each. All test nodes match, but only the 2nd and
+	// 3rd have label bar, so the 1st is not changed.
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	q, err := query.Translate("y")
+	require.NoError(t, err)
+	gotOld, err := store.DeleteLabelByQuery(context.Background(), wo, q, "bar")
+	require.NoError(t, err)
+
+	expectOld := []etre.Entity{}
+	for _, n := range testNodes[1:] {
+		expectOld = append(expectOld, etre.Entity{
+			"_id":   n["_id"],
+			"_type": n["_type"],
+			"_rev":  n["_rev"],
+			"bar":   "",
+		})
+	}
+	assert.ElementsMatch(t, expectOld, gotOld)
+
+	// The bar label should no longer be set on any entity, and only the
+	// entities that had it are changed
+	got, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	for _, e := range got {
+		assert.NotContains(t, e, "bar")
+		if e["_id"] == testNodes[0]["_id"] {
+			assert.Equal(t, int64(0), e["_rev"])
+		} else {
+			assert.Equal(t, int64(1), e["_rev"])
+		}
+	}
+
+	require.Len(t, gotEvents, 2)
+	gotIds := []string{}
+	for _, event := range gotEvents {
+		assert.Equal(t, "u", event.Op)
+		assert.Equal(t, int64(1), event.EntityRev)
+		assert.Equal(t, username, event.Caller)
+		require.NotNil(t, event.Old)
+		assert.Contains(t, *event.Old, "bar")
+		require.NotNil(t, event.New)
+		assert.NotContains(t, *event.New, "bar")
+		gotIds = append(gotIds, event.EntityId)
+	}
+	assert.ElementsMatch(t, []string{
+		testNodes[1]["_id"].(bson.ObjectID).Hex(),
+		testNodes[2]["_id"].(bson.ObjectID).Hex(),
+	}, gotIds)
+
+	// No entities have the label now, so nothing is changed
+	gotEvents = []etre.CDCEvent{}
+	gotOld, err = store.DeleteLabelByQuery(context.Background(), wo, q, "bar")
+	require.NoError(t, err)
+	assert.Empty(t, gotOld)
+	assert.Empty(t, gotEvents)
+}
+
+func TestRenameLabel(t *testing.T) {
+	// Test that the label is renamed in all matching entities that have it,
+	// with a CDC event for each: old has the label, new has the new label.
+	// All test nodes match, but only the 2nd and 3rd have label bar, so the
+	// 1st is not changed.
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	q, err := query.Translate("y")
+	require.NoError(t, err)
+	gotOld, err := store.RenameLabel(context.Background(), wo, q, "bar", "baz", false)
+	require.NoError(t, err)
+	require.Len(t, gotOld, 2)
+	for _, e := range gotOld {
+		assert.Equal(t, "", e["bar"])
+		assert.NotContains(t, e, "baz")
+	}
+
+	got, err := readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	for _, e := range got {
+		assert.NotContains(t, e, "bar")
+		if e["_id"] == testNodes[0]["_id"] {
+			assert.NotContains(t, e, "baz")
+			assert.Equal(t, int64(0), e["_rev"])
+		} else {
+			assert.Equal(t, "", e["baz"])
+			assert.Equal(t, int64(1), e["_rev"])
+		}
+	}
+
+	require.Len(t, gotEvents, 2)
+	for _, event := range gotEvents {
+		assert.Equal(t, "u", event.Op)
+		assert.Equal(t, int64(1), event.EntityRev)
+		require.NotNil(t, event.Old)
+		assert.Equal(t, "", (*event.Old)["bar"])
+		assert.NotContains(t, *event.Old, "baz")
+		require.NotNil(t, event.New)
+		assert.Equal(t, "", (*event.New)["baz"])
+		assert.NotContains(t, *event.New, "bar")
+	}
+
+	// The 1st test node has labels foo and x. Without overwrite, renaming foo
+	// to x is an error and nothing is changed. With overwrite, x is replaced.
+	gotEvents = []etre.CDCEvent{}
+	q, err = query.Translate("y=a")
+	require.NoError(t, err)
+	_, err = store.RenameLabel(context.Background(), wo, q, "foo", "x", false)
+	var ve entity.ValidationError
+	require.ErrorAs(t, err, &ve)
+	assert.Equal(t, "label-exists", ve.Type)
+	assert.Empty(t, gotEvents)
+
+	gotOld, err = store.RenameLabel(context.Background(), wo, q, "foo", "x", true)
+	require.NoError(t, err)
+	require.Len(t, gotOld, 1)
+	assert.Equal(t, int64(2), gotOld[0]["x"])
+	require.Len(t, gotEvents, 1)
+	assert.Equal(t, int64(2), (*gotEvents[0].Old)["x"])
+	assert.Equal(t, "", (*gotEvents[0].New)["x"])
+
+	got, err = readStream(store.StreamEntities(context.Background(), entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, "", got[0]["x"])
+	assert.NotContains(t, got[0], "foo")
+}
+
+func TestStreamEntitiesHint(t *testing.T) {
+	// Test that QueryFilter.Hint makes the query use the index, by name or key
+	// spec, without changing the results, and that the index must exist
+	store := setup(t, &mock.CDCStore{})
+	ctx := context.Background()
+	_, err := coll[entityType].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "y", Value: 1}},
+		Options: options.Index().SetName("y_idx"),
+	})
+	require.NoError(t, err)
+
+	// Number of times the index was used, from $indexStats
+	indexOps := func() int64 {
+		cursor, err := coll[entityType].Aggregate(ctx, mongo.Pipeline{{{Key: "$indexStats", Value: bson.D{}}}})
+		require.NoError(t, err)
+		var stats []struct {
+			Name     string `bson:"name"`
+			Accesses struct {
+				Ops int64 `bson:"ops"`
+			} `bson:"accesses"`
+		}
+		require.NoError(t, cursor.All(ctx, &stats))
+		for _, s := range stats {
+			if s.Name == "y_idx" {
+				return s.Accesses.Ops
+			}
+		}
+		t.Fatal("index y_idx not found")
+		return 0
+	}
+
+	q, err := query.Translate("x>1")
+	require.NoError(t, err)
+	expect, err := readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	require.Len(t, expect, 3)
+
+	for _, hint := range []string{"y_idx", "y:1"} {
+		ops := indexOps()
+		got, err := readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{Hint: hint}))
+		require.NoError(t, err, hint)
+		assert.ElementsMatch(t, expect, got, hint)
+		assert.Greater(t, indexOps(), ops, "index not used for hint %s", hint)
+	}
+
+	for _, hint := range []string{"nope", "y:-1", "y:x"} {
+		_, err = readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{Hint: hint}))
+		var ve entity.ValidationError
+		require.ErrorAs(t, err, &ve, hint)
+		assert.Equal(t, "invalid-hint", ve.Type, hint)
+	}
+}
+
+func TestStreamEntitiesSort(t *testing.T) {
+	// Test that QueryFilter.Sort orders the results by the labels and directions,
+	// and that invalid sort keys are an error
+	store := setup(t, &mock.CDCStore{})
+	ctx := context.Background()
+
+	q, err := query.Translate("x>1")
+	require.NoError(t, err)
+	f := etre.QueryFilter{ReturnLabels: []string{"x"}, Sort: "y:-1,x:1"}
+	got, err := readStream(store.StreamEntities(ctx, entityType, q, f))
+	require.NoError(t, err)
+	expect := []etre.Entity{{"x": int64(4)}, {"x": int64(6)}, {"x": int64(2)}}
+	assert.Equal(t, expect, got)
+
+	f.Sort = "x:-1"
+	got, err = readStream(store.StreamEntities(ctx, entityType, q, f))
+	require.NoError(t, err)
+	expect = []etre.Entity{{"x": int64(6)}, {"x": int64(4)}, {"x": int64(2)}}
+	assert.Equal(t, expect, got)
+
+	for _, sort := range []string{"x", "x:2", ":1", "x:1,"} {
+		_, err = readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{Sort: sort}))
+		var ve entity.ValidationError
+		require.ErrorAs(t, err, &ve, sort)
+		assert.Equal(t, "invalid-sort", ve.Type, sort)
+	}
+}
+
+func TestStreamEntitiesCollation(t *testing.T) {
+	// Test that QueryFilter.Collation with strength 2 matches case-insensitively:
+	// y=A matches y=a, which it does not match without the collation
+	store := setup(t, &mock.CDCStore{})
+	ctx := context.Background()
+
+	q, err := query.Translate("y=A")
+	require.NoError(t, err)
+
+	got, err := readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{}))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	f := etre.QueryFilter{
+		ReturnLabels: []string{"x", "y"},
+		Collation:    &etre.Collation{Locale: "en", Strength: 2},
+	}
+	got, err = readStream(store.StreamEntities(ctx, entityType, q, f))
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"x": int64(2), "y": "a"}}, got)
+
+	// Distinct query uses the collation, too
+	f = etre.QueryFilter{
+		ReturnLabels: []string{"y"},
+		Distinct:     true,
+		Collation:    &etre.Collation{Locale: "en", Strength: 2},
+	}
+	got, err = readStream(store.StreamEntities(ctx, entityType, q, f))
+	require.NoError(t, err)
+	assert.Equal(t, []etre.Entity{{"y": "a"}}, got)
+}
+
+func TestStreamEntitiesQuotedValues(t *testing.T) {
+	// Test that quoted values in a query match values with spaces and commas,
+	// which cannot be written unquoted
+	store := setup(t, &mock.CDCStore{})
+	ctx := context.Background()
+
+	_, err := store.CreateEntities(ctx, wo, []etre.Entity{
+		{"x": int64(7), "y": "us east"},
+		{"x": int64(8), "y": "a,b"},
+	})
+	require.NoError(t, err)
+
+	f := etre.QueryFilter{ReturnLabels: []string{"x"}}
+	for qs, expect := range map[string][]etre.Entity{
+		`y="us east"`:             {{"x": int64(7)}},
+		`y='a,b'`:                 {{"x": int64(8)}},
+		`y in ("a,b", "us east")`: {{"x": int64(7)}, {"x": int64(8)}},
+		`y="a,b" ^ y=a`:           {{"x": int64(2)}, {"x": int64(8)}},
+	} {
+		q, err := query.TranslateVersion(qs, query.LATEST_VERSION)
+		require.NoError(t, err, qs)
+		got, err := readStream(store.StreamEntities(ctx, entityType, q, f))
+		require.NoError(t, err, qs)
+		assert.ElementsMatch(t, expect, got, qs)
+	}
+}
+
+func TestStreamEntitiesMaxQueryTime(t *testing.T) {
+	// Test that a query that runs longer than its max time returns a query timeout
+	// error. The fail point blocks the find command longer than the max time; it
+	// requires test commands to be enabled on the server.
+	setup(t, &mock.CDCStore{})
+	store := entity.NewStore(coll, &mock.CDCStore{}, config.EntityConfig{
+		Types:        []string{entityType},
+		BatchSize:    5000,
+		MaxQueryTime: "1s",
+	})
+	ctx := context.Background()
+	err := client.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "configureFailPoint", Value: "failCommand"},
+		{Key: "mode", Value: bson.D{{Key: "times", Value: 1}}},
+		{Key: "data", Value: bson.D{
+			{Key: "failCommands", Value: bson.A{"find"}},
+			{Key: "blockConnection", Value: true},
+			{Key: "blockTimeMS", Value: 500},
+		}},
+	}).Err()
+	if err != nil {
+		t.Skipf("cannot set fail point: %s", err)
+	}
+
+	// Max time in filter lower than config
+	q, err := query.Translate("x")
+	require.NoError(t, err)
+	_, err = readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{MaxTimeMS: 50}))
+	var dbErr entity.DbError
+	require.ErrorAs(t, err, &dbErr)
+	assert.Equal(t, "query-timeout", dbErr.Type)
+
+	// Fail point is done (times: 1), so the same query is within its max time
+	got, err := readStream(store.StreamEntities(ctx, entityType, q, etre.QueryFilter{MaxTimeMS: 50}))
+	require.NoError(t, err)
+	assert.Len(t, got, 3)
+}
+
 func TestStreamEntitiesLimit(t *testing.T) {
 	// Test that Limit caps the number of entities returned. There are 3 test
 	// nodes, so limit=2 should return only 2.
@@ -0,0 +1,188 @@
+// Copyright 2026, Square, Inc.
+
+package entity
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/square/etre"
+	"github.com/square/etre/query"
+)
+
+// tracer uses the OpenTelemetry global tracer provider, which is a no-op unless
+// the program that runs Etre sets one with otel.SetTracerProvider.
+var tracer = otel.Tracer("github.com/square/etre/entity")
+
+// tracedStore is a Store that creates a span for every Store method call with
+// attributes etre.entity_type, etre.op, and etre.result_count (number of entities
+// read or written). The span is a child of the span in the context, if any, like
+// the API request span.
+type tracedStore struct {
+	store Store
+}
+
+var _ Store = tracedStore{}
+
+// NewTracedStore returns a Store that traces calls to the given Store.
+func NewTracedStore(s Store) tracedStore {
+	return tracedStore{store: s}
+}
+
+func startSpan(ctx context.Context, method, entityType, op string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "entity.Store/"+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("etre.entity_type", entityType),
+			attribute.String("etre.op", op),
+		),
+	)
+}
+
+func endSpan(span trace.Span, n int, err error) {
+	span.SetAttributes(attribute.Int("etre.result_count", n))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s tracedStore) ReadEntity(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+	ctx, span := startSpan(ctx, "ReadEntity", entityType, "read")
+	e, err := s.store.ReadEntity(ctx, entityType, entityId, f)
+	n := 0
+	if e != nil {
+		n = 1
+	}
+	endSpan(span, n, err)
+	return e, err
+}
+
+func (s tracedStore) ReadEntitiesByIds(ctx context.Context, entityType string, entityIds []string, f etre.QueryFilter) ([]etre.Entity, error) {
+	ctx, span := startSpan(ctx, "ReadEntitiesByIds", entityType, "read")
+	entities, err := s.store.ReadEntitiesByIds(ctx, entityType, entityIds, f)
+	endSpan(span, len(entities), err)
+	return entities, err
+}
+
+// StreamEntities ends the span when the stream ends, after the last result is
+// received or the context is done.
+func (s tracedStore) StreamEntities(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan EntityResult {
+	ctx, span := startSpan(ctx, "StreamEntities", entityType, "read")
+	in := s.store.StreamEntities(ctx, entityType, q, f)
+	out := make(chan EntityResult, cap(in))
+	go func() {
+		defer close(out)
+		n := 0
+		var err error
+		defer func() { endSpan(span, n, err) }()
+		for r := range in {
+			if r.Err != nil {
+				err = r.Err
+			} else {
+				n++
+			}
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (s tracedStore) GroupEntities(ctx context.Context, entityType string, q query.Query, groupBy string, f etre.QueryFilter) (map[string][]etre.Entity, error) {
+	ctx, span := startSpan(ctx, "GroupEntities", entityType, "read")
+	groups, err := s.store.GroupEntities(ctx, entityType, q, groupBy, f)
+	n := 0
+	for _, entities := range groups {
+		n += len(entities)
+	}
+	endSpan(span, n, err)
+	return groups, err
+}
+
+func (s tracedStore) CountGroups(ctx context.Context, entityType string, q query.Query, groupBy string) ([]etre.GroupCount, error) {
+	ctx, span := startSpan(ctx, "CountGroups", entityType, "read")
+	counts, err := s.store.CountGroups(ctx, entityType, q, groupBy)
+	endSpan(span, len(counts), err)
+	return counts, err
+}
+
+func (s tracedStore) CreateEntities(ctx context.Context, wo WriteOp, entities []etre.Entity) ([]string, error) {
+	ctx, span := startSpan(ctx, "CreateEntities", wo.EntityType, "create")
+	ids, err := s.store.CreateEntities(ctx, wo, entities)
+	endSpan(span, len(ids), err)
+	return ids, err
+}
+
+func (s tracedStore) CreateEntityIfNotExists(ctx context.Context, wo WriteOp, q query.Query, e etre.Entity) (etre.Entity, bool, error) {
+	ctx, span := startSpan(ctx, "CreateEntityIfNotExists", wo.EntityType, "create")
+	got, created, err := s.store.CreateEntityIfNotExists(ctx, wo, q, e)
+	n := 0
+	if created {
+		n = 1
+	}
+	endSpan(span, n, err)
+	return got, created, err
+}
+
+func (s tracedStore) UpdateEntities(ctx context.Context, wo WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+	ctx, span := startSpan(ctx, "UpdateEntities", wo.EntityType, "update")
+	diffs, err := s.store.UpdateEntities(ctx, wo, q, patch)
+	endSpan(span, len(diffs), err)
+	return diffs, err
+}
+
+func (s tracedStore) DeleteEntities(ctx context.Context, wo WriteOp, q query.Query) ([]etre.Entity, error) {
+	ctx, span := startSpan(ctx, "DeleteEntities", wo.EntityType, "delete")
+	deleted, err := s.store.DeleteEntities(ctx, wo, q)
+	endSpan(span, len(deleted), err)
+	return deleted, err
+}
+
+func (s tracedStore) DeleteAll(ctx context.Context, wo WriteOp) ([]etre.Entity, error) {
+	ctx, span := startSpan(ctx, "DeleteAll", wo.EntityType, "delete-all")
+	deleted, err := s.store.DeleteAll(ctx, wo)
+	endSpan(span, len(deleted), err)
+	return deleted, err
+}
+
+func (s tracedStore) RestoreEntities(ctx context.Context, wo WriteOp, q query.Query) ([]etre.Entity, error) {
+	ctx, span := startSpan(ctx, "RestoreEntities", wo.EntityType, "restore")
+	restored, err := s.store.RestoreEntities(ctx, wo, q)
+	endSpan(span, len(restored), err)
+	return restored, err
+}
+
+func (s tracedStore) DeleteLabel(ctx context.Context, wo WriteOp, label string) (etre.Entity, error) {
+	ctx, span := startSpan(ctx, "DeleteLabel", wo.EntityType, "delete-label")
+	diff, err := s.store.DeleteLabel(ctx, wo, label)
+	n := 0
+	if diff != nil {
+		n = 1
+	}
+	endSpan(span, n, err)
+	return diff, err
+}
+
+func (s tracedStore) DeleteLabelByQuery(ctx context.Context, wo WriteOp, q query.Query, label string) ([]etre.Entity, error) {
+	ctx, span := startSpan(ctx, "DeleteLabelByQuery", wo.EntityType, "delete-label")
+	diffs, err := s.store.DeleteLabelByQuery(ctx, wo, q, label)
+	endSpan(span, len(diffs), err)
+	return diffs, err
+}
+
+func (s tracedStore) RenameLabel(ctx context.Context, wo WriteOp, q query.Query, label, newLabel string, overwrite bool) ([]etre.Entity, error) {
+	ctx, span := startSpan(ctx, "RenameLabel", wo.EntityType, "rename-label")
+	diffs, err := s.store.RenameLabel(ctx, wo, q, label, newLabel, overwrite)
+	endSpan(span, len(diffs), err)
+	return diffs, err
+}
@@ -0,0 +1,74 @@
+// Copyright 2026, Square, Inc.
+
+package entity_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/square/etre"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/query"
+	"github.com/square/etre/test/mock"
+)
+
+// The global tracer provider can be set only once because package tracers
+// delegate to the first one set, so tests share the exporter and reset it.
+var (
+	exporter    = tracetest.NewInMemoryExporter()
+	setExporter sync.Once
+)
+
+func TestTracedStore(t *testing.T) {
+	// Test that store reads are traced with entity type, op, and result count.
+	// Use the mock store because the traced store only wraps it.
+	setExporter.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	})
+	exporter.Reset()
+
+	entities := []etre.Entity{{"_id": "a"}, {"_id": "b"}}
+	s := entity.NewTracedStore(mock.EntityStore{
+		ReadEntityFunc: func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
+			return nil, fmt.Errorf("db error")
+		},
+		StreamEntitiesFunc: func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
+			return mock.DoStreamEntities(entities, nil)
+		},
+	})
+
+	var got []etre.Entity
+	for r := range s.StreamEntities(context.Background(), entityType, query.Query{}, etre.QueryFilter{}) {
+		require.NoError(t, r.Err)
+		got = append(got, r.Entity)
+	}
+	assert.Equal(t, entities, got)
+
+	_, err := s.ReadEntity(context.Background(), entityType, "a", etre.QueryFilter{})
+	require.Error(t, err)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+
+	assert.Equal(t, "entity.Store/StreamEntities", spans[0].Name)
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		attribute.String("etre.entity_type", entityType),
+		attribute.String("etre.op", "read"),
+		attribute.Int("etre.result_count", 2),
+	}, spans[0].Attributes)
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+
+	assert.Equal(t, "entity.Store/ReadEntity", spans[1].Name)
+	assert.Contains(t, spans[1].Attributes, attribute.Int("etre.result_count", 0))
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+}
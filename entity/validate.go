@@ -4,9 +4,12 @@ package entity
 import (
 	"fmt"
 	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/square/etre"
+	"github.com/square/etre/config"
 )
 
 const (
@@ -15,25 +18,44 @@ const (
 	VALIDATE_ON_DELETE
 )
 
+// ValidationError is an invalid entity, label, or value. If the error is for
+// one entity in a write, EntityIndex is its index in the request, and Label is
+// the label or nested label path that's invalid, if the error is for one label.
 type ValidationError struct {
-	Err  error
-	Type string
+	Err         error
+	Type        string
+	EntityIndex *int
+	Label       string
 }
 
 func (e ValidationError) Error() string {
 	return e.Err.Error()
 }
 
+// entityIndex returns a pointer to i for ValidationError.EntityIndex, which is
+// nil if the error is not for one entity.
+func entityIndex(i int) *int {
+	return &i
+}
+
 type Validator interface {
 	EntityType(string) error
 	Entities([]etre.Entity, byte) error
+	Schema(entityType string, entities []etre.Entity, op byte) error
 	WriteOp(WriteOp) error
-	DeleteLabel(string) error
+	DeleteLabel(entityType, label string) error
+	RenameLabel(entityType, label, newLabel string) error
+	Aliases(aliases map[string]string) error
 }
 
 type validator struct {
-	entityTypes []string
-	validType   map[string]bool
+	entityTypes  []string
+	validType    map[string]bool
+	schema       map[string]config.SchemaConfig
+	labelPattern *regexp.Regexp
+
+	maxLabels     int
+	maxValueBytes int
 }
 
 func NewValidator(entityTypes []string) validator {
@@ -47,6 +69,30 @@ func NewValidator(entityTypes []string) validator {
 	}
 }
 
+// WithSchema returns a copy of the validator that validates entities against
+// the label schema keyed on entity type (config.entity.schema). See Schema.
+func (v validator) WithSchema(schema map[string]config.SchemaConfig) validator {
+	v.schema = schema
+	return v
+}
+
+// WithLabelPattern returns a copy of the validator that requires new label names
+// to match the pattern (config.entity.label_pattern), in addition to the fixed
+// label name rules. See labelName.
+func (v validator) WithLabelPattern(pattern *regexp.Regexp) validator {
+	v.labelPattern = pattern
+	return v
+}
+
+// WithLimits returns a copy of the validator that limits the number of labels
+// per entity and the size of string label values (config.entity.max_labels and
+// max_value_bytes). Zero is no limit. See limits.
+func (v validator) WithLimits(maxLabels, maxValueBytes int) validator {
+	v.maxLabels = maxLabels
+	v.maxValueBytes = maxValueBytes
+	return v
+}
+
 func (v validator) EntityType(entityType string) error {
 	if !v.validType[entityType] {
 		return ValidationError{
@@ -65,45 +111,76 @@ func (v validator) Entities(entities []etre.Entity, op byte) error {
 		// aren't allowed. Maybe caller means to delete the entity?
 		if len(e) == 0 && (op == VALIDATE_ON_UPDATE || op == VALIDATE_ON_CREATE) {
 			return ValidationError{
-				Err:  fmt.Errorf("entity at index %d is empty (no labels); empty entities are not allowed on create or patch", i),
-				Type: "empty-entity",
+				Err:         fmt.Errorf("entity at index %d is empty (no labels); empty entities are not allowed on create or patch", i),
+				Type:        "empty-entity",
+				EntityIndex: entityIndex(i),
 			}
 		}
 
 		for label, val := range e {
 			if label == "" {
 				return ValidationError{
-					Err:  fmt.Errorf("empty string label (entity index %d)", i),
-					Type: "empty-string-label",
+					Err:         fmt.Errorf("empty string label (entity index %d)", i),
+					Type:        "empty-string-label",
+					EntityIndex: entityIndex(i),
 				}
 			}
 			if strings.IndexAny(label, " \t") != -1 {
 				return ValidationError{
-					Err:  fmt.Errorf("label cannot have whitesspace: '%s' (entity index %d)", label, i),
-					Type: "label-has-whitespace",
+					Err:         fmt.Errorf("label cannot have whitesspace: '%s' (entity index %d)", label, i),
+					Type:        "label-has-whitespace",
+					EntityIndex: entityIndex(i),
+					Label:       label,
 				}
 			}
 			switch op {
 			case VALIDATE_ON_CREATE:
-				// User cannot set these metalabels on create
-				for _, ml := range []string{"_id", "_type", "_rev", "_created", "_updated"} {
-					if label != ml {
-						continue
-					}
-					if _, ok := e[ml]; ok {
+				// User cannot set metalabels on create, except set op metalabels
+				if etre.IsMetalabel(label) {
+					if !setLabel[label] {
 						return ValidationError{
-							Err:  fmt.Errorf("cannot set metalabel %s on create (entity index %d)", ml, i),
-							Type: "cannot-set-metalabel",
+							Err:         fmt.Errorf("cannot set metalabel %s on create (entity index %d)", label, i),
+							Type:        "cannot-set-metalabel",
+							EntityIndex: entityIndex(i),
+							Label:       label,
 						}
 					}
+				} else if err := v.labelName(label); err != nil {
+					return ValidationError{
+						Err:         fmt.Errorf("%s (entity index %d)", err, i),
+						Type:        "invalid-label",
+						EntityIndex: entityIndex(i),
+						Label:       label,
+					}
 				}
 			case VALIDATE_ON_UPDATE:
-				// Cannot patch (change) metalabel values
-				if etre.IsMetalabel(label) {
-					return ValidationError{
-						Err:  fmt.Errorf("cannot change metalabel %s on patch (entity index %d)", label, i),
-						Type: "cannot-change-metalabel",
+				// Patch directives (not labels)
+				switch label {
+				case PATCH_UNSET:
+					paths, err := unsetPaths(val, i)
+					if err != nil {
+						return err
+					}
+					entities[i][label] = paths
+					continue
+				case PATCH_INC:
+					inc, err := incValues(val, i)
+					if err != nil {
+						return err
 					}
+					for path := range inc {
+						if err := v.patchLabelName(path, i); err != nil {
+							return err
+						}
+					}
+					entities[i][label] = inc
+					continue
+				}
+				if err := patchPath(label, i); err != nil {
+					return err
+				}
+				if err := v.patchLabelName(label, i); err != nil {
+					return err
 				}
 			}
 
@@ -126,16 +203,410 @@ func (v validator) Entities(entities []etre.Entity, op byte) error {
 				valid := k == reflect.String || k == reflect.Int || k == reflect.Bool
 				if !valid {
 					return ValidationError{
-						Err:  fmt.Errorf("invalid value type %s for key %v (value: %v); valid types: string, int, bool (entity index %d)", reflect.TypeOf(val), label, val, i),
-						Type: "invalid-value-type",
+						Err:         fmt.Errorf("invalid value type %s for key %v (value: %v); valid types: string, int, bool (entity index %d)", reflect.TypeOf(val), label, val, i),
+						Type:        "invalid-value-type",
+						EntityIndex: entityIndex(i),
+						Label:       label,
+					}
+				}
+			}
+		}
+
+		if err := v.limits(e, i); err != nil {
+			return err
+		}
+
+		switch op {
+		case VALIDATE_ON_CREATE:
+			if err := setLabels(e, i); err != nil {
+				return err
+			}
+		case VALIDATE_ON_UPDATE:
+			if err := patchConflict(e, i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// limits returns an error if the entity or patch has more labels than the max,
+// not counting metalabels and PATCH_UNSET, or a string label value larger than
+// the max. MongoDB has a 16MB document limit, but entities should be much smaller.
+func (v validator) limits(e etre.Entity, i int) error {
+	if v.maxLabels > 0 {
+		n := 0
+		for label := range e {
+			switch {
+			case label == PATCH_UNSET || etre.IsMetalabel(label):
+				// Removed or not a label
+			case label == PATCH_INC:
+				n += len(patchInc(e))
+			default:
+				n++
+			}
+		}
+		if n > v.maxLabels {
+			return ValidationError{
+				Err:         fmt.Errorf("entity has %d labels, max %d (config.entity.max_labels) (entity index %d)", n, v.maxLabels, i),
+				Type:        "entity-too-large",
+				EntityIndex: entityIndex(i),
+			}
+		}
+	}
+	if v.maxValueBytes > 0 {
+		for label, val := range e {
+			if s, ok := val.(string); ok && len(s) > v.maxValueBytes {
+				return ValidationError{
+					Err:         fmt.Errorf("label %s value is %d bytes, max %d (config.entity.max_value_bytes) (entity index %d)", label, len(s), v.maxValueBytes, i),
+					Type:        "entity-too-large",
+					EntityIndex: entityIndex(i),
+					Label:       label,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// labelName returns an error if the label name is not allowed for a new label:
+// it cannot contain "." (MongoDB nested path separator) or "$" (MongoDB operator
+// prefix), or begin with "_" (reserved for metalabels), and it must match the
+// label pattern, if set. The caller checks empty names, whitespace, and metalabels.
+func (v validator) labelName(label string) error {
+	if strings.ContainsAny(label, ".$") {
+		return fmt.Errorf("invalid label: '%s': labels cannot contain . or $", label)
+	}
+	if strings.HasPrefix(label, "_") {
+		return fmt.Errorf("invalid label: '%s': labels cannot begin with _ (reserved for metalabels)", label)
+	}
+	if v.labelPattern != nil && !v.labelPattern.MatchString(label) {
+		return fmt.Errorf("invalid label: '%s': does not match pattern %s (config.entity.label_pattern)", label, v.labelPattern)
+	}
+	return nil
+}
+
+// patchLabelName returns an error if the label of the patch label or nested label
+// path (like "a" for "a.b") is not an allowed label name. Call it after patchPath.
+func (v validator) patchLabelName(path string, i int) error {
+	label := strings.SplitN(path, ".", 2)[0]
+	if err := v.labelName(label); err != nil {
+		return ValidationError{
+			Err:         fmt.Errorf("%s (entity index %d)", err, i),
+			Type:        "invalid-label",
+			EntityIndex: entityIndex(i),
+			Label:       label,
+		}
+	}
+	return nil
+}
+
+// setLabel are the set op metalabels (see etre.Set). They are the only metalabels
+// that can be set on create: not as data, but as set op metadata copied to the
+// CDC event. They cannot be changed on update; the set op is from the write op.
+var setLabel = map[string]bool{
+	"_setId":   true,
+	"_setOp":   true,
+	"_setSize": true,
+}
+
+// setLabels returns an error if the entity has some but not all set op metalabels,
+// or if their values are invalid: _setId and _setOp must be non-empty strings, and
+// _setSize must be an int greater than zero. Call it after label values are
+// normalized (float to int).
+func setLabels(e etre.Entity, i int) error {
+	n := 0
+	for label := range setLabel {
+		if _, ok := e[label]; ok {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	if n != len(setLabel) {
+		return ValidationError{
+			Err:         fmt.Errorf("set op metalabels _setId, _setOp, and _setSize must all be set or none set (entity index %d)", i),
+			Type:        "invalid-set-label",
+			EntityIndex: entityIndex(i),
+		}
+	}
+	id, _ := e["_setId"].(string)
+	op, _ := e["_setOp"].(string)
+	size, _ := e["_setSize"].(int)
+	if id == "" || op == "" || size < 1 {
+		return ValidationError{
+			Err:         fmt.Errorf("invalid set op metalabels: _setId=%v, _setOp=%v, _setSize=%v: _setId and _setOp must be non-empty strings and _setSize must be an integer greater than zero (entity index %d)", e["_setId"], e["_setOp"], e["_setSize"], i),
+			Type:        "invalid-set-label",
+			EntityIndex: entityIndex(i),
+		}
+	}
+	return nil
+}
+
+// patchConflict returns an error if the patch changes a path more than once,
+// like "a" in the patch and in PATCH_INC, or changes a path and one of its
+// parents, like "a" and "a.b". MongoDB cannot update both.
+func patchConflict(patch etre.Entity, i int) error {
+	paths := patchPaths(patch)
+	for j, p := range paths {
+		for _, q := range paths[j+1:] {
+			if p == q || strings.HasPrefix(p, q+".") || strings.HasPrefix(q, p+".") {
+				return ValidationError{
+					Err:         fmt.Errorf("patch changes conflicting labels or nested label paths %s and %s (entity index %d)", p, q, i),
+					Type:        "patch-conflict",
+					EntityIndex: entityIndex(i),
+					Label:       q,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// patchPath returns an error if the patch label or nested label path (like "a.b")
+// is invalid or changes a metalabel.
+func patchPath(path string, i int) error {
+	fields := strings.Split(path, ".")
+	// Cannot patch (change) metalabel values
+	if etre.IsMetalabel(fields[0]) {
+		return ValidationError{
+			Err:         fmt.Errorf("cannot change metalabel %s on patch (entity index %d)", fields[0], i),
+			Type:        "cannot-change-metalabel",
+			EntityIndex: entityIndex(i),
+			Label:       fields[0],
+		}
+	}
+	for _, f := range fields {
+		if f == "" || strings.HasPrefix(f, "$") {
+			return ValidationError{
+				Err:         fmt.Errorf("invalid label or nested label path: '%s': labels and fields cannot be empty or begin with $ (entity index %d)", path, i),
+				Type:        "invalid-patch-path",
+				EntityIndex: entityIndex(i),
+				Label:       path,
+			}
+		}
+	}
+	return nil
+}
+
+// unsetPaths returns the PATCH_UNSET value as a []string. It's a []interface{}
+// when decoded from JSON.
+func unsetPaths(val interface{}, i int) ([]string, error) {
+	var paths []string
+	switch v := val.(type) {
+	case []string:
+		paths = v
+	case []interface{}:
+		paths = make([]string, len(v))
+		for j := range v {
+			s, ok := v[j].(string)
+			if !ok {
+				return nil, ValidationError{
+					Err:         fmt.Errorf("invalid %s value: %v: must be a list of labels or nested label paths (entity index %d)", PATCH_UNSET, val, i),
+					Type:        "invalid-value-type",
+					EntityIndex: entityIndex(i),
+					Label:       PATCH_UNSET,
+				}
+			}
+			paths[j] = s
+		}
+	default:
+		return nil, ValidationError{
+			Err:         fmt.Errorf("invalid %s value: %v: must be a list of labels or nested label paths (entity index %d)", PATCH_UNSET, val, i),
+			Type:        "invalid-value-type",
+			EntityIndex: entityIndex(i),
+			Label:       PATCH_UNSET,
+		}
+	}
+	for _, p := range paths {
+		if err := patchPath(p, i); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// incValues returns the PATCH_INC value as a map of labels or nested label paths
+// to int amounts. Like label values, float amounts are truncated to int.
+func incValues(val interface{}, i int) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	switch v := val.(type) {
+	case map[string]interface{}:
+		m = v
+	case etre.Entity:
+		m = v
+	default:
+		return nil, ValidationError{
+			Err:         fmt.Errorf("invalid %s value: %v: must be an object of labels or nested label paths to numbers (entity index %d)", PATCH_INC, val, i),
+			Type:        "invalid-value-type",
+			EntityIndex: entityIndex(i),
+			Label:       PATCH_INC,
+		}
+	}
+	if len(m) == 0 {
+		return nil, ValidationError{
+			Err:         fmt.Errorf("%s is empty (entity index %d)", PATCH_INC, i),
+			Type:        "invalid-value-type",
+			EntityIndex: entityIndex(i),
+			Label:       PATCH_INC,
+		}
+	}
+	inc := make(map[string]interface{}, len(m))
+	for path, n := range m {
+		if err := patchPath(path, i); err != nil {
+			return nil, err
+		}
+		switch n := n.(type) {
+		case float64:
+			inc[path] = int(n)
+		case int:
+			inc[path] = n
+		default:
+			return nil, ValidationError{
+				Err:         fmt.Errorf("invalid %s amount %v for %s: must be a number (entity index %d)", PATCH_INC, n, path, i),
+				Type:        "invalid-value-type",
+				EntityIndex: entityIndex(i),
+				Label:       path,
+			}
+		}
+	}
+	return inc, nil
+}
+
+// Schema returns nil if the entities conform to the label constraints in the
+// entity type schema: required labels, label types, and enum values. On create,
+// required labels must be set. On update, the entities are patches: only labels
+// in the patch are checked, and required labels cannot be removed. Call it after
+// Entities, which validates and normalizes label values and patch directives.
+func (v validator) Schema(entityType string, entities []etre.Entity, op byte) error {
+	labels := v.schema[entityType].Labels
+	if len(labels) == 0 {
+		return nil
+	}
+	for i, e := range entities {
+		for _, ls := range labels {
+			switch op {
+			case VALIDATE_ON_CREATE:
+				val, ok := e[ls.Name]
+				if (!ok || val == nil) && ls.Required {
+					return ValidationError{
+						Err:         fmt.Errorf("missing required label %s (entity index %d)", ls.Name, i),
+						Type:        "missing-required-label",
+						EntityIndex: entityIndex(i),
+						Label:       ls.Name,
+					}
+				}
+				if ok {
+					if err := schemaValue(ls, val, i); err != nil {
+						return err
 					}
 				}
+			case VALIDATE_ON_UPDATE:
+				if err := schemaPatch(ls, e, i); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// schemaPatch returns an error if the patch changes the schema label to a value
+// that does not conform to the label constraints.
+func schemaPatch(ls config.LabelSchema, patch etre.Entity, i int) error {
+	if val, ok := patch[ls.Name]; ok {
+		if val == nil && ls.Required {
+			return ValidationError{
+				Err:         fmt.Errorf("cannot set required label %s to null (entity index %d)", ls.Name, i),
+				Type:        "missing-required-label",
+				EntityIndex: entityIndex(i),
+				Label:       ls.Name,
+			}
+		}
+		if val != nil {
+			if err := schemaValue(ls, val, i); err != nil {
+				return err
+			}
+		}
+	}
+	if ls.Required {
+		for _, path := range patchUnset(patch) {
+			if path == ls.Name {
+				return ValidationError{
+					Err:         fmt.Errorf("cannot remove required label %s (entity index %d)", ls.Name, i),
+					Type:        "missing-required-label",
+					EntityIndex: entityIndex(i),
+					Label:       ls.Name,
+				}
+			}
+		}
+	}
+	if _, ok := patchInc(patch)[ls.Name]; ok && ((ls.Type != "" && ls.Type != config.LABEL_TYPE_INT) || len(ls.Enum) > 0) {
+		return ValidationError{
+			Err:         fmt.Errorf("cannot increment label %s: type %s or enum (entity index %d)", ls.Name, ls.Type, i),
+			Type:        "invalid-label-type",
+			EntityIndex: entityIndex(i),
+			Label:       ls.Name,
+		}
+	}
+	if ls.Type != "" {
+		for _, path := range patchPaths(patch) {
+			if strings.HasPrefix(path, ls.Name+".") {
+				return ValidationError{
+					Err:         fmt.Errorf("cannot change nested label path %s: label %s is type %s (entity index %d)", path, ls.Name, ls.Type, i),
+					Type:        "invalid-label-type",
+					EntityIndex: entityIndex(i),
+					Label:       path,
+				}
 			}
 		}
 	}
 	return nil
 }
 
+// schemaValue returns an error if the label value is not the schema label type
+// or not one of its enum values.
+func schemaValue(ls config.LabelSchema, val interface{}, i int) error {
+	var ok bool
+	switch ls.Type {
+	case config.LABEL_TYPE_STRING:
+		_, ok = val.(string)
+	case config.LABEL_TYPE_INT:
+		switch val.(type) {
+		case int, int32, int64:
+			ok = true
+		}
+	case config.LABEL_TYPE_BOOL:
+		_, ok = val.(bool)
+	default:
+		ok = true
+	}
+	if !ok {
+		return ValidationError{
+			Err:         fmt.Errorf("invalid value for label %s: %v: must be type %s (entity index %d)", ls.Name, val, ls.Type, i),
+			Type:        "invalid-label-type",
+			EntityIndex: entityIndex(i),
+			Label:       ls.Name,
+		}
+	}
+	if len(ls.Enum) == 0 {
+		return nil
+	}
+	s := fmt.Sprintf("%v", val)
+	for _, v := range ls.Enum {
+		if s == v {
+			return nil
+		}
+	}
+	return ValidationError{
+		Err:         fmt.Errorf("invalid value for label %s: %v: must be one of: %s (entity index %d)", ls.Name, val, strings.Join(ls.Enum, ", "), i),
+		Type:        "invalid-label-value",
+		EntityIndex: entityIndex(i),
+		Label:       ls.Name,
+	}
+}
+
 func (v validator) WriteOp(wo WriteOp) error {
 	if err := v.EntityType(wo.EntityType); err != nil {
 		return err
@@ -143,12 +614,117 @@ func (v validator) WriteOp(wo WriteOp) error {
 	return nil
 }
 
-func (v validator) DeleteLabel(label string) error {
+// DeleteLabel returns nil if the label can be deleted from entities of the type:
+// it's not a metalabel or a required label in the entity type schema.
+func (v validator) DeleteLabel(entityType, label string) error {
 	if etre.IsMetalabel(label) {
 		return ValidationError{
 			Err:  fmt.Errorf("cannot delete metalabel %s", label),
 			Type: "cannot-delete-metalabel",
 		}
 	}
+	return v.notRequired(entityType, label, "delete")
+}
+
+// RenameLabel returns nil if the label can be renamed to the new label in entities
+// of the type. Like DeleteLabel, renaming a required label is an error because
+// entities would no longer have it.
+func (v validator) RenameLabel(entityType, label, newLabel string) error {
+	if err := v.newLabel(label, newLabel); err != nil {
+		return err
+	}
+	return v.notRequired(entityType, label, "rename")
+}
+
+// notRequired returns a ValidationError if the label is required in the entity
+// type schema, else nil. The op is "delete" or "rename" for the error message.
+func (v validator) notRequired(entityType, label, op string) error {
+	for _, ls := range v.schema[entityType].Labels {
+		if ls.Name == label && ls.Required {
+			return ValidationError{
+				Err:   fmt.Errorf("cannot %s required label %s of entity type %s (schema)", op, label, entityType),
+				Type:  "missing-required-label",
+				Label: label,
+			}
+		}
+	}
+	return nil
+}
+
+// newLabel returns nil if the label can be given the new name.
+func (v validator) newLabel(label, newLabel string) error {
+	if etre.IsMetalabel(label) || etre.IsMetalabel(newLabel) {
+		return ValidationError{
+			Err:  fmt.Errorf("cannot rename metalabel %s to %s", label, newLabel),
+			Type: "cannot-change-metalabel",
+		}
+	}
+	if newLabel == "" {
+		return ValidationError{
+			Err:  fmt.Errorf("empty string new label"),
+			Type: "empty-string-label",
+		}
+	}
+	if strings.IndexAny(newLabel, " \t") != -1 {
+		return ValidationError{
+			Err:  fmt.Errorf("label cannot have whitesspace: '%s'", newLabel),
+			Type: "label-has-whitespace",
+		}
+	}
+	if err := v.labelName(newLabel); err != nil {
+		return ValidationError{
+			Err:  fmt.Errorf("new label: %s", err),
+			Type: "invalid-label",
+		}
+	}
+	if newLabel == label {
+		return ValidationError{
+			Err:  fmt.Errorf("new label %s is the same as the label", newLabel),
+			Type: "invalid-label",
+		}
+	}
+	return nil
+}
+
+// Aliases validates the label aliases of a query filter (etre.QueryFilter.Aliases).
+// Each alias must be a valid new name for its label, like RenameLabel, but required
+// labels can be aliased because aliases don't change entities. An alias
+// cannot be another aliased label or the alias of two labels because the result
+// would depend on the order of the aliases.
+func (v validator) Aliases(aliases map[string]string) error {
+	labels := make([]string, 0, len(aliases))
+	for label := range aliases {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels) // first error is deterministic
+
+	aliased := map[string]string{} // alias -> label
+	for _, label := range labels {
+		alias := aliases[label]
+		if label == "" {
+			return ValidationError{
+				Err:  fmt.Errorf("empty string label for alias %s", alias),
+				Type: "empty-string-label",
+			}
+		}
+		if err := v.newLabel(label, alias); err != nil {
+			verr := err.(ValidationError)
+			verr.Err = fmt.Errorf("invalid alias %s for label %s: %s", alias, label, verr.Err)
+			return verr
+		}
+		if _, ok := aliases[alias]; ok {
+			return ValidationError{
+				Err:  fmt.Errorf("alias %s for label %s is also an aliased label", alias, label),
+				Type: "invalid-alias",
+			}
+		}
+		if other, ok := aliased[alias]; ok {
+			return ValidationError{
+				Err:  fmt.Errorf("alias %s for labels %s and %s", alias, other, label),
+				Type: "invalid-alias",
+			}
+		}
+		aliased[alias] = label
+	}
 	return nil
 }
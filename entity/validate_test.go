@@ -3,12 +3,15 @@
 package entity_test
 
 import (
+	"fmt"
+	"regexp"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/square/etre"
+	"github.com/square/etre/config"
 	"github.com/square/etre/entity"
 )
 
@@ -31,6 +34,7 @@ func TestValidateCreateEntitiesErrorsMetalabels(t *testing.T) {
 		{"a": "b", "_rev": int64(0)},                  // _rev not allowed
 		{"a": "b", "_created": int64(0)},              // _created not allowed
 		{"a": "b", "_updated": int64(0)},              // _updated not allowed
+		{"a": "b", "_deleted": int64(0)},              // _deleted not allowed
 	}
 
 	for _, e := range invalid {
@@ -46,6 +50,107 @@ func TestValidateCreateEntitiesErrorsMetalabels(t *testing.T) {
 	}
 }
 
+func TestValidateSetLabels(t *testing.T) {
+	// Set op metalabels can be set on create, as set op metadata (all or none),
+	// but not as arbitrary data, and never on update
+	ok := []etre.Entity{{"a": "b", "_setId": "343", "_setOp": "something", "_setSize": float64(2)}}
+	require.NoError(t, validate.Entities(ok, entity.VALIDATE_ON_CREATE))
+	assert.Equal(t, etre.Set{Id: "343", Op: "something", Size: 2}, ok[0].Set())
+
+	invalid := []etre.Entity{
+		{"a": "b", "_setSize": 3},                                    // not all set
+		{"a": "b", "_setId": "343", "_setOp": "something"},           // not all set
+		{"a": "b", "_setId": "343", "_setOp": "op", "_setSize": "x"}, // size as data
+		{"a": "b", "_setId": "343", "_setOp": "op", "_setSize": 0},   // size not > 0
+		{"a": "b", "_setId": 343, "_setOp": "op", "_setSize": 1},     // id not string
+		{"a": "b", "_setId": "", "_setOp": "op", "_setSize": 1},      // id empty
+	}
+	for _, e := range invalid {
+		err := validate.Entities([]etre.Entity{e}, entity.VALIDATE_ON_CREATE)
+		assertValidationError(t, err, "invalid-set-label")
+	}
+
+	for _, label := range []string{"_setId", "_setOp", "_setSize"} {
+		err := validate.Entities([]etre.Entity{{label: "x"}}, entity.VALIDATE_ON_UPDATE)
+		assertValidationError(t, err, "cannot-change-metalabel")
+	}
+}
+
+func TestValidateLabelNames(t *testing.T) {
+	// Labels cannot contain . or $, or begin with _ (except metalabels)
+	for _, label := range []string{"a.b", "$set", "a$", "_foo"} {
+		err := validate.Entities([]etre.Entity{{label: "x"}}, entity.VALIDATE_ON_CREATE)
+		assertValidationError(t, err, "invalid-label")
+		if err != nil {
+			assert.Contains(t, err.Error(), label)
+		}
+	}
+
+	// On update, "a.b" is a nested label path, "$set" is an invalid path,
+	// and the label of a path is checked
+	require.NoError(t, validate.Entities([]etre.Entity{{"a.b": "x"}}, entity.VALIDATE_ON_UPDATE))
+	err := validate.Entities([]etre.Entity{{"$set": "x"}}, entity.VALIDATE_ON_UPDATE)
+	assertValidationError(t, err, "invalid-patch-path")
+	for _, patch := range []etre.Entity{
+		{"_foo": "x"},
+		{"_foo.b": "x"},
+		{"a$": "x"},
+		{entity.PATCH_INC: map[string]interface{}{"_foo": float64(1)}},
+	} {
+		err := validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE)
+		assertValidationError(t, err, "invalid-label")
+	}
+
+	// Existing labels that are not allowed can be removed
+	err = validate.Entities([]etre.Entity{{entity.PATCH_UNSET: []interface{}{"_foo"}}}, entity.VALIDATE_ON_UPDATE)
+	require.NoError(t, err)
+
+	// Label pattern (config.entity.label_pattern)
+	validate := entity.NewValidator(entityTypes).WithLabelPattern(regexp.MustCompile("^[a-z][a-z0-9-]*$"))
+	require.NoError(t, validate.Entities([]etre.Entity{{"rack-1": "x"}}, entity.VALIDATE_ON_CREATE))
+	err = validate.Entities([]etre.Entity{{"Rack": "x"}}, entity.VALIDATE_ON_CREATE)
+	assertValidationError(t, err, "invalid-label")
+	err = validate.Entities([]etre.Entity{{"Rack": "x"}}, entity.VALIDATE_ON_UPDATE)
+	assertValidationError(t, err, "invalid-label")
+	err = validate.RenameLabel(entityType, "rack", "Rack")
+	assertValidationError(t, err, "invalid-label")
+}
+
+func TestValidateLimits(t *testing.T) {
+	validate := entity.NewValidator(entityTypes).WithLimits(3, 10)
+
+	// At the limits; metalabels and removed labels don't count
+	ok := []etre.Entity{
+		{"a": "0123456789", "b": 1, "c": true, "_setId": "343", "_setOp": "op", "_setSize": 1},
+	}
+	require.NoError(t, validate.Entities(ok, entity.VALIDATE_ON_CREATE))
+	patch := etre.Entity{"a": "x", "b": "y", "c": "z", entity.PATCH_UNSET: []interface{}{"d", "e"}}
+	require.NoError(t, validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE))
+
+	// Too many labels
+	tooMany := etre.Entity{"a": 1, "b": 2, "c": 3, "d": 4}
+	err := validate.Entities([]etre.Entity{tooMany}, entity.VALIDATE_ON_CREATE)
+	assertValidationError(t, err, "entity-too-large")
+	err = validate.Entities([]etre.Entity{{"a": 1, "b": 2, entity.PATCH_INC: map[string]interface{}{"c": float64(1), "d": float64(1)}}}, entity.VALIDATE_ON_UPDATE)
+	assertValidationError(t, err, "entity-too-large")
+
+	// Oversized value
+	err = validate.Entities([]etre.Entity{{"a": "01234567890"}}, entity.VALIDATE_ON_CREATE)
+	assertValidationError(t, err, "entity-too-large")
+	if err != nil {
+		assert.Contains(t, err.Error(), "label a")
+	}
+	err = validate.Entities([]etre.Entity{{"a.b": "01234567890"}}, entity.VALIDATE_ON_UPDATE)
+	assertValidationError(t, err, "entity-too-large")
+
+	// No limits by default
+	big := etre.Entity{"a": string(make([]byte, 1000))}
+	for i := 0; i < 100; i++ {
+		big[fmt.Sprintf("l%d", i)] = i
+	}
+	require.NoError(t, entity.NewValidator(entityTypes).Entities([]etre.Entity{big}, entity.VALIDATE_ON_CREATE))
+}
+
 func TestValidateCreateEntitiesErrorsWhitespace(t *testing.T) {
 	invalid := []etre.Entity{
 		{" ": "b"},   // label can't be space
@@ -83,6 +188,96 @@ func TestValidateCreateEntitiesErrorsWhitespace(t *testing.T) {
 	}
 }
 
+func TestValidateUpdateNestedPatch(t *testing.T) {
+	// Nested label paths and the $unset patch directive are valid on update.
+	// $unset decoded from JSON is a []interface{}, which is made a []string.
+	patch := etre.Entity{
+		"a.b":              1.0,
+		entity.PATCH_UNSET: []interface{}{"c", "a.d"},
+	}
+	err := validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE)
+	require.NoError(t, err)
+	assert.Equal(t, etre.Entity{"a.b": 1, entity.PATCH_UNSET: []string{"c", "a.d"}}, patch)
+
+	invalid := map[string]etre.Entity{
+		"cannot-change-metalabel": {"_rev.x": 1},
+		"invalid-patch-path":      {"a..b": 1},
+		"invalid-value-type":      {entity.PATCH_UNSET: "a"},
+	}
+	for errType, e := range invalid {
+		err := validate.Entities([]etre.Entity{e}, entity.VALIDATE_ON_UPDATE)
+		require.Error(t, err, "no error patching entity, expected one: %+v", e)
+		assertValidationError(t, err, errType)
+	}
+	err = validate.Entities([]etre.Entity{{entity.PATCH_UNSET: []interface{}{"_id"}}}, entity.VALIDATE_ON_UPDATE)
+	assertValidationError(t, err, "cannot-change-metalabel")
+}
+
+func TestValidateUpdateInc(t *testing.T) {
+	// $inc decoded from JSON is a map[string]interface{} of float64 amounts,
+	// which are made ints like label values
+	patch := etre.Entity{
+		"a":              "x",
+		entity.PATCH_INC: map[string]interface{}{"b": 1.0, "c.d": -2.0},
+	}
+	err := validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE)
+	require.NoError(t, err)
+	expect := etre.Entity{
+		"a":              "x",
+		entity.PATCH_INC: map[string]interface{}{"b": 1, "c.d": -2},
+	}
+	assert.Equal(t, expect, patch)
+
+	invalid := map[string]etre.Entity{
+		"invalid-value-type":      {entity.PATCH_INC: map[string]interface{}{"b": "1"}},
+		"cannot-change-metalabel": {entity.PATCH_INC: map[string]interface{}{"_rev": 1}},
+		"patch-conflict":          {"b": 1, entity.PATCH_INC: map[string]interface{}{"b": 1}},
+	}
+	for errType, e := range invalid {
+		err := validate.Entities([]etre.Entity{e}, entity.VALIDATE_ON_UPDATE)
+		require.Error(t, err, "no error patching entity, expected one: %+v", e)
+		assertValidationError(t, err, errType)
+	}
+	err = validate.Entities([]etre.Entity{{entity.PATCH_INC: 1}}, entity.VALIDATE_ON_UPDATE)
+	assertValidationError(t, err, "invalid-value-type")
+}
+
+func TestJSONPatch(t *testing.T) {
+	patch, err := entity.JSONPatch([]etre.JSONPatchOp{
+		{Op: "add", Path: "/a", Value: "x"},
+		{Op: "replace", Path: "/b/c~1d/e~0f", Value: 1}, // ~1 = /, ~0 = ~
+		{Op: "remove", Path: "/g"},
+		{Op: "remove", Path: "/b/h"},
+	})
+	require.NoError(t, err)
+	expect := etre.Entity{
+		"a":                "x",
+		"b.c/d.e~f":        1,
+		entity.PATCH_UNSET: []string{"g", "b.h"},
+	}
+	assert.Equal(t, expect, patch)
+	assert.ElementsMatch(t, []string{"a", "b", "g"}, entity.PatchLabels(patch))
+
+	invalid := [][]etre.JSONPatchOp{
+		{},                             // no ops
+		{{Op: "test", Path: "/a"}},     // op not supported
+		{{Op: "add", Path: ""}},        // root
+		{{Op: "add", Path: "/"}},       // empty label
+		{{Op: "add", Path: "/a//b"}},   // empty field
+		{{Op: "add", Path: "/a/-"}},    // array append
+		{{Op: "add", Path: "/a/$set"}}, // operator
+		{{Op: "add", Path: "/a.b"}},    // "." in label
+		{{Op: "add", Path: "/a"}, {Op: "remove", Path: "/a"}},   // same path
+		{{Op: "add", Path: "/a/b"}, {Op: "remove", Path: "/a"}}, // parent path
+	}
+	for _, ops := range invalid {
+		_, err := entity.JSONPatch(ops)
+		require.Error(t, err, "no error for ops %+v, expected one", ops)
+		_, ok := err.(entity.ValidationError)
+		assert.True(t, ok, "error is %T, expected entity.ValidationError", err)
+	}
+}
+
 func TestValidateWriteOpOK(t *testing.T) {
 	wo := entity.WriteOp{
 		EntityType: "grue",
@@ -94,12 +289,146 @@ func TestValidateWriteOpOK(t *testing.T) {
 }
 
 func TestValidateDeleteLabel(t *testing.T) {
-	err := validate.DeleteLabel("foo")
+	err := validate.DeleteLabel(entityType, "foo")
 	require.NoError(t, err)
-	err = validate.DeleteLabel("_id")
+	err = validate.DeleteLabel(entityType, "_id")
 	require.Error(t, err)
 }
 
+func TestValidateRenameLabel(t *testing.T) {
+	err := validate.RenameLabel(entityType, "dc", "datacenter")
+	require.NoError(t, err)
+
+	invalid := map[string][2]string{
+		"cannot-change-metalabel": {"_id", "id"},
+		"empty-string-label":      {"dc", ""},
+		"label-has-whitespace":    {"dc", "data center"},
+		"invalid-label":           {"dc", "data.center"},
+	}
+	for errType, labels := range invalid {
+		err := validate.RenameLabel(entityType, labels[0], labels[1])
+		assertValidationError(t, err, errType)
+	}
+	err = validate.RenameLabel(entityType, "dc", "_type")
+	assertValidationError(t, err, "cannot-change-metalabel")
+	err = validate.RenameLabel(entityType, "dc", "dc")
+	assertValidationError(t, err, "invalid-label")
+}
+
+func TestValidateAliases(t *testing.T) {
+	err := validate.Aliases(map[string]string{"dc": "datacenter", "y": "letter"})
+	require.NoError(t, err)
+	err = validate.Aliases(nil)
+	require.NoError(t, err)
+
+	invalid := map[string]map[string]string{
+		"cannot-change-metalabel": {"_id": "id"},
+		"empty-string-label":      {"dc": ""},
+		"label-has-whitespace":    {"dc": "data center"},
+		"invalid-label":           {"dc": "data.center"},
+	}
+	for errType, aliases := range invalid {
+		err := validate.Aliases(aliases)
+		assertValidationError(t, err, errType)
+	}
+
+	// Alias is another aliased label, or the alias of two labels
+	err = validate.Aliases(map[string]string{"a": "b", "b": "c"})
+	assertValidationError(t, err, "invalid-alias")
+	err = validate.Aliases(map[string]string{"a": "c", "b": "c"})
+	assertValidationError(t, err, "invalid-alias")
+}
+
+func TestValidateSchema(t *testing.T) {
+	validate := entity.NewValidator(entityTypes).WithSchema(map[string]config.SchemaConfig{
+		entityType: {Labels: []config.LabelSchema{
+			{Name: "zone"}, // no constraints
+			{Name: "env", Required: true, Type: config.LABEL_TYPE_STRING, Enum: []string{"prod", "staging"}},
+			{Name: "cpus", Type: config.LABEL_TYPE_INT, Enum: []string{"8", "16"}},
+			{Name: "active", Type: config.LABEL_TYPE_BOOL},
+		}},
+	})
+
+	// Create: values normalized by Entities first, like the API
+	ok := []etre.Entity{
+		{"env": "prod"},
+		{"env": "staging", "cpus": float64(16), "active": true, "zone": 1, "other": "x"},
+	}
+	require.NoError(t, validate.Entities(ok, entity.VALIDATE_ON_CREATE))
+	require.NoError(t, validate.Schema(entityType, ok, entity.VALIDATE_ON_CREATE))
+
+	invalid := map[string]etre.Entity{
+		"missing-required-label": {"cpus": 8},
+		"invalid-label-value":    {"env": "dev"},
+		"invalid-label-type":     {"env": "prod", "active": "yes"},
+	}
+	for errType, e := range invalid {
+		err := validate.Schema(entityType, []etre.Entity{e}, entity.VALIDATE_ON_CREATE)
+		assertValidationError(t, err, errType)
+	}
+	err := validate.Schema(entityType, []etre.Entity{{"env": "prod", "cpus": 4}}, entity.VALIDATE_ON_CREATE)
+	assertValidationError(t, err, "invalid-label-value")
+	assert.Contains(t, err.Error(), "cpus") // names the label
+
+	// Update: only patch labels are checked, so required labels can be omitted
+	patch := etre.Entity{"cpus": 8}
+	require.NoError(t, validate.Schema(entityType, []etre.Entity{patch}, entity.VALIDATE_ON_UPDATE))
+	invalidPatches := map[string]etre.Entity{
+		"invalid-label-value":    {"env": "dev"},
+		"invalid-label-type":     {"cpus": "8"},
+		"missing-required-label": {"env": nil},
+	}
+	for errType, e := range invalidPatches {
+		err := validate.Schema(entityType, []etre.Entity{e}, entity.VALIDATE_ON_UPDATE)
+		assertValidationError(t, err, errType)
+	}
+	patches := map[string]etre.Entity{
+		"missing-required-label": {entity.PATCH_UNSET: []interface{}{"env"}},
+		"invalid-label-type":     {entity.PATCH_INC: map[string]interface{}{"cpus": float64(1)}}, // enum
+	}
+	for errType, e := range patches {
+		require.NoError(t, validate.Entities([]etre.Entity{e}, entity.VALIDATE_ON_UPDATE))
+		err := validate.Schema(entityType, []etre.Entity{e}, entity.VALIDATE_ON_UPDATE)
+		assertValidationError(t, err, errType)
+	}
+	err = validate.Schema(entityType, []etre.Entity{{"env.x": "a"}}, entity.VALIDATE_ON_UPDATE)
+	assertValidationError(t, err, "invalid-label-type")
+
+	// Required labels cannot be deleted or renamed, but can be aliased
+	assertValidationError(t, validate.DeleteLabel(entityType, "env"), "missing-required-label")
+	assertValidationError(t, validate.RenameLabel(entityType, "env", "environment"), "missing-required-label")
+	require.NoError(t, validate.DeleteLabel(entityType, "cpus"))
+	require.NoError(t, validate.RenameLabel(entityType, "cpus", "cores"))
+	require.NoError(t, validate.DeleteLabel("other", "env"))
+	require.NoError(t, validate.Aliases(map[string]string{"env": "environment"}))
+
+	// No schema for entity type: nothing to validate
+	require.NoError(t, validate.Schema("other", []etre.Entity{{"cpus": "x"}}, entity.VALIDATE_ON_CREATE))
+}
+
+func TestValidateErrorEntityIndexLabel(t *testing.T) {
+	// Errors for one entity have its index, and errors for one label have the label
+	validate := entity.NewValidator([]string{entityType})
+	entities := []etre.Entity{{"a": "ok"}, {"b": "ok", "c d": "ok"}}
+	err := validate.Entities(entities, entity.VALIDATE_ON_CREATE)
+	assertValidationError(t, err, "label-has-whitespace")
+	ve := err.(entity.ValidationError)
+	require.NotNil(t, ve.EntityIndex)
+	assert.Equal(t, 1, *ve.EntityIndex)
+	assert.Equal(t, "c d", ve.Label)
+
+	err = validate.Entities([]etre.Entity{{"_setId": "1"}}, entity.VALIDATE_ON_CREATE)
+	assertValidationError(t, err, "invalid-set-label")
+	ve = err.(entity.ValidationError)
+	require.NotNil(t, ve.EntityIndex)
+	assert.Equal(t, 0, *ve.EntityIndex)
+	assert.Equal(t, "", ve.Label) // not one label
+
+	err = validate.EntityType("bad")
+	assertValidationError(t, err, "invalid-entity-type")
+	assert.Nil(t, err.(entity.ValidationError).EntityIndex) // not one entity
+}
+
 // assertValidationError asserts the error to be a non-nil ValidationError and asserts the expected type.
 func assertValidationError(t *testing.T, err error, expectedType string) {
 	// Ugly asserts and returns instead of require so that the test can continue
@@ -7,13 +7,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,15 +25,76 @@ import (
 // an entity type argument because a client is bound to only one entity type.
 // Use a EntityClients map to pass multiple clients for different entity types.
 type EntityClient interface {
-	// Query returns entities that match the query and pass the filter.
+	// Query returns entities that match the query and pass the filter. If the client
+	// was made with EntityClientConfig.ETagCache and the result has not changed since
+	// the last same query, it returns ErrNotModified and no entities.
 	Query(ctx context.Context, query string, filter QueryFilter) ([]Entity, error)
 
-	// Get returns a single entity by internal ID.
+	// QueryBatch runs several queries in one request. Results are in the same order
+	// as the requests. If a query fails, its QueryResult.Error is set but the other
+	// queries are not affected. The returned error is set only if the whole request fails.
+	QueryBatch(ctx context.Context, reqs []QueryRequest) ([]QueryResult, error)
+
+	// GroupCount returns the number of entities that match the query for each value
+	// of the label. Values are strings; entities without the label are counted in
+	// the empty string value. The server counts entities; they are not returned.
+	GroupCount(ctx context.Context, query string, label string) (map[string]int64, error)
+
+	// Exists returns true if at least one entity matches the query. It's cheaper
+	// than Query because the server reads only the id of the first matching entity
+	// and returns no entities.
+	Exists(ctx context.Context, query string) (bool, error)
+
+	// ExportStream returns entities that match the query, or all entities if the
+	// query is empty, as newline-delimited JSON (one entity per line) streamed from
+	// the server. Only filter.ReturnLabels, filter.IncludeDeleted, and filter.Aliases
+	// apply. The caller must close the stream. Read returns the error if the export
+	// fails after it started, so the export is complete only if Read returns io.EOF.
+	// Exporting many entities can take longer than the default query timeout: set
+	// EntityClientConfig.QueryTimeout.
+	ExportStream(ctx context.Context, query string, filter QueryFilter) (io.ReadCloser, error)
+
+	// Get returns a single entity by internal ID. It's ReadOne with no filter.
 	Get(ctx context.Context, id string) (Entity, error)
 
-	// Insert is a bulk operation that creates the given entities.
+	// ReadOne returns a single entity by internal ID. Only filter.ReturnLabels,
+	// filter.IncludeDeleted, and filter.Aliases apply; other filter fields are
+	// ignored. If the entity does not exist, it returns ErrEntityNotFound.
+	ReadOne(ctx context.Context, id string, filter QueryFilter) (Entity, error)
+
+	// History returns all CDC events for the given entity by internal ID, oldest
+	// first. It returns events for deleted entities, too, as far back as CDC
+	// retention. It requires CDC access.
+	History(ctx context.Context, id string) ([]CDCEvent, error)
+
+	// ReadByIds returns entities by internal ID in one request. The returned entities
+	// are in the same order as the ids: one per id, or nil if not found. A duplicate
+	// id returns the same entity more than once.
+	ReadByIds(ctx context.Context, ids []string) ([]Entity, error)
+
+	// Insert is a bulk operation that creates the given entities. Like all write
+	// methods, if the API returns WriteResult.Error, the error is set, too: it
+	// matches the Err* var for the error type, like ErrDuplicate, with errors.Is.
 	Insert(ctx context.Context, entities []Entity) (WriteResult, error)
 
+	// InsertIfNotExists creates the entity only if no entity matches the query.
+	// The check and insert are atomic on the server only if the entity collection
+	// has a unique index on the query labels. If inserted, WriteResult.Writes[0]
+	// has the new entity ID and no Diff. If an entity already matches the query,
+	// nothing is written and WriteResult.Writes[0].Diff is the existing entity.
+	// Unlike Insert, an existing entity is not an error.
+	InsertIfNotExists(ctx context.Context, query string, entity Entity) (WriteResult, error)
+
+	// ImportStream creates entities read from r as newline-delimited JSON (one
+	// entity per line) streamed to the server, which inserts them in batches. Unlike
+	// Insert, an entity that is not inserted does not stop the import: it's counted
+	// in ImportResult.Failed with its error in ImportResult.Errors, and the error is
+	// nil. The error is set (and ImportResult.Error, if from the API) only if the
+	// import stopped before the end of r. It is not retried because r is read once.
+	// Importing many entities can take longer than the default query timeout: set
+	// EntityClientConfig.QueryTimeout.
+	ImportStream(ctx context.Context, r io.Reader) (ImportResult, error)
+
 	// Update is a bulk operation that patches entities that match the query.
 	Update(ctx context.Context, query string, patch Entity) (WriteResult, error)
 
@@ -42,13 +107,37 @@ type EntityClient interface {
 	// DeleteOne removes the given entity by internal ID.
 	DeleteOne(ctx context.Context, id string) (WriteResult, error)
 
+	// DeleteAll removes all entities of the entity type, including soft-deleted
+	// entities. It requires admin access, and confirm must be the entity type.
+	// The returned entities have only meta-labels _id, _type, and _rev.
+	DeleteAll(ctx context.Context, confirm string) (WriteResult, error)
+
+	// Restore is a bulk operation that restores all soft-deleted entities that match
+	// the query. Matching entities that are not soft-deleted are ignored.
+	Restore(ctx context.Context, query string) (WriteResult, error)
+
+	// RestoreOne restores the given soft-deleted entity by internal ID. It's an
+	// error if the entity is not soft-deleted.
+	RestoreOne(ctx context.Context, id string) (WriteResult, error)
+
 	// Labels returns all labels on the given entity by internal ID.
 	Labels(ctx context.Context, id string) ([]string, error)
 
 	// DeleteLabel removes the given label from the given entity by internal ID.
-	// Labels should be stable, long-lived. Consequently, there's no bulk label delete.
+	// Labels should be stable, long-lived. For migrations, use DeleteLabelByQuery.
 	DeleteLabel(ctx context.Context, id string, label string) (WriteResult, error)
 
+	// DeleteLabelByQuery is a bulk operation that removes the given label from all
+	// entities that match the query. It requires an admin role because labels
+	// should be stable, long-lived; use it to remove a deprecated label.
+	DeleteLabelByQuery(ctx context.Context, query string, label string) (WriteResult, error)
+
+	// RenameLabel is a bulk operation that renames the given label to newLabel in all
+	// entities that match the query. Like DeleteLabelByQuery, it requires an admin role.
+	// If overwrite is false and a matching entity already has newLabel, nothing is
+	// renamed and an error is returned; if true, the value of newLabel is replaced.
+	RenameLabel(ctx context.Context, query string, label, newLabel string, overwrite bool) (WriteResult, error)
+
 	// EntityType returns the entity type of the client.
 	EntityType() string
 
@@ -66,6 +155,12 @@ type EntityClient interface {
 	// for server-side metrics. The trace string is a comma-separated list of key=value
 	// pairs like: app=foo,host=bar. Invalid trace values are silently ignored by the server.
 	WithTrace(string) EntityClient
+
+	// WithHeaders returns a new EntityClient that sends the headers with every request,
+	// like an auth token or routing hint for a gateway in front of Etre. Headers are
+	// added to headers set by previous calls, and replace the values of the same header.
+	// Etre headers, like TRACE_HEADER and QUERY_TIMEOUT_HEADER, take precedence.
+	WithHeaders(http.Header) EntityClient
 }
 
 // EntityClientConfig represents required and optional configuration for an EntityClient.
@@ -78,6 +173,9 @@ type EntityClientConfig struct {
 	RetryWait    time.Duration // optional wait time between retries
 	RetryLogging bool          // log error on retry to stderr
 	QueryTimeout time.Duration // timeout passed to API via etre.QUERY_TIMEOUT_HEADER
+	QueryVersion int           // optional query language version passed to API via etre.QUERY_VERSION_HEADER
+	ETagCache    bool          // Query returns ErrNotModified if the result has not changed (see EntityClient.Query)
+	Headers      http.Header   // optional headers sent with every request (see EntityClient.WithHeaders)
 	Debug        bool
 }
 
@@ -109,6 +207,9 @@ type entityClient struct {
 	retryWait        time.Duration
 	retryLogging     bool
 	queryTimeout     time.Duration
+	queryVersion     int
+	etags            *etagCache  // nil unless EntityClientConfig.ETagCache
+	headers          http.Header // custom headers (see WithHeaders)
 }
 
 // NewEntityClient creates a new type-specific Etre API client that makes requests
@@ -127,7 +228,7 @@ func NewEntityClient(entityType, addr string, httpClient *http.Client) EntityCli
 
 func NewEntityClientWithConfig(c EntityClientConfig) EntityClient {
 	DebugEnabled = c.Debug
-	return entityClient{
+	ec := entityClient{
 		entityType:   c.EntityType,
 		addr:         c.Addr,
 		httpClient:   c.HTTPClient,
@@ -135,7 +236,13 @@ func NewEntityClientWithConfig(c EntityClientConfig) EntityClient {
 		retryWait:    c.RetryWait,
 		retryLogging: c.RetryLogging,
 		queryTimeout: c.QueryTimeout,
+		queryVersion: c.QueryVersion,
+		headers:      mergeHeaders(nil, c.Headers),
+	}
+	if c.ETagCache {
+		ec.etags = &etagCache{mux: &sync.Mutex{}, tags: map[string]string{}}
 	}
+	return ec
 }
 
 func (c entityClient) WithSet(set Set) EntityClient {
@@ -151,6 +258,31 @@ func (c entityClient) WithTrace(trace string) EntityClient {
 	return new
 }
 
+func (c entityClient) WithHeaders(h http.Header) EntityClient {
+	new := c
+	new.headers = mergeHeaders(c.headers, h) // copy, c.headers not modified
+	return new
+}
+
+// mergeHeaders returns a copy of dst with the headers in src. A header in src
+// replaces all values of the same header in dst. It returns nil if both are empty.
+func mergeHeaders(dst, src http.Header) http.Header {
+	if len(dst) == 0 && len(src) == 0 {
+		return nil
+	}
+	h := dst.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	for k, v := range src {
+		h.Del(k)
+		for _, s := range v {
+			h.Add(k, s)
+		}
+	}
+	return h
+}
+
 func (c entityClient) Query(ctx context.Context, query string, filter QueryFilter) ([]Entity, error) {
 	if query == "" {
 		return nil, ErrNoQuery
@@ -168,13 +300,39 @@ func (c entityClient) Query(ctx context.Context, query string, filter QueryFilte
 	if filter.Limit > 0 {
 		path += "&limit=" + strconv.FormatInt(filter.Limit, 10)
 	}
+	if filter.IncludeDeleted {
+		path += "&deleted"
+	}
+	if filter.Hint != "" {
+		path += "&hint=" + url.QueryEscape(filter.Hint)
+	}
+	if filter.Sort != "" {
+		path += "&sort=" + url.QueryEscape(filter.Sort)
+	}
+	if filter.MaxTimeMS > 0 {
+		path += "&maxTimeMS=" + strconv.FormatInt(filter.MaxTimeMS, 10)
+	}
+	if filter.Collation != nil {
+		path += "&collation=" + url.QueryEscape(filter.Collation.String())
+	}
+	if len(filter.Aliases) > 0 {
+		path += "&aliases=" + aliasesParam(filter.Aliases)
+	}
 
 	var entities []Entity
 	err := c.apiRetry(func() (bool, error) {
-		resp, bytes, err := c.do(ctx, "GET", path, nil)
+		var header http.Header
+		key := c.etagKey(path)
+		if tag := c.etags.get(key); tag != "" {
+			header = http.Header{"If-None-Match": {tag}}
+		}
+		resp, bytes, err := c.doRequest(ctx, "GET", path, nil, header)
 		if err != nil {
 			return false, err
 		}
+		if resp.StatusCode == http.StatusNotModified {
+			return true, ErrNotModified
+		}
 		if resp.StatusCode != http.StatusOK {
 			return readError(resp, bytes)
 		}
@@ -183,18 +341,208 @@ func (c entityClient) Query(ctx context.Context, query string, filter QueryFilte
 				return false, err
 			}
 		}
+		c.etags.set(key, resp.Header.Get("ETag"))
 		return true, nil
 	})
 	return entities, err
 }
 
+func (c entityClient) QueryBatch(ctx context.Context, reqs []QueryRequest) ([]QueryResult, error) {
+	if len(reqs) == 0 {
+		return nil, ErrNoQuery
+	}
+	for _, r := range reqs {
+		if r.Query == "" {
+			return nil, ErrNoQuery
+		}
+	}
+	Debug("batch query: %+v", reqs)
+	payload, err := json.Marshal(reqs)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %s", err)
+	}
+
+	var results []QueryResult
+	err = c.apiRetry(func() (bool, error) {
+		resp, bytes, err := c.do(ctx, "POST", "/entities/"+c.entityType+"/batch-query", payload)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		results = nil // reset on retry
+		if len(bytes) > 0 {
+			if err := json.Unmarshal(bytes, &results); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	return results, err
+}
+
+func (c entityClient) GroupCount(ctx context.Context, query string, label string) (map[string]int64, error) {
+	if query == "" {
+		return nil, ErrNoQuery
+	}
+	if label == "" {
+		return nil, ErrNoLabel
+	}
+	Debug("query='%s', groupBy=%s", query, label)
+
+	path := "/entities/" + c.entityType + "/aggregate?query=" + url.QueryEscape(query) + "&groupBy=" + url.QueryEscape(label)
+	var counts map[string]int64
+	err := c.apiRetry(func() (bool, error) {
+		resp, bytes, err := c.do(ctx, "GET", path, nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		var groups []GroupCount
+		if len(bytes) > 0 {
+			if err := json.Unmarshal(bytes, &groups); err != nil {
+				return false, err
+			}
+		}
+		counts = make(map[string]int64, len(groups))
+		for _, g := range groups {
+			var v string
+			if g.Value != nil {
+				v = fmt.Sprintf("%v", g.Value)
+			}
+			counts[v] += g.Count
+		}
+		return true, nil
+	})
+	return counts, err
+}
+
+func (c entityClient) Exists(ctx context.Context, query string) (bool, error) {
+	if query == "" {
+		return false, ErrNoQuery
+	}
+	Debug("exists query='%s'", query)
+
+	path := "/entities/" + c.entityType + "?query=" + url.QueryEscape(query)
+	var exists bool
+	err := c.apiRetry(func() (bool, error) {
+		resp, bytes, err := c.do(ctx, "HEAD", path, nil)
+		if err != nil {
+			return false, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			exists = true
+			return true, nil
+		case http.StatusNotFound:
+			exists = false
+			return true, nil
+		}
+		return readError(resp, bytes)
+	})
+	return exists, err
+}
+
+func (c entityClient) ExportStream(ctx context.Context, query string, filter QueryFilter) (io.ReadCloser, error) {
+	Debug("export query='%s', filter=%+v", query, filter)
+
+	path := "/entities/" + c.entityType + "/export"
+	var params []string
+	if query != "" {
+		params = append(params, "query="+url.QueryEscape(query))
+	}
+	if len(filter.ReturnLabels) > 0 {
+		params = append(params, "labels="+url.QueryEscape(strings.Join(filter.ReturnLabels, ",")))
+	}
+	if filter.IncludeDeleted {
+		params = append(params, "deleted")
+	}
+	if len(filter.Aliases) > 0 {
+		params = append(params, "aliases="+aliasesParam(filter.Aliases))
+	}
+	if len(params) > 0 {
+		path += "?" + strings.Join(params, "&")
+	}
+
+	// Retry only until the response starts; the stream cannot be retried
+	var stream io.ReadCloser
+	err := c.apiRetry(func() (bool, error) {
+		resp, err := c.send(ctx, "GET", path, nil, nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			bytes, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return false, fmt.Errorf("ioutil.ReadAll: %s", err)
+			}
+			return readError(resp, bytes)
+		}
+		stream = exportStream{resp: resp}
+		return true, nil
+	})
+	return stream, err
+}
+
+// exportStream is the response body of an export. At the end of the body, Read
+// returns the error from the etre.ERROR_TRAILER, if any, instead of io.EOF.
+type exportStream struct {
+	resp *http.Response
+}
+
+func (s exportStream) Read(p []byte) (int, error) {
+	n, err := s.resp.Body.Read(p)
+	if err == io.EOF {
+		if trailer := s.resp.Trailer.Get(ERROR_TRAILER); trailer != "" {
+			var e Error
+			if jerr := json.Unmarshal([]byte(trailer), &e); jerr != nil || e.Type == "" {
+				return n, fmt.Errorf("%s: export failed: %s", errorPrefix(s.resp), trailer)
+			}
+			if e.HTTPStatus >= 500 {
+				return n, apiError{prefix: "Server error", err: e}
+			}
+			return n, apiError{prefix: "Client error", err: e}
+		}
+	}
+	return n, err
+}
+
+func (s exportStream) Close() error {
+	return s.resp.Body.Close()
+}
+
 func (c entityClient) Get(ctx context.Context, id string) (Entity, error) {
+	return c.ReadOne(ctx, id, QueryFilter{})
+}
+
+func (c entityClient) ReadOne(ctx context.Context, id string, filter QueryFilter) (Entity, error) {
 	if id == "" {
 		return nil, ErrIdNotSet
 	}
+	Debug("id=%s, filter=%+v", id, filter)
+
+	path := "/entity/" + c.entityType + "/" + url.PathEscape(id)
+	var params []string
+	if len(filter.ReturnLabels) > 0 {
+		params = append(params, "labels="+url.QueryEscape(strings.Join(filter.ReturnLabels, ",")))
+	}
+	if filter.IncludeDeleted {
+		params = append(params, "deleted")
+	}
+	if len(filter.Aliases) > 0 {
+		params = append(params, "aliases="+aliasesParam(filter.Aliases))
+	}
+	if len(params) > 0 {
+		path += "?" + strings.Join(params, "&")
+	}
+
 	var entity Entity
 	err := c.apiRetry(func() (bool, error) {
-		resp, bytes, err := c.do(ctx, "GET", "/entity/"+c.entityType+"/"+url.PathEscape(id), nil)
+		resp, bytes, err := c.do(ctx, "GET", path, nil)
 		if err != nil {
 			return false, err
 		}
@@ -211,6 +559,61 @@ func (c entityClient) Get(ctx context.Context, id string) (Entity, error) {
 	return entity, err
 }
 
+func (c entityClient) History(ctx context.Context, id string) ([]CDCEvent, error) {
+	if id == "" {
+		return nil, ErrIdNotSet
+	}
+	var events []CDCEvent
+	err := c.apiRetry(func() (bool, error) {
+		resp, bytes, err := c.do(ctx, "GET", "/entity/"+c.entityType+"/"+url.PathEscape(id)+"/history", nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		if err := json.Unmarshal(bytes, &events); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	return events, err
+}
+
+func (c entityClient) ReadByIds(ctx context.Context, ids []string) ([]Entity, error) {
+	if len(ids) == 0 {
+		return nil, ErrNoEntity
+	}
+	for _, id := range ids {
+		if id == "" {
+			return nil, ErrIdNotSet
+		}
+	}
+	payload, err := json.Marshal(ids)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %s", err)
+	}
+
+	var entities []Entity
+	err = c.apiRetry(func() (bool, error) {
+		resp, bytes, err := c.do(ctx, "POST", "/entities/"+c.entityType+"/by-ids", payload)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp, bytes)
+		}
+		entities = nil // reset on retry
+		if len(bytes) > 0 {
+			if err := json.Unmarshal(bytes, &entities); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	return entities, err
+}
+
 func (c entityClient) Insert(ctx context.Context, entities []Entity) (WriteResult, error) {
 	if len(entities) == 0 {
 		return WriteResult{}, ErrNoEntity
@@ -220,6 +623,57 @@ func (c entityClient) Insert(ctx context.Context, entities []Entity) (WriteResul
 	return c.write(ctx, entities, 1, "POST", "/entities/"+c.entityType)
 }
 
+func (c entityClient) InsertIfNotExists(ctx context.Context, query string, entity Entity) (WriteResult, error) {
+	if query == "" {
+		return WriteResult{}, ErrNoQuery
+	}
+	if len(entity) == 0 {
+		return WriteResult{}, ErrNoEntity
+	}
+	Debug("query='%s', entity=%+v", query, entity)
+	query = url.QueryEscape(query) // always escape the query
+	return c.write(ctx, entity, 1, "POST", "/entity/"+c.entityType+"?query="+query)
+}
+
+func (c entityClient) ImportStream(ctx context.Context, r io.Reader) (ImportResult, error) {
+	Debug("import")
+	var res ImportResult
+
+	endpoint := "/entities/" + c.entityType + "/import"
+	if c.set.Size > 0 {
+		endpoint += fmt.Sprintf("?setId=%s&setOp=%s&setSize=%d", c.set.Id, c.set.Op, c.set.Size)
+	}
+
+	// No apiRetry: r cannot be sent again
+	header := http.Header{"Content-Type": []string{NDJSON_CONTENT_TYPE}}
+	resp, err := c.send(ctx, "POST", endpoint, r, header)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return res, fmt.Errorf("ioutil.ReadAll: %s", err)
+	}
+
+	// On import, API should return an etre.ImportResult, but if API crashes
+	// there won't be response data, and a proxy might return its own error
+	if len(bytes) == 0 || json.Unmarshal(bytes, &res) != nil {
+		_, err := readError(resp, bytes)
+		return ImportResult{}, err
+	}
+	Debug("import result: %+v", res)
+	if res.Error != nil {
+		res.Error.HTTPStatus = resp.StatusCode
+		return res, apiError{prefix: errorPrefix(resp), err: *res.Error}
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, err := readError(resp, bytes)
+		return res, err
+	}
+	return res, nil
+}
+
 func (c entityClient) Update(ctx context.Context, query string, patch Entity) (WriteResult, error) {
 	if query == "" {
 		return WriteResult{}, ErrNoQuery
@@ -241,11 +695,7 @@ func (c entityClient) UpdateOne(ctx context.Context, id string, patch Entity) (W
 	Debug("_id=%s, patch=%+v", id, patch)
 	// Let API return error if patch contains (meta)labels that cannot be updated,
 	// e.g. _id. Currently, the API does not allow any metalabels in the patch.
-	wr, err := c.write(ctx, patch, 1, "PUT", "/entity/"+c.entityType+"/"+id)
-	if err != nil {
-		return WriteResult{}, err
-	}
-	return wr, nil
+	return c.write(ctx, patch, 1, "PUT", "/entity/"+c.entityType+"/"+url.PathEscape(id))
 }
 
 func (c entityClient) Delete(ctx context.Context, query string) (WriteResult, error) {
@@ -262,11 +712,29 @@ func (c entityClient) DeleteOne(ctx context.Context, id string) (WriteResult, er
 		return WriteResult{}, ErrIdNotSet
 	}
 	Debug("_id=%s", id)
-	wr, err := c.write(ctx, nil, 1, "DELETE", "/entity/"+c.entityType+"/"+id)
-	if err != nil {
-		return WriteResult{}, err
+	return c.write(ctx, nil, 1, "DELETE", "/entity/"+c.entityType+"/"+url.PathEscape(id))
+}
+
+func (c entityClient) DeleteAll(ctx context.Context, confirm string) (WriteResult, error) {
+	Debug("confirm='%s'", confirm)
+	return c.write(ctx, nil, -1, "DELETE", "/entities/"+c.entityType+"/all?confirm="+url.QueryEscape(confirm))
+}
+
+func (c entityClient) Restore(ctx context.Context, query string) (WriteResult, error) {
+	if query == "" {
+		return WriteResult{}, ErrNoQuery
+	}
+	Debug("query='%s'", query)
+	query = url.QueryEscape(query) // always escape the query
+	return c.write(ctx, nil, -1, "PUT", "/entities/"+c.entityType+"/restore?query="+query)
+}
+
+func (c entityClient) RestoreOne(ctx context.Context, id string) (WriteResult, error) {
+	if id == "" {
+		return WriteResult{}, ErrIdNotSet
 	}
-	return wr, nil
+	Debug("_id=%s", id)
+	return c.write(ctx, nil, 1, "PUT", "/entity/"+c.entityType+"/"+url.PathEscape(id)+"/restore")
 }
 
 func (c entityClient) Labels(ctx context.Context, id string) ([]string, error) {
@@ -276,7 +744,7 @@ func (c entityClient) Labels(ctx context.Context, id string) ([]string, error) {
 
 	var labels []string
 	err := c.apiRetry(func() (bool, error) {
-		resp, bytes, err := c.do(ctx, "GET", "/entity/"+c.entityType+"/"+id+"/labels", nil)
+		resp, bytes, err := c.do(ctx, "GET", "/entity/"+c.entityType+"/"+url.PathEscape(id)+"/labels", nil)
 		if err != nil {
 			return false, err
 		}
@@ -299,11 +767,35 @@ func (c entityClient) DeleteLabel(ctx context.Context, id string, label string)
 		return WriteResult{}, ErrNoLabel
 	}
 	Debug("_id=%s, label=%s", id, label)
-	wr, err := c.write(ctx, nil, 1, "DELETE", "/entity/"+c.entityType+"/"+id+"/labels/"+label)
-	if err != nil {
-		return WriteResult{}, err
+	return c.write(ctx, nil, 1, "DELETE", "/entity/"+c.entityType+"/"+url.PathEscape(id)+"/labels/"+label)
+}
+
+func (c entityClient) DeleteLabelByQuery(ctx context.Context, query string, label string) (WriteResult, error) {
+	if query == "" {
+		return WriteResult{}, ErrNoQuery
+	}
+	if label == "" {
+		return WriteResult{}, ErrNoLabel
 	}
-	return wr, nil
+	Debug("query='%s', label=%s", query, label)
+	query = url.QueryEscape(query) // always escape the query
+	return c.write(ctx, nil, -1, "DELETE", "/entities/"+c.entityType+"/labels/"+label+"?query="+query)
+}
+
+func (c entityClient) RenameLabel(ctx context.Context, query string, label, newLabel string, overwrite bool) (WriteResult, error) {
+	if query == "" {
+		return WriteResult{}, ErrNoQuery
+	}
+	if label == "" || newLabel == "" {
+		return WriteResult{}, ErrNoLabel
+	}
+	Debug("query='%s', label=%s, newLabel=%s, overwrite=%t", query, label, newLabel, overwrite)
+	query = url.QueryEscape(query) // always escape the query
+	endpoint := "/entities/" + c.entityType + "/labels/" + label + "?query=" + query + "&name=" + url.QueryEscape(newLabel)
+	if overwrite {
+		endpoint += "&overwrite=true"
+	}
+	return c.write(ctx, nil, -1, "PUT", endpoint)
 }
 
 func (c entityClient) EntityType() string {
@@ -348,23 +840,28 @@ func (c entityClient) write(ctx context.Context, payload interface{}, n int, met
 		done := resp.StatusCode >= 400 && resp.StatusCode < 500
 
 		// On write, API should return an etre.WriteResult, but if API crashes
-		// there won't be response data
+		// there won't be response data, and a proxy might return its own error
+		wr = WriteResult{} // outer scope, reset on retry
 		if len(bytes) == 0 {
-			return done, fmt.Errorf("Server error: HTTP status %d, no response (check API logs)", resp.StatusCode)
+			return readError(resp, bytes)
 		}
-		wr = WriteResult{} // outer scope, reset on retry
 		if err := json.Unmarshal(bytes, &wr); err != nil {
-			return done, fmt.Errorf("json.Unmarshal: %s", err)
+			return readError(resp, bytes)
 		}
 		Debug("write result: %+v", wr)
+		if wr.Error != nil {
+			// Not retried because writes are not idempotent, even if rate limited
+			// (the caller should back off): the caller gets wr.Error and a typed
+			// error, like ErrDuplicate for a duplicate entity
+			wr.Error.HTTPStatus = resp.StatusCode
+			return true, apiError{prefix: errorPrefix(resp), err: *wr.Error}
+		}
 		if resp.StatusCode == http.StatusNotFound {
 			return done, ErrEntityNotFound
 		}
 		if wr.IsZero() && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-			if resp.StatusCode >= 500 {
-				return done, fmt.Errorf("Server error: HTTP status %d, response: '%s'", resp.StatusCode, string(bytes))
-			}
-			return done, fmt.Errorf("Client error: HTTP status %d, response: '%s'", resp.StatusCode, string(bytes))
+			// Not a WriteResult, like an etre.Error from the API before the write
+			return readError(resp, bytes)
 		}
 		return true, nil
 	})
@@ -372,26 +869,51 @@ func (c entityClient) write(ctx context.Context, payload interface{}, n int, met
 }
 
 func (c entityClient) do(ctx context.Context, method, endpoint string, payload []byte) (*http.Response, []byte, error) {
+	return c.doRequest(ctx, method, endpoint, payload, nil)
+}
+
+// doRequest is do with extra request headers, like If-None-Match.
+func (c entityClient) doRequest(ctx context.Context, method, endpoint string, payload []byte, header http.Header) (*http.Response, []byte, error) {
+	// Can't pass a nil *bytes.Buffer because net/http/request.go looks at the type:
+	//   switch v := body.(type) {
+	//       case *bytes.Buffer:
+	// So even though it's nil, request.go will attempt to read it, causing a panic.
+	var buf io.Reader
+	if payload != nil {
+		buf = bytes.NewBuffer(payload)
+	}
+	resp, err := c.send(ctx, method, endpoint, buf, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Read API response
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, fmt.Errorf("ioutil.ReadAll: %s", err)
+	}
+
+	return resp, body, nil
+}
+
+// send sends the request and returns the response without reading the body,
+// which the caller must close. doRequest reads the body; ExportStream streams it.
+// The request body is nil or streamed from body, like ImportStream.
+func (c entityClient) send(ctx context.Context, method, endpoint string, body io.Reader, header http.Header) (*http.Response, error) {
 	// Make a complete URL: addr + API_ROOT + endpoint
 	// _CALLER MUST url.QueryEscape(query)!_ We can't escape the whole endpoint
 	// here because it'll escape /.
 	url := c.url(endpoint)
 
 	// Make request
-	var req *http.Request
-	var err error
-	if payload != nil {
-		buf := bytes.NewBuffer(payload)
-		req, err = http.NewRequestWithContext(ctx, method, url, buf)
-	} else {
-		// Can't use a nil *bytes.Buffer because net/http/request.go looks at the type:
-		//   switch v := body.(type) {
-		//       case *bytes.Buffer:
-		// So even though it's nil, request.go will attempt to read it, causing a panic.
-		req, err = http.NewRequestWithContext(ctx, method, url, nil)
-	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		return nil, nil, fmt.Errorf("http.NewRequest: %s: %s", url, err)
+		return nil, fmt.Errorf("http.NewRequest: %s: %s", url, err)
+	}
+	// Custom headers first so that they cannot replace the Etre headers below
+	for k, v := range c.headers {
+		req.Header[k] = v
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set(VERSION_HEADER, VERSION)
@@ -401,6 +923,15 @@ func (c entityClient) do(ctx context.Context, method, endpoint string, payload [
 	if c.traceHeaderValue != "" {
 		req.Header.Set(TRACE_HEADER, c.traceHeaderValue)
 	}
+	if c.queryVersion > 0 {
+		req.Header.Set(QUERY_VERSION_HEADER, strconv.Itoa(c.queryVersion))
+	}
+	if id := RequestId(ctx); id != "" {
+		req.Header.Set(REQUEST_ID_HEADER, id)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 
 	// Send request
 	Debug("request: %+v", req)
@@ -408,50 +939,195 @@ func (c entityClient) do(ctx context.Context, method, endpoint string, payload [
 	if err != nil {
 		Debug("httpClient.Do() error: %v", err)
 		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return nil, nil, ErrClientTimeout
+			return nil, ErrClientTimeout
 		}
-		return nil, nil, fmt.Errorf("http.Client.Do: %s", err)
+		return nil, fmt.Errorf("http.Client.Do: %s", err)
 	}
 	Debug("response: %+v", resp)
+	return resp, nil
+}
 
-	// Read API response
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return resp, nil, fmt.Errorf("ioutil.ReadAll: %s", err)
+// aliasesParam returns the aliases query param value: label:alias pairs sorted
+// by label, so the same aliases make the same request path (see etagCache).
+func aliasesParam(aliases map[string]string) string {
+	pairs := make([]string, 0, len(aliases))
+	for label, alias := range aliases {
+		pairs = append(pairs, label+":"+alias)
 	}
-
-	return resp, body, nil
+	sort.Strings(pairs)
+	return url.QueryEscape(strings.Join(pairs, ","))
 }
 
 func (c entityClient) url(endpoint string) string {
 	return c.addr + API_ROOT + endpoint
 }
 
+// etagKey returns the etagCache key for the request path: the path and the
+// custom headers, which can change the response (for example, the user). Clients
+// derived with WithHeaders share the cache but not the keys, so a client never
+// gets ErrNotModified for a result that only another client received.
+func (c entityClient) etagKey(path string) string {
+	if len(c.headers) == 0 {
+		return path
+	}
+	var buf bytes.Buffer
+	buf.WriteString(path)
+	buf.WriteString("\n")
+	c.headers.Write(&buf) // sorted by header name
+	return buf.String()
+}
+
+// etagCache maps query request keys (see entityClient.etagKey) to the ETag of
+// the last response. It's shared by derived clients. A nil cache is valid: it
+// caches nothing.
+type etagCache struct {
+	mux  *sync.Mutex
+	tags map[string]string
+}
+
+// etagCacheSize is the max number of cached ETags. When full, the cache is
+// cleared, which only causes one full response per query.
+const etagCacheSize = 1000
+
+func (c *etagCache) get(key string) string {
+	if c == nil {
+		return ""
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.tags[key]
+}
+
+func (c *etagCache) set(key, tag string) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if tag == "" {
+		delete(c.tags, key)
+		return
+	}
+	if len(c.tags) >= etagCacheSize {
+		c.tags = map[string]string{}
+	}
+	c.tags[key] = tag
+}
+
+// apiError is an Error returned by the API. Callers can get the Error with
+// errors.As, for example to check its Type.
+type apiError struct {
+	prefix string // "Client error" or "Server error"
+	err    Error
+}
+
+func (e apiError) Error() string {
+	return fmt.Sprintf("%s: %s: %s (HTTP status %d)", e.prefix, e.err.Type, e.err.Message, e.err.HTTPStatus)
+}
+
+func (e apiError) Unwrap() error {
+	return e.err
+}
+
+// Is returns true if target is the sentinel error for the API error type, like
+// ErrDuplicate for "duplicate-entity", so callers can use errors.Is instead of
+// matching the error message. Is also returns true if target is an Error with
+// the same type, like ErrCDCHistoryGone. Unknown types match neither, but the
+// error message is the same.
+func (e apiError) Is(target error) bool {
+	if t, ok := target.(Error); ok {
+		return t.Type == e.err.Type
+	}
+	sentinel, ok := typedErrors[e.err.Type]
+	return ok && sentinel == target
+}
+
+// typedErrors maps API error types (see api/errors.go) to sentinel errors.
+// See apiError.Is.
+var typedErrors = map[string]error{
+	"duplicate-entity":     ErrDuplicate,
+	"entity-not-found":     ErrEntityNotFound,
+	"missing-param":        ErrMissingParam,
+	"invalid-param":        ErrInvalidParam,
+	"invalid-query":        ErrInvalidQuery,
+	"invalid-content":      ErrInvalidContent,
+	"no-content":           ErrNoContent,
+	"result-too-large":     ErrResultTooLarge,
+	"payload-too-large":    ErrPayloadTooLarge,
+	"cdc-disabled":         ErrCDCDisabled,
+	"endpoint-not-found":   ErrEndpointNotFound,
+	"query-timeout":        ErrQueryTimeout,
+	"internal-error":       ErrInternal,
+	"db-insert-failed":     ErrDBInsertFailed,
+	"db-update-failed":     ErrDBUpdateFailed,
+	"rate-limited":         ErrRateLimited,
+	"cdc-replay-busy":      ErrCDCReplayBusy,
+	"cdc-client-not-found": ErrCDCClientNotFound,
+}
+
 func readError(resp *http.Response, bytes []byte) (bool, error) {
 	done := resp.StatusCode >= 400 && resp.StatusCode < 500
 
-	if resp.StatusCode == http.StatusNotFound {
-		return done, ErrEntityNotFound
-	}
+	// A 404 without an etre.Error, like GET /entity/:type/:id, is ErrEntityNotFound.
+	// With an etre.Error, it's typed like other errors, so "endpoint-not-found" is
+	// not mistaken for a missing entity.
+	notFound := resp.StatusCode == http.StatusNotFound
 
 	// No response data from API, it crashed or had unhandled error
 	if len(bytes) == 0 {
-		return done, fmt.Errorf("Server error: HTTP status %d, no response (check API logs)", resp.StatusCode)
+		if notFound {
+			return done, ErrEntityNotFound
+		}
+		return done, fmt.Errorf("%s: HTTP status %d, no response (check API logs)", errorPrefix(resp), resp.StatusCode)
 	}
 
 	// Response data should be an etre.Error
 	var errResp Error
 	if err := json.Unmarshal(bytes, &errResp); err != nil {
-		return done, fmt.Errorf("Server error: HTTP status %d, cannot decode response (%s): %s", resp.StatusCode, err, string(bytes))
+		if notFound {
+			return done, ErrEntityNotFound
+		}
+		return done, responseError(resp, bytes, fmt.Sprintf("cannot decode response (%s)", err))
 	}
 	if errResp.Type == "" || errResp.Message == "" {
-		return done, fmt.Errorf("Server error: HTTP status %d, unknown response: %s", resp.StatusCode, string(bytes))
+		if notFound {
+			return done, ErrEntityNotFound
+		}
+		return done, responseError(resp, bytes, "unknown response")
+	}
+	errResp.HTTPStatus = resp.StatusCode
+	if errResp.RequestId == "" {
+		errResp.RequestId = resp.Header.Get(REQUEST_ID_HEADER)
 	}
 	if resp.StatusCode >= 500 {
-		return done, fmt.Errorf("Server error: %s: %s (HTTP status %d)", errResp.Type, errResp.Message, resp.StatusCode)
+		return done, apiError{prefix: "Server error", err: errResp}
+	}
+	return done, apiError{prefix: "Client error", err: errResp}
+}
+
+// maxBodySnippet is the max number of bytes of the response body in an error
+// from responseError.
+const maxBodySnippet = 256
+
+// responseError returns an error for a response body that is not an etre.Error,
+// like an HTML 502 page from a proxy or gateway in front of the API. The error has
+// the reason, the Content-Type if it's not JSON, and a snippet of the body.
+func responseError(resp *http.Response, body []byte, reason string) error {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "" && mediaType != "application/json" {
+		reason += ", Content-Type " + mediaType + " (not from the API? check proxies)"
+	}
+	snippet := strings.Join(strings.Fields(string(body)), " ") // one line
+	if len(snippet) > maxBodySnippet {
+		snippet = strings.ToValidUTF8(snippet[:maxBodySnippet], "") + "..." // no partial rune
 	}
-	return done, fmt.Errorf("Client error: %s: %s (HTTP status %d)", errResp.Type, errResp.Message, resp.StatusCode)
+	return fmt.Errorf("%s: HTTP status %d, %s: %s", errorPrefix(resp), resp.StatusCode, reason, snippet)
+}
+
+func errorPrefix(resp *http.Response) string {
+	if resp.StatusCode >= 500 {
+		return "Server error"
+	}
+	return "Client error"
 }
 
 func (c entityClient) apiRetry(f func() (bool, error)) error {
@@ -485,18 +1161,33 @@ func (c entityClient) apiRetry(f func() (bool, error)) error {
 // return empty slices and no error. Defining a callback function allows tests
 // to intercept, save, and inspect Client calls and simulate Etre API returns.
 type MockEntityClient struct {
-	QueryFunc       func(ctx context.Context, query string, filter QueryFilter) ([]Entity, error)
-	GetFunc         func(ctx context.Context, id string) (Entity, error)
-	InsertFunc      func(ctx context.Context, entities []Entity) (WriteResult, error)
-	UpdateFunc      func(ctx context.Context, query string, patch Entity) (WriteResult, error)
-	UpdateOneFunc   func(ctx context.Context, id string, patch Entity) (WriteResult, error)
-	DeleteFunc      func(ctx context.Context, query string) (WriteResult, error)
-	DeleteOneFunc   func(ctx context.Context, id string) (WriteResult, error)
-	LabelsFunc      func(ctx context.Context, id string) ([]string, error)
-	DeleteLabelFunc func(ctx context.Context, id string, label string) (WriteResult, error)
-	EntityTypeFunc  func() string
-	WithSetFunc     func(Set) EntityClient
-	WithTraceFunc   func(string) EntityClient
+	QueryFunc              func(ctx context.Context, query string, filter QueryFilter) ([]Entity, error)
+	QueryBatchFunc         func(ctx context.Context, reqs []QueryRequest) ([]QueryResult, error)
+	GroupCountFunc         func(ctx context.Context, query string, label string) (map[string]int64, error)
+	ExistsFunc             func(ctx context.Context, query string) (bool, error)
+	ExportStreamFunc       func(ctx context.Context, query string, filter QueryFilter) (io.ReadCloser, error)
+	GetFunc                func(ctx context.Context, id string) (Entity, error)
+	ReadOneFunc            func(ctx context.Context, id string, filter QueryFilter) (Entity, error)
+	HistoryFunc            func(ctx context.Context, id string) ([]CDCEvent, error)
+	ReadByIdsFunc          func(ctx context.Context, ids []string) ([]Entity, error)
+	InsertFunc             func(ctx context.Context, entities []Entity) (WriteResult, error)
+	InsertIfNotExistsFunc  func(ctx context.Context, query string, entity Entity) (WriteResult, error)
+	ImportStreamFunc       func(ctx context.Context, r io.Reader) (ImportResult, error)
+	UpdateFunc             func(ctx context.Context, query string, patch Entity) (WriteResult, error)
+	UpdateOneFunc          func(ctx context.Context, id string, patch Entity) (WriteResult, error)
+	DeleteFunc             func(ctx context.Context, query string) (WriteResult, error)
+	DeleteAllFunc          func(ctx context.Context, confirm string) (WriteResult, error)
+	DeleteOneFunc          func(ctx context.Context, id string) (WriteResult, error)
+	RestoreFunc            func(ctx context.Context, query string) (WriteResult, error)
+	RestoreOneFunc         func(ctx context.Context, id string) (WriteResult, error)
+	LabelsFunc             func(ctx context.Context, id string) ([]string, error)
+	DeleteLabelFunc        func(ctx context.Context, id string, label string) (WriteResult, error)
+	DeleteLabelByQueryFunc func(ctx context.Context, query string, label string) (WriteResult, error)
+	RenameLabelFunc        func(ctx context.Context, query string, label, newLabel string, overwrite bool) (WriteResult, error)
+	EntityTypeFunc         func() string
+	WithSetFunc            func(Set) EntityClient
+	WithTraceFunc          func(string) EntityClient
+	WithHeadersFunc        func(http.Header) EntityClient
 }
 
 func (c MockEntityClient) Query(ctx context.Context, query string, filter QueryFilter) ([]Entity, error) {
@@ -506,6 +1197,34 @@ func (c MockEntityClient) Query(ctx context.Context, query string, filter QueryF
 	return nil, nil
 }
 
+func (c MockEntityClient) QueryBatch(ctx context.Context, reqs []QueryRequest) ([]QueryResult, error) {
+	if c.QueryBatchFunc != nil {
+		return c.QueryBatchFunc(ctx, reqs)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) GroupCount(ctx context.Context, query string, label string) (map[string]int64, error) {
+	if c.GroupCountFunc != nil {
+		return c.GroupCountFunc(ctx, query, label)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) Exists(ctx context.Context, query string) (bool, error) {
+	if c.ExistsFunc != nil {
+		return c.ExistsFunc(ctx, query)
+	}
+	return false, nil
+}
+
+func (c MockEntityClient) ExportStream(ctx context.Context, query string, filter QueryFilter) (io.ReadCloser, error) {
+	if c.ExportStreamFunc != nil {
+		return c.ExportStreamFunc(ctx, query, filter)
+	}
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
 func (c MockEntityClient) Get(ctx context.Context, id string) (Entity, error) {
 	if c.GetFunc != nil {
 		return c.GetFunc(ctx, id)
@@ -513,6 +1232,27 @@ func (c MockEntityClient) Get(ctx context.Context, id string) (Entity, error) {
 	return nil, nil
 }
 
+func (c MockEntityClient) ReadOne(ctx context.Context, id string, filter QueryFilter) (Entity, error) {
+	if c.ReadOneFunc != nil {
+		return c.ReadOneFunc(ctx, id, filter)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) History(ctx context.Context, id string) ([]CDCEvent, error) {
+	if c.HistoryFunc != nil {
+		return c.HistoryFunc(ctx, id)
+	}
+	return nil, nil
+}
+
+func (c MockEntityClient) ReadByIds(ctx context.Context, ids []string) ([]Entity, error) {
+	if c.ReadByIdsFunc != nil {
+		return c.ReadByIdsFunc(ctx, ids)
+	}
+	return nil, nil
+}
+
 func (c MockEntityClient) Insert(ctx context.Context, entities []Entity) (WriteResult, error) {
 	if c.InsertFunc != nil {
 		return c.InsertFunc(ctx, entities)
@@ -520,6 +1260,20 @@ func (c MockEntityClient) Insert(ctx context.Context, entities []Entity) (WriteR
 	return WriteResult{}, nil
 }
 
+func (c MockEntityClient) InsertIfNotExists(ctx context.Context, query string, entity Entity) (WriteResult, error) {
+	if c.InsertIfNotExistsFunc != nil {
+		return c.InsertIfNotExistsFunc(ctx, query, entity)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) ImportStream(ctx context.Context, r io.Reader) (ImportResult, error) {
+	if c.ImportStreamFunc != nil {
+		return c.ImportStreamFunc(ctx, r)
+	}
+	return ImportResult{}, nil
+}
+
 func (c MockEntityClient) Update(ctx context.Context, query string, patch Entity) (WriteResult, error) {
 	if c.UpdateFunc != nil {
 		return c.UpdateFunc(ctx, query, patch)
@@ -541,6 +1295,13 @@ func (c MockEntityClient) Delete(ctx context.Context, query string) (WriteResult
 	return WriteResult{}, nil
 }
 
+func (c MockEntityClient) DeleteAll(ctx context.Context, confirm string) (WriteResult, error) {
+	if c.DeleteAllFunc != nil {
+		return c.DeleteAllFunc(ctx, confirm)
+	}
+	return WriteResult{}, nil
+}
+
 func (c MockEntityClient) DeleteOne(ctx context.Context, id string) (WriteResult, error) {
 	if c.DeleteOneFunc != nil {
 		return c.DeleteOneFunc(ctx, id)
@@ -548,6 +1309,20 @@ func (c MockEntityClient) DeleteOne(ctx context.Context, id string) (WriteResult
 	return WriteResult{}, nil
 }
 
+func (c MockEntityClient) Restore(ctx context.Context, query string) (WriteResult, error) {
+	if c.RestoreFunc != nil {
+		return c.RestoreFunc(ctx, query)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) RestoreOne(ctx context.Context, id string) (WriteResult, error) {
+	if c.RestoreOneFunc != nil {
+		return c.RestoreOneFunc(ctx, id)
+	}
+	return WriteResult{}, nil
+}
+
 func (c MockEntityClient) Labels(ctx context.Context, id string) ([]string, error) {
 	if c.LabelsFunc != nil {
 		return c.LabelsFunc(ctx, id)
@@ -562,6 +1337,20 @@ func (c MockEntityClient) DeleteLabel(ctx context.Context, id string, label stri
 	return WriteResult{}, nil
 }
 
+func (c MockEntityClient) DeleteLabelByQuery(ctx context.Context, query string, label string) (WriteResult, error) {
+	if c.DeleteLabelByQueryFunc != nil {
+		return c.DeleteLabelByQueryFunc(ctx, query, label)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) RenameLabel(ctx context.Context, query string, label, newLabel string, overwrite bool) (WriteResult, error) {
+	if c.RenameLabelFunc != nil {
+		return c.RenameLabelFunc(ctx, query, label, newLabel, overwrite)
+	}
+	return WriteResult{}, nil
+}
+
 func (c MockEntityClient) EntityType() string {
 	if c.EntityTypeFunc != nil {
 		return c.EntityTypeFunc()
@@ -582,3 +1371,10 @@ func (c MockEntityClient) WithTrace(trace string) EntityClient {
 	}
 	return c
 }
+
+func (c MockEntityClient) WithHeaders(h http.Header) EntityClient {
+	if c.WithHeadersFunc != nil {
+		return c.WithHeadersFunc(h)
+	}
+	return c
+}
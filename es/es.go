@@ -6,6 +6,7 @@ package es
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -539,20 +540,21 @@ func writeResult(ctx app.Context, set etre.Set, wr etre.WriteResult, err error,
 
 	// Errors?
 	if err != nil {
-		switch err {
-		case etre.ErrEntityNotFound:
+		switch {
+		case errors.Is(err, etre.ErrEntityNotFound):
 			if ctx.Options.Strict {
 				return false, fmt.Errorf("Not found: %s %s does not exist", ctx.EntityType, ctx.EntityId)
 			} else {
 				return false, nil
 			}
-		case etre.ErrNoQuery:
+		case err == etre.ErrNoQuery:
 			return false, fmt.Errorf("No query given")
-		case etre.ErrNoEntity:
+		case err == etre.ErrNoEntity:
 			return false, fmt.Errorf("No entity given")
-		default:
+		case wr.Error == nil:
 			return false, err
 		}
+		// Else the API error is wr.Error, reported below
 	}
 	if wr.Error != nil {
 		return false, fmt.Errorf("Failed to %s %s %s: %s (%s)", op, ctx.EntityType, ctx.EntityId, wr.Error.Message, wr.Error.Type)
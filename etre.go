@@ -4,13 +4,16 @@
 package etre
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path"
 	"runtime"
 	"sort"
+	"strconv"
 	"time"
 )
 
@@ -22,11 +25,26 @@ const (
 	META_LABEL_REV            = "_rev"
 	META_LABEL_CREATED        = "_created"
 	META_LABEL_UPDATED        = "_updated"
+	META_LABEL_DELETED        = "_deleted"
 	CDC_WRITE_TIMEOUT  int    = 5 // seconds
 
 	VERSION_HEADER       = "X-Etre-Version"
 	TRACE_HEADER         = "X-Etre-Trace"
 	QUERY_TIMEOUT_HEADER = "X-Etre-Query-Timeout"
+	QUERY_VERSION_HEADER = "X-Etre-Query-Version"
+	REQUEST_ID_HEADER    = "X-Request-Id"
+
+	// JSON_PATCH_CONTENT_TYPE is the Content-Type of a JSON Patch (RFC 6902)
+	// update: a JSON array of JSONPatchOp instead of a patch Entity.
+	JSON_PATCH_CONTENT_TYPE = "application/json-patch+json"
+
+	// NDJSON_CONTENT_TYPE is the Content-Type of an entity export or import:
+	// newline-delimited JSON, one entity per line.
+	NDJSON_CONTENT_TYPE = "application/x-ndjson"
+
+	// ERROR_TRAILER is the HTTP trailer with the Error (JSON) if an export fails
+	// after the response started, when the HTTP status can no longer change.
+	ERROR_TRAILER = "X-Etre-Error"
 )
 
 var (
@@ -40,6 +58,32 @@ var (
 	ErrCallerBlocked  = errors.New("caller blocked")
 	ErrEntityNotFound = errors.New("entity not found")
 	ErrClientTimeout  = errors.New("client timeout")
+	ErrNotModified    = errors.New("not modified")
+	ErrDuplicate      = errors.New("duplicate entity: identifying labels conflict with another entity")
+)
+
+// These errors match API errors returned by EntityClient, by error type, so
+// callers can branch on specific failures with errors.Is. For example, if the
+// API returns error type "invalid-query", errors.Is(err, ErrInvalidQuery) is true.
+// The error returned by EntityClient is still the full API error (type, message,
+// and HTTP status); use errors.As with Error to get it.
+var (
+	ErrMissingParam      = errors.New("missing parameter")
+	ErrInvalidParam      = errors.New("invalid parameter")
+	ErrInvalidQuery      = errors.New("invalid query")
+	ErrInvalidContent    = errors.New("invalid content")
+	ErrNoContent         = errors.New("no content")
+	ErrResultTooLarge    = errors.New("query result too large")
+	ErrPayloadTooLarge   = errors.New("HTTP payload too large")
+	ErrCDCDisabled       = errors.New("CDC disabled")
+	ErrEndpointNotFound  = errors.New("API endpoint not found")
+	ErrQueryTimeout      = errors.New("query exceeded max query time")
+	ErrInternal          = errors.New("internal server error")
+	ErrDBInsertFailed    = errors.New("database insert failed")
+	ErrDBUpdateFailed    = errors.New("database update failed")
+	ErrRateLimited       = errors.New("rate limited")
+	ErrCDCReplayBusy     = errors.New("CDC fallback replay already running")
+	ErrCDCClientNotFound = errors.New("CDC client not found")
 )
 
 // Entity represents a single Etre entity. The caller is responsible for knowing
@@ -93,6 +137,21 @@ func (e Entity) Updated() time.Time {
 	return time.Unix(0, nanos)
 }
 
+// Deleted returns the time the entity was soft-deleted from the META_LABEL_DELETED
+// label. If the label is not present (the entity is not deleted), returns the
+// zero value of time.Time.
+func (e Entity) Deleted() time.Time {
+	v := e[META_LABEL_DELETED]
+	if v == nil {
+		return time.Time{}
+	}
+	nanos, err := toInt64(v)
+	if err != nil {
+		panic(fmt.Sprintf("entity %s has invalid _deleted data type: %T; expected int64", e.Id(), v))
+	}
+	return time.Unix(0, nanos)
+}
+
 func (e Entity) Type() string {
 	return e[META_LABEL_TYPE].(string)
 }
@@ -176,6 +235,7 @@ var metaLabels = map[string]bool{
 	"_setSize": true,
 	"_created": true,
 	"_updated": true,
+	"_deleted": true,
 	"_type":    true,
 }
 
@@ -211,14 +271,98 @@ type QueryFilter struct {
 	// ReturnLabels defines labels included in matching entities. An empty slice
 	// returns all labels, including meta-labels. Else, only labels in the slice
 	// are returned.
-	ReturnLabels []string
+	ReturnLabels []string `json:"labels,omitempty"`
 
 	// Distinct returns unique entities if ReturnLabels contains a single value.
 	// Etre returns an error if enabled and ReturnLabels has more than one value.
-	Distinct bool
+	Distinct bool `json:"distinct,omitempty"`
 
 	// Limit caps the number of entities returned. Zero means no limit.
-	Limit int64
+	Limit int64 `json:"limit,omitempty"`
+
+	// IncludeDeleted returns soft-deleted entities (with META_LABEL_DELETED),
+	// which are not returned by default. See config.EntityConfig.SoftDelete.
+	IncludeDeleted bool `json:"includeDeleted,omitempty"`
+
+	// Hint is the index for the query to use, for queries the MongoDB query planner
+	// handles poorly: an index name like "x_1", or an index key spec like "x:1,y:-1".
+	// The index must exist, else Etre returns an "invalid-hint" error. It does not
+	// apply to Distinct queries.
+	Hint string `json:"hint,omitempty"`
+
+	// Sort orders matching entities by labels, like "x:1,y:-1": x ascending, then y
+	// descending. If not set, the order is undefined. Else, Etre returns an "invalid-sort"
+	// error if it's not label:1 or label:-1 keys. It does not apply to Distinct queries.
+	Sort string `json:"sort,omitempty"`
+
+	// MaxTimeMS is the max time (milliseconds) for the query to run on MongoDB. It
+	// can only lower the configured max (entity.max_query_time). If exceeded, Etre
+	// returns a "query-timeout" error. Zero is the configured max, if any.
+	MaxTimeMS int64 `json:"maxTimeMS,omitempty"`
+
+	// Collation is the collation for the query to compare strings, like case-insensitive
+	// matching: "hostname=Foo" matches "foo" with Collation{Locale: "en", Strength: 2}.
+	// A query with a collation can use only indexes with the same collation, so create
+	// a matching collated index for the query labels, else the query is a collection scan.
+	Collation *Collation `json:"collation,omitempty"`
+
+	// Aliases renames labels in matching entities: a map of stored label to returned
+	// label, like {"dc": "datacenter"} to return label dc as datacenter. If an entity
+	// has both labels, the aliased label replaces the other: datacenter is the value
+	// of dc. Query and ReturnLabels use stored labels, not aliases. An alias cannot be
+	// a metalabel, another aliased label, or the alias of two labels.
+	Aliases map[string]string `json:"aliases,omitempty"`
+}
+
+// Collation is a MongoDB collation: language-specific rules for comparing strings.
+// See https://www.mongodb.com/docs/manual/reference/collation/.
+type Collation struct {
+	// Locale is an ICU locale like "en", or "simple" for binary comparison.
+	Locale string `json:"locale"`
+
+	// Strength is the ICU comparison level, 1 to 5. Levels 1 (base characters)
+	// and 2 (base characters and diacritics) ignore case. Zero is the default, 3.
+	Strength int `json:"strength,omitempty"`
+}
+
+// String returns the collation as "locale" or "locale:strength", which is the
+// format of the collation query parameter.
+func (c Collation) String() string {
+	if c.Strength == 0 {
+		return c.Locale
+	}
+	return c.Locale + ":" + strconv.Itoa(c.Strength)
+}
+
+// QueryRequest is one query in a batch query (see EntityClient.QueryBatch).
+type QueryRequest struct {
+	Query  string      `json:"query"`
+	Filter QueryFilter `json:"filter"`
+}
+
+// QueryResult is the result of one QueryRequest in a batch query. Results are
+// in the same order as the requests. If Error is set, the query failed and
+// Entities is nil. One failed query does not fail the other queries.
+type QueryResult struct {
+	Entities []Entity `json:"entities"`
+	Error    *Error   `json:"error,omitempty"`
+}
+
+// GroupCount is the number of entities with one value of a label, returned by
+// GET /entities/:type/aggregate. Value is nil for entities without the label.
+type GroupCount struct {
+	Value interface{} `json:"value"`
+	Count int64       `json:"count"`
+}
+
+// JSONPatchOp is one JSON Patch (RFC 6902) operation in an update sent with
+// Content-Type JSON_PATCH_CONTENT_TYPE. Op is "add", "replace", or "remove".
+// Path is a JSON Pointer (RFC 6901) to a label, like "/a", or to a nested field
+// of an object label, like "/a/b". Value is not used for "remove".
+type JSONPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
 }
 
 // WriteResult represents the result of a write operation (insert, update delete).
@@ -228,9 +372,18 @@ type QueryFilter struct {
 // error, so len(Writes) = index into slice of entities sent by client that failed.
 // For example, if the first entity causes an error, len(Writes) = 0. If the third
 // entity fails, len(Writes) = 2 (zero indexed).
+//
+// An unordered insert or bulk update (?ordered=false) does not stop on the first
+// error: Writes are the entities written, Errors are the entities not written, and
+// Error is the first of Errors.
+//
+// If Error is a duplicate entity error, EntityClient also returns it as the error,
+// which matches ErrDuplicate: errors.Is(err, ErrDuplicate) is true.
 type WriteResult struct {
-	Writes []Write `json:"writes"`          // successful writes
-	Error  *Error  `json:"error,omitempty"` // error before, during, or after writes
+	Writes []Write      `json:"writes"`           // successful writes
+	Error  *Error       `json:"error,omitempty"`  // error before, during, or after writes
+	Errors []WriteError `json:"errors,omitempty"` // per-entity errors (unordered write)
+	SetId  string       `json:"setId,omitempty"`  // server-generated SetId of a bulk write
 }
 
 func (wr WriteResult) IsZero() bool {
@@ -244,6 +397,29 @@ type Write struct {
 	Diff     Entity `json:"diff,omitempty"` // previous entity label values (update)
 }
 
+// WriteError is the error of one entity not written by an unordered insert or bulk
+// update (?ordered=false). For an insert, Index is the index of the entity in the
+// slice of entities sent by the client. For an update, Index is -1 because the
+// entities are matched by the query, and Error.EntityId is the entity not updated.
+type WriteError struct {
+	Index int   `json:"index"`
+	Error Error `json:"error"`
+}
+
+// ImportResult is the summary of an import (POST /entities/:type/import). Inserted
+// and Failed count all entities in the stream. Errors has the error of each entity
+// not inserted, up to a server limit, and WriteError.Index is its index in the
+// stream (0-based, blank lines not counted), as is WriteError.Error.EntityIndex.
+// Error is set if the import stopped
+// before the end of the stream, like on a database error; entities before it
+// were imported, and entities after it were not read.
+type ImportResult struct {
+	Inserted int          `json:"inserted"`
+	Failed   int          `json:"failed"`
+	Errors   []WriteError `json:"errors,omitempty"`
+	Error    *Error       `json:"error,omitempty"`
+}
+
 // Error is the standard response for all handled errors. Client errors (HTTP 400
 // codes) and internal errors (HTTP 500 codes) are returned as an Error, if handled.
 // If not handled (API crash, panic, etc.), Etre returns an HTTP 500 code and the
@@ -253,6 +429,21 @@ type Error struct {
 	Type       string `json:"type"`       // error slug (e.g. db-error, missing-param, etc.)
 	EntityId   string `json:"entityId"`   // entity ID that caused error, if any
 	HTTPStatus int    `json:"httpStatus"` // HTTP status code
+
+	// Set on write if the error is for one entity in the request, like an invalid
+	// label in the 2nd entity of a bulk insert: EntityIndex is its index in the
+	// request (0-based), and Label is the invalid label, if the error is for one label.
+	EntityIndex *int   `json:"entityIndex,omitempty"`
+	Label       string `json:"label,omitempty"`
+
+	// Conflict is set on a duplicate-entity error (see ErrDuplicate): the labels and
+	// values of the unique index that conflict with another entity, like {"x": 6},
+	// only the labels the caller can read. It's a pointer so that Error is comparable.
+	Conflict *Entity `json:"conflict,omitempty"`
+
+	// RequestId is the REQUEST_ID_HEADER value of the request, which the API logs
+	// with the error. See WithRequestId.
+	RequestId string `json:"requestId,omitempty"`
 }
 
 func (e Error) New(msgFmt string, msgArgs ...interface{}) Error {
@@ -270,10 +461,111 @@ func (e Error) Error() string {
 	return e.String()
 }
 
+type requestIdKey struct{}
+
+// WithRequestId returns a copy of the context with the request ID. EntityClient
+// sends it in the REQUEST_ID_HEADER of requests made with the context, and the API
+// returns it in errors (Error.RequestId) and logs it, which correlates client errors
+// with server logs. If not set, the API generates a request ID. In the API, the
+// context passed to the entity store has the request ID.
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestId returns the request ID set by WithRequestId, or an empty string.
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// IsRateLimited returns true if the error is from the API rate limiting the caller
+// (HTTP status 429). The caller should back off before retrying. For writes, pass
+// WriteResult.Error. EntityClient does not retry rate-limited requests.
+func IsRateLimited(err error) bool {
+	var e Error
+	if errors.As(err, &e) {
+		return e.HTTPStatus == http.StatusTooManyRequests
+	}
+	var pe *Error
+	if errors.As(err, &pe) && pe != nil {
+		return pe.HTTPStatus == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// ErrCDCPositionGone is returned by the CDC feed when the start position is
+// no longer in the CDC store, for example because events older than the
+// retention window were deleted. The consumer cannot resume without missing
+// events; it must resync from the entities and restart the feed from now.
+var ErrCDCPositionGone = Error{
+	Type:       "cdc-position-gone",
+	Message:    "CDC feed start position is no longer available",
+	HTTPStatus: http.StatusGone,
+}
+
+// ErrCDCHistoryGone is returned by a point-in-time read when the entity's CDC
+// events do not go back far enough to reconstruct it, for example because events
+// older than the retention window were deleted.
+var ErrCDCHistoryGone = Error{
+	Type:       "cdc-history-gone",
+	Message:    "CDC events needed to reconstruct the entity are no longer available",
+	HTTPStatus: http.StatusGone,
+}
+
+// IsCDCPositionGone returns true if the error is ErrCDCPositionGone from the
+// CDC feed. See CDCClient.Error.
+func IsCDCPositionGone(err error) bool {
+	var e Error
+	if errors.As(err, &e) {
+		return e.Type == ErrCDCPositionGone.Type
+	}
+	return false
+}
+
+// ErrCDCSeqDisabled is returned by the CDC feed when the start position is a
+// sequence number (CDCPosition.Seq) but the server does not write CDC events in
+// transactions (entity.transactions config), so events might be committed out of
+// sequence order, and resuming by sequence number could skip events.
+var ErrCDCSeqDisabled = Error{
+	Type:       "cdc-seq-disabled",
+	Message:    "CDC feed cannot start from a sequence number because entity transactions are not enabled",
+	HTTPStatus: http.StatusNotImplemented,
+}
+
+// ErrSlowConsumer is the reason the change stream server disconnects a CDC
+// feed client that is too slow to receive events. The client can reconnect
+// and resume from its last event. CDCClient reconnects if CDCClientConfig.Reconnect
+// is true.
+var ErrSlowConsumer = Error{
+	Type:       "slow-consumer",
+	Message:    "CDC feed client disconnected because it's too slow to receive events",
+	HTTPStatus: http.StatusServiceUnavailable,
+}
+
+// IsSlowConsumer returns true if the error is ErrSlowConsumer from the CDC feed.
+func IsSlowConsumer(err error) bool {
+	var e Error
+	if errors.As(err, &e) {
+		return e.Type == ErrSlowConsumer.Type
+	}
+	return false
+}
+
+// Health is the response to GET /health. The API returns HTTP 503 if a required
+// database is not connected: the main database, or the CDC database if CDC is
+// enabled. CDCDb is false if CDC is disabled. MainDb includes entity types with
+// their own datasource: it is false if any is not connected.
+type Health struct {
+	MainDb  bool   `json:"main_db"` // connected to main database
+	CDCDb   bool   `json:"cdc_db"`  // connected to CDC database
+	Version string `json:"version"` // Etre version
+}
+
 type CDCEvent struct {
 	Id     string `json:"eventId" bson:"_id,omitempty"`
-	Ts     int64  `json:"ts" bson:"ts"` // Unix nanoseconds
-	Op     string `json:"op" bson:"op"` // i=insert, u=update, d=delete
+	Ts     int64  `json:"ts" bson:"ts"`                       // Unix milliseconds
+	Seq    int64  `json:"seq,omitempty" bson:"seq,omitempty"` // sequence number, strictly increasing across all events
+	Op     string `json:"op" bson:"op"`                       // i=insert, u=update, d=delete
 	Caller string `json:"user" bson:"caller"`
 
 	EntityId   string  `json:"entityId" bson:"entityId"`           // _id of entity
@@ -291,6 +583,28 @@ type CDCEvent struct {
 	SetSize int    `json:"setSize,omitempty" bson:"setSize,omitempty"`
 }
 
+// CDCReplay is a request to replay past CDC events to one CDC feed client
+// (POST /changes/replay). ClientId is required: it's the client id of a feed
+// connected to the Etre instance that receives the request, as reported by
+// GET /status. The range of events is required: SinceId and UntilId, or SinceSeq
+// and UntilSeq, both inclusive. The client receives the events in sequence order,
+// after any events already sent, and other clients do not receive them.
+type CDCReplay struct {
+	ClientId string `json:"clientId"`
+	SinceId  string `json:"sinceId,omitempty"`
+	UntilId  string `json:"untilId,omitempty"`
+	SinceSeq int64  `json:"sinceSeq,omitempty"`
+	UntilSeq int64  `json:"untilSeq,omitempty"`
+}
+
+// CDCReplayResult is the response to a CDCReplay. Events is the number of events
+// sent to the client. The client receives the events asynchronously, so they
+// might not have been received yet.
+type CDCReplayResult struct {
+	ClientId string `json:"clientId"`
+	Events   int    `json:"events"`
+}
+
 // Latency represents network latencies in milliseconds.
 type Latency struct {
 	Send int64 // client -> server
@@ -34,6 +34,19 @@ type MetricsSystemReport struct {
 	// The API returns HTTP status 401 (unauthorized). If the caller fails to
 	// authenticate, only Query and AuthenticationFailed are incremented.
 	AuthenticationFailed int64 `json:"authentication-failed"`
+
+	// Authentication and authorization outcomes counted by the auth manager.
+	// AuthorizeOK and AuthorizeDenied count every decision, so one request
+	// can count more than once, e.g. when labels are authorized separately.
+	AuthenticateOK    int64 `json:"authenticate-ok"`
+	AuthenticateError int64 `json:"authenticate-error"`
+	AuthorizeOK       int64 `json:"authorize-ok"`
+	AuthorizeDenied   int64 `json:"authorize-denied"`
+
+	// CDCDropped counter is the number of change stream clients dropped because
+	// they were too slow: the per-client buffer (cdc.change_stream.buffer_size)
+	// was full. Dropped clients must reconnect and resume.
+	CDCDropped int64 `json:"cdc-dropped"`
 }
 
 // MetricsGroupReport is the top-level metric reporting structure for each metric group.
@@ -65,12 +78,17 @@ type MetricsRequestReport struct {
 }
 
 // MetricsEntityReport are measurements related to an entity type. It contains
-// three sub-reports: Query, Label, Trace.
+// four sub-reports: Query, Label, QueryLabel, Trace.
 type MetricsEntityReport struct {
 	EntityType string                         `json:"entity-type"`
 	Query      *MetricsQueryReport            `json:"query"`
 	Label      map[string]*MetricsLabelReport `json:"label"`
 	Trace      map[string]map[string]int64    `json:"trace,omitempty"`
+
+	// QueryLabel counters are the number of read queries that used each label,
+	// counted once per query. To bound cardinality, only labels in the entity
+	// type schema (config.entity.schema) are counted.
+	QueryLabel map[string]int64 `json:"query-label,omitempty"`
 }
 
 // MetricsQueryReport are measurements related to querying an entity type.
@@ -99,7 +117,9 @@ type MetricsQueryReport struct {
 
 	// ReadId counter is the number of reads by entity ID. It is a subset of Read.
 	// These API endpoints increment ReadId by 1:
-	//   GET /api/v1/entity/:id
+	//   GET  /api/v1/entity/:id
+	//   GET  /api/v1/entities/:type/by-ids
+	//   POST /api/v1/entities/:type/by-ids
 	ReadId int64 `json:"read-id"`
 
 	// ReadLabels counter is the number of read label queries. It is a subset of Read.
@@ -178,6 +198,7 @@ type MetricsQueryReport struct {
 	// DeleteLabel counter is the number of delete label queries. It is a subset of Write.
 	// These API endpoints increment DeleteLabel:
 	//   DELETE /api/v1/entity/:type/:id/labels/:label
+	//   DELETE /api/v1/entities/:type/labels/:label
 	DeleteLabel int64 `json:"delete-label"`
 
 	// Created, Updated, and Deleted counters are the number of entities successfully
@@ -218,6 +239,26 @@ type MetricsQueryReport struct {
 	LatencyMs_p99  float64 `json:"latency-ms_p99"`
 	LatencyMs_p999 float64 `json:"latency-ms_p999"`
 
+	// ReadLatencyMs, CreateLatencyMs, UpdateLatencyMs, and DeleteLatencyMs stats
+	// represent query latency in milliseconds per op. Unlike LatencyMs, they are
+	// not sampled: every query is counted in a histogram with log-linear buckets
+	// (each ~9% wide), so percentiles are accurate within a few percent. _p50 is
+	// the median, _p95 and _p99 are the 95th and 99th percentiles. Update includes
+	// delete label queries. Queries that fail before the op is known, like invalid
+	// write queries, are only counted in LatencyMs.
+	ReadLatencyMs_p50   float64 `json:"read-latency-ms_p50"`
+	ReadLatencyMs_p95   float64 `json:"read-latency-ms_p95"`
+	ReadLatencyMs_p99   float64 `json:"read-latency-ms_p99"`
+	CreateLatencyMs_p50 float64 `json:"create-latency-ms_p50"`
+	CreateLatencyMs_p95 float64 `json:"create-latency-ms_p95"`
+	CreateLatencyMs_p99 float64 `json:"create-latency-ms_p99"`
+	UpdateLatencyMs_p50 float64 `json:"update-latency-ms_p50"`
+	UpdateLatencyMs_p95 float64 `json:"update-latency-ms_p95"`
+	UpdateLatencyMs_p99 float64 `json:"update-latency-ms_p99"`
+	DeleteLatencyMs_p50 float64 `json:"delete-latency-ms_p50"`
+	DeleteLatencyMs_p95 float64 `json:"delete-latency-ms_p95"`
+	DeleteLatencyMs_p99 float64 `json:"delete-latency-ms_p99"`
+
 	// MissSLA counter is the number of queries with LatencyMs greater than
 	// the configured query latency SLA (config.metrics.query_latency_sla).
 	MissSLA int64 `json:"miss-sla"`
@@ -237,4 +278,12 @@ type MetricsLabelReport struct {
 
 type MetricsCDCReport struct {
 	Clients int64 `json:"clients"`
+
+	// LagMs stats represent the age of CDC events in milliseconds when sent to
+	// change stream clients: the time sent minus the event Ts. High lag means
+	// clients are behind real-time because of backpressure or slow consumers.
+	// Like LatencyMs, only the worst case is reported: max and percentiles.
+	LagMs_max  float64 `json:"lag-ms_max"`
+	LagMs_p99  float64 `json:"lag-ms_p99"`
+	LagMs_p999 float64 `json:"lag-ms_p999"`
 }
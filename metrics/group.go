@@ -104,33 +104,41 @@ type globalMetrics struct {
 }
 
 type entityMetrics struct {
-	query *queryMetrics
-	label map[string]*labelMetrics
-	trace map[string]map[string]*gm.Counter
+	query      *queryMetrics
+	label      map[string]*labelMetrics
+	queryLabel map[string]*gm.Counter
+	trace      map[string]map[string]*gm.Counter
 }
 
 type queryMetrics struct {
-	Query        *gm.Counter
-	Read         *gm.Counter
-	ReadQuery    *gm.Counter
-	ReadId       *gm.Counter
-	ReadMatch    *gm.Histogram
-	ReadLabels   *gm.Counter
-	Write        *gm.Counter
-	CreateOne    *gm.Counter
-	CreateMany   *gm.Counter
-	CreateBulk   *gm.Histogram
-	UpdateId     *gm.Counter
-	UpdateQuery  *gm.Counter
-	UpdateBulk   *gm.Histogram
-	DeleteId     *gm.Counter
-	DeleteQuery  *gm.Counter
-	DeleteBulk   *gm.Histogram
-	DeleteLabel  *gm.Counter
-	SetOp        *gm.Counter
-	Labels       *gm.Histogram
-	Latency      *gm.Histogram
-	MissSLA      *gm.Counter
+	Query       *gm.Counter
+	Read        *gm.Counter
+	ReadQuery   *gm.Counter
+	ReadId      *gm.Counter
+	ReadMatch   *gm.Histogram
+	ReadLabels  *gm.Counter
+	Write       *gm.Counter
+	CreateOne   *gm.Counter
+	CreateMany  *gm.Counter
+	CreateBulk  *gm.Histogram
+	UpdateId    *gm.Counter
+	UpdateQuery *gm.Counter
+	UpdateBulk  *gm.Histogram
+	DeleteId    *gm.Counter
+	DeleteQuery *gm.Counter
+	DeleteBulk  *gm.Histogram
+	DeleteLabel *gm.Counter
+	SetOp       *gm.Counter
+	Labels      *gm.Histogram
+	Latency     *gm.Histogram
+	MissSLA     *gm.Counter
+
+	// Latency per op, recorded with Latency (see groupEntityMetrics.op)
+	ReadLatency   *latencyHistogram
+	CreateLatency *latencyHistogram
+	UpdateLatency *latencyHistogram
+	DeleteLatency *latencyHistogram
+
 	Created      *gm.Counter
 	Updated      *gm.Counter
 	Deleted      *gm.Counter
@@ -145,6 +153,7 @@ type labelMetrics struct {
 
 type cdcMetrics struct {
 	Clients *gm.Counter
+	Lag     *gm.Histogram
 }
 
 func NewGroupMetrics() *groupMetrics {
@@ -158,6 +167,7 @@ func NewGroupMetrics() *groupMetrics {
 		},
 		cdc: &cdcMetrics{
 			Clients: gm.NewCounter(),
+			Lag:     gm.NewHistogram(latencyConfig),
 		},
 		entity: map[string]*entityMetrics{},
 		Mutex:  &sync.Mutex{},
@@ -202,6 +212,10 @@ func (m *groupMetrics) Report(reset bool) etre.Metrics {
 	m.report.Request.ClientError = m.request.ClientError.Count()
 
 	m.report.CDC.Clients = m.cdc.Clients.Count()
+	lagSnap := m.cdc.Lag.Snapshot(reset)
+	m.report.CDC.LagMs_max = lagSnap.Max
+	m.report.CDC.LagMs_p99 = lagSnap.Percentile[0.99]
+	m.report.CDC.LagMs_p999 = lagSnap.Percentile[0.999]
 
 	for entityType := range m.entity {
 		em := m.entity[entityType]
@@ -238,6 +252,10 @@ func (m *groupMetrics) Report(reset bool) etre.Metrics {
 		er.Query.LatencyMs_max = latencySnap.Max
 		er.Query.LatencyMs_p99 = latencySnap.Percentile[0.99]
 		er.Query.LatencyMs_p999 = latencySnap.Percentile[0.999]
+		qr.ReadLatencyMs_p50, qr.ReadLatencyMs_p95, qr.ReadLatencyMs_p99 = p50p95p99(em.query.ReadLatency, reset)
+		qr.CreateLatencyMs_p50, qr.CreateLatencyMs_p95, qr.CreateLatencyMs_p99 = p50p95p99(em.query.CreateLatency, reset)
+		qr.UpdateLatencyMs_p50, qr.UpdateLatencyMs_p95, qr.UpdateLatencyMs_p99 = p50p95p99(em.query.UpdateLatency, reset)
+		qr.DeleteLatencyMs_p50, qr.DeleteLatencyMs_p95, qr.DeleteLatencyMs_p99 = p50p95p99(em.query.DeleteLatency, reset)
 
 		for label, lm := range em.label {
 			lr, ok := er.Label[label]
@@ -250,6 +268,14 @@ func (m *groupMetrics) Report(reset bool) etre.Metrics {
 			lr.Delete = lm.Delete.Count()
 		}
 
+		if len(em.queryLabel) > 0 {
+			queryLabel := make(map[string]int64, len(em.queryLabel))
+			for label, cnt := range em.queryLabel {
+				queryLabel[label] = cnt.Count()
+			}
+			er.QueryLabel = queryLabel
+		}
+
 		trace := map[string]map[string]int64{}
 		for traceMetric, traceValues := range em.trace {
 			trace[traceMetric] = map[string]int64{}
@@ -260,7 +286,55 @@ func (m *groupMetrics) Report(reset bool) etre.Metrics {
 		er.Trace = trace
 	}
 
-	return etre.Metrics{Groups: []etre.MetricsGroupReport{m.report}}
+	// Return a copy because the next call reuses and changes m.report
+	return etre.Metrics{Groups: []etre.MetricsGroupReport{copyGroupReport(m.report)}}
+}
+
+// copyGroupReport returns a deep copy of the group report.
+func copyGroupReport(r etre.MetricsGroupReport) etre.MetricsGroupReport {
+	c := r
+	if r.Request != nil {
+		request := *r.Request
+		c.Request = &request
+	}
+	if r.CDC != nil {
+		cdc := *r.CDC
+		c.CDC = &cdc
+	}
+	if r.Entity != nil {
+		c.Entity = make(map[string]*etre.MetricsEntityReport, len(r.Entity))
+		for entityType, er := range r.Entity {
+			ec := *er
+			if er.Query != nil {
+				query := *er.Query
+				ec.Query = &query
+			}
+			if er.Label != nil {
+				ec.Label = make(map[string]*etre.MetricsLabelReport, len(er.Label))
+				for label, lr := range er.Label {
+					l := *lr
+					ec.Label[label] = &l
+				}
+			}
+			if er.Trace != nil {
+				ec.Trace = make(map[string]map[string]int64, len(er.Trace))
+				for metric, vals := range er.Trace {
+					ec.Trace[metric] = make(map[string]int64, len(vals))
+					for v, n := range vals {
+						ec.Trace[metric][v] = n
+					}
+				}
+			}
+			if er.QueryLabel != nil {
+				ec.QueryLabel = make(map[string]int64, len(er.QueryLabel))
+				for label, n := range er.QueryLabel {
+					ec.QueryLabel[label] = n
+				}
+			}
+			c.Entity[entityType] = &ec
+		}
+	}
+	return c
 }
 
 func minMaxAvgMed(h *gm.Histogram, reset bool) (int64, int64, int64, int64) {
@@ -272,6 +346,11 @@ func minMaxAvgMed(h *gm.Histogram, reset bool) (int64, int64, int64, int64) {
 	return int64(snap.Min), int64(snap.Max), avg, int64(snap.Percentile[0.50])
 }
 
+func p50p95p99(h *latencyHistogram, reset bool) (float64, float64, float64) {
+	snap := h.Snapshot(reset)
+	return snap.Percentile(0.50), snap.Percentile(0.95), snap.Percentile(0.99)
+}
+
 // --------------------------------------------------------------------------
 
 // groupEntityMetrics represents a groupMetrics bound to one entity type.
@@ -288,9 +367,14 @@ func minMaxAvgMed(h *gm.Histogram, reset bool) (int64, int64, int64, int64) {
 // Consequently, groupEntityMetrics provides all the Metrics interface methods
 // except Report() which groupMetrics provides because the report is not
 // entity type specific.
+//
+// Since a groupEntityMetrics is one request, it also tracks the request op
+// (read, create, update, or delete) from the counters the API increments,
+// like Read and CreateOne, to record LatencyMs per op.
 type groupEntityMetrics struct {
 	*groupMetrics                // embedded, provides Report()
 	em            *entityMetrics // points to groupMetrics.entity[EntityType()]
+	op            byte           // Read, CreateOne, UpdateId, DeleteId, or 0 if not known yet
 }
 
 var _ Metrics = &groupEntityMetrics{} // ensure groupEntityMetrics implements Metrics
@@ -343,9 +427,15 @@ func (m *groupEntityMetrics) EntityType(entityType string) {
 			Latency:      gm.NewHistogram(latencyConfig),
 			MissSLA:      gm.NewCounter(),
 			QueryTimeout: gm.NewCounter(),
+
+			ReadLatency:   newLatencyHistogram(),
+			CreateLatency: newLatencyHistogram(),
+			UpdateLatency: newLatencyHistogram(),
+			DeleteLatency: newLatencyHistogram(),
 		},
-		label: map[string]*labelMetrics{},
-		trace: map[string]map[string]*gm.Counter{},
+		label:      map[string]*labelMetrics{},
+		queryLabel: map[string]*gm.Counter{},
+		trace:      map[string]map[string]*gm.Counter{},
 	}
 
 	m.report.Entity[entityType] = &etre.MetricsEntityReport{
@@ -358,6 +448,16 @@ func (m *groupEntityMetrics) EntityType(entityType string) {
 }
 
 func (m *groupEntityMetrics) Inc(mn byte, n int64) {
+	switch mn {
+	case Read:
+		m.op = Read
+	case CreateOne, CreateMany:
+		m.op = CreateOne
+	case UpdateId, UpdateQuery, DeleteLabel: // deleting a label updates the entity
+		m.op = UpdateId
+	case DeleteId, DeleteQuery:
+		m.op = DeleteId
+	}
 	switch mn {
 	// Query
 	case Query:
@@ -420,6 +520,10 @@ func (m *groupEntityMetrics) Inc(mn byte, n int64) {
 }
 
 func (m *groupEntityMetrics) IncLabel(mn byte, label string) {
+	if mn == LabelQuery {
+		m.getQueryLabelCounter(label).Add(1)
+		return
+	}
 	lm := m.getLabelMetrics(label)
 	switch mn {
 	case LabelRead:
@@ -449,11 +553,32 @@ func (m *groupEntityMetrics) getLabelMetrics(label string) *labelMetrics {
 	return lm
 }
 
+func (m *groupEntityMetrics) getQueryLabelCounter(label string) *gm.Counter {
+	m.Lock()
+	defer m.Unlock()
+	cnt, ok := m.em.queryLabel[label]
+	if !ok {
+		cnt = gm.NewCounter()
+		m.em.queryLabel[label] = cnt
+	}
+	return cnt
+}
+
 func (m *groupEntityMetrics) Val(mn byte, n int64) {
 	f := float64(n)
 	switch mn {
 	case LatencyMs:
 		m.em.query.Latency.Record(f)
+		switch m.op {
+		case Read:
+			m.em.query.ReadLatency.Record(f)
+		case CreateOne:
+			m.em.query.CreateLatency.Record(f)
+		case UpdateId:
+			m.em.query.UpdateLatency.Record(f)
+		case DeleteId:
+			m.em.query.DeleteLatency.Record(f)
+		}
 	case Labels:
 		m.em.query.Labels.Record(f)
 	case ReadMatch:
@@ -464,6 +589,9 @@ func (m *groupEntityMetrics) Val(mn byte, n int64) {
 		m.em.query.UpdateBulk.Record(f)
 	case DeleteBulk:
 		m.em.query.DeleteBulk.Record(f)
+	// CDC
+	case CDCLagMs:
+		m.cdc.Lag.Record(f)
 	default:
 		errMsg := fmt.Sprintf("non-gauge metric number passed to Val: %d", mn)
 		panic(errMsg)
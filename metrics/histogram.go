@@ -0,0 +1,146 @@
+// Copyright 2026, Square, Inc.
+
+package metrics
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Latency histogram buckets are log-linear: bucket 0 is [0, 1ms), then each
+// power of 2 milliseconds is divided into latencyBucketsPerDoubling buckets
+// up to 2^latencyDoublings ms (~131s), then one overflow bucket. With 8 buckets
+// per doubling, each bucket is ~9% wide, so percentiles (interpolated within
+// a bucket) are accurate to within ~9% (usually much less) regardless of scale:
+// 1ms vs 2ms is as distinguishable as 1s vs 2s. Memory is fixed: 138 counters.
+const (
+	latencyBucketsPerDoubling = 8
+	latencyDoublings          = 17
+	latencyBuckets            = 1 + (latencyDoublings * latencyBucketsPerDoubling) + 1
+)
+
+// latencyHistogram is a concurrent, fixed-size histogram of query latencies
+// in milliseconds. Unlike gm.Histogram, it does not sample values, so it is
+// cheap to keep one per entity type and op.
+type latencyHistogram struct {
+	counts [latencyBuckets]atomic.Int64
+	min    atomic.Uint64 // math.Float64bits
+	max    atomic.Uint64 // math.Float64bits
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	h := &latencyHistogram{}
+	h.min.Store(math.Float64bits(math.Inf(1)))
+	return h
+}
+
+// Record records one latency value in milliseconds.
+func (h *latencyHistogram) Record(ms float64) {
+	if ms < 0 || math.IsNaN(ms) {
+		return
+	}
+	h.counts[latencyBucket(ms)].Add(1)
+	for {
+		old := h.min.Load()
+		if ms >= math.Float64frombits(old) || h.min.CompareAndSwap(old, math.Float64bits(ms)) {
+			break
+		}
+	}
+	for {
+		old := h.max.Load()
+		if ms <= math.Float64frombits(old) || h.max.CompareAndSwap(old, math.Float64bits(ms)) {
+			break
+		}
+	}
+}
+
+// Snapshot returns a copy of the histogram. If reset is true, the histogram
+// is reset to zero.
+func (h *latencyHistogram) Snapshot(reset bool) latencySnapshot {
+	s := latencySnapshot{}
+	for i := range h.counts {
+		if reset {
+			s.counts[i] = h.counts[i].Swap(0)
+		} else {
+			s.counts[i] = h.counts[i].Load()
+		}
+		s.n += s.counts[i]
+	}
+	if reset {
+		s.min = math.Float64frombits(h.min.Swap(math.Float64bits(math.Inf(1))))
+		s.max = math.Float64frombits(h.max.Swap(0))
+	} else {
+		s.min = math.Float64frombits(h.min.Load())
+		s.max = math.Float64frombits(h.max.Load())
+	}
+	return s
+}
+
+type latencySnapshot struct {
+	counts [latencyBuckets]int64
+	n      int64
+	min    float64
+	max    float64
+}
+
+// Percentile returns the p percentile (0 < p <= 1) latency in milliseconds,
+// linearly interpolated within the bucket that contains it. The bucket bounds
+// are clamped to the min and max values, so the percentile is exact if all
+// values are equal. It returns 0 if there are no values.
+func (s latencySnapshot) Percentile(p float64) float64 {
+	if s.n == 0 {
+		return 0
+	}
+	rank := p * float64(s.n)
+	var cum float64
+	for i, c := range s.counts {
+		if c == 0 {
+			continue
+		}
+		if cum+float64(c) < rank {
+			cum += float64(c)
+			continue
+		}
+		lo, hi := latencyBucketBounds(i)
+		if lo < s.min {
+			lo = s.min
+		}
+		if hi > s.max {
+			hi = s.max
+		}
+		v := lo + (hi-lo)*((rank-cum)/float64(c))
+		return math.Round(v*1000) / 1000 // µs precision
+	}
+	return s.max
+}
+
+// latencyBucket returns the bucket index for the value in milliseconds.
+func latencyBucket(ms float64) int {
+	if ms < 1 {
+		return 0
+	}
+	i := 1 + int(math.Log2(ms)*latencyBucketsPerDoubling)
+	if i >= latencyBuckets {
+		return latencyBuckets - 1 // overflow
+	}
+	// Log2 can be off by a rounding error at bucket bounds
+	if lo, _ := latencyBucketBounds(i); ms < lo {
+		i--
+	} else if _, hi := latencyBucketBounds(i); ms >= hi {
+		i++
+	}
+	return i
+}
+
+// latencyBucketBounds returns the lower (inclusive) and upper (exclusive)
+// bounds of bucket i in milliseconds. The overflow bucket upper bound is +Inf.
+func latencyBucketBounds(i int) (float64, float64) {
+	if i == 0 {
+		return 0, 1
+	}
+	lo := math.Exp2(float64(i-1) / latencyBucketsPerDoubling)
+	if i == latencyBuckets-1 {
+		return lo, math.Inf(1)
+	}
+	return lo, math.Exp2(float64(i) / latencyBucketsPerDoubling)
+}
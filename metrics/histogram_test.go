@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	// Record distributions of latencies and compare the histogram percentiles
+	// to the exact percentiles. Buckets are ~9% wide, so with interpolation
+	// the percentiles should be within 5%.
+	rnd := rand.New(rand.NewSource(42))
+	dists := map[string]func() float64{
+		"uniform 1-1000ms": func() float64 { return 1 + rnd.Float64()*999 },
+		"log-normal ~20ms": func() float64 { return math.Exp(3 + rnd.NormFloat64()) },
+		"exponential ~5ms": func() float64 { return 1 + rnd.ExpFloat64()*5 },
+		"bimodal 2ms/2s": func() float64 {
+			if rnd.Intn(10) == 0 {
+				return 2000 + rnd.Float64()*200
+			}
+			return 2 + rnd.Float64()*0.5
+		},
+	}
+	for name, next := range dists {
+		h := newLatencyHistogram()
+		vals := make([]float64, 10000)
+		for i := range vals {
+			vals[i] = next()
+			h.Record(vals[i])
+		}
+		sort.Float64s(vals)
+		snap := h.Snapshot(false)
+		assert.Equal(t, int64(len(vals)), snap.n, name)
+		assert.Equal(t, vals[len(vals)-1], snap.max, name)
+		for _, p := range []float64{0.50, 0.95, 0.99} {
+			exact := vals[int(math.Ceil(p*float64(len(vals))))-1]
+			got := snap.Percentile(p)
+			assert.InEpsilon(t, exact, got, 0.05, "%s p%.0f: exact %f, got %f", name, p*100, exact, got)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	assert.Equal(t, 0.0, h.Snapshot(false).Percentile(0.99))
+
+	// Single value and sub-ms and overflow values are exact (clamped to min/max)
+	h.Record(7)
+	assert.Equal(t, 7.0, h.Snapshot(false).Percentile(0.5))
+	h.Record(0.25)
+	assert.InDelta(t, 0.25, h.Snapshot(false).Percentile(0.001), 0.01)
+	h.Record(500000) // 500s > last bucket
+	assert.Equal(t, 500000.0, h.Snapshot(false).Percentile(1))
+
+	// Reset
+	snap := h.Snapshot(true)
+	assert.Equal(t, int64(3), snap.n)
+	snap = h.Snapshot(false)
+	assert.Equal(t, int64(0), snap.n)
+	assert.Equal(t, 0.0, snap.Percentile(0.5))
+	h.Record(3)
+	assert.Equal(t, 3.0, h.Snapshot(false).Percentile(0.5))
+
+	// Buckets are contiguous and increasing
+	for i := 1; i < latencyBuckets; i++ {
+		_, prevHi := latencyBucketBounds(i - 1)
+		lo, hi := latencyBucketBounds(i)
+		assert.Equal(t, prevHi, lo, "bucket %d", i)
+		assert.Less(t, lo, hi, "bucket %d", i)
+		assert.Equal(t, i, latencyBucket(lo), "bucket %d", i)
+	}
+}
@@ -58,6 +58,13 @@ const (
 	QueryTimeout                     // 34. counter
 	Load                             // 35. gauge   (system)
 	Error                            // 36. counter (system)
+	CDCLagMs                         // 37. histogram (global)
+	AuthenticateOK                   // 38. counter (system)
+	AuthenticateError                // 39. counter (system)
+	AuthorizeOK                      // 40. counter (system)
+	AuthorizeDenied                  // 41. counter (system)
+	CDCDropped                       // 42. counter (system)
+	LabelQuery                       // 43. counter (per-label, schema labels only)
 )
 
 // Metrics abstracts how metrics are stored and sampled.
@@ -74,7 +81,7 @@ type Metrics interface {
 	Inc(mn byte, n int64)
 
 	// IncLabel increments the metric name (mn) counter for the label by 1.
-	// The metric must be LabelRead, LabelUpdate, or LabelDelete.
+	// The metric must be LabelRead, LabelUpdate, LabelDelete, or LabelQuery.
 	//
 	// This is only valid for group metrics.
 	IncLabel(mn byte, label string)
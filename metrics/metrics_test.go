@@ -4,6 +4,7 @@ package metrics_test
 
 import (
 	"encoding/json"
+	"sync"
 	"testing"
 	"time"
 
@@ -101,48 +102,51 @@ func TestEntityMetrics(t *testing.T) {
 					"t1": &etre.MetricsEntityReport{
 						EntityType: "t1",
 						Query: &etre.MetricsQueryReport{
-							Query:          100,
-							SetOp:          101,
-							MissSLA:        102,
-							Read:           103,
-							ReadQuery:      104,
-							ReadId:         105,
-							ReadMatch_min:  30,
-							ReadMatch_max:  30,
-							ReadMatch_avg:  30,
-							ReadMatch_med:  30,
-							ReadLabels:     106,
-							Write:          107,
-							CreateOne:      108,
-							CreateMany:     115,
-							CreateBulk_min: 40,
-							CreateBulk_max: 40,
-							CreateBulk_avg: 40,
-							CreateBulk_med: 40,
-							UpdateId:       110,
-							UpdateQuery:    116,
-							UpdateBulk_min: 50,
-							UpdateBulk_max: 50,
-							UpdateBulk_avg: 50,
-							UpdateBulk_med: 50,
-							DeleteId:       112,
-							DeleteQuery:    117,
-							DeleteBulk_min: 60,
-							DeleteBulk_max: 60,
-							DeleteBulk_avg: 60,
-							DeleteBulk_med: 60,
-							DeleteLabel:    114,
-							Labels_min:     5,
-							Labels_max:     20,
-							Labels_avg:     11,
-							Labels_med:     10,
-							LatencyMs_max:  250,
-							LatencyMs_p99:  250,
-							LatencyMs_p999: 250,
-							Created:        118,
-							Updated:        119,
-							Deleted:        120,
-							QueryTimeout:   130,
+							Query:               100,
+							SetOp:               101,
+							MissSLA:             102,
+							Read:                103,
+							ReadQuery:           104,
+							ReadId:              105,
+							ReadMatch_min:       30,
+							ReadMatch_max:       30,
+							ReadMatch_avg:       30,
+							ReadMatch_med:       30,
+							ReadLabels:          106,
+							Write:               107,
+							CreateOne:           108,
+							CreateMany:          115,
+							CreateBulk_min:      40,
+							CreateBulk_max:      40,
+							CreateBulk_avg:      40,
+							CreateBulk_med:      40,
+							UpdateId:            110,
+							UpdateQuery:         116,
+							UpdateBulk_min:      50,
+							UpdateBulk_max:      50,
+							UpdateBulk_avg:      50,
+							UpdateBulk_med:      50,
+							DeleteId:            112,
+							DeleteQuery:         117,
+							DeleteBulk_min:      60,
+							DeleteBulk_max:      60,
+							DeleteBulk_avg:      60,
+							DeleteBulk_med:      60,
+							DeleteLabel:         114,
+							Labels_min:          5,
+							Labels_max:          20,
+							Labels_avg:          11,
+							Labels_med:          10,
+							LatencyMs_max:       250,
+							LatencyMs_p99:       250,
+							LatencyMs_p999:      250,
+							UpdateLatencyMs_p50: 250, // last op was DeleteLabel
+							UpdateLatencyMs_p95: 250,
+							UpdateLatencyMs_p99: 250,
+							Created:             118,
+							Updated:             119,
+							Deleted:             120,
+							QueryTimeout:        130,
 						},
 						Label: map[string]*etre.MetricsLabelReport{
 							"lr": &etre.MetricsLabelReport{
@@ -228,6 +232,53 @@ func TestMultipleEntityMetrics(t *testing.T) {
 	assert.Equal(t, expectReport, gotReport)
 }
 
+func TestCDCLagMetrics(t *testing.T) {
+	// CDC lag is recorded without an entity type because the changes
+	// endpoint doesn't have one
+	gm := metrics.NewGroupMetrics()
+	em := metrics.NewGroupEntityMetrics(gm)
+
+	em.Inc(metrics.CDCClients, 1)
+	em.Val(metrics.CDCLagMs, 100)
+	em.Val(metrics.CDCLagMs, 5000)
+
+	gotReport := em.Report(true)
+	require.Len(t, gotReport.Groups, 1)
+	cdc := gotReport.Groups[0].CDC
+	assert.Equal(t, int64(1), cdc.Clients)
+	assert.Equal(t, float64(5000), cdc.LagMs_max)
+	assert.Equal(t, float64(5000), cdc.LagMs_p99)
+
+	// Reset
+	gotReport = em.Report(true)
+	assert.Equal(t, float64(0), gotReport.Groups[0].CDC.LagMs_max)
+}
+
+func TestSystemAuthMetrics(t *testing.T) {
+	sm := metrics.NewSystemMetrics()
+	sm.Inc(metrics.AuthenticateOK, 2)
+	sm.Inc(metrics.AuthenticateError, 1)
+	sm.Inc(metrics.AuthorizeOK, 3)
+	sm.Inc(metrics.AuthorizeDenied, 1)
+
+	r := sm.Report(false).System
+	require.NotNil(t, r)
+	assert.Equal(t, int64(2), r.AuthenticateOK)
+	assert.Equal(t, int64(1), r.AuthenticateError)
+	assert.Equal(t, int64(3), r.AuthorizeOK)
+	assert.Equal(t, int64(1), r.AuthorizeDenied)
+}
+
+func TestSystemCDCDropped(t *testing.T) {
+	sm := metrics.NewSystemMetrics()
+	sm.Inc(metrics.CDCDropped, 1)
+	sm.Inc(metrics.CDCDropped, 1)
+
+	r := sm.Report(false).System
+	require.NotNil(t, r)
+	assert.Equal(t, int64(2), r.CDCDropped)
+}
+
 func TestSharedEntityMetrics(t *testing.T) {
 	// Like TestMultipleEntityMetrics above but this time we have 2 em
 	// instances that concurrently read/write the same entity type (t1)
@@ -338,3 +389,137 @@ func TestMemoryStore(t *testing.T) {
 	expectNames := []string{"test"}
 	assert.Equal(t, expectNames, gotNames)
 }
+
+func TestLatencyPerOp(t *testing.T) {
+	// Each request is a new groupEntityMetrics which records LatencyMs for the op
+	// of the last query counter: Read, CreateOne, UpdateId, DeleteId, etc.
+	gm := metrics.NewGroupMetrics()
+	request := func(op byte, ms int64) {
+		em := metrics.NewGroupEntityMetrics(gm)
+		em.EntityType("t1")
+		if op == metrics.ReadQuery {
+			em.Inc(metrics.Read, 1)
+		} else {
+			em.Inc(metrics.Write, 1)
+		}
+		em.Inc(op, 1)
+		em.Val(metrics.LatencyMs, ms)
+	}
+	for i := int64(1); i <= 100; i++ {
+		request(metrics.ReadQuery, i) // 1-100ms
+	}
+	request(metrics.CreateMany, 20)
+	request(metrics.UpdateQuery, 30)
+	request(metrics.DeleteLabel, 40) // update
+	request(metrics.DeleteId, 50)
+	request(metrics.Write, 60) // op not known
+
+	r := gm.Report(true)
+	qr := r.Groups[0].Entity["t1"].Query
+	assert.InEpsilon(t, 50, qr.ReadLatencyMs_p50, 0.05)
+	assert.InEpsilon(t, 95, qr.ReadLatencyMs_p95, 0.05)
+	assert.InEpsilon(t, 99, qr.ReadLatencyMs_p99, 0.05)
+	assert.Equal(t, 20.0, qr.CreateLatencyMs_p99)
+	assert.InEpsilon(t, 30, qr.UpdateLatencyMs_p50, 0.1) // bucket [30, ~32ms)
+	assert.InEpsilon(t, 40, qr.UpdateLatencyMs_p99, 0.1)
+	assert.Equal(t, 50.0, qr.DeleteLatencyMs_p99)
+	assert.Equal(t, 100.0, qr.LatencyMs_max)
+
+	// Reset
+	r = gm.Report(false)
+	qr = r.Groups[0].Entity["t1"].Query
+	assert.Equal(t, 0.0, qr.ReadLatencyMs_p99)
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	// Snapshot while writers increment metrics in two groups. Snapshots must
+	// be copies that don't change (no torn reads), and the counter deltas
+	// from SnapshotAndReset must add up to the total without losing increments.
+	store := metrics.NewMemoryStore()
+	f := metrics.GroupFactory{Store: store}
+	groups := []string{"g1", "g2"}
+
+	const writers = 4
+	const n = 2000
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				m := f.Make(groups) // one request
+				m.EntityType("t1")
+				m.Inc(metrics.Query, 1)
+				m.Inc(metrics.Read, 1)
+				m.Inc(metrics.ReadQuery, 1)
+				m.IncLabel(metrics.LabelRead, "x")
+				m.IncLabel(metrics.LabelQuery, "x")
+				m.Val(metrics.LatencyMs, 5)
+			}
+		}()
+	}
+
+	writersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(writersDone)
+	}()
+
+	type saved struct {
+		m    etre.Metrics
+		json string
+	}
+	var snapshots []saved
+	deltas := map[string]int64{}
+	addDeltas := func(m etre.Metrics) {
+		for _, g := range m.Groups {
+			er := g.Entity["t1"]
+			if er == nil {
+				continue
+			}
+			require.GreaterOrEqual(t, er.Query.Read, int64(0))
+			deltas[g.Group] += er.Query.Read
+		}
+	}
+	for done := false; !done; {
+		select {
+		case <-writersDone:
+			done = true
+		default:
+		}
+		m := store.Snapshot()
+		bytes, _ := json.Marshal(m)
+		snapshots = append(snapshots, saved{m: m, json: string(bytes)})
+		addDeltas(store.SnapshotAndReset())
+		time.Sleep(time.Millisecond)
+	}
+	addDeltas(store.SnapshotAndReset()) // the rest
+	require.Greater(t, len(snapshots), 1)
+
+	// Earlier snapshots did not change (not torn by later snapshots or writes)
+	for i, s := range snapshots {
+		bytes, _ := json.Marshal(s.m)
+		require.Equal(t, s.json, string(bytes), "snapshot %d changed", i)
+	}
+
+	total := int64(writers * n)
+	final := store.Snapshot()
+	require.Len(t, final.Groups, 2)
+	for i, g := range final.Groups {
+		assert.Equal(t, groups[i], g.Group) // sorted by name
+		er := g.Entity["t1"]
+		assert.Equal(t, total, er.Query.Read, g.Group) // cumulative, not reset
+		assert.Equal(t, total, er.Label["x"].Read, g.Group)
+		assert.Equal(t, total, er.QueryLabel["x"], g.Group)
+		assert.Equal(t, total, deltas[g.Group], g.Group)
+	}
+
+	// Nothing since the last SnapshotAndReset: counters deltas and stats are zero
+	m := store.SnapshotAndReset()
+	for _, g := range m.Groups {
+		qr := g.Entity["t1"].Query
+		assert.Equal(t, int64(0), qr.Read)
+		assert.Equal(t, float64(0), qr.LatencyMs_max)
+		assert.Equal(t, float64(0), qr.ReadLatencyMs_p99)
+	}
+}
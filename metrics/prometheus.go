@@ -0,0 +1,167 @@
+// Copyright 2026, Square, Inc.
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/square/etre"
+)
+
+// PROMETHEUS_CONTENT_TYPE is the Content-Type of the Prometheus text exposition format.
+const PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// gauges are metrics (JSON field names) that go up and down. Stats (fields with
+// a suffix like "_max" and "_p99") are gauges, too. All other metrics are counters.
+var gauges = map[string]bool{
+	"load":    true,
+	"clients": true,
+}
+
+// isCounter returns true if the report field (JSON field name) is a counter.
+func isCounter(field string) bool {
+	return !gauges[field] && !strings.Contains(field, "_")
+}
+
+// WritePrometheus writes the metrics report in Prometheus text exposition format.
+// Metric names are the JSON field names prefixed by the sub-report: "etre_system_",
+// "etre_request_", "etre_query_", and "etre_cdc_". Counters have suffix "_total".
+// Group metrics have label "group", and query metrics have label "entity_type".
+// Query label usage (MetricsEntityReport.QueryLabel) is written as counter
+// "etre_query_label_total" with label "label".
+//
+// To bound label cardinality, label (MetricsLabelReport) and trace metrics are
+// not written: their values are user-defined. QueryLabel is bounded by the schema.
+func WritePrometheus(w io.Writer, m etre.Metrics) error {
+	bw := bufio.NewWriter(w)
+
+	if m.System != nil {
+		writeFamilies(bw, "etre_system", []sample{{v: reflect.ValueOf(*m.System)}})
+	}
+
+	groups := make([]etre.MetricsGroupReport, 0, len(m.Groups))
+	for _, g := range m.Groups {
+		if g.Group != "" {
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Group < groups[j].Group })
+
+	var request, query, cdc []sample
+	var queryLabel []string // sample lines
+	for _, g := range groups {
+		labels := []string{"group", g.Group}
+		if g.Request != nil {
+			request = append(request, sample{labels: labels, v: reflect.ValueOf(*g.Request)})
+		}
+		entityTypes := make([]string, 0, len(g.Entity))
+		for et := range g.Entity {
+			entityTypes = append(entityTypes, et)
+		}
+		sort.Strings(entityTypes)
+		for _, et := range entityTypes {
+			e := g.Entity[et]
+			if e == nil {
+				continue
+			}
+			if e.Query != nil {
+				query = append(query, sample{labels: append(labels, "entity_type", et), v: reflect.ValueOf(*e.Query)})
+			}
+			names := make([]string, 0, len(e.QueryLabel))
+			for label := range e.QueryLabel {
+				names = append(names, label)
+			}
+			sort.Strings(names)
+			for _, label := range names {
+				queryLabel = append(queryLabel, fmt.Sprintf("etre_query_label_total%s %d",
+					promLabels([]string{"group", g.Group, "entity_type", et, "label", label}), e.QueryLabel[label]))
+			}
+		}
+		if g.CDC != nil {
+			cdc = append(cdc, sample{labels: labels, v: reflect.ValueOf(*g.CDC)})
+		}
+	}
+	writeFamilies(bw, "etre_request", request)
+	writeFamilies(bw, "etre_query", query)
+	if len(queryLabel) > 0 {
+		fmt.Fprintln(bw, "# TYPE etre_query_label_total counter")
+		for _, line := range queryLabel {
+			fmt.Fprintln(bw, line)
+		}
+	}
+	writeFamilies(bw, "etre_cdc", cdc)
+
+	return bw.Flush()
+}
+
+// sample is one metrics sub-report (struct value) with its Prometheus labels
+// as name-value pairs.
+type sample struct {
+	labels []string
+	v      reflect.Value
+}
+
+// writeFamilies writes one metric family per struct field. All samples of
+// a family must be written together, so samples are written field by field.
+func writeFamilies(w *bufio.Writer, prefix string, samples []sample) {
+	if len(samples) == 0 {
+		return
+	}
+	t := samples[0].v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if field == "" || field == "-" {
+			continue
+		}
+		kind := t.Field(i).Type.Kind()
+		if kind != reflect.Int64 && kind != reflect.Float64 {
+			continue // not a metric, like MetricsEntityReport.EntityType
+		}
+		name := prefix + "_" + strings.ReplaceAll(field, "-", "_")
+		typ := "gauge"
+		if isCounter(field) {
+			typ = "counter"
+			name += "_total"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		for _, s := range samples {
+			f := s.v.Field(i)
+			var val string
+			if kind == reflect.Int64 {
+				val = fmt.Sprintf("%d", f.Int())
+			} else {
+				val = fmt.Sprintf("%g", f.Float())
+			}
+			fmt.Fprintf(w, "%s%s %s\n", name, promLabels(s.labels), val)
+		}
+	}
+}
+
+// promLabels returns the labels (name-value pairs) formatted like {a="1",b="2"}.
+func promLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], promEscape(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// promEscape escapes a label value. %q escapes backslash, double quote, and
+// newline, but it also escapes non-printable runes which Prometheus does not
+// allow, so replace those first.
+func promEscape(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r != '\n' && (r < 0x20 || r == 0x7f) {
+			return -1
+		}
+		return r
+	}, s)
+}
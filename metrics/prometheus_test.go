@@ -0,0 +1,89 @@
+// Copyright 2026, Square, Inc.
+
+package metrics_test
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/square/etre/metrics"
+)
+
+var (
+	promType   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge)$`)
+	promSample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+)
+
+// parsePrometheus parses the text exposition format and returns the samples:
+// metric name => labels => value. It fails the test if a line does not parse,
+// a sample does not have a TYPE, or a metric family is not contiguous.
+func parsePrometheus(t *testing.T, out []byte) map[string]map[string]string {
+	samples := map[string]map[string]string{}
+	types := map[string]bool{}
+	current := ""
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if m := promType.FindStringSubmatch(line); m != nil {
+			require.False(t, types[m[1]], "duplicate TYPE: %s", line)
+			types[m[1]] = true
+			current = m[1]
+			continue
+		}
+		m := promSample.FindStringSubmatch(line)
+		require.NotNil(t, m, "invalid line: %s", line)
+		require.Equal(t, current, m[1], "sample not in its metric family: %s", line)
+		if samples[m[1]] == nil {
+			samples[m[1]] = map[string]string{}
+		}
+		samples[m[1]][m[2]] = m[3]
+	}
+	require.NoError(t, s.Err())
+	return samples
+}
+
+func TestWritePrometheus(t *testing.T) {
+	sm := metrics.NewSystemMetrics()
+	sm.Inc(metrics.Query, 3)
+	sm.Inc(metrics.Load, 1)
+
+	gm := metrics.NewGroupMetrics()
+	em := metrics.NewGroupEntityMetrics(gm)
+	em.EntityType("node")
+	em.Inc(metrics.Read, 2)
+	em.IncLabel(metrics.LabelRead, "zone")
+	em.Trace(map[string]string{"app": "foo"})
+	em.Val(metrics.LatencyMs, 10)
+	em.EntityType("host")
+	em.Inc(metrics.Read, 5)
+	em.Inc(metrics.ClientError, 1)
+	em.Inc(metrics.CDCClients, 1)
+
+	all := sm.Report(false)
+	r := gm.Report(false)
+	r.Groups[0].Group = `g1"x`
+	all.Groups = r.Groups
+
+	var buf bytes.Buffer
+	err := metrics.WritePrometheus(&buf, all)
+	require.NoError(t, err)
+	t.Log(buf.String())
+
+	got := parsePrometheus(t, buf.Bytes())
+	assert.Equal(t, "3", got["etre_system_query_total"][""])
+	assert.Equal(t, "1", got["etre_system_load"][""])
+	assert.Equal(t, "1", got["etre_request_client_error_total"][`{group="g1\"x"}`])
+	assert.Equal(t, "2", got["etre_query_read_total"][`{group="g1\"x",entity_type="node"}`])
+	assert.Equal(t, "5", got["etre_query_read_total"][`{group="g1\"x",entity_type="host"}`])
+	assert.Equal(t, "10", got["etre_query_latency_ms_max"][`{group="g1\"x",entity_type="node"}`])
+	assert.Equal(t, "1", got["etre_cdc_clients"][`{group="g1\"x"}`])
+
+	// Label and trace metrics are not written to bound label cardinality
+	assert.NotContains(t, buf.String(), "zone")
+	assert.NotContains(t, buf.String(), "foo")
+}
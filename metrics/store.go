@@ -4,24 +4,44 @@ package metrics
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+
+	"github.com/square/etre"
 )
 
 type Store interface {
 	Add(m Metrics, name string) error
 	Get(name string) Metrics
 	Names() []string
+
+	// Snapshot returns a copy of the metrics of all groups, sorted by group name.
+	// The copy does not change when metrics change, so it is safe to use while
+	// requests update metrics.
+	Snapshot() etre.Metrics
+
+	// SnapshotAndReset is like Snapshot for interval reporting: counters are
+	// deltas since the previous call to SnapshotAndReset, and stats (like
+	// latency percentiles) are reset. The stored counters are not reset, so
+	// Snapshot and the API metrics endpoint still report cumulative counters.
+	SnapshotAndReset() etre.Metrics
 }
 
 type memoryStore struct {
 	metrics map[string]Metrics
 	*sync.RWMutex
+	resetMux *sync.Mutex
+	prev     map[string]etre.MetricsGroupReport // cumulative, as of last SnapshotAndReset
 }
 
 func NewMemoryStore() Store {
 	return &memoryStore{
-		metrics: map[string]Metrics{},
-		RWMutex: &sync.RWMutex{},
+		metrics:  map[string]Metrics{},
+		RWMutex:  &sync.RWMutex{},
+		resetMux: &sync.Mutex{},
+		prev:     map[string]etre.MetricsGroupReport{},
 	}
 }
 
@@ -50,3 +70,88 @@ func (s *memoryStore) Names() []string {
 	s.RUnlock()
 	return names
 }
+
+func (s *memoryStore) Snapshot() etre.Metrics {
+	return s.snapshot(false)
+}
+
+func (s *memoryStore) SnapshotAndReset() etre.Metrics {
+	s.resetMux.Lock() // serialize to compute deltas from s.prev
+	defer s.resetMux.Unlock()
+	m := s.snapshot(true)
+	for i := range m.Groups {
+		cum := copyGroupReport(m.Groups[i])
+		if prev, ok := s.prev[cum.Group]; ok {
+			subGroupCounters(&m.Groups[i], prev)
+		}
+		s.prev[cum.Group] = cum
+	}
+	return m
+}
+
+func (s *memoryStore) snapshot(reset bool) etre.Metrics {
+	// Read lock to report all groups at once: no groups are added while
+	// reporting. Group metrics Report returns a copy, and counters are atomic,
+	// so requests are not blocked while reporting.
+	s.RLock()
+	defer s.RUnlock()
+	names := make([]string, 0, len(s.metrics))
+	for name := range s.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	groups := make([]etre.MetricsGroupReport, 0, len(names))
+	for _, name := range names {
+		r := s.metrics[name].Report(reset)
+		if len(r.Groups) == 0 {
+			continue
+		}
+		g := r.Groups[0]
+		g.Group = name
+		groups = append(groups, g)
+	}
+	return etre.Metrics{Groups: groups}
+}
+
+// subGroupCounters subtracts the prev counters from the group report counters.
+// Gauges and stats are not changed.
+func subGroupCounters(r *etre.MetricsGroupReport, prev etre.MetricsGroupReport) {
+	subCounters(r.Request, prev.Request)
+	subCounters(r.CDC, prev.CDC)
+	for entityType, er := range r.Entity {
+		pe, ok := prev.Entity[entityType]
+		if !ok {
+			continue
+		}
+		subCounters(er.Query, pe.Query)
+		for label, lr := range er.Label {
+			subCounters(lr, pe.Label[label])
+		}
+		for label := range er.QueryLabel {
+			er.QueryLabel[label] -= pe.QueryLabel[label]
+		}
+		for metric, vals := range er.Trace {
+			for v := range vals {
+				vals[v] -= pe.Trace[metric][v]
+			}
+		}
+	}
+}
+
+// subCounters subtracts prev counters from r counters. Both must be pointers
+// to the same report struct type, like *etre.MetricsQueryReport.
+func subCounters(r, prev interface{}) {
+	rv, pv := reflect.ValueOf(r), reflect.ValueOf(prev)
+	if rv.IsNil() || pv.IsNil() {
+		return
+	}
+	rv, pv = rv.Elem(), pv.Elem()
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if t.Field(i).Type.Kind() != reflect.Int64 || !isCounter(field) {
+			continue
+		}
+		rv.Field(i).SetInt(rv.Field(i).Int() - pv.Field(i).Int())
+	}
+}
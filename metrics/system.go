@@ -19,6 +19,11 @@ type systemMetrics struct {
 	invalidEntityType *gm.Counter
 	load              *gm.Gauge
 	error             *gm.Counter
+	authnOK           *gm.Counter
+	authnError        *gm.Counter
+	authzOK           *gm.Counter
+	authzDenied       *gm.Counter
+	cdcDropped        *gm.Counter
 }
 
 var _ Metrics = &systemMetrics{} // ensure systemMetrics implements Metrics
@@ -31,6 +36,11 @@ func NewSystemMetrics() *systemMetrics {
 		invalidEntityType: gm.NewCounter(),
 		load:              gm.NewGauge(gm.Config{}),
 		error:             gm.NewCounter(),
+		authnOK:           gm.NewCounter(),
+		authnError:        gm.NewCounter(),
+		authzOK:           gm.NewCounter(),
+		authzDenied:       gm.NewCounter(),
+		cdcDropped:        gm.NewCounter(),
 	}
 }
 
@@ -48,6 +58,16 @@ func (m *systemMetrics) Inc(mn byte, n int64) {
 		m.load.Add(n)
 	case Error:
 		m.error.Add(n)
+	case AuthenticateOK:
+		m.authnOK.Add(n)
+	case AuthenticateError:
+		m.authnError.Add(n)
+	case AuthorizeOK:
+		m.authzOK.Add(n)
+	case AuthorizeDenied:
+		m.authzDenied.Add(n)
+	case CDCDropped:
+		m.cdcDropped.Add(n)
 	default:
 		errMsg := fmt.Sprintf("non-counter metric number passed to Inc: %d", mn)
 		panic(errMsg)
@@ -74,6 +94,11 @@ func (m *systemMetrics) Report(reset bool) etre.Metrics {
 		AuthenticationFailed: m.authFail.Count(),
 		Load:                 int64(m.load.Last()),
 		Error:                m.error.Count(),
+		AuthenticateOK:       m.authnOK.Count(),
+		AuthenticateError:    m.authnError.Count(),
+		AuthorizeOK:          m.authzOK.Count(),
+		AuthorizeDenied:      m.authzDenied.Count(),
+		CDCDropped:           m.cdcDropped.Count(),
 	}
 	return etre.Metrics{System: r}
 }
@@ -0,0 +1,207 @@
+// Copyright 2026, Square, Inc.
+
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Builder builds a valid query string from labels and values, which is safer than
+// string concatenation for values from user input. For example:
+//
+//	q, err := query.New().Equal("y", "a").GreaterThan("z", 1).Build() // "y=a,z>1"
+//
+// Predicates are ANDed. Or starts a new OR term (VERSION_3). Values are quoted only
+// if needed (VERSION_4), like a value with a comma, so any string value can be
+// matched. The first invalid label or value is an error, and the query is not built.
+// Send built queries with version LATEST_VERSION (etre.EntityClientConfig.QueryVersion)
+// because the API uses DEFAULT_VERSION if the client does not set a version.
+type Builder struct {
+	terms [][]string // OR terms, each a list of ANDed predicates
+	err   error
+}
+
+// New returns a new, empty query Builder.
+func New() *Builder {
+	return &Builder{}
+}
+
+// Equal adds predicate label=value.
+func (b *Builder) Equal(label, value string) *Builder {
+	return b.add(label, "=", value)
+}
+
+// NotEqual adds predicate label!=value.
+func (b *Builder) NotEqual(label, value string) *Builder {
+	return b.add(label, "!=", value)
+}
+
+// In adds predicate label in (values).
+func (b *Builder) In(label string, values ...string) *Builder {
+	return b.addSet(label, "in", values)
+}
+
+// NotIn adds predicate label notin (values).
+func (b *Builder) NotIn(label string, values ...string) *Builder {
+	return b.addSet(label, "notin", values)
+}
+
+// Exists adds predicate label, which matches entities that have the label.
+func (b *Builder) Exists(label string) *Builder {
+	if b.err == nil {
+		b.err = validLabel(label)
+	}
+	return b.pred(label)
+}
+
+// NotExists adds predicate !label, which matches entities that do not have the label.
+func (b *Builder) NotExists(label string) *Builder {
+	if b.err == nil {
+		b.err = validLabel(label)
+	}
+	return b.pred("!" + label)
+}
+
+// GreaterThan adds predicate label>value. The value is a number (int, int64,
+// or float64), or a string for a string comparison, which is always quoted.
+func (b *Builder) GreaterThan(label string, value interface{}) *Builder {
+	return b.addCompare(label, ">", value)
+}
+
+// GreaterOrEqual adds predicate label>=value. See GreaterThan.
+func (b *Builder) GreaterOrEqual(label string, value interface{}) *Builder {
+	return b.addCompare(label, ">=", value)
+}
+
+// LessThan adds predicate label<value. See GreaterThan.
+func (b *Builder) LessThan(label string, value interface{}) *Builder {
+	return b.addCompare(label, "<", value)
+}
+
+// LessOrEqual adds predicate label<=value. See GreaterThan.
+func (b *Builder) LessOrEqual(label string, value interface{}) *Builder {
+	return b.addCompare(label, "<=", value)
+}
+
+// Or starts a new OR term: predicates added after Or are ANDed in the new term,
+// and the query matches if any term matches. It requires VERSION_3.
+func (b *Builder) Or() *Builder {
+	if len(b.terms) == 0 {
+		b.terms = append(b.terms, nil) // empty first term, error on Build
+	}
+	b.terms = append(b.terms, nil)
+	return b
+}
+
+// Err returns the first invalid label or value, if any.
+func (b *Builder) Err() error {
+	return b.err
+}
+
+// Build returns the query string, or an error if a label or value is invalid,
+// or the query or an OR term is empty.
+func (b *Builder) Build() (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	if len(b.terms) == 0 {
+		return "", fmt.Errorf("empty query: no predicates")
+	}
+	terms := make([]string, len(b.terms))
+	for i, preds := range b.terms {
+		if len(preds) == 0 {
+			return "", fmt.Errorf("empty OR term %d: no predicates", i)
+		}
+		terms[i] = strings.Join(preds, ",")
+	}
+	return strings.Join(terms, string(OR_OPERATOR)), nil
+}
+
+// String returns the query string, or an empty string if Build returns an error.
+func (b *Builder) String() string {
+	q, _ := b.Build()
+	return q
+}
+
+func (b *Builder) add(label, op, value string) *Builder {
+	if b.err == nil {
+		b.err = validLabel(label)
+	}
+	return b.pred(label + op + quoteValue(value))
+}
+
+func (b *Builder) addSet(label, op string, values []string) *Builder {
+	if b.err == nil {
+		if b.err = validLabel(label); b.err == nil && len(values) == 0 {
+			b.err = fmt.Errorf("%s: no values for %s operator", label, op)
+		}
+	}
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quoteValue(v)
+	}
+	return b.pred(label + " " + op + " (" + strings.Join(quoted, ",") + ")")
+}
+
+func (b *Builder) addCompare(label, op string, value interface{}) *Builder {
+	var s string
+	switch v := value.(type) {
+	case int:
+		s = strconv.Itoa(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		s = quote(v) // string comparison, not number
+	default:
+		if b.err == nil {
+			b.err = fmt.Errorf("%s: value for %s operator is not a number or string: %v (%T)", label, op, value, value)
+		}
+	}
+	if b.err == nil {
+		b.err = validLabel(label)
+	}
+	return b.pred(label + op + s)
+}
+
+func (b *Builder) pred(p string) *Builder {
+	if len(b.terms) == 0 {
+		b.terms = append(b.terms, nil)
+	}
+	last := len(b.terms) - 1
+	b.terms[last] = append(b.terms[last], p)
+	return b
+}
+
+// validLabel returns an error if the label cannot be parsed as a label.
+func validLabel(label string) error {
+	if label == "" {
+		return fmt.Errorf("empty label")
+	}
+	for _, r := range label {
+		if isSpace(r) || r == ',' || IsInvalidLabelChar(r) {
+			return fmt.Errorf("%s: invalid label character: %q", label, r)
+		}
+	}
+	return nil
+}
+
+// quoteValue returns the value quoted if it cannot be parsed as is: if it's
+// empty, has characters that separate predicates, OR terms, or value lists, or
+// quotes, or begins or ends with a space that the parser trims. Else, it returns
+// the value as is, which is valid in every query language version.
+func quoteValue(value string) string {
+	if value == "" || strings.TrimSpace(value) != value || value[0] == '=' ||
+		strings.ContainsAny(value, `,()"'`+string(OR_OPERATOR)) {
+		return quote(value)
+	}
+	return value
+}
+
+// quote returns the value double-quoted with \ and " escaped (VERSION_4).
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,132 @@
+// Copyright 2026, Square, Inc.
+
+package query_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/square/etre/query"
+)
+
+func TestBuilder(t *testing.T) {
+	// Test that built queries are the expected string and round-trip through
+	// query.Translate to the expected predicates, including values with special
+	// characters that the parser allows in a value, and values that must be quoted
+	testCases := []struct {
+		b      *query.Builder
+		query  string
+		expect query.Query
+	}{
+		{
+			b:     query.New().Equal("y", "a").GreaterThan("z", 1),
+			query: "y=a,z>1",
+			expect: query.Query{Predicates: []query.Predicate{
+				{Label: "y", Operator: "=", Value: "a"},
+				{Label: "z", Operator: ">", Value: 1},
+			}},
+		},
+		{
+			b:     query.New().NotEqual("y", "us east").In("z", "a", "b c").NotIn("_id", "1"),
+			query: "y!=us east,z in (a,b c),_id notin (1)",
+			expect: query.Query{Predicates: []query.Predicate{
+				{Label: "y", Operator: "!=", Value: "us east"},
+				{Label: "z", Operator: "in", Value: []string{"a", "b c"}},
+				{Label: "_id", Operator: "notin", Value: []string{"1"}},
+			}},
+		},
+		{
+			b:     query.New().Exists("x").NotExists("y").LessOrEqual("z", 1.5).GreaterOrEqual("z", int64(-2)).LessThan("s", "b"),
+			query: `x,!y,z<=1.5,z>=-2,s<"b"`,
+			expect: query.Query{Predicates: []query.Predicate{
+				{Label: "x", Operator: "exists"},
+				{Label: "y", Operator: "notexists"},
+				{Label: "z", Operator: "<=", Value: 1.5},
+				{Label: "z", Operator: ">=", Value: -2},
+				{Label: "s", Operator: "<", Value: "b"},
+			}},
+		},
+		{
+			// Special characters allowed in values
+			b:     query.New().Equal("path", "/a/b?c=d&e").Equal("who", `@foo "bar"`).Equal("pct", "100%!"),
+			query: `path=/a/b?c=d&e,who="@foo \"bar\"",pct=100%!`,
+			expect: query.Query{Predicates: []query.Predicate{
+				{Label: "path", Operator: "=", Value: "/a/b?c=d&e"},
+				{Label: "who", Operator: "=", Value: `@foo "bar"`},
+				{Label: "pct", Operator: "=", Value: "100%!"},
+			}},
+		},
+		{
+			// Quoted values
+			b:     query.New().Equal("y", "a,z=b").NotEqual("y", " a").Equal("z", "").In("z", "a^b", "(c)", `d\e`),
+			query: `y="a,z=b",y!=" a",z="",z in ("a^b","(c)",d\e)`,
+			expect: query.Query{Predicates: []query.Predicate{
+				{Label: "y", Operator: "=", Value: "a,z=b"},
+				{Label: "y", Operator: "!=", Value: " a"},
+				{Label: "z", Operator: "=", Value: ""},
+				{Label: "z", Operator: "in", Value: []string{"a^b", "(c)", `d\e`}},
+			}},
+		},
+		{
+			b:     query.New().Equal("y", "=a").GreaterThan("s", `a"b`).NotIn("z", "it's", `back\slash"`),
+			query: `y="=a",s>"a\"b",z notin ("it's","back\\slash\"")`,
+			expect: query.Query{Predicates: []query.Predicate{
+				{Label: "y", Operator: "=", Value: "=a"},
+				{Label: "s", Operator: ">", Value: `a"b`},
+				{Label: "z", Operator: "notin", Value: []string{"it's", `back\slash"`}},
+			}},
+		},
+		{
+			b:     query.New().Equal("y", "a").Or().Equal("y", "b").Exists("z"),
+			query: "y=a^y=b,z",
+			expect: query.Query{Or: []query.Query{
+				{Predicates: []query.Predicate{{Label: "y", Operator: "=", Value: "a"}}},
+				{Predicates: []query.Predicate{
+					{Label: "y", Operator: "=", Value: "b"},
+					{Label: "z", Operator: "exists"},
+				}},
+			}},
+		},
+	}
+	for _, tc := range testCases {
+		got, err := tc.b.Build()
+		require.NoError(t, err, tc.query)
+		assert.Equal(t, tc.query, got)
+		assert.Equal(t, tc.query, tc.b.String())
+
+		q, err := query.TranslateVersion(got, query.LATEST_VERSION)
+		require.NoError(t, err, got)
+		assert.Equal(t, tc.expect, q, got)
+	}
+}
+
+func TestBuilderInvalid(t *testing.T) {
+	// Test that labels that would make a malformed or different query are errors,
+	// and the query is not built. Values are quoted, so only invalid types are errors
+	testCases := []*query.Builder{
+		query.New(),                            // empty
+		query.New().Equal("y", "a").Or(),       // empty OR term
+		query.New().Or().Equal("y", "a"),       // empty OR term
+		query.New().Equal("", "a"),             // empty label
+		query.New().Equal("y z", "a"),          // space in label
+		query.New().Equal("y=z", "a"),          // op in label
+		query.New().Exists("y,z"),              // comma in label
+		query.New().NotExists("(y)"),           // invalid label char
+		query.New().In("y"),                    // no values
+		query.New().GreaterThan("z", []int{1}), // not number or string
+		query.New().Equal("y,z", "a").Equal("z", "c"),
+	}
+	for i, b := range testCases {
+		got, err := b.Build()
+		assert.Error(t, err, "test case %d", i)
+		assert.Empty(t, got, "test case %d", i)
+		assert.Empty(t, b.String(), "test case %d", i)
+	}
+
+	// Err returns the first error
+	b := query.New().Equal("y,z", "a").Equal("", "c")
+	require.Error(t, b.Err())
+	assert.Contains(t, b.Err().Error(), "y,z")
+}
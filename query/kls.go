@@ -70,8 +70,29 @@ func IsInvalidLabelChar(r rune) bool {
 
 var Debug = false
 
+// symbolOps are the valid operators made of IsOp characters. The parser reads
+// a symbol op until the first non-'=' character, so it must check the whole op:
+// ">=" is valid but ">==" is not.
+var symbolOps = map[string]bool{
+	"=":  true,
+	"==": true,
+	"!=": true,
+	"<":  true,
+	"<=": true,
+	">":  true,
+	">=": true,
+}
+
 // Parse parses a Kubernetes Label Selector sttring.
 func Parse(selector string) ([]Requirement, error) {
+	return parse(selector, false)
+}
+
+// parse parses the selector. If quotes is true (VERSION_4), a value can be quoted
+// with " or ', and commas, parentheses, and spaces in quotes are part of the value.
+// Quoted values are returned with their quotes and escapes; translateValues
+// unquotes them. Labels cannot have quotes.
+func parse(selector string, quotes bool) ([]Requirement, error) {
 	if selector == "" {
 		return []Requirement{}, nil
 	}
@@ -83,7 +104,26 @@ func Parse(selector string) ([]Requirement, error) {
 	startOffset := 0
 	pred := []string{}
 	inValueList := false // skip commas inside "(val1,valN)"
+	var quote rune       // skip all inside "quoted value" (if quotes)
+	escaped := false     // previous char in quote is \
 	for endOffset, r := range selector {
+		if quotes {
+			if quote != 0 {
+				switch {
+				case escaped:
+					escaped = false
+				case r == '\\':
+					escaped = true
+				case r == quote:
+					quote = 0
+				}
+				continue
+			}
+			if isQuote(r) {
+				quote = r
+				continue
+			}
+		}
 		if inValueList {
 			if r == ')' {
 				inValueList = false
@@ -100,6 +140,9 @@ func Parse(selector string) ([]Requirement, error) {
 		pred = append(pred, selector[startOffset:endOffset])
 		startOffset = endOffset + 1 // first char after ,
 	}
+	if quote != 0 {
+		return nil, fmt.Errorf("%s: missing closing quote %c", selector, quote)
+	}
 	if startOffset < len(selector) {
 		// Last predicate to end of selector, e.g. "bar" in "x=y,foo,bar"
 		pred = append(pred, selector[startOffset:])
@@ -135,7 +178,7 @@ func Parse(selector string) ([]Requirement, error) {
 						if Debug {
 							fmt.Printf("first char of label at %d\n", right)
 						}
-						if IsInvalidLabelChar(cur) {
+						if IsInvalidLabelChar(cur) || (quotes && isQuote(cur)) {
 							return nil, fmt.Errorf("'%s': invalid label first character: %s", selector, string(cur))
 						}
 						left = right // 1st char of label
@@ -169,7 +212,7 @@ func Parse(selector string) ([]Requirement, error) {
 			case state_label:
 				// Label char if not space or operator
 				if !isSpace(cur) && !IsOp(cur) {
-					if IsInvalidLabelChar(cur) {
+					if IsInvalidLabelChar(cur) || (quotes && isQuote(cur)) {
 						return nil, fmt.Errorf("%s: invalid label character: %s", selector, string(cur))
 					}
 					continue // more label chars
@@ -258,12 +301,19 @@ func Parse(selector string) ([]Requirement, error) {
 		}
 
 		if IsOp(rune(req.Op[0])) {
+			if !symbolOps[req.Op] {
+				return nil, fmt.Errorf("%s: invalid operator: %s", selector, req.Op)
+			}
 			req.Values = []string{req.val}
 		} else if req.Op == "in" || req.Op == "notin" {
 			if len(req.val) < 3 {
 				return nil, fmt.Errorf("invalid [not]in value list: %s", req.val)
 			}
-			req.Values = strings.Split(req.val[1:len(req.val)-1], ",")
+			if quotes {
+				req.Values = splitValues(req.val[1 : len(req.val)-1])
+			} else {
+				req.Values = strings.Split(req.val[1:len(req.val)-1], ",")
+			}
 		} else if req.Op == "exists" || req.Op == "notexists" {
 			// No values
 		} else {
@@ -280,6 +330,39 @@ func Parse(selector string) ([]Requirement, error) {
 	return all, nil
 }
 
+// splitValues splits a [not]in value list on commas outside of quotes and trims
+// spaces around each value (VERSION_4).
+func splitValues(list string) []string {
+	values := []string{}
+	start := 0
+	var quote rune
+	escaped := false
+	for i, r := range list {
+		if quote != 0 {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == quote:
+				quote = 0
+			}
+			continue
+		}
+		if isQuote(r) {
+			quote = r
+		} else if r == ',' {
+			values = append(values, strings.TrimSpace(list[start:i]))
+			start = i + 1
+		}
+	}
+	return append(values, strings.TrimSpace(list[start:]))
+}
+
+func isQuote(r rune) bool {
+	return r == '"' || r == '\''
+}
+
 func isSpace(r rune) bool {
 	return r == 0x20 || r == 0x09 || r == 0x0D || r == 0x0A
 }
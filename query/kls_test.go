@@ -190,6 +190,16 @@ func TestParseInequality(t *testing.T) {
 	}
 }
 
+func TestParseInvalidOperator(t *testing.T) {
+	// The parser reads = after an op char, so these are one invalid op, not
+	// a valid op and a value beginning with =
+	sels := []string{"x>==1", "x<==1", "x===1", "x!==1", "x >== 1"}
+	for _, sel := range sels {
+		_, err := query.Parse(sel)
+		assert.Error(t, err, sel)
+	}
+}
+
 func TestParseMixed(t *testing.T) {
 
 	// equality, exists
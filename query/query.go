@@ -9,36 +9,162 @@
 package query
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 )
 
-// Query is a list of predicates.
+// Query language versions. The API selects the version from the X-Etre-Query-Version
+// header (etre.QUERY_VERSION_HEADER). When the grammar or translation changes in a
+// way that makes the same query string mean something different, add a new version
+// and keep the old behavior for clients that request the old version.
+const (
+	// VERSION_1 is the original translation: values for <, >, <=, >= are
+	// integers, and a non-integer value is silently translated to 0.
+	VERSION_1 = 1
+
+	// VERSION_2 translates values for <, >, <=, >= as integers or floats,
+	// and returns an error for non-numeric values. A double-quoted value is
+	// a string: z>"2" compares strings, not numbers.
+	VERSION_2 = 2
+
+	// VERSION_3 adds the OR operator ^ between comma-separated predicates:
+	// "y=a ^ y=b,z" matches y=a OR (y=b AND z). Comma (AND) binds tighter
+	// than ^, and there is no grouping. In earlier versions, ^ is part of a value.
+	VERSION_3 = 3
+
+	// VERSION_4 adds quoted values for all operators: y="us east", y='a,b', and
+	// y in ("a,b", c). Commas, spaces, ^, parentheses, and operators in quotes are
+	// part of the value. In quotes, \ escapes the quote character and \ itself:
+	// y="say \"hi\"" and y='it\'s'. Quotes in an unquoted value or a label are
+	// an error, and spaces around [not]in values are trimmed. In earlier versions,
+	// quotes are part of the value, except for <, >, <=, >= (see VERSION_2).
+	VERSION_4 = 4
+
+	// LATEST_VERSION is the latest version. Clients must request it (or any
+	// version after VERSION_1) with the header.
+	LATEST_VERSION = VERSION_4
+
+	// DEFAULT_VERSION is used when a version is not specified. It's VERSION_1 so
+	// that existing clients, which do not send the header, get the original
+	// translation: a query does not change meaning when Etre adds a version.
+	DEFAULT_VERSION = VERSION_1
+)
+
+// OR_OPERATOR separates OR terms in a query (VERSION_3).
+const OR_OPERATOR = '^'
+
+// Query is a list of predicates, all of which must match. If Or is set, at
+// least one of its queries must match, too. Translate sets either Predicates
+// or Or, not both.
 type Query struct {
 	Predicates []Predicate
+	Or         []Query
 }
 
-// Predicate represents a predicate in a Query.
+// Predicate represents a predicate in a Query. Operator is one of =, ==, !=,
+// in, notin, <, <=, >, >=, exists, or notexists. Value is nil for exists and
+// notexists, a []string for in and notin, a number for <, <=, >, and >=,
+// else a string.
 type Predicate struct {
 	Label    string
 	Operator string
 	Value    interface{}
 }
 
-// Translate parses KLS and wraps it in Query struct.
-// It returns a Query and an error if encountered while parsing KLS.
+// Labels returns the unique labels referenced by the query in the order they
+// first appear, including labels in Or queries. Callers use it to authorize
+// or validate labels before querying the database.
+func (q Query) Labels() []string {
+	return unique(q.AllPredicates(), func(p Predicate) string { return p.Label })
+}
+
+// Operators returns the unique operators used by the query in the order they
+// first appear, including operators in Or queries.
+func (q Query) Operators() []string {
+	return unique(q.AllPredicates(), func(p Predicate) string { return p.Operator })
+}
+
+// AllPredicates returns Predicates and the predicates of all Or queries.
+func (q Query) AllPredicates() []Predicate {
+	if len(q.Or) == 0 {
+		return q.Predicates
+	}
+	all := append([]Predicate{}, q.Predicates...)
+	for _, or := range q.Or {
+		all = append(all, or.AllPredicates()...)
+	}
+	return all
+}
+
+func unique(predicates []Predicate, field func(Predicate) string) []string {
+	vals := []string{}
+	seen := map[string]bool{}
+	for _, p := range predicates {
+		v := field(p)
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		vals = append(vals, v)
+	}
+	return vals
+}
+
+// ById returns a Query for the entity with the given id: _id=id. Unlike
+// Translate("_id=" + id), the id is not parsed, so it can be any string, like
+// a natural-key id with commas or quotes.
+func ById(id string) Query {
+	return Query{Predicates: []Predicate{{Label: "_id", Operator: "=", Value: id}}}
+}
+
+// Translate parses KLS and wraps it in Query struct using the latest query
+// language version. It returns a Query and an error if encountered while parsing KLS.
 func Translate(labelSelectors string) (Query, error) {
+	return TranslateVersion(labelSelectors, DEFAULT_VERSION)
+}
+
+// TranslateVersion is like Translate but uses the given query language version.
+// It returns an error if the version is not valid.
+func TranslateVersion(labelSelectors string, version int) (Query, error) {
 	query := Query{}
 
-	req, err := Parse(labelSelectors)
+	if version < VERSION_1 || version > LATEST_VERSION {
+		return query, fmt.Errorf("invalid query language version: %d (valid versions: %d to %d)", version, VERSION_1, LATEST_VERSION)
+	}
+
+	// OR terms: "a ^ b,c" -> Or: [a, (b AND c)]
+	if version >= VERSION_3 {
+		terms := splitOr(labelSelectors, version >= VERSION_4)
+		if len(terms) > 1 {
+			for _, term := range terms {
+				if strings.TrimSpace(term) == "" {
+					return Query{}, fmt.Errorf("empty OR term in query: %s", labelSelectors)
+				}
+				or, err := TranslateVersion(term, version)
+				if err != nil {
+					return Query{}, err
+				}
+				query.Or = append(query.Or, or)
+			}
+			return query, nil
+		}
+	}
+
+	req, err := parse(labelSelectors, version >= VERSION_4)
 	if err != nil {
 		return query, err
 	}
 
 	for _, r := range req {
+		v, err := translateValues(version, r.Op, r.Values)
+		if err != nil {
+			return Query{}, fmt.Errorf("%s: %s", r.Label, err)
+		}
 		p := Predicate{
 			Label:    r.Label,
 			Operator: r.Op,
-			Value:    translateValues(r.Op, r.Values),
+			Value:    v,
 		}
 		query.Predicates = append(query.Predicates, p)
 	}
@@ -51,7 +177,30 @@ func Translate(labelSelectors string) (Query, error) {
 // https://github.com/kubernetes/apimachinery/blob/master/pkg/labels/selector.go#L104-L110.).
 // We choose to translate data here to keep data consistent between db package
 // and audit log package.
-func translateValues(operator string, values []string) interface{} {
+func translateValues(version int, operator string, values []string) (interface{}, error) {
+	// Quoted values are strings (VERSION_4). Unquoted values for <, <=, >, >= are
+	// numbers, translated below like VERSION_2.
+	if version >= VERSION_4 && operator != "exists" && operator != "notexists" {
+		strs := make([]string, len(values))
+		isQuoted := false
+		for i, v := range values {
+			var err error
+			if strs[i], isQuoted, err = unquote(v); err != nil {
+				return nil, err
+			}
+		}
+		switch operator {
+		case "in", "notin":
+			return strs, nil
+		case "=", "==", "!=":
+			return strs[0], nil
+		default:
+			if isQuoted {
+				return strs[0], nil // string comparison: z>"2"
+			}
+		}
+	}
+
 	var value interface{}
 	switch operator {
 	case "in", "notin":
@@ -61,10 +210,105 @@ func translateValues(operator string, values []string) interface{} {
 		// Values set must contain one value.
 		value = values[0]
 	case ">", ">=", "<", "<=":
-		// Values set must contain only one value, which was interpreted as an integer, so convert from string to integer
-		value, _ = strconv.Atoi(values[0])
+		// Values set must contain only one value, which was interpreted as a number, so convert from string to number
+		if version == VERSION_1 {
+			value, _ = strconv.Atoi(values[0])
+			break
+		}
+		// Force string comparison with double quotes: z>"2". This matches only
+		// string values because MongoDB does not compare strings and numbers.
+		if s, ok := quoted(values[0]); ok {
+			value = s
+			break
+		}
+		if i, err := strconv.Atoi(values[0]); err == nil {
+			value = i
+		} else if f, err := strconv.ParseFloat(values[0], 64); err == nil {
+			value = f
+		} else {
+			return nil, fmt.Errorf("value for %s operator is not a number: %s", operator, values[0])
+		}
 	case "exists", "notexists":
 		// No values
 	}
-	return value
+	return value, nil
+}
+
+// splitOr splits the query on OR_OPERATOR outside of [not]in value lists, and
+// outside of quoted values if quotes is true (VERSION_4).
+func splitOr(labelSelectors string, quotes bool) []string {
+	terms := []string{}
+	start := 0
+	inValueList := false
+	var quote rune
+	escaped := false
+	for i, r := range labelSelectors {
+		if quote != 0 {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == quote:
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case quotes && isQuote(r):
+			quote = r
+		case r == '(':
+			inValueList = true
+		case r == ')':
+			inValueList = false
+		case r == OR_OPERATOR && !inValueList:
+			terms = append(terms, labelSelectors[start:i])
+			start = i + 1
+		}
+	}
+	return append(terms, labelSelectors[start:])
+}
+
+// unquote returns the value without quotes and escapes, and true if it's quoted
+// with " or ' (VERSION_4). An unquoted value is returned as is, but it cannot have
+// quotes because they must be escaped in a quoted value.
+func unquote(v string) (string, bool, error) {
+	if v == "" || !isQuote(rune(v[0])) {
+		if strings.ContainsAny(v, `"'`) {
+			return "", false, fmt.Errorf("quote in unquoted value %s: quote the value and escape quotes with \\", v)
+		}
+		return v, false, nil
+	}
+	quote := v[0]
+	var sb strings.Builder
+	escaped := false
+	for i := 1; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case escaped:
+			if c != quote && c != '\\' {
+				return "", false, fmt.Errorf("invalid escape \\%c in quoted value %s: only \\%c and \\\\ are valid", c, v, quote)
+			}
+			sb.WriteByte(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == quote:
+			if i != len(v)-1 {
+				return "", false, fmt.Errorf("characters after closing quote in value %s", v)
+			}
+			return sb.String(), true, nil
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", false, fmt.Errorf("missing closing quote in value %s", v)
+}
+
+// quoted returns the value without double quotes and true if it's double-quoted.
+func quoted(v string) (string, bool) {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v, false
+	}
+	return v[1 : len(v)-1], true
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/square/etre/query"
 )
@@ -103,3 +104,216 @@ func TestQueryTranslate(t *testing.T) {
 		assert.Equal(t, tc.expect, got, "query '%s'", tc.query)
 	}
 }
+
+func TestQueryTranslateVersion(t *testing.T) {
+	// Same query string, different translation by version where the grammar changed
+	v1 := []test{
+		{
+			query: "z>1.5",
+			expect: query.Query{
+				Predicates: []query.Predicate{{Label: "z", Operator: ">", Value: 0}}, // v1: not an int = 0
+			},
+		},
+		{
+			query: "z<=abc",
+			expect: query.Query{
+				Predicates: []query.Predicate{{Label: "z", Operator: "<=", Value: 0}},
+			},
+		},
+		{
+			query: "z>1",
+			expect: query.Query{
+				Predicates: []query.Predicate{{Label: "z", Operator: ">", Value: 1}},
+			},
+		},
+	}
+	for _, tc := range v1 {
+		got, err := query.TranslateVersion(tc.query, query.VERSION_1)
+		require.NoError(t, err, "query '%s'", tc.query)
+		assert.Equal(t, tc.expect, got, "query '%s'", tc.query)
+	}
+
+	v2 := []test{
+		{
+			query: "z>1.5",
+			expect: query.Query{
+				Predicates: []query.Predicate{{Label: "z", Operator: ">", Value: 1.5}},
+			},
+		},
+		{
+			query:        "z<=abc",
+			expect:       query.Query{},
+			returnsError: true,
+		},
+		{
+			query: "z>1",
+			expect: query.Query{
+				Predicates: []query.Predicate{{Label: "z", Operator: ">", Value: 1}},
+			},
+		},
+	}
+	for _, tc := range v2 {
+		got, err := query.TranslateVersion(tc.query, query.VERSION_2)
+		if tc.returnsError {
+			assert.Error(t, err, "query '%s' should return an error but didn't", tc.query)
+		} else {
+			require.NoError(t, err, "query '%s'", tc.query)
+		}
+		assert.Equal(t, tc.expect, got, "query '%s'", tc.query)
+	}
+
+	// Quoted values for <, >, <=, >= are strings in v2, not numbers
+	got, err := query.TranslateVersion(`z>"2"`, query.VERSION_2)
+	require.NoError(t, err)
+	assert.Equal(t, query.Query{Predicates: []query.Predicate{{Label: "z", Operator: ">", Value: "2"}}}, got)
+	got, err = query.TranslateVersion(`z<=""`, query.VERSION_2)
+	require.NoError(t, err)
+	assert.Equal(t, "", got.Predicates[0].Value)
+	_, err = query.TranslateVersion(`z>"2`, query.VERSION_2) // unbalanced quote
+	assert.Error(t, err)
+	got, err = query.TranslateVersion(`z>"2"`, query.VERSION_1) // v1: not an int = 0
+	require.NoError(t, err)
+	assert.Equal(t, 0, got.Predicates[0].Value)
+
+	// Translate uses the default version, v1, for compatibility
+	got, err = query.Translate("z>1.5")
+	require.NoError(t, err)
+	assert.Equal(t, 0, got.Predicates[0].Value)
+
+	// Invalid versions
+	_, err = query.TranslateVersion("z>1", 0)
+	assert.Error(t, err)
+	_, err = query.TranslateVersion("z>1", query.LATEST_VERSION+1)
+	assert.Error(t, err)
+}
+
+func TestQueryLabelsAndOperators(t *testing.T) {
+	q, err := query.Translate("foo, !bar, z>1, foo!=x")
+	require.NoError(t, err)
+
+	// Predicates are the parsed (label, operator, value) tuples
+	expect := []query.Predicate{
+		{Label: "foo", Operator: "exists"},
+		{Label: "bar", Operator: "notexists"},
+		{Label: "z", Operator: ">", Value: 1},
+		{Label: "foo", Operator: "!=", Value: "x"},
+	}
+	assert.Equal(t, expect, q.Predicates)
+
+	// Labels and operators are unique, in the order they first appear
+	assert.Equal(t, []string{"foo", "bar", "z"}, q.Labels())
+	assert.Equal(t, []string{"exists", "notexists", ">", "!="}, q.Operators())
+
+	// Empty query
+	assert.Equal(t, []string{}, query.Query{}.Labels())
+	assert.Equal(t, []string{}, query.Query{}.Operators())
+}
+
+func TestQueryTranslateOr(t *testing.T) {
+	// Comma (AND) binds tighter than ^ (OR)
+	got, err := query.TranslateVersion("y=a ^ y=b,z>1", query.VERSION_3)
+	require.NoError(t, err)
+	expect := query.Query{
+		Or: []query.Query{
+			{Predicates: []query.Predicate{{Label: "y", Operator: "=", Value: "a"}}},
+			{Predicates: []query.Predicate{{Label: "y", Operator: "=", Value: "b"}, {Label: "z", Operator: ">", Value: 1}}},
+		},
+	}
+	assert.Equal(t, expect, got)
+	assert.Equal(t, []string{"y", "z"}, got.Labels())
+	assert.Equal(t, []string{"=", ">"}, got.Operators())
+	assert.Len(t, got.AllPredicates(), 3)
+
+	// ^ in a value list is not OR
+	got, err = query.TranslateVersion("y in (a^b,c)", query.VERSION_3)
+	require.NoError(t, err)
+	assert.Equal(t, query.Query{Predicates: []query.Predicate{{Label: "y", Operator: "in", Value: []string{"a^b", "c"}}}}, got)
+
+	// Empty OR terms and errors in a term are errors
+	for _, q := range []string{"y=a ^", "^ y=a", "y=a ^^ y=b", "y=a ^ ,", "y=a ^ z>foo"} {
+		_, err := query.TranslateVersion(q, query.VERSION_3)
+		assert.Error(t, err, q)
+	}
+
+	// Before v3, ^ is part of the value
+	got, err = query.TranslateVersion("y=a^b", query.VERSION_2)
+	require.NoError(t, err)
+	assert.Equal(t, query.Query{Predicates: []query.Predicate{{Label: "y", Operator: "=", Value: "a^b"}}}, got)
+}
+
+func TestQueryTranslateQuoted(t *testing.T) {
+	// Quoted values (v4) can have spaces, commas, and other special characters
+	tests := []test{
+		{
+			query:  `y="us east"`,
+			expect: query.Query{Predicates: []query.Predicate{{Label: "y", Operator: "=", Value: "us east"}}},
+		},
+		{
+			query: `y='a,b', z!=" a^b "`,
+			expect: query.Query{Predicates: []query.Predicate{
+				{Label: "y", Operator: "=", Value: "a,b"},
+				{Label: "z", Operator: "!=", Value: " a^b "},
+			}},
+		},
+		{
+			query:  `y in ("a,b", c, 'd)')`,
+			expect: query.Query{Predicates: []query.Predicate{{Label: "y", Operator: "in", Value: []string{"a,b", "c", "d)"}}}},
+		},
+		{
+			query: `y="say \"hi\"", z='it\'s', w="a\\b"`,
+			expect: query.Query{Predicates: []query.Predicate{
+				{Label: "y", Operator: "=", Value: `say "hi"`},
+				{Label: "z", Operator: "=", Value: "it's"},
+				{Label: "w", Operator: "=", Value: `a\b`},
+			}},
+		},
+		{
+			query: `y="a,b" ^ y=c`,
+			expect: query.Query{Or: []query.Query{
+				{Predicates: []query.Predicate{{Label: "y", Operator: "=", Value: "a,b"}}},
+				{Predicates: []query.Predicate{{Label: "y", Operator: "=", Value: "c"}}},
+			}},
+		},
+		{
+			// Quoted compare values are strings, unquoted are numbers
+			query: `z>"2", z<=2`,
+			expect: query.Query{Predicates: []query.Predicate{
+				{Label: "z", Operator: ">", Value: "2"},
+				{Label: "z", Operator: "<=", Value: 2},
+			}},
+		},
+	}
+	for _, tc := range tests {
+		got, err := query.TranslateVersion(tc.query, query.VERSION_4)
+		require.NoError(t, err, "query '%s'", tc.query)
+		assert.Equal(t, tc.expect, got, "query '%s'", tc.query)
+	}
+
+	// Malformed quoted values are errors
+	for _, q := range []string{
+		`y="a`,        // missing closing quote
+		`y="a"b`,      // characters after closing quote
+		`y=a"b"`,      // quote in unquoted value
+		`y="a\n"`,     // invalid escape
+		`y in ("a,b)`, // missing closing quote
+		`"y"=a`,       // quote in label
+	} {
+		_, err := query.TranslateVersion(q, query.VERSION_4)
+		assert.Error(t, err, q)
+	}
+
+	// Before v4, quotes are part of the value
+	got, err := query.TranslateVersion(`y="a"`, query.VERSION_3)
+	require.NoError(t, err)
+	assert.Equal(t, query.Query{Predicates: []query.Predicate{{Label: "y", Operator: "=", Value: `"a"`}}}, got)
+}
+
+func TestQueryById(t *testing.T) {
+	// ById is _id=id without parsing the id, so it can be any string
+	expect, err := query.Translate("_id=abc")
+	require.NoError(t, err)
+	assert.Equal(t, expect, query.ById("abc"))
+
+	got := query.ById(`a,b "c"`)
+	assert.Equal(t, []query.Predicate{{Label: "_id", Operator: "=", Value: `a,b "c"`}}, got.Predicates)
+}
@@ -6,6 +6,8 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
+	"regexp"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/mongo"
@@ -18,15 +20,30 @@ import (
 	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
 	"github.com/square/etre/config"
+	"github.com/square/etre/db"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/metrics"
 )
 
+// DB_HEALTH_CHECK_INTERVAL is how often the server pings the databases after
+// connecting to update app.Health.
+const DB_HEALTH_CHECK_INTERVAL = 5 * time.Second
+
+// CDC_PURGE_INTERVAL is how often the server deletes CDC events older than
+// config.CDCConfig.Retention, if set.
+const CDC_PURGE_INTERVAL = 10 * time.Minute
+
+// CDC_REPLAY_INTERVAL is how often the server replays the CDC fallback file
+// (config.CDCConfig.FallbackFile) while connected to the CDC database.
+const CDC_REPLAY_INTERVAL = 1 * time.Minute
+
 type Server struct {
 	appCtx       app.Context
 	api          *api.API
 	mainDbClient *mongo.Client
 	cdcDbClient  *mongo.Client
+	entityDbs    []entityDb // entity.datasource with their own client
+	cdcRetention time.Duration
 	stopChan     chan struct{}
 }
 
@@ -53,6 +70,16 @@ func (s *Server) Boot(configFile string) error {
 	s.appCtx.Config = cfg
 	log.Printf("Config: %+v", config.Redact(s.appCtx.Config))
 
+	// System metrics, made first because the change stream server uses them
+	s.appCtx.SystemMetrics = metrics.NewSystemMetrics()
+
+	// Main datasource, connected first because CDC uses it if entity.transactions=true
+	mainClient, err := s.appCtx.Plugins.DB.Connect(cfg.Datasource)
+	if err != nil {
+		return fmt.Errorf("cannot connect to main datasource: %s", err)
+	}
+	s.mainDbClient = mainClient
+
 	// //////////////////////////////////////////////////////////////////////
 	// CDC Store and Change Stream
 	// //////////////////////////////////////////////////////////////////////
@@ -60,12 +87,27 @@ func (s *Server) Boot(configFile string) error {
 		log.Println("CDC and change feeds are disabled because cdc.disabled=true in config")
 	} else {
 		log.Printf("CDC enabled on %s.%s\n", cfg.Datasource.Database, config.CDC_COLLECTION)
-		cdcClient, err := s.appCtx.Plugins.DB.Connect(cfg.CDC.Datasource)
-		if err != nil {
-			return fmt.Errorf("cannot connect to CDC datasource: %s", err)
+		cdcClient := mainClient
+		if cfg.Entity.Transactions {
+			// Transactions cannot span clients, so CDC events must be written
+			// with the same client as entities
+			log.Println("CDC uses main datasource because entity.transactions=true in config")
+		} else {
+			cdcClient, err = s.appCtx.Plugins.DB.Connect(cfg.CDC.Datasource)
+			if err != nil {
+				return fmt.Errorf("cannot connect to CDC datasource: %s", err)
+			}
 		}
 		s.cdcDbClient = cdcClient
-		cdcOpts := options.Collection().SetBSONOptions(&options.BSONOptions{ObjectIDAsHexString: true}) // Because etre.CDCEvent has string _id, not bson.ObjectID
+		cdcDatasource := cfg.CDC.Datasource
+		if cfg.Entity.Transactions {
+			cdcDatasource = cfg.Datasource
+		}
+		cdcOpts, err := db.CollectionOptions(cdcDatasource)
+		if err != nil {
+			return fmt.Errorf("invalid CDC datasource config: %s", err)
+		}
+		cdcOpts.SetBSONOptions(&options.BSONOptions{ObjectIDAsHexString: true}) // Because etre.CDCEvent has string _id, not bson.ObjectID
 		cdcColl := cdcClient.Database(cfg.Datasource.Database).Collection(config.CDC_COLLECTION, cdcOpts)
 
 		// Store
@@ -73,34 +115,66 @@ func (s *Server) Boot(configFile string) error {
 			RetryCount: cfg.CDC.WriteRetryCount,
 			RetryWait:  cfg.CDC.WriteRetryWait,
 		}
-		s.appCtx.CDCStore = cdc.NewStore(cdcColl, cfg.CDC.FallbackFile, wrp)
+		fallback := cdc.FallbackConfig{
+			File:     cfg.CDC.FallbackFile,
+			Format:   cfg.CDC.FallbackFormat,
+			MaxSize:  cfg.CDC.FallbackMaxSize,
+			MaxFiles: cfg.CDC.FallbackMaxFiles,
+		}
+		if cfg.CDC.FallbackMaxAge != "" {
+			fallback.MaxAge, _ = time.ParseDuration(cfg.CDC.FallbackMaxAge) // validated above
+		}
+		s.appCtx.CDCStore = cdc.NewStoreWithFallback(cdcColl, fallback, wrp)
 
+		var slowClientGrace time.Duration
+		if cfg.CDC.ChangeStream.SlowClientGrace != "" {
+			slowClientGrace, _ = time.ParseDuration(cfg.CDC.ChangeStream.SlowClientGrace) // validated above
+		}
 		s.appCtx.ChangesServer = changestream.NewMongoDBServer(changestream.ServerConfig{
-			CDCCollection: cdcColl,
-			MaxClients:    cfg.CDC.ChangeStream.MaxClients,
-			BufferSize:    cfg.CDC.ChangeStream.BufferSize,
+			CDCCollection:    cdcColl,
+			MaxClients:       cfg.CDC.ChangeStream.MaxClients,
+			BufferSize:       cfg.CDC.ChangeStream.BufferSize,
+			SlowClientPolicy: cfg.CDC.ChangeStream.SlowClientPolicy,
+			SlowClientGrace:  slowClientGrace,
+			Metrics:          s.appCtx.SystemMetrics,
+			OnDrop: func(e changestream.DropEvent) {
+				log.Printf("CDC: %s: dropped: buffer full (%d events), first event not sent: %s", e.ClientId, e.BufferSize, e.Event.Id)
+			},
 		})
 
+		if cfg.CDC.Retention != "" {
+			s.cdcRetention, _ = time.ParseDuration(cfg.CDC.Retention) // validated above
+			log.Printf("CDC retention: %s", s.cdcRetention)
+		}
+
 		s.appCtx.StreamerFactory = changestream.ServerStreamFactory{
-			Server: s.appCtx.ChangesServer,
-			Store:  s.appCtx.CDCStore,
+			Server:    s.appCtx.ChangesServer,
+			Store:     s.appCtx.CDCStore,
+			Retention: s.cdcRetention,
+
+			// Events are committed in sequence order only in transactions
+			ResumeBySeq: cfg.Entity.Transactions,
 		}
 	}
 
 	// //////////////////////////////////////////////////////////////////////
 	// Entity Store and Validator
 	// //////////////////////////////////////////////////////////////////////
-	mainClient, err := s.appCtx.Plugins.DB.Connect(cfg.Datasource)
+	coll, err := s.entityCollections(cfg)
 	if err != nil {
-		return fmt.Errorf("cannot connect to main datasource: %s", err)
+		return err
 	}
-	s.mainDbClient = mainClient
-	coll := make(map[string]*mongo.Collection, len(cfg.Entity.Types))
-	for _, entityType := range cfg.Entity.Types {
-		coll[entityType] = mainClient.Database(cfg.Datasource.Database).Collection(entityType)
+	if s.appCtx.Logger == nil {
+		s.appCtx.Logger = slog.Default()
 	}
-	s.appCtx.EntityStore = entity.NewStore(coll, s.appCtx.CDCStore, cfg.Entity)
-	s.appCtx.EntityValidator = entity.NewValidator(cfg.Entity.Types)
+	s.appCtx.EntityStore = entity.NewTracedStore(entity.NewStore(coll, s.appCtx.CDCStore, cfg.Entity).WithLogger(s.appCtx.Logger))
+	validate := entity.NewValidator(cfg.Entity.Types).
+		WithSchema(cfg.Entity.Schema).
+		WithLimits(cfg.Entity.MaxLabels, cfg.Entity.MaxValueBytes)
+	if cfg.Entity.LabelPattern != "" {
+		validate = validate.WithLabelPattern(regexp.MustCompile(cfg.Entity.LabelPattern)) // validated by config.Validate
+	}
+	s.appCtx.EntityValidator = validate
 
 	// //////////////////////////////////////////////////////////////////////
 	// Auth
@@ -109,7 +183,26 @@ func (s *Server) Boot(configFile string) error {
 	if err != nil {
 		return fmt.Errorf("invalid ACL role: %s", err)
 	}
-	s.appCtx.Auth = auth.NewManager(acls, s.appCtx.Plugins.Auth)
+	authPlugins := []auth.Plugin{s.appCtx.Plugins.Auth}
+	if len(s.appCtx.Plugins.AuthChain) > 0 {
+		authPlugins = s.appCtx.Plugins.AuthChain
+	}
+	if len(cfg.Security.StaticTokens) > 0 {
+		tokens, err := MapConfigStaticTokens(cfg.Security.StaticTokens)
+		if err != nil {
+			return fmt.Errorf("invalid static token: %s", err)
+		}
+		// Static tokens are tried first. The default AllowAll plugin is replaced,
+		// else it would allow requests without a valid token.
+		staticAuth := auth.NewStaticAuth(tokens)
+		if _, ok := s.appCtx.Plugins.Auth.(auth.AllowAll); ok && len(s.appCtx.Plugins.AuthChain) == 0 {
+			authPlugins = []auth.Plugin{staticAuth}
+		} else {
+			authPlugins = append([]auth.Plugin{staticAuth}, authPlugins...)
+		}
+		log.Printf("Static token auth enabled: %d tokens", len(tokens))
+	}
+	s.appCtx.Auth = auth.NewManager(acls, authPlugins...).WithAuditFunc(s.appCtx.Hooks.AuditAuth)
 
 	// //////////////////////////////////////////////////////////////////////
 	// Metrics
@@ -120,7 +213,9 @@ func (s *Server) Boot(configFile string) error {
 
 	s.appCtx.MetricsStore = metrics.NewMemoryStore()
 	s.appCtx.MetricsFactory = metrics.GroupFactory{Store: s.appCtx.MetricsStore}
-	s.appCtx.SystemMetrics = metrics.NewSystemMetrics()
+	s.appCtx.Auth = s.appCtx.Auth.WithMetrics(s.appCtx.SystemMetrics)
+
+	s.appCtx.Health = &app.Health{}
 
 	// //////////////////////////////////////////////////////////////////////
 	// API
@@ -136,13 +231,36 @@ func (s *Server) Run() error {
 	// Verify we can connect to the db.
 	mainDbDoneChan := make(chan struct{})
 	log.Printf("Connecting to main database: %s", s.appCtx.Config.Datasource.URL)
-	go s.connectToDatasource(s.appCtx.Config.Datasource, s.mainDbClient, mainDbDoneChan)
+	go s.connectToDatasource(s.appCtx.Config.Datasource, s.mainDbClient, mainDbDoneChan, s.appCtx.Health.SetMainDb)
+
+	// Entity type datasources are part of the main database: the main database
+	// is not connected (done) until all are connected
+	if len(s.entityDbs) > 0 {
+		doneChans := make([]chan struct{}, len(s.entityDbs)+1)
+		doneChans[0] = mainDbDoneChan
+		for i, edb := range s.entityDbs {
+			log.Printf("Connecting to entity database: %s", edb.ds.URL)
+			name := edb.ds.URL
+			doneChans[i+1] = make(chan struct{})
+			s.appCtx.Health.SetEntityDb(name, false)
+			go s.connectToDatasource(edb.ds, edb.client, doneChans[i+1], func(connected bool) {
+				s.appCtx.Health.SetEntityDb(name, connected)
+			})
+		}
+		mainDbDoneChan = make(chan struct{})
+		go func() {
+			for _, c := range doneChans {
+				<-c
+			}
+			close(mainDbDoneChan)
+		}()
+	}
 
 	var cdcDbDoneChan chan struct{}
 	if cdcEnabled {
 		log.Printf("Connecting to CDC database: %s", s.appCtx.Config.CDC.Datasource.URL)
 		cdcDbDoneChan = make(chan struct{})
-		go s.connectToDatasource(s.appCtx.Config.CDC.Datasource, s.cdcDbClient, cdcDbDoneChan)
+		go s.connectToDatasource(s.appCtx.Config.CDC.Datasource, s.cdcDbClient, cdcDbDoneChan, s.appCtx.Health.SetCDCDb)
 	}
 
 	notifyTimeout := time.NewTimer(2100 * time.Millisecond)
@@ -179,6 +297,12 @@ DB_CONN_WAIT:
 				time.Sleep(100 * time.Millisecond)
 			}
 		}()
+		if s.cdcRetention > 0 {
+			go s.purgeCDC()
+		}
+		if s.appCtx.Config.CDC.FallbackFile != "" {
+			go s.replayCDC()
+		}
 	}
 
 	// Run the API - this will block until the API is stopped (or encounters
@@ -204,6 +328,25 @@ func (s *Server) Stop() error {
 	} else {
 		err = s.api.Stop()
 	}
+
+	// Disconnect the db clients after the API stops so in-flight requests
+	// can finish. CDC might use the main client, so disconnect each once.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clients := []*mongo.Client{s.mainDbClient, s.cdcDbClient}
+	for _, edb := range s.entityDbs {
+		clients = append(clients, edb.client)
+	}
+	seen := map[*mongo.Client]bool{}
+	for _, client := range clients {
+		if client == nil || seen[client] {
+			continue
+		}
+		seen[client] = true
+		if derr := client.Disconnect(ctx); derr != nil {
+			log.Printf("Error disconnecting db client: %s", derr)
+		}
+	}
 	return err
 }
 
@@ -215,6 +358,65 @@ func (s *Server) Context() app.Context {
 	return s.appCtx
 }
 
+// purgeCDC deletes CDC events older than the retention every CDC_PURGE_INTERVAL
+// until the server is stopped.
+func (s *Server) purgeCDC() {
+	ticker := time.NewTicker(CDC_PURGE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		s.purgeCDCOnce(time.Now())
+		select {
+		case <-ticker.C:
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+func (s *Server) purgeCDCOnce(now time.Time) {
+	beforeTs := now.Add(-s.cdcRetention).UnixNano() / int64(time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), CDC_PURGE_INTERVAL)
+	defer cancel()
+	n, err := s.appCtx.CDCStore.Purge(ctx, beforeTs)
+	if err != nil {
+		log.Printf("ERROR: purging CDC events before %d: %s", beforeTs, err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Purged %d CDC events before %d (retention %s)", n, beforeTs, s.cdcRetention)
+	}
+}
+
+// replayCDC replays the CDC fallback file every CDC_REPLAY_INTERVAL until the
+// server is stopped. It does not replay while the CDC database is not connected
+// because the events cannot be written.
+func (s *Server) replayCDC() {
+	ticker := time.NewTicker(CDC_REPLAY_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if s.appCtx.Health.CDCDb() {
+			s.replayCDCOnce()
+		}
+		select {
+		case <-ticker.C:
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+func (s *Server) replayCDCOnce() {
+	ctx, cancel := context.WithTimeout(context.Background(), CDC_REPLAY_INTERVAL)
+	defer cancel()
+	n, err := s.appCtx.CDCStore.ReplayFallback(ctx)
+	if n > 0 {
+		log.Printf("Replayed %d CDC events from fallback file %s", n, s.appCtx.Config.CDC.FallbackFile)
+	}
+	if err != nil {
+		log.Printf("ERROR: replaying CDC fallback file %s: %s", s.appCtx.Config.CDC.FallbackFile, err)
+	}
+}
+
 func (s *Server) stopped() bool {
 	select {
 	case <-s.stopChan:
@@ -224,13 +426,55 @@ func (s *Server) stopped() bool {
 	}
 }
 
-func (s *Server) connectToDatasource(ds config.DatasourceConfig, client *mongo.Client, doneChan chan struct{}) {
-	defer close(doneChan)
+// entityDb is an entity type datasource (config.entity.datasource) that does
+// not use the main client.
+type entityDb struct {
+	ds     config.DatasourceConfig
+	client *mongo.Client
+}
+
+// entityCollections returns the entity type collections. By default, entity
+// types are in the main datasource. An entity type with its own datasource
+// (config.entity.datasource) uses a new client, unless only its database or
+// collection options differ, then it uses the same client as the main datasource
+// or another entity type.
+func (s *Server) entityCollections(cfg config.Config) (map[string]*mongo.Collection, error) {
+	clients := map[config.DatasourceConfig]*mongo.Client{
+		cfg.Datasource.ClientConfig(): s.mainDbClient,
+	}
+	coll := make(map[string]*mongo.Collection, len(cfg.Entity.Types))
+	for _, entityType := range cfg.Entity.Types {
+		ds := cfg.EntityDatasource(entityType)
+		client, ok := clients[ds.ClientConfig()]
+		if !ok {
+			var err error
+			client, err = s.appCtx.Plugins.DB.Connect(ds)
+			if err != nil {
+				return nil, fmt.Errorf("cannot connect to %s datasource: %s", entityType, err)
+			}
+			clients[ds.ClientConfig()] = client
+			s.entityDbs = append(s.entityDbs, entityDb{ds: ds, client: client})
+		}
+		opts, err := db.CollectionOptions(ds)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s datasource config: %s", entityType, err)
+		}
+		coll[entityType] = client.Database(ds.Database).Collection(entityType, opts)
+	}
+	return coll, nil
+}
+
+// connectToDatasource pings the datasource until connected, then closes doneChan.
+// After that, it pings the datasource every DB_HEALTH_CHECK_INTERVAL until the
+// server is stopped. It calls setConnected on every ping to update app.Health.
+func (s *Server) connectToDatasource(ds config.DatasourceConfig, client *mongo.Client, doneChan chan struct{}, setConnected func(bool)) {
+	connected := false
 	firstError := true
 	for !s.stopped() {
 		err := client.Ping(context.TODO(), nil)
 		if err == nil {
-			return
+			connected = true
+			break
 		}
 		if firstError {
 			log.Printf("Error connecting to %s: %s. Will retry every 500ms until successful.", ds.URL, err)
@@ -238,6 +482,48 @@ func (s *Server) connectToDatasource(ds config.DatasourceConfig, client *mongo.C
 		}
 		time.Sleep(500 * time.Millisecond)
 	}
+	setConnected(connected)
+	close(doneChan)
+	if !connected {
+		return // stopped
+	}
+
+	for !s.stopped() {
+		select {
+		case <-s.stopChan:
+			return
+		case <-time.After(DB_HEALTH_CHECK_INTERVAL):
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DB_HEALTH_CHECK_INTERVAL)
+		err := client.Ping(ctx, nil)
+		cancel()
+		if err != nil && connected {
+			log.Printf("ERROR: lost connection to %s: %s", ds.URL, err)
+		} else if err == nil && !connected {
+			log.Printf("Reconnected to %s", ds.URL)
+		}
+		setConnected(err == nil)
+		connected = err == nil
+	}
+}
+
+// MapConfigStaticTokens maps config static tokens to auth callers keyed on token.
+func MapConfigStaticTokens(tokens []config.StaticToken) (map[string]auth.Caller, error) {
+	callers := make(map[string]auth.Caller, len(tokens))
+	for i, t := range tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("static token %d (name %s): token not set", i, t.Name)
+		}
+		if _, ok := callers[t.Token]; ok {
+			return nil, fmt.Errorf("static token %d (name %s): duplicate token", i, t.Name)
+		}
+		callers[t.Token] = auth.Caller{
+			Name:         t.Name,
+			Roles:        t.Roles,
+			MetricGroups: t.MetricGroups,
+		}
+	}
+	return callers, nil
 }
 
 func MapConfigACLRoles(aclRoles []config.ACL) ([]auth.ACL, error) {
@@ -248,9 +534,30 @@ func MapConfigACLRoles(aclRoles []config.ACL) ([]auth.ACL, error) {
 			Admin:             acl.Admin,
 			Read:              acl.Read,
 			Write:             acl.Write,
+			Insert:            acl.Insert,
+			Update:            acl.Update,
+			Delete:            acl.Delete,
 			CDC:               acl.CDC,
 			TraceKeysRequired: acl.TraceKeysRequired,
+			TraceKeyPatterns:  acl.TraceKeyPatterns,
+			DenyLabels:        acl.DenyLabels,
+			AllowLabels:       acl.AllowLabels,
+			Inherits:          acl.Inherits,
+			Deny: auth.Deny{
+				Read:   acl.Deny.Read,
+				Write:  acl.Deny.Write,
+				Insert: acl.Deny.Insert,
+				Update: acl.Deny.Update,
+				Delete: acl.Deny.Delete,
+				CDC:    acl.Deny.CDC,
+			},
 		}
 	}
+	if err := auth.CompileTracePatterns(acls); err != nil {
+		return nil, err
+	}
+	if err := auth.ValidateInherits(acls); err != nil {
+		return nil, err
+	}
 	return acls, nil
 }
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -10,6 +12,7 @@ import (
 
 	"github.com/square/etre/app"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/cdc/changestream"
 	"github.com/square/etre/config"
 	"github.com/square/etre/db"
 	"github.com/square/etre/test/mock"
@@ -50,11 +53,116 @@ func TestDBPlugin(t *testing.T) {
 	require.NoError(t, err, "Error stopping server")
 }
 
+// TestEntityDatasource tests that entity types with their own datasource
+// (config.entity.datasource) use a different client or database
+func TestEntityDatasource(t *testing.T) {
+	var connected []config.DatasourceConfig
+	ctx := app.Defaults()
+	ctx.Plugins.DB = &mock.DBPlugin{
+		ConnectFunc: func(cfg config.DatasourceConfig) (*mongo.Client, error) {
+			connected = append(connected, cfg)
+			return db.Default{}.Connect(cfg) // does not connect until used
+		},
+	}
+	s := NewServer(ctx)
+
+	cfg := config.Default()
+	cfg.Entity.Types = []string{"node", "host", "rack"}
+	cfg.Entity.Datasource = map[string]config.DatasourceConfig{
+		"node": {URL: "mongodb://127.0.0.1:27018", Database: "nodes"},
+		"host": {Database: "hosts"},
+	}
+	require.NoError(t, config.Validate(cfg))
+
+	mainClient, err := db.Default{}.Connect(cfg.Datasource)
+	require.NoError(t, err)
+	s.mainDbClient = mainClient
+
+	coll, err := s.entityCollections(cfg)
+	require.NoError(t, err)
+	require.Len(t, coll, 3)
+
+	// node: different cluster, so a new client
+	require.Len(t, connected, 1)
+	assert.Equal(t, "mongodb://127.0.0.1:27018", connected[0].URL)
+	assert.Equal(t, "nodes", coll["node"].Database().Name())
+	assert.NotSame(t, mainClient, coll["node"].Database().Client())
+	require.Len(t, s.entityDbs, 1)
+	assert.Same(t, coll["node"].Database().Client(), s.entityDbs[0].client)
+
+	// host: same cluster, different database, so the main client
+	assert.Equal(t, "hosts", coll["host"].Database().Name())
+	assert.Same(t, mainClient, coll["host"].Database().Client())
+
+	// rack: main datasource
+	assert.Equal(t, cfg.Datasource.Database, coll["rack"].Database().Name())
+	assert.Same(t, mainClient, coll["rack"].Database().Client())
+}
+
+// TestCDCRetention tests that cdc.retention is applied to change feeds and
+// CDC events before the retention window are purged
+func TestCDCRetention(t *testing.T) {
+	ctx := app.Defaults()
+	ctx.Hooks.LoadConfig = func(ctx app.Context) (config.Config, error) {
+		cfg := config.Default()
+		cfg.CDC.Retention = "24h"
+		return cfg, nil
+	}
+	s := NewServer(ctx)
+	err := s.Boot("")
+	require.NoError(t, err, "Error booting server")
+	defer s.Stop()
+
+	assert.Equal(t, 24*time.Hour, s.cdcRetention)
+	sf, ok := s.appCtx.StreamerFactory.(changestream.ServerStreamFactory)
+	require.True(t, ok, "StreamerFactory is %T, expected changestream.ServerStreamFactory", s.appCtx.StreamerFactory)
+	assert.Equal(t, 24*time.Hour, sf.Retention)
+
+	var gotTs int64
+	s.appCtx.CDCStore = mock.CDCStore{
+		PurgeFunc: func(ctx context.Context, beforeTs int64) (int64, error) {
+			gotTs = beforeTs
+			return 3, nil
+		},
+	}
+	now := time.Now()
+	s.purgeCDCOnce(now)
+	expectTs := now.Add(-24*time.Hour).UnixNano() / int64(time.Millisecond)
+	assert.Equal(t, expectTs, gotTs)
+}
+
+// TestCDCFallback tests that the server boots with cdc.fallback_* config and
+// replays the fallback file
+func TestCDCFallback(t *testing.T) {
+	ctx := app.Defaults()
+	ctx.Hooks.LoadConfig = func(ctx app.Context) (config.Config, error) {
+		cfg := config.Default()
+		cfg.CDC.FallbackMaxAge = "24h"
+		return cfg, nil
+	}
+	s := NewServer(ctx)
+	err := s.Boot("")
+	require.NoError(t, err, "Error booting server")
+	defer s.Stop()
+
+	replayed := 0
+	s.appCtx.CDCStore = mock.CDCStore{
+		ReplayFallbackFunc: func(ctx context.Context) (int, error) {
+			replayed++
+			return 2, nil
+		},
+	}
+	s.replayCDCOnce()
+	assert.Equal(t, 1, replayed)
+}
+
 func TestMapConfigACLRoles(t *testing.T) {
 	// Check the number of fields in both ACL structs. Any time one of them is edited, it is likely the other one needs to be updated as well.
 	// Testing the field counts ensures that any time someone edits one of these, they don't forget to update the other one (or this test) to match.
-	assert.Equal(t, 6, reflect.TypeOf(config.ACL{}).NumField(), "Wrong number of fields in config.ACL. Did you edit the class and forget to update the test?")
-	assert.Equal(t, 6, reflect.TypeOf(auth.ACL{}).NumField(), "Wrong number of fields in auth.ACL. Did you edit the class and forget to update the test?")
+	assert.Equal(t, 14, reflect.TypeOf(config.ACL{}).NumField(), "Wrong number of fields in config.ACL. Did you edit the class and forget to update the test?")
+	assert.Equal(t, 14, reflect.TypeOf(auth.ACL{}).NumField(), "Wrong number of fields in auth.ACL. Did you edit the class and forget to update the test?")
+	assert.Equal(t, 6, reflect.TypeOf(config.ACLDeny{}).NumField(), "Wrong number of fields in config.ACLDeny. Did you edit the class and forget to update the test?")
+	assert.Equal(t, 6, reflect.TypeOf(auth.Deny{}).NumField(), "Wrong number of fields in auth.Deny. Did you edit the class and forget to update the test?")
 
 	testCases := []struct {
 		name      string
@@ -95,16 +203,44 @@ func TestMapConfigACLRoles(t *testing.T) {
 				Admin:             true,
 				Read:              []string{"host", "dns"},
 				Write:             []string{"host", "elasticache"},
+				Insert:            []string{"host"},
+				Update:            []string{"host", "elasticache"},
+				Delete:            []string{},
 				CDC:               true,
 				TraceKeysRequired: []string{"key1", "key2"},
+				TraceKeyPatterns:  map[string]string{"key1": "[a-z]+"},
+				DenyLabels:        map[string][]string{"host": {"secret"}},
+				AllowLabels:       map[string][]string{"dns": {"name", "ip"}},
+				Deny: config.ACLDeny{
+					Read:   []string{"secret"},
+					Write:  []string{"dns"},
+					Insert: []string{"a"},
+					Update: []string{"b"},
+					Delete: []string{"c"},
+					CDC:    true,
+				},
 			},
 			authACL: auth.ACL{
 				Role:              "t4",
 				Admin:             true,
 				Read:              []string{"host", "dns"},
 				Write:             []string{"host", "elasticache"},
+				Insert:            []string{"host"},
+				Update:            []string{"host", "elasticache"},
+				Delete:            []string{},
 				CDC:               true,
 				TraceKeysRequired: []string{"key1", "key2"},
+				TraceKeyPatterns:  map[string]string{"key1": "[a-z]+"},
+				DenyLabels:        map[string][]string{"host": {"secret"}},
+				AllowLabels:       map[string][]string{"dns": {"name", "ip"}},
+				Deny: auth.Deny{
+					Read:   []string{"secret"},
+					Write:  []string{"dns"},
+					Insert: []string{"a"},
+					Update: []string{"b"},
+					Delete: []string{"c"},
+					CDC:    true,
+				},
 			},
 		},
 	}
@@ -118,3 +254,40 @@ func TestMapConfigACLRoles(t *testing.T) {
 		})
 	}
 }
+
+func TestMapConfigACLRolesInherits(t *testing.T) {
+	converted, err := MapConfigACLRoles([]config.ACL{
+		{Role: "reader", Read: []string{"host"}},
+		{Role: "writer", Write: []string{"host"}, Inherits: []string{"reader"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, converted, 2)
+	assert.Equal(t, []string{"reader"}, converted[1].Inherits)
+
+	// Inherited roles are resolved by the auth manager, not merged into ACLs
+	man := auth.NewManager(converted)
+	caller := auth.Caller{Name: "test", Roles: []string{"writer"}}
+	assert.NoError(t, man.Authorize(caller, auth.Action{EntityType: "host", Op: auth.OP_READ}))
+
+	_, err = MapConfigACLRoles([]config.ACL{
+		{Role: "a", Inherits: []string{"b"}},
+		{Role: "b", Inherits: []string{"a"}},
+	})
+	require.Error(t, err)
+}
+
+func TestMapConfigStaticTokens(t *testing.T) {
+	callers, err := MapConfigStaticTokens([]config.StaticToken{
+		{Token: "abc", Name: "deploy", Roles: []string{"ops"}, MetricGroups: []string{"deploy"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]auth.Caller{
+		"abc": {Name: "deploy", Roles: []string{"ops"}, MetricGroups: []string{"deploy"}},
+	}, callers)
+
+	_, err = MapConfigStaticTokens([]config.StaticToken{{Name: "no-token"}})
+	require.Error(t, err)
+
+	_, err = MapConfigStaticTokens([]config.StaticToken{{Token: "abc"}, {Token: "abc"}})
+	require.Error(t, err)
+}
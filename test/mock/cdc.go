@@ -12,8 +12,10 @@ import (
 var _ cdc.Store = CDCStore{}
 
 type CDCStore struct {
-	WriteFunc func(context.Context, etre.CDCEvent) error
-	ReadFunc  func(cdc.Filter) ([]etre.CDCEvent, error)
+	WriteFunc          func(context.Context, etre.CDCEvent) error
+	ReadFunc           func(cdc.Filter) ([]etre.CDCEvent, error)
+	PurgeFunc          func(context.Context, int64) (int64, error)
+	ReplayFallbackFunc func(context.Context) (int, error)
 }
 
 func (s CDCStore) Write(ctx context.Context, e etre.CDCEvent) error {
@@ -30,6 +32,20 @@ func (s CDCStore) Read(filter cdc.Filter) ([]etre.CDCEvent, error) {
 	return nil, nil
 }
 
+func (s CDCStore) Purge(ctx context.Context, beforeTs int64) (int64, error) {
+	if s.PurgeFunc != nil {
+		return s.PurgeFunc(ctx, beforeTs)
+	}
+	return 0, nil
+}
+
+func (s CDCStore) ReplayFallback(ctx context.Context) (int, error) {
+	if s.ReplayFallbackFunc != nil {
+		return s.ReplayFallbackFunc(ctx)
+	}
+	return 0, nil
+}
+
 // Some test events that can be insterted into a db.
 var CDCEvents = []etre.CDCEvent{
 	etre.CDCEvent{Id: "nru", EntityId: "e1", EntityRev: 0, Ts: 10},
@@ -10,12 +10,18 @@ import (
 )
 
 type ChangeStreamServer struct {
-	WatchFunc func(string) (<-chan etre.CDCEvent, error)
-	CloseFunc func(string)
-	RunFunc   func() error
-	StopFunc  func()
+	WatchFunc   func(string) (<-chan etre.CDCEvent, error)
+	CloseFunc   func(string)
+	RunFunc     func() error
+	StopFunc    func()
+	StatusFunc  func() changestream.ServerStatus
+	ErrFunc     func(string) error
+	ReplayFunc  func(string, []etre.CDCEvent) error
+	ReplaysFunc func(string) <-chan []etre.CDCEvent
 }
 
+var _ changestream.Server = ChangeStreamServer{}
+
 func (s ChangeStreamServer) Watch(clientId string) (<-chan etre.CDCEvent, error) {
 	if s.WatchFunc != nil {
 		return s.WatchFunc(clientId)
@@ -42,6 +48,34 @@ func (s ChangeStreamServer) Stop() {
 	}
 }
 
+func (s ChangeStreamServer) Err(clientId string) error {
+	if s.ErrFunc != nil {
+		return s.ErrFunc(clientId)
+	}
+	return nil
+}
+
+func (s ChangeStreamServer) Status() changestream.ServerStatus {
+	if s.StatusFunc != nil {
+		return s.StatusFunc()
+	}
+	return changestream.ServerStatus{}
+}
+
+func (s ChangeStreamServer) Replay(clientId string, events []etre.CDCEvent) error {
+	if s.ReplayFunc != nil {
+		return s.ReplayFunc(clientId, events)
+	}
+	return nil
+}
+
+func (s ChangeStreamServer) Replays(clientId string) <-chan []etre.CDCEvent {
+	if s.ReplaysFunc != nil {
+		return s.ReplaysFunc(clientId)
+	}
+	return nil
+}
+
 // --------------------------------------------------------------------------
 
 var _ changestream.StreamerFactory = StreamerFactory{}
@@ -60,11 +94,12 @@ func (f StreamerFactory) Make(clientId string) changestream.Streamer {
 var _ changestream.Streamer = &Stream{}
 
 type Stream struct {
-	StartFunc  func(sinceTs int64) <-chan etre.CDCEvent
-	InSyncFunc func() chan struct{}
-	StatusFunc func() changestream.Status
-	StopFunc   func()
-	ErrorFunc  func() error
+	StartFunc     func(sinceTs int64) <-chan etre.CDCEvent
+	StartWithFunc func(changestream.StartOptions) <-chan etre.CDCEvent
+	InSyncFunc    func() chan struct{}
+	StatusFunc    func() changestream.Status
+	StopFunc      func()
+	ErrorFunc     func() error
 }
 
 func (s Stream) Start(sinceTs int64) <-chan etre.CDCEvent {
@@ -75,6 +110,13 @@ func (s Stream) Start(sinceTs int64) <-chan etre.CDCEvent {
 
 }
 
+func (s Stream) StartWith(opts changestream.StartOptions) <-chan etre.CDCEvent {
+	if s.StartWithFunc != nil {
+		return s.StartWithFunc(opts)
+	}
+	return s.Start(opts.SinceTs)
+}
+
 func (s Stream) InSync() chan struct{} {
 	if s.InSyncFunc != nil {
 		return s.InSyncFunc()
@@ -11,13 +11,21 @@ import (
 )
 
 type EntityStore struct {
-	ReadEntityFunc        func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error)
-	DeleteEntityLabelFunc func(context.Context, entity.WriteOp, string) (etre.Entity, error)
-	CreateEntitiesFunc    func(context.Context, entity.WriteOp, []etre.Entity) ([]string, error)
-	UpdateEntitiesFunc    func(context.Context, entity.WriteOp, query.Query, etre.Entity) ([]etre.Entity, error)
-	DeleteEntitiesFunc    func(context.Context, entity.WriteOp, query.Query) ([]etre.Entity, error)
-	DeleteLabelFunc       func(context.Context, entity.WriteOp, string) (etre.Entity, error)
-	StreamEntitiesFunc    func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult
+	ReadEntityFunc         func(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error)
+	ReadByIdsFunc          func(ctx context.Context, entityType string, entityIds []string, f etre.QueryFilter) ([]etre.Entity, error)
+	DeleteEntityLabelFunc  func(context.Context, entity.WriteOp, string) (etre.Entity, error)
+	CreateEntitiesFunc     func(context.Context, entity.WriteOp, []etre.Entity) ([]string, error)
+	CreateIfNotExistsFunc  func(context.Context, entity.WriteOp, query.Query, etre.Entity) (etre.Entity, bool, error)
+	UpdateEntitiesFunc     func(context.Context, entity.WriteOp, query.Query, etre.Entity) ([]etre.Entity, error)
+	DeleteEntitiesFunc     func(context.Context, entity.WriteOp, query.Query) ([]etre.Entity, error)
+	DeleteAllFunc          func(context.Context, entity.WriteOp) ([]etre.Entity, error)
+	RestoreEntitiesFunc    func(context.Context, entity.WriteOp, query.Query) ([]etre.Entity, error)
+	DeleteLabelFunc        func(context.Context, entity.WriteOp, string) (etre.Entity, error)
+	DeleteLabelByQueryFunc func(context.Context, entity.WriteOp, query.Query, string) ([]etre.Entity, error)
+	RenameLabelFunc        func(ctx context.Context, wo entity.WriteOp, q query.Query, label, newLabel string, overwrite bool) ([]etre.Entity, error)
+	StreamEntitiesFunc     func(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult
+	GroupEntitiesFunc      func(ctx context.Context, entityType string, q query.Query, groupBy string, f etre.QueryFilter) (map[string][]etre.Entity, error)
+	CountGroupsFunc        func(ctx context.Context, entityType string, q query.Query, groupBy string) ([]etre.GroupCount, error)
 }
 
 func (s EntityStore) DeleteEntityLabel(ctx context.Context, wo entity.WriteOp, label string) (etre.Entity, error) {
@@ -34,6 +42,13 @@ func (s EntityStore) CreateEntities(ctx context.Context, wo entity.WriteOp, enti
 	return nil, nil
 }
 
+func (s EntityStore) CreateEntityIfNotExists(ctx context.Context, wo entity.WriteOp, q query.Query, e etre.Entity) (etre.Entity, bool, error) {
+	if s.CreateIfNotExistsFunc != nil {
+		return s.CreateIfNotExistsFunc(ctx, wo, q, e)
+	}
+	return e, true, nil
+}
+
 func (s EntityStore) ReadEntity(ctx context.Context, entityType string, entityId string, f etre.QueryFilter) (etre.Entity, error) {
 	if s.ReadEntityFunc != nil {
 		return s.ReadEntityFunc(ctx, entityType, entityId, f)
@@ -41,6 +56,13 @@ func (s EntityStore) ReadEntity(ctx context.Context, entityType string, entityId
 	return nil, nil
 }
 
+func (s EntityStore) ReadEntitiesByIds(ctx context.Context, entityType string, entityIds []string, f etre.QueryFilter) ([]etre.Entity, error) {
+	if s.ReadByIdsFunc != nil {
+		return s.ReadByIdsFunc(ctx, entityType, entityIds, f)
+	}
+	return make([]etre.Entity, len(entityIds)), nil
+}
+
 func (s EntityStore) UpdateEntities(ctx context.Context, wo entity.WriteOp, q query.Query, u etre.Entity) ([]etre.Entity, error) {
 	if s.UpdateEntitiesFunc != nil {
 		return s.UpdateEntitiesFunc(ctx, wo, q, u)
@@ -55,6 +77,20 @@ func (s EntityStore) DeleteEntities(ctx context.Context, wo entity.WriteOp, q qu
 	return nil, nil
 }
 
+func (s EntityStore) DeleteAll(ctx context.Context, wo entity.WriteOp) ([]etre.Entity, error) {
+	if s.DeleteAllFunc != nil {
+		return s.DeleteAllFunc(ctx, wo)
+	}
+	return nil, nil
+}
+
+func (s EntityStore) RestoreEntities(ctx context.Context, wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+	if s.RestoreEntitiesFunc != nil {
+		return s.RestoreEntitiesFunc(ctx, wo, q)
+	}
+	return nil, nil
+}
+
 func (s EntityStore) DeleteLabel(ctx context.Context, wo entity.WriteOp, label string) (etre.Entity, error) {
 	if s.DeleteLabelFunc != nil {
 		return s.DeleteLabelFunc(ctx, wo, label)
@@ -62,6 +98,20 @@ func (s EntityStore) DeleteLabel(ctx context.Context, wo entity.WriteOp, label s
 	return etre.Entity{}, nil
 }
 
+func (s EntityStore) DeleteLabelByQuery(ctx context.Context, wo entity.WriteOp, q query.Query, label string) ([]etre.Entity, error) {
+	if s.DeleteLabelByQueryFunc != nil {
+		return s.DeleteLabelByQueryFunc(ctx, wo, q, label)
+	}
+	return nil, nil
+}
+
+func (s EntityStore) RenameLabel(ctx context.Context, wo entity.WriteOp, q query.Query, label, newLabel string, overwrite bool) ([]etre.Entity, error) {
+	if s.RenameLabelFunc != nil {
+		return s.RenameLabelFunc(ctx, wo, q, label, newLabel, overwrite)
+	}
+	return nil, nil
+}
+
 func (s EntityStore) StreamEntities(ctx context.Context, entityType string, q query.Query, f etre.QueryFilter) <-chan entity.EntityResult {
 	if s.StreamEntitiesFunc != nil {
 		return s.StreamEntitiesFunc(ctx, entityType, q, f)
@@ -69,6 +119,20 @@ func (s EntityStore) StreamEntities(ctx context.Context, entityType string, q qu
 	return DoStreamEntities(nil, nil)
 }
 
+func (s EntityStore) GroupEntities(ctx context.Context, entityType string, q query.Query, groupBy string, f etre.QueryFilter) (map[string][]etre.Entity, error) {
+	if s.GroupEntitiesFunc != nil {
+		return s.GroupEntitiesFunc(ctx, entityType, q, groupBy, f)
+	}
+	return map[string][]etre.Entity{}, nil
+}
+
+func (s EntityStore) CountGroups(ctx context.Context, entityType string, q query.Query, groupBy string) ([]etre.GroupCount, error) {
+	if s.CountGroupsFunc != nil {
+		return s.CountGroupsFunc(ctx, entityType, q, groupBy)
+	}
+	return []etre.GroupCount{}, nil
+}
+
 func DoStreamEntities(entities []etre.Entity, err error) <-chan entity.EntityResult {
 	ch := make(chan entity.EntityResult)
 	go func() {
@@ -3,6 +3,8 @@
 package mock
 
 import (
+	"sync"
+
 	"github.com/square/etre"
 	"github.com/square/etre/metrics"
 )
@@ -46,9 +48,13 @@ type MetricMethodArgs struct {
 
 var _ metrics.Metrics = &MetricRecorder{}
 
-// MetricRecorder records the called methods and values.
+// MetricRecorder records the called methods and values. It's safe for concurrent
+// use because some metrics are recorded by other goroutines, like CDC lag by the
+// change stream client. Read Called after those goroutines are done, or use Calls
+// to wait for them.
 type MetricRecorder struct {
 	Called []MetricMethodArgs
+	mux    sync.Mutex
 }
 
 func NewMetricsRecorder() *MetricRecorder {
@@ -58,10 +64,21 @@ func NewMetricsRecorder() *MetricRecorder {
 }
 
 func (m *MetricRecorder) Reset() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 	m.Called = []MetricMethodArgs{}
 }
 
+// Calls returns a copy of Called.
+func (m *MetricRecorder) Calls() []MetricMethodArgs {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]MetricMethodArgs{}, m.Called...)
+}
+
 func (m *MetricRecorder) EntityType(et string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 	m.Called = append(m.Called, MetricMethodArgs{
 		Method:    "EntityType",
 		StringVal: et,
@@ -69,6 +86,8 @@ func (m *MetricRecorder) EntityType(et string) {
 }
 
 func (m *MetricRecorder) Inc(mn byte, n int64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 	m.Called = append(m.Called, MetricMethodArgs{
 		Method: "Inc",
 		Metric: mn,
@@ -77,6 +96,8 @@ func (m *MetricRecorder) Inc(mn byte, n int64) {
 }
 
 func (m *MetricRecorder) IncLabel(mn byte, label string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 	m.Called = append(m.Called, MetricMethodArgs{
 		Method:    "IncLabel",
 		Metric:    mn,
@@ -85,6 +106,8 @@ func (m *MetricRecorder) IncLabel(mn byte, label string) {
 }
 
 func (m *MetricRecorder) Val(mn byte, n int64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 	m.Called = append(m.Called, MetricMethodArgs{
 		Method: "Val",
 		Metric: mn,
@@ -146,9 +169,11 @@ func (m metricsMultiplexer) Report(reset bool) etre.Metrics {
 // --------------------------------------------------------------------------
 
 type MetricsStore struct {
-	AddFunc   func(m metrics.Metrics, name string) error
-	GetFunc   func(name string) metrics.Metrics
-	NamesFunc func() []string
+	AddFunc              func(m metrics.Metrics, name string) error
+	GetFunc              func(name string) metrics.Metrics
+	NamesFunc            func() []string
+	SnapshotFunc         func() etre.Metrics
+	SnapshotAndResetFunc func() etre.Metrics
 }
 
 var _ metrics.Store = MetricsStore{}
@@ -173,3 +198,17 @@ func (s MetricsStore) Names() []string {
 	}
 	return []string{"etre"} // auth.DEFAULT_METRIC_GROUP
 }
+
+func (s MetricsStore) Snapshot() etre.Metrics {
+	if s.SnapshotFunc != nil {
+		return s.SnapshotFunc()
+	}
+	return etre.Metrics{}
+}
+
+func (s MetricsStore) SnapshotAndReset() etre.Metrics {
+	if s.SnapshotAndResetFunc != nil {
+		return s.SnapshotAndResetFunc()
+	}
+	return etre.Metrics{}
+}